@@ -12,17 +12,99 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// nel-collector runs a NEL collector on port 8080, printing out a summary of
-// each report that it receives.
+// nel-collector runs a NEL collector on port 8080 (or the address given by the
+// --listen flag), printing out a summary of each report that it receives.  You
+// can also scrape Prometheus metrics (including exemplars, if you ask for the
+// OpenMetrics format) from /metrics.  Those include HTTP-level metrics about
+// each upload
+// (see metrics.UploadMetrics), the number of times that a processor has
+// panicked (see collector.Pipeline.Panics), and, if the configuration sets
+// `record_processor_counts`, the number of reports going into and out of each
+// processor (see metrics.ProcessorMetrics), and the number of reports that each
+// publisher couldn't send (see metrics.PublisherMetrics).
+//
+// Use the --config flag to load the pipeline's settings and processors from a
+// TOML file instead of using the default configuration.  Along with the
+// processors in package core, the configuration can use any of the publishers
+// in package publish, except that this binary doesn't link in any
+// database/sql drivers, so SQLPublisher needs a custom build that imports
+// one.  If --config names a directory, every `*.toml` file in it is loaded
+// (see collector.NewPipelineFromConfigDir).  If the configuration's `pipeline`
+// section sets `wal_dir`, each upload is saved to a write-ahead log there
+// before it's processed, and anything that wasn't processed when the collector
+// last stopped is replayed at startup (see collector.WAL).
+//
+// To avoid opening a TCP port at all, such as when a local proxy forwards
+// requests to the collector, use --socket to listen on a Unix domain socket
+// instead; --socket-mode sets the socket's permissions (see
+// collector.ListenUnix).  Set `trust_unix_socket` in the `pipeline` section
+// to take each upload's client address from the proxy's X-Forwarded-For
+// header.
+//
+// The server's timeouts come from the `pipeline` section of the configuration
+// (see collector.PipelineConfig.ReadTimeout), but the --read-timeout,
+// --read-header-timeout, --write-timeout, and --idle-timeout flags override
+// them.
+//
+// A collector that should only accept reports forwarded by other collectors
+// (see publish.WebhookPublisher's `signing_secret`) can use
+// --signature-secret-file to reject uploads that weren't signed with the
+// secret in that file (see collector.VerifySignature); --signature-header and
+// --signature-algorithm must match the senders' settings.  Signatures are
+// timestamped, and --signature-max-skew sets how old (or how far in the
+// future) they can be, which also bounds how far apart the collectors' clocks
+// can drift.  The senders should use `format = "reports"`, so that the
+// reports are forwarded in a form that the collector accepts.
+//
+// During an incident, you can have the collector keep telling clients that
+// their uploads succeeded, so that they don't retry them, while discarding
+// their reports unprocessed (see collector.Pipeline.SetAcceptAndDrop).  To
+// allow that, use --admin-listen to serve an admin endpoint at
+// /accept-and-drop on a separate, private address; POST `enabled=true` or
+// `enabled=false` to it to switch the mode (see
+// collector.AcceptAndDropHandler).  Discarded reports are counted in the
+// nel_absorbed_reports_total metric.  The admin address also serves the
+// `admin_path` of any SampleReports processor, where you can GET its sampling
+// rate or PATCH a new `rate` (see core.SampleRateHandler).
+//
+// Since they expose the reports themselves, and the collector's
+// configuration, the debug endpoints are only served on the admin address
+// too.  You can watch reports as they arrive by connecting to /debug/tail,
+// fetch the most recent ones from /debug/recent (see core.RecentReports for
+// its `limit` and `since` parameters), see which processors are running at
+// /debug/config (both of which are gzipped for clients that accept it), and
+// check which URLs have had the most errors recently at /debug/top, if the
+// configuration has a TopN processor (see core.TopN for its `n` parameter).
+//
+// `nel-collector replay --config x.toml --dir payloads/` runs the pipeline
+// against recorded upload payloads instead of listening for new ones, printing
+// each processed batch as JSON.  Use --client-ip and --url to set the client
+// address and collector URL that the payloads are attributed to.  Without
+// --config, replay only keeps the NEL reports, rather than using the default
+// configuration, whose CLF dump to stdout would be mixed in with the JSON.
 package main
 
 import (
+	"bytes"
 	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/google/nel-collector/pkg/collector"
-	_ "github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/metrics"
+	_ "github.com/google/nel-collector/pkg/publish"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var defaultConfig = []byte(`
@@ -32,8 +114,81 @@ type = "KeepNelReports"
 [[processor]]
 type = "DumpReportsAsCLF"
 dest = "stdout"
+
+[[processor]]
+type = "LiveTail"
+
+[[processor]]
+type = "RecentReports"
+
+[[processor]]
+type = "ReportMetrics"
 `)
 
+var configPath = flag.String("config", "", "path to a TOML configuration file, or a directory of them")
+var listenAddr = flag.String("listen", ":8080", "address to listen for HTTP requests on")
+var socketPath = flag.String("socket", "", "path of a Unix domain socket to listen on instead of --listen")
+var socketMode = flag.String("socket-mode", "0660", "permissions of the --socket file, in octal")
+var readTimeout = flag.Duration("read-timeout", 0, "longest time to read a whole request, overriding the configuration")
+var readHeaderTimeout = flag.Duration("read-header-timeout", 0, "longest time to read a request's headers, overriding the configuration")
+var writeTimeout = flag.Duration("write-timeout", 0, "longest time to write a response, overriding the configuration")
+var idleTimeout = flag.Duration("idle-timeout", 0, "longest time to keep an idle connection open, overriding the configuration")
+var signatureSecretFile = flag.String("signature-secret-file", "", "path to a file containing the secret that uploads must be signed with")
+var signatureHeader = flag.String("signature-header", collector.DefaultSignatureHeader, "request header containing each upload's signature")
+var signatureAlgorithm = flag.String("signature-algorithm", "sha256", "hash function that upload signatures use (sha256 or sha512)")
+var signatureMaxSkew = flag.Duration("signature-max-skew", collector.DefaultSignatureMaxSkew, "how far an upload signature's timestamp can be from the current time")
+var adminAddr = flag.String("admin-listen", "", "address to serve admin endpoints on, which should not be publicly reachable")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "longest time to wait for in-flight requests when shutting down")
+
+// defaultSignedUploadBytes is the largest signed upload that we accept, if the
+// configuration doesn't set max_upload_bytes, since we have to read the whole
+// body into memory to check its signature.
+const defaultSignedUploadBytes = 1 << 20
+
+// overrideTimeout replaces *timeout with the value of a flag, if it was set.
+func overrideTimeout(timeout *time.Duration, flagValue time.Duration) {
+	if flagValue > 0 {
+		*timeout = flagValue
+	}
+}
+
+// listen opens the listener that the server accepts connections from: the
+// Unix domain socket from --socket if there is one, or else the TCP address
+// from --listen.
+func listen() (net.Listener, error) {
+	if *socketPath == "" {
+		return net.Listen("tcp", *listenAddr)
+	}
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --socket-mode: %v", err)
+	}
+	return collector.ListenUnix(*socketPath, os.FileMode(mode))
+}
+
+// verifyUploads wraps the upload handler so that it rejects uploads that
+// aren't signed with the secret from --signature-secret-file, if there is one.
+func verifyUploads(pipeline *collector.Pipeline, uploads http.Handler) (http.Handler, error) {
+	if *signatureSecretFile == "" {
+		return uploads, nil
+	}
+	secret, err := ioutil.ReadFile(*signatureSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := collector.NewPayloadSigner(bytes.TrimSpace(secret), *signatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	signer.Header = *signatureHeader
+	signer.MaxSkew = *signatureMaxSkew
+	maxBytes := pipeline.MaxUploadBytes()
+	if maxBytes == 0 {
+		maxBytes = defaultSignedUploadBytes
+	}
+	return collector.VerifySignature(uploads, signer, maxBytes), nil
+}
+
 var rootBody = []byte(`
 <html>
   <head>
@@ -55,12 +210,123 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	pipeline := &collector.Pipeline{}
-	err := pipeline.LoadFromConfig(context.Background(), defaultConfig)
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	flag.Parse()
+
+	var pipeline *collector.Pipeline
+	if info, err := os.Stat(*configPath); err == nil && info.IsDir() {
+		pipeline, err = collector.NewPipelineFromConfigDir(context.Background(), *configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		config := defaultConfig
+		if *configPath != "" {
+			config, err = ioutil.ReadFile(*configPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		pipeline, err = collector.NewPipelineFromConfig(context.Background(), config)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleRoot)
+	uploads, err := metrics.NewUploadMetrics(pipeline, prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verified, err := verifyUploads(pipeline, uploads)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux.Handle("/upload/", verified)
+	panics := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "nel_processor_panics_total",
+			Help: "Number of times that a processor panicked while processing a batch.",
+		},
+		func() float64 { return float64(pipeline.Panics()) })
+	if err := prometheus.Register(panics); err != nil {
+		log.Fatal(err)
+	}
+	absorbed := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "nel_absorbed_reports_total",
+			Help: "Number of reports that were discarded unprocessed while accept-and-drop mode was on.",
+		},
+		func() float64 { return float64(pipeline.Absorbed()) })
+	if err := prometheus.Register(absorbed); err != nil {
+		log.Fatal(err)
+	}
+	empty := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "nel_empty_uploads_total",
+			Help: "Number of uploads that didn't contain any reports.",
+		},
+		func() float64 { return float64(pipeline.EmptyUploads()) })
+	if err := prometheus.Register(empty); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := metrics.NewProcessorMetrics(pipeline, prometheus.DefaultRegisterer); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := metrics.NewLoadMetrics(pipeline, prometheus.DefaultRegisterer); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := metrics.NewPublisherMetrics(pipeline, prometheus.DefaultRegisterer); err != nil {
+		log.Fatal(err)
+	}
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+
+	// On shutdown, start rejecting new uploads right away, so that a load
+	// balancer stops sending them to us, wait (for up to --shutdown-timeout)
+	// for the requests that are in flight, and finish processing the uploads
+	// that are already queued before exiting.
+	server := pipeline.NewServer(*listenAddr, mux)
+	overrideTimeout(&server.ReadTimeout, *readTimeout)
+	overrideTimeout(&server.ReadHeaderTimeout, *readHeaderTimeout)
+	overrideTimeout(&server.WriteTimeout, *writeTimeout)
+	overrideTimeout(&server.IdleTimeout, *idleTimeout)
+	listener, err := listen()
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.HandleFunc("/", handleRoot)
-	http.Handle("/upload/", pipeline)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if *adminAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/accept-and-drop", collector.AcceptAndDropHandler(pipeline))
+		admin.Handle("/", core.SampleRateHandler())
+		admin.Handle("/debug/tail", core.NamedLiveTail("default"))
+		admin.Handle("/debug/recent", collector.GzipHandler(core.NamedRecentReports("default")))
+		admin.Handle("/debug/top", core.NamedTopN("default"))
+		admin.Handle("/debug/config", collector.GzipHandler(collector.DescribeHandler(pipeline)))
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, admin))
+		}()
+	}
+	// Serve returns as soon as Shutdown starts, so we wait for it to finish
+	// before closing the pipeline.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		pipeline.Drain()
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	pipeline.Close()
 }
@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// defaultReplayConfig is the configuration that replay uses without --config.
+// It doesn't have defaultConfig's processors for the live server, most
+// importantly the CLF dump to stdout, which would be mixed in with the JSON
+// that replay prints there.
+var defaultReplayConfig = []byte(`
+[[processor]]
+type = "KeepNelReports"
+`)
+
+// replay runs the `replay` subcommand, which sends recorded upload payloads
+// through the pipeline instead of listening for new ones.  Each file in --dir
+// is parsed with collector.NewReportBatch, just like the body of a real upload
+// from --client-ip, and then run through every processor synchronously.  The
+// processed batch is printed to stdout in the wire format (see
+// collector.MarshalBatch), one line per file.  Files that can't be parsed are
+// reported on stderr, and make the command exit with an error once every file
+// has been replayed.  Without --config, the only processor is KeepNelReports.
+func replay(args []string) {
+	if err := runReplay(args, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runReplay does the work of replay, printing the processed batches to
+// stdout.
+func runReplay(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to a TOML configuration file, or a directory of them")
+	dir := flags.String("dir", "", "directory of recorded payloads to replay")
+	clientIP := flags.String("client-ip", "127.0.0.1", "client IP address that the payloads are attributed to")
+	collectorURL := flags.String("url", "https://localhost/upload/", "collector URL that the payloads are attributed to")
+	flags.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("replay needs --dir")
+	}
+
+	pipeline := collector.NewSynchronousPipeline(nil)
+	defer pipeline.Close()
+	var err error
+	if info, statErr := os.Stat(*configPath); statErr == nil && info.IsDir() {
+		err = pipeline.LoadFromConfigDir(context.Background(), *configPath)
+	} else {
+		config := defaultReplayConfig
+		if *configPath != "" {
+			config, err = ioutil.ReadFile(*configPath)
+			if err != nil {
+				return err
+			}
+		}
+		err = pipeline.LoadFromConfig(context.Background(), config)
+	}
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(*dir)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, file := range files {
+		if !file.IsDir() {
+			paths = append(paths, filepath.Join(*dir, file.Name()))
+		}
+	}
+	sort.Strings(paths)
+
+	failed := 0
+	encoder := json.NewEncoder(stdout)
+	for _, path := range paths {
+		batch, err := replayFile(path, *clientIP, *collectorURL, pipeline.Clock())
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+			failed++
+			continue
+		}
+		pipeline.ProcessBatch(context.Background(), batch)
+		if err := encoder.Encode(collector.NewWireBatch(batch)); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d payloads couldn't be parsed", failed, len(paths))
+	}
+	return nil
+}
+
+// replayFile parses a recorded payload, as if it had been uploaded from
+// clientIP to collectorURL.
+func replayFile(path, clientIP, collectorURL string, clock collector.Clock) (*collector.ReportBatch, error) {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", collectorURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --url: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/reports+json")
+	r.RemoteAddr = net.JoinHostPort(clientIP, "0")
+	return collector.NewReportBatch(r, clock)
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// replayDir creates a directory of payloads to replay: two real ones from the
+// pipelinetest testdata, and one that can't be parsed.
+func replayDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "TestReplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"non-nel-report.json", "valid-nel-report.json"} {
+		payload, err := ioutil.ReadFile(filepath.Join("../../pkg/pipelinetest/testdata/reports", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), payload, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "garbage.json"), []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// replayOutput decodes the batches that replay printed, failing if anything
+// else was mixed in with them.
+func replayOutput(t *testing.T, stdout *bytes.Buffer) []collector.WireBatch {
+	var batches []collector.WireBatch
+	for _, line := range strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n") {
+		var batch collector.WireBatch
+		if err := json.Unmarshal([]byte(line), &batch); err != nil {
+			t.Fatalf("replay printed %q, which isn't a batch: %v", line, err)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func TestReplay(t *testing.T) {
+	dir := replayDir(t)
+	defer os.RemoveAll(dir)
+
+	var stdout bytes.Buffer
+	err := runReplay([]string{"--dir", dir, "--client-ip", "192.0.2.1"}, &stdout)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 payloads") {
+		t.Errorf("replay should report the payload that it couldn't parse, got %v", err)
+	}
+	batches := replayOutput(t, &stdout)
+	if len(batches) != 2 {
+		t.Fatalf("replay printed %d batches, wanted 2", len(batches))
+	}
+	for _, batch := range batches {
+		if batch.ClientIP != "192.0.2.1" {
+			t.Errorf("Replayed batch has ClientIP %q, wanted 192.0.2.1", batch.ClientIP)
+		}
+	}
+	// The default configuration only keeps NEL reports.
+	if got, want := len(batches[0].Reports), 0; got != want {
+		t.Errorf("Replayed non-NEL payload kept %d reports, wanted %d", got, want)
+	}
+	if got, want := len(batches[1].Reports), 1; got != want {
+		t.Errorf("Replayed NEL payload kept %d reports, wanted %d", got, want)
+	}
+}
+
+func TestReplayConfig(t *testing.T) {
+	dir := replayDir(t)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	if err := os.Mkdir(config, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(config, "annotate.toml"), []byte("[[processor]]\ntype = \"ClassifyReportType\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	runReplay([]string{"--dir", dir, "--config", config}, &stdout)
+	batches := replayOutput(t, &stdout)
+	if len(batches) != 2 {
+		t.Fatalf("replay printed %d batches, wanted 2", len(batches))
+	}
+	if got, want := len(batches[0].Reports), 1; got != want {
+		t.Fatalf("Replayed non-NEL payload kept %d reports, wanted %d", got, want)
+	}
+	if got := batches[0].Reports[0].Annotations["ReportSchema"]; got == nil {
+		t.Errorf("Replayed report wasn't classified by the --config processors")
+	}
+
+	if err := runReplay([]string{"--dir", dir, "--config", filepath.Join(dir, "missing.toml")}, &stdout); err == nil {
+		t.Errorf("replay should fail with a missing --config")
+	}
+	if err := runReplay(nil, &stdout); err == nil {
+		t.Errorf("replay should fail without --dir")
+	}
+}
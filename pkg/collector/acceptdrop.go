@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+type acceptAndDropHandler struct {
+	p *Pipeline
+}
+
+// AcceptAndDropHandler returns an http.Handler that lets an operator turn a
+// pipeline's accept-and-drop mode (see Pipeline.SetAcceptAndDrop) on and off
+// at runtime.  A POST request with an `enabled` form value of "true" or
+// "false" changes the mode; any other method just reports it.  Either way,
+// the response is a JSON object containing the current mode (`enabled`) and
+// the number of reports that have been discarded so far (`absorbed`).
+//
+// The handler doesn't do any authentication of its own, so it should only be
+// served on an address that isn't reachable by the public.
+func AcceptAndDropHandler(p *Pipeline) http.Handler {
+	return acceptAndDropHandler{p}
+}
+
+func (h acceptAndDropHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid `enabled` value", http.StatusBadRequest)
+			return
+		}
+		h.p.SetAcceptAndDrop(enabled)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Enabled  bool  `json:"enabled"`
+		Absorbed int64 `json:"absorbed"`
+	}{h.p.AcceptAndDrop(), h.p.Absorbed()})
+}
@@ -18,6 +18,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"reflect"
+	"strings"
+	"sync"
 )
 
 // Annotations lets you attach an arbitrary collection of extra data to each
@@ -25,13 +28,62 @@ import (
 // an arbitrary type; it's up to you to make sure that your processors don't
 // make conflicting assumptions about the type of an annotation with a
 // particular name.
+//
+// By convention, annotations whose names start with InternalAnnotationPrefix
+// (two underscores, such as `__halt`) are internal: they're only meant for
+// other processors in the pipeline, such as intermediate scores or control
+// flags, and shouldn't appear in published output.  Put a ProjectAnnotations
+// processor (see package core) in front of your publishers to strip them, or
+// to keep only an allow-list of annotations; see AnnotationProjection.
+//
+// The methods of Annotations are safe to call from multiple goroutines at
+// once, so processors that fan a batch out to other goroutines don't need to
+// coordinate their annotations.  The map and the lock that guards it are
+// created together, by the first annotation that's added (or by
+// CloneAnnotations), so that has to happen before the Annotations are shared
+// with other goroutines.  (The locking doesn't extend to the annotation values
+// themselves, or to reading or writing the Annotations map directly, which
+// you should only do while no other goroutine can be using it.)
 type Annotations struct {
 	Annotations map[string]interface{}
+
+	// mu guards Annotations.  Annotations are embedded by value in reports and
+	// batches, which are copied freely, so we can't embed a lock by value; a
+	// copy shares its original's lock, just as it shares its map.
+	mu *sync.RWMutex
+}
+
+// rlock locks the annotations for reading, and returns the function that
+// unlocks them.  Annotations without a lock haven't been written to by any of
+// our methods, so nothing can be writing to them concurrently.
+func (a *Annotations) rlock() func() {
+	mu := a.mu
+	if mu == nil {
+		return func() {}
+	}
+	mu.RLock()
+	return mu.RUnlock
+}
+
+// lock locks the annotations for writing, and returns the function that
+// unlocks them.  If they don't have a lock yet, this is the first write, which
+// can't be concurrent with anything else (see Annotations), so we create the
+// lock and the map now.
+func (a *Annotations) lock() func() {
+	if a.mu == nil {
+		a.mu = new(sync.RWMutex)
+		if a.Annotations == nil {
+			a.Annotations = make(map[string]interface{})
+		}
+	}
+	a.mu.Lock()
+	return a.mu.Unlock
 }
 
 // GetAnnotation returns the annotation with the given name, or nil if there
 // isn't one.
 func (a *Annotations) GetAnnotation(name string) interface{} {
+	defer a.rlock()()
 	return a.Annotations[name]
 }
 
@@ -39,25 +91,135 @@ func (a *Annotations) GetAnnotation(name string) interface{} {
 // If it doesn't, then we save `defaultValue` as the new value for this
 // annotation, and return it.
 func (a *Annotations) GetOrAddAnnotation(name string, defaultValue interface{}) interface{} {
+	defer a.lock()()
 	result, present := a.Annotations[name]
 	if present {
 		return result
 	}
-	a.SetAnnotation(name, defaultValue)
+	a.setAnnotation(name, defaultValue)
 	return defaultValue
 }
 
 // SetAnnotation adds an annotation, overwriting any existing annotation with
 // the same name.
 func (a *Annotations) SetAnnotation(name string, value interface{}) {
+	defer a.lock()()
+	a.setAnnotation(name, value)
+}
+
+// empty returns whether no annotations have ever been added, in which case
+// there's nothing to remove, and no need to create the map and its lock.
+func (a *Annotations) empty() bool {
+	return a.mu == nil && a.Annotations == nil
+}
+
+// setAnnotation is SetAnnotation for callers that already hold the lock.
+func (a *Annotations) setAnnotation(name string, value interface{}) {
 	if a.Annotations == nil {
 		a.Annotations = make(map[string]interface{})
 	}
 	a.Annotations[name] = value
 }
 
+// DeleteAnnotation removes the annotation with the given name, if there is
+// one.
+func (a *Annotations) DeleteAnnotation(name string) {
+	if a.empty() {
+		return
+	}
+	defer a.lock()()
+	delete(a.Annotations, name)
+}
+
+// Equal returns whether two sets of annotations have the same names and
+// values, which also lets go-cmp compare reports and batches.
+func (a Annotations) Equal(b Annotations) bool {
+	if len(a.Annotations) != len(b.Annotations) {
+		return false
+	}
+	return len(a.Annotations) == 0 || reflect.DeepEqual(a.Annotations, b.Annotations)
+}
+
+// CloneAnnotations returns a copy of a set of annotations.  The copy has its
+// own map, so you can add, remove, or replace annotations in one without
+// affecting the other.  (The annotation values themselves are not copied,
+// though, so you shouldn't modify them in place if they're shared.)
+func (a *Annotations) CloneAnnotations() Annotations {
+	defer a.rlock()()
+	if a.Annotations == nil {
+		return Annotations{}
+	}
+	result := Annotations{
+		Annotations: make(map[string]interface{}, len(a.Annotations)),
+		mu:          new(sync.RWMutex),
+	}
+	for name, value := range a.Annotations {
+		result.Annotations[name] = value
+	}
+	return result
+}
+
+// FilterAnnotations removes every annotation whose name keep returns false
+// for.
+func (a *Annotations) FilterAnnotations(keep func(name string) bool) {
+	if a.empty() {
+		return
+	}
+	defer a.lock()()
+	for name := range a.Annotations {
+		if !keep(name) {
+			delete(a.Annotations, name)
+		}
+	}
+}
+
+// InternalAnnotationPrefix starts the names of internal annotations, which
+// shouldn't be published; see Annotations.
+const InternalAnnotationPrefix = "__"
+
+// AnnotationProjection chooses which of a batch's annotations, and its
+// reports' annotations, should be published.  The zero value keeps
+// everything.
+type AnnotationProjection struct {
+	// If not empty, only annotations with these names are kept.
+	Allow []string
+
+	// Annotations whose names start with any of these prefixes are removed,
+	// even if they're in Allow.
+	StripPrefixes []string
+}
+
+// Keep returns whether an annotation with the given name should be kept.
+func (p AnnotationProjection) Keep(name string) bool {
+	for _, prefix := range p.StripPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range p.Allow {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply removes the annotations that shouldn't be kept from a batch and each
+// of its reports.  If other processors still need them, Apply it to a copy
+// of the batch; see ReportBatch.Clone.
+func (p AnnotationProjection) Apply(batch *ReportBatch) {
+	batch.FilterAnnotations(p.Keep)
+	for i := range batch.Reports {
+		batch.Reports[i].FilterAnnotations(p.Keep)
+	}
+}
+
 // AnnotationWriter returns an io.Writer that can be used to build up the
-// content of a []byte annotation.
+// content of a []byte annotation.  Each Write appends to the annotation
+// atomically, so writers for the same annotation can be used concurrently.
 func (a *Annotations) AnnotationWriter(name string) io.Writer {
 	return &annotationWriter{a, name}
 }
@@ -69,11 +231,13 @@ type annotationWriter struct {
 
 // Write appends the contents of p to the current value of the annotation.
 func (w *annotationWriter) Write(p []byte) (int, error) {
+	defer w.a.lock()()
+
 	// If there's already a value for the annotation, ensure that it's a []byte,
 	// raising an error if it's some other type.  If there is no value, start with
 	// a nil slice.
 	var b []byte
-	value := w.a.GetAnnotation(w.name)
+	value := w.a.Annotations[w.name]
 	if value != nil {
 		var ok bool
 		b, ok = value.([]byte)
@@ -85,6 +249,6 @@ func (w *annotationWriter) Write(p []byte) (int, error) {
 	// Delegate to bytes.Buffer to do all of the heavy lifting.
 	buf := bytes.NewBuffer(b)
 	result, err := buf.Write(p)
-	w.a.SetAnnotation(w.name, buf.Bytes())
+	w.a.setAnnotation(w.name, buf.Bytes())
 	return result, err
 }
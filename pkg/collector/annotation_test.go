@@ -15,6 +15,9 @@
 package collector_test
 
 import (
+	"fmt"
+	"sort"
+	"sync"
 	"testing"
 
 	"github.com/google/nel-collector/pkg/collector"
@@ -67,3 +70,81 @@ func TestAnnotationWriter(t *testing.T) {
 		t.Errorf("GetAnnotation(%#v) = %#v, wanted %#v", "test", value, "hello world")
 	}
 }
+
+// TestConcurrentAnnotations is most useful when run with the race detector.
+func TestConcurrentAnnotations(t *testing.T) {
+	batch := &collector.ReportBatch{Reports: make([]collector.NelReport, 1)}
+	// The first annotation creates the map and its lock, so it has to be
+	// added before the batch is shared.
+	batch.SetAnnotation("Shared", -1)
+	batch.Reports[0].SetAnnotation("Setup", true)
+	batch.Reports[0].DeleteAnnotation("Setup")
+	const goroutines, writes = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			writer := batch.AnnotationWriter("Log")
+			for j := 0; j < writes; j++ {
+				name := fmt.Sprintf("Annotation%d", i)
+				batch.SetAnnotation(name, j)
+				batch.GetAnnotation(name)
+				batch.GetOrAddAnnotation("Shared", i)
+				batch.Reports[0].SetAnnotation(name, j)
+				batch.Reports[0].CloneAnnotations()
+				batch.Reports[0].DeleteAnnotation(name)
+				writer.Write([]byte("x"))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got, want := len(batch.GetAnnotation("Log").([]byte)), goroutines*writes; got != want {
+		t.Errorf("Concurrent AnnotationWriters wrote %d bytes, wanted %d", got, want)
+	}
+	for i := 0; i < goroutines; i++ {
+		name := fmt.Sprintf("Annotation%d", i)
+		if got, want := batch.GetAnnotation(name), writes-1; got != want {
+			t.Errorf("GetAnnotation(%s) = %v, wanted %v", name, got, want)
+		}
+	}
+	if got := len(batch.Reports[0].Annotations.Annotations); got != 0 {
+		t.Errorf("Report has %d annotations left, wanted 0", got)
+	}
+}
+
+func TestAnnotationProjection(t *testing.T) {
+	newBatch := func() *collector.ReportBatch {
+		batch := &collector.ReportBatch{Reports: make([]collector.NelReport, 1)}
+		for _, name := range []string{"ClientIP", "Region", "__halt", "__score"} {
+			batch.SetAnnotation(name, true)
+			batch.Reports[0].SetAnnotation(name, true)
+		}
+		return batch
+	}
+	cases := []struct {
+		name       string
+		projection collector.AnnotationProjection
+		want       []string
+	}{
+		{"KeepEverything", collector.AnnotationProjection{}, []string{"ClientIP", "Region", "__halt", "__score"}},
+		{"StripInternal", collector.AnnotationProjection{StripPrefixes: []string{collector.InternalAnnotationPrefix}}, []string{"ClientIP", "Region"}},
+		{"Allow", collector.AnnotationProjection{Allow: []string{"Region", "__score"}}, []string{"Region", "__score"}},
+		{"AllowAndStrip", collector.AnnotationProjection{Allow: []string{"Region", "__score"}, StripPrefixes: []string{"__"}}, []string{"Region"}},
+	}
+	for _, c := range cases {
+		batch := newBatch()
+		c.projection.Apply(batch)
+		for _, annotations := range []*collector.Annotations{&batch.Annotations, &batch.Reports[0].Annotations} {
+			var got []string
+			for name := range annotations.Annotations {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(c.want) {
+				t.Errorf("AnnotationProjection(%s) kept %v, wanted %v", c.name, got, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"unicode/utf8"
+)
+
+// CBORMediaType is the media type of uploads that CBORParser parses.
+const CBORMediaType = "application/reports+cbor"
+
+// DefaultMaxCBORBytes is the largest payload that a CBORParser accepts, if you
+// don't choose a different limit.
+const DefaultMaxCBORBytes = 1 << 20
+
+// CBORParser is a PayloadParser for uploads whose reports are encoded in CBOR
+// (RFC 7049) rather than JSON, for constrained clients that want to save
+// bytes.  The payload must have the same structure as the standard format
+// defined by the Reporting spec: an array of reports, each of which is a map
+// with text string keys.  We convert it to JSON and hand it to Reports to
+// parse, so the resulting reports are exactly what the equivalent JSON upload
+// would produce, and the same limits on the number of reports apply.  This
+// isn't part of the Reporting spec, so a Pipeline only uses it if you ask; see
+// PipelineConfig.AcceptCBOR.
+type CBORParser struct {
+	// The largest payload that we accept, in bytes.  Larger payloads are
+	// rejected with a PayloadTooLargeError.  If 0, we use
+	// DefaultMaxCBORBytes.
+	MaxBytes int64
+
+	// The parser for the converted payload.  If nil, we use
+	// DefaultPayloadParser.
+	Reports PayloadParser
+}
+
+// Parse converts a CBOR upload to JSON, and parses it.
+func (p CBORParser) Parse(r *http.Request, clock Clock) (*ReportBatch, error) {
+	maxBytes := p.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxCBORBytes
+	}
+	// Read one byte more than the limit, so that we can tell whether the
+	// payload is too large.
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) > maxBytes {
+		return nil, PayloadTooLargeError{maxBytes}
+	}
+	value, err := decodeCBOR(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CBOR payload: %v", err)
+	}
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CBOR payload: %v", err)
+	}
+
+	reports := p.Reports
+	if reports == nil {
+		reports = DefaultPayloadParser
+	}
+	inner := *r
+	inner.Body = ioutil.NopCloser(bytes.NewReader(converted))
+	inner.ContentLength = int64(len(converted))
+	return reports.Parse(&inner, clock)
+}
+
+// maxCBORDepth is how deeply arrays and maps can be nested in a CBOR payload.
+// Reports only need a few levels, and this keeps a malicious payload from
+// exhausting the stack.
+const maxCBORDepth = 32
+
+// CBOR major types.
+const (
+	cborUnsigned = iota
+	cborNegative
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// cborBreak is the additional information that ends an indefinite-length item.
+const cborBreak = 31
+
+// errCBORBreak is returned by cborDecoder.value when it finds the end of an
+// indefinite-length item.
+var errCBORBreak = fmt.Errorf("unexpected break")
+
+// decodeCBOR decodes a single CBOR data item into the same kinds of values
+// that encoding/json would decode the equivalent JSON into, except that
+// integers stay integers.  Byte strings become []byte (which encoding/json
+// marshals as base64), tags are ignored, and undefined becomes nil.  Values
+// that JSON can't represent, such as maps with non-string keys or NaN, are
+// errors.
+func decodeCBOR(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	value, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%d unexpected bytes after the payload", len(d.data)-d.pos)
+	}
+	return value, nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	result := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return result, nil
+}
+
+// header reads the initial byte of a data item, along with its argument.
+// indefinite is set for items whose length isn't known in advance.
+func (d *cborDecoder) header() (major byte, info byte, arg uint64, indefinite bool, err error) {
+	initial, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	major, info = initial[0]>>5, initial[0]&0x1f
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		raw, err := d.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		for _, b := range raw {
+			arg = arg<<8 | uint64(b)
+		}
+	case info == cborBreak:
+		indefinite = true
+	default:
+		return 0, 0, 0, false, fmt.Errorf("reserved additional information %d", info)
+	}
+	return major, info, arg, indefinite, nil
+}
+
+// length checks that a string or container with n elements could fit in the
+// rest of the payload, so that a bogus length can't make us allocate a huge
+// amount of memory.
+func (d *cborDecoder) length(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("nested more than %d levels deep", maxCBORDepth)
+	}
+	major, info, arg, indefinite, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	if indefinite {
+		switch major {
+		case cborBytes, cborText, cborArray, cborMap:
+		case cborSimple:
+			return nil, errCBORBreak
+		default:
+			return nil, fmt.Errorf("major type %d can't have an indefinite length", major)
+		}
+	}
+
+	switch major {
+	case cborUnsigned:
+		if arg > math.MaxInt64 {
+			return arg, nil
+		}
+		return int64(arg), nil
+	case cborNegative:
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("negative integer out of range")
+		}
+		return -1 - int64(arg), nil
+	case cborBytes, cborText:
+		s, err := d.str(major, arg, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborBytes {
+			return s, nil
+		}
+		if !utf8.Valid(s) {
+			return nil, fmt.Errorf("text string isn't valid UTF-8")
+		}
+		return string(s), nil
+	case cborArray:
+		return d.array(arg, indefinite, depth)
+	case cborMap:
+		return d.object(arg, indefinite, depth)
+	case cborTag:
+		return d.value(depth + 1)
+	default:
+		return d.simple(info, arg)
+	}
+}
+
+// str reads the contents of a byte or text string.  An indefinite-length
+// string is a series of definite-length chunks of the same major type.
+func (d *cborDecoder) str(major byte, arg uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		return d.next(arg)
+	}
+	var result []byte
+	for {
+		chunkMajor, chunkInfo, chunkArg, chunkIndefinite, err := d.header()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor == cborSimple && chunkInfo == cborBreak {
+			return result, nil
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, fmt.Errorf("invalid chunk in indefinite-length string")
+		}
+		chunk, err := d.next(chunkArg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, chunk...)
+	}
+}
+
+func (d *cborDecoder) array(arg uint64, indefinite bool, depth int) (interface{}, error) {
+	var result []interface{}
+	if !indefinite {
+		n, err := d.length(arg)
+		if err != nil {
+			return nil, err
+		}
+		result = make([]interface{}, 0, n)
+	} else {
+		result = []interface{}{}
+	}
+	for i := uint64(0); indefinite || i < arg; i++ {
+		item, err := d.value(depth + 1)
+		if err == errCBORBreak && indefinite {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+func (d *cborDecoder) object(arg uint64, indefinite bool, depth int) (interface{}, error) {
+	if !indefinite {
+		if _, err := d.length(arg); err != nil {
+			return nil, err
+		}
+	}
+	result := make(map[string]interface{})
+	for i := uint64(0); indefinite || i < arg; i++ {
+		key, err := d.value(depth + 1)
+		if err == errCBORBreak && indefinite {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys must be text strings, not %T", key)
+		}
+		value, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// simple decodes the simple values and floating-point numbers of major type 7.
+func (d *cborDecoder) simple(info byte, arg uint64) (interface{}, error) {
+	var f float64
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		f = halfToFloat(uint16(arg))
+	case 26:
+		f = float64(math.Float32frombits(uint32(arg)))
+	case 27:
+		f = math.Float64frombits(arg)
+	default:
+		return nil, fmt.Errorf("unsupported simple value %d", arg)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("%v can't be converted to JSON", f)
+	}
+	return f, nil
+}
+
+// halfToFloat converts an IEEE 754 half-precision number to a float64.
+func halfToFloat(half uint16) float64 {
+	exponent := int(half>>10) & 0x1f
+	mantissa := float64(half & 0x3ff)
+	var f float64
+	switch exponent {
+	case 0:
+		f = math.Ldexp(mantissa, -24)
+	case 31:
+		if mantissa == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if half&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func parseCBOR(parser collector.CBORParser, payload []byte) (*collector.ReportBatch, error) {
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+	request.Header.Set("Content-Type", collector.CBORMediaType)
+	return parser.Parse(request, pipelinetest.NewSimulatedClock())
+}
+
+// normalizeBodies replaces the RawBody of each report with its decoded value,
+// since the JSON that a CBOR payload is converted to isn't formatted the same
+// way as the original.
+func normalizeBodies(t *testing.T, batch *collector.ReportBatch) []interface{} {
+	var bodies []interface{}
+	for i := range batch.Reports {
+		var body interface{}
+		if batch.Reports[i].RawBody != nil {
+			if err := json.Unmarshal(batch.Reports[i].RawBody, &body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bodies = append(bodies, body)
+		batch.Reports[i].RawBody = nil
+	}
+	return bodies
+}
+
+// TestCBORUploads checks that each CBOR fixture, which encodes the same
+// reports as the JSON payload with the same name, is parsed into the same
+// reports.
+func TestCBORUploads(t *testing.T) {
+	names, err := pipelinetest.GetPayloadNames("../pipelinetest/testdata/reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			payload := testdata(filepath.Join("testdata", "TestCBORUploads", name+".cbor"))
+			got, err := parseCBOR(collector.CBORParser{}, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := httptest.NewRequest("POST", "https://example.com/upload/",
+				bytes.NewReader(testdata(filepath.Join("../pipelinetest/testdata/reports", name+".json"))))
+			want, err := collector.NewReportBatch(request, pipelinetest.NewSimulatedClock())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(normalizeBodies(t, want), normalizeBodies(t, got)); diff != "" {
+				t.Errorf("CBORParser got report bodies with diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(want.Reports, got.Reports); diff != "" {
+				t.Errorf("CBORParser got reports with diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCBORPayloads(t *testing.T) {
+	payload := func(s string) []byte {
+		b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// An indefinite-length array of an indefinite-length map, with a chunked
+	// string, a tagged string, and a half-precision float.
+	batch, err := parseCBOR(collector.CBORParser{}, payload(`
+		9f bf
+		  63 616765  19 01f4
+		  64 74797065  7f 67 6e6574776f726b 66 2d6572726f72 ff
+		  63 75726c  c0 74 68747470733a2f2f6578616d706c652e636f6d2f
+		  64 626f6479  a2
+		    64 74797065  62 6f6b
+		    71 73616d706c696e675f6672616374696f6e  f9 3800
+		ff ff
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []collector.NelReport{{
+		Age:              500,
+		ReportType:       "network-error",
+		URL:              "https://example.com/",
+		SamplingFraction: 0.5,
+		Type:             "ok",
+	}}
+	if diff := cmp.Diff(want, batch.Reports); diff != "" {
+		t.Errorf("CBORParser got diff (-want +got):\n%s", diff)
+	}
+
+	for _, c := range []struct {
+		name, payload string
+	}{
+		{"Empty", ``},
+		{"Truncated", `82 a0`},
+		{"TrailingBytes", `80 00`},
+		{"NotAnArray", `a0`},
+		{"IntegerKey", `81 a1 01 02`},
+		{"NaN", `81 a1 63616765 f9 7e00`},
+		{"InvalidUTF8", `81 a1 63616765 61 ff`},
+		{"UnexpectedBreak", `81 ff`},
+		{"HugeLength", `9b 7fffffffffffffff`},
+		{"TooDeep", strings.Repeat("81", 100) + "80"},
+	} {
+		if _, err := parseCBOR(collector.CBORParser{}, payload(c.payload)); err == nil {
+			t.Errorf("CBORParser(%s) should return error", c.name)
+		}
+	}
+}
+
+func TestCBORUploadLimits(t *testing.T) {
+	payload := testdata(filepath.Join("testdata", "TestCBORUploads", "multiple-valid-nel-reports.cbor"))
+	cases := []struct {
+		name   string
+		config collector.PipelineConfig
+		want   int
+	}{
+		{"Disabled", collector.PipelineConfig{}, http.StatusUnsupportedMediaType},
+		{"Enabled", collector.PipelineConfig{AcceptCBOR: true}, http.StatusNoContent},
+		{"TooLarge", collector.PipelineConfig{AcceptCBOR: true, MaxCBORBytes: 16}, http.StatusRequestEntityTooLarge},
+		{"TooManyReports", collector.PipelineConfig{AcceptCBOR: true, MaxReportsPerBatch: 1}, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), c.config)
+			processed := make(channelProcessor, 1)
+			pipeline.AddProcessor(processed)
+
+			request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+			request.Header.Set("Content-Type", collector.CBORMediaType)
+			var response httptest.ResponseRecorder
+			pipeline.ServeHTTP(&response, request)
+			pipeline.Close()
+			if response.Code != c.want {
+				t.Fatalf("ServeHTTP(%s): got %d, wanted %d", c.name, response.Code, c.want)
+			}
+			if c.want != http.StatusNoContent {
+				return
+			}
+
+			batch := <-processed
+			if got, want := len(batch.Reports), 2; got != want {
+				t.Errorf("ServeHTTP(%s) got %d reports, wanted %d", c.name, got, want)
+			}
+		})
+	}
+}
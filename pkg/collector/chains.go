@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// AnyReportType is the report type of a ReportTypeChain that handles every
+// report type that doesn't have a chain of its own.
+const AnyReportType = "*"
+
+// A ReportTypeChain is a chain of processors that handles the reports of one
+// type.
+type ReportTypeChain struct {
+	ReportType string
+	Processors []ReportProcessor
+}
+
+// ReportTypeChains is a processor that splits each batch up by report type,
+// and sends the reports of each type through their own chain of processors,
+// so that each type only passes through the processors that are relevant to
+// it.  Reports whose type doesn't have a chain are sent to the AnyReportType
+// chain, if there is one, and are otherwise dropped.
+//
+// Each chain receives its own copy of the batch (see ReportBatch.Clone),
+// containing just the reports of its type, and the original batch is never
+// modified.  Chains are run one after another, in the order they were
+// configured; a chain that doesn't receive any reports isn't run at all.
+//
+// LoadFromConfig creates one of these from the `chain` sections of a
+// configuration file, such as:
+//
+//	[[chain]]
+//	report_type = "network-error"
+//
+//	[[chain.processor]]
+//	type = "ReportMetrics"
+//
+//	[[chain]]
+//	report_type = "*"
+//
+//	[[chain.processor]]
+//	type = "DumpReportsAsJSON"
+type ReportTypeChains struct {
+	Chains []ReportTypeChain
+}
+
+// ProcessReports sends each report in the batch through the chain for its
+// report type.
+func (c *ReportTypeChains) ProcessReports(ctx context.Context, batch *ReportBatch) {
+	chains := make(map[string]int, len(c.Chains))
+	for i, chain := range c.Chains {
+		chains[chain.ReportType] = i
+	}
+	fallback, hasFallback := chains[AnyReportType]
+
+	// routed[i] holds the indexes of the reports for the ith chain.
+	routed := make([][]int, len(c.Chains))
+	for i := range batch.Reports {
+		idx, ok := chains[batch.Reports[i].ReportType]
+		if !ok || batch.Reports[i].ReportType == AnyReportType {
+			if !hasFallback {
+				continue
+			}
+			idx = fallback
+		}
+		routed[idx] = append(routed[idx], i)
+	}
+
+	for i, indexes := range routed {
+		if len(indexes) == 0 {
+			continue
+		}
+		clone := batch.Clone()
+		reports := make([]NelReport, len(indexes))
+		for j, idx := range indexes {
+			reports[j] = clone.Reports[idx]
+		}
+		clone.Reports = reports
+		for _, processor := range c.Chains[i].Processors {
+			processor.ProcessReports(ctx, clone)
+		}
+	}
+}
+
+// Close closes any processors in the chains that need to be closed.
+func (c *ReportTypeChains) Close() error {
+	var result error
+	for _, chain := range c.Chains {
+		if err := CloseProcessors(chain.Processors); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// chainConfig is the configuration of one `chain` section.
+type chainConfig struct {
+	ReportType string           `toml:"report_type"`
+	Processors []toml.Primitive `toml:"processor"`
+}
+
+// loadChains creates a ReportTypeChains processor from the `chain` sections of
+// a configuration file, along with a description of it (see
+// Pipeline.Describe).
+func loadChains(ctx context.Context, configs []chainConfig) (*ReportTypeChains, ProcessorInfo, error) {
+	result := &ReportTypeChains{}
+	var described []interface{}
+	seen := make(map[string]bool)
+	for idx, config := range configs {
+		if config.ReportType == "" {
+			result.Close()
+			return nil, ProcessorInfo{}, fmt.Errorf("Chain %d is missing `report_type`", idx)
+		}
+		if seen[config.ReportType] {
+			result.Close()
+			return nil, ProcessorInfo{}, fmt.Errorf("Chain %d has duplicate `report_type` %q", idx, config.ReportType)
+		}
+		seen[config.ReportType] = true
+		if len(config.Processors) == 0 {
+			result.Close()
+			return nil, ProcessorInfo{}, fmt.Errorf("Chain %d (%s) is missing `processor`", idx, config.ReportType)
+		}
+		processors, infos, _, err := loadProcessors(ctx, config.Processors, true)
+		if err != nil {
+			result.Close()
+			return nil, ProcessorInfo{}, fmt.Errorf("Chain %d (%s): %v", idx, config.ReportType, err)
+		}
+		result.Chains = append(result.Chains, ReportTypeChain{ReportType: config.ReportType, Processors: processors})
+
+		var describedProcessors []interface{}
+		for _, info := range infos {
+			fields := map[string]interface{}{"type": info.Type}
+			for key, value := range info.Config {
+				fields[key] = value
+			}
+			describedProcessors = append(describedProcessors, fields)
+		}
+		described = append(described, map[string]interface{}{
+			"report_type": config.ReportType,
+			"processor":   describedProcessors,
+		})
+	}
+	return result, ProcessorInfo{Type: "ReportTypeChains", Config: map[string]interface{}{"chain": described}}, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// recordTypes is a processor that records the report types that it sees in
+// recordedTypes, under its name.
+type recordTypes struct {
+	Name string `toml:"name"`
+}
+
+var (
+	recordedMu    sync.Mutex
+	recordedTypes map[string][]string
+)
+
+func (r recordTypes) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	recordedMu.Lock()
+	defer recordedMu.Unlock()
+	for _, report := range batch.Reports {
+		recordedTypes[r.Name] = append(recordedTypes[r.Name], report.ReportType)
+	}
+	// Make sure that chains can't see each other's changes.
+	batch.Reports = nil
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc("RecordTypes", func(ctx context.Context, config toml.Primitive) (collector.ReportProcessor, error) {
+		var r recordTypes
+		err := collector.DecodeConfig(ctx, config, &r)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+}
+
+func TestReportTypeChains(t *testing.T) {
+	cases := []struct {
+		name, config string
+		want         map[string][]string
+	}{
+		{"Default", `
+			[[processor]]
+			type = "HasSettings"
+
+			[[chain]]
+			report_type = "network-error"
+			[[chain.processor]]
+			type = "RecordTypes"
+			name = "nel"
+			[[chain.processor]]
+			type = "RecordTypes"
+			name = "nel-again"
+
+			[[chain]]
+			report_type = "*"
+			[[chain.processor]]
+			type = "RecordTypes"
+			name = "other"
+		`, map[string][]string{
+			"nel":   {"network-error", "network-error"},
+			"other": {"csp-violation", "deprecation"},
+		}},
+		{"NoDefault", `
+			[[chain]]
+			report_type = "deprecation"
+			[[chain.processor]]
+			type = "RecordTypes"
+			name = "deprecation"
+
+			[[chain]]
+			report_type = "intervention"
+			[[chain.processor]]
+			type = "RecordTypes"
+			name = "intervention"
+		`, map[string][]string{
+			"deprecation": {"deprecation"},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recordedTypes = make(map[string][]string)
+			pipeline := collector.NewSynchronousPipeline(pipelinetest.NewSimulatedClock())
+			defer pipeline.Close()
+			if err := pipeline.LoadFromConfig(context.Background(), []byte("strict = true\n"+c.config)); err != nil {
+				t.Fatal(err)
+			}
+			batch := &collector.ReportBatch{Reports: []collector.NelReport{
+				{ReportType: "network-error"},
+				{ReportType: "csp-violation"},
+				{ReportType: "network-error"},
+				{ReportType: "deprecation"},
+			}}
+			pipeline.ProcessBatch(context.Background(), batch)
+			if diff := cmp.Diff(c.want, recordedTypes); diff != "" {
+				t.Errorf("ReportTypeChains got diff (-want +got):\n%s", diff)
+			}
+			if got, want := len(batch.Reports), 4; got != want {
+				t.Errorf("ReportTypeChains left %d reports in the original batch, wanted %d", got, want)
+			}
+		})
+	}
+}
+
+func TestReportTypeChainsDescribe(t *testing.T) {
+	var pipeline collector.Pipeline
+	config := `
+		[[chain]]
+		report_type = "network-error"
+		[[chain.processor]]
+		type = "HasSettings"
+		size = 5
+		api_key = "hunter2"
+	`
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	want := []collector.ProcessorInfo{{
+		Type: "ReportTypeChains",
+		Config: map[string]interface{}{"chain": []interface{}{
+			map[string]interface{}{
+				"report_type": "network-error",
+				"processor": []interface{}{
+					map[string]interface{}{"type": "HasSettings", "size": int64(5), "api_key": "REDACTED"},
+				},
+			},
+		}},
+	}}
+	if diff := cmp.Diff(want, pipeline.Describe()); diff != "" {
+		t.Errorf("Describe() got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReportTypeChainsBadConfig(t *testing.T) {
+	for _, c := range []struct {
+		config, wantError string
+	}{
+		{`chain = [{processor = [{type = "HasSettings"}]}]`,
+			"Chain 0 is missing `report_type`"},
+		{`chain = [{report_type = "network-error"}]`,
+			"Chain 0 (network-error) is missing `processor`"},
+		{`chain = [{report_type = "*", processor = [{type = "HasSettings"}]}, {report_type = "*", processor = [{type = "HasSettings"}]}]`,
+			"Chain 1 has duplicate `report_type` \"*\""},
+		{`chain = [{report_type = "*", processor = [{type = "UnknownType"}]}]`,
+			"Chain 0 (*): Unknown processor type UnknownType for processor 0"},
+		{"strict = true\nchain = [{report_type = \"*\", processor = [{type = \"HasSettings\", sise = 5}]}]",
+			"Chain 0 (*): Processor 0 (HasSettings) has unknown field `sise`"},
+	} {
+		var pipeline collector.Pipeline
+		err := pipeline.LoadFromConfig(context.Background(), []byte(c.config))
+		if err == nil || !strings.Contains(err.Error(), c.wantError) {
+			t.Errorf("LoadFromConfig(%s) got error %v, wanted %q", c.config, err, c.wantError)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"time"
+)
+
+// appendCoalescedBatch adds the reports from batch to combined.  A combined
+// batch can contain reports uploaded by several different clients, so any
+// per-batch information that processors might need is copied onto each report
+// as an annotation: ClientIP, ClientUserAgent, ClientReferrer, and Host, TLS
+// (if the upload used TLS), along with all of the batch's own annotations.
+// (Annotations that the report already has are not overwritten.)  The
+// batch's Header is not copied, since annotations are published and headers
+// can contain credentials, so processors that look at request headers (such
+// as ReportMetrics' trace IDs) don't see them in a combined batch.
+func appendCoalescedBatch(combined, batch *ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		report.GetOrAddAnnotation("ClientIP", batch.ClientIP)
+		report.GetOrAddAnnotation("ClientUserAgent", batch.ClientUserAgent)
+		report.GetOrAddAnnotation("ClientReferrer", batch.ClientReferrer)
+		report.GetOrAddAnnotation("Host", batch.Host)
+		if batch.TLS != nil {
+			report.GetOrAddAnnotation("TLS", *batch.TLS)
+		}
+		for name, value := range batch.Annotations.Annotations {
+			report.GetOrAddAnnotation(name, value)
+		}
+		combined.Reports = append(combined.Reports, *report)
+	}
+}
+
+// coalesce reads uploaded batches from in, and merges them together into
+// larger batches that are written to out.  A combined batch is written once it
+// contains at least maxReports reports, or maxDelay after the first of its
+// uploads was received, whichever comes first.  The combined batch's Time and
+// CollectorURL are taken from the first upload; its other per-upload fields
+// are left empty, since they can differ from one report to the next.
+//
+// When in is closed, any pending reports are written, and then out is closed.
+func coalesce(in <-chan *ReportBatch, out chan<- *ReportBatch, maxReports int, maxDelay time.Duration) {
+	defer close(out)
+
+	var pending *ReportBatch
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+			timeout = nil
+		}
+		if pending != nil {
+			out <- pending
+			pending = nil
+		}
+	}
+
+	for {
+		select {
+		case batch, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			if pending == nil {
+				pending = &ReportBatch{
+					Time:         batch.Time,
+					CollectorURL: batch.CollectorURL,
+				}
+				timer = time.NewTimer(maxDelay)
+				timeout = timer.C
+			}
+			appendCoalescedBatch(pending, batch)
+			if len(pending.Reports) >= maxReports {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
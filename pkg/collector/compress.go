@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GzipHandler returns an http.Handler that gzips the responses of another
+// handler, for clients that accept it.  It's meant for the debug endpoints,
+// such as DescribeHandler, whose JSON responses can get large; there's no
+// point wrapping a Pipeline, whose responses don't have a body.
+//
+// We compress a response if the request's Accept-Encoding header accepts gzip
+// (explicitly or with `*`) with a nonzero q-value, unless the header also
+// lists identity with a higher one.  So `identity`, `gzip;q=0`, and `identity,
+// gzip;q=0.5` all get an uncompressed response, but `deflate, gzip;q=0.8` gets
+// a gzipped one.  Responses that already have a Content-Encoding, and those
+// that can't have a body, are never compressed.  Flushing the response also
+// flushes the compressor, so streaming handlers still stream.
+func GzipHandler(handler http.Handler) http.Handler {
+	return gzipHandler{handler}
+}
+
+type gzipHandler struct {
+	handler http.Handler
+}
+
+func (h gzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	gw := &gzipResponseWriter{ResponseWriter: w}
+	defer gw.close()
+	h.handler.ServeHTTP(gw, r)
+}
+
+// acceptsGzip returns whether an Accept-Encoding header prefers a gzipped
+// response to an uncompressed one.
+func acceptsGzip(header string) bool {
+	if header == "" {
+		return false
+	}
+	gzipQ, identityQ := -1.0, -1.0
+	anyQ := -1.0
+	for _, item := range strings.Split(header, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.ToLower(param[:2]) == "q=" {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		switch coding {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "identity":
+			identityQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if identityQ < 0 {
+		// Identity is always acceptable, but unless the client lists it (or
+		// `*`), it's only a last resort.
+		identityQ = anyQ
+	}
+	return gzipQ > 0 && gzipQ >= identityQ
+}
+
+// gzipResponseWriter compresses everything that's written to it, once it's
+// decided that the response should be compressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader decides whether to compress the response, based on its status
+// and headers.
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if header.Get("Content-Encoding") == "" && bodyAllowed(status) {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// bodyAllowed returns whether a response with the given status can have a
+// body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush sends everything that's been written so far to the client.
+func (w *gzipResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close writes the end of the compressed stream, if there is one.
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
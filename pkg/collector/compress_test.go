@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+func TestGzipHandler(t *testing.T) {
+	body := strings.Repeat(`{"type": "KeepNelReports"}`, 100)
+	handler := collector.GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(body))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}
+	}))
+
+	for _, c := range []struct {
+		path, acceptEncoding string
+		gzipped              bool
+	}{
+		{"/", "", false},
+		{"/", "gzip", true},
+		{"/", "deflate, gzip;q=0.8", true},
+		{"/", "x-gzip", true},
+		{"/", "*", true},
+		{"/", "GZIP", true},
+		{"/", "identity", false},
+		{"/", "gzip;q=0", false},
+		{"/", "*;q=0", false},
+		{"/", "identity, gzip;q=0.5", false},
+		{"/", "identity;q=0, gzip", true},
+		{"/", "gzip;q=bogus", false},
+		{"/empty", "gzip", false},
+		{"/encoded", "gzip", false},
+	} {
+		request := httptest.NewRequest("GET", "https://example.com"+c.path, nil)
+		if c.acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if got := response.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("GzipHandler(%s, %q) got Vary %q, wanted Accept-Encoding", c.path, c.acceptEncoding, got)
+		}
+		gzipped := response.Header().Get("Content-Encoding") == "gzip"
+		if gzipped != c.gzipped {
+			t.Errorf("GzipHandler(%s, %q) gzipped = %v, wanted %v", c.path, c.acceptEncoding, gzipped, c.gzipped)
+			continue
+		}
+		if c.path != "/" {
+			continue
+		}
+		got := response.Body.String()
+		if gzipped {
+			reader, err := gzip.NewReader(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = string(decompressed)
+		}
+		if got != body {
+			t.Errorf("GzipHandler(%s, %q) got body %q, wanted %q", c.path, c.acceptEncoding, got, body)
+		}
+	}
+}
+
+func TestGzipHandlerFlushes(t *testing.T) {
+	flushed := make(chan bool)
+	handler := collector.GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte("second\n"))
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first line arrives before the handler has finished.
+	first := make([]byte, len("first\n"))
+	if _, err := reader.Read(first); err != nil || string(first) != "first\n" {
+		t.Fatalf("GzipHandler got %q (%v), wanted first line", first, err)
+	}
+	close(flushed)
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil || string(rest) != "second\n" {
+		t.Errorf("GzipHandler got %q (%v), wanted second line", rest, err)
+	}
+}
@@ -17,6 +17,14 @@ package collector
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -37,25 +45,250 @@ import (
 //
 // The `type` field of each element identifies which kind of processor to add;
 // any additional fields let you specify any processor-specific configuration.
+// A processor with `enabled = false` is skipped entirely, which lets you turn
+// it off without deleting its configuration.
+//
+// The configuration can also have sections named `chain`, each of which has a
+// `report_type` and its own list of `processor` sections, so that each type of
+// report only passes through the processors that are relevant to it.  Every
+// batch is split up by report type, after it has passed through all of the
+// top-level processors; see ReportTypeChains.
+//
+// Any `${VAR}` in a string value is replaced by the value of the VAR
+// environment variable, so that secrets (such as passwords in DSNs) can be
+// kept out of the configuration file.  `${VAR:-default}` uses `default` if VAR
+// is unset or empty, and `$$` stands for a literal `$`.  It's an error to refer
+// to an unset variable without a default.  Describe shows each processor's
+// configuration before these references are replaced.
+//
+// Processors that load their configuration using DecodeConfig are checked for
+// fields that they don't recognize, which are usually typos.  Normally we just
+// log a warning about them; if the configuration contains a top-level
+// `strict = true` setting, they are treated as errors instead.
+//
+// Normally, if any processor can't be created, the whole configuration fails
+// to load.  With a top-level `continue_on_error = true` setting, a processor
+// whose loader returns an error is logged and left out instead, so that the
+// collector can still run without it (for instance, while a database file
+// that the processor needs is missing).  Skipped lists the processors that
+// were left out.  This only applies to the `processor` sections themselves; a
+// processor whose nested children can't be created is skipped as a whole.
+// Errors in the structure of the configuration, such as an unknown processor
+// type, still fail the load.
+//
+// If ctx comes from ReuseProcessors, processors whose configurations haven't
+// changed are taken over from the pipeline that this one replaces, rather
+// than being created again.
 func (p *Pipeline) LoadFromConfig(ctx context.Context, configBytes []byte) error {
 
-	var config struct {
-		Processors []toml.Primitive `toml:"processor"`
-	}
+	var config processorsConfig
 	err := toml.Unmarshal(configBytes, &config)
 	if err != nil {
 		return fmt.Errorf("Invalid NEL configuration")
 	}
 
-	if config.Processors == nil {
+	if config.Processors == nil && config.Chains == nil {
 		return fmt.Errorf("NEL configuration missing `processors`")
 	}
 
-	if len(config.Processors) == 0 {
+	if len(config.Processors) == 0 && len(config.Chains) == 0 {
 		return fmt.Errorf("NEL configuration `processors` array must be non-empty")
 	}
 
-	for idx, processorPrimitive := range config.Processors {
+	reuse := newProcessorReuse(ctx)
+	ctx = context.WithValue(ctx, reuseProcessorsKey{}, reuse)
+	processors, infos, sources, skipped, err := p.loadProcessorsConfig(ctx, config)
+	if err != nil {
+		return err
+	}
+	reuse.commit(sources)
+	p.processors = append(p.processors, processors...)
+	p.infos = append(p.infos, infos...)
+	p.sources = append(p.sources, sources...)
+	p.skipped = append(p.skipped, skipped...)
+
+	return nil
+}
+
+// SkippedProcessor describes a processor that was left out of a pipeline
+// because it couldn't be created; see the `continue_on_error` setting of
+// LoadFromConfig.
+type SkippedProcessor struct {
+	// The index of the processor's section, within the configuration file or
+	// chain that it's in.
+	Index int
+	// The name that the processor's type was registered under.
+	Type string
+	// The error that its loader returned.
+	Err error
+}
+
+// Skipped returns the processors that were left out of the pipeline because
+// they couldn't be created.
+func (p *Pipeline) Skipped() []SkippedProcessor {
+	result := make([]SkippedProcessor, len(p.skipped))
+	copy(result, p.skipped)
+	return result
+}
+
+// processorsConfig is the part of a configuration file that LoadFromConfig
+// uses.
+type processorsConfig struct {
+	Strict          bool             `toml:"strict"`
+	ContinueOnError bool             `toml:"continue_on_error"`
+	Processors      []toml.Primitive `toml:"processor"`
+	Chains          []chainConfig    `toml:"chain"`
+}
+
+// loadProcessorsConfig creates the processors in a configuration file, along
+// with their descriptions and sources, and also returns any that were skipped
+// because of `continue_on_error`.  Any `chain` sections become a single
+// ReportTypeChains processor at the end.
+func (p *Pipeline) loadProcessorsConfig(ctx context.Context, config processorsConfig) ([]ReportProcessor, []ProcessorInfo, []processorSource, []SkippedProcessor, error) {
+	if config.Strict {
+		ctx = context.WithValue(ctx, strictConfigKey{}, true)
+	}
+	var skipped []SkippedProcessor
+	if config.ContinueOnError {
+		ctx = context.WithValue(ctx, skippedProcessorsKey{}, &skipped)
+	}
+	ctx = context.WithValue(ctx, clockKey{}, p.Clock())
+	processors, infos, sources, err := loadProcessors(ctx, config.Processors, true)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if len(config.Chains) == 0 {
+		return processors, infos, sources, skipped, nil
+	}
+	// Only top-level processors are reused, since the ones in chains belong to
+	// the ReportTypeChains processor that runs them.
+	ctx = context.WithValue(ctx, reuseProcessorsKey{}, (*processorReuse)(nil))
+	chains, info, err := loadChains(ctx, config.Chains)
+	if err != nil {
+		closeLoaded(processors, sources)
+		return nil, nil, nil, nil, err
+	}
+	return append(processors, chains), append(infos, info), append(sources, processorSource{}), skipped, nil
+}
+
+// configDirFiles returns the paths of the configuration files in a directory,
+// in lexical order.
+func configDirFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No NEL configuration files in %s", dir)
+	}
+	return paths, nil
+}
+
+// LoadFromConfigDir loads pipeline processors from every `*.toml` file in a
+// directory, and adds them to the pipeline.  This lets a configuration be
+// split into fragments that are managed separately (for instance, by
+// different teams, or as the keys of a Kubernetes ConfigMap).  Each file has
+// the same format as for LoadFromConfig; their processors are added in the
+// lexical order of their file names, so you can prefix the names with numbers
+// to control the order.  A file can have no `processor` sections at all, as
+// long as some other file does, and a `strict = true` setting only applies to
+// the file that it's in.  If any file is invalid, the error names the file,
+// and none of the processors are added.
+func (p *Pipeline) LoadFromConfigDir(ctx context.Context, dir string) error {
+	paths, err := configDirFiles(dir)
+	if err != nil {
+		return err
+	}
+	reuse := newProcessorReuse(ctx)
+	ctx = context.WithValue(ctx, reuseProcessorsKey{}, reuse)
+	var processors []ReportProcessor
+	var infos []ProcessorInfo
+	var sources []processorSource
+	var skipped []SkippedProcessor
+	for _, path := range paths {
+		var config processorsConfig
+		configBytes, err := ioutil.ReadFile(path)
+		if err == nil {
+			if toml.Unmarshal(configBytes, &config) != nil {
+				err = fmt.Errorf("Invalid NEL configuration")
+			}
+		}
+		var loaded []ReportProcessor
+		var loadedInfos []ProcessorInfo
+		var loadedSources []processorSource
+		var loadedSkipped []SkippedProcessor
+		if err == nil {
+			loaded, loadedInfos, loadedSources, loadedSkipped, err = p.loadProcessorsConfig(ctx, config)
+		}
+		if err != nil {
+			closeLoaded(processors, sources)
+			return fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		processors = append(processors, loaded...)
+		infos = append(infos, loadedInfos...)
+		sources = append(sources, loadedSources...)
+		skipped = append(skipped, loadedSkipped...)
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("NEL configuration in %s has no `processor` sections", dir)
+	}
+	reuse.commit(sources)
+	p.processors = append(p.processors, processors...)
+	p.infos = append(p.infos, infos...)
+	p.sources = append(p.sources, sources...)
+	p.skipped = append(p.skipped, skipped...)
+	return nil
+}
+
+// LoadProcessors creates a list of processors from their TOML configurations.
+// Each element of configs must be an object with a `type` field identifying the
+// kind of processor to create, just like the `processor` sections that
+// LoadFromConfig expects.  This is useful for processors that contain nested
+// chains of other processors.
+func LoadProcessors(ctx context.Context, configs []toml.Primitive) ([]ReportProcessor, error) {
+	processors, _, _, err := loadProcessors(ctx, configs, false)
+	return processors, err
+}
+
+// LoadChildProcessors creates the chain of processors in the `children` array
+// of a processor's configuration.  In TOML, the children are written as a
+// `[[processor.children]]` array of tables, each of which is loaded just like
+// a top-level `processor` section, so children can contain children of their
+// own.  It returns an empty chain if there's no `children` array.
+//
+// Processors that run a nested chain should load it with this, so that every
+// configuration nests chains the same way.  A processor with several chains
+// (such as one per route) can call it on the table of each one.
+func LoadChildProcessors(ctx context.Context, config toml.Primitive) ([]ReportProcessor, error) {
+	var children struct {
+		Children []toml.Primitive `toml:"children"`
+	}
+	if err := DecodeConfig(ctx, config, &children); err != nil {
+		return nil, err
+	}
+	return LoadProcessors(ctx, children.Children)
+}
+
+// loadProcessors creates a list of processors from their TOML configurations,
+// and also returns a description of each one (see Pipeline.Describe).  If
+// expandEnv is set, we first expand any environment variable references in
+// each configuration.  (Nested chains of processors are part of their parent's
+// configuration, so they've already been expanded by the time that their
+// parent's loader calls LoadProcessors.)
+func loadProcessors(ctx context.Context, configs []toml.Primitive, expandEnv bool) ([]ReportProcessor, []ProcessorInfo, []processorSource, error) {
+	var processors []ReportProcessor
+	var infos []ProcessorInfo
+	var sources []processorSource
+	for idx, originalPrimitive := range configs {
+		processorPrimitive := originalPrimitive
+		if expandEnv {
+			var err error
+			processorPrimitive, err = expandEnvPrimitive(originalPrimitive)
+			if err != nil {
+				closeLoaded(processors, sources)
+				return nil, nil, nil, fmt.Errorf("Processor config %d invalid %v", idx, err)
+			}
+		}
 		var processorConfig struct {
 			Type string `toml:"type"`
 		}
@@ -63,28 +296,729 @@ func (p *Pipeline) LoadFromConfig(ctx context.Context, configBytes []byte) error
 		if err != nil {
 			// The only way that PrimitiveDecode can fail is if the primitive isn't an
 			// object.  (If it's missing a `type` field that will just be set to nil.)
-			return fmt.Errorf("Processor config 0 must be an object")
+			closeLoaded(processors, sources)
+			return nil, nil, nil, fmt.Errorf("Processor config %d must be an object", idx)
 		}
 		if processorConfig.Type == "" {
-			return fmt.Errorf("Processor config %d is missing `type`", idx)
+			closeLoaded(processors, sources)
+			return nil, nil, nil, fmt.Errorf("Processor config %d is missing `type`", idx)
+		}
+
+		var enabledConfig struct {
+			Enabled *bool `toml:"enabled"`
+		}
+		if err := toml.PrimitiveDecode(processorPrimitive, &enabledConfig); err != nil {
+			closeLoaded(processors, sources)
+			return nil, nil, nil, fmt.Errorf("Processor config %d invalid `enabled`: %v", idx, err)
+		}
+		if enabledConfig.Enabled != nil && !*enabledConfig.Enabled {
+			continue
 		}
 
 		loader, ok := reportLoaders[processorConfig.Type]
 		if !ok {
-			return fmt.Errorf("Unknown processor type %s for processor %d", processorConfig.Type, idx)
+			closeLoaded(processors, sources)
+			return nil, nil, nil, fmt.Errorf("Unknown processor type %s for processor %d", processorConfig.Type, idx)
+		}
+
+		key := configKey(processorPrimitive)
+		if reuse, _ := ctx.Value(reuseProcessorsKey{}).(*processorReuse); reuse != nil {
+			if processor, info, source, ok := reuse.borrow(key); ok {
+				processors = append(processors, processor)
+				infos = append(infos, info)
+				sources = append(sources, source)
+				continue
+			}
+		}
+
+		// Nested chains of processors are always loaded fail-fast, so that a
+		// processor is either skipped as a whole or loaded completely.
+		fields := &configFields{known: map[string]bool{"type": true, "enabled": true}}
+		loaderCtx := context.WithValue(ctx, configFieldsKey{}, fields)
+		loaderCtx = context.WithValue(loaderCtx, skippedProcessorsKey{}, (*[]SkippedProcessor)(nil))
+		loaderCtx = context.WithValue(loaderCtx, reuseProcessorsKey{}, (*processorReuse)(nil))
+		processor, err := loader.Load(loaderCtx, processorPrimitive)
+		if skipped, _ := ctx.Value(skippedProcessorsKey{}).(*[]SkippedProcessor); err != nil && skipped != nil {
+			log.Printf("Skipping processor %d (%s), which couldn't be created: %v", idx, processorConfig.Type, err)
+			*skipped = append(*skipped, SkippedProcessor{Index: idx, Type: processorConfig.Type, Err: err})
+			continue
+		}
+		if err != nil {
+			closeLoaded(processors, sources)
+			return nil, nil, nil, fmt.Errorf("Couldn't create a %s for processor %d: %v", processorConfig.Type, idx, err)
+		}
+		processors = append(processors, processor)
+		infos = append(infos, newProcessorInfo(processorConfig.Type, originalPrimitive))
+		sources = append(sources, processorSource{configKey: key})
+
+		if unknown := fields.unknown(processorPrimitive); len(unknown) > 0 {
+			if strict, _ := ctx.Value(strictConfigKey{}).(bool); strict {
+				closeLoaded(processors, sources)
+				return nil, nil, nil, fmt.Errorf("Processor %d (%s) has unknown field `%s`", idx, processorConfig.Type, strings.Join(unknown, "`, `"))
+			}
+			log.Printf("Ignoring unknown field `%s` in processor %d (%s)", strings.Join(unknown, "`, `"), idx, processorConfig.Type)
+		}
+	}
+	return processors, infos, sources, nil
+}
+
+type strictConfigKey struct{}
+type skippedProcessorsKey struct{}
+type configFieldsKey struct{}
+
+// configFields keeps track of which fields a processor's loader understands,
+// so that we can warn about any other fields in its configuration.
+type configFields struct {
+	// Whether the loader used DecodeConfig; if not, we can't tell which fields
+	// it understands.
+	recorded bool
+	known    map[string]bool
+}
+
+func (c *configFields) unknown(config toml.Primitive) []string {
+	if !c.recorded {
+		return nil
+	}
+	var keys map[string]interface{}
+	if err := toml.PrimitiveDecode(config, &keys); err != nil {
+		return nil
+	}
+	var result []string
+	for key := range keys {
+		if !c.known[key] && !c.known[strings.ToLower(key)] {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// configFieldNames returns the name of each TOML field that a struct type
+// understands.  Fields without a `toml` tag are matched case-insensitively, so
+// we return their lower-cased names.
+func configFieldNames(t reflect.Type) map[string]reflect.Type {
+	result := make(map[string]reflect.Type)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return result
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			if field.Anonymous {
+				for embeddedName, embeddedType := range configFieldNames(field.Type) {
+					result[embeddedName] = embeddedType
+				}
+				continue
+			}
+			name = strings.ToLower(field.Name)
+		}
+		result[name] = field.Type
+	}
+	return result
+}
+
+// DecodeConfig decodes the configuration of a processor into a struct, just
+// like toml.PrimitiveDecode.  Loaders should use this instead of calling
+// toml.PrimitiveDecode directly: if decoding fails, the error identifies the
+// offending field, and LoadFromConfig can tell which fields in the
+// configuration weren't used, which usually indicates a typo.
+func DecodeConfig(ctx context.Context, config toml.Primitive, v interface{}) error {
+	names := configFieldNames(reflect.TypeOf(v))
+	if fields, ok := ctx.Value(configFieldsKey{}).(*configFields); ok {
+		fields.recorded = true
+		for name := range names {
+			fields.known[name] = true
+		}
+	}
+
+	err := toml.PrimitiveDecode(config, v)
+	if err == nil {
+		return nil
+	}
+
+	// Try to figure out which field caused the error, by decoding each of them
+	// separately.
+	var values map[string]toml.Primitive
+	if toml.PrimitiveDecode(config, &values) != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fieldType, ok := names[key]
+		if !ok {
+			fieldType, ok = names[strings.ToLower(key)]
+		}
+		if !ok {
+			continue
+		}
+		if fieldErr := toml.PrimitiveDecode(values[key], reflect.New(fieldType).Interface()); fieldErr != nil {
+			return fmt.Errorf("invalid `%s`: %v", key, fieldErr)
+		}
+	}
+	return err
+}
+
+// PipelineConfig contains the settings for the pipeline itself, which are read
+// from the `pipeline` section of a configuration file.  For instance:
+//
+//     [pipeline]
+//     buffer_size = 1000
+//     num_workers = 10
+//     coalesce_reports = 100
+//     coalesce_delay = "500ms"
+//
+// Any settings that are missing (or zero) get their default values.
+type PipelineConfig struct {
+	// The number of report batches that can be queued up waiting for a worker
+	// before new uploads are dropped.  Defaults to 1000.
+	BufferSize int64 `toml:"buffer_size"`
+
+	// The number of workers that process queued report batches.  Defaults to
+	// 10.
+	NumWorkers int `toml:"num_workers"`
+
+	// If nonzero, uploaded batches are merged together into larger batches of
+	// up to this many reports before being handed to the processors, so that
+	// processors with a large per-batch overhead can amortize it.  Since a
+	// combined batch can contain reports from several clients, each report
+	// gets ClientIP, ClientUserAgent, ClientReferrer, Host, and TLS
+	// annotations, along with copies of its original batch's annotations;
+	// request headers are dropped (see ReportBatch.Header).  Defaults to 0
+	// (disabled).
+	CoalesceReports int `toml:"coalesce_reports"`
+
+	// The longest that an upload will wait to be merged with others before its
+	// combined batch is processed anyway.  Only used if CoalesceReports is
+	// set.  Defaults to 1s.
+	CoalesceDelay Duration `toml:"coalesce_delay"`
+
+	// If nonzero, the maximum number of reports that we accept in a single
+	// upload.  Defaults to 0 (no limit).
+	MaxReportsPerBatch int `toml:"max_reports_per_batch"`
+
+	// What to do with uploads that contain more than MaxReportsPerBatch
+	// reports: "reject" them with a 413 status code, or "truncate" them,
+	// keeping only the first MaxReportsPerBatch reports.  (See
+	// ReportBatchParser.)  Defaults to "reject".
+	OversizedBatches string `toml:"oversized_batches"`
+
+	// What to do with uploads that are valid JSON arrays, but contain some
+	// elements that aren't valid reports: "reject" them with a 400 status
+	// code, or "skip" the malformed elements, processing the rest and
+	// recording how many we skipped.  (See ReportBatchParser.)  Defaults to
+	// "reject".
+	MalformedReports string `toml:"malformed_reports"`
+
+	// What to do with uploads that don't contain any reports, such as an empty
+	// JSON array: "process" them like any other upload, running every
+	// processor against an empty batch, or "skip" them, responding with the
+	// usual success status without queueing them at all.  Either way, they're
+	// counted; see Pipeline.EmptyUploads.  Defaults to "process", since some
+	// processors (such as ones that count uploads) want to see every upload.
+	EmptyUploads string `toml:"empty_uploads"`
+
+	// The deepest that arrays and objects can be nested in an upload's JSON;
+	// uploads that are nested more deeply are rejected with a 400 status code.
+	// (See ReportBatchParser.MaxDepth.)  Defaults to DefaultMaxJSONDepth.
+	MaxJSONDepth int `toml:"max_json_depth"`
+
+	// If nonzero, the largest upload body that we accept, in bytes; larger
+	// ones are rejected with a 413 status code.  We count the bytes as we read
+	// the body, rather than trusting its Content-Length, so this also applies
+	// to chunked uploads, which don't have one.  Defaults to 0 (no limit).
+	MaxUploadBytes int64 `toml:"max_upload_bytes"`
+
+	// If set, we also accept uploads via GET, for clients that can't send POST
+	// requests.  The payload (which must be in the standard format, as if it
+	// had a Content-Type of application/reports+json) is base64-encoded in the
+	// query parameter with this name.  The same limits apply as for POST
+	// uploads.  This isn't part of the Reporting spec, so it's disabled by
+	// default.
+	GetParameter string `toml:"get_parameter"`
+
+	// If set, we also accept multipart/form-data uploads, for clients that
+	// send their reports as a form field rather than as the body of the
+	// request.  The reports (in the standard format) are taken from the field
+	// with this name; see MultipartParser.  The same limits apply as for other
+	// uploads.  This isn't part of the Reporting spec, so it's disabled by
+	// default.
+	MultipartField string `toml:"multipart_field"`
+
+	// The largest MultipartField that we accept, in bytes; larger ones are
+	// rejected with a 413 status code.  Only used if MultipartField is set.
+	// Defaults to 1MiB.
+	MaxMultipartBytes int64 `toml:"max_multipart_bytes"`
+
+	// If set, we also accept uploads whose reports are encoded in CBOR rather
+	// than JSON, with a Content-Type of application/reports+cbor; see
+	// CBORParser.  The same limits apply as for other uploads.  This isn't
+	// part of the Reporting spec, so it's disabled by default.
+	AcceptCBOR bool `toml:"accept_cbor"`
+
+	// The largest CBOR payload that we accept, in bytes; larger ones are
+	// rejected with a 413 status code.  Only used if AcceptCBOR is set.
+	// Defaults to 1MiB.
+	MaxCBORBytes int64 `toml:"max_cbor_bytes"`
+
+	// If nonzero, the fraction of BufferSize (between 0 and 1) above which the
+	// queue counts as backed up.  While it is, new uploads are rejected with a
+	// 503 status code and a Retry-After header, rather than waiting until the
+	// queue is completely full and silently dropping them.  Defaults to 0
+	// (disabled).
+	BackpressureThreshold float64 `toml:"backpressure_threshold"`
+
+	// The Retry-After that we send when the queue is completely full.  Between
+	// BackpressureThreshold and a full queue, Retry-After grows in proportion to
+	// how backed up the queue is.  Only used if BackpressureThreshold is set.
+	// Defaults to 1m.
+	MaxRetryAfter Duration `toml:"max_retry_after"`
+
+	// The status code that we respond to successful uploads with, which must be
+	// a 2xx code.  Defaults to 204 No Content, but some clients and proxies
+	// treat that specially, and expect 200 instead.
+	SuccessStatus int `toml:"success_status"`
+
+	// If set, the body that we respond to successful uploads with, as
+	// text/plain.  Can't be used with a SuccessStatus of 204.
+	SuccessBody string `toml:"success_body"`
+
+	// If set, we give each upload a random batch ID, which we store in the
+	// batch's BatchID annotation (a string), and send back in this response
+	// header (such as "X-Report-Id").  Since reports are processed after we
+	// respond, this lets a client match an upload up with any logs or
+	// published reports for it later on.  Usually used with a SuccessStatus
+	// of 202 Accepted.
+	BatchIDHeader string `toml:"batch_id_header"`
+
+	// If nonzero, the most uploads that ServeHTTP handles at once.  Uploads
+	// that arrive while this many are in flight are rejected straight away
+	// with a 503 status code, before we read their payloads.  (See also
+	// ConcurrencyLimiter.)  Defaults to 0 (no limit).
+	MaxConcurrentUploads int `toml:"max_concurrent_uploads"`
+
+	// The success_fraction and failure_fraction of the NEL policy that clients
+	// are given when the collector isn't loaded at all.  As the collector's
+	// load grows, we recommend smaller fractions; see
+	// Pipeline.RecommendedFractions.  The collector can't change what clients
+	// do by itself, since the policy is served by the origins being monitored,
+	// but whatever generates those policies can read the recommendation from
+	// LoadHintHeader or from metrics.LoadMetrics.  These default to 0 and 1, the
+	// spec's defaults (so a FailureFraction of 0 can't be used).
+	SuccessFraction float64 `toml:"success_fraction"`
+	FailureFraction float64 `toml:"failure_fraction"`
+
+	// If set, successful uploads get a response header with this name (such as
+	// "NEL-Load-Hint") describing the collector's current load and the
+	// fractions that we recommend, such as
+	// "load=0.5, success_fraction=0.005, failure_fraction=0.75".  Defaults to
+	// "" (disabled).
+	LoadHintHeader string `toml:"load_hint_header"`
+
+	// If set, we record how long each processor takes to handle each batch,
+	// according to the pipeline's Clock, in the batch's ProcessorTimings
+	// annotation.  That's a map[string]time.Duration, whose keys are each
+	// processor's index and type, such as "2:ReportMetrics", so that a later
+	// processor (such as a dumper) can surface them.  Processors inside
+	// another processor's nested chain are included in their parent's time.
+	// Defaults to false, since it adds some overhead to every batch.
+	RecordProcessorTimings bool `toml:"record_processor_timings"`
+
+	// If set, we count the reports in each batch before and after each
+	// processor handles it, so that you can see how many reports each filter
+	// or sampler removes; see Pipeline.ProcessorCounts (and
+	// metrics.NewProcessorMetrics, which exports them).  Defaults to false.
+	RecordProcessorCounts bool `toml:"record_processor_counts"`
+
+	// If set, every upload that we accept is written to a write-ahead log in
+	// this directory before it's queued, and any batches that weren't fully
+	// processed when the collector last stopped (say, because it crashed) are
+	// processed again when it starts, so that each upload is delivered to the
+	// processors at least once; see WAL.  Can't be used with
+	// CoalesceReports.  Only used by NewPipelineFromConfig and
+	// NewPipelineFromConfigDir.  Defaults to "" (disabled).
+	WALDir string `toml:"wal_dir"`
+
+	// The size of each of the write-ahead log's segment files; segments are
+	// deleted once every batch in them has been processed.  Only used if
+	// WALDir is set.  Defaults to 16MiB.
+	WALSegmentBytes int64 `toml:"wal_segment_bytes"`
+
+	// When the write-ahead log is synced to disk: "always" (before we respond
+	// to each upload), "interval" (once a second), or "never" (whenever the
+	// operating system decides to).  Only used if WALDir is set.  Defaults to
+	// "always".
+	WALSync string `toml:"wal_sync"`
+
+	// The timeouts for servers created by Pipeline.NewServer: the longest that
+	// we wait to read a whole request (including its upload), or just its
+	// headers; the longest that we take to write a response; and the longest
+	// that we keep an idle connection open.  (See http.Server.)  Default to
+	// 30s, 10s, 0 (no limit), and 2m.  WriteTimeout is disabled by default
+	// because it also applies to streaming responses, such as LiveTail's.
+	ReadTimeout       Duration `toml:"read_timeout"`
+	ReadHeaderTimeout Duration `toml:"read_header_timeout"`
+	WriteTimeout      Duration `toml:"write_timeout"`
+	IdleTimeout       Duration `toml:"idle_timeout"`
+
+	// The largest request header (including the request line) that servers
+	// created by Pipeline.NewServer accept.  Larger requests are rejected with
+	// a 431 status before we parse anything, so a client can't make us hold
+	// on to enormous cookies or forwarding chains.  Defaults to 1MiB
+	// (http.DefaultMaxHeaderBytes).
+	MaxHeaderBytes int `toml:"max_header_bytes"`
+
+	// The addresses (as CIDRs, such as "10.0.0.0/8") of any proxies in front
+	// of the collector.  When an upload arrives from one of them, we take the
+	// batch's ClientIP from its X-Forwarded-For header instead: it's the
+	// rightmost address in the header that isn't one of these proxies.
+	// Defaults to none, so X-Forwarded-For is ignored.
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// Whether uploads that arrive over a Unix domain socket (see ListenUnix)
+	// come from a trusted proxy.  Those don't have an address to check against
+	// TrustedProxies, but only local processes that are allowed to open the
+	// socket can send them, so if that's just your proxy, set this to take
+	// their ClientIP from their X-Forwarded-For header too, in the same way.
+	// Defaults to false, so they have an empty ClientIP.
+	TrustUnixSocket bool `toml:"trust_unix_socket"`
+
+	// The most X-Forwarded-For entries that we look at, counting from the
+	// right, when finding an upload's ClientIP.  Anything to the left of them
+	// isn't parsed at all; if every entry that we look at is a trusted proxy,
+	// the leftmost of them is used.  Only used if TrustedProxies or
+	// TrustUnixSocket is set.  Defaults to 10.
+	MaxForwardedHops int `toml:"max_forwarded_hops"`
+}
+
+const defaultCoalesceDelay = time.Second
+const defaultMaxRetryAfter = time.Minute
+const defaultReadTimeout = 30 * time.Second
+const defaultReadHeaderTimeout = 10 * time.Second
+const defaultIdleTimeout = 2 * time.Minute
+const defaultMaxForwardedHops = 10
+
+// withDefaults returns a copy of c with any zero settings replaced by their
+// default values.
+func (c PipelineConfig) withDefaults() PipelineConfig {
+	if c.BufferSize == 0 {
+		c.BufferSize = defaultBufferSize
+	}
+	if c.NumWorkers == 0 {
+		c.NumWorkers = defaultNumWorkers
+	}
+	if c.CoalesceReports > 0 && c.CoalesceDelay.Duration == 0 {
+		c.CoalesceDelay.Duration = defaultCoalesceDelay
+	}
+	if c.OversizedBatches == "" {
+		c.OversizedBatches = "reject"
+	}
+	if c.MalformedReports == "" {
+		c.MalformedReports = "reject"
+	}
+	if c.EmptyUploads == "" {
+		c.EmptyUploads = "process"
+	}
+	if c.MaxJSONDepth == 0 {
+		c.MaxJSONDepth = DefaultMaxJSONDepth
+	}
+	if c.BackpressureThreshold > 0 && c.MaxRetryAfter.Duration == 0 {
+		c.MaxRetryAfter.Duration = defaultMaxRetryAfter
+	}
+	if c.MultipartField != "" && c.MaxMultipartBytes == 0 {
+		c.MaxMultipartBytes = DefaultMaxMultipartBytes
+	}
+	if c.AcceptCBOR && c.MaxCBORBytes == 0 {
+		c.MaxCBORBytes = DefaultMaxCBORBytes
+	}
+	if c.SuccessStatus == 0 {
+		c.SuccessStatus = http.StatusNoContent
+	}
+	if c.FailureFraction == 0 {
+		c.FailureFraction = 1
+	}
+	if c.WALDir != "" && c.WALSegmentBytes == 0 {
+		c.WALSegmentBytes = DefaultWALSegmentBytes
+	}
+	if c.WALDir != "" && c.WALSync == "" {
+		c.WALSync = WALSyncAlways
+	}
+	if c.ReadTimeout.Duration == 0 {
+		c.ReadTimeout.Duration = defaultReadTimeout
+	}
+	if c.ReadHeaderTimeout.Duration == 0 {
+		c.ReadHeaderTimeout.Duration = defaultReadHeaderTimeout
+	}
+	if c.IdleTimeout.Duration == 0 {
+		c.IdleTimeout.Duration = defaultIdleTimeout
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	if (len(c.TrustedProxies) > 0 || c.TrustUnixSocket) && c.MaxForwardedHops == 0 {
+		c.MaxForwardedHops = defaultMaxForwardedHops
+	}
+	return c
+}
+
+// Duration is a time.Duration that can be read from a configuration file,
+// where it's written as a string that time.ParseDuration understands, such as
+// "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration string.
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// ParsePipelineConfig extracts the `pipeline` section from the contents of a
+// TOML configuration file, filling in default values for any missing settings.
+func ParsePipelineConfig(configBytes []byte) (PipelineConfig, error) {
+	var config struct {
+		Pipeline PipelineConfig `toml:"pipeline"`
+	}
+	err := toml.Unmarshal(configBytes, &config)
+	if err != nil {
+		return PipelineConfig{}, fmt.Errorf("Invalid NEL configuration")
+	}
+
+	result := config.Pipeline
+	if result.BufferSize < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `buffer_size` must be at least 1")
+	}
+	if result.NumWorkers < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `num_workers` must be at least 1")
+	}
+	if result.CoalesceReports < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `coalesce_reports` must not be negative")
+	}
+	if result.CoalesceDelay.Duration < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `coalesce_delay` must not be negative")
+	}
+	if result.MaxReportsPerBatch < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_reports_per_batch` must not be negative")
+	}
+	if result.OversizedBatches != "" && result.OversizedBatches != "reject" && result.OversizedBatches != "truncate" {
+		return PipelineConfig{}, fmt.Errorf("Pipeline invalid `oversized_batches`: %s", result.OversizedBatches)
+	}
+	if result.MalformedReports != "" && result.MalformedReports != "reject" && result.MalformedReports != "skip" {
+		return PipelineConfig{}, fmt.Errorf("Pipeline invalid `malformed_reports`: %s", result.MalformedReports)
+	}
+	if result.EmptyUploads != "" && result.EmptyUploads != "process" && result.EmptyUploads != "skip" {
+		return PipelineConfig{}, fmt.Errorf("Pipeline invalid `empty_uploads`: %s", result.EmptyUploads)
+	}
+	if result.MaxJSONDepth < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_json_depth` must not be negative")
+	}
+	if result.MaxUploadBytes < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_upload_bytes` must not be negative")
+	}
+	if result.MaxMultipartBytes < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_multipart_bytes` must not be negative")
+	}
+	if result.MaxCBORBytes < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_cbor_bytes` must not be negative")
+	}
+	if result.BackpressureThreshold < 0 || result.BackpressureThreshold >= 1 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `backpressure_threshold` must be at least 0 and less than 1")
+	}
+	if result.MaxRetryAfter.Duration < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_retry_after` must not be negative")
+	}
+	if result.MaxConcurrentUploads < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_concurrent_uploads` must not be negative")
+	}
+	if result.SuccessFraction < 0 || result.SuccessFraction > 1 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `success_fraction` must be between 0 and 1")
+	}
+	if result.FailureFraction < 0 || result.FailureFraction > 1 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `failure_fraction` must be between 0 and 1")
+	}
+	if result.LoadHintHeader != "" && !validHeaderName(result.LoadHintHeader) {
+		return PipelineConfig{}, fmt.Errorf("Pipeline invalid `load_hint_header`: %q", result.LoadHintHeader)
+	}
+	for _, timeout := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"read_timeout", result.ReadTimeout.Duration},
+		{"read_header_timeout", result.ReadHeaderTimeout.Duration},
+		{"write_timeout", result.WriteTimeout.Duration},
+		{"idle_timeout", result.IdleTimeout.Duration},
+	} {
+		if timeout.duration < 0 {
+			return PipelineConfig{}, fmt.Errorf("Pipeline `%s` must not be negative", timeout.name)
 		}
+	}
+	if result.MaxHeaderBytes < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_header_bytes` must not be negative")
+	}
+	if _, err := parseTrustedProxies(result.TrustedProxies); err != nil {
+		return PipelineConfig{}, fmt.Errorf("Pipeline invalid `trusted_proxies`: %v", err)
+	}
+	if result.MaxForwardedHops < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `max_forwarded_hops` must not be negative")
+	}
+	if result.WALSegmentBytes < 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `wal_segment_bytes` must not be negative")
+	}
+	switch result.WALSync {
+	case "", WALSyncAlways, WALSyncInterval, WALSyncNever:
+	default:
+		return PipelineConfig{}, fmt.Errorf("Pipeline invalid `wal_sync`: %s", result.WALSync)
+	}
+	if result.WALDir != "" && result.CoalesceReports > 0 {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `wal_dir` can't be used with `coalesce_reports`")
+	}
+	if result.SuccessStatus != 0 && (result.SuccessStatus < 200 || result.SuccessStatus > 299) {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `success_status` must be a 2xx status code")
+	}
+	if result.SuccessBody != "" && (result.SuccessStatus == 0 || result.SuccessStatus == http.StatusNoContent) {
+		return PipelineConfig{}, fmt.Errorf("Pipeline `success_body` can't be used with a 204 `success_status`")
+	}
+	if result.BatchIDHeader != "" && !validHeaderName(result.BatchIDHeader) {
+		return PipelineConfig{}, fmt.Errorf("Pipeline invalid `batch_id_header`: %q", result.BatchIDHeader)
+	}
+	return result.withDefaults(), nil
+}
 
-		processor, err := loader.Load(ctx, processorPrimitive)
+// NewPipelineFromConfig creates a new Pipeline whose settings and processors
+// are both loaded from the contents of a TOML configuration file.  The
+// pipeline's settings come from the `pipeline` section (see PipelineConfig),
+// and its processors from the `processor` sections (see LoadFromConfig).
+func NewPipelineFromConfig(ctx context.Context, configBytes []byte) (*Pipeline, error) {
+	config, err := ParsePipelineConfig(configBytes)
+	if err != nil {
+		return nil, err
+	}
+	p := NewPipelineWithConfig(config)
+	if err := p.openWAL(ctx, config); err != nil {
+		p.Close()
+		return nil, err
+	}
+	err = p.LoadFromConfig(ctx, configBytes)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.commitWAL()
+	p.replayWAL(ctx)
+	return p, nil
+}
+
+// NewPipelineFromConfigDir creates a new Pipeline whose settings and
+// processors are loaded from the `*.toml` files in a directory.  The
+// pipeline's settings come from whichever file has a `pipeline` section (it's
+// an error for more than one of them to have one), and its processors from
+// all of the files (see LoadFromConfigDir).
+func NewPipelineFromConfigDir(ctx context.Context, dir string) (*Pipeline, error) {
+	paths, err := configDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var config PipelineConfig
+	var configPath string
+	for _, path := range paths {
+		configBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var sections map[string]toml.Primitive
+		if toml.Unmarshal(configBytes, &sections) != nil {
+			return nil, fmt.Errorf("%s: Invalid NEL configuration", filepath.Base(path))
+		}
+		if _, ok := sections["pipeline"]; !ok {
+			continue
+		}
+		if configPath != "" {
+			return nil, fmt.Errorf("Both %s and %s have a `pipeline` section", filepath.Base(configPath), filepath.Base(path))
+		}
+		configPath = path
+		config, err = ParsePipelineConfig(configBytes)
 		if err != nil {
-			return fmt.Errorf("Couldn't create a %s for processor %d: %v", processorConfig.Type, idx, err)
+			return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
 		}
+	}
 
-		p.AddProcessor(processor)
+	p := NewPipelineWithConfig(config)
+	if err := p.openWAL(ctx, config); err != nil {
+		p.Close()
+		return nil, err
+	}
+	err = p.LoadFromConfigDir(ctx, dir)
+	if err != nil {
+		p.Close()
+		return nil, err
 	}
+	p.commitWAL()
+	p.replayWAL(ctx)
+	return p, nil
+}
 
+// openWAL opens the write-ahead log that the pipeline's configuration asks for,
+// if any, and starts using it.  If we're replacing a pipeline that's using the
+// same log (see ReuseProcessors), we borrow its log instead, since it can't be
+// opened twice.
+func (p *Pipeline) openWAL(ctx context.Context, config PipelineConfig) error {
+	if config.WALDir == "" {
+		return nil
+	}
+	old, _ := ctx.Value(reusePipelineKey{}).(*Pipeline)
+	if old != nil && old.wal != nil && filepath.Clean(old.wal.Dir) == filepath.Clean(config.WALDir) {
+		p.UseWAL(old.wal)
+		p.walFrom = old
+		return nil
+	}
+	wal, err := OpenWAL(config.WALDir, config.WALSegmentBytes, config.WALSync)
+	if err != nil {
+		return err
+	}
+	p.UseWAL(wal)
 	return nil
 }
 
+// commitWAL takes over the write-ahead log that openWAL borrowed, if any, once
+// the pipeline has loaded successfully, so that the old pipeline doesn't close
+// it.
+func (p *Pipeline) commitWAL() {
+	old := p.walFrom
+	if old == nil {
+		return
+	}
+	old.mu.Lock()
+	old.walLent = true
+	old.mu.Unlock()
+	p.walFrom = nil
+}
+
+// replayWAL processes any batches left in the write-ahead log, once the
+// pipeline's processors have been loaded.
+func (p *Pipeline) replayWAL(ctx context.Context) {
+	if n := p.ReplayWAL(ctx); n > 0 {
+		log.Printf("Replaying %d batches from write-ahead log", n)
+	}
+}
+
 // ReportLoader is an interface that knows how to load a ReportProcessor at
 // runtime via the contents of a TOML configuration file.
 type ReportLoader interface {
@@ -110,6 +1044,31 @@ func (f ContextReportLoaderFunc) Load(ctx context.Context, config toml.Primitive
 	return f(ctx, config)
 }
 
+// ClockReportLoaderFunc allows you to register a simple function (which needs
+// access to a Context and to the pipeline's Clock) as a ReportLoader.
+// Processors that depend on the current time should use the Clock instead of
+// calling time.Now directly, so that their behavior is reproducible in tests
+// that use a simulated clock.
+type ClockReportLoaderFunc func(ctx context.Context, clock Clock, config toml.Primitive) (ReportProcessor, error)
+
+// Load defers to a ClockReportLoaderFunc to load a ReportProcessor from the
+// contents of a configuration file.
+func (f ClockReportLoaderFunc) Load(ctx context.Context, config toml.Primitive) (ReportProcessor, error) {
+	return f(ctx, ClockFromContext(ctx), config)
+}
+
+type clockKey struct{}
+
+// ClockFromContext returns the Clock of the pipeline whose processors are being
+// loaded; LoadFromConfig makes it available to each ReportLoader via its
+// Context.  If there isn't one, we return a Clock that uses time.Now.
+func ClockFromContext(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(clockKey{}).(Clock); ok {
+		return clock
+	}
+	return defaultClock
+}
+
 var reportLoaders = make(map[string]ReportLoader)
 
 // RegisterReportLoader registers a ReportLoader for a particular kind of report
@@ -119,7 +1078,9 @@ func RegisterReportLoader(name string, loader ReportLoader) {
 }
 
 // RegisterReportLoaderFunc registers a function that can load a particular kind
-// of report processor.
+// of report processor.  Since the function doesn't have access to a Context,
+// LoadFromConfig can't check its configuration for unknown fields; use
+// RegisterContextReportLoaderFunc and DecodeConfig for that.
 func RegisterReportLoaderFunc(name string, loader func(config toml.Primitive) (ReportProcessor, error)) {
 	RegisterReportLoader(name, ReportLoaderFunc(loader))
 }
@@ -129,3 +1090,21 @@ func RegisterReportLoaderFunc(name string, loader func(config toml.Primitive) (R
 func RegisterContextReportLoaderFunc(name string, loader func(ctx context.Context, config toml.Primitive) (ReportProcessor, error)) {
 	RegisterReportLoader(name, ContextReportLoaderFunc(loader))
 }
+
+// RegisterClockReportLoaderFunc registers a function that can load a
+// particular kind of time-dependent report processor.  The function receives
+// the Clock of the pipeline that the processor is being loaded into.
+func RegisterClockReportLoaderFunc(name string, loader func(ctx context.Context, clock Clock, config toml.Primitive) (ReportProcessor, error)) {
+	RegisterReportLoader(name, ClockReportLoaderFunc(loader))
+}
+
+// validHeaderName returns whether name is a valid HTTP header name (a token,
+// as defined by RFC 7230).
+func validHeaderName(name string) bool {
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ProcessorInfo describes one of the processors in a pipeline.
+type ProcessorInfo struct {
+	// The name that the processor's type was registered under (see
+	// RegisterReportLoader), or its Go type if it was added to the pipeline
+	// directly with AddProcessor.
+	Type string `json:"type"`
+
+	// The configuration that the processor was loaded from, not including its
+	// `type`, with any sensitive values redacted.  This is nil for processors
+	// that weren't loaded from a configuration file.
+	Config map[string]interface{} `json:"config,omitempty"`
+
+	// The number of goroutines that run the processor, if it was added with
+	// AddProcessorWithConcurrency.
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// Whether the processor was taken over from the pipeline that this one
+	// replaced, rather than being created from scratch; see ReuseProcessors.
+	Reused bool `json:"reused,omitempty"`
+}
+
+// sensitiveConfigField matches the names of configuration fields whose values
+// shouldn't be shown by Describe.
+var sensitiveConfigField = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|auth|dsn|api_?key|access_?key|private_?key|routing_?key)`)
+
+const redacted = "REDACTED"
+
+// redactConfig replaces the values of any sensitive fields in a configuration
+// (and in any nested tables) with a placeholder.  It also removes the password
+// from any URLs.
+func redactConfig(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			if sensitiveConfigField.MatchString(key) {
+				result[key] = redacted
+			} else {
+				result[key] = redactConfig(field)
+			}
+		}
+		return result
+	case []map[string]interface{}:
+		result := make([]interface{}, len(value))
+		for i, field := range value {
+			result[i] = redactConfig(field)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, field := range value {
+			result[i] = redactConfig(field)
+		}
+		return result
+	case string:
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+func newProcessorInfo(processorType string, config toml.Primitive) ProcessorInfo {
+	var fields map[string]interface{}
+	if err := toml.PrimitiveDecode(config, &fields); err != nil {
+		return ProcessorInfo{Type: processorType}
+	}
+	delete(fields, "type")
+	delete(fields, "enabled")
+	return ProcessorInfo{
+		Type:   processorType,
+		Config: redactConfig(fields).(map[string]interface{}),
+	}
+}
+
+// Describe returns a description of each of the processors in the pipeline,
+// in order.
+func (p *Pipeline) Describe() []ProcessorInfo {
+	result := make([]ProcessorInfo, len(p.infos))
+	copy(result, p.infos)
+	return result
+}
+
+// Processors returns the processors in the pipeline, in order.  The result is
+// a copy, so changing it doesn't affect the pipeline.  Processors()[i] is the
+// processor that Describe()[i] describes, so the two can be zipped together to
+// find the name that each processor's type was registered under.
+func (p *Pipeline) Processors() []ReportProcessor {
+	result := make([]ReportProcessor, len(p.processors))
+	copy(result, p.processors)
+	return result
+}
+
+// A Describer can describe the processors that it runs; both Pipeline and
+// HotSwap are Describers.
+type Describer interface {
+	Describe() []ProcessorInfo
+}
+
+type describeHandler struct {
+	d Describer
+}
+
+// DescribeHandler returns an http.Handler that responds with the result of
+// d.Describe, encoded as JSON.  This is useful for checking which processors
+// are running, especially after a configuration has been hot-swapped in.
+func DescribeHandler(d Describer) http.Handler {
+	return describeHandler{d}
+}
+
+func (h describeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(h.d.Describe())
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envReference matches the environment variable references that expandEnv
+// replaces, along with the `$$` escape.
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// expandEnv replaces each `${VAR}` in a string with the value of the VAR
+// environment variable, and each `${VAR:-default}` with the value of VAR, or
+// with `default` if VAR is unset or empty.  `$$` is replaced by a single `$`,
+// so that you can write a literal `${`.  It's an error to refer to a variable
+// that's unset, unless there's a default.
+func expandEnv(s string) (string, error) {
+	var err error
+	result := envReference.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		groups := envReference.FindStringSubmatch(match)
+		value, ok := os.LookupEnv(groups[1])
+		if groups[2] != "" {
+			if value == "" {
+				value = groups[2][2:]
+			}
+		} else if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", groups[1])
+		}
+		return value
+	})
+	return result, err
+}
+
+// expandEnvValue expands the environment variable references in every string
+// within a decoded TOML value, returning the new value and whether anything
+// changed.
+func expandEnvValue(value interface{}) (interface{}, bool, error) {
+	switch value := value.(type) {
+	case string:
+		expanded, err := expandEnv(value)
+		return expanded, expanded != value, err
+	case map[string]interface{}:
+		changed := false
+		result := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			expanded, fieldChanged, err := expandEnvValue(field)
+			if err != nil {
+				return nil, false, fmt.Errorf("`%s`: %v", key, err)
+			}
+			result[key] = expanded
+			changed = changed || fieldChanged
+		}
+		return result, changed, nil
+	case []map[string]interface{}:
+		changed := false
+		result := make([]map[string]interface{}, len(value))
+		for i, table := range value {
+			expanded, tableChanged, err := expandEnvValue(table)
+			if err != nil {
+				return nil, false, err
+			}
+			result[i] = expanded.(map[string]interface{})
+			changed = changed || tableChanged
+		}
+		return result, changed, nil
+	case []interface{}:
+		changed := false
+		result := make([]interface{}, len(value))
+		for i, element := range value {
+			expanded, elementChanged, err := expandEnvValue(element)
+			if err != nil {
+				return nil, false, err
+			}
+			result[i] = expanded
+			changed = changed || elementChanged
+		}
+		return result, changed, nil
+	default:
+		return value, false, nil
+	}
+}
+
+// expandEnvPrimitive expands the environment variable references in every
+// string within a processor's configuration (see expandEnv).
+func expandEnvPrimitive(config toml.Primitive) (toml.Primitive, error) {
+	var fields map[string]interface{}
+	if err := toml.PrimitiveDecode(config, &fields); err != nil {
+		// Not an object; loadProcessors will report that.
+		return config, nil
+	}
+	expanded, changed, err := expandEnvValue(fields)
+	if err != nil || !changed {
+		return config, err
+	}
+
+	// There's no way to build a Primitive directly, so round-trip the expanded
+	// configuration through the TOML encoder.
+	var encoded bytes.Buffer
+	if err := toml.NewEncoder(&encoded).Encode(expanded); err != nil {
+		return config, err
+	}
+	var result toml.Primitive
+	if _, err := toml.Decode(encoded.String(), &result); err != nil {
+		return config, err
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses the CIDRs in PipelineConfig.TrustedProxies.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP returns the address of the client that an upload came
+// from, given the address that it arrived from (remote) and its headers.  If
+// remote is a trusted proxy (or the upload came over a trusted Unix domain
+// socket, in which case remote is empty and socket is true), we walk its X-Forwarded-For header from right to
+// left, and return the first address that isn't a trusted proxy.  We only look
+// at the rightmost maxHops entries, and we work backwards from the end of the
+// header rather than splitting all of it, so that a client can't make us do
+// more work by sending a long chain.  If we run out of entries, reach the
+// limit, or find one that isn't an IP address, we return the last address that
+// we did trust.
+func forwardedClientIP(remote string, socket bool, header http.Header, trusted []*net.IPNet, maxHops int) string {
+	if !socket {
+		ip := net.ParseIP(remote)
+		if ip == nil || !isTrustedProxy(ip, trusted) {
+			return remote
+		}
+	}
+
+	client := remote
+	hops := 0
+	values := header["X-Forwarded-For"]
+	for i := len(values) - 1; i >= 0; i-- {
+		value := values[i]
+		for {
+			comma := strings.LastIndexByte(value, ',')
+			entry := strings.TrimSpace(value[comma+1:])
+			if hops++; hops > maxHops {
+				return client
+			}
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return client
+			}
+			client = entry
+			if !isTrustedProxy(ip, trusted) {
+				return client
+			}
+			if comma < 0 {
+				break
+			}
+			value = value[:comma]
+		}
+	}
+	return client
+}
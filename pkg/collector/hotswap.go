@@ -15,13 +15,20 @@
 package collector
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
 	"sync"
+
+	"github.com/BurntSushi/toml"
 )
 
 // HandlerCloser is an interface for a http.Handler that processes data
 // asynchronously and therefore must be closed. Once Close is called,
-// the caller must ensure that no further calls to ServeHTTP are made.
+// the caller must ensure that no further calls to ServeHTTP are made,
+// unless the handler (like Pipeline) allows them.
 type HandlerCloser interface {
 	Close()
 	http.Handler
@@ -33,6 +40,10 @@ type HandlerCloser interface {
 // Handler, and call Swap. In a threadsafe manner, the old Handler will be
 // replaced and all future calls to ServeHTTP will use the new version of the
 // handler.
+//
+// To avoid rebuilding every processor (and reconnecting every publisher) when
+// only a few of them have changed, load the new Pipeline with a context from
+// ReuseProcessors, passing the Pipeline that it replaces.
 type HotSwap struct {
 	mu sync.RWMutex
 	hc HandlerCloser
@@ -58,6 +69,17 @@ func (h *HotSwap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.hc.ServeHTTP(w, r)
 }
 
+// Describe describes the processors of the contained handler, if it's a
+// Describer.
+func (h *HotSwap) Describe() []ProcessorInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if d, ok := h.hc.(Describer); ok {
+		return d.Describe()
+	}
+	return nil
+}
+
 // Close closes the contained HandlerCloser, first ensuring that all in-progress
 // calls to ServeHTTP have completed. It is up to the caller to ensure that no
 // calls to ServeHTTP are made after this function has started.
@@ -68,3 +90,138 @@ func (h *HotSwap) Close() {
 		h.hc.Close()
 	}
 }
+
+type reuseProcessorsKey struct{}
+
+// ReuseProcessors returns a context that makes LoadFromConfig and
+// LoadFromConfigDir (and so NewPipelineFromConfig and NewPipelineFromConfigDir)
+// reuse the processors of old whose configurations haven't changed, instead of
+// creating new ones.  This is meant for reloading a configuration with
+// HotSwap: only the processors that were added, removed, or changed are
+// created or closed, so that (for instance) publishers that rarely change
+// don't have to reconnect on every reload.
+//
+// A processor is reused if a top-level `processor` section of the new
+// configuration is identical to the one that it was loaded from, after
+// expanding environment variables; each one can only be reused once.
+// Processors inside a `chain`, and processors that weren't loaded from a
+// configuration file, are always created from scratch.  Reused processors
+// belong to the new pipeline once it has loaded successfully, and old won't
+// close them when it's closed; if the new configuration fails to load, they
+// stay with old.  old must still be running, and the two pipelines will both
+// use the reused processors until old is closed, so this is only suitable for
+// processors that can handle batches from more than one pipeline (which any
+// processor that handles concurrent batches already can).
+//
+// In the same way, if the new pipeline's `wal_dir` is the same as old's, it
+// shares old's write-ahead log (which can't be opened twice), keeping its
+// other settings, and takes it over once it has loaded successfully.
+func ReuseProcessors(ctx context.Context, old *Pipeline) context.Context {
+	return context.WithValue(ctx, reusePipelineKey{}, old)
+}
+
+type reusePipelineKey struct{}
+
+// configKey returns a hash of a processor's configuration, which is the same
+// for any two identical configurations.
+func configKey(config toml.Primitive) string {
+	var fields map[string]interface{}
+	if err := toml.PrimitiveDecode(config, &fields); err != nil {
+		return ""
+	}
+	// encoding/json sorts the keys of maps, so this is canonical.
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:])
+}
+
+// processorSource records where one of a pipeline's processors came from.
+type processorSource struct {
+	// A hash of the processor's configuration (after environment variables
+	// are expanded), used to decide whether it can be reused.  Empty for
+	// processors that weren't loaded from a top-level `processor` section.
+	configKey string
+
+	// If borrowed is set, the processor still belongs to another pipeline (at
+	// index borrowedIndex), until the configuration that it was borrowed for
+	// has finished loading.
+	borrowed      bool
+	borrowedIndex int
+}
+
+// processorReuse keeps track of the processors that a configuration that's
+// being loaded can borrow from an old pipeline.
+type processorReuse struct {
+	old       *Pipeline
+	available map[string][]int
+}
+
+// newProcessorReuse returns the processors that can be borrowed from the
+// pipeline passed to ReuseProcessors, if there is one.
+func newProcessorReuse(ctx context.Context) *processorReuse {
+	old, _ := ctx.Value(reusePipelineKey{}).(*Pipeline)
+	if old == nil {
+		return nil
+	}
+	r := &processorReuse{old: old, available: make(map[string][]int)}
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	for i, source := range old.sources {
+		if source.configKey != "" && !old.lent[i] {
+			r.available[source.configKey] = append(r.available[source.configKey], i)
+		}
+	}
+	return r
+}
+
+// borrow returns a processor from the old pipeline whose configuration has the
+// given key, if there's one that hasn't been borrowed yet.
+func (r *processorReuse) borrow(key string) (ReportProcessor, ProcessorInfo, processorSource, bool) {
+	if r == nil || key == "" || len(r.available[key]) == 0 {
+		return nil, ProcessorInfo{}, processorSource{}, false
+	}
+	index := r.available[key][0]
+	r.available[key] = r.available[key][1:]
+	info := r.old.infos[index]
+	info.Concurrency = 0
+	info.Reused = true
+	source := processorSource{configKey: key, borrowed: true, borrowedIndex: index}
+	return r.old.processors[index], info, source, true
+}
+
+// commit hands the borrowed processors in a configuration that has finished
+// loading over to the new pipeline, so that the old one won't close them.
+func (r *processorReuse) commit(sources []processorSource) {
+	if r == nil {
+		return
+	}
+	r.old.mu.Lock()
+	defer r.old.mu.Unlock()
+	for i := range sources {
+		if !sources[i].borrowed {
+			continue
+		}
+		if r.old.lent == nil {
+			r.old.lent = make(map[int]bool)
+		}
+		r.old.lent[sources[i].borrowedIndex] = true
+		sources[i].borrowed = false
+	}
+}
+
+// closeLoaded closes the processors from a configuration that failed to load,
+// apart from any that were borrowed from another pipeline, which still belong
+// to it.
+func closeLoaded(processors []ReportProcessor, sources []processorSource) error {
+	var owned []ReportProcessor
+	for i, processor := range processors {
+		if i < len(sources) && sources[i].borrowed {
+			continue
+		}
+		owned = append(owned, processor)
+	}
+	return CloseProcessors(owned)
+}
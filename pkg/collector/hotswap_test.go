@@ -15,11 +15,16 @@
 package collector_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
 )
 
 func TestHotSwapChangesWhichHandlerIsRun(t *testing.T) {
@@ -52,3 +57,85 @@ func (d dummyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(d.statusCode)
 }
 func (d dummyHandler) Close() {}
+
+// reloadable is a processor that records every instance that's created, so
+// that we can check which ones are reused.
+type reloadable struct {
+	closeCounter
+	ID string `toml:"id"`
+}
+
+var reloadables []*reloadable
+
+func init() {
+	collector.RegisterContextReportLoaderFunc("Reloadable", func(ctx context.Context, config toml.Primitive) (collector.ReportProcessor, error) {
+		r := &reloadable{}
+		if err := collector.DecodeConfig(ctx, config, r); err != nil {
+			return nil, err
+		}
+		reloadables = append(reloadables, r)
+		return r, nil
+	})
+}
+
+func reloadableConfig(ids ...string) string {
+	var config string
+	for _, id := range ids {
+		config += "[[processor]]\ntype = \"Reloadable\"\nid = \"" + id + "\"\n"
+	}
+	return config
+}
+
+func TestReuseProcessors(t *testing.T) {
+	reloadables = nil
+	ctx := context.Background()
+	old := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	if err := old.LoadFromConfig(ctx, []byte(reloadableConfig("a", "b", "b"))); err != nil {
+		t.Fatal(err)
+	}
+	a, b1, b2 := reloadables[0], reloadables[1], reloadables[2]
+
+	// A configuration that fails to load leaves the old pipeline's processors
+	// alone.
+	failed := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	if err := failed.LoadFromConfig(collector.ReuseProcessors(ctx, old), []byte(reloadableConfig("a")+"[[processor]]\ntype = \"AlwaysThrowsError\"")); err == nil {
+		t.Fatalf("LoadFromConfig should return error")
+	}
+	failed.Close()
+	if len(reloadables) != 3 || atomic.LoadInt64(&a.closed) != 0 {
+		t.Fatalf("Failed reload created or closed processors")
+	}
+
+	reloaded := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	if err := reloaded.LoadFromConfig(collector.ReuseProcessors(ctx, old), []byte(reloadableConfig("a", "c", "b"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloadables) != 4 || reloadables[3].ID != "c" {
+		t.Fatalf("Reload created %d processors, wanted only c", len(reloadables)-3)
+	}
+	var reused []bool
+	for _, info := range reloaded.Describe() {
+		reused = append(reused, info.Reused)
+	}
+	if diff := cmp.Diff([]bool{true, false, true}, reused); diff != "" {
+		t.Errorf("Reused processors diff (-want +got):\n%s", diff)
+	}
+
+	// The old pipeline only closes the processor that wasn't reused.
+	old.Close()
+	for _, c := range []struct {
+		name string
+		r    *reloadable
+		want int64
+	}{{"a", a, 0}, {"first b", b1, 0}, {"second b", b2, 1}} {
+		if got := atomic.LoadInt64(&c.r.closed); got != c.want {
+			t.Errorf("Closing old pipeline closed %s %d times, wanted %d", c.name, got, c.want)
+		}
+	}
+	reloaded.Close()
+	for _, r := range []*reloadable{a, b1, reloadables[3]} {
+		if got := atomic.LoadInt64(&r.closed); got != 1 {
+			t.Errorf("Closing reloaded pipeline closed %s %d times, wanted 1", r.ID, got)
+		}
+	}
+}
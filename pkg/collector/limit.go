@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// semaphore limits how many goroutines can do something at once.
+type semaphore chan struct{}
+
+// tryAcquire takes a slot if one is free, without waiting, and returns
+// whether it did.
+func (s semaphore) tryAcquire() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+// setDate sets a response's Date header from clock, rather than letting
+// net/http use the real time, so that tests with a simulated clock can check
+// time-dependent headers.
+func setDate(w http.ResponseWriter, clock Clock) {
+	w.Header().Set("Date", clock.Now().UTC().Format(http.TimeFormat))
+}
+
+// rejectOverloaded responds to a request that we don't have capacity for.
+func rejectOverloaded(w http.ResponseWriter, clock Clock) {
+	setDate(w, clock)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Too many concurrent uploads", http.StatusServiceUnavailable)
+}
+
+// ConcurrencyLimiter is an http.Handler that passes requests on to another
+// handler, but only a limited number at a time.  Requests that arrive while
+// that many are already being handled get an immediate 503 response, with a
+// Retry-After header, instead of waiting.
+//
+// This bounds the work that a flood of uploads can cause before they even
+// reach the pipeline's queue (such as reading and parsing their payloads), and
+// so the memory that they can use.  You can wrap any handler, such as a
+// Pipeline or a HotSwap; a Pipeline can also limit itself, see
+// PipelineConfig.MaxConcurrentUploads.
+//
+// The limiter's own responses are dated by Clock.
+type ConcurrencyLimiter struct {
+	Clock Clock
+
+	handler  http.Handler
+	slots    semaphore
+	rejected int64
+}
+
+// NewConcurrencyLimiter creates a new ConcurrencyLimiter that lets handler
+// handle up to max requests at once.  If handler has a Clock (as a Pipeline
+// does), the limiter uses it too; otherwise it uses time.Now.
+func NewConcurrencyLimiter(handler http.Handler, max int) *ConcurrencyLimiter {
+	clock := Clock(defaultClock)
+	if clocked, ok := handler.(interface{ Clock() Clock }); ok {
+		clock = clocked.Clock()
+	}
+	return &ConcurrencyLimiter{Clock: clock, handler: handler, slots: make(semaphore, max)}
+}
+
+// ServeHTTP handles the request with the wrapped handler, if it isn't already
+// handling too many.
+func (l *ConcurrencyLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !l.slots.tryAcquire() {
+		atomic.AddInt64(&l.rejected, 1)
+		clock := l.Clock
+		if clock == nil {
+			clock = defaultClock
+		}
+		rejectOverloaded(w, clock)
+		return
+	}
+	defer l.slots.release()
+	l.handler.ServeHTTP(w, r)
+}
+
+// InFlight returns the number of requests that are currently being handled.
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+// Rejected returns the number of requests that have been rejected because too
+// many were already being handled.
+func (l *ConcurrencyLimiter) Rejected() int64 {
+	return atomic.LoadInt64(&l.rejected)
+}
+
+// uploadBodyLimiter is the body of an upload that can be at most max bytes
+// long; see limitUploadBody.
+type uploadBodyLimiter struct {
+	io.ReadCloser
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+// limitUploadBody wraps the body of an upload so that reading more than max
+// bytes from it fails with a PayloadTooLargeError, which the parsers pass
+// along.  (If a parser wraps the error, the pipeline still knows to respond
+// with a 413, because the limiter remembers that it was exceeded.)  We count
+// the bytes as they're read, so this works for chunked uploads, which don't
+// have a Content-Length.  The limit is enforced by http.MaxBytesReader, which
+// also tells the server to close the connection after responding, rather than
+// reading the rest of an oversized body.
+func limitUploadBody(w http.ResponseWriter, body io.ReadCloser, max int64) *uploadBodyLimiter {
+	return &uploadBodyLimiter{ReadCloser: http.MaxBytesReader(w, body, max), max: max}
+}
+
+func (l *uploadBodyLimiter) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.read += int64(n)
+	if err != nil && err != io.EOF && l.read >= l.max {
+		// MaxBytesReader only fails once the body has gone past the limit.
+		l.exceeded = true
+		err = PayloadTooLargeError{l.max}
+	}
+	return n, err
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListenUnix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nel.sock")
+
+	// A socket left behind by a collector that's gone away is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := collector.ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Errorf("ListenUnix created socket with mode %v, wanted %v", got, want)
+	}
+	// But one that's still in use isn't.
+	if _, err := collector.ListenUnix(path, 0600); err == nil {
+		t.Errorf("ListenUnix should fail when the socket is in use")
+	}
+
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	processed := make(channelProcessor, 1)
+	pipeline.AddProcessor(processed)
+	server := pipeline.NewServer("", pipeline)
+	go server.Serve(listener)
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	response, err := client.Post("http://localhost/upload/", "application/reports+json", bytes.NewReader(testdata(validNelReportPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("Upload over Unix socket got %d, wanted %d", response.StatusCode, http.StatusNoContent)
+	}
+	if batch := <-processed; batch.ClientIP != "" || len(batch.Reports) == 0 {
+		t.Errorf("Upload over Unix socket got ClientIP %q and %d reports, wanted no ClientIP and some reports", batch.ClientIP, len(batch.Reports))
+	}
+
+	server.Shutdown(context.Background())
+	pipeline.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("Shutdown should remove the socket, got %v", err)
+	}
+}
+
+func TestListenUnixRefusesToClobberFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListenUnix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nel.sock")
+	if err := ioutil.WriteFile(path, []byte("important"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collector.ListenUnix(path, 0600); err == nil {
+		t.Errorf("ListenUnix should refuse to replace a regular file")
+	}
+	if contents, err := ioutil.ReadFile(path); err != nil || string(contents) != "important" {
+		t.Errorf("ListenUnix changed %s to %q (%v)", path, contents, err)
+	}
+}
+
+func TestListenUnixTrustedProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListenUnix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		name  string
+		trust bool
+		want  string
+	}{
+		{"Trusted", true, "203.0.113.5"},
+		{"Untrusted", false, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, c.name+".sock")
+			listener, err := collector.ListenUnix(path, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+				TrustedProxies:   []string{"10.0.0.0/8"},
+				TrustUnixSocket:  c.trust,
+				MaxForwardedHops: 3,
+			})
+			defer pipeline.Close()
+			processed := make(channelProcessor, 1)
+			pipeline.AddProcessor(processed)
+			server := pipeline.NewServer("", pipeline)
+			go server.Serve(listener)
+			defer server.Shutdown(context.Background())
+
+			client := http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			}}
+			request, err := http.NewRequest("POST", "http://localhost/upload/", bytes.NewReader(testdata(validNelReportPath)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/reports+json")
+			// The local proxy appends the address of the load balancer in
+			// front of it, which is another trusted proxy.
+			request.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.5, 10.0.0.1")
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if batch := <-processed; batch.ClientIP != c.want {
+				t.Errorf("ClientIP = %q, wanted %q", batch.ClientIP, c.want)
+			}
+		})
+	}
+}
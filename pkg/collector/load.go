@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// LoadFactor returns how loaded the pipeline is, between 0 (idle) and 1
+// (unable to take any more uploads).  That's the fuller of the queue and, if
+// PipelineConfig.MaxConcurrentUploads is set, the upload slots; a draining
+// pipeline is fully loaded.  A synchronous pipeline doesn't have a queue, so
+// only its upload slots count.
+func (p *Pipeline) LoadFactor() float64 {
+	if p.isDraining() {
+		return 1
+	}
+	var load float64
+	if !p.synchronous && cap(p.c) > 0 {
+		load = float64(len(p.c)) / float64(cap(p.c))
+	}
+	if p.uploads != nil {
+		if uploads := float64(len(p.uploads)) / float64(cap(p.uploads)); uploads > load {
+			load = uploads
+		}
+	}
+	return load
+}
+
+// RecommendedFractions returns the success_fraction and failure_fraction that
+// we recommend clients' NEL policies use, given the pipeline's current load
+// (see LoadFactor).  Starting from PipelineConfig.SuccessFraction and
+// FailureFraction, the success fraction shrinks in proportion to the load,
+// reaching 0 when we're fully loaded, while the failure fraction, since
+// failure reports are the ones that we most want, only shrinks by up to half.
+//
+// The Reporting spec doesn't give us a way to tell clients to report less, so
+// this is only advice, for whatever serves the NEL policies to act on.
+func (p *Pipeline) RecommendedFractions() (success, failure float64) {
+	return p.fractionsAt(p.LoadFactor())
+}
+
+// fractionsAt returns the recommended fractions at a particular load.
+func (p *Pipeline) fractionsAt(load float64) (success, failure float64) {
+	failureFraction := p.failureFraction
+	if failureFraction == 0 {
+		failureFraction = 1
+	}
+	return p.successFraction * (1 - load), failureFraction * (1 - load/2)
+}
+
+// loadHint returns the value of the load hint header; see
+// PipelineConfig.LoadHintHeader.
+func (p *Pipeline) loadHint() string {
+	load := p.LoadFactor()
+	success, failure := p.fractionsAt(load)
+	format := func(f float64) string { return strconv.FormatFloat(f, 'g', 4, 64) }
+	return fmt.Sprintf("load=%s, success_fraction=%s, failure_fraction=%s", format(load), format(success), format(failure))
+}
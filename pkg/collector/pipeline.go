@@ -15,11 +15,24 @@
 package collector
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,6 +47,55 @@ type ReportProcessor interface {
 	ProcessReports(ctx context.Context, batch *ReportBatch)
 }
 
+// A ReportProcessorCloser is a ReportProcessor that holds onto resources (such
+// as buffered reports or network connections) that must be cleaned up when the
+// pipeline shuts down.  Pipeline.Close calls Close on each of these processors
+// once all queued reports have been processed.
+type ReportProcessorCloser interface {
+	ReportProcessor
+	Close() error
+}
+
+// A FallibleReportProcessor is a ReportProcessor that can tell its caller when
+// it fails to handle a batch; for instance, a publisher whose backend is
+// unavailable.  The pipeline itself always calls ProcessReports (which should
+// log any errors); decorators that want to react to failures, such as
+// core.DeadLetter, call TryProcessReports instead.
+type FallibleReportProcessor interface {
+	ReportProcessor
+
+	// TryProcessReports handles a single batch of reports just like
+	// ProcessReports, but returns an error if the batch couldn't be handled.
+	TryProcessReports(ctx context.Context, batch *ReportBatch) error
+}
+
+// TryProcessReports runs a processor against a batch, returning an error if it
+// implements FallibleReportProcessor and fails.  Processors that can't fail
+// always succeed.
+func TryProcessReports(ctx context.Context, processor ReportProcessor, batch *ReportBatch) error {
+	if fallible, ok := processor.(FallibleReportProcessor); ok {
+		return fallible.TryProcessReports(ctx, batch)
+	}
+	processor.ProcessReports(ctx, batch)
+	return nil
+}
+
+// CloseProcessors closes each processor in a list that implements
+// ReportProcessorCloser.  Every processor is closed, even if some of them fail;
+// we return the first error encountered.  Processors that contain nested chains
+// of other processors should use this to close their children.
+func CloseProcessors(processors []ReportProcessor) error {
+	var result error
+	for _, processor := range processors {
+		if closer, ok := processor.(ReportProcessorCloser); ok {
+			if err := closer.Close(); err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
 // Clock lets you override how a pipeline assigns timestamps to each report.
 // The default is to use time.Now; you can provide a custom implementation to
 // get reproducible timestamps in test cases.
@@ -49,22 +111,159 @@ func (c nowClock) Now() time.Time {
 
 var defaultClock nowClock
 
-// Pipeline is a series of processors that should be applied to each report that
-// the collector receives. It uses a fixed number of workers to process the reports
-// and a fixed sized queue that the workers read from. If the queue fills, reports
-// are dropped. Pipeline{} is not a usable instance, use NewPipeline for production
-// and NewTestPipeline* in tests.
+// Pipeline is a series of processors that should be applied to each report
+// that the collector receives. It uses a fixed number of workers to process
+// the reports and a fixed sized queue that the workers read from. If the queue
+// fills, reports are dropped. Small uploads can optionally be coalesced into
+// larger batches before the workers see them; see PipelineConfig. Pipeline{}
+// is not a usable instance, use NewPipeline for production and
+// NewTestPipeline* in tests.
 type Pipeline struct {
+	// The number of times that a processor has panicked; see Panics.  This is
+	// first so that it's 64-bit aligned for the atomic operations on it.
+	panics int64
+
+	// The number of reports that have been absorbed and dropped while
+	// accept-and-drop mode was on; see SetAcceptAndDrop.
+	absorbed int64
+
+	// The number of uploads that didn't contain any reports; see
+	// EmptyUploads.
+	emptyUploads int64
+
+	// Nonzero while accept-and-drop mode is on.
+	acceptAndDrop int32
+
 	processors []ReportProcessor
+	infos      []ProcessorInfo
+	sources    []processorSource
+	skipped    []SkippedProcessor
+	stages     []*stage
+	parsers    map[string]PayloadParser
 	clock      Clock
 	c          chan *ReportBatch
+	numWorkers int
 	wg         *sync.WaitGroup
+
+	// If set, uploads can also use GET, with their payload in this query
+	// parameter; see PipelineConfig.GetParameter.
+	getParameter string
+
+	// If nonzero, uploads are rejected once the queue is more than this full;
+	// see PipelineConfig.BackpressureThreshold.
+	backpressureThreshold float64
+	maxRetryAfter         time.Duration
+
+	// The response to successful uploads; see PipelineConfig.SuccessStatus.
+	successStatus int
+	successBody   string
+
+	// If set, the response header that we send each upload's batch ID in; see
+	// PipelineConfig.BatchIDHeader.
+	batchIDHeader string
+
+	// If set, limits how many uploads ServeHTTP handles at once; see
+	// PipelineConfig.MaxConcurrentUploads.
+	uploads semaphore
+
+	// The fractions that RecommendedFractions scales, and the response header
+	// that it's sent in, if any; see PipelineConfig.LoadHintHeader.
+	successFraction float64
+	failureFraction float64
+	loadHintHeader  string
+
+	// If nonzero, the largest upload body that we accept; see
+	// PipelineConfig.MaxUploadBytes.
+	maxUploadBytes int64
+
+	// If set, uploads that don't contain any reports aren't processed; see
+	// PipelineConfig.EmptyUploads.
+	skipEmptyUploads bool
+
+	// If set, we record how long each processor takes; see
+	// PipelineConfig.RecordProcessorTimings.
+	recordTimings bool
+
+	// If set, we count the reports going into and out of each processor; see
+	// PipelineConfig.RecordProcessorCounts.
+	recordCounts bool
+	countsMu     sync.Mutex
+	counts       []*reportCounts
+
+	// If set, each batch is written to this log before it's queued, and marked
+	// as done once every processor has handled it; see UseWAL.  walOffsets
+	// holds the batches that are in flight.  walStop is closed when the
+	// pipeline starts draining, to stop ReplayWAL waiting for room in the
+	// queue.
+	wal        *WAL
+	walMu      sync.Mutex
+	walOffsets map[*ReportBatch]walBatch
+	walStop    chan struct{}
+
+	// walFrom is the pipeline that the log was borrowed from, until this one
+	// has loaded successfully; walLent is set once another pipeline has taken
+	// it over.  Either way, the log isn't ours to close.  See ReuseProcessors.
+	walFrom *Pipeline
+	walLent bool
+
+	// The timeouts for servers created by NewServer; see
+	// PipelineConfig.ReadTimeout.
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+
+	// If set, uploads from these proxies (or over a Unix domain socket) get
+	// their ClientIP from their X-Forwarded-For header; see
+	// PipelineConfig.TrustedProxies and TrustUnixSocket.
+	trustedProxies   []*net.IPNet
+	trustUnixSocket  bool
+	maxForwardedHops int
+
+	// If synchronous is set, ProcessReports runs the processors itself, rather
+	// than queueing the batch for a worker.
+	synchronous bool
+
+	// closing is set once the pipeline starts draining.  ProcessReports holds
+	// a read lock on mu while sending to c, so that once Drain has set closing
+	// (while holding the write lock), nothing else will be sent to c.
+	mu      sync.RWMutex
+	closing bool
+
+	// The indexes of any processors that have been taken over by another
+	// pipeline (see ReuseProcessors), and so mustn't be closed when this one
+	// is.  Guarded by mu.
+	lent map[int]bool
+
+	drainOnce  sync.Once
+	stagesOnce sync.Once
+	closeOnce  sync.Once
+}
+
+// A stage is a group of goroutines that runs a processor that was added with
+// AddProcessorWithConcurrency, along with the processors that follow it (up to
+// the next stage).
+type stage struct {
+	c  chan stageBatch
+	wg sync.WaitGroup
+}
+
+type stageBatch struct {
+	ctx   context.Context
+	batch *ReportBatch
 }
 
 // NewPipeline creates a new Pipeline with a specified buffer size
 // and number of workers.
 func NewPipeline(bufferSize int64, numWorkers int) *Pipeline {
-	return setupPipeline(context.Background(), nil, bufferSize, numWorkers)
+	return NewPipelineWithConfig(PipelineConfig{BufferSize: bufferSize, NumWorkers: numWorkers})
+}
+
+// NewPipelineWithConfig creates a new Pipeline with the specified settings.
+// Any settings that are zero get their default values.
+func NewPipelineWithConfig(config PipelineConfig) *Pipeline {
+	return setupPipeline(context.Background(), nil, config.withDefaults())
 }
 
 const defaultBufferSize = 1000
@@ -79,78 +278,803 @@ func NewTestPipeline(clock Clock) *Pipeline {
 // NewTestPipelineWithBuffer creates a new Pipeline with a specified buffer size and clock.
 // This should only be used for testing.
 func NewTestPipelineWithBuffer(clock Clock, bufferSize int64) *Pipeline {
-	return setupPipeline(context.Background(), clock, bufferSize, defaultNumWorkers)
+	return NewTestPipelineWithConfig(clock, PipelineConfig{BufferSize: bufferSize})
+}
+
+// NewTestPipelineWithConfig creates a new Pipeline with the specified settings
+// and clock.  This should only be used for testing.
+func NewTestPipelineWithConfig(clock Clock, config PipelineConfig) *Pipeline {
+	return setupPipeline(context.Background(), clock, config.withDefaults())
+}
+
+// NewSynchronousPipeline creates a new Pipeline that doesn't have a queue or
+// any workers; instead, ProcessReports runs all of the processors against each
+// upload before it returns.  (ProcessUpload then returns the batch after every
+// processor has seen it.)  This makes the results of tests deterministic, but
+// means that a slow processor delays the response to the upload, so it should
+// only be used for testing.
+func NewSynchronousPipeline(clock Clock) *Pipeline {
+	p := setupPipeline(context.Background(), clock, PipelineConfig{})
+	p.synchronous = true
+	return p
+}
+
+// Synchronous returns whether the pipeline runs its processors within
+// ProcessReports; see NewSynchronousPipeline.
+func (p *Pipeline) Synchronous() bool {
+	return p.synchronous
 }
 
-func setupPipeline(ctx context.Context, clock Clock, bufferSize int64, numWorkers int) *Pipeline {
+func setupPipeline(ctx context.Context, clock Clock, config PipelineConfig) *Pipeline {
 	p := &Pipeline{
-		clock: clock,
-		c:     make(chan *ReportBatch, bufferSize),
-		wg:    &sync.WaitGroup{},
+		clock:        clock,
+		c:            make(chan *ReportBatch, config.BufferSize),
+		numWorkers:   config.NumWorkers,
+		wg:           &sync.WaitGroup{},
+		getParameter: config.GetParameter,
+
+		backpressureThreshold: config.BackpressureThreshold,
+		maxRetryAfter:         config.MaxRetryAfter.Duration,
+		successStatus:         config.SuccessStatus,
+		successBody:           config.SuccessBody,
+		batchIDHeader:         config.BatchIDHeader,
+		maxUploadBytes:        config.MaxUploadBytes,
+		successFraction:       config.SuccessFraction,
+		failureFraction:       config.FailureFraction,
+		loadHintHeader:        config.LoadHintHeader,
+		skipEmptyUploads:      config.EmptyUploads == "skip",
+
+		recordTimings: config.RecordProcessorTimings,
+		recordCounts:  config.RecordProcessorCounts,
+
+		readTimeout:       config.ReadTimeout.Duration,
+		readHeaderTimeout: config.ReadHeaderTimeout.Duration,
+		writeTimeout:      config.WriteTimeout.Duration,
+		idleTimeout:       config.IdleTimeout.Duration,
+		maxHeaderBytes:    config.MaxHeaderBytes,
+
+		trustUnixSocket:  config.TrustUnixSocket,
+		maxForwardedHops: config.MaxForwardedHops,
+	}
+	// ParsePipelineConfig has already checked that these are valid.
+	p.trustedProxies, _ = parseTrustedProxies(config.TrustedProxies)
+	if config.MaxConcurrentUploads > 0 {
+		p.uploads = make(semaphore, config.MaxConcurrentUploads)
+	}
+	reports := DefaultPayloadParser
+	if config.MaxReportsPerBatch > 0 || config.MalformedReports == "skip" || config.MaxJSONDepth != DefaultMaxJSONDepth {
+		reports = ReportBatchParser{
+			MaxReports: config.MaxReportsPerBatch,
+			Truncate:   config.OversizedBatches == "truncate",
+			Tolerant:   config.MalformedReports == "skip",
+			MaxDepth:   config.MaxJSONDepth,
+		}
+	}
+	for _, mediaType := range ReportMediaTypes {
+		p.RegisterPayloadParser(mediaType, reports)
+	}
+	if config.MultipartField != "" {
+		p.RegisterPayloadParser("multipart/form-data", MultipartParser{
+			Field:    config.MultipartField,
+			MaxBytes: config.MaxMultipartBytes,
+			Reports:  reports,
+		})
 	}
-	for i := 0; i < numWorkers; i++ {
+	if config.AcceptCBOR {
+		p.RegisterPayloadParser(CBORMediaType, CBORParser{
+			MaxBytes: config.MaxCBORBytes,
+			Reports:  reports,
+		})
+	}
+	work := p.c
+	if config.CoalesceReports > 0 {
+		work = make(chan *ReportBatch)
 		p.wg.Add(1)
 		go func() {
 			defer p.wg.Done()
-			for reports := range p.c {
-				for _, publisher := range p.processors {
-					publisher.ProcessReports(ctx, reports)
-				}
+			coalesce(p.c, work, config.CoalesceReports, config.CoalesceDelay.Duration)
+		}()
+	}
+	for i := 0; i < config.NumWorkers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for reports := range work {
+				p.runProcessors(ctx, reports, 0, nil)
 			}
 		}()
 	}
 	return p
 }
 
+// Clock returns the clock that the pipeline uses to timestamp each batch of
+// reports.
+func (p *Pipeline) Clock() Clock {
+	if p.clock == nil {
+		return defaultClock
+	}
+	return p.clock
+}
+
+// BufferSize returns the number of report batches that can be queued up
+// waiting for a worker before new uploads start being dropped.
+func (p *Pipeline) BufferSize() int {
+	return cap(p.c)
+}
+
+// NumWorkers returns the number of workers that process queued report batches.
+func (p *Pipeline) NumWorkers() int {
+	return p.numWorkers
+}
+
+// MaxUploadBytes returns the largest upload body that the pipeline accepts, or
+// 0 if there's no limit.
+func (p *Pipeline) MaxUploadBytes() int64 {
+	return p.maxUploadBytes
+}
+
+// NewServer creates an HTTP server that listens on addr and serves requests
+// using handler (which will usually route uploads to the pipeline), with the
+// timeouts and header size limit from the pipeline's settings.  Without
+// timeouts, a slow client can tie up a connection indefinitely while we wait
+// for its upload.  As with any http.Server, call Shutdown to stop it
+// gracefully.
+func (p *Pipeline) NewServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       p.readTimeout,
+		ReadHeaderTimeout: p.readHeaderTimeout,
+		WriteTimeout:      p.writeTimeout,
+		IdleTimeout:       p.idleTimeout,
+		MaxHeaderBytes:    p.maxHeaderBytes,
+	}
+}
+
 // AddProcessor adds a new processor to the pipeline.
 func (p *Pipeline) AddProcessor(processor ReportProcessor) {
 	p.processors = append(p.processors, processor)
+	p.infos = append(p.infos, ProcessorInfo{Type: fmt.Sprintf("%T", processor)})
+	p.sources = append(p.sources, processorSource{})
+}
+
+// ReportMediaTypes are the media types that a new Pipeline parses using the
+// standard format defined by the Reporting spec (see DefaultPayloadParser).
+var ReportMediaTypes = []string{"application/reports+json", "application/report"}
+
+// AddProcessorWithConcurrency adds a new processor to the pipeline, which runs
+// in its own group of n goroutines instead of in the pipeline's workers.  When
+// a batch reaches this processor, it's handed off to one of those goroutines,
+// which runs this processor and any processors after it, up to the next one
+// that was added with AddProcessorWithConcurrency.  That lets you run a slow
+// processor (one that publishes reports over the network, say) with more
+// concurrency than a CPU-bound one, without the fast processors having to wait
+// for it.  If all n goroutines are busy, the batch waits for one of them to
+// become free, so that a slow stage eventually fills the pipeline's queue,
+// rather than holding an unbounded number of batches in memory.
+func (p *Pipeline) AddProcessorWithConcurrency(processor ReportProcessor, n int) {
+	if n < 1 {
+		n = 1
+	}
+	s := &stage{c: make(chan stageBatch)}
+	index := len(p.processors)
+	p.AddProcessor(processor)
+	for len(p.stages) < index {
+		p.stages = append(p.stages, nil)
+	}
+	p.stages = append(p.stages, s)
+	p.infos[index].Concurrency = n
+
+	s.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer s.wg.Done()
+			for item := range s.c {
+				p.runProcessors(item.ctx, item.batch, index, s)
+			}
+		}()
+	}
+}
+
+// ProcessBatch runs all of the processors in the pipeline against a batch of
+// reports, in the calling goroutine, and returns the processed batch once
+// they've all finished.  The batch is modified in place (the result is the
+// same pointer), and any reports that the processors dropped are gone from its
+// Reports.  This bypasses the pipeline's queue and workers (and any stages
+// added with AddProcessorWithConcurrency), as well as its write-ahead log,
+// which makes it useful for tests, and lets you use a configured pipeline as a
+// library for reports that don't arrive over HTTP, such as ones read from a
+// message queue or replayed from a file.
+//
+// ProcessBatch can be called from several goroutines at once, and alongside
+// the pipeline's own workers, since the processors already have to cope with
+// being run concurrently by those workers.  Each call needs a batch of its
+// own, though; and since nothing is queued, the pipeline's buffer size and
+// draining don't apply, so callers have to provide their own backpressure,
+// and stop calling ProcessBatch before closing the pipeline.
+func (p *Pipeline) ProcessBatch(ctx context.Context, batch *ReportBatch) *ReportBatch {
+	for index := range p.processors {
+		p.runProcessor(ctx, batch, index)
+	}
+	return batch
+}
+
+// runProcessor runs the processor at index against a batch, recording how long
+// it took if RecordProcessorTimings is set, and how many reports it kept if
+// RecordProcessorCounts is set.  If the processor panics, we log the panic and
+// carry on (see Panics), so that one bad batch can't kill the worker that's
+// processing it.
+func (p *Pipeline) runProcessor(ctx context.Context, batch *ReportBatch, index int) {
+	defer p.recoverProcessor(batch, index)
+	var start time.Time
+	if p.recordTimings {
+		start = p.Clock().Now()
+	}
+	before := len(batch.Reports)
+	if p.wal != nil {
+		if err := TryProcessReports(ctx, p.processors[index], batch); err != nil {
+			log.Printf("Processor %d (%s) failed: %v", index, p.infos[index].Type, err)
+			p.walFail(batch)
+		}
+	} else {
+		p.processors[index].ProcessReports(ctx, batch)
+	}
+	if p.recordCounts {
+		p.countsAt(index).add(before, len(batch.Reports))
+	}
+	if !p.recordTimings {
+		return
+	}
+	elapsed := p.Clock().Now().Sub(start)
+	timings, ok := batch.GetAnnotation("ProcessorTimings").(map[string]time.Duration)
+	if !ok {
+		timings = make(map[string]time.Duration)
+		batch.SetAnnotation("ProcessorTimings", timings)
+	}
+	timings[fmt.Sprintf("%d:%s", index, p.infos[index].Type)] = elapsed
+}
+
+// reportCounts are the running totals of the reports that have gone into and
+// come out of a processor.
+type reportCounts struct {
+	in, out, dropped int64
+}
+
+func (c *reportCounts) add(in, out int) {
+	atomic.AddInt64(&c.in, int64(in))
+	atomic.AddInt64(&c.out, int64(out))
+	if out < in {
+		atomic.AddInt64(&c.dropped, int64(in-out))
+	}
+}
+
+// countsAt returns the counts for the processor at index.
+func (p *Pipeline) countsAt(index int) *reportCounts {
+	p.countsMu.Lock()
+	defer p.countsMu.Unlock()
+	for len(p.counts) <= index {
+		p.counts = append(p.counts, &reportCounts{})
+	}
+	return p.counts[index]
+}
+
+// ProcessorCounts is the number of reports that have gone into and come out of
+// one of the pipeline's processors; see Pipeline.ProcessorCounts.
+type ProcessorCounts struct {
+	// The processor's position in the pipeline, and its type, as in
+	// ProcessorInfo.
+	Index int
+	Type  string
+
+	// The total number of reports in the batches that the processor has been
+	// given, and in those batches once it returned.
+	In  int64
+	Out int64
+
+	// The number of reports that the processor removed.  Processors that add
+	// reports to some batches, while removing them from others, can remove
+	// more than In-Out.
+	Dropped int64
+}
+
+// ProcessorCounts returns the number of reports that have gone into and come
+// out of each of the pipeline's processors, in order, which shows how much
+// each filter or sampler removes.  It only has any counts if
+// PipelineConfig.RecordProcessorCounts is set.  Processors inside another
+// processor's nested chain aren't counted separately.
+func (p *Pipeline) ProcessorCounts() []ProcessorCounts {
+	if !p.recordCounts {
+		return nil
+	}
+	result := make([]ProcessorCounts, len(p.infos))
+	for index, info := range p.infos {
+		counts := p.countsAt(index)
+		result[index] = ProcessorCounts{
+			Index:   index,
+			Type:    info.Type,
+			In:      atomic.LoadInt64(&counts.in),
+			Out:     atomic.LoadInt64(&counts.out),
+			Dropped: atomic.LoadInt64(&counts.dropped),
+		}
+	}
+	return result
+}
+
+// recoverProcessor recovers from a panic in the processor at index, logging it
+// along with the batch that caused it.  It must be deferred directly.
+func (p *Pipeline) recoverProcessor(batch *ReportBatch, index int) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	atomic.AddInt64(&p.panics, 1)
+	p.walFail(batch)
+	encoded, err := MarshalBatch(batch)
+	if err != nil {
+		encoded = []byte(fmt.Sprintf("(couldn't encode batch: %v)", err))
+	}
+	log.Printf("Processor %d (%s) panicked: %v\nBatch: %s\n%s", index, p.infos[index].Type, recovered, encoded, debug.Stack())
+}
+
+// Panics returns the number of times that a processor has panicked while
+// processing a batch.  Each panic is logged, and the batch carries on to the
+// next processor, as if the one that panicked had returned.  (The batch may be
+// only partly processed, though.)
+func (p *Pipeline) Panics() int64 {
+	return atomic.LoadInt64(&p.panics)
+}
+
+// stageAt returns the stage that runs the processor at index, or nil if it's
+// run by whichever goroutine ran the processor before it.
+func (p *Pipeline) stageAt(index int) *stage {
+	if index < len(p.stages) {
+		return p.stages[index]
+	}
+	return nil
+}
+
+// runProcessors runs the processors in the pipeline against a batch, starting
+// from the processor at index, until the batch needs to be handed off to a
+// different stage.  current is the stage that's calling runProcessors, or nil
+// for one of the pipeline's workers.
+func (p *Pipeline) runProcessors(ctx context.Context, batch *ReportBatch, index int, current *stage) {
+	for ; index < len(p.processors); index++ {
+		if s := p.stageAt(index); s != nil && s != current {
+			s.c <- stageBatch{ctx, batch}
+			return
+		}
+		p.runProcessor(ctx, batch, index)
+	}
+	p.walDone(batch)
+}
+
+// RegisterPayloadParser registers a parser that extracts reports from uploads
+// with a particular media type.  This lets you accept payloads in formats other
+// than the standard one defined by the Reporting spec, or replace the parser
+// for one of the ReportMediaTypes.  Any parameters in the Content-Type of an
+// upload (such as its charset) are ignored when choosing its parser.
+func (p *Pipeline) RegisterPayloadParser(mediaType string, parser PayloadParser) {
+	if p.parsers == nil {
+		p.parsers = make(map[string]PayloadParser)
+	}
+	p.parsers[strings.ToLower(mediaType)] = parser
+}
+
+// payloadParser returns the parser registered for the media type of a
+// Content-Type header, or nil if there isn't one.
+func (p *Pipeline) payloadParser(contentType string) PayloadParser {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	return p.parsers[mediaType]
 }
 
 // ErrDropped is returned from ProcessReports when the queue is full and the report is dropped.
 var ErrDropped = errors.New("queue full, report dropped")
 
+// ErrDraining is returned from ProcessReports when the pipeline is draining
+// (see Drain), and the report is rejected.
+var ErrDraining = errors.New("pipeline draining, report rejected")
+
+// ErrBackpressure is returned from ProcessReports when the queue is backed up
+// (see PipelineConfig.BackpressureThreshold), and the report is rejected.
+var ErrBackpressure = errors.New("queue backed up, report rejected")
+
+// isDraining returns whether the pipeline has started draining.
+func (p *Pipeline) isDraining() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.closing
+}
+
+// retryAfter returns how long a client should wait before uploading again,
+// based on how full the queue is, or 0 if the queue isn't backed up.
+func (p *Pipeline) retryAfter() time.Duration {
+	if p.backpressureThreshold == 0 || p.synchronous || cap(p.c) == 0 {
+		return 0
+	}
+	occupancy := float64(len(p.c)) / float64(cap(p.c))
+	if occupancy <= p.backpressureThreshold {
+		return 0
+	}
+	scale := (occupancy - p.backpressureThreshold) / (1 - p.backpressureThreshold)
+	retryAfter := time.Duration(scale * float64(p.maxRetryAfter))
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return retryAfter
+}
+
+// enqueue adds a batch to the queue (or processes it immediately, in a
+// synchronous pipeline), unless the queue is full or the pipeline has started
+// draining.
+func (p *Pipeline) enqueue(ctx context.Context, reports *ReportBatch) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closing {
+		return ErrDraining
+	}
+	if p.wal != nil {
+		offset, err := p.wal.Append(reports)
+		if err != nil {
+			log.Printf("Error writing to write-ahead log: %v", err)
+			return ErrWAL
+		}
+		p.walStart(reports, offset)
+	}
+	if p.synchronous {
+		p.ProcessBatch(ctx, reports)
+		p.walDone(reports)
+		return nil
+	}
+	select {
+	case p.c <- reports:
+		return nil
+	default:
+		// The client is told to try again, so we don't keep the batch in
+		// the log; replaying it as well would only duplicate it.
+		p.walDone(reports)
+		return ErrDropped
+	}
+}
+
+// UseWAL makes the pipeline write each batch that it accepts to a write-ahead
+// log before queueing it, and mark it as done in the log once every processor
+// has handled it.  Uploads that can't be written to the log, or that can't be
+// queued because the queue is full, are rejected with a 503 status code.  (A
+// batch that's rejected because the queue is full is marked as done, since the
+// client will upload it again.)
+//
+// A batch that a processor panics on, or that a FallibleReportProcessor fails
+// to handle, is passed to WAL.Fail once the rest of the processors have
+// handled it, which saves it in the log's file of failed batches rather than
+// replaying it.  Batches that were still in flight when the collector stopped
+// are processed again the next time that the log is opened.  (So processors
+// see each batch at least once, rather than exactly once.)  Call ReplayWAL
+// once the pipeline's processors have been added, to process any batches that
+// weren't done when the log was last closed.  The pipeline closes the log
+// when it's closed.
+//
+// This can't be used with PipelineConfig.CoalesceReports, since a combined
+// batch wouldn't know the offsets of the uploads that went into it; nor
+// should it be called while the pipeline is handling uploads.
+func (p *Pipeline) UseWAL(wal *WAL) {
+	p.wal = wal
+	p.walOffsets = make(map[*ReportBatch]walBatch)
+	p.walStop = make(chan struct{})
+}
+
+// ReplayWAL queues the batches in the pipeline's write-ahead log (see UseWAL)
+// that weren't done when it was last closed, waiting for room in the queue if
+// needed, and returns how many there were.
+func (p *Pipeline) ReplayWAL(ctx context.Context) int {
+	if p.wal == nil {
+		return 0
+	}
+	entries := p.wal.Replay()
+	for i, entry := range entries {
+		// Whatever's left when the pipeline starts draining stays in the log
+		// for next time.
+		if !p.replayEntry(ctx, entry) {
+			return i
+		}
+	}
+	return len(entries)
+}
+
+// replayEntry queues a batch from the write-ahead log, or processes it
+// immediately in a synchronous pipeline.  It returns false if the pipeline
+// started draining first.  We hold p.mu while sending to the queue, since
+// Drain closes it, so we also give up waiting once walStop is closed; otherwise
+// Drain would never get the lock.
+func (p *Pipeline) replayEntry(ctx context.Context, entry WALEntry) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closing {
+		return false
+	}
+	p.walStart(entry.Batch, entry.Offset)
+	if p.synchronous {
+		p.ProcessBatch(ctx, entry.Batch)
+		p.walDone(entry.Batch)
+		return true
+	}
+	select {
+	case p.c <- entry.Batch:
+		return true
+	case <-p.walStop:
+		p.walForget(entry.Batch)
+		return false
+	}
+}
+
+// walBatch is the write-ahead log offset of a batch that's in flight, and
+// whether any processor has failed to handle it.
+type walBatch struct {
+	offset uint64
+	failed bool
+}
+
+// walStart records the write-ahead log offset of a batch that's about to be
+// processed.
+func (p *Pipeline) walStart(batch *ReportBatch, offset uint64) {
+	p.walMu.Lock()
+	p.walOffsets[batch] = walBatch{offset: offset}
+	p.walMu.Unlock()
+}
+
+// walFail records that a processor failed to handle a batch, so that it's
+// saved as failed in the write-ahead log, rather than just being marked as
+// done.
+func (p *Pipeline) walFail(batch *ReportBatch) {
+	if p.wal == nil {
+		return
+	}
+	p.walMu.Lock()
+	if b, ok := p.walOffsets[batch]; ok {
+		b.failed = true
+		p.walOffsets[batch] = b
+	}
+	p.walMu.Unlock()
+}
+
+// walForget stops tracking a batch without marking it as done, so that it
+// stays in the write-ahead log, and is replayed the next time that the log is
+// opened.
+func (p *Pipeline) walForget(batch *ReportBatch) (walBatch, bool) {
+	if p.wal == nil {
+		return walBatch{}, false
+	}
+	p.walMu.Lock()
+	defer p.walMu.Unlock()
+	b, ok := p.walOffsets[batch]
+	delete(p.walOffsets, batch)
+	return b, ok
+}
+
+// walDone marks a batch as done in the write-ahead log, if there is one, or as
+// failed if a processor failed to handle it.
+func (p *Pipeline) walDone(batch *ReportBatch) {
+	b, ok := p.walForget(batch)
+	if !ok {
+		return
+	}
+	if b.failed {
+		if err := p.wal.Fail(b.offset); err != nil {
+			log.Printf("Error saving failed batch in write-ahead log: %v", err)
+		}
+		return
+	}
+	if err := p.wal.Done(b.offset); err != nil {
+		log.Printf("Error updating write-ahead log checkpoint: %v", err)
+	}
+}
+
 // ProcessReports extracts reports from a POST upload payload, as defined by the
 // Reporting spec, and runs all of the processors in the pipeline against each
-// report. Returns ErrDropped if the request was dropped due to a full queue and nil
-// on success. All other errors indicate something wrong with the request.
+// report. Returns ErrDropped if the request was dropped due to a full queue,
+// ErrDraining if it was rejected because the pipeline is draining,
+// ErrBackpressure if it was rejected because the queue is backed up,
+// ErrAbsorbed if it was discarded because of SetAcceptAndDrop, ErrEmptyUpload
+// if it didn't contain any reports and PipelineConfig.EmptyUploads is "skip",
+// ErrWAL if it couldn't be written to the write-ahead log (see UseWAL), and
+// nil on success. All other errors indicate something wrong with the request.
 func (p *Pipeline) ProcessReports(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	if r.Method != "POST" {
+	_, err := p.ProcessUpload(ctx, w, r)
+	return err
+}
+
+// ProcessUpload is like ProcessReports, but also returns the batch of reports
+// that was extracted from the upload, if there was one.  In a synchronous
+// pipeline (see NewSynchronousPipeline), every processor has already run
+// against the batch; otherwise, the batch has just been queued, and you
+// shouldn't touch it, since a worker might be processing it.
+func (p *Pipeline) ProcessUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) (*ReportBatch, error) {
+	if r.Method == "GET" && p.getParameter != "" {
+		var err error
+		r, err = p.getUploadRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, err
+		}
+	} else if r.Method != "POST" {
 		http.Error(w, "Must use POST to upload reports", http.StatusMethodNotAllowed)
-		return fmt.Errorf("Must use POST to upload reports")
+		return nil, fmt.Errorf("Must use POST to upload reports")
+	}
+
+	if p.isDraining() {
+		http.Error(w, "Collector is shutting down", http.StatusServiceUnavailable)
+		return nil, ErrDraining
+	}
+
+	if retryAfter := p.retryAfter(); retryAfter > 0 && !p.AcceptAndDrop() {
+		seconds := (retryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+		http.Error(w, "Collector is overloaded", http.StatusServiceUnavailable)
+		return nil, ErrBackpressure
 	}
 
 	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/reports+json" {
-		http.Error(w, "Must use application/reports+json to upload reports", http.StatusBadRequest)
-		return fmt.Errorf("Must use application/reports+json to upload reports")
+	parser := p.payloadParser(contentType)
+	if parser == nil {
+		http.Error(w, "Unsupported Content-Type for reports", http.StatusUnsupportedMediaType)
+		return nil, fmt.Errorf("Unsupported Content-Type %q for reports", contentType)
 	}
 
-	clock := p.clock
-	if clock == nil {
-		clock = defaultClock
+	var limiter *uploadBodyLimiter
+	if p.maxUploadBytes > 0 {
+		// A chunked upload doesn't have a Content-Length, so we can't rely on
+		// this check alone; limitUploadBody also counts the bytes as they're
+		// read.
+		if r.ContentLength > p.maxUploadBytes {
+			err := PayloadTooLargeError{p.maxUploadBytes}
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return nil, err
+		}
+		limiter = limitUploadBody(w, r.Body, p.maxUploadBytes)
+		r.Body = limiter
 	}
 
-	reports, err := NewReportBatch(r, clock)
+	reports, err := parser.Parse(r, p.Clock())
 	if err != nil {
+		if limiter != nil && limiter.exceeded {
+			err = PayloadTooLargeError{p.maxUploadBytes}
+		}
+		switch err.(type) {
+		case TooManyReportsError, PayloadTooLargeError:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return nil, err
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		return err
+		return nil, err
 	}
 
-	// 204 isn't an error, per-se, but this does the right thing.
-	http.Error(w, "", http.StatusNoContent)
+	if socket := p.trustUnixSocket && fromUnixSocket(r); socket || len(p.trustedProxies) > 0 {
+		reports.ClientIP = forwardedClientIP(reports.ClientIP, socket, r.Header, p.trustedProxies, p.maxForwardedHops)
+	}
 
-	select {
-	case p.c <- reports:
-		return nil
-	default:
-		return ErrDropped
+	if len(reports.Reports) == 0 {
+		atomic.AddInt64(&p.emptyUploads, 1)
+		if p.skipEmptyUploads {
+			p.writeSuccess(w)
+			return reports, ErrEmptyUpload
+		}
+	}
+
+	if p.AcceptAndDrop() {
+		atomic.AddInt64(&p.absorbed, int64(len(reports.Reports)))
+		p.writeSuccess(w)
+		return reports, ErrAbsorbed
 	}
+
+	// The batch ID has to be in place before the batch is queued, since a
+	// worker might pick it up straight away.
+	var batchID string
+	if p.batchIDHeader != "" {
+		batchID = newBatchID()
+		reports.SetAnnotation("BatchID", batchID)
+	}
+
+	err = p.enqueue(ctx, reports)
+	if err == ErrDraining {
+		http.Error(w, "Collector is shutting down", http.StatusServiceUnavailable)
+		return reports, err
+	}
+	if err == ErrWAL {
+		http.Error(w, "Couldn't save reports", http.StatusServiceUnavailable)
+		return reports, err
+	}
+	if err == ErrDropped && p.wal != nil {
+		// We've dropped the batch, so the client should try again.
+		http.Error(w, "Collector is overloaded", http.StatusServiceUnavailable)
+		return reports, err
+	}
+
+	if batchID != "" {
+		w.Header().Set(p.batchIDHeader, batchID)
+	}
+	p.writeSuccess(w)
+	return reports, err
+}
+
+// newBatchID returns a random ID for a batch of reports; see
+// PipelineConfig.BatchIDHeader.
+func newBatchID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// crypto/rand shouldn't ever fail, and a less random ID is better than
+		// none.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// writeSuccess responds to a successful upload.
+func (p *Pipeline) writeSuccess(w http.ResponseWriter) {
+	if p.loadHintHeader != "" {
+		w.Header().Set(p.loadHintHeader, p.loadHint())
+	}
+	status := p.successStatus
+	if status == 0 {
+		status = http.StatusNoContent
+	}
+	if status == http.StatusNoContent {
+		// 204 isn't an error, per-se, but this does the right thing.
+		http.Error(w, "", http.StatusNoContent)
+		return
+	}
+	if p.successBody == "" {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, p.successBody)
+}
+
+// getUploadRequest converts a GET upload, whose payload is base64-encoded in a
+// query parameter, into the equivalent POST upload, so that it can go through
+// the usual parsing.  The payload is removed from the new request's URL.
+func (p *Pipeline) getUploadRequest(r *http.Request) (*http.Request, error) {
+	query := r.URL.Query()
+	encoded := query.Get(p.getParameter)
+	if encoded == "" {
+		return nil, fmt.Errorf("Missing %q query parameter", p.getParameter)
+	}
+	// Accept both the standard and URL-safe base64 alphabets, with or without
+	// padding.  A "+" that wasn't escaped in the query string arrives as a
+	// space.
+	encoded = strings.NewReplacer("+", "-", " ", "-", "/", "_").Replace(strings.TrimRight(encoded, "="))
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base64 in %q query parameter: %v", p.getParameter, err)
+	}
+
+	// We change the new request's URL and headers, so it needs its own copies
+	// of them.
+	post := r.WithContext(r.Context())
+	postURL := *r.URL
+	post.URL = &postURL
+	post.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		post.Header[name] = append([]string(nil), values...)
+	}
+	post.Method = "POST"
+	query.Del(p.getParameter)
+	post.URL.RawQuery = query.Encode()
+	post.RequestURI = ""
+	post.Header.Set("Content-Type", ReportMediaTypes[0])
+	post.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	post.ContentLength = int64(len(payload))
+	return post, nil
 }
 
 // serveCORS handles OPTIONS requests by allowing POST requests with a
-// Content-Type header from any origin.
-func serveCORS(w http.ResponseWriter, r *http.Request) {
+// Content-Type header from any origin.  The response is dated by clock, which
+// is the pipeline's.
+func serveCORS(w http.ResponseWriter, r *http.Request, clock Clock) {
+	setDate(w, clock)
 	w.Header().Set("Access-Control-Allow-Methods", "POST")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -160,19 +1084,120 @@ func serveCORS(w http.ResponseWriter, r *http.Request) {
 // off to ProcessReports for processing.
 func (p *Pipeline) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "OPTIONS" {
-		serveCORS(w, r)
+		serveCORS(w, r, p.Clock())
 		return
 	}
+	if p.uploads != nil {
+		if !p.uploads.tryAcquire() {
+			rejectOverloaded(w, p.Clock())
+			return
+		}
+		defer p.uploads.release()
+	}
 	ctx := r.Context()
 	p.ProcessReports(ctx, w, r)
 }
 
+// ErrAbsorbed is returned from ProcessReports when the pipeline is in
+// accept-and-drop mode (see SetAcceptAndDrop), and the report was discarded
+// even though the client was told that it succeeded.
+var ErrAbsorbed = errors.New("accept-and-drop mode, report discarded")
+
+// ErrEmptyUpload is returned from ProcessReports when an upload didn't contain
+// any reports, and so wasn't processed, even though the client was told that
+// it succeeded; see PipelineConfig.EmptyUploads.
+var ErrEmptyUpload = errors.New("upload contains no reports, not processed")
+
+// SetAcceptAndDrop turns accept-and-drop mode on or off.  While it's on, every
+// upload that we can parse gets the usual success response, but its reports
+// are discarded without being queued or processed.  That's useful during an
+// incident, when you want clients to stop sending (or retrying) reports
+// without the processors having to handle them; unlike Drain, which rejects
+// uploads, this tells clients that their uploads succeeded, so that they
+// don't retry them.  It's safe to call at any time; uploads that are already
+// queued are processed as usual.
+func (p *Pipeline) SetAcceptAndDrop(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&p.acceptAndDrop, value)
+}
+
+// AcceptAndDrop returns whether accept-and-drop mode is on; see
+// SetAcceptAndDrop.
+func (p *Pipeline) AcceptAndDrop() bool {
+	return atomic.LoadInt32(&p.acceptAndDrop) != 0
+}
+
+// Absorbed returns the number of reports that have been discarded because
+// accept-and-drop mode was on.
+func (p *Pipeline) Absorbed() int64 {
+	return atomic.LoadInt64(&p.absorbed)
+}
+
+// EmptyUploads returns the number of uploads that didn't contain any reports
+// (such as an empty JSON array), whether or not they were processed.
+func (p *Pipeline) EmptyUploads() int64 {
+	return atomic.LoadInt64(&p.emptyUploads)
+}
+
+// Drain stops the pipeline from accepting new uploads; from now on,
+// ProcessReports responds to them with a 503 status code, so that a load
+// balancer will send them to another collector.  It then waits until every
+// upload that was already queued has been processed.  It's safe to call Drain
+// while other goroutines are calling ProcessReports, and to call it more than
+// once.
+func (p *Pipeline) Drain() {
+	p.drainOnce.Do(func() {
+		if p.walStop != nil {
+			close(p.walStop)
+		}
+		p.mu.Lock()
+		p.closing = true
+		p.mu.Unlock()
+		close(p.c)
+	})
+	p.wg.Wait()
+	// Each stage only hands batches on to later stages, so we can shut them
+	// down in order.
+	p.stagesOnce.Do(func() {
+		for _, s := range p.stages {
+			if s != nil {
+				close(s.c)
+				s.wg.Wait()
+			}
+		}
+	})
+}
+
 // Close stops the processing, such that anything in the queue
-// gets processed, but nothing is added. It then waits until all
-// processing workers have completed. All calls to ProcessReports
-// must complete before Close is called, otherwise it will cause
-// a panic.
+// gets processed, but nothing is added (see Drain). It then waits until all
+// processing workers have completed, and closes any processors
+// that implement ReportProcessorCloser (except for any that another pipeline
+// has taken over; see ReuseProcessors). It's safe to call Close while
+// requests are still being handled by ServeHTTP or ProcessReports; any
+// that haven't queued their reports yet get a 503 response. Calling Close
+// more than once has no further effect.
 func (p *Pipeline) Close() {
-	close(p.c)
-	p.wg.Wait()
+	p.Drain()
+	p.closeOnce.Do(func() {
+		p.mu.RLock()
+		var owned []ReportProcessor
+		for i, processor := range p.processors {
+			if !p.lent[i] {
+				owned = append(owned, processor)
+			}
+		}
+		ownsWAL := p.wal != nil && p.walFrom == nil && !p.walLent
+		p.mu.RUnlock()
+		if err := CloseProcessors(owned); err != nil {
+			log.Printf("Error closing pipeline processors: %v", err)
+		}
+		if ownsWAL {
+			if err := p.wal.Close(); err != nil {
+				log.Printf("Error closing write-ahead log: %v", err)
+			}
+		}
+	})
 }
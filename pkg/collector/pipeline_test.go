@@ -17,11 +17,24 @@ package collector_test
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/nel-collector/pkg/collector"
 	"github.com/google/nel-collector/pkg/pipelinetest"
 )
@@ -45,6 +58,9 @@ func TestRespondsToOptionsRequest(t *testing.T) {
 	if want, got := "*", response.Header().Get("Access-Control-Allow-Origin"); got != want {
 		t.Errorf("response.Header().Get(\"Access-Control-Allow-Origin\"): got %v, want %v", got, want)
 	}
+	if want, got := "Thu, 01 Jan 1970 00:00:00 GMT", response.Header().Get("Date"); got != want {
+		t.Errorf("response.Header().Get(\"Date\"): got %v, want %v", got, want)
+	}
 	if want, got := 200, response.Result().StatusCode; got != want {
 		t.Errorf("response.Result().StatusCode: got %v, want %v", got, want)
 	}
@@ -70,12 +86,1039 @@ func TestIgnoreWrongContentType(t *testing.T) {
 	request.Header.Add("Content-Type", "application/json")
 	var response httptest.ResponseRecorder
 	pipeline.ServeHTTP(&response, request)
-	if want := http.StatusBadRequest; response.Code != want {
+	if want := http.StatusUnsupportedMediaType; response.Code != want {
 		t.Errorf("ServeHTTP(Content-Type=application/json): got %d, wanted %d", response.Code, want)
 		return
 	}
 }
 
+func TestReportMediaTypes(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	for _, contentType := range []string{
+		"application/reports+json",
+		"application/report",
+		"application/reports+json; charset=utf-8",
+		"Application/Reports+JSON",
+	} {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", contentType)
+		var response httptest.ResponseRecorder
+		pipeline.ServeHTTP(&response, request)
+		if want := http.StatusNoContent; response.Code != want {
+			t.Errorf("ServeHTTP(Content-Type=%s): got %d, wanted %d", contentType, response.Code, want)
+		}
+	}
+}
+
+// envelopeParser parses reports that are wrapped in an object with some extra
+// fields.
+func envelopeParser(r *http.Request, clock collector.Clock) (*collector.ReportBatch, error) {
+	var envelope struct {
+		Source  string                `json:"source"`
+		Reports []collector.NelReport `json:"reports"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	batch := &collector.ReportBatch{Time: clock.Now(), Reports: envelope.Reports}
+	batch.SetAnnotation("Source", envelope.Source)
+	return batch, nil
+}
+
+type channelProcessor chan *collector.ReportBatch
+
+func (c channelProcessor) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	c <- batch
+}
+
+func TestCustomPayloadParser(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	c := make(channelProcessor, 1)
+	pipeline.AddProcessor(c)
+	pipeline.RegisterPayloadParser("application/x-envelope+json", collector.PayloadParserFunc(envelopeParser))
+
+	payload := `{"source": "internal", "reports": ` + string(testdata(validNelReportPath)) + `}`
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader([]byte(payload)))
+	request.Header.Add("Content-Type", "application/x-envelope+json")
+	var response httptest.ResponseRecorder
+	pipeline.ServeHTTP(&response, request)
+	if want := http.StatusNoContent; response.Code != want {
+		t.Fatalf("ServeHTTP(Content-Type=application/x-envelope+json): got %d, wanted %d", response.Code, want)
+	}
+
+	batch := <-c
+	if got, want := batch.GetAnnotation("Source"), "internal"; got != want {
+		t.Errorf("Source annotation: got %v, wanted %v", got, want)
+	}
+	if got, want := len(batch.Reports), 1; got != want {
+		t.Errorf("len(batch.Reports): got %d, wanted %d", got, want)
+	}
+
+	// The standard format should still be accepted.
+	request = httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+	request.Header.Add("Content-Type", "application/reports+json")
+	response = httptest.ResponseRecorder{}
+	pipeline.ServeHTTP(&response, request)
+	if want := http.StatusNoContent; response.Code != want {
+		t.Errorf("ServeHTTP(Content-Type=application/reports+json): got %d, wanted %d", response.Code, want)
+	}
+	<-c
+}
+
+// panicsOnClient is a processor that panics on batches from one client IP.
+type panicsOnClient string
+
+func (p panicsOnClient) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if batch.ClientIP == string(p) {
+		panic("bad batch")
+	}
+	batch.SetAnnotation("Survived", true)
+}
+
+func TestProcessorPanics(t *testing.T) {
+	// With a single worker, the second upload is only processed if the worker
+	// survives the first one.
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{NumWorkers: 1})
+	defer pipeline.Close()
+	pipeline.AddProcessor(panicsOnClient("192.0.2.1"))
+	c := make(channelProcessor, 2)
+	pipeline.AddProcessor(c)
+
+	for _, clientIP := range []string{"192.0.2.1", "192.0.2.2"} {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", "application/reports+json")
+		request.Header.Add("Referer", "https://"+clientIP+"/")
+		request.RemoteAddr = clientIP + ":1234"
+		var response httptest.ResponseRecorder
+		pipeline.ServeHTTP(&response, request)
+	}
+
+	// Both batches carry on to the next processor, but only the second was
+	// annotated.
+	for _, want := range []interface{}{nil, true} {
+		batch := <-c
+		if got := batch.GetAnnotation("Survived"); got != want {
+			t.Errorf("Batch from %s has Survived annotation %v, wanted %v", batch.ClientIP, got, want)
+		}
+	}
+	if got, want := pipeline.Panics(), int64(1); got != want {
+		t.Errorf("Panics() = %d, wanted %d", got, want)
+	}
+}
+
+func TestCoalesceReports(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+		CoalesceReports: 2,
+		CoalesceDelay:   collector.Duration{Duration: time.Hour},
+	})
+	c := make(channelProcessor, 2)
+	pipeline.AddProcessor(c)
+
+	upload := func(clientIP string) {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", "application/reports+json")
+		request.Header.Add("Referer", "https://"+clientIP+"/")
+		request.RemoteAddr = clientIP + ":1234"
+		var response httptest.ResponseRecorder
+		pipeline.ServeHTTP(&response, request)
+		if want := http.StatusNoContent; response.Code != want {
+			t.Fatalf("ServeHTTP: got %d, wanted %d", response.Code, want)
+		}
+	}
+
+	// The first two uploads should be combined into a single batch as soon as
+	// there are enough reports.
+	upload("192.0.2.1")
+	upload("192.0.2.2")
+	batch := <-c
+	if got, want := len(batch.Reports), 2; got != want {
+		t.Fatalf("len(batch.Reports): got %d, wanted %d", got, want)
+	}
+	if batch.ClientIP != "" {
+		t.Errorf("batch.ClientIP: got %v, wanted empty", batch.ClientIP)
+	}
+	for i, want := range []string{"192.0.2.1", "192.0.2.2"} {
+		if got := batch.Reports[i].GetAnnotation("ClientIP"); got != want {
+			t.Errorf("batch.Reports[%d] ClientIP annotation: got %v, wanted %v", i, got, want)
+		}
+		if got, want := batch.Reports[i].GetAnnotation("ClientReferrer"), "https://"+want+"/"; got != want {
+			t.Errorf("batch.Reports[%d] ClientReferrer annotation: got %v, wanted %v", i, got, want)
+		}
+		if got, want := batch.Reports[i].GetAnnotation("Host"), "example.com"; got != want {
+			t.Errorf("batch.Reports[%d] Host annotation: got %v, wanted %v", i, got, want)
+		}
+		// httptest fills in a TLS 1.2 connection for https URLs.
+		if got, ok := batch.Reports[i].GetAnnotation("TLS").(collector.TLSInfo); !ok || got.Version != "TLS 1.2" {
+			t.Errorf("batch.Reports[%d] TLS annotation: got %v, wanted TLS 1.2", i, got)
+		}
+	}
+
+	// Closing the pipeline should flush any partially filled batch.
+	upload("192.0.2.3")
+	pipeline.Close()
+	batch = <-c
+	if got, want := len(batch.Reports), 1; got != want {
+		t.Fatalf("len(batch.Reports): got %d, wanted %d", got, want)
+	}
+	if got, want := batch.Reports[0].GetAnnotation("ClientIP"), "192.0.2.3"; got != want {
+		t.Errorf("batch.Reports[0] ClientIP annotation: got %v, wanted %v", got, want)
+	}
+}
+
+func TestMaxReportsPerBatch(t *testing.T) {
+	payload := testdata("../pipelinetest/testdata/reports/multiple-valid-nel-reports.json")
+	var count []json.RawMessage
+	if err := json.Unmarshal(payload, &count); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{"reject", "truncate"} {
+		pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+			MaxReportsPerBatch: 1,
+			OversizedBatches:   mode,
+		})
+		c := make(channelProcessor, 2)
+		pipeline.AddProcessor(c)
+
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+		request.Header.Add("Content-Type", "application/reports+json")
+		var response httptest.ResponseRecorder
+		pipeline.ServeHTTP(&response, request)
+		pipeline.Close()
+
+		if mode == "reject" {
+			if want := http.StatusRequestEntityTooLarge; response.Code != want {
+				t.Errorf("ServeHTTP(%s): got %d, wanted %d", mode, response.Code, want)
+			}
+			if len(c) != 0 {
+				t.Errorf("ServeHTTP(%s) shouldn't process the rejected batch", mode)
+			}
+			continue
+		}
+
+		if want := http.StatusNoContent; response.Code != want {
+			t.Fatalf("ServeHTTP(%s): got %d, wanted %d", mode, response.Code, want)
+		}
+		batch := <-c
+		if got, want := len(batch.Reports), 1; got != want {
+			t.Errorf("ServeHTTP(%s) kept %d reports, wanted %d", mode, got, want)
+		}
+		if got, want := batch.GetAnnotation("OriginalReportCount"), len(count); got != want {
+			t.Errorf("ServeHTTP(%s) OriginalReportCount = %v, wanted %v", mode, got, want)
+		}
+	}
+}
+
+func TestMaxJSONDepth(t *testing.T) {
+	payload := []byte(`[{"type": "network-error", "body": ` + strings.Repeat("[", 10000) + strings.Repeat("]", 10000) + `}]`)
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{MaxJSONDepth: 16})
+	c := make(channelProcessor, 1)
+	pipeline.AddProcessor(c)
+
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+	request.Header.Add("Content-Type", "application/reports+json")
+	response := httptest.NewRecorder()
+	pipeline.ServeHTTP(response, request)
+	pipeline.Close()
+
+	if want := http.StatusBadRequest; response.Code != want {
+		t.Errorf("ServeHTTP: got %d, wanted %d", response.Code, want)
+	}
+	if got, want := strings.TrimSpace(response.Body.String()), "Upload is nested more than 16 levels deep"; got != want {
+		t.Errorf("ServeHTTP responded with %q, wanted %q", got, want)
+	}
+	if len(c) != 0 {
+		t.Errorf("ServeHTTP shouldn't process the rejected batch")
+	}
+}
+
+func TestEmptyUploads(t *testing.T) {
+	for _, mode := range []string{"process", "skip"} {
+		pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+			EmptyUploads: mode,
+		})
+		c := make(channelProcessor, 3)
+		pipeline.AddProcessor(c)
+
+		var errs []error
+		for _, payload := range []string{`[]`, `null`, `[{"type": "network-error", "body": {"type": "ok"}}]`} {
+			request := httptest.NewRequest("POST", "https://example.com/upload/", strings.NewReader(payload))
+			request.Header.Add("Content-Type", "application/reports+json")
+			response := httptest.NewRecorder()
+			errs = append(errs, pipeline.ProcessReports(context.Background(), response, request))
+			if want := http.StatusNoContent; response.Code != want {
+				t.Errorf("ServeHTTP(%s, %s): got %d, wanted %d", mode, payload, response.Code, want)
+			}
+		}
+		pipeline.Close()
+
+		if got, want := pipeline.EmptyUploads(), int64(2); got != want {
+			t.Errorf("EmptyUploads(%s) = %d, wanted %d", mode, got, want)
+		}
+		wantErr, wantBatches := error(nil), 3
+		if mode == "skip" {
+			wantErr, wantBatches = collector.ErrEmptyUpload, 1
+		}
+		if errs[0] != wantErr || errs[1] != wantErr || errs[2] != nil {
+			t.Errorf("ProcessReports(%s) got errors %v", mode, errs)
+		}
+		if got := len(c); got != wantBatches {
+			t.Errorf("Pipeline(%s) processed %d batches, wanted %d", mode, got, wantBatches)
+		}
+	}
+}
+
+func TestMalformedReports(t *testing.T) {
+	payload := testdata("testdata/TestMalformedReports/mixed-reports.json")
+	for _, mode := range []string{"reject", "skip"} {
+		pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+			MalformedReports: mode,
+		})
+		c := make(channelProcessor, 1)
+		pipeline.AddProcessor(c)
+
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+		request.Header.Add("Content-Type", "application/reports+json")
+		var response httptest.ResponseRecorder
+		pipeline.ServeHTTP(&response, request)
+		pipeline.Close()
+
+		if mode == "reject" {
+			if want := http.StatusBadRequest; response.Code != want {
+				t.Errorf("ServeHTTP(%s): got %d, wanted %d", mode, response.Code, want)
+			}
+			if len(c) != 0 {
+				t.Errorf("ServeHTTP(%s) shouldn't process the rejected batch", mode)
+			}
+			continue
+		}
+
+		if want := http.StatusNoContent; response.Code != want {
+			t.Fatalf("ServeHTTP(%s): got %d, wanted %d", mode, response.Code, want)
+		}
+		batch := <-c
+		var urls []string
+		for _, report := range batch.Reports {
+			urls = append(urls, report.URL)
+		}
+		if want := []string{"https://example.com/about/", "https://example.com/login/"}; !equalStrings(urls, want) {
+			t.Errorf("ServeHTTP(%s) kept reports for %v, wanted %v", mode, urls, want)
+		}
+		if got, want := batch.GetAnnotation("SkippedReportCount"), 3; got != want {
+			t.Errorf("ServeHTTP(%s) SkippedReportCount = %v, wanted %v", mode, got, want)
+		}
+		if got := batch.GetAnnotation("OriginalReportCount"); got != nil {
+			t.Errorf("ServeHTTP(%s) OriginalReportCount = %v, wanted nothing", mode, got)
+		}
+	}
+
+	// Skipping malformed reports doesn't extend to uploads that aren't valid
+	// JSON.
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+		MalformedReports: "skip",
+	})
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload[:len(payload)/2]))
+	request.Header.Add("Content-Type", "application/reports+json")
+	var response httptest.ResponseRecorder
+	pipeline.ServeHTTP(&response, request)
+	pipeline.Close()
+	if want := http.StatusBadRequest; response.Code != want {
+		t.Errorf("ServeHTTP(truncated payload): got %d, wanted %d", response.Code, want)
+	}
+}
+
+func TestMaxUploadBytes(t *testing.T) {
+	payload := testdata("../pipelinetest/testdata/reports/multiple-valid-nel-reports.json")
+	cases := []struct {
+		name     string
+		maxBytes int64
+		chunked  bool
+		want     int
+	}{
+		{"Chunked", int64(len(payload)), true, http.StatusNoContent},
+		{"ChunkedTooLarge", int64(len(payload)) / 2, true, http.StatusRequestEntityTooLarge},
+		{"ContentLength", int64(len(payload)), false, http.StatusNoContent},
+		{"ContentLengthTooLarge", int64(len(payload)) / 2, false, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+				MaxUploadBytes: c.maxBytes,
+			})
+			processed := make(channelProcessor, 1)
+			pipeline.AddProcessor(processed)
+			var transferEncoding []string
+			var contentLength int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				transferEncoding = r.TransferEncoding
+				contentLength = r.ContentLength
+				pipeline.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			// The client can't tell how long a MultiReader is, so it sends a
+			// chunked body without a Content-Length.
+			var body io.Reader = bytes.NewReader(payload)
+			if c.chunked {
+				body = io.MultiReader(body)
+			}
+			request, err := http.NewRequest("POST", server.URL+"/upload/", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", "application/reports+json")
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			pipeline.Close()
+
+			if chunked := len(transferEncoding) == 1 && transferEncoding[0] == "chunked" && contentLength == -1; chunked != c.chunked {
+				t.Fatalf("Upload has Transfer-Encoding %v and Content-Length %d, wanted chunked=%v", transferEncoding, contentLength, c.chunked)
+			}
+			if response.StatusCode != c.want {
+				t.Fatalf("ServeHTTP(%s): got %d, wanted %d", c.name, response.StatusCode, c.want)
+			}
+			if c.want != http.StatusNoContent {
+				if len(processed) != 0 {
+					t.Errorf("ServeHTTP(%s) shouldn't process the rejected batch", c.name)
+				}
+				return
+			}
+			if batch := <-processed; len(batch.Reports) != 2 {
+				t.Errorf("ServeHTTP(%s) got %d reports, wanted 2", c.name, len(batch.Reports))
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+		MaxHeaderBytes: 4096,
+	})
+	defer pipeline.Close()
+	processed := make(channelProcessor, 1)
+	pipeline.AddProcessor(processed)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := pipeline.NewServer("", pipeline)
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	upload := func(header, value string) int {
+		request, err := http.NewRequest("POST", "http://"+listener.Addr().String()+"/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/reports+json")
+		request.Header.Set(header, value)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	if got := upload("Cookie", "session=abc"); got != http.StatusNoContent {
+		t.Errorf("Upload with small header got %d, wanted %d", got, http.StatusNoContent)
+	}
+	<-processed
+	for _, header := range []string{"Cookie", "X-Forwarded-For"} {
+		if got := upload(header, strings.Repeat("x", 64*1024)); got != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("Upload with oversized %s header got %d, wanted %d", header, got, http.StatusRequestHeaderFieldsTooLarge)
+		}
+	}
+	if len(processed) != 0 {
+		t.Errorf("Uploads with oversized headers shouldn't be processed")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	// The chain of 10000 trusted hops would be parsed in its entirety without
+	// max_forwarded_hops; instead we stop after 3.
+	longChain := "203.0.113.5" + strings.Repeat(", 192.0.2.9", 10000)
+	cases := []struct {
+		name       string
+		remoteAddr string
+		header     []string
+		want       string
+	}{
+		{"NoHeader", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"UntrustedRemote", "198.51.100.1:1234", []string{"203.0.113.5"}, "198.51.100.1"},
+		{"OneHop", "192.0.2.1:1234", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"SkipsTrustedHops", "192.0.2.1:1234", []string{"198.51.100.7, 203.0.113.5, 192.0.2.9"}, "203.0.113.5"},
+		{"SeveralHeaders", "192.0.2.1:1234", []string{"198.51.100.7, 203.0.113.5", "192.0.2.8,192.0.2.9"}, "203.0.113.5"},
+		{"IPv6", "192.0.2.1:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"Invalid", "192.0.2.1:1234", []string{"203.0.113.5, not-an-ip, 192.0.2.9"}, "192.0.2.9"},
+		{"Empty", "192.0.2.1:1234", []string{""}, "192.0.2.1"},
+		{"TooManyHops", "192.0.2.1:1234", []string{"203.0.113.5, 192.0.2.7, 192.0.2.8, 192.0.2.9"}, "192.0.2.7"},
+		{"LongChain", "192.0.2.1:1234", []string{longChain}, "192.0.2.9"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+				TrustedProxies:   []string{"192.0.2.0/24"},
+				MaxForwardedHops: 3,
+			})
+			defer pipeline.Close()
+			processed := make(channelProcessor, 1)
+			pipeline.AddProcessor(processed)
+			request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+			request.RemoteAddr = c.remoteAddr
+			request.Header.Set("Content-Type", "application/reports+json")
+			for _, value := range c.header {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+			var response httptest.ResponseRecorder
+			if err := pipeline.ProcessReports(context.Background(), &response, request); err != nil {
+				t.Fatal(err)
+			}
+			if batch := <-processed; batch.ClientIP != c.want {
+				t.Errorf("ClientIP = %q, wanted %q", batch.ClientIP, c.want)
+			}
+		})
+	}
+}
+
+func TestUploadTLSInfo(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	processed := make(channelProcessor, 1)
+	pipeline.AddProcessor(processed)
+	ts := httptest.NewTLSServer(pipeline)
+	defer ts.Close()
+
+	client := ts.Client()
+	config := client.Transport.(*http.Transport).TLSClientConfig
+	config.MaxVersion = tls.VersionTLS12
+	config.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	response, err := client.Post(ts.URL, "application/reports+json", bytes.NewReader(testdata(validNelReportPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	want := &collector.TLSInfo{Version: "TLS 1.2", CipherSuite: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	if diff := cmp.Diff(want, (<-processed).TLS); diff != "" {
+		t.Errorf("Batch TLS diff (-want +got):\n%s", diff)
+	}
+}
+
+func BenchmarkProcessReports(b *testing.B) {
+	payload := benchmarkPayload(b)
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	pipeline.AddProcessor(clockProcessor{})
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/reports+json")
+		var response httptest.ResponseRecorder
+		if err := pipeline.ProcessReports(ctx, &response, request); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetUploads(t *testing.T) {
+	payload := testdata("../pipelinetest/testdata/reports/multiple-valid-nel-reports.json")
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	cases := []struct {
+		name, parameter, query string
+		maxReports             int
+		want                   int
+	}{
+		{"Disabled", "", "r=" + url.QueryEscape(encoded), 0, http.StatusMethodNotAllowed},
+		{"Standard", "r", "r=" + url.QueryEscape(encoded) + "&tag=a", 0, http.StatusNoContent},
+		{"URLSafe", "r", "tag=a&r=" + base64.RawURLEncoding.EncodeToString(payload), 0, http.StatusNoContent},
+		{"Missing", "r", "reports=" + url.QueryEscape(encoded), 0, http.StatusBadRequest},
+		{"NotBase64", "r", "r=%7B%7D", 0, http.StatusBadRequest},
+		{"TooManyReports", "r", "r=" + url.QueryEscape(encoded), 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+				GetParameter:       c.parameter,
+				MaxReportsPerBatch: c.maxReports,
+			})
+			processed := make(channelProcessor, 1)
+			pipeline.AddProcessor(processed)
+
+			request := httptest.NewRequest("GET", "https://example.com/upload/?"+c.query, nil)
+			var response httptest.ResponseRecorder
+			pipeline.ServeHTTP(&response, request)
+			pipeline.Close()
+			if response.Code != c.want {
+				t.Fatalf("ServeHTTP(GET %s): got %d, wanted %d", c.query, response.Code, c.want)
+			}
+			if c.want != http.StatusNoContent {
+				return
+			}
+
+			batch := <-processed
+			if got, want := len(batch.Reports), 2; got != want {
+				t.Errorf("ServeHTTP(GET %s) got %d reports, wanted %d", c.query, got, want)
+			}
+			// The payload shouldn't end up in the batch.
+			if got, want := batch.CollectorURL.String(), "https://example.com/upload/?tag=a"; got != want {
+				t.Errorf("ServeHTTP(GET %s) got CollectorURL %s, wanted %s", c.query, got, want)
+			}
+		})
+	}
+}
+
+func TestMultipartUploads(t *testing.T) {
+	payload := testdata(validNelReportPath)
+	form := func(field string) (*bytes.Buffer, string) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("comment", "ignored")
+		part, _ := writer.CreateFormFile(field, "reports.json")
+		part.Write(payload)
+		writer.Close()
+		return &body, writer.FormDataContentType()
+	}
+	cases := []struct {
+		name, configField, formField string
+		maxBytes                     int64
+		want                         int
+	}{
+		{"Disabled", "", "reports", 0, http.StatusUnsupportedMediaType},
+		{"Enabled", "reports", "reports", 0, http.StatusNoContent},
+		{"MissingField", "reports", "other", 0, http.StatusBadRequest},
+		{"TooLarge", "reports", "reports", 16, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+				MultipartField:    c.configField,
+				MaxMultipartBytes: c.maxBytes,
+			})
+			processed := make(channelProcessor, 1)
+			pipeline.AddProcessor(processed)
+
+			body, contentType := form(c.formField)
+			request := httptest.NewRequest("POST", "https://example.com/upload/", body)
+			request.Header.Set("Content-Type", contentType)
+			var response httptest.ResponseRecorder
+			pipeline.ServeHTTP(&response, request)
+			pipeline.Close()
+			if response.Code != c.want {
+				t.Fatalf("ServeHTTP(%s): got %d, wanted %d", c.name, response.Code, c.want)
+			}
+			if c.want != http.StatusNoContent {
+				return
+			}
+
+			batch := <-processed
+			if got, want := len(batch.Reports), 1; got != want {
+				t.Errorf("ServeHTTP(%s) got %d reports, wanted %d", c.name, got, want)
+			}
+		})
+	}
+}
+
+// blockingProcessor signals on started whenever it starts processing a batch,
+// and then waits until release is closed.
+type blockingProcessor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingProcessor) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	b.started <- struct{}{}
+	<-b.release
+}
+
+func TestBackpressure(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+		BufferSize:            10,
+		NumWorkers:            1,
+		BackpressureThreshold: 0.5,
+		MaxRetryAfter:         collector.Duration{10 * time.Second},
+	})
+	defer pipeline.Close()
+	blocking := blockingProcessor{started: make(chan struct{}, 100), release: make(chan struct{})}
+	pipeline.AddProcessor(blocking)
+	defer close(blocking.release)
+
+	upload := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", "application/reports+json")
+		response := httptest.NewRecorder()
+		pipeline.ServeHTTP(response, request)
+		return response
+	}
+
+	// The first upload occupies the only worker, so the rest wait in the
+	// queue.  Uploads are accepted until the queue is more than half full.
+	upload()
+	<-blocking.started
+	for i := 0; i < 6; i++ {
+		if response := upload(); response.Code != http.StatusNoContent {
+			t.Fatalf("Upload %d got %d, wanted %d", i, response.Code, http.StatusNoContent)
+		}
+	}
+	response := upload()
+	if got, want := response.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Upload to a backed-up queue got %d, wanted %d", got, want)
+	}
+	// The queue is 60% full, which is a fifth of the way from the threshold to
+	// completely full.
+	if got, want := response.Header().Get("Retry-After"), "2"; got != want {
+		t.Errorf("Upload to a backed-up queue got Retry-After %q, wanted %q", got, want)
+	}
+}
+
+func TestSuccessStatus(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      collector.PipelineConfig
+		status      int
+		body        string
+		contentType string
+	}{
+		{"Default", collector.PipelineConfig{}, http.StatusNoContent, "", ""},
+		{"OK", collector.PipelineConfig{SuccessStatus: http.StatusOK}, http.StatusOK, "", ""},
+		{"Body", collector.PipelineConfig{SuccessStatus: http.StatusAccepted, SuccessBody: "thanks"}, http.StatusAccepted, "thanks", "text/plain; charset=utf-8"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), c.config)
+			defer pipeline.Close()
+			request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+			request.Header.Add("Content-Type", "application/reports+json")
+			response := httptest.NewRecorder()
+			pipeline.ServeHTTP(response, request)
+			if response.Code != c.status {
+				t.Errorf("Upload got %d, wanted %d", response.Code, c.status)
+			}
+			if got := response.Body.String(); c.status != http.StatusNoContent && got != c.body {
+				t.Errorf("Upload got body %q, wanted %q", got, c.body)
+			}
+			if c.contentType != "" && response.Header().Get("Content-Type") != c.contentType {
+				t.Errorf("Upload got Content-Type %q, wanted %q", response.Header().Get("Content-Type"), c.contentType)
+			}
+		})
+	}
+}
+
+func TestBatchIDHeader(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+		SuccessStatus: http.StatusAccepted,
+		BatchIDHeader: "X-Report-Id",
+	})
+	defer pipeline.Close()
+	c := make(channelProcessor, 2)
+	pipeline.AddProcessor(c)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", "application/reports+json")
+		response := httptest.NewRecorder()
+		pipeline.ServeHTTP(response, request)
+		if response.Code != http.StatusAccepted {
+			t.Errorf("Upload got %d, wanted %d", response.Code, http.StatusAccepted)
+		}
+		id := response.Header().Get("X-Report-Id")
+		if id == "" {
+			t.Fatalf("Upload is missing X-Report-Id header")
+		}
+		batch := <-c
+		if got := batch.GetAnnotation("BatchID"); got != id {
+			t.Errorf("Batch has BatchID %v, wanted %q from X-Report-Id", got, id)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("Uploads got the same batch ID %q", ids[0])
+	}
+
+	// Rejected uploads don't get an ID.
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader([]byte("[{")))
+	request.Header.Add("Content-Type", "application/reports+json")
+	response := httptest.NewRecorder()
+	pipeline.ServeHTTP(response, request)
+	if got := response.Header().Get("X-Report-Id"); got != "" {
+		t.Errorf("Rejected upload got X-Report-Id %q", got)
+	}
+}
+
+func TestLoadFactor(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{
+		BufferSize:      10,
+		NumWorkers:      1,
+		SuccessFraction: 0.1,
+		LoadHintHeader:  "NEL-Load-Hint",
+	})
+	blocking := blockingProcessor{started: make(chan struct{}, 100), release: make(chan struct{})}
+	pipeline.AddProcessor(blocking)
+
+	upload := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", "application/reports+json")
+		response := httptest.NewRecorder()
+		pipeline.ServeHTTP(response, request)
+		return response
+	}
+
+	if got := pipeline.LoadFactor(); got != 0 {
+		t.Errorf("LoadFactor() of an idle pipeline = %v, wanted 0", got)
+	}
+	// The first upload occupies the only worker, so the rest wait in the
+	// queue.
+	upload()
+	<-blocking.started
+	var response *httptest.ResponseRecorder
+	for i := 0; i < 4; i++ {
+		response = upload()
+	}
+	if got, want := pipeline.LoadFactor(), 0.4; got != want {
+		t.Errorf("LoadFactor() = %v, wanted %v", got, want)
+	}
+	if got, want := response.Header().Get("NEL-Load-Hint"), "load=0.4, success_fraction=0.06, failure_fraction=0.8"; got != want {
+		t.Errorf("Upload got NEL-Load-Hint %q, wanted %q", got, want)
+	}
+
+	close(blocking.release)
+	pipeline.Close()
+	if got := pipeline.LoadFactor(); got != 1 {
+		t.Errorf("LoadFactor() of a closed pipeline = %v, wanted 1", got)
+	}
+	if success, failure := pipeline.RecommendedFractions(); success != 0 || failure != 0.5 {
+		t.Errorf("RecommendedFractions() of a closed pipeline = %v, %v, wanted 0, 0.5", success, failure)
+	}
+}
+
+// blockingReader returns the contents of a payload, but not until it's
+// released, so that the upload stays in flight.
+type blockingReader struct {
+	started chan struct{}
+	release chan struct{}
+	payload io.Reader
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	if b.started != nil {
+		b.started <- struct{}{}
+		b.started = nil
+		<-b.release
+	}
+	return b.payload.Read(p)
+}
+
+func TestMaxConcurrentUploads(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{MaxConcurrentUploads: 2})
+	defer pipeline.Close()
+	upload := func(body io.Reader) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", body)
+		request.Header.Add("Content-Type", "application/reports+json")
+		response := httptest.NewRecorder()
+		pipeline.ServeHTTP(response, request)
+		return response
+	}
+
+	// Two uploads whose payloads haven't arrived yet use up all of the slots.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := &blockingReader{started, release, bytes.NewReader(testdata(validNelReportPath))}
+			if response := upload(body); response.Code != http.StatusNoContent {
+				t.Errorf("Blocked upload got %d, wanted %d", response.Code, http.StatusNoContent)
+			}
+		}()
+		<-started
+	}
+	response := upload(bytes.NewReader(testdata(validNelReportPath)))
+	if got, want := response.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Upload with no free slots got %d, wanted %d", got, want)
+	}
+	if got := response.Header().Get("Retry-After"); got == "" {
+		t.Errorf("Upload with no free slots didn't get a Retry-After")
+	}
+	if got, want := response.Header().Get("Date"), "Thu, 01 Jan 1970 00:00:00 GMT"; got != want {
+		t.Errorf("Upload with no free slots got Date %q, wanted %q", got, want)
+	}
+
+	close(release)
+	wg.Wait()
+	if response := upload(bytes.NewReader(testdata(validNelReportPath))); response.Code != http.StatusNoContent {
+		t.Errorf("Upload after the slots were freed got %d, wanted %d", response.Code, http.StatusNoContent)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	limiter := collector.NewConcurrencyLimiter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), 1)
+	limiter.Clock = pipelinetest.NewSimulatedClock()
+	var date string
+	serve := func() int {
+		response := httptest.NewRecorder()
+		limiter.ServeHTTP(response, httptest.NewRequest("POST", "https://example.com/upload/", nil))
+		if response.Code == http.StatusServiceUnavailable {
+			date = response.Header().Get("Date")
+		}
+		return response.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- serve() }()
+	<-started
+	if got := limiter.InFlight(); got != 1 {
+		t.Errorf("InFlight = %d, wanted 1", got)
+	}
+	if got, want := serve(), http.StatusServiceUnavailable; got != want {
+		t.Errorf("Request with no free slots got %d, wanted %d", got, want)
+	}
+	close(release)
+	if got, want := <-done, http.StatusOK; got != want {
+		t.Errorf("Request got %d, wanted %d", got, want)
+	}
+	go func() { <-started }()
+	if got, want := serve(), http.StatusOK; got != want {
+		t.Errorf("Request after the slot was freed got %d, wanted %d", got, want)
+	}
+	if got := limiter.Rejected(); got != 1 {
+		t.Errorf("Rejected = %d, wanted 1", got)
+	}
+	if got, want := date, "Thu, 01 Jan 1970 00:00:00 GMT"; got != want {
+		t.Errorf("Rejected request got Date %q, wanted %q", got, want)
+	}
+
+	// A limiter in front of a pipeline uses the pipeline's clock.
+	clock := pipelinetest.NewSimulatedClock()
+	pipeline := collector.NewTestPipeline(clock)
+	defer pipeline.Close()
+	if got := collector.NewConcurrencyLimiter(pipeline, 1).Clock; got != collector.Clock(clock) {
+		t.Errorf("ConcurrencyLimiter wrapping a pipeline has Clock %v, wanted the pipeline's", got)
+	}
+}
+
+// countingProcessor counts the reports that it sees.
+type countingProcessor struct {
+	count int64
+}
+
+func (c *countingProcessor) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	atomic.AddInt64(&c.count, int64(len(batch.Reports)))
+}
+
+func TestDrainRacingUploads(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	counter := &countingProcessor{}
+	pipeline.AddProcessor(counter)
+	payload := testdata(validNelReportPath)
+
+	var accepted, rejected int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 50; j++ {
+				request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+				request.Header.Add("Content-Type", "application/reports+json")
+				response := httptest.NewRecorder()
+				err := pipeline.ProcessReports(context.Background(), response, request)
+				switch {
+				case err == nil:
+					atomic.AddInt64(&accepted, 1)
+				case err == collector.ErrDraining:
+					if response.Code != http.StatusServiceUnavailable {
+						t.Errorf("ProcessReports while draining: got %d, wanted %d", response.Code, http.StatusServiceUnavailable)
+					}
+					atomic.AddInt64(&rejected, 1)
+				case err == collector.ErrDropped:
+				default:
+					t.Errorf("ProcessReports: %v", err)
+				}
+			}
+		}()
+	}
+
+	close(start)
+	pipeline.Drain()
+	// Every upload that was accepted before Drain returned should have been
+	// processed.
+	processed := atomic.LoadInt64(&counter.count)
+	wg.Wait()
+	pipeline.Close()
+
+	if got := atomic.LoadInt64(&counter.count); got != processed {
+		t.Errorf("processed %d reports after Drain returned", got-processed)
+	}
+	if got := atomic.LoadInt64(&accepted); got != processed {
+		t.Errorf("accepted %d uploads but processed %d", got, processed)
+	}
+	if atomic.LoadInt64(&rejected) == 0 {
+		t.Logf("no uploads raced with Drain")
+	}
+}
+
+// closeCounter counts how many times it's been closed.
+type closeCounter struct {
+	closed int64
+}
+
+func (c *closeCounter) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt64(&c.closed, 1)
+	return nil
+}
+
+func TestCloseRacingUploads(t *testing.T) {
+	payload := testdata(validNelReportPath)
+	for round := 0; round < 20; round++ {
+		pipeline := collector.NewTestPipelineWithBuffer(pipelinetest.NewSimulatedClock(), 4)
+		closer := &closeCounter{}
+		pipeline.AddProcessor(closer)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+					request.Header.Add("Content-Type", "application/reports+json")
+					response := httptest.NewRecorder()
+					pipeline.ServeHTTP(response, request)
+					if code := response.Code; code != http.StatusNoContent && code != http.StatusServiceUnavailable {
+						t.Errorf("ServeHTTP during Close: got %d", code)
+					}
+				}
+			}()
+		}
+		pipeline.Close()
+		wg.Wait()
+		pipeline.Close()
+
+		if got := atomic.LoadInt64(&closer.closed); got != 1 {
+			t.Fatalf("processor closed %d times, wanted 1", got)
+		}
+	}
+}
+
 func TestProcessReports(t *testing.T) {
 	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
 	defer pipeline.Close()
@@ -91,6 +1134,34 @@ func TestProcessReports(t *testing.T) {
 	p.Run(t)
 }
 
+// encodeCSV encodes the URL and type of each report in a batch as CSV.
+func encodeCSV(batch *collector.ReportBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"client_ip", "url", "type"})
+	for _, report := range batch.Reports {
+		w.Write([]string{batch.ClientIP, report.URL, report.Type})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func TestCustomEncoder(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	p := pipelinetest.PipelineTest{
+		TestName:        "TestCustomEncoder",
+		Pipeline:        pipeline,
+		Encoder:         encodeCSV,
+		OutputExtension: ".csv",
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
 // Custom annotations
 
 var clientCountries = map[string]string{
@@ -127,3 +1198,244 @@ func TestCustomAnnotation(t *testing.T) {
 	}
 	p.Run(t)
 }
+
+// barrierProcessor blocks each batch until n batches are being processed at
+// the same time.
+type barrierProcessor struct {
+	n       int
+	mu      sync.Mutex
+	waiting int
+	release chan struct{}
+}
+
+func (b *barrierProcessor) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	b.mu.Lock()
+	b.waiting++
+	if b.waiting == b.n {
+		close(b.release)
+	}
+	b.mu.Unlock()
+	<-b.release
+}
+
+func TestAddProcessorWithConcurrency(t *testing.T) {
+	// With a single worker, the barrier can only be reached if its stage has
+	// its own goroutines.
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{NumWorkers: 1})
+	before := &countingProcessor{}
+	barrier := &barrierProcessor{n: 3, release: make(chan struct{})}
+	after := &countingProcessor{}
+	pipeline.AddProcessor(before)
+	pipeline.AddProcessorWithConcurrency(barrier, 3)
+	pipeline.AddProcessor(after)
+
+	for i := 0; i < 6; i++ {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", "application/reports+json")
+		response := httptest.NewRecorder()
+		pipeline.ServeHTTP(response, request)
+		if want := http.StatusNoContent; response.Code != want {
+			t.Fatalf("ServeHTTP: got %d, wanted %d", response.Code, want)
+		}
+	}
+
+	// Close waits for the stage to finish, too.
+	pipeline.Close()
+	if got, want := atomic.LoadInt64(&before.count), int64(6); got != want {
+		t.Errorf("Processor before the stage saw %d reports, wanted %d", got, want)
+	}
+	if got, want := atomic.LoadInt64(&after.count), int64(6); got != want {
+		t.Errorf("Processor after the stage saw %d reports, wanted %d", got, want)
+	}
+	if got, want := pipeline.Describe()[1].Concurrency, 3; got != want {
+		t.Errorf("Describe()[1].Concurrency = %d, wanted %d", got, want)
+	}
+}
+
+func TestSynchronousPipeline(t *testing.T) {
+	pipeline := collector.NewSynchronousPipeline(pipelinetest.NewSimulatedClock())
+	counter := &countingProcessor{}
+	pipeline.AddProcessor(counter)
+	pipeline.AddProcessor(pipelinetest.EncodeBatchAsResult{})
+
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+	request.Header.Add("Content-Type", "application/reports+json")
+	response := httptest.NewRecorder()
+	batch, err := pipeline.ProcessUpload(context.Background(), response, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every processor has already run by the time ProcessUpload returns.
+	if got, want := atomic.LoadInt64(&counter.count), int64(1); got != want {
+		t.Errorf("Processor saw %d reports, wanted %d", got, want)
+	}
+	if batch.GetAnnotation("TestResult") == nil {
+		t.Errorf("ProcessUpload returned a batch without a TestResult annotation")
+	}
+
+	pipeline.Close()
+	request = httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+	request.Header.Add("Content-Type", "application/reports+json")
+	response = httptest.NewRecorder()
+	if _, err := pipeline.ProcessUpload(context.Background(), response, request); err != collector.ErrDraining {
+		t.Errorf("ProcessUpload after Close got error %v, wanted %v", err, collector.ErrDraining)
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	counter := &countingProcessor{}
+	pipeline.AddProcessor(counter)
+	pipeline.AddProcessor(pipelinetest.EncodeBatchAsResult{})
+
+	// Batches that didn't come from an HTTP upload, processed from several
+	// goroutines at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reports []collector.NelReport
+			if err := collector.DecodeRawReports(testdata(validNelReportPath), &reports); err != nil {
+				t.Error(err)
+				return
+			}
+			batch := &collector.ReportBatch{Reports: reports}
+			got := pipeline.ProcessBatch(context.Background(), batch)
+			if got != batch {
+				t.Errorf("ProcessBatch returned a different batch")
+			}
+			if got.GetAnnotation("TestResult") == nil {
+				t.Errorf("ProcessBatch returned a batch without a TestResult annotation")
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := atomic.LoadInt64(&counter.count), int64(4); got != want {
+		t.Errorf("Processor saw %d reports, wanted %d", got, want)
+	}
+}
+
+func TestAcceptAndDrop(t *testing.T) {
+	pipeline := collector.NewSynchronousPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	counter := &countingProcessor{}
+	pipeline.AddProcessor(counter)
+	admin := collector.AcceptAndDropHandler(pipeline)
+
+	upload := func() (*httptest.ResponseRecorder, error) {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+		request.Header.Add("Content-Type", "application/reports+json")
+		response := httptest.NewRecorder()
+		return response, pipeline.ProcessReports(context.Background(), response, request)
+	}
+	setMode := func(form string) string {
+		request := httptest.NewRequest("POST", "https://example.com/accept-and-drop", strings.NewReader(form))
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+		return strings.TrimSpace(response.Body.String())
+	}
+
+	if got, want := setMode("enabled=true"), `{"enabled":true,"absorbed":0}`; got != want {
+		t.Errorf("Turning on accept-and-drop mode got %s, wanted %s", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		response, err := upload()
+		if err != collector.ErrAbsorbed {
+			t.Errorf("Upload in accept-and-drop mode got error %v, wanted %v", err, collector.ErrAbsorbed)
+		}
+		if response.Code != http.StatusNoContent {
+			t.Errorf("Upload in accept-and-drop mode got %d, wanted %d", response.Code, http.StatusNoContent)
+		}
+	}
+	if got := atomic.LoadInt64(&counter.count); got != 0 {
+		t.Errorf("Processor saw %d reports in accept-and-drop mode, wanted 0", got)
+	}
+
+	if got, want := setMode("enabled=false"), `{"enabled":false,"absorbed":2}`; got != want {
+		t.Errorf("Turning off accept-and-drop mode got %s, wanted %s", got, want)
+	}
+	if _, err := upload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&counter.count); got != 1 {
+		t.Errorf("Processor saw %d reports after accept-and-drop mode, wanted 1", got)
+	}
+	if got := setMode("enabled=maybe"); !strings.Contains(got, "Invalid") {
+		t.Errorf("Invalid accept-and-drop mode got %s", got)
+	}
+}
+
+// tickingClock is a Clock that moves forward by a second every time that it's
+// read.
+type tickingClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(time.Second)
+	return c.now
+}
+
+func TestRecordProcessorTimings(t *testing.T) {
+	for _, record := range []bool{false, true} {
+		pipeline := collector.NewTestPipelineWithConfig(&tickingClock{}, collector.PipelineConfig{RecordProcessorTimings: record})
+		pipeline.AddProcessor(&countingProcessor{})
+		pipeline.AddProcessor(&countingProcessor{})
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{{}}}
+		pipeline.ProcessBatch(context.Background(), batch)
+		pipeline.Close()
+
+		var want interface{}
+		if record {
+			want = map[string]time.Duration{
+				"0:*collector_test.countingProcessor": time.Second,
+				"1:*collector_test.countingProcessor": time.Second,
+			}
+		}
+		if diff := cmp.Diff(want, batch.GetAnnotation("ProcessorTimings")); diff != "" {
+			t.Errorf("ProcessorTimings with RecordProcessorTimings=%v got diff (-want +got):\n%s", record, diff)
+		}
+	}
+}
+
+// dropsEvery removes every nth report from each batch.
+type dropsEvery int
+
+func (p dropsEvery) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var kept []collector.NelReport
+	for i, report := range batch.Reports {
+		if (i+1)%int(p) != 0 {
+			kept = append(kept, report)
+		}
+	}
+	batch.Reports = kept
+}
+
+func TestRecordProcessorCounts(t *testing.T) {
+	for _, record := range []bool{false, true} {
+		pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{RecordProcessorCounts: record})
+		pipeline.AddProcessor(dropsEvery(2))
+		pipeline.AddProcessor(&countingProcessor{})
+		for _, n := range []int{4, 3} {
+			pipeline.ProcessBatch(context.Background(), &collector.ReportBatch{Reports: make([]collector.NelReport, n)})
+		}
+		pipeline.Close()
+
+		var want []collector.ProcessorCounts
+		if record {
+			want = []collector.ProcessorCounts{
+				{Index: 0, Type: "collector_test.dropsEvery", In: 7, Out: 4, Dropped: 3},
+				{Index: 1, Type: "*collector_test.countingProcessor", In: 4, Out: 4},
+			}
+		}
+		if diff := cmp.Diff(want, pipeline.ProcessorCounts()); diff != "" {
+			t.Errorf("ProcessorCounts with RecordProcessorCounts=%v got diff (-want +got):\n%s", record, diff)
+		}
+	}
+}
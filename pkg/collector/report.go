@@ -15,9 +15,12 @@
 package collector
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -76,6 +79,13 @@ type NelReport struct {
 	Annotations
 }
 
+// EventTime returns the time that a report's event happened, given the time
+// that the report was received: its age is the number of milliseconds between
+// the two.
+func (r *NelReport) EventTime(received time.Time) time.Time {
+	return received.Add(-time.Duration(r.Age) * time.Millisecond)
+}
+
 type rawReport struct {
 	Age        int             `json:"age"`
 	ReportType string          `json:"type"`
@@ -105,6 +115,12 @@ func (r *NelReport) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+	return r.fromRaw(&raw)
+}
+
+// fromRaw fills in a NelReport from the outer layer of its JSON payload,
+// parsing the nested body if it's a NEL report.
+func (r *NelReport) fromRaw(raw *rawReport) error {
 	r.Age = raw.Age
 	r.ReportType = raw.ReportType
 	r.URL = raw.URL
@@ -112,7 +128,7 @@ func (r *NelReport) UnmarshalJSON(b []byte) error {
 
 	if raw.ReportType == "network-error" {
 		var body nelReportBody
-		err = json.Unmarshal(raw.Body, &body)
+		err := json.Unmarshal(raw.Body, &body)
 		if err != nil {
 			return err
 		}
@@ -181,15 +197,32 @@ type ReportBatch struct {
 	// The IP address of the client that uploaded the batch of reports.  You can
 	// typically assume that's the same IP address that was used for the original
 	// requests.  The IP address will be encoded as a string; for example,
-	// "192.0.2.1" or "2001:db8::2".
+	// "192.0.2.1" or "2001:db8::2".  It's empty for uploads that arrive over a
+	// Unix domain socket (see ListenUnix), which don't have an address, unless
+	// the socket is trusted to forward them (see
+	// PipelineConfig.TrustUnixSocket).
 	ClientIP string
 
 	// The user agent of the client that uploaded the batch of reports.
 	ClientUserAgent string
 
+	// The value of the Referer header of the upload request, if any.
+	ClientReferrer string
+
+	// The host that the batch of reports was uploaded to, taken from the Host
+	// header of the upload request.
+	Host string
+
+	// Information about the TLS connection that the batch of reports was
+	// uploaded over.  This will be nil if the reports were uploaded in
+	// plaintext.
+	TLS *TLSInfo
+
 	// The key-value pairs of the HTTP header that is received by the collector.
 	// This can be used to get additional information. One example is to get the
 	// remote address of the client when the collector runs behind a proxy.
+	// It's nil in a batch that combines several uploads (see
+	// PipelineConfig.CoalesceReports), whose headers can differ.
 	Header http.Header
 
 	// An arbitrary set of extra data that you can attach to this batch of
@@ -197,12 +230,188 @@ type ReportBatch struct {
 	Annotations
 }
 
+// Clone returns a copy of a report batch that can be modified independently of
+// the original.  The copy has its own Reports slice, and each report and the
+// batch itself have their own copy of their annotations.  (Annotation values,
+// RawBody, and Header are shared with the original, and should be treated as
+// read-only.)
+func (b *ReportBatch) Clone() *ReportBatch {
+	result := *b
+	result.Annotations = b.CloneAnnotations()
+	if b.Reports != nil {
+		result.Reports = make([]NelReport, len(b.Reports))
+		for i := range b.Reports {
+			result.Reports[i] = b.Reports[i]
+			result.Reports[i].Annotations = b.Reports[i].CloneAnnotations()
+		}
+	}
+	return &result
+}
+
+// TLSInfo describes the TLS connection that a batch of reports was uploaded
+// over.
+type TLSInfo struct {
+	// The TLS version that was negotiated; for example, "TLS 1.3".
+	Version string
+
+	// The name of the cipher suite that was negotiated; for example,
+	// "TLS_AES_128_GCM_SHA256".
+	CipherSuite string
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	return &TLSInfo{
+		Version:     tlsName(tlsVersionNames, state.Version),
+		CipherSuite: tlsName(tlsCipherSuiteNames, state.CipherSuite),
+	}
+}
+
+// A PayloadParser extracts a batch of reports from an upload request.  You can
+// register your own parsers with a Pipeline to accept uploads in non-standard
+// formats.
+type PayloadParser interface {
+	// Parse reads the request's body and fills in a new ReportBatch, using
+	// clock to timestamp the batch.  It should return an error if the payload
+	// can't be parsed.
+	Parse(r *http.Request, clock Clock) (*ReportBatch, error)
+}
+
+// PayloadParserFunc allows you to use a simple function as a PayloadParser.
+type PayloadParserFunc func(r *http.Request, clock Clock) (*ReportBatch, error)
+
+// Parse defers to a PayloadParserFunc to parse a request.
+func (f PayloadParserFunc) Parse(r *http.Request, clock Clock) (*ReportBatch, error) {
+	return f(r, clock)
+}
+
+// DefaultPayloadParser parses uploads in the standard format defined by the
+// Reporting spec, using NewReportBatch.
+var DefaultPayloadParser PayloadParser = PayloadParserFunc(NewReportBatch)
+
 // NewReportBatch takes a HTTP request and a clock and fills in a ReportBatch,
 // returning an error if parsing fails.
 func NewReportBatch(r *http.Request, clock Clock) (*ReportBatch, error) {
+	return ReportBatchParser{}.Parse(r, clock)
+}
+
+// ReportBatchParser is a PayloadParser for uploads in the standard format
+// defined by the Reporting spec, which can limit the number of reports that it
+// accepts in a single upload.  (A client could otherwise send a huge number of
+// tiny reports to use up CPU in downstream processors.)  The zero value
+// accepts any number of reports, just like NewReportBatch.
+type ReportBatchParser struct {
+	// The maximum number of reports to accept in a single upload, or 0 for no
+	// limit.
+	MaxReports int
+
+	// What to do with an upload that contains more than MaxReports reports.  If
+	// false, we reject the upload with a TooManyReportsError.  If true, we
+	// keep the first MaxReports reports, and record the number of reports in
+	// the original upload in the batch's OriginalReportCount annotation.
+	Truncate bool
+
+	// What to do with an upload that's a valid JSON array, but contains some
+	// elements that aren't valid reports (such as a NEL report whose body
+	// isn't an object, or a field with the wrong type).  If false, we reject
+	// the whole upload.  If true, we skip those elements, keep the rest, and
+	// record the number that we skipped in the batch's SkippedReportCount
+	// annotation.  An upload that isn't valid JSON at all is always rejected.
+	Tolerant bool
+
+	// The deepest that arrays and objects can be nested in an upload,
+	// counting the array of reports itself; uploads that are nested more
+	// deeply are rejected with a TooDeeplyNestedError, before any of their
+	// reports are parsed.  (Otherwise, a small but pathologically nested
+	// upload could use up a lot of CPU and memory in the JSON decoder.)  If
+	// 0, we use DefaultMaxJSONDepth.
+	MaxDepth int
+}
+
+// DefaultMaxJSONDepth is the deepest that a ReportBatchParser lets an upload's
+// arrays and objects be nested, if you don't choose a different limit.  That's
+// far deeper than any real report needs.
+const DefaultMaxJSONDepth = 32
+
+// TooDeeplyNestedError is returned by ReportBatchParser when it rejects an
+// upload because its JSON is nested too deeply.
+type TooDeeplyNestedError struct {
+	MaxDepth int
+}
+
+// Error describes the nesting limit that the upload exceeded.
+func (e TooDeeplyNestedError) Error() string {
+	return fmt.Sprintf("Upload is nested more than %d levels deep", e.MaxDepth)
+}
+
+// depthLimiter is the body of an upload whose JSON can be nested at most max
+// levels deep.  It scans the JSON as it's read, so the decoder never sees
+// anything past the point where the limit was exceeded.
+type depthLimiter struct {
+	io.Reader
+	max      int
+	depth    int
+	inString bool
+	escaped  bool
+	exceeded bool
+}
+
+func (l *depthLimiter) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	for i, c := range p[:n] {
+		switch {
+		case l.inString:
+			if l.escaped {
+				l.escaped = false
+			} else if c == '\\' {
+				l.escaped = true
+			} else if c == '"' {
+				l.inString = false
+			}
+		case c == '"':
+			l.inString = true
+		case c == '[' || c == '{':
+			l.depth++
+			if l.depth > l.max {
+				l.exceeded = true
+				return i, TooDeeplyNestedError{l.max}
+			}
+		case c == ']' || c == '}':
+			l.depth--
+		}
+	}
+	return n, err
+}
+
+// TooManyReportsError is returned by ReportBatchParser when it rejects an
+// upload because it contains too many reports.
+type TooManyReportsError struct {
+	MaxReports int
+}
+
+// Error describes the limit on the number of reports that the upload
+// exceeded.
+func (e TooManyReportsError) Error() string {
+	return fmt.Sprintf("Upload contains more than %d reports", e.MaxReports)
+}
+
+// fromUnixSocket returns whether a request arrived over a Unix domain socket.
+func fromUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// Parse takes a HTTP request and a clock and fills in a ReportBatch, returning
+// an error if parsing fails.
+func (p ReportBatchParser) Parse(r *http.Request, clock Clock) (*ReportBatch, error) {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return nil, fmt.Errorf("net.SplitHostPort(%v): %v", r.RemoteAddr, err)
+		if !fromUnixSocket(r) {
+			return nil, fmt.Errorf("net.SplitHostPort(%v): %v", r.RemoteAddr, err)
+		}
+		host = ""
 	}
 
 	var reports ReportBatch
@@ -210,15 +419,187 @@ func NewReportBatch(r *http.Request, clock Clock) (*ReportBatch, error) {
 	reports.CollectorURL = *r.URL
 	reports.ClientIP = host
 	reports.ClientUserAgent = r.Header.Get("User-Agent")
+	reports.ClientReferrer = r.Header.Get("Referer")
+	reports.Host = r.Host
+	reports.TLS = newTLSInfo(r.TLS)
 	reports.Header = r.Header
-	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&reports.Reports)
+	maxDepth := p.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxJSONDepth
+	}
+	body := &depthLimiter{Reader: r.Body, max: maxDepth}
+	var count, skipped int
+	reports.Reports, count, skipped, err = p.decodeReports(body)
 	if err != nil {
+		if body.exceeded {
+			return nil, TooDeeplyNestedError{maxDepth}
+		}
+		switch err.(type) {
+		case TooManyReportsError, PayloadTooLargeError:
+			return nil, err
+		}
 		return nil, fmt.Errorf("decoder.Decode(&reports.Reports): %v", err)
 	}
+	if count > len(reports.Reports)+skipped {
+		reports.SetAnnotation("OriginalReportCount", count)
+	}
+	if skipped > 0 {
+		reports.SetAnnotation("SkippedReportCount", skipped)
+	}
 	return &reports, nil
 }
 
+// DefaultMaxMultipartBytes is the largest form field that a MultipartParser
+// accepts, if you don't choose a different limit.
+const DefaultMaxMultipartBytes = 1 << 20
+
+// PayloadTooLargeError is returned by MultipartParser and CBORParser when they
+// reject an upload because its reports are too large, and by any parser when
+// an upload's body is larger than PipelineConfig.MaxUploadBytes.
+type PayloadTooLargeError struct {
+	MaxBytes int64
+}
+
+// Error describes the size limit that the upload exceeded.
+func (e PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("Upload payload is larger than %d bytes", e.MaxBytes)
+}
+
+// MultipartParser is a PayloadParser for multipart/form-data uploads, for
+// clients that send their reports in a form field rather than as the body of
+// the request.  The contents of the field (which can also be a file) must be
+// in the standard format defined by the Reporting spec; we hand them to
+// Reports to parse, as if they were the body of the request.  The rest of the
+// form is ignored.  This isn't part of the Reporting spec, so a Pipeline only
+// uses it if you ask; see PipelineConfig.MultipartField.
+type MultipartParser struct {
+	// The name of the form field that contains the reports.
+	Field string
+
+	// The largest field that we accept, in bytes.  Larger fields are rejected
+	// with a PayloadTooLargeError.  If 0, we use DefaultMaxMultipartBytes.
+	MaxBytes int64
+
+	// The parser for the field's contents.  If nil, we use
+	// DefaultPayloadParser.
+	Reports PayloadParser
+}
+
+// Parse extracts the reports field from a multipart/form-data upload, and
+// parses it.
+func (p MultipartParser) Parse(r *http.Request, clock Clock) (*ReportBatch, error) {
+	maxBytes := p.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxMultipartBytes
+	}
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Missing %q form field", p.Field)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() != p.Field {
+			continue
+		}
+		// Read one byte more than the limit, so that we can tell whether the
+		// field is too large.
+		payload, err := ioutil.ReadAll(io.LimitReader(part, maxBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(payload)) > maxBytes {
+			return nil, PayloadTooLargeError{maxBytes}
+		}
+
+		reports := p.Reports
+		if reports == nil {
+			reports = DefaultPayloadParser
+		}
+		inner := *r
+		inner.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		inner.ContentLength = int64(len(payload))
+		return reports.Parse(&inner, clock)
+	}
+}
+
+// decodeReports parses a JSON array of reports, returning the reports that we
+// kept along with the number of reports in the array, and the number of
+// malformed reports that we skipped (which is always 0 unless p.Tolerant is
+// set).  Rather than decoding the whole array at once (which requires
+// json.Decoder to buffer the entire payload), we step through the array one
+// element at a time, so that the memory needed beyond the parsed reports
+// themselves is proportional to the size of a single report.
+func (p ReportBatchParser) decodeReports(body io.Reader) ([]NelReport, int, int, error) {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if token == nil {
+		// A JSON null decodes to an empty batch, as it does with json.Unmarshal.
+		return nil, 0, 0, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, 0, 0, fmt.Errorf("expected a JSON array of reports, got %v", token)
+	}
+
+	reports := []NelReport{}
+	count := 0
+	skipped := 0
+	for decoder.More() {
+		count++
+		if p.MaxReports > 0 && count > p.MaxReports {
+			if !p.Truncate {
+				return nil, 0, 0, TooManyReportsError{p.MaxReports}
+			}
+			// Skip over (but still validate) any reports past the limit,
+			// without parsing their contents.
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+		if p.Tolerant {
+			// Separate the element from the array first, so that a report
+			// that doesn't match our types can't affect how we parse the ones
+			// after it.
+			var element json.RawMessage
+			if err := decoder.Decode(&element); err != nil {
+				return nil, 0, 0, err
+			}
+			var report NelReport
+			if err := report.UnmarshalJSON(element); err != nil {
+				skipped++
+				continue
+			}
+			reports = append(reports, report)
+			continue
+		}
+		// Decode the outer layer of the report directly, rather than via
+		// NelReport.UnmarshalJSON, which would have to scan it a second time.
+		var raw rawReport
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, 0, 0, err
+		}
+		reports = append(reports, NelReport{})
+		if err := reports[len(reports)-1].fromRaw(&raw); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	// Consume the closing bracket.
+	if _, err := decoder.Token(); err != nil {
+		return nil, 0, 0, err
+	}
+	return reports, count, skipped, nil
+}
+
 // PrintBatchAsCLF prints out a summary of each report in the batch using a
 // format not unlike the format of an Apache access.log file.
 func PrintBatchAsCLF(batch *ReportBatch, w io.Writer) {
@@ -241,7 +622,8 @@ func PrintBatchAsCLF(batch *ReportBatch, w io.Writer) {
 // EncodeRawReports marshals an array of NelReports without using our custom
 // spec-aware JSON parsing rules, instead dumping out the content exactly as it
 // looks in Go.  This is used extensively in test cases to compare the results
-// of parsing and annotating against golden files.
+// of parsing and annotating against golden files.  Its format changes whenever
+// NelReport does; use MarshalBatch if you need a stable format.
 func EncodeRawReports(reports []NelReport) ([]byte, error) {
 	// This type alias lets us override our spec-aware JSON parsing rules, and
 	// dump out the content of a NelReport instance exactly as it looks in Go.
@@ -15,12 +15,19 @@
 package collector_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
 )
 
 // JSON marshalling and unmarshalling
@@ -83,3 +90,156 @@ func TestNelReport(t *testing.T) {
 		})
 	}
 }
+
+func TestNewReportBatchPayloads(t *testing.T) {
+	cases := []struct {
+		name, payload string
+		count         int
+		valid         bool
+	}{
+		{"Null", `null`, 0, true},
+		{"Empty", `[]`, 0, true},
+		{"One", `[{"type": "network-error", "body": {"type": "ok"}}]`, 1, true},
+		{"Two", `[{"type": "network-error", "body": {"type": "ok"}}, {"type": "csp-violation", "body": {}}]`, 2, true},
+		{"Object", `{"type": "network-error"}`, 0, false},
+		{"Truncated", `[{"type": "network-error"}, `, 0, false},
+		{"Unclosed", `[{"type": "network-error"}`, 0, false},
+		{"Garbage", `[{"type": "network-error"} 5]`, 0, false},
+	}
+	for _, c := range cases {
+		t.Run("NewReportBatch:"+c.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "https://example.com/upload/", strings.NewReader(c.payload))
+			batch, err := collector.NewReportBatch(request, pipelinetest.NewSimulatedClock())
+			if !c.valid {
+				if err == nil {
+					t.Errorf("NewReportBatch(%s) should return error", c.payload)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewReportBatch(%s): %v", c.payload, err)
+			}
+			if got := len(batch.Reports); got != c.count {
+				t.Errorf("NewReportBatch(%s) has %d reports, wanted %d", c.payload, got, c.count)
+			}
+		})
+	}
+}
+
+// nested returns a NEL report whose body contains an array nested depth levels
+// deep.
+func nested(depth int) string {
+	return `[{"type": "network-error", "body": {"type": "ok", "x": ` + strings.Repeat("[", depth) + strings.Repeat("]", depth) + `}}]`
+}
+
+func TestReportBatchParserMaxDepth(t *testing.T) {
+	cases := []struct {
+		name, payload string
+		maxDepth      int
+		valid         bool
+	}{
+		// The outer array, the report, and its body take up three levels.
+		{"Default", nested(collector.DefaultMaxJSONDepth - 3), 0, true},
+		{"TooDeepForDefault", nested(collector.DefaultMaxJSONDepth - 2), 0, false},
+		{"Limit", nested(5), 8, true},
+		{"TooDeep", nested(6), 8, false},
+		{"BracketsInStrings", `[{"type": "network-error", "body": {"type": "ok", "x": "[[[[[[\"{{{{{{"}}]`, 4, true},
+		{"Pathological", `[` + strings.Repeat(`{"a":[`, 500000), 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "https://example.com/upload/", strings.NewReader(c.payload))
+			_, err := collector.ReportBatchParser{MaxDepth: c.maxDepth}.Parse(request, pipelinetest.NewSimulatedClock())
+			if c.valid {
+				if err != nil {
+					t.Errorf("Parse(%s): %v", c.name, err)
+				}
+				return
+			}
+			if _, ok := err.(collector.TooDeeplyNestedError); !ok {
+				t.Errorf("Parse(%s) got error %v, wanted TooDeeplyNestedError", c.name, err)
+			}
+		})
+	}
+}
+
+// benchmarkPayload returns an upload containing 1000 reports, mostly NEL
+// reports but with some of other types mixed in.
+func benchmarkPayload(b *testing.B) []byte {
+	var reports []json.RawMessage
+	for _, name := range []string{"multiple-valid-nel-reports", "non-nel-report"} {
+		var file []json.RawMessage
+		err := json.Unmarshal(testdata(filepath.Join("../pipelinetest/testdata/reports", name+".json")), &file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		reports = append(reports, file...)
+	}
+	var payload bytes.Buffer
+	payload.WriteString("[")
+	for i := 0; i < 1000; i++ {
+		if i > 0 {
+			payload.WriteString(",")
+		}
+		payload.Write(reports[i%len(reports)])
+	}
+	payload.WriteString("]")
+	return payload.Bytes()
+}
+
+func BenchmarkNewReportBatch(b *testing.B) {
+	payload := benchmarkPayload(b)
+	clock := pipelinetest.NewSimulatedClock()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+		if _, err := collector.NewReportBatch(request, clock); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalBatch(t *testing.T) {
+	collectorURL, _ := url.Parse("https://collector.example/upload?a=b")
+	batch := &collector.ReportBatch{
+		Time:            time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC),
+		CollectorURL:    *collectorURL,
+		ClientIP:        "192.0.2.1",
+		ClientUserAgent: "Mozilla/5.0",
+		Host:            "collector.example",
+		TLS:             &collector.TLSInfo{Version: "TLS 1.3", CipherSuite: "TLS_AES_128_GCM_SHA256"},
+		Header:          http.Header{"Authorization": {"secret"}},
+		Reports: []collector.NelReport{
+			{Age: 500, ReportType: "network-error", URL: "https://example.com/", Phase: "connection", Type: "tcp.timed_out", SamplingFraction: 1},
+			{ReportType: "csp-violation", URL: "https://example.com/", RawBody: []byte(`{"blocked":"x"}`)},
+		},
+	}
+	batch.SetAnnotation("Source", "test")
+	batch.Reports[0].SetAnnotation("Count", 3)
+
+	encoded, err := collector.MarshalBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"format_version":1,"received_at":"2024-01-02T15:30:00Z","collector_url":"https://collector.example/upload?a=b","client_ip":"192.0.2.1","client_user_agent":"Mozilla/5.0","host":"collector.example","tls":{"version":"TLS 1.3","cipher_suite":"TLS_AES_128_GCM_SHA256"},"annotations":{"Source":"test"},"reports":[{"age":500,"report_type":"network-error","url":"https://example.com/","user_agent":"","sampling_fraction":1,"phase":"connection","type":"tcp.timed_out","annotations":{"Count":3}},{"age":0,"report_type":"csp-violation","url":"https://example.com/","user_agent":"","body":{"blocked":"x"}}]}`
+	if string(encoded) != want {
+		t.Errorf("MarshalBatch = %s, wanted %s", encoded, want)
+	}
+
+	decoded, err := collector.UnmarshalBatch(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The header isn't encoded, and numeric annotations come back as float64s.
+	batch.Header = nil
+	batch.Reports[0].SetAnnotation("Count", 3.0)
+	if diff := cmp.Diff(batch, decoded); diff != "" {
+		t.Errorf("UnmarshalBatch got diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := collector.UnmarshalBatch([]byte(`{"format_version":2,"reports":[]}`)); err == nil {
+		t.Errorf("UnmarshalBatch should reject a newer format version")
+	}
+}
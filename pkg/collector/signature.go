@@ -0,0 +1,213 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSignatureHeader is the request header that a PayloadSigner's
+// signatures are sent in, unless you choose a different one.
+const DefaultSignatureHeader = "X-NEL-Signature"
+
+// DefaultSignatureMaxSkew is how far a signature's timestamp can be from the
+// current time before a PayloadSigner rejects it, unless you choose a
+// different limit.
+const DefaultSignatureMaxSkew = 5 * time.Minute
+
+var signatureAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// PayloadSigner signs the bodies of requests that one collector sends to
+// another (such as with publish.WebhookPublisher) with an HMAC, using a secret
+// that the two collectors share, so that the receiving collector can tell
+// that they haven't been forged or tampered with; see VerifySignature.
+//
+// A signature looks like `t=<timestamp>,sha256=<hex digest>`, giving the time
+// (in seconds since the Unix epoch) when the payload was signed and naming the
+// hash function that the HMAC uses, and is sent in the Header request header.
+// The HMAC covers the timestamp, followed by a period and the payload, so that
+// the timestamp can't be changed either.  Verify rejects signatures whose
+// timestamps are more than MaxSkew away from the current time (according to
+// Clock, or time.Now if it's nil), so that a request that was captured in
+// transit can't be replayed later.
+type PayloadSigner struct {
+	Header  string
+	MaxSkew time.Duration
+	Clock   Clock
+
+	algorithm string
+	newHash   func() hash.Hash
+	secret    []byte
+}
+
+// NewPayloadSigner creates a new PayloadSigner that signs payloads with
+// secret, using DefaultSignatureHeader and DefaultSignatureMaxSkew.  algorithm must be "sha256" or
+// "sha512".
+func NewPayloadSigner(secret []byte, algorithm string) (*PayloadSigner, error) {
+	newHash, ok := signatureAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("Unknown signature algorithm %s", algorithm)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Signature secret must not be empty")
+	}
+	return &PayloadSigner{
+		Header:    DefaultSignatureHeader,
+		MaxSkew:   DefaultSignatureMaxSkew,
+		algorithm: algorithm,
+		newHash:   newHash,
+		secret:    secret,
+	}, nil
+}
+
+func (s *PayloadSigner) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+func (s *PayloadSigner) mac(timestamp string, payload []byte) []byte {
+	mac := hmac.New(s.newHash, s.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Sign returns the signature for a payload, timestamped with the current time.
+func (s *PayloadSigner) Sign(payload []byte) string {
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	return "t=" + timestamp + "," + s.algorithm + "=" + hex.EncodeToString(s.mac(timestamp, payload))
+}
+
+// Verify returns whether signature is a valid signature for a payload.  The
+// signature must use the same algorithm as the signer, and its timestamp must
+// be within MaxSkew of the current time.
+func (s *PayloadSigner) Verify(payload []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "t=") {
+		return false
+	}
+	comma := strings.IndexByte(signature, ',')
+	if comma < 0 {
+		return false
+	}
+	timestamp := signature[len("t="):comma]
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	now, signed := s.now(), time.Unix(seconds, 0)
+	if signed.Before(now.Add(-s.MaxSkew)) || signed.After(now.Add(s.MaxSkew)) {
+		return false
+	}
+	prefix := s.algorithm + "="
+	digest := signature[comma+1:]
+	if !strings.HasPrefix(digest, prefix) {
+		return false
+	}
+	got, err := hex.DecodeString(digest[len(prefix):])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, s.mac(timestamp, payload))
+}
+
+// SignatureVerifier is an http.Handler that only passes on requests whose
+// bodies have a valid signature from a PayloadSigner with the same secret and
+// algorithm; see VerifySignature.
+type SignatureVerifier struct {
+	handler  http.Handler
+	signer   *PayloadSigner
+	maxBytes int64
+	rejected int64
+}
+
+// VerifySignature wraps a handler (such as a Pipeline) so that it only sees
+// requests that were signed by signer, for a collector that should only
+// accept reports forwarded by other collectors.  Requests without a
+// signature, or with one that isn't valid or whose timestamp is too far from
+// the current time, get a 401 response.  We have to
+// read the whole body before we can check its signature, so bodies larger
+// than maxBytes get a 413 response instead.  OPTIONS requests (CORS
+// preflights) are passed on without being checked, since they don't have a
+// body.  Other requests must be POSTs, and anything else gets a 405 response:
+// since only the body is signed, a GET upload (see
+// PipelineConfig.GetParameter), whose body is empty, could otherwise be
+// authorized by any signature of an empty body.
+func VerifySignature(handler http.Handler, signer *PayloadSigner, maxBytes int64) *SignatureVerifier {
+	return &SignatureVerifier{handler: handler, signer: signer, maxBytes: maxBytes}
+}
+
+// ServeHTTP checks the request's signature, and passes it on to the wrapped
+// handler if it's valid.
+func (v *SignatureVerifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		v.handler.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		atomic.AddInt64(&v.rejected, 1)
+		http.Error(w, "Must use POST to upload signed reports", http.StatusMethodNotAllowed)
+		return
+	}
+	signature := r.Header.Get(v.signer.Header)
+	if signature == "" {
+		atomic.AddInt64(&v.rejected, 1)
+		http.Error(w, "Missing "+v.signer.Header+" header", http.StatusUnauthorized)
+		return
+	}
+	// Read one byte more than the limit, so that we can tell whether the body
+	// is too large.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, v.maxBytes+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > v.maxBytes {
+		atomic.AddInt64(&v.rejected, 1)
+		http.Error(w, PayloadTooLargeError{v.maxBytes}.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !v.signer.Verify(body, signature) {
+		atomic.AddInt64(&v.rejected, 1)
+		http.Error(w, "Invalid "+v.signer.Header+" header", http.StatusUnauthorized)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	v.handler.ServeHTTP(w, r)
+}
+
+// Rejected returns the number of requests that have been rejected because
+// they weren't properly signed.
+func (v *SignatureVerifier) Rejected() int64 {
+	return atomic.LoadInt64(&v.rejected)
+}
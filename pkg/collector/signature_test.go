@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestPayloadSigner(t *testing.T) {
+	signer, err := collector.NewPayloadSigner([]byte("Jefe"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &pipelinetest.SimulatedClock{CurrentTime: time.Unix(1700000000, 0)}
+	signer.Clock = clock
+	payload := []byte("what do ya want for nothing?")
+	mac := hmac.New(sha256.New, []byte("Jefe"))
+	mac.Write([]byte("1700000000."))
+	mac.Write(payload)
+	want := "t=1700000000,sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := signer.Sign(payload); got != want {
+		t.Errorf("Sign() = %s, wanted %s", got, want)
+	}
+	if !signer.Verify(payload, want) {
+		t.Errorf("Verify() rejected a valid signature")
+	}
+	sha512, err := collector.NewPayloadSigner([]byte("Jefe"), "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha512.Clock = clock
+	digest := strings.TrimPrefix(want, "t=1700000000,")
+	for _, signature := range []string{
+		"",
+		digest,
+		"t=1700000000," + strings.TrimPrefix(digest, "sha256="),
+		"t=1700000001," + digest,
+		"t=soon," + digest,
+		"t=1700000000,sha256=not hex",
+		want + "00",
+		sha512.Sign(payload),
+	} {
+		if signer.Verify(payload, signature) {
+			t.Errorf("Verify(%q) should reject signature", signature)
+		}
+	}
+
+	// Signatures are only valid for MaxSkew either side of when they were
+	// made, so that they can't be replayed later.
+	for _, c := range []struct {
+		offset time.Duration
+		valid  bool
+	}{
+		{-collector.DefaultSignatureMaxSkew, true},
+		{collector.DefaultSignatureMaxSkew, true},
+		{-collector.DefaultSignatureMaxSkew - time.Second, false},
+		{collector.DefaultSignatureMaxSkew + time.Second, false},
+	} {
+		clock.CurrentTime = time.Unix(1700000000, 0).Add(c.offset)
+		if got := signer.Verify(payload, want); got != c.valid {
+			t.Errorf("Verify() %v after signing = %v, wanted %v", c.offset, got, c.valid)
+		}
+	}
+
+	if _, err := collector.NewPayloadSigner([]byte("Jefe"), "md5"); err == nil {
+		t.Errorf("NewPayloadSigner(md5) should return error")
+	}
+	if _, err := collector.NewPayloadSigner(nil, "sha256"); err == nil {
+		t.Errorf("NewPayloadSigner without a secret should return error")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	signer, err := collector.NewPayloadSigner([]byte("secret"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []string
+	handler := collector.VerifySignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}), signer, 64)
+
+	body := `[{"type": "network-error"}]`
+	stale := &collector.PayloadSigner{}
+	*stale = *signer
+	stale.Clock = &pipelinetest.SimulatedClock{CurrentTime: time.Now().Add(-time.Hour)}
+	large := strings.Repeat(" ", 64) + body
+	for _, c := range []struct {
+		name, method, body, signature string
+		status                        int
+	}{
+		{"Valid", "POST", body, signer.Sign([]byte(body)), http.StatusNoContent},
+		{"Unsigned", "POST", body, "", http.StatusUnauthorized},
+		{"Invalid", "POST", body, signer.Sign([]byte(body + " ")), http.StatusUnauthorized},
+		{"Stale", "POST", body, stale.Sign([]byte(body)), http.StatusUnauthorized},
+		{"TooLarge", "POST", large, signer.Sign([]byte(large)), http.StatusRequestEntityTooLarge},
+		{"Preflight", "OPTIONS", "", "", http.StatusNoContent},
+		// A GET upload's reports are in its URL, which isn't signed.
+		{"Get", "GET", "", signer.Sign(nil), http.StatusMethodNotAllowed},
+	} {
+		request := httptest.NewRequest(c.method, "https://example.com/upload/", strings.NewReader(c.body))
+		if c.signature != "" {
+			request.Header.Set(collector.DefaultSignatureHeader, c.signature)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != c.status {
+			t.Errorf("VerifySignature(%s) got status %d, wanted %d", c.name, response.Code, c.status)
+		}
+	}
+	if len(received) != 2 || received[0] != body {
+		t.Errorf("VerifySignature passed on %q, wanted the valid upload and the preflight", received)
+	}
+	if got, want := handler.Rejected(), int64(5); got != want {
+		t.Errorf("VerifySignature rejected %d requests, wanted %d", got, want)
+	}
+}
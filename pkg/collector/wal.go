@@ -0,0 +1,589 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The fsync policies that a WAL can use.
+const (
+	// WALSyncAlways syncs each batch to disk before Append returns.
+	WALSyncAlways = "always"
+	// WALSyncInterval syncs the log once a second, so a crash can lose up to
+	// a second's worth of uploads.
+	WALSyncInterval = "interval"
+	// WALSyncNever leaves it up to the operating system when to write the
+	// log to disk, so a crash of the machine (rather than the collector) can
+	// lose uploads.
+	WALSyncNever = "never"
+)
+
+// DefaultWALSegmentBytes is the default size of a WAL's segment files.
+const DefaultWALSegmentBytes = 16 << 20
+
+const walSuffix = ".wal"
+const walCheckpointFile = "checkpoint"
+const walLockFile = "lock"
+const walFailedFile = "failed.jsonl"
+const walSyncInterval = time.Second
+
+// walCheckpointBatches is how far the checkpoint moves forward before we save
+// it again.  Saving it less often means that a crash can replay a few more
+// batches that were already done, which at-least-once delivery allows.
+const walCheckpointBatches = 64
+
+// ErrWAL is returned from ProcessReports when an upload couldn't be written to
+// the pipeline's write-ahead log (see UseWAL), and the report is rejected.
+var ErrWAL = errors.New("couldn't write to write-ahead log, report rejected")
+
+// WAL is a write-ahead log of report batches, which lets a Pipeline deliver
+// each batch that it accepts at least once, even if the collector crashes or
+// is restarted before the batch has been processed; see Pipeline.UseWAL.
+//
+// Each batch that's appended to the log gets an offset, one more than the
+// previous batch's.  Once a batch has been processed, call Done with its
+// offset.  The log's checkpoint is the oldest offset that isn't done yet,
+// which is saved to a file in Dir every few dozen batches, and when the log is
+// closed.  When the log is opened, every batch at or after the saved
+// checkpoint is loaded, so that it can be replayed (see Replay).  Since
+// batches can finish out of order, and the checkpoint isn't saved after every
+// one, some of those may already have been processed, which is why delivery
+// is at least once, rather than exactly once.
+//
+// A batch that couldn't be processed is passed to Fail instead of Done, which
+// copies it to the file failed.jsonl in Dir (in the same format as the
+// segments, described below) before marking it as done, so that one bad batch
+// can't hold the checkpoint back, and the log keeps being truncated.  It's up
+// to you to inspect those batches, and to upload them again if needed.
+//
+// Only one WAL can have a directory open at a time; OpenWAL locks it (on
+// systems that support flock), and fails if it's already locked.
+//
+// The log is a directory of append-only segment files, named after the
+// offset of their first batch, each containing one line of JSON per batch.
+// (As with core.Spool, annotations come back in their JSON form; for
+// instance, numbers become float64s.  The batch's TLS details aren't saved.)
+// We start a new segment once the current one is SegmentBytes long, and
+// delete each segment once every batch in it is done.  If a crash left a
+// segment with a partly written line, that line is skipped.
+type WAL struct {
+	Dir          string
+	SegmentBytes int64
+
+	// When we sync the log to disk: WALSyncAlways, WALSyncInterval, or
+	// WALSyncNever.
+	Sync string
+
+	mu           sync.Mutex
+	lock         *os.File
+	next         uint64
+	checkpoint   uint64
+	saved        uint64
+	outstanding  map[uint64]bool
+	segments     []walSegment
+	current      *os.File
+	currentBytes int64
+	dirty        bool
+	unprocessed  []WALEntry
+	closed       bool
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// walSegment is one of a WAL's segment files.  start is the offset of the
+// first batch in it, and end is one more than the offset of the last one.
+type walSegment struct {
+	path  string
+	start uint64
+	end   uint64
+}
+
+// WALEntry is a batch that was loaded from a WAL, along with its offset.
+type WALEntry struct {
+	Offset uint64
+	Batch  *ReportBatch
+}
+
+// OpenWAL opens the write-ahead log in dir, creating the directory if needed,
+// and loads any batches that weren't done when it was last closed.  sync must
+// be one of WALSyncAlways, WALSyncInterval, or WALSyncNever.
+func OpenWAL(dir string, segmentBytes int64, sync string) (*WAL, error) {
+	switch sync {
+	case WALSyncAlways, WALSyncInterval, WALSyncNever:
+	default:
+		return nil, fmt.Errorf("Unknown WAL sync policy %s", sync)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockWALDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openLockedWAL(dir, segmentBytes, sync)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	w.lock = lock
+	if sync == WALSyncInterval {
+		w.done = make(chan struct{})
+		w.wg.Add(1)
+		go w.syncPeriodically()
+	}
+	return w, nil
+}
+
+// openLockedWAL loads the write-ahead log in dir, once it's been locked.
+func openLockedWAL(dir string, segmentBytes int64, sync string) (*WAL, error) {
+	w := &WAL{
+		Dir:          dir,
+		SegmentBytes: segmentBytes,
+		Sync:         sync,
+		outstanding:  make(map[uint64]bool),
+	}
+	os.Remove(filepath.Join(dir, walCheckpointFile+".tmp"))
+	data, err := ioutil.ReadFile(filepath.Join(dir, walCheckpointFile))
+	if err == nil {
+		w.checkpoint, err = strconv.ParseUint(string(bytes.TrimSpace(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid WAL checkpoint in %s: %v", dir, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	w.next = w.checkpoint
+	w.saved = w.checkpoint
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		segment, records, err := w.loadSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		if records == 0 {
+			// A crash can leave behind an empty segment, whose name could
+			// clash with the next one that we create.
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		w.segments = append(w.segments, segment)
+	}
+	// Skip over any records at the checkpoint that were corrupt.
+	w.advance()
+	if err := w.truncate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// loadSegment reads the batches in a segment file, keeping any that aren't
+// done yet, and returns the number of batches that it contains.
+func (w *WAL) loadSegment(path string) (walSegment, int, error) {
+	segment := walSegment{path: path}
+	segment.start, _ = strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), walSuffix), 10, 64)
+	segment.end = segment.start
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return segment, 0, err
+	}
+	records := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		offset, batch, err := decodeWALRecord(line)
+		if err != nil {
+			log.Printf("WAL: skipping corrupt record in %s: %v", path, err)
+			continue
+		}
+		records++
+		if offset+1 > segment.end {
+			segment.end = offset + 1
+		}
+		if offset+1 > w.next {
+			w.next = offset + 1
+		}
+		if offset >= w.checkpoint && !w.outstanding[offset] {
+			w.outstanding[offset] = true
+			w.unprocessed = append(w.unprocessed, WALEntry{offset, batch})
+		}
+	}
+	return segment, records, nil
+}
+
+type walRecord struct {
+	Offset            uint64                   `json:"offset"`
+	Time              time.Time                `json:"time"`
+	CollectorURL      string                   `json:"collector_url,omitempty"`
+	ClientIP          string                   `json:"client_ip,omitempty"`
+	ClientUserAgent   string                   `json:"client_user_agent,omitempty"`
+	ClientReferrer    string                   `json:"client_referrer,omitempty"`
+	Host              string                   `json:"host,omitempty"`
+	Header            http.Header              `json:"header,omitempty"`
+	Annotations       map[string]interface{}   `json:"annotations,omitempty"`
+	Reports           []NelReport              `json:"reports"`
+	ReportAnnotations []map[string]interface{} `json:"report_annotations,omitempty"`
+}
+
+func encodeWALRecord(offset uint64, batch *ReportBatch) ([]byte, error) {
+	record := walRecord{
+		Offset:          offset,
+		Time:            batch.Time,
+		CollectorURL:    batch.CollectorURL.String(),
+		ClientIP:        batch.ClientIP,
+		ClientUserAgent: batch.ClientUserAgent,
+		ClientReferrer:  batch.ClientReferrer,
+		Host:            batch.Host,
+		Header:          batch.Header,
+		Annotations:     batch.CloneAnnotations().Annotations,
+		Reports:         batch.Reports,
+	}
+	for i := range batch.Reports {
+		annotations := batch.Reports[i].CloneAnnotations().Annotations
+		if len(annotations) > 0 && record.ReportAnnotations == nil {
+			record.ReportAnnotations = make([]map[string]interface{}, len(batch.Reports))
+		}
+		if record.ReportAnnotations != nil {
+			record.ReportAnnotations[i] = annotations
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func decodeWALRecord(line []byte) (uint64, *ReportBatch, error) {
+	var record walRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return 0, nil, err
+	}
+	batch := &ReportBatch{
+		Time:            record.Time,
+		ClientIP:        record.ClientIP,
+		ClientUserAgent: record.ClientUserAgent,
+		ClientReferrer:  record.ClientReferrer,
+		Host:            record.Host,
+		Header:          record.Header,
+		Reports:         record.Reports,
+	}
+	if u, err := url.Parse(record.CollectorURL); err == nil {
+		batch.CollectorURL = *u
+	}
+	for name, value := range record.Annotations {
+		batch.SetAnnotation(name, value)
+	}
+	for i, annotations := range record.ReportAnnotations {
+		if i >= len(batch.Reports) {
+			break
+		}
+		for name, value := range annotations {
+			batch.Reports[i].SetAnnotation(name, value)
+		}
+	}
+	return record.Offset, batch, nil
+}
+
+// Replay returns the batches that weren't done when the log was opened,
+// oldest first.  Each one still needs to be marked as done once it's been
+// processed.  Later calls return nothing.
+func (w *WAL) Replay() []WALEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := w.unprocessed
+	w.unprocessed = nil
+	return entries
+}
+
+// Append adds a batch to the log, and returns its offset.
+func (w *WAL) Append(batch *ReportBatch) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, fmt.Errorf("WAL is closed")
+	}
+	line, err := encodeWALRecord(w.next, batch)
+	if err != nil {
+		return 0, err
+	}
+	if w.current != nil && w.currentBytes >= w.SegmentBytes {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if w.current == nil {
+		path := filepath.Join(w.Dir, fmt.Sprintf("%020d%s", w.next, walSuffix))
+		w.current, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return 0, err
+		}
+		w.currentBytes = 0
+		w.segments = append(w.segments, walSegment{path: path, start: w.next, end: w.next})
+	}
+	n, err := w.current.Write(line)
+	w.currentBytes += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	if w.Sync == WALSyncAlways {
+		if err := w.current.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		w.dirty = true
+	}
+	offset := w.next
+	w.next++
+	w.outstanding[offset] = true
+	w.segments[len(w.segments)-1].end = w.next
+	return offset, nil
+}
+
+// Done marks the batch at offset as processed, moving the checkpoint forward
+// if it was the oldest one that wasn't done yet.  Once the checkpoint has
+// moved far enough, we save it and delete any segments that are no longer
+// needed.
+func (w *WAL) Done(offset uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.outstanding[offset] {
+		return nil
+	}
+	return w.markDone(offset)
+}
+
+// Fail copies the batch at offset to the log's file of failed batches (see
+// WAL), and then marks it as done.  The batch is marked as done even if it
+// couldn't be copied, so that it doesn't hold the checkpoint back.
+func (w *WAL) Fail(offset uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.outstanding[offset] {
+		return nil
+	}
+	err := w.saveFailed(offset)
+	if doneErr := w.markDone(offset); err == nil {
+		err = doneErr
+	}
+	return err
+}
+
+// saveFailed appends the record of the batch at offset to the log's file of
+// failed batches.  w.mu must be held.
+func (w *WAL) saveFailed(offset uint64) error {
+	var line []byte
+	for _, segment := range w.segments {
+		if offset < segment.start || offset >= segment.end {
+			continue
+		}
+		data, err := ioutil.ReadFile(segment.path)
+		if err != nil {
+			return err
+		}
+		for _, l := range bytes.Split(data, []byte("\n")) {
+			var record struct {
+				Offset uint64 `json:"offset"`
+			}
+			if json.Unmarshal(l, &record) == nil && record.Offset == offset {
+				line = append(l, '\n')
+				break
+			}
+		}
+	}
+	if line == nil {
+		return fmt.Errorf("Couldn't find WAL batch %d to save it as failed", offset)
+	}
+	f, err := os.OpenFile(filepath.Join(w.Dir, walFailedFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if err == nil && w.Sync == WALSyncAlways {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// markDone marks the batch at offset as done, which it must not already be.
+// w.mu must be held.
+func (w *WAL) markDone(offset uint64) error {
+	delete(w.outstanding, offset)
+	if offset != w.checkpoint {
+		return nil
+	}
+	w.advance()
+	if w.checkpoint-w.saved < walCheckpointBatches {
+		return nil
+	}
+	return w.save()
+}
+
+// advance moves the checkpoint forward past every batch that's done.  Each
+// offset is only passed once, so this takes constant time per batch overall.
+// w.mu must be held.
+func (w *WAL) advance() {
+	for w.checkpoint < w.next && !w.outstanding[w.checkpoint] {
+		w.checkpoint++
+	}
+}
+
+// save writes the checkpoint to disk, if it's moved since it was last saved,
+// and deletes any segments that are no longer needed.  w.mu must be held.
+func (w *WAL) save() error {
+	if w.checkpoint != w.saved {
+		if err := w.writeCheckpoint(); err != nil {
+			return err
+		}
+		w.saved = w.checkpoint
+	}
+	return w.truncate()
+}
+
+// Checkpoint returns the offset of the oldest batch that isn't done yet (or
+// of the next batch to be appended, if they all are).
+func (w *WAL) Checkpoint() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.checkpoint
+}
+
+// writeCheckpoint atomically replaces the checkpoint file.  w.mu must be held.
+func (w *WAL) writeCheckpoint() error {
+	path := filepath.Join(w.Dir, walCheckpointFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", w.checkpoint)
+	if err == nil && w.Sync == WALSyncAlways {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// truncate deletes every segment (other than the one we're appending to) whose
+// batches are all before the saved checkpoint.  w.mu must be held.
+func (w *WAL) truncate() error {
+	var kept []walSegment
+	for i, segment := range w.segments {
+		current := w.current != nil && i == len(w.segments)-1
+		if current || segment.end > w.saved {
+			kept = append(kept, segment)
+			continue
+		}
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.segments = kept
+	return nil
+}
+
+// rotate closes the current segment.  w.mu must be held.
+func (w *WAL) rotate() error {
+	if w.current == nil {
+		return nil
+	}
+	err := w.current.Sync()
+	if closeErr := w.current.Close(); err == nil {
+		err = closeErr
+	}
+	w.current = nil
+	w.dirty = false
+	return err
+}
+
+func (w *WAL) syncPeriodically() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty && w.current != nil {
+				if err := w.current.Sync(); err != nil {
+					log.Printf("WAL: %v", err)
+				}
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the log, saves its checkpoint, deletes any segments
+// whose batches are all done, and unlocks its directory.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+	if w.done != nil {
+		close(w.done)
+		w.wg.Wait()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.rotate()
+	if saveErr := w.save(); err == nil {
+		err = saveErr
+	}
+	if w.lock != nil {
+		if closeErr := w.lock.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,439 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// walSegments returns the names of the segment files in a WAL's directory.
+func walSegments(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Put each batch in a segment of its own.
+	wal, err := collector.OpenWAL(dir, 1, collector.WALSyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	for i, clientIP := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		batch := &collector.ReportBatch{
+			Time:     received,
+			ClientIP: clientIP,
+			Reports:  []collector.NelReport{{URL: "https://example.com/", Type: "tcp.timed_out"}},
+		}
+		batch.SetAnnotation("Upload", clientIP)
+		batch.Reports[0].SetAnnotation("Index", i)
+		offset, err := wal.Append(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != uint64(i) {
+			t.Errorf("Append #%d returned offset %d", i, offset)
+		}
+	}
+	// Batches can finish out of order, but the checkpoint only moves past the
+	// oldest one that's still in flight.
+	wal.Done(0)
+	wal.Done(2)
+	if got := wal.Checkpoint(); got != 1 {
+		t.Errorf("Checkpoint() = %d, wanted 1", got)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"00000000000000000001.wal", "00000000000000000002.wal"}
+	if got := walSegments(t, dir); !equalStrings(got, want) {
+		t.Errorf("WAL segments = %v, wanted %v", got, want)
+	}
+
+	// A crash can leave a partly written line at the end of a segment.
+	f, err := os.OpenFile(filepath.Join(dir, want[1]), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"offset":3,"time":`)
+	f.Close()
+
+	wal, err = collector.OpenWAL(dir, 1, collector.WALSyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := wal.Replay()
+	if len(entries) != 2 || entries[0].Offset != 1 || entries[1].Offset != 2 {
+		t.Fatalf("Replay() = %v, wanted offsets 1 and 2", entries)
+	}
+	batch := entries[0].Batch
+	if batch.ClientIP != "192.0.2.2" || !batch.Time.Equal(received) || len(batch.Reports) != 1 {
+		t.Errorf("Replayed batch = %+v", batch)
+	}
+	if got := batch.GetAnnotation("Upload"); got != "192.0.2.2" {
+		t.Errorf("Replayed batch Upload = %v", got)
+	}
+	if got := batch.Reports[0].GetAnnotation("Index"); got != 1.0 {
+		t.Errorf("Replayed report Index = %v", got)
+	}
+	if entries := wal.Replay(); len(entries) != 0 {
+		t.Errorf("Second Replay() = %v, wanted nothing", entries)
+	}
+
+	wal.Done(1)
+	wal.Done(2)
+	offset, err := wal.Append(&collector.ReportBatch{Time: received})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 3 {
+		t.Errorf("Append after reopening returned offset %d, wanted 3", offset)
+	}
+	wal.Done(offset)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := walSegments(t, dir); len(got) != 0 {
+		t.Errorf("WAL segments = %v, wanted none", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPipelineWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Leave a batch in the log that was never processed, as if the collector
+	// had crashed.
+	wal, err := collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.Append(&collector.ReportBatch{Reports: []collector.NelReport{{}, {}}}); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	wal, err = collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	pipeline.UseWAL(wal)
+	counter := &countingProcessor{}
+	pipeline.AddProcessor(counter)
+	if n := pipeline.ReplayWAL(context.Background()); n != 1 {
+		t.Errorf("ReplayWAL() = %d, wanted 1", n)
+	}
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+	request.Header.Add("Content-Type", "application/reports+json")
+	response := httptest.NewRecorder()
+	if err := pipeline.ProcessReports(context.Background(), response, request); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Close()
+	if got := atomic.LoadInt64(&counter.count); got != 3 {
+		t.Errorf("Processed %d reports, wanted 3", got)
+	}
+	if got := wal.Checkpoint(); got != 2 {
+		t.Errorf("Checkpoint() = %d, wanted 2", got)
+	}
+
+	// Once the log is closed, uploads can't be written to it.
+	response = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+	request.Header.Add("Content-Type", "application/reports+json")
+	pipeline = collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	pipeline.UseWAL(wal)
+	if err := pipeline.ProcessReports(context.Background(), response, request); err != collector.ErrWAL {
+		t.Errorf("ProcessReports with a closed WAL = %v, wanted ErrWAL", err)
+	}
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("ProcessReports with a closed WAL responded with %d", response.Code)
+	}
+	pipeline.Close()
+}
+
+func TestWALLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever); err == nil {
+		t.Errorf("OpenWAL of a directory that's in use should return error")
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+	if err != nil {
+		t.Fatalf("OpenWAL after closing: %v", err)
+	}
+	wal.Close()
+}
+
+// walFailer fails to handle every batch, either by returning an error or by
+// panicking.
+type walFailer struct {
+	panics bool
+}
+
+func (f walFailer) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	f.TryProcessReports(ctx, batch)
+}
+
+func (f walFailer) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if f.panics {
+		panic("walFailer")
+	}
+	return errors.New("walFailer")
+}
+
+// uploadTo uploads a valid batch of reports to a pipeline.
+func uploadTo(pipeline *collector.Pipeline) (*httptest.ResponseRecorder, error) {
+	request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(testdata(validNelReportPath)))
+	request.Header.Add("Content-Type", "application/reports+json")
+	response := httptest.NewRecorder()
+	err := pipeline.ProcessReports(context.Background(), response, request)
+	return response, err
+}
+
+// replayOffsets reopens the WAL in dir, and returns the offsets of the batches
+// that it would replay.
+func replayOffsets(t *testing.T, dir string) []uint64 {
+	wal, err := collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	var offsets []uint64
+	for _, entry := range wal.Replay() {
+		offsets = append(offsets, entry.Offset)
+	}
+	return offsets
+}
+
+func TestPipelineWALSavesFailedBatches(t *testing.T) {
+	for _, failer := range []walFailer{{panics: false}, {panics: true}} {
+		dir, err := ioutil.TempDir("", "wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		wal, err := collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		pipeline.UseWAL(wal)
+		pipeline.AddProcessor(failer)
+		if _, err := uploadTo(pipeline); err != nil {
+			t.Fatal(err)
+		}
+		pipeline.Close()
+		if got := replayOffsets(t, dir); len(got) != 0 {
+			t.Errorf("After %+v, WAL replays offsets %v, wanted none", failer, got)
+		}
+		failed, err := ioutil.ReadFile(filepath.Join(dir, "failed.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := bytes.Count(failed, []byte("\n")); lines != 1 || !bytes.HasPrefix(failed, []byte(`{"offset":0,`)) {
+			t.Errorf("After %+v, failed batches = %s, wanted offset 0", failer, failed)
+		}
+	}
+}
+
+func TestPipelineWALQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Put each batch in a segment of its own.
+	wal, err := collector.OpenWAL(dir, 1, collector.WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{BufferSize: 1, NumWorkers: 1})
+	pipeline.UseWAL(wal)
+	blocking := blockingProcessor{started: make(chan struct{}, 10), release: make(chan struct{})}
+	pipeline.AddProcessor(blocking)
+
+	// The first upload occupies the only worker, and the second fills the
+	// queue.
+	uploadTo(pipeline)
+	<-blocking.started
+	uploadTo(pipeline)
+	response, err := uploadTo(pipeline)
+	if err != collector.ErrDropped {
+		t.Errorf("ProcessReports with a full queue = %v, wanted ErrDropped", err)
+	}
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("ProcessReports with a full queue responded with %d", response.Code)
+	}
+	close(blocking.release)
+
+	// The client will retry the rejected batch, so it mustn't hold back the
+	// checkpoint, or be replayed.
+	pipeline.Drain()
+	if got := wal.Checkpoint(); got != 3 {
+		t.Errorf("Checkpoint() = %d, wanted 3", got)
+	}
+	pipeline.Close()
+	if got := walSegments(t, dir); len(got) != 0 {
+		t.Errorf("WAL kept segments %v", got)
+	}
+	if got := replayOffsets(t, dir); len(got) != 0 {
+		t.Errorf("WAL replays offsets %v, wanted none", got)
+	}
+}
+
+func TestReplayWALWhileDraining(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wal, err := collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := wal.Append(&collector.ReportBatch{Reports: []collector.NelReport{{}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.Close()
+
+	wal, err = collector.OpenWAL(dir, collector.DefaultWALSegmentBytes, collector.WALSyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{BufferSize: 1, NumWorkers: 1})
+	pipeline.UseWAL(wal)
+	blocking := blockingProcessor{started: make(chan struct{}, 10), release: make(chan struct{})}
+	pipeline.AddProcessor(blocking)
+
+	// The first batch occupies the only worker, and the second fills the
+	// queue, so the replay waits for room for the third until we drain.
+	replayed := make(chan int)
+	go func() {
+		replayed <- pipeline.ReplayWAL(context.Background())
+	}()
+	<-blocking.started
+	drained := make(chan struct{})
+	go func() {
+		pipeline.Drain()
+		close(drained)
+	}()
+	select {
+	case n := <-replayed:
+		if n != 2 {
+			t.Errorf("ReplayWAL() = %d, wanted 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReplayWAL didn't stop when the pipeline started draining")
+	}
+	close(blocking.release)
+	<-drained
+	pipeline.Close()
+	if got := replayOffsets(t, dir); len(got) != 1 || got[0] != 2 {
+		t.Errorf("WAL replays offsets %v, wanted [2]", got)
+	}
+}
+
+func TestReuseWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := []byte(fmt.Sprintf("[pipeline]\nwal_dir = %q\n[[processor]]\ntype = \"HasSettings\"\n", dir))
+
+	ctx := context.Background()
+	old, err := collector.NewPipelineFromConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A configuration that fails to load leaves the log with the old
+	// pipeline.
+	failed := append(config, "[[processor]]\ntype = \"AlwaysThrowsError\"\n"...)
+	if _, err := collector.NewPipelineFromConfig(collector.ReuseProcessors(ctx, old), failed); err == nil {
+		t.Fatal("NewPipelineFromConfig should return error")
+	}
+	if _, err := uploadTo(old); err != nil {
+		t.Errorf("ProcessReports after a failed reload = %v", err)
+	}
+	reloaded, err := collector.NewPipelineFromConfig(collector.ReuseProcessors(ctx, old), config)
+	if err != nil {
+		t.Fatalf("Reloading with the same wal_dir: %v", err)
+	}
+	old.Close()
+	if _, err := uploadTo(reloaded); err != nil {
+		t.Errorf("ProcessReports after the old pipeline was closed = %v", err)
+	}
+	reloaded.Close()
+	if got := replayOffsets(t, dir); len(got) != 0 {
+		t.Errorf("WAL replays offsets %v, wanted none", got)
+	}
+}
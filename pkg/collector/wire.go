@@ -0,0 +1,198 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// There are three ways to serialize reports, for different purposes:
+//
+//   - NelReport's MarshalJSON and UnmarshalJSON use the format defined by the
+//     Reporting and NEL specs, which is what user agents upload.  It only
+//     contains the reports themselves, without their annotations or anything
+//     about the batch that they were uploaded in.
+//
+//   - EncodeRawReports and EncodeRawBatch dump out the Go representation of
+//     reports and batches, using Go's field names.  They're meant for
+//     comparing against golden files in tests, and change whenever these types
+//     do.
+//
+//   - MarshalBatch and UnmarshalBatch use the wire format defined in this
+//     file, which is meant for exchanging batches with other systems.  Its
+//     field names are stable: fields may be added to it, but existing fields
+//     won't be renamed or removed without changing WireFormatVersion.
+
+// WireFormatVersion is the version of the wire format used by MarshalBatch.
+const WireFormatVersion = 1
+
+// WireReport is the wire format of a single report (see MarshalBatch).  Field
+// names match the Reporting and NEL specs, but the body of a NEL report is
+// flattened into the report itself.  For other kinds of reports, Body is their
+// unparsed body.
+type WireReport struct {
+	Age              int                    `json:"age"`
+	ReportType       string                 `json:"report_type"`
+	URL              string                 `json:"url"`
+	UserAgent        string                 `json:"user_agent"`
+	Referrer         string                 `json:"referrer,omitempty"`
+	SamplingFraction float32                `json:"sampling_fraction,omitempty"`
+	ServerIP         string                 `json:"server_ip,omitempty"`
+	Protocol         string                 `json:"protocol,omitempty"`
+	Method           string                 `json:"method,omitempty"`
+	StatusCode       int                    `json:"status_code,omitempty"`
+	ElapsedTime      int                    `json:"elapsed_time,omitempty"`
+	Phase            string                 `json:"phase,omitempty"`
+	Type             string                 `json:"type,omitempty"`
+	Body             json.RawMessage        `json:"body,omitempty"`
+	Annotations      map[string]interface{} `json:"annotations,omitempty"`
+}
+
+// NewWireReport converts a report into its wire format.
+func NewWireReport(report *NelReport) WireReport {
+	return WireReport{
+		Age:              report.Age,
+		ReportType:       report.ReportType,
+		URL:              report.URL,
+		UserAgent:        report.UserAgent,
+		Referrer:         report.Referrer,
+		SamplingFraction: report.SamplingFraction,
+		ServerIP:         report.ServerIP,
+		Protocol:         report.Protocol,
+		Method:           report.Method,
+		StatusCode:       report.StatusCode,
+		ElapsedTime:      report.ElapsedTime,
+		Phase:            report.Phase,
+		Type:             report.Type,
+		Body:             json.RawMessage(report.RawBody),
+		Annotations:      report.Annotations.Annotations,
+	}
+}
+
+// NelReport converts a report from its wire format.
+func (w WireReport) NelReport() NelReport {
+	return NelReport{
+		Age:              w.Age,
+		ReportType:       w.ReportType,
+		URL:              w.URL,
+		UserAgent:        w.UserAgent,
+		Referrer:         w.Referrer,
+		SamplingFraction: w.SamplingFraction,
+		ServerIP:         w.ServerIP,
+		Protocol:         w.Protocol,
+		Method:           w.Method,
+		StatusCode:       w.StatusCode,
+		ElapsedTime:      w.ElapsedTime,
+		Phase:            w.Phase,
+		Type:             w.Type,
+		RawBody:          []byte(w.Body),
+		Annotations:      Annotations{Annotations: w.Annotations},
+	}
+}
+
+// WireTLSInfo is the wire format of a TLSInfo.
+type WireTLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+}
+
+// WireBatch is the wire format of a batch of reports (see MarshalBatch).  The
+// batch's Header isn't included, since it can contain credentials.
+type WireBatch struct {
+	FormatVersion   int                    `json:"format_version"`
+	ReceivedAt      time.Time              `json:"received_at"`
+	CollectorURL    string                 `json:"collector_url,omitempty"`
+	ClientIP        string                 `json:"client_ip,omitempty"`
+	ClientUserAgent string                 `json:"client_user_agent,omitempty"`
+	ClientReferrer  string                 `json:"client_referrer,omitempty"`
+	Host            string                 `json:"host,omitempty"`
+	TLS             *WireTLSInfo           `json:"tls,omitempty"`
+	Annotations     map[string]interface{} `json:"annotations,omitempty"`
+	Reports         []WireReport           `json:"reports"`
+}
+
+// NewWireBatch converts a batch into its wire format.
+func NewWireBatch(batch *ReportBatch) WireBatch {
+	w := WireBatch{
+		FormatVersion:   WireFormatVersion,
+		ReceivedAt:      batch.Time.UTC(),
+		CollectorURL:    batch.CollectorURL.String(),
+		ClientIP:        batch.ClientIP,
+		ClientUserAgent: batch.ClientUserAgent,
+		ClientReferrer:  batch.ClientReferrer,
+		Host:            batch.Host,
+		Annotations:     batch.Annotations.Annotations,
+		Reports:         make([]WireReport, len(batch.Reports)),
+	}
+	if batch.TLS != nil {
+		w.TLS = &WireTLSInfo{Version: batch.TLS.Version, CipherSuite: batch.TLS.CipherSuite}
+	}
+	for i := range batch.Reports {
+		w.Reports[i] = NewWireReport(&batch.Reports[i])
+	}
+	return w
+}
+
+// ReportBatch converts a batch from its wire format.
+func (w WireBatch) ReportBatch() (*ReportBatch, error) {
+	batch := &ReportBatch{
+		Time:            w.ReceivedAt,
+		ClientIP:        w.ClientIP,
+		ClientUserAgent: w.ClientUserAgent,
+		ClientReferrer:  w.ClientReferrer,
+		Host:            w.Host,
+		Annotations:     Annotations{Annotations: w.Annotations},
+	}
+	collectorURL, err := url.Parse(w.CollectorURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collector_url: %v", err)
+	}
+	batch.CollectorURL = *collectorURL
+	if w.TLS != nil {
+		batch.TLS = &TLSInfo{Version: w.TLS.Version, CipherSuite: w.TLS.CipherSuite}
+	}
+	if w.Reports != nil {
+		batch.Reports = make([]NelReport, len(w.Reports))
+		for i, report := range w.Reports {
+			batch.Reports[i] = report.NelReport()
+		}
+	}
+	return batch, nil
+}
+
+// MarshalBatch encodes a batch of reports, including its annotations and the
+// annotations of each report, in the wire format (see WireBatch).
+func MarshalBatch(batch *ReportBatch) ([]byte, error) {
+	return json.Marshal(NewWireBatch(batch))
+}
+
+// UnmarshalBatch decodes a batch of reports that was encoded by MarshalBatch.
+// Annotation values are decoded as their JSON equivalents (numbers become
+// float64s, objects become map[string]interface{}s, and so on), so they won't
+// necessarily have the same Go types as when they were encoded.  It's an
+// error if the batch was encoded with a newer version of the wire format.
+func UnmarshalBatch(data []byte) (*ReportBatch, error) {
+	var w WireBatch
+	if err := json.Unmarshal(data, &w); err != nil {
+		return nil, err
+	}
+	if w.FormatVersion > WireFormatVersion {
+		return nil, fmt.Errorf("unsupported wire format version %d", w.FormatVersion)
+	}
+	return w.ReportBatch()
+}
@@ -0,0 +1,325 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// AbuseFilter is a pipeline processor that scores each report on how likely
+// it is to be garbage, using several heuristics at once, and drops the ones
+// whose score reaches Threshold.  Each heuristic that a report trips adds its
+// weight to the report's score:
+//
+//   - MalformedURLWeight, if the report's URL can't be parsed, or isn't an
+//     HTTP(S) or WebSocket URL.
+//   - ImpossibleStatusWeight, if a `network-error` report has a status code
+//     that isn't between 100 and 599.  (0 means there was no response, which
+//     is fine.)
+//   - PrivateServerIPWeight, if the report's server_ip is in one of
+//     PrivateServerIPRanges, as for FilterServerIP.
+//   - FloodWeight, if the client that uploaded the report has sent more than
+//     FloodLimit reports in the current FloodWindow.  (Windows are fixed, and
+//     aligned to the epoch of Clock.)  We track at most MaxClients clients at a
+//     time, forgetting about the ones that we've heard from least recently.
+//   - DisallowedDomainWeight, if Domains is set and the report's URL isn't on
+//     one of its registrable domains, as for RestrictToDomains.
+//
+// A weight of 0 turns a heuristic off.  Reports that we keep get an
+// annotation (AbuseScore, by default) with their score, as a float64, so that
+// you can see how close they came, and tune the weights and threshold without
+// throwing anything away by setting a threshold that can't be reached.
+// AbuseFilter counts the reports that it drops; see Dropped.
+type AbuseFilter struct {
+	MalformedURLWeight     float64
+	ImpossibleStatusWeight float64
+	PrivateServerIPWeight  float64
+	FloodWeight            float64
+	DisallowedDomainWeight float64
+
+	PrivateServerIPRanges []*net.IPNet
+	FloodLimit            int
+	FloodWindow           time.Duration
+	MaxClients            int
+	Domains               *RestrictToDomains
+
+	Threshold  float64
+	Annotation string
+
+	// Clock is used to decide which flood window each batch is in.  If nil,
+	// we use the current time.
+	Clock collector.Clock
+
+	dropped int64
+	mu      sync.Mutex
+	clients *ttlCache
+}
+
+// NewAbuseFilter creates a new AbuseFilter that drops reports whose score
+// reaches threshold.  The malformed URL, impossible status, and private server
+// IP heuristics have a weight of 1 (with DefaultPrivateServerIPRanges); the
+// flood and disallowed domain heuristics are off until you set their weights
+// along with FloodLimit or Domains.
+func NewAbuseFilter(threshold float64) (*AbuseFilter, error) {
+	ranges, err := ParseCIDRs(DefaultPrivateServerIPRanges)
+	if err != nil {
+		return nil, err
+	}
+	return &AbuseFilter{
+		MalformedURLWeight:     1,
+		ImpossibleStatusWeight: 1,
+		PrivateServerIPWeight:  1,
+		PrivateServerIPRanges:  ranges,
+		FloodWindow:            time.Minute,
+		MaxClients:             10000,
+		Threshold:              threshold,
+		Annotation:             "AbuseScore",
+	}, nil
+}
+
+// Dropped returns the number of reports that the processor has thrown away.
+func (f *AbuseFilter) Dropped() int64 {
+	return atomic.LoadInt64(&f.dropped)
+}
+
+func (f *AbuseFilter) now() time.Time {
+	if f.Clock == nil {
+		return time.Now()
+	}
+	return f.Clock.Now()
+}
+
+// flooding counts a report from a client, and returns whether the client has
+// now sent more than FloodLimit reports in the current window.  f.mu must be
+// held.
+func (f *AbuseFilter) flooding(client string, index int64, now time.Time) bool {
+	if f.clients == nil {
+		f.clients = newTTLCache(f.MaxClients, 0)
+	}
+	var window *quotaWindow
+	if value, ok := f.clients.get(client, now); ok {
+		window = value.(*quotaWindow)
+		if window.index != index {
+			window.index = index
+			window.count = 0
+		}
+	} else {
+		window = &quotaWindow{index: index}
+		f.clients.add(client, window, now)
+	}
+	window.count++
+	return window.count > f.FloodLimit
+}
+
+// score returns the sum of the weights of the heuristics that a report trips,
+// apart from the flood heuristic.
+func (f *AbuseFilter) score(report *collector.NelReport) float64 {
+	var score float64
+	if f.MalformedURLWeight != 0 {
+		if _, ok := parseOrigin(report.URL); !ok {
+			score += f.MalformedURLWeight
+		}
+	}
+	if f.ImpossibleStatusWeight != 0 && report.ReportType == "network-error" && report.StatusCode != 0 {
+		if report.StatusCode < 100 || report.StatusCode > 599 {
+			score += f.ImpossibleStatusWeight
+		}
+	}
+	if f.PrivateServerIPWeight != 0 {
+		if (FilterServerIP{Ranges: f.PrivateServerIPRanges}).matches(report) {
+			score += f.PrivateServerIPWeight
+		}
+	}
+	if f.DisallowedDomainWeight != 0 && f.Domains != nil {
+		if !f.Domains.allowed(report) {
+			score += f.DisallowedDomainWeight
+		}
+	}
+	return score
+}
+
+// ProcessReports scores each report in the batch, and throws away the ones
+// whose score reaches the threshold.
+func (f *AbuseFilter) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	flood := f.FloodWeight != 0 && f.FloodLimit > 0
+	var index int64
+	var now time.Time
+	if flood {
+		now = f.now()
+		width := f.FloodWindow
+		if width <= 0 {
+			width = 1
+		}
+		index = now.UnixNano() / int64(width)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	var filtered []collector.NelReport
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		score := f.score(report)
+		if flood && f.flooding(clientIP(batch, report), index, now) {
+			score += f.FloodWeight
+		}
+		if score >= f.Threshold {
+			continue
+		}
+		report.SetAnnotation(f.Annotation, score)
+		filtered = append(filtered, *report)
+	}
+	atomic.AddInt64(&f.dropped, int64(len(batch.Reports)-len(filtered)))
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"AbuseFilter",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			type heuristic struct {
+				Enabled *bool    `toml:"enabled"`
+				Weight  *float64 `toml:"weight"`
+			}
+			var config struct {
+				Threshold  *float64 `toml:"threshold"`
+				Annotation string   `toml:"annotation"`
+
+				MalformedURL     heuristic `toml:"malformed_url"`
+				ImpossibleStatus heuristic `toml:"impossible_status"`
+				PrivateServerIP  struct {
+					Enabled *bool    `toml:"enabled"`
+					Weight  *float64 `toml:"weight"`
+					Ranges  []string `toml:"ranges"`
+				} `toml:"private_server_ip"`
+				Flood struct {
+					Enabled    *bool    `toml:"enabled"`
+					Weight     *float64 `toml:"weight"`
+					Limit      int      `toml:"limit"`
+					Window     string   `toml:"window"`
+					MaxClients *int     `toml:"max_clients"`
+				} `toml:"flood"`
+				DisallowedDomain struct {
+					Enabled *bool    `toml:"enabled"`
+					Weight  *float64 `toml:"weight"`
+					Domains []string `toml:"domains"`
+				} `toml:"disallowed_domain"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			threshold := 1.0
+			if config.Threshold != nil {
+				threshold = *config.Threshold
+				if threshold <= 0 {
+					return nil, fmt.Errorf("AbuseFilter `threshold` must be positive")
+				}
+			}
+			f, err := NewAbuseFilter(threshold)
+			if err != nil {
+				return nil, err
+			}
+			if config.Annotation != "" {
+				f.Annotation = config.Annotation
+			}
+
+			// weight returns the weight for a heuristic, which is 0 if it's
+			// disabled, or 1 if it's enabled without an explicit weight.
+			// Heuristics that need more settings are only enabled by default if
+			// they have them.
+			weight := func(name string, h heuristic, configured bool) (float64, error) {
+				enabled := configured
+				if h.Enabled != nil {
+					enabled = *h.Enabled
+				}
+				if !enabled {
+					return 0, nil
+				}
+				if h.Weight == nil {
+					return 1, nil
+				}
+				if *h.Weight < 0 {
+					return 0, fmt.Errorf("AbuseFilter `%s.weight` must not be negative", name)
+				}
+				return *h.Weight, nil
+			}
+			if f.MalformedURLWeight, err = weight("malformed_url", config.MalformedURL, true); err != nil {
+				return nil, err
+			}
+			if f.ImpossibleStatusWeight, err = weight("impossible_status", config.ImpossibleStatus, true); err != nil {
+				return nil, err
+			}
+			if f.PrivateServerIPWeight, err = weight("private_server_ip", heuristic{config.PrivateServerIP.Enabled, config.PrivateServerIP.Weight}, true); err != nil {
+				return nil, err
+			}
+			if config.PrivateServerIP.Ranges != nil {
+				f.PrivateServerIPRanges, err = ParseCIDRs(config.PrivateServerIP.Ranges)
+				if err != nil {
+					return nil, fmt.Errorf("AbuseFilter invalid `private_server_ip.ranges`: %v", err)
+				}
+			}
+
+			flood := config.Flood
+			if f.FloodWeight, err = weight("flood", heuristic{flood.Enabled, flood.Weight}, flood.Limit != 0); err != nil {
+				return nil, err
+			}
+			if f.FloodWeight != 0 {
+				if flood.Limit < 1 {
+					return nil, fmt.Errorf("AbuseFilter `flood.limit` must be positive")
+				}
+				f.FloodLimit = flood.Limit
+				if flood.Window != "" {
+					f.FloodWindow, err = time.ParseDuration(flood.Window)
+					if err != nil {
+						return nil, fmt.Errorf("AbuseFilter invalid `flood.window`: %v", err)
+					}
+					if f.FloodWindow <= 0 {
+						return nil, fmt.Errorf("AbuseFilter `flood.window` must be positive")
+					}
+				}
+				if flood.MaxClients != nil {
+					if *flood.MaxClients < 1 {
+						return nil, fmt.Errorf("AbuseFilter `flood.max_clients` must be positive")
+					}
+					f.MaxClients = *flood.MaxClients
+				}
+			}
+
+			domains := config.DisallowedDomain
+			if f.DisallowedDomainWeight, err = weight("disallowed_domain", heuristic{domains.Enabled, domains.Weight}, len(domains.Domains) != 0); err != nil {
+				return nil, err
+			}
+			if f.DisallowedDomainWeight != 0 {
+				if len(domains.Domains) == 0 {
+					return nil, fmt.Errorf("AbuseFilter missing `disallowed_domain.domains`")
+				}
+				f.Domains, err = NewRestrictToDomains(domains.Domains)
+				if err != nil {
+					return nil, fmt.Errorf("AbuseFilter invalid `disallowed_domain.domains`: %v", err)
+				}
+			}
+			f.Clock = clock
+			return f, nil
+		})
+}
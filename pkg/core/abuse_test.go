@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// abuseScores returns the URL and AbuseScore of each report in the batch.
+func abuseScores(batch *collector.ReportBatch) []string {
+	var result []string
+	for _, report := range batch.Reports {
+		result = append(result, fmt.Sprintf("%s %v", report.URL, report.GetAnnotation("AbuseScore")))
+	}
+	return result
+}
+
+func TestAbuseFilter(t *testing.T) {
+	f, err := core.NewAbuseFilter(1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Domains, err = core.NewRestrictToDomains([]string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.DisallowedDomainWeight = 0.5
+	batch := &collector.ReportBatch{ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+		{ReportType: "network-error", URL: "https://example.com/", StatusCode: 200},
+		{ReportType: "network-error", URL: "https://other.com/", StatusCode: 200},
+		{ReportType: "network-error", URL: "https://example.com/", StatusCode: 999},
+		{ReportType: "network-error", URL: "https://other.com/", StatusCode: 999},
+		{ReportType: "network-error", URL: "javascript:alert(1)", ServerIP: "10.0.0.1"},
+		{ReportType: "csp-violation", URL: "https://example.com/", StatusCode: 999},
+	}}
+	f.ProcessReports(context.Background(), batch)
+	want := []string{
+		"https://example.com/ 0",
+		"https://other.com/ 0.5",
+		"https://example.com/ 1",
+		"https://example.com/ 0",
+	}
+	if diff := cmp.Diff(want, abuseScores(batch)); diff != "" {
+		t.Errorf("AbuseFilter got diff (-want +got):\n%s", diff)
+	}
+	if got, want := f.Dropped(), int64(2); got != want {
+		t.Errorf("AbuseFilter.Dropped() = %d, wanted %d", got, want)
+	}
+}
+
+func TestAbuseFilterFlood(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	f, err := core.NewAbuseFilter(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Clock = clock
+	f.FloodWeight = 1
+	f.FloodLimit = 3
+
+	process := func(clientIP string, count int) int {
+		batch := &collector.ReportBatch{ClientIP: clientIP}
+		for i := 0; i < count; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", URL: "https://example.com/"})
+		}
+		f.ProcessReports(context.Background(), batch)
+		return len(batch.Reports)
+	}
+	if got := process("192.0.2.1", 2); got != 2 {
+		t.Errorf("AbuseFilter kept %d of the first 2 reports, wanted 2", got)
+	}
+	if got := process("192.0.2.1", 2); got != 1 {
+		t.Errorf("AbuseFilter kept %d of the next 2 reports, wanted 1", got)
+	}
+	if got := process("192.0.2.2", 2); got != 2 {
+		t.Errorf("AbuseFilter kept %d reports from another client, wanted 2", got)
+	}
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	if got := process("192.0.2.1", 3); got != 3 {
+		t.Errorf("AbuseFilter kept %d reports in the next window, wanted 3", got)
+	}
+}
+
+func TestAbuseFilterConfig(t *testing.T) {
+	config := `
+[[processor]]
+type = "AbuseFilter"
+threshold = 2.0
+annotation = "Garbage"
+[processor.malformed_url]
+weight = 2.0
+[processor.private_server_ip]
+enabled = false
+[processor.disallowed_domain]
+domains = ["example.com"]
+`
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{
+		{ReportType: "network-error", URL: "https://example.com/", ServerIP: "10.0.0.1"},
+		{ReportType: "network-error", URL: "https://other.com/", StatusCode: 999},
+		{ReportType: "network-error", URL: "not a url"},
+	}}
+	pipeline.ProcessBatch(context.Background(), batch)
+	var got []string
+	for _, report := range batch.Reports {
+		got = append(got, fmt.Sprintf("%s %v", report.URL, report.GetAnnotation("Garbage")))
+	}
+	want := []string{"https://example.com/ 0"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("AbuseFilter got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAbuseFilterBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`threshold = 0.0`,
+		"[processor.malformed_url]\nweight = -1.0",
+		"[processor.private_server_ip]\nranges = [\"bogus\"]",
+		"[processor.flood]\nenabled = true",
+		"[processor.flood]\nlimit = -1",
+		"[processor.flood]\nlimit = 10\nwindow = \"soon\"",
+		"[processor.flood]\nlimit = 10\nwindow = \"0s\"",
+		"[processor.flood]\nlimit = 10\nmax_clients = 0",
+		"[processor.disallowed_domain]\nenabled = true",
+		"[processor.disallowed_domain]\ndomains = [\"www.example.com\"]",
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"AbuseFilter\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1024
+
+	// Once the forward-decay scale factor grows past this, we renormalize all of
+	// the counters to keep them from overflowing.
+	maxDecayScale = 1e6
+
+	// The decay interval that AdaptiveSample uses if you don't choose one.
+	defaultAdaptiveSampleDecay = time.Minute
+)
+
+// decayingSketch is a count-min sketch whose counts decay exponentially over
+// time.  We use "forward decay": rather than scaling down every counter as
+// time passes, we scale up each new increment, and divide by the current scale
+// whenever we read a value.  That keeps updates O(depth).
+type decayingSketch struct {
+	cells    [sketchDepth][sketchWidth]float64
+	total    float64
+	sumSq    float64
+	landmark time.Time
+	tau      time.Duration
+}
+
+func (s *decayingSketch) scale(now time.Time) float64 {
+	if s.landmark.IsZero() {
+		s.landmark = now
+	}
+	scale := math.Exp(float64(now.Sub(s.landmark)) / float64(s.tau))
+	if scale > maxDecayScale {
+		for i := range s.cells {
+			for j := range s.cells[i] {
+				s.cells[i][j] /= scale
+			}
+		}
+		s.total /= scale
+		s.sumSq /= scale * scale
+		s.landmark = now
+		scale = 1
+	}
+	return scale
+}
+
+func sketchIndexes(key string) [sketchDepth]int {
+	var result [sketchDepth]int
+	for i := range result {
+		h := fnv.New64a()
+		h.Write([]byte{byte(i)})
+		h.Write([]byte(key))
+		result[i] = int(h.Sum64() % sketchWidth)
+	}
+	return result
+}
+
+// add counts one occurrence of key, and returns the decayed estimate of how
+// often we've seen that key (including this occurrence), how many items we've
+// seen in total, and the sum of the squares of all of the per-key counts.
+func (s *decayingSketch) add(key string, now time.Time) (count, total, sumSq float64) {
+	scale := s.scale(now)
+	indexes := sketchIndexes(key)
+
+	count = math.Inf(1)
+	for i, j := range indexes {
+		count = math.Min(count, s.cells[i][j]/scale)
+	}
+	// Incrementing a count from c to c+1 increases the sum of squares by 2c+1.
+	s.sumSq += (2*count + 1) * scale * scale
+	s.total += scale
+	for i, j := range indexes {
+		s.cells[i][j] += scale
+	}
+	return count + 1, s.total / scale, s.sumSq / (scale * scale)
+}
+
+// AdaptiveSample is a pipeline processor that samples reports, trying to keep
+// the total number of reports that it lets through near TargetRate per second,
+// while always keeping reports whose (type, status code) combination is rare.
+//
+// We keep an exponentially decaying count of how often we've seen each
+// combination, in a count-min sketch so that memory use stays bounded no
+// matter how many combinations we see.  We divide the target rate evenly
+// among the combinations that we're currently seeing (weighted by how often we
+// see them); combinations that arrive less often than their share are always
+// kept, and more common ones are sampled down to their share.
+//
+// Each report that we keep gets a SamplingWeight annotation containing the
+// reciprocal of the probability that we kept it, so that downstream
+// aggregations can sum weights instead of counting reports.
+//
+// You should usually create one with NewAdaptiveSample, but an AdaptiveSample
+// with just a TargetRate works too, with a decay interval of one minute.
+type AdaptiveSample struct {
+	// The total number of reports per second that we try to let through.
+	TargetRate float64
+
+	// Clock is used to decay the counts.  If nil, we use the current time.
+	Clock collector.Clock
+
+	mu     sync.Mutex
+	sketch decayingSketch
+	rand   *rand.Rand
+}
+
+// NewAdaptiveSample creates a new AdaptiveSample processor.  decayInterval
+// controls how quickly we forget about reports that we've seen; it's the
+// time constant of the exponential decay.
+func NewAdaptiveSample(targetRate float64, decayInterval time.Duration) *AdaptiveSample {
+	return &AdaptiveSample{
+		TargetRate: targetRate,
+		sketch:     decayingSketch{tau: decayInterval},
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *AdaptiveSample) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+// probability counts a report with the given key, and returns the probability
+// with which we should keep it.
+func (s *AdaptiveSample) probability(key string, now time.Time) float64 {
+	count, total, sumSq := s.sketch.add(key, now)
+	// The decayed counts are (roughly) rates multiplied by the decay interval,
+	// so we scale the target rate the same way.
+	target := s.TargetRate * s.sketch.tau.Seconds()
+	// N²/Σc² is the "effective number" of combinations that we're seeing: if we
+	// see k combinations equally often, it's exactly k.
+	effectiveKeys := total * total / sumSq
+	share := target / effectiveKeys
+	if count <= share {
+		return 1
+	}
+	return share / count
+}
+
+// ProcessReports throws away some of the reports in the batch, annotating the
+// ones that are kept with their sampling weight.
+func (s *AdaptiveSample) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if s.sketch.tau <= 0 {
+		s.sketch.tau = defaultAdaptiveSampleDecay
+	}
+
+	var filtered []collector.NelReport
+	for _, report := range batch.Reports {
+		key := report.ReportType + "\x00" + report.Type + "\x00" + strconv.Itoa(report.StatusCode)
+		p := s.probability(key, now)
+		if p >= 1 || s.rand.Float64() < p {
+			report.SetAnnotation("SamplingWeight", 1/p)
+			filtered = append(filtered, report)
+		}
+	}
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"AdaptiveSample",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				TargetRate    float64 `toml:"target_rate"`
+				DecayInterval string  `toml:"decay_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.TargetRate <= 0 {
+				return nil, fmt.Errorf("AdaptiveSample `target_rate` must be positive")
+			}
+
+			decayInterval := defaultAdaptiveSampleDecay
+			if config.DecayInterval != "" {
+				decayInterval, err = time.ParseDuration(config.DecayInterval)
+				if err != nil {
+					return nil, fmt.Errorf("AdaptiveSample invalid `decay_interval`: %v", err)
+				}
+				if decayInterval <= 0 {
+					return nil, fmt.Errorf("AdaptiveSample `decay_interval` must be positive")
+				}
+			}
+			s := NewAdaptiveSample(config.TargetRate, decayInterval)
+			s.Clock = clock
+			return s, nil
+		})
+}
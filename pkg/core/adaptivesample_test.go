@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestAdaptiveSampleKeepsRareReports(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	sampler := core.NewAdaptiveSample(10, time.Second)
+	sampler.Clock = clock
+
+	// Simulate 20 seconds of 1000 successful reports per second, along with one
+	// timeout per second.
+	var common, rare int
+	var commonWeight float64
+	for i := 0; i < 2000; i++ {
+		clock.CurrentTime = clock.CurrentTime.Add(10 * time.Millisecond)
+		batch := &collector.ReportBatch{}
+		for j := 0; j < 10; j++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", Type: "ok", StatusCode: 200})
+		}
+		if i%100 == 0 {
+			batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", Type: "tcp.timed_out"})
+		}
+		sampler.ProcessReports(context.Background(), batch)
+
+		for _, report := range batch.Reports {
+			weight, ok := report.GetAnnotation("SamplingWeight").(float64)
+			if !ok || weight < 1 {
+				t.Fatalf("AdaptiveSample set SamplingWeight to %v, wanted a float64 >= 1", report.GetAnnotation("SamplingWeight"))
+			}
+			if report.Type == "ok" {
+				common++
+				if i >= 1000 {
+					commonWeight = weight
+				}
+			} else {
+				rare++
+				if weight != 1 {
+					t.Errorf("AdaptiveSample gave rare report a weight of %v, wanted 1", weight)
+				}
+			}
+		}
+	}
+
+	if rare != 20 {
+		t.Errorf("AdaptiveSample kept %d rare reports, wanted all 20", rare)
+	}
+	// We should be keeping about 10 per second, or 200 in total; allow plenty of
+	// slack for the warm-up period and for randomness.
+	if common < 100 || common > 500 {
+		t.Errorf("AdaptiveSample kept %d common reports, wanted about 200", common)
+	}
+	if commonWeight < 50 || commonWeight > 200 {
+		t.Errorf("AdaptiveSample gave common reports a weight of %v, wanted about 100", commonWeight)
+	}
+}
+
+func TestAdaptiveSampleZeroValue(t *testing.T) {
+	sampler := &core.AdaptiveSample{TargetRate: 10}
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "network-error", Type: "tcp.timed_out"}}}
+	sampler.ProcessReports(context.Background(), batch)
+	if len(batch.Reports) != 1 {
+		t.Fatalf("AdaptiveSample kept %d reports, wanted 1", len(batch.Reports))
+	}
+	if got, want := batch.Reports[0].GetAnnotation("SamplingWeight"), 1.0; got != want {
+		t.Errorf("AdaptiveSample set SamplingWeight to %v, wanted %v", got, want)
+	}
+}
+
+func TestAdaptiveSampleBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "AdaptiveSample"}]`,
+		`processor = [{type = "AdaptiveSample", target_rate = 10.0, decay_interval = "soon"}]`,
+		`processor = [{type = "AdaptiveSample", target_rate = 10.0, decay_interval = "-1s"}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// maxAnomalyCatchUp is the most empty buckets that we fold into a host's
+// averages one at a time when it comes back after a quiet spell.  After that
+// many, the averages have decayed to (nearly) nothing anyway.
+const maxAnomalyCatchUp = 1000
+
+// anomalyState holds the exponentially weighted moving average and variance
+// of the number of failures in each bucket for one host, along with the count
+// for the bucket that's still in progress.
+type anomalyState struct {
+	bucket   int64
+	count    float64
+	mean     float64
+	variance float64
+	buckets  int
+}
+
+// advance folds the counts for any buckets before the given one into the
+// averages.
+func (s *anomalyState) advance(bucket int64, alpha float64) {
+	if bucket <= s.bucket {
+		return
+	}
+	elapsed := bucket - s.bucket
+	if elapsed > maxAnomalyCatchUp {
+		elapsed = maxAnomalyCatchUp
+	}
+	for i := int64(0); i < elapsed; i++ {
+		s.fold(s.count, alpha)
+		s.count = 0
+	}
+	s.bucket = bucket
+}
+
+// fold adds one completed bucket's count to the averages.  This is the usual
+// incremental form of the exponentially weighted mean and variance.
+func (s *anomalyState) fold(count, alpha float64) {
+	if s.buckets == 0 {
+		s.mean = count
+	} else {
+		diff := count - s.mean
+		incr := alpha * diff
+		s.mean += incr
+		s.variance = (1 - alpha) * (s.variance + diff*incr)
+	}
+	s.buckets++
+}
+
+// score returns how many standard deviations the current bucket's count is
+// above the average.  So that a host that's always had the same number of
+// failures doesn't get a huge score for one more, the standard deviation is
+// never taken to be less than 1.
+func (s *anomalyState) score(minBuckets int) float64 {
+	if s.buckets < minBuckets {
+		return 0
+	}
+	return (s.count - s.mean) / math.Max(math.Sqrt(s.variance), 1)
+}
+
+// AnomalyScore is a pipeline processor that scores how unusual each host's
+// current number of failures is, so that alerts can fire on a statistical
+// deviation rather than a fixed threshold.
+//
+// We count the `network-error` reports (other than successful ones) for each
+// host in fixed buckets of Interval, aligned to the epoch of Clock.  When a
+// bucket is over, its count is folded into an exponentially weighted moving
+// average and variance of the host's counts, where Alpha is the weight of the
+// newest bucket (so larger values forget the past more quickly).  Buckets in
+// which we don't see any reports for a host count as zero.
+//
+// The score is the z-score of the count for the current bucket so far: the
+// number of standard deviations that it's above the average (or below it, if
+// it's negative).  Each `network-error` report gets its host's score as an
+// AnomalyScore annotation, a float64, and the batch gets the highest of its
+// hosts' scores.  Until we've seen MinBuckets buckets for a host, its score is
+// always 0.
+//
+// We track at most MaxKeys hosts at a time, forgetting about the ones that
+// we've heard from least recently.
+type AnomalyScore struct {
+	Alpha      float64
+	Interval   time.Duration
+	MinBuckets int
+	MaxKeys    int
+
+	// Clock is used to decide which bucket each batch is in.  If nil, we use
+	// the current time.
+	Clock collector.Clock
+
+	key    func(report *collector.NelReport) (string, bool)
+	mu     sync.Mutex
+	states *ttlCache
+}
+
+// NewAnomalyScore creates a new AnomalyScore processor, which scores each
+// value of field separately.  As with OutageDetector, the field can be "host",
+// for the host of each report's URL, or any of the fields that Where's
+// conditions can use.
+func NewAnomalyScore(field string, alpha float64, interval time.Duration) (*AnomalyScore, error) {
+	key, err := reportKey(field)
+	if err != nil {
+		return nil, err
+	}
+	return &AnomalyScore{
+		Alpha:      alpha,
+		Interval:   interval,
+		MinBuckets: 5,
+		MaxKeys:    10000,
+		key:        key,
+	}, nil
+}
+
+func (a *AnomalyScore) now() time.Time {
+	if a.Clock == nil {
+		return time.Now()
+	}
+	return a.Clock.Now()
+}
+
+// state returns the state for a key, creating it if needed.  a.mu must be
+// held.
+func (a *AnomalyScore) state(key string, bucket int64, now time.Time) *anomalyState {
+	if a.states == nil {
+		a.states = newTTLCache(a.MaxKeys, 0)
+	}
+	if state, ok := a.states.get(key, now); ok {
+		return state.(*anomalyState)
+	}
+	state := &anomalyState{bucket: bucket}
+	a.states.add(key, state, now)
+	return state
+}
+
+// ProcessReports counts the failures for each host in the batch, and
+// annotates the batch's reports with the resulting scores.
+func (a *AnomalyScore) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	failures := make(map[string]int)
+	var keys []string
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" {
+			continue
+		}
+		key, ok := a.key(report)
+		if !ok {
+			continue
+		}
+		if _, seen := failures[key]; !seen {
+			keys = append(keys, key)
+			failures[key] = 0
+		}
+		if isFailure(report) {
+			failures[key]++
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	now := a.now()
+	width := a.Interval
+	if width <= 0 {
+		width = 1
+	}
+	bucket := now.UnixNano() / int64(width)
+	scores := make(map[string]float64, len(keys))
+	highest := math.Inf(-1)
+	a.mu.Lock()
+	for _, key := range keys {
+		state := a.state(key, bucket, now)
+		state.advance(bucket, a.Alpha)
+		state.count += float64(failures[key])
+		score := state.score(a.MinBuckets)
+		scores[key] = score
+		highest = math.Max(highest, score)
+	}
+	a.mu.Unlock()
+
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" {
+			continue
+		}
+		if key, ok := a.key(report); ok {
+			report.SetAnnotation("AnomalyScore", scores[key])
+		}
+	}
+	batch.SetAnnotation("AnomalyScore", highest)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"AnomalyScore",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Field      string   `toml:"field"`
+				Alpha      *float64 `toml:"alpha"`
+				Interval   string   `toml:"interval"`
+				MinBuckets *int     `toml:"min_buckets"`
+				MaxKeys    *int     `toml:"max_keys"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Field == "" {
+				config.Field = "host"
+			}
+			alpha := 0.1
+			if config.Alpha != nil {
+				alpha = *config.Alpha
+				if alpha <= 0 || alpha >= 1 {
+					return nil, fmt.Errorf("AnomalyScore `alpha` must be between 0 and 1")
+				}
+			}
+			interval := time.Minute
+			if config.Interval != "" {
+				interval, err = time.ParseDuration(config.Interval)
+				if err != nil {
+					return nil, fmt.Errorf("AnomalyScore invalid `interval`: %v", err)
+				}
+				if interval <= 0 {
+					return nil, fmt.Errorf("AnomalyScore `interval` must be positive")
+				}
+			}
+
+			a, err := NewAnomalyScore(config.Field, alpha, interval)
+			if err != nil {
+				return nil, fmt.Errorf("AnomalyScore invalid `field`: %s", config.Field)
+			}
+			if config.MinBuckets != nil {
+				if *config.MinBuckets < 0 {
+					return nil, fmt.Errorf("AnomalyScore `min_buckets` must not be negative")
+				}
+				a.MinBuckets = *config.MinBuckets
+			}
+			if config.MaxKeys != nil {
+				if *config.MaxKeys < 1 {
+					return nil, fmt.Errorf("AnomalyScore `max_keys` must be positive")
+				}
+				a.MaxKeys = *config.MaxKeys
+			}
+			a.Clock = clock
+			return a, nil
+		})
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestAnomalyScore(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	a, err := core.NewAnomalyScore("host", 0.2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Clock = clock
+
+	// process sends a batch with the given number of failures for a.example,
+	// and a successful report for b.example, in the next bucket.  It returns
+	// a.example's score, and checks that the batch has the highest score.
+	process := func(failures int) float64 {
+		clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{
+			{ReportType: "network-error", URL: "https://b.example/", Type: "ok"},
+			{ReportType: "csp-violation", URL: "https://a.example/"},
+		}}
+		for i := 0; i < failures; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", URL: "https://a.example/", Type: "tcp.reset"})
+		}
+		a.ProcessReports(context.Background(), batch)
+		if batch.Reports[1].GetAnnotation("AnomalyScore") != nil {
+			t.Fatalf("AnomalyScore annotated a csp-violation report")
+		}
+		b := batch.Reports[0].GetAnnotation("AnomalyScore").(float64)
+		if failures == 0 {
+			return b
+		}
+		score := batch.Reports[2].GetAnnotation("AnomalyScore").(float64)
+		highest := score
+		if b > highest {
+			highest = b
+		}
+		if got := batch.GetAnnotation("AnomalyScore"); got != highest {
+			t.Fatalf("AnomalyScore annotated batch with %v, wanted %v", got, highest)
+		}
+		return score
+	}
+
+	// Hosts don't have a score until they have some history.
+	for i := 0; i < 5; i++ {
+		if score := process(10); score != 0 {
+			t.Fatalf("AnomalyScore got %v during warm-up, wanted 0", score)
+		}
+	}
+	// A steady baseline of about 10 failures a minute isn't anomalous.
+	for i := 0; i < 50; i++ {
+		failures := 8
+		if i%2 == 1 {
+			failures = 12
+		}
+		if score := process(failures); score > 3 || score < -3 {
+			t.Fatalf("AnomalyScore got %v for %d failures during the baseline", score, failures)
+		}
+	}
+	// But a sudden spike is.
+	if score := process(40); score < 5 {
+		t.Errorf("AnomalyScore got %v for a spike, wanted at least 5", score)
+	}
+	// A host without any failures scores 0 once it has some history.
+	if score := process(0); score != 0 {
+		t.Errorf("AnomalyScore got %v for a host that never fails, wanted 0", score)
+	}
+}
+
+func TestAnomalyScoreQuietSpell(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	a, err := core.NewAnomalyScore("host", 0.5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Clock = clock
+	a.MinBuckets = 1
+	process := func(failures int) float64 {
+		batch := &collector.ReportBatch{}
+		for i := 0; i < failures; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", URL: "https://a.example/", Type: "tcp.reset"})
+		}
+		a.ProcessReports(context.Background(), batch)
+		return batch.GetAnnotation("AnomalyScore").(float64)
+	}
+	for i := 0; i < 10; i++ {
+		process(100)
+		clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	}
+	// The minutes when we didn't hear from the host count as zeros, so after
+	// a long quiet spell, a few failures are anomalous again.
+	clock.CurrentTime = clock.CurrentTime.Add(24 * time.Hour)
+	if score := process(5); score < 4 {
+		t.Errorf("AnomalyScore got %v after a quiet spell, wanted at least 4", score)
+	}
+}
+
+func TestAnomalyScoreBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`field = "nonexistent"`,
+		`alpha = 0.0`,
+		`alpha = 1.0`,
+		`interval = "soon"`,
+		`interval = "0s"`,
+		`min_buckets = -1`,
+		`max_keys = 0`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"AnomalyScore\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
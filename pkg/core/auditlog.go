@@ -0,0 +1,295 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// auditHashes are the hash algorithms that AuditLog can use.
+var auditHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// auditRecord is one entry of an audit log.
+type auditRecord struct {
+	Seq          uint64 `json:"seq"`
+	Time         string `json:"time"`
+	ClientIPHash string `json:"client_ip_hash,omitempty"`
+	Reports      int    `json:"reports"`
+	ContentHash  string `json:"content_hash"`
+	Previous     string `json:"prev"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// AuditLog is a pipeline processor that keeps a tamper-evident record of every
+// batch that it sees, as proof that it was received, separately from wherever
+// the reports themselves are stored.  It writes one line of JSON for each
+// batch, with:
+//
+//   - `seq`, the entry's position in the log, starting from 1;
+//   - `time`, the time that the batch was received (or, if it doesn't have
+//     one, the current time according to Clock), in UTC;
+//   - `client_ip_hash`, a salted hash of the IP address of the client that
+//     uploaded the batch (left out if it doesn't have one);
+//   - `reports`, the number of reports in the batch;
+//   - `content_hash`, a hash of the JSON encodings of the batch's reports (as
+//     produced by NelReport.MarshalJSON);
+//   - `prev`, the `hash` of the previous entry (empty for the first one); and
+//   - `hash`, a hash of the entry's JSON encoding without its `hash` field.
+//
+// Since each entry includes the hash of the one before, changing, removing,
+// or reordering any entry breaks the chain from that point on, which
+// VerifyAuditLog detects.  All of the hashes use Algorithm (sha256, sha384, or
+// sha512), and are hex-encoded.
+//
+// AuditLog should come first in the pipeline, before anything that filters
+// reports; note that if PipelineConfig.CoalesceReports is set, each batch can
+// hold several uploads.  Empty batches are recorded too.
+type AuditLog struct {
+	Writer    io.Writer
+	Algorithm string
+	Salt      string
+
+	// Clock is used for batches that don't have a receive time.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+
+	newHash  func() hash.Hash
+	mu       sync.Mutex
+	seq      uint64
+	previous string
+	closer   io.Closer
+}
+
+// NewAuditLog creates a new AuditLog processor that starts a new log in
+// writer, hashing with algorithm.  It returns an error if the algorithm isn't
+// supported.
+func NewAuditLog(writer io.Writer, algorithm, salt string) (*AuditLog, error) {
+	newHash, ok := auditHashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %s", algorithm)
+	}
+	return &AuditLog{Writer: writer, Algorithm: algorithm, Salt: salt, newHash: newHash}, nil
+}
+
+// NewAuditLogFile creates a new AuditLog processor that appends to the log in
+// path, creating it if needed.  If the file already has entries, we check the
+// whole chain (see VerifyAuditLog), and carry it on from the last entry; it
+// returns an error if the existing log has been tampered with.
+func NewAuditLogFile(path, algorithm, salt string) (*AuditLog, error) {
+	a, err := NewAuditLog(nil, algorithm, salt)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	last, err := readAuditLog(f, a.newHash)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	a.seq = last.Seq
+	a.previous = last.Hash
+	a.Writer = f
+	a.closer = f
+	return a, nil
+}
+
+// hashHex returns the hex-encoded hash of some data.
+func (a *AuditLog) hashHex(data ...[]byte) string {
+	h := a.newHash()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sealAuditRecord fills in the hash of an entry, and returns its encoding.
+func sealAuditRecord(record *auditRecord, newHash func() hash.Hash) ([]byte, error) {
+	record.Hash = ""
+	unsealed, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	h := newHash()
+	h.Write(unsealed)
+	record.Hash = hex.EncodeToString(h.Sum(nil))
+	return json.Marshal(record)
+}
+
+// readAuditLog checks the chain of entries in an audit log, and returns the
+// last one (which is empty if there aren't any).
+func readAuditLog(r io.Reader, newHash func() hash.Hash) (auditRecord, error) {
+	var last auditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return last, fmt.Errorf("entry %d: %v", line, err)
+		}
+		if record.Seq != last.Seq+1 {
+			return last, fmt.Errorf("entry %d: has sequence number %d, wanted %d", line, record.Seq, last.Seq+1)
+		}
+		if record.Previous != last.Hash {
+			return last, fmt.Errorf("entry %d: doesn't follow entry %d", line, last.Seq)
+		}
+		claimed := record.Hash
+		if _, err := sealAuditRecord(&record, newHash); err != nil {
+			return last, fmt.Errorf("entry %d: %v", line, err)
+		}
+		if record.Hash != claimed {
+			return last, fmt.Errorf("entry %d: hash mismatch", line)
+		}
+		last = record
+	}
+	return last, scanner.Err()
+}
+
+// VerifyAuditLog checks the chain of entries in an audit log written by
+// AuditLog with the given hash algorithm, and returns the number of entries.
+// It returns an error describing the first entry that has been tampered with,
+// if there is one.  (Removing entries from the end of the log can't be
+// detected this way; compare the number of entries with a copy of the last
+// hash kept elsewhere to catch that.)
+func VerifyAuditLog(r io.Reader, algorithm string) (int, error) {
+	newHash, ok := auditHashes[algorithm]
+	if !ok {
+		return 0, fmt.Errorf("unknown hash algorithm %s", algorithm)
+	}
+	last, err := readAuditLog(r, newHash)
+	return int(last.Seq), err
+}
+
+func (a *AuditLog) now() time.Time {
+	if a.Clock == nil {
+		return time.Now()
+	}
+	return a.Clock.Now()
+}
+
+// TryProcessReports appends an entry for the batch to the log, returning an
+// error if it can't be written.
+func (a *AuditLog) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	received := batch.Time
+	if received.IsZero() {
+		received = a.now()
+	}
+	content := a.newHash()
+	for _, report := range batch.Reports {
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			return fmt.Errorf("couldn't encode report: %v", err)
+		}
+		content.Write(encoded)
+		content.Write([]byte{'\n'})
+	}
+	record := auditRecord{
+		Time:        received.UTC().Format(time.RFC3339Nano),
+		Reports:     len(batch.Reports),
+		ContentHash: hex.EncodeToString(content.Sum(nil)),
+	}
+	if batch.ClientIP != "" {
+		record.ClientIPHash = a.hashHex([]byte(a.Salt), []byte(batch.ClientIP))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	record.Seq = a.seq + 1
+	record.Previous = a.previous
+	line, err := sealAuditRecord(&record, a.newHash)
+	if err != nil {
+		return err
+	}
+	if _, err := a.Writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("couldn't write audit log entry %d: %v", record.Seq, err)
+	}
+	a.seq = record.Seq
+	a.previous = record.Hash
+	return nil
+}
+
+// ProcessReports appends an entry for the batch to the log, logging any
+// error.
+func (a *AuditLog) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := a.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("AuditLog: %v", err)
+	}
+}
+
+// Close closes the file that the AuditLog writes to, if it was created by
+// NewAuditLogFile.
+func (a *AuditLog) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"AuditLog",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Path      string `toml:"path"`
+				Algorithm string `toml:"algorithm"`
+				Salt      string `toml:"salt"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Path == "" {
+				return nil, fmt.Errorf("AuditLog missing `path`")
+			}
+			if config.Algorithm == "" {
+				config.Algorithm = "sha256"
+			}
+			if _, ok := auditHashes[config.Algorithm]; !ok {
+				return nil, fmt.Errorf("AuditLog invalid `algorithm`: %s", config.Algorithm)
+			}
+			if config.Salt == "" {
+				return nil, fmt.Errorf("AuditLog missing `salt`")
+			}
+
+			a, err := NewAuditLogFile(config.Path, config.Algorithm, config.Salt)
+			if err != nil {
+				return nil, fmt.Errorf("AuditLog invalid `path`: %v", err)
+			}
+			a.Clock = clock
+			return a, nil
+		})
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a, err := core.NewAuditLog(&buf, "sha256", "pepper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.FixedZone("CET", 3600))
+	a.ProcessReports(context.Background(), &collector.ReportBatch{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+		{ReportType: "network-error", URL: "https://a.example/", Type: "tcp.reset"},
+		{ReportType: "network-error", URL: "https://b.example/", Type: "ok"},
+	}})
+	a.ProcessReports(context.Background(), &collector.ReportBatch{Time: received, ClientIP: "192.0.2.1"})
+	a.ProcessReports(context.Background(), &collector.ReportBatch{Time: received})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("AuditLog wrote %d entries, wanted 3", len(lines))
+	}
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	first := entries[0]
+	if first["seq"] != 1.0 || first["time"] != "2024-01-02T14:30:00Z" || first["reports"] != 2.0 || first["prev"] != "" || len(first["hash"].(string)) != 64 {
+		t.Errorf("AuditLog wrote entry %v", first)
+	}
+	if ipHash, _ := first["client_ip_hash"].(string); len(ipHash) != 64 || strings.Contains(ipHash, "192.0.2.1") {
+		t.Errorf("AuditLog wrote client_ip_hash %q", ipHash)
+	}
+	if entries[1]["client_ip_hash"] != first["client_ip_hash"] || entries[1]["content_hash"] == first["content_hash"] {
+		t.Errorf("AuditLog wrote entries %v and %v", first, entries[1])
+	}
+	if _, ok := entries[2]["client_ip_hash"]; ok {
+		t.Errorf("AuditLog wrote a client_ip_hash for a batch without a client IP")
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i]["prev"] != entries[i-1]["hash"] {
+			t.Errorf("AuditLog entry %d doesn't follow entry %d", i+1, i)
+		}
+	}
+
+	if n, err := core.VerifyAuditLog(strings.NewReader(buf.String()), "sha256"); err != nil || n != 3 {
+		t.Errorf("VerifyAuditLog = %d, %v, wanted 3 entries", n, err)
+	}
+	tampered := []string{
+		strings.Replace(buf.String(), `"reports":2`, `"reports":1`, 1),
+		strings.Join([]string{lines[0], lines[2]}, "\n"),
+		strings.Join([]string{lines[1], lines[0], lines[2]}, "\n"),
+	}
+	for _, log := range tampered {
+		if _, err := core.VerifyAuditLog(strings.NewReader(log), "sha256"); err == nil {
+			t.Errorf("VerifyAuditLog(%s) should return error", log)
+		}
+	}
+	if _, err := core.VerifyAuditLog(strings.NewReader(buf.String()), "sha512"); err == nil {
+		t.Errorf("VerifyAuditLog with the wrong algorithm should return error")
+	}
+}
+
+func TestAuditLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	config := fmt.Sprintf(`
+		[[processor]]
+		type = "AuditLog"
+		path = %q
+		algorithm = "sha512"
+		salt = "pepper"
+	`, path)
+
+	// A new pipeline carries on the chain from where the last one left off.
+	for i := 0; i < 2; i++ {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+			t.Fatal(err)
+		}
+		pipeline.ProcessBatch(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{{URL: "https://a.example/"}}})
+		pipeline.Close()
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := core.VerifyAuditLog(bytes.NewReader(data), "sha512"); err != nil || n != 2 {
+		t.Errorf("VerifyAuditLog = %d, %v, wanted 2 entries", n, err)
+	}
+
+	// But not if the log has been tampered with.
+	ioutil.WriteFile(path, bytes.Replace(data, []byte(`"reports":1`), []byte(`"reports":0`), 1), 0644)
+	var pipeline collector.Pipeline
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+		t.Errorf("LoadFromConfig with a tampered log should return error")
+	}
+}
+
+func TestAuditLogBadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for _, config := range []string{
+		`salt = "pepper"`,
+		fmt.Sprintf("path = %q", path),
+		fmt.Sprintf("path = %q\nsalt = \"pepper\"\nalgorithm = \"md5\"", path),
+		fmt.Sprintf("path = %q\nsalt = \"pepper\"", filepath.Join(dir, "nonexistent", "audit.log")),
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"AuditLog\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// AvailabilityScore is a pipeline processor that keeps a rolling availability
+// percentage for each host: the percentage of the recent `network-error`
+// reports about it that weren't errors.  Each of those reports gets the
+// score for its host (including the report itself), as a float64 between 0
+// and 100, in an annotation (Availability by default), and Scores returns the
+// current score for every host, so that it can be exported as a metric.
+// Recent means within the last Window, which we measure in tenths of Window,
+// as with AttachErrorRate.
+//
+// By default, every report whose type isn't "ok" counts as an error.  If
+// ErrorTypes is set, only reports with one of those types do instead; a type
+// like "dns" also matches every type that starts with "dns.".  Reports whose
+// status code is in one of ErrorStatusClasses (such as "5xx") count as errors
+// too, whatever their type.
+//
+// We track at most MaxKeys hosts at a time, forgetting about the ones that
+// we've heard from least recently.
+type AvailabilityScore struct {
+	Annotation string
+	Window     time.Duration
+	MaxKeys    int
+
+	ErrorTypes         []string
+	ErrorStatusClasses []string
+
+	// Clock is used to decide which reports are recent.  If nil, we use the
+	// current time.
+	Clock collector.Clock
+
+	key     func(report *collector.NelReport) (string, bool)
+	mu      sync.Mutex
+	windows *ttlCache
+}
+
+// NewAvailabilityScore creates a new AvailabilityScore processor, which keeps
+// a separate score for each value of field, over the given window.  The field
+// can be "host", for the host of each report's URL, or any of the fields that
+// Where's conditions can use.
+func NewAvailabilityScore(field string, window time.Duration) (*AvailabilityScore, error) {
+	key, err := reportKey(field)
+	if err != nil {
+		return nil, err
+	}
+	return &AvailabilityScore{
+		Annotation: "Availability",
+		Window:     window,
+		MaxKeys:    10000,
+		key:        key,
+	}, nil
+}
+
+func (a *AvailabilityScore) now() time.Time {
+	if a.Clock == nil {
+		return time.Now()
+	}
+	return a.Clock.Now()
+}
+
+// bucket returns the number of the window bucket that now falls in.
+func (a *AvailabilityScore) bucket(now time.Time) int64 {
+	bucketWidth := a.Window / errorRateBuckets
+	if bucketWidth <= 0 {
+		bucketWidth = 1
+	}
+	return now.UnixNano() / int64(bucketWidth)
+}
+
+// isError returns whether a report counts against its host's availability.
+func (a *AvailabilityScore) isError(report *collector.NelReport) bool {
+	if report.StatusCode != 0 {
+		class := fmt.Sprintf("%dxx", report.StatusCode/100)
+		for _, errorClass := range a.ErrorStatusClasses {
+			if class == errorClass {
+				return true
+			}
+		}
+	}
+	if a.ErrorTypes == nil {
+		return report.Type != "ok"
+	}
+	for _, errorType := range a.ErrorTypes {
+		if report.Type == errorType || strings.HasPrefix(report.Type, errorType+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// window returns the window for a key, creating it if needed.  a.mu must be
+// held.
+func (a *AvailabilityScore) window(key string, now time.Time) *errorRateWindow {
+	if a.windows == nil {
+		a.windows = newTTLCache(a.MaxKeys, 0)
+	}
+	if window, ok := a.windows.get(key, now); ok {
+		return window.(*errorRateWindow)
+	}
+	window := &errorRateWindow{}
+	a.windows.add(key, window, now)
+	return window
+}
+
+// ProcessReports updates the counts for each host in the batch, and annotates
+// the batch's reports with the resulting scores.
+func (a *AvailabilityScore) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	keys := make([]string, len(batch.Reports))
+	counted := make([]bool, len(batch.Reports))
+	reports := make(map[string]int)
+	errors := make(map[string]int)
+	var distinct []string
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" {
+			continue
+		}
+		key, ok := a.key(report)
+		if !ok {
+			continue
+		}
+		keys[i] = key
+		counted[i] = true
+		if reports[key] == 0 {
+			distinct = append(distinct, key)
+		}
+		reports[key]++
+		if a.isError(report) {
+			errors[key]++
+		}
+	}
+	if len(distinct) == 0 {
+		return
+	}
+
+	now := a.now()
+	bucket := a.bucket(now)
+	scores := make(map[string]float64, len(distinct))
+	a.mu.Lock()
+	for _, key := range distinct {
+		scores[key] = 100 * (1 - a.window(key, now).add(bucket, reports[key], errors[key]))
+	}
+	a.mu.Unlock()
+
+	for i := range batch.Reports {
+		if counted[i] {
+			batch.Reports[i].SetAnnotation(a.Annotation, scores[keys[i]])
+		}
+	}
+}
+
+// Scores returns the current availability score for each host that has had
+// any reports within the window.
+func (a *AvailabilityScore) Scores() map[string]float64 {
+	bucket := a.bucket(a.now())
+	scores := make(map[string]float64)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.windows == nil {
+		return scores
+	}
+	a.windows.each(func(key string, value interface{}) {
+		window := value.(*errorRateWindow)
+		for i := range window.index {
+			if window.index[i] > bucket-errorRateBuckets && window.index[i] <= bucket && window.reports[i] > 0 {
+				scores[key] = 100 * (1 - window.rate(bucket))
+				return
+			}
+		}
+	})
+	return scores
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"AvailabilityScore",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Field              string   `toml:"field"`
+				Annotation         string   `toml:"annotation"`
+				Window             string   `toml:"window"`
+				MaxKeys            *int     `toml:"max_keys"`
+				ErrorTypes         []string `toml:"error_types"`
+				ErrorStatusClasses []string `toml:"error_status_classes"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Field == "" {
+				config.Field = "host"
+			}
+			window := 5 * time.Minute
+			if config.Window != "" {
+				window, err = time.ParseDuration(config.Window)
+				if err != nil {
+					return nil, fmt.Errorf("AvailabilityScore invalid `window`: %v", err)
+				}
+				if window <= 0 {
+					return nil, fmt.Errorf("AvailabilityScore `window` must be positive")
+				}
+			}
+			for _, class := range config.ErrorStatusClasses {
+				if len(class) != 3 || class[0] < '1' || class[0] > '5' || class[1:] != "xx" {
+					return nil, fmt.Errorf("AvailabilityScore invalid `error_status_classes`: %s", class)
+				}
+			}
+
+			a, err := NewAvailabilityScore(config.Field, window)
+			if err != nil {
+				return nil, fmt.Errorf("AvailabilityScore invalid `field`: %s", config.Field)
+			}
+			if config.MaxKeys != nil {
+				if *config.MaxKeys < 1 {
+					return nil, fmt.Errorf("AvailabilityScore `max_keys` must be positive")
+				}
+				a.MaxKeys = *config.MaxKeys
+			}
+			if config.Annotation != "" {
+				a.Annotation = config.Annotation
+			}
+			a.ErrorTypes = config.ErrorTypes
+			a.ErrorStatusClasses = config.ErrorStatusClasses
+			a.Clock = clock
+			return a, nil
+		})
+}
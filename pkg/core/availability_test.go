@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestAvailabilityScore(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	a, err := core.NewAvailabilityScore("host", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Clock = clock
+	start := clock.CurrentTime
+
+	report := func(url, typ string, status int) collector.NelReport {
+		return collector.NelReport{ReportType: "network-error", URL: url, Type: typ, StatusCode: status}
+	}
+	cases := []struct {
+		offset  time.Duration
+		reports []collector.NelReport
+		want    []interface{}
+		scores  map[string]float64
+	}{
+		{
+			0,
+			[]collector.NelReport{
+				report("https://a.example/", "ok", 200),
+				report("https://a.example/x", "tcp.reset", 0),
+				report("https://b.example/", "ok", 200),
+				{ReportType: "csp-violation", URL: "https://a.example/"},
+			},
+			[]interface{}{50.0, 50.0, 100.0, nil},
+			map[string]float64{"a.example": 50, "b.example": 100},
+		},
+		{
+			30 * time.Second,
+			[]collector.NelReport{report("https://a.example/", "ok", 200), report("https://a.example/", "ok", 200)},
+			[]interface{}{75.0, 75.0},
+			map[string]float64{"a.example": 75, "b.example": 100},
+		},
+		// The first batch has left the window.
+		{
+			61 * time.Second,
+			[]collector.NelReport{report("https://a.example/", "http.error", 503)},
+			[]interface{}{100.0 * 2 / 3},
+			map[string]float64{"a.example": 100.0 * 2 / 3},
+		},
+	}
+	for _, c := range cases {
+		clock.CurrentTime = start.Add(c.offset)
+		batch := &collector.ReportBatch{Reports: c.reports}
+		a.ProcessReports(context.Background(), batch)
+		var got []interface{}
+		for _, report := range batch.Reports {
+			got = append(got, report.GetAnnotation("Availability"))
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("At %v, Availability diff (-want +got):\n%s", c.offset, diff)
+		}
+		if diff := cmp.Diff(c.scores, a.Scores()); diff != "" {
+			t.Errorf("At %v, Scores() diff (-want +got):\n%s", c.offset, diff)
+		}
+	}
+}
+
+func TestAvailabilityScoreErrors(t *testing.T) {
+	a, err := core.NewAvailabilityScore("url", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.ErrorTypes = []string{"dns", "tcp.timed_out"}
+	a.ErrorStatusClasses = []string{"5xx"}
+	a.Clock = pipelinetest.NewSimulatedClock()
+
+	for _, c := range []struct {
+		report collector.NelReport
+		want   float64
+	}{
+		{collector.NelReport{Type: "dns.name_not_resolved"}, 0},
+		{collector.NelReport{Type: "tcp.timed_out"}, 0},
+		{collector.NelReport{Type: "tcp.reset"}, 100},
+		{collector.NelReport{Type: "ok", StatusCode: 503}, 0},
+		{collector.NelReport{Type: "http.error", StatusCode: 404}, 100},
+	} {
+		c.report.ReportType = "network-error"
+		c.report.URL = "https://example.com/" + c.report.Type
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{c.report}}
+		a.ProcessReports(context.Background(), batch)
+		if got := batch.Reports[0].GetAnnotation("Availability"); got != c.want {
+			t.Errorf("Availability of %s report with status %d = %v, wanted %v", c.report.Type, c.report.StatusCode, got, c.want)
+		}
+	}
+}
+
+func TestAvailabilityScoreBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "AvailabilityScore", field = "nope"}]`,
+		`processor = [{type = "AvailabilityScore", window = "0s"}]`,
+		`processor = [{type = "AvailabilityScore", window = "soon"}]`,
+		`processor = [{type = "AvailabilityScore", max_keys = 0}]`,
+		`processor = [{type = "AvailabilityScore", error_status_classes = ["500"]}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// The strategies that Balance can use to choose a child for each batch.
+const (
+	BalanceRoundRobin    = "round_robin"
+	BalanceLeastInFlight = "least_in_flight"
+)
+
+// Balance is a pipeline processor that spreads batches across several
+// interchangeable children, such as multiple instances of a publisher, so that
+// no single instance becomes a bottleneck.  Unlike Tee, which sends every batch
+// to all of its branches, Balance sends each batch to exactly one child.  The
+// child receives the batch itself rather than a copy, just as if it came next
+// in the pipeline.
+//
+// With the BalanceRoundRobin strategy, children take turns, with each one
+// receiving a share of the batches proportional to its weight.  (Turns are
+// interleaved, so weights of 2 and 1 give a pattern like A B A rather than
+// A A B.)  With BalanceLeastInFlight, each batch goes to the child that's
+// processing the fewest batches relative to its weight, which adapts to
+// children that slow down; ties go to the child that comes first.  Either way,
+// balancing only helps if the pipeline has several workers, since each worker
+// waits for its batch to be processed.
+type Balance struct {
+	Children []collector.ReportProcessor
+	Weights  []int
+	Strategy string
+
+	mu sync.Mutex
+	// current is the running score of each child for weighted round-robin.
+	current  []int
+	inFlight []int
+}
+
+// NewBalance creates a new Balance processor.  If weights is nil, every child
+// has a weight of 1.  It returns an error if there are no children, if weights
+// doesn't have one positive weight for each child, or if strategy is invalid.
+func NewBalance(children []collector.ReportProcessor, weights []int, strategy string) (*Balance, error) {
+	if len(children) == 0 {
+		return nil, fmt.Errorf("no children")
+	}
+	if weights == nil {
+		weights = make([]int, len(children))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != len(children) {
+		return nil, fmt.Errorf("got %d weights for %d children", len(weights), len(children))
+	}
+	for _, weight := range weights {
+		if weight <= 0 {
+			return nil, fmt.Errorf("weights must be positive")
+		}
+	}
+	switch strategy {
+	case BalanceRoundRobin, BalanceLeastInFlight:
+	default:
+		return nil, fmt.Errorf("invalid strategy %s", strategy)
+	}
+	return &Balance{
+		Children: children,
+		Weights:  weights,
+		Strategy: strategy,
+		current:  make([]int, len(children)),
+		inFlight: make([]int, len(children)),
+	}, nil
+}
+
+// choose picks the child for the next batch and counts it as in flight.
+func (b *Balance) choose() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	chosen := 0
+	if b.Strategy == BalanceLeastInFlight {
+		// Compare inFlight[i]/Weights[i] without dividing.
+		for i := range b.Children {
+			if b.inFlight[i]*b.Weights[chosen] < b.inFlight[chosen]*b.Weights[i] {
+				chosen = i
+			}
+		}
+	} else {
+		// Smooth weighted round-robin: every child's score grows by its
+		// weight, and the child with the highest score is chosen and knocked
+		// back by the total weight.
+		total := 0
+		for i, weight := range b.Weights {
+			b.current[i] += weight
+			total += weight
+			if b.current[i] > b.current[chosen] {
+				chosen = i
+			}
+		}
+		b.current[chosen] -= total
+	}
+	b.inFlight[chosen]++
+	return chosen
+}
+
+func (b *Balance) done(chosen int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight[chosen]--
+}
+
+// ProcessReports sends the batch to one of the children.
+func (b *Balance) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	chosen := b.choose()
+	defer b.done(chosen)
+	b.Children[chosen].ProcessReports(ctx, batch)
+}
+
+// Close closes any children that need to be closed.
+func (b *Balance) Close() error {
+	return collector.CloseProcessors(b.Children)
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"Balance",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Weights  []int  `toml:"weights"`
+				Strategy string `toml:"strategy"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			for _, weight := range config.Weights {
+				if weight <= 0 {
+					return nil, fmt.Errorf("Balance `weights` must be positive")
+				}
+			}
+			switch config.Strategy {
+			case "":
+				config.Strategy = BalanceRoundRobin
+			case BalanceRoundRobin, BalanceLeastInFlight:
+			default:
+				return nil, fmt.Errorf("Balance invalid `strategy`: %s", config.Strategy)
+			}
+
+			children, err := collector.LoadChildProcessors(ctx, configPrimitive)
+			if err != nil {
+				return nil, fmt.Errorf("Balance: %v", err)
+			}
+			if len(children) == 0 {
+				return nil, fmt.Errorf("Balance missing `children`")
+			}
+			if config.Weights != nil && len(config.Weights) != len(children) {
+				collector.CloseProcessors(children)
+				return nil, fmt.Errorf("Balance `weights` must have one weight for each child")
+			}
+			return NewBalance(children, config.Weights, config.Strategy)
+		})
+}
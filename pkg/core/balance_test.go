@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// balanceRecorder returns children that record which of them received each
+// batch.
+func balanceRecorder(names ...string) ([]collector.ReportProcessor, func() string) {
+	var mu sync.Mutex
+	var seen []string
+	var children []collector.ReportProcessor
+	for _, name := range names {
+		name := name
+		children = append(children, processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, name)
+		}))
+	}
+	return children, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(seen, " ")
+	}
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights []int
+		want    string
+	}{
+		{"Unweighted", nil, "a b c a b c"},
+		{"Weighted", []int{2, 1, 3}, "c a b c a c"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			children, seen := balanceRecorder("a", "b", "c")
+			balance, err := core.NewBalance(children, c.weights, core.BalanceRoundRobin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 6; i++ {
+				balance.ProcessReports(context.Background(), &collector.ReportBatch{})
+			}
+			if got := seen(); got != c.want {
+				t.Errorf("Balance sent batches to %q, wanted %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBalanceLeastInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		close(started)
+		<-release
+	})
+	children, seen := balanceRecorder("fast")
+	balance, err := core.NewBalance(append([]collector.ReportProcessor{slow}, children...), nil, core.BalanceLeastInFlight)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While the slow child is busy, every batch goes to the fast one, which
+	// round-robin wouldn't do.
+	done := make(chan struct{})
+	go func() {
+		balance.ProcessReports(context.Background(), &collector.ReportBatch{})
+		close(done)
+	}()
+	<-started
+	for i := 0; i < 3; i++ {
+		balance.ProcessReports(context.Background(), &collector.ReportBatch{})
+	}
+	close(release)
+	<-done
+	if got, want := seen(), "fast fast fast"; got != want {
+		t.Errorf("Balance sent batches to %q, wanted %q", got, want)
+	}
+}
+
+func TestBalanceConfig(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "Balance"
+		weights = [1, 2]
+
+		  [[processor.children]]
+		  type = "KeepNelReports"
+
+		  [[processor.children]]
+		  type = "ClassifyReportType"
+	`, &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "csp-violation"}}})
+	// The second child has the higher weight, so it gets the first batch.
+	if got, want := batch.Reports[0].GetAnnotation("ReportSchema"), "unknown"; got != want {
+		t.Errorf("Balance annotated report with %v, wanted %v", got, want)
+	}
+}
+
+func TestBalanceBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "Balance"}]`,
+		`processor = [{type = "Balance", children = [{type = "UnknownType"}]}]`,
+		`processor = [{type = "Balance", children = [{type = "KeepNelReports"}], weights = [1, 2]}]`,
+		`processor = [{type = "Balance", children = [{type = "KeepNelReports"}], weights = [0]}]`,
+		`processor = [{type = "Balance", children = [{type = "KeepNelReports"}], strategy = "random"}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
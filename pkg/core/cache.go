@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a fixed-size, least-recently-used cache whose entries also
+// expire a fixed amount of time after they're added (unless the ttl is zero,
+// in which case they only leave the cache when they're evicted).  It's safe to
+// use from multiple goroutines.
+type ttlCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type ttlCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(size int, ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached value for key, if there is one that hasn't expired.
+func (c *ttlCache) get(key string, now time.Time) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*ttlCacheEntry)
+	if c.ttl > 0 && !now.Before(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.value, true
+}
+
+// add caches a value for key, evicting the least recently used entry if the
+// cache is full.
+func (c *ttlCache) add(key string, value interface{}, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*ttlCacheEntry)
+		entry.value = value
+		entry.expires = now.Add(c.ttl)
+		c.lru.MoveToFront(element)
+		return
+	}
+	if c.size <= 0 {
+		return
+	}
+	for c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*ttlCacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&ttlCacheEntry{key, value, now.Add(c.ttl)})
+}
+
+// each calls f for each value in the cache (including any that have expired),
+// from the most to the least recently used.
+func (c *ttlCache) each(f func(key string, value interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*ttlCacheEntry)
+		f(entry.key, entry.value)
+	}
+}
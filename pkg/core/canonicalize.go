@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// CanonicalizeURL is a pipeline processor that saves a canonical form of each
+// report's URL in an annotation named CanonicalURL, so that variants of the
+// same URL can be grouped together.  The report's URL itself is unchanged.
+// Each of the rules is applied only if it's enabled:
+//
+//   - StripWWW removes a leading `www.` from the host, so that
+//     https://www.example.com/ and https://example.com/ are the same.
+//   - Scheme, if set, replaces the URL's scheme (for instance, with "https").
+//   - LowercaseHost lowercases the host.
+//   - DropDefaultPort removes the port if it's the default for the URL's
+//     original scheme.
+//   - DropTrailingSlash removes any slashes at the end of the path.
+//
+// The query and fragment are left alone.  URLs that we can't parse, or that
+// don't have a host, are copied into the annotation unchanged.
+type CanonicalizeURL struct {
+	StripWWW          bool
+	Scheme            string
+	LowercaseHost     bool
+	DropDefaultPort   bool
+	DropTrailingSlash bool
+}
+
+// NewCanonicalizeURL creates a new CanonicalizeURL processor with all of the
+// rules enabled, other than replacing the scheme.
+func NewCanonicalizeURL() *CanonicalizeURL {
+	return &CanonicalizeURL{
+		StripWWW:          true,
+		LowercaseHost:     true,
+		DropDefaultPort:   true,
+		DropTrailingSlash: true,
+	}
+}
+
+func (c *CanonicalizeURL) canonicalize(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return rawurl
+	}
+	host, port := u.Hostname(), u.Port()
+	if c.LowercaseHost {
+		host = strings.ToLower(host)
+	}
+	if c.StripWWW && len(host) > 4 && strings.EqualFold(host[:4], "www.") {
+		host = host[4:]
+	}
+	if c.DropDefaultPort && port == defaultPorts[strings.ToLower(u.Scheme)] {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	if c.Scheme != "" {
+		u.Scheme = c.Scheme
+	}
+	if c.DropTrailingSlash {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+	}
+	return u.String()
+}
+
+// ProcessReports annotates each report with the canonical form of its URL.
+func (c *CanonicalizeURL) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		report.SetAnnotation("CanonicalURL", c.canonicalize(report.URL))
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"CanonicalizeURL",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				StripWWW          *bool  `toml:"strip_www"`
+				Scheme            string `toml:"scheme"`
+				LowercaseHost     *bool  `toml:"lowercase_host"`
+				DropDefaultPort   *bool  `toml:"drop_default_port"`
+				DropTrailingSlash *bool  `toml:"drop_trailing_slash"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			c := NewCanonicalizeURL()
+			if config.Scheme != "" {
+				if _, ok := defaultPorts[config.Scheme]; !ok {
+					return nil, fmt.Errorf("CanonicalizeURL invalid `scheme`: %s", config.Scheme)
+				}
+				c.Scheme = config.Scheme
+			}
+			for _, rule := range []struct {
+				value *bool
+				field *bool
+			}{
+				{config.StripWWW, &c.StripWWW},
+				{config.LowercaseHost, &c.LowercaseHost},
+				{config.DropDefaultPort, &c.DropDefaultPort},
+				{config.DropTrailingSlash, &c.DropTrailingSlash},
+			} {
+				if rule.value != nil {
+					*rule.field = *rule.value
+				}
+			}
+			return c, nil
+		})
+}
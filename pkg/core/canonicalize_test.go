@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestCanonicalizeURL(t *testing.T) {
+	urls := []string{
+		"https://www.Example.com/x/",
+		"https://example.com:443/x?q=1",
+		"http://WWW.example.com:8080/",
+		"https://[2001:DB8::1]:443/",
+		"https://www/x",
+		"not a url\x7f",
+	}
+	cases := []struct {
+		name, config string
+		want         []string
+	}{
+		{"Defaults", ``, []string{
+			"https://example.com/x",
+			"https://example.com/x?q=1",
+			"http://example.com:8080",
+			"https://[2001:db8::1]",
+			"https://www/x",
+			"not a url\x7f",
+		}},
+		{"ForceScheme", `scheme = "https"`, []string{
+			"https://example.com/x",
+			"https://example.com/x?q=1",
+			"https://example.com:8080",
+			"https://[2001:db8::1]",
+			"https://www/x",
+			"not a url\x7f",
+		}},
+		{"SomeRulesDisabled", "strip_www = false\ndrop_trailing_slash = false\ndrop_default_port = false", []string{
+			"https://www.example.com/x/",
+			"https://example.com:443/x?q=1",
+			"http://www.example.com:8080/",
+			"https://[2001:db8::1]:443/",
+			"https://www/x",
+			"not a url\x7f",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batch := &collector.ReportBatch{}
+			for _, url := range urls {
+				batch.Reports = append(batch.Reports, collector.NelReport{URL: url})
+			}
+			batch = pipelinetest.RunTestConfig("[[processor]]\ntype = \"CanonicalizeURL\"\n"+c.config, batch)
+			var got []string
+			for i, report := range batch.Reports {
+				if report.URL != urls[i] {
+					t.Errorf("CanonicalizeURL changed URL %q to %q", urls[i], report.URL)
+				}
+				got = append(got, report.GetAnnotation("CanonicalURL").(string))
+			}
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("CanonicalizeURL got diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeURLBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`scheme = "ftp"`,
+		`strip_www = "yes"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"CanonicalizeURL\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
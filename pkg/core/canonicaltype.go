@@ -0,0 +1,233 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// NelTypes are the NEL error types that CanonicalizeType knows about: the ones
+// defined by the NEL spec, along with a few that browsers are known to send.
+var NelTypes = []string{
+	"ok",
+	"dns.unreachable",
+	"dns.name_not_resolved",
+	"dns.failed",
+	"dns.address_changed",
+	"tcp.timed_out",
+	"tcp.closed",
+	"tcp.reset",
+	"tcp.refused",
+	"tcp.aborted",
+	"tcp.address_invalid",
+	"tcp.address_unreachable",
+	"tcp.failed",
+	"tls.version_or_cipher_mismatch",
+	"tls.bad_client_auth_cert",
+	"tls.cert.name_invalid",
+	"tls.cert.date_invalid",
+	"tls.cert.authority_invalid",
+	"tls.cert.invalid",
+	"tls.cert.revoked",
+	"tls.cert.pinned_key_not_in_cert_chain",
+	"tls.protocol.error",
+	"tls.failed",
+	"http.error",
+	"http.protocol.error",
+	"http.response.invalid",
+	"http.response.invalid.empty",
+	"http.response.invalid.content_length_mismatch",
+	"http.response.invalid.incomplete_chunked_encoding",
+	"http.response.invalid.invalid_chunked_encoding",
+	"http.response.invalid.invalid_redirect",
+	"http.response.invalid.multiple_content_lengths",
+	"http.response.redirect_loop",
+	"http.failed",
+	"h2.ping_failed",
+	"h2.protocol.error",
+	"quic.protocol.error",
+	"abandoned",
+	"unknown",
+}
+
+// DefaultTypeAliases map legacy and non-standard spellings of NEL types, which
+// older browsers and some client libraries send, to the types in NelTypes.
+var DefaultTypeAliases = map[string]string{
+	"dns.name_not_found":           "dns.name_not_resolved",
+	"dns.unresolved":               "dns.name_not_resolved",
+	"tcp.timeout":                  "tcp.timed_out",
+	"tcp.connection_timed_out":     "tcp.timed_out",
+	"tcp.connection_reset":         "tcp.reset",
+	"tcp.connection_refused":       "tcp.refused",
+	"tcp.connection_closed":        "tcp.closed",
+	"tcp.connection_aborted":       "tcp.aborted",
+	"tls.cert.common_name_invalid": "tls.cert.name_invalid",
+	"tls.cert.expired":             "tls.cert.date_invalid",
+	"tls.cert.untrusted":           "tls.cert.authority_invalid",
+	"tls.version_mismatch":         "tls.version_or_cipher_mismatch",
+	"tls.cipher_mismatch":          "tls.version_or_cipher_mismatch",
+	"http.redirect_loop":           "http.response.redirect_loop",
+	"http.response.redirect.loop":  "http.response.redirect_loop",
+	"http.response.empty":          "http.response.invalid.empty",
+	"http2.ping_failed":            "h2.ping_failed",
+	"http2.protocol.error":         "h2.protocol.error",
+	"quic.protocol_error":          "quic.protocol.error",
+}
+
+// DefaultTypePrefixes are the vendor prefixes that CanonicalizeType removes
+// from NEL types unless you choose different ones.
+var DefaultTypePrefixes = []string{"x-", "chrome.", "chromium.", "webkit.", "moz."}
+
+// CanonicalizeType is a pipeline processor that rewrites the type of each
+// `network-error` report into a canonical set, so that dashboards grouped by
+// type don't split as browsers change their spelling of the same error.  Each
+// type is trimmed and lowercased, the first of Prefixes that it starts with
+// (such as a vendor prefix like "x-") is removed, and then it's looked up in
+// Aliases, which maps legacy spellings to their replacements.
+//
+// If the result is one of the Known types (or the target of an alias), it
+// becomes the report's type.  Otherwise, the report's type is left exactly as
+// it was sent, unless BucketUnknown is set, in which case it becomes
+// "unknown".  Whenever a report's type is changed, the original is saved in an
+// annotation (OriginalType by default), so nothing is lost.  Other reports
+// are left alone.
+type CanonicalizeType struct {
+	// Maps lowercased types to their canonical spelling.
+	Aliases       map[string]string
+	Known         map[string]bool
+	Prefixes      []string
+	BucketUnknown bool
+	Annotation    string
+}
+
+// NewCanonicalizeType creates a new CanonicalizeType processor that knows
+// about NelTypes, uses DefaultTypeAliases and DefaultTypePrefixes, and passes
+// unknown types through.
+func NewCanonicalizeType() *CanonicalizeType {
+	c := &CanonicalizeType{
+		Aliases:    make(map[string]string, len(DefaultTypeAliases)),
+		Known:      make(map[string]bool, len(NelTypes)),
+		Prefixes:   DefaultTypePrefixes,
+		Annotation: "OriginalType",
+	}
+	for alias, typ := range DefaultTypeAliases {
+		c.Aliases[alias] = typ
+	}
+	for _, typ := range NelTypes {
+		c.Known[typ] = true
+	}
+	return c
+}
+
+// AddAlias adds an alias, replacing any existing alias with the same name, and
+// marks its target as a known type.
+func (c *CanonicalizeType) AddAlias(alias, typ string) {
+	c.Aliases[strings.ToLower(alias)] = typ
+	c.Known[typ] = true
+}
+
+// Canonical returns the canonical form of a NEL type, and whether it's a
+// known type.
+func (c *CanonicalizeType) Canonical(typ string) (string, bool) {
+	result := strings.ToLower(strings.TrimSpace(typ))
+	for _, prefix := range c.Prefixes {
+		if strings.HasPrefix(result, prefix) {
+			result = result[len(prefix):]
+			break
+		}
+	}
+	if alias, ok := c.Aliases[result]; ok {
+		result = alias
+	}
+	return result, c.Known[result]
+}
+
+// ProcessReports canonicalizes the type of each `network-error` report in the
+// batch.
+func (c *CanonicalizeType) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" || report.Type == "" {
+			continue
+		}
+		canonical, known := c.Canonical(report.Type)
+		if !known {
+			if !c.BucketUnknown {
+				continue
+			}
+			canonical = "unknown"
+		}
+		if canonical != report.Type {
+			report.SetAnnotation(c.Annotation, report.Type)
+			report.Type = canonical
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"CanonicalizeType",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Aliases        map[string]string `toml:"aliases"`
+				BuiltinAliases *bool             `toml:"builtin_aliases"`
+				KnownTypes     []string          `toml:"known_types"`
+				Prefixes       []string          `toml:"prefixes"`
+				Unknown        string            `toml:"unknown"`
+				Annotation     string            `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			c := NewCanonicalizeType()
+			if config.BuiltinAliases != nil && !*config.BuiltinAliases {
+				c.Aliases = make(map[string]string)
+			}
+			for alias, typ := range config.Aliases {
+				if alias == "" || typ == "" {
+					return nil, fmt.Errorf("CanonicalizeType `aliases` must not contain empty types")
+				}
+				c.AddAlias(alias, typ)
+			}
+			for _, typ := range config.KnownTypes {
+				if typ == "" {
+					return nil, fmt.Errorf("CanonicalizeType `known_types` must not contain empty types")
+				}
+				c.Known[strings.ToLower(typ)] = true
+			}
+			if config.Prefixes != nil {
+				c.Prefixes = config.Prefixes
+			}
+			switch config.Unknown {
+			case "", "pass":
+			case "bucket":
+				c.BucketUnknown = true
+			default:
+				return nil, fmt.Errorf("CanonicalizeType invalid `unknown`: %s", config.Unknown)
+			}
+			if config.Annotation != "" {
+				c.Annotation = config.Annotation
+			}
+			return c, nil
+		})
+}
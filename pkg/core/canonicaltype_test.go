@@ -0,0 +1,116 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestCanonicalizeType(t *testing.T) {
+	cases := []struct {
+		reportType, errorType string
+		want                  string
+		original              interface{}
+	}{
+		{"network-error", "tcp.timed_out", "tcp.timed_out", nil},
+		{"network-error", "ok", "ok", nil},
+		// Legacy spellings.
+		{"network-error", "tcp.timeout", "tcp.timed_out", "tcp.timeout"},
+		{"network-error", "tls.cert.common_name_invalid", "tls.cert.name_invalid", "tls.cert.common_name_invalid"},
+		{"network-error", "dns.name_not_found", "dns.name_not_resolved", "dns.name_not_found"},
+		{"network-error", "http.response.redirect.loop", "http.response.redirect_loop", "http.response.redirect.loop"},
+		// Vendor prefixes, case, and whitespace.
+		{"network-error", "x-tcp.reset", "tcp.reset", "x-tcp.reset"},
+		{"network-error", "Chrome.TLS.Cert.Expired", "tls.cert.date_invalid", "Chrome.TLS.Cert.Expired"},
+		{"network-error", " TCP.Refused ", "tcp.refused", " TCP.Refused "},
+		// Unknown types pass through unchanged.
+		{"network-error", "tcp.something_new", "tcp.something_new", nil},
+		{"network-error", "X-Vendor.Thing", "X-Vendor.Thing", nil},
+		{"csp-violation", "tcp.timeout", "tcp.timeout", nil},
+	}
+	batch := &collector.ReportBatch{}
+	for _, c := range cases {
+		batch.Reports = append(batch.Reports, collector.NelReport{ReportType: c.reportType, Type: c.errorType})
+	}
+	core.NewCanonicalizeType().ProcessReports(context.Background(), batch)
+	for i, c := range cases {
+		report := &batch.Reports[i]
+		if report.Type != c.want {
+			t.Errorf("CanonicalizeType(%s, %q) = %q, wanted %q", c.reportType, c.errorType, report.Type, c.want)
+		}
+		if got := report.GetAnnotation("OriginalType"); got != c.original {
+			t.Errorf("CanonicalizeType(%s, %q) OriginalType = %v, wanted %v", c.reportType, c.errorType, got, c.original)
+		}
+	}
+}
+
+func TestCanonicalizeTypeConfig(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "CanonicalizeType"
+		builtin_aliases = false
+		known_types = ["Custom.Failure"]
+		prefixes = ["acme."]
+		unknown = "bucket"
+		annotation = "RawType"
+
+		[processor.aliases]
+		"TCP.Timeout" = "tcp.timed_out"
+		"h2.stalled" = "h2.stream_stalled"
+	`, &collector.ReportBatch{Reports: []collector.NelReport{
+		{ReportType: "network-error", Type: "tcp.timeout"},
+		{ReportType: "network-error", Type: "acme.h2.stalled"},
+		{ReportType: "network-error", Type: "custom.failure"},
+		{ReportType: "network-error", Type: "tls.cert.expired"},
+		{ReportType: "network-error", Type: "x-tcp.reset"},
+		{ReportType: "network-error", Type: "tcp.reset"},
+	}})
+	cases := []struct {
+		want     string
+		original interface{}
+	}{
+		{"tcp.timed_out", "tcp.timeout"},
+		{"h2.stream_stalled", "acme.h2.stalled"},
+		{"custom.failure", nil},
+		// The built-in aliases and prefixes are turned off.
+		{"unknown", "tls.cert.expired"},
+		{"unknown", "x-tcp.reset"},
+		{"tcp.reset", nil},
+	}
+	for i, c := range cases {
+		report := &batch.Reports[i]
+		if report.Type != c.want || report.GetAnnotation("RawType") != c.original {
+			t.Errorf("CanonicalizeType report %d = %q (RawType %v), wanted %q (RawType %v)", i, report.Type, report.GetAnnotation("RawType"), c.want, c.original)
+		}
+	}
+}
+
+func TestCanonicalizeTypeBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`unknown = "drop"`,
+		`known_types = [""]`,
+		"[processor.aliases]\n\"tcp.timeout\" = \"\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"CanonicalizeType\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
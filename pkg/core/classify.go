@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// reportSchemas lists the fields that must be present in the body of each kind
+// of report that we know about.  (NEL reports are handled separately, since
+// their bodies have already been parsed.)
+var reportSchemas = map[string][]string{
+	"csp-violation": {"documentURL", "effectiveDirective"},
+	"deprecation":   {"id", "message"},
+	"intervention":  {"id", "message"},
+	"crash":         {},
+}
+
+// ClassifyReportType is a pipeline processor that records which report schema
+// each report's body matches.  The schema is saved in a per-report annotation;
+// it will be one of `network-error`, `csp-violation`, `deprecation`,
+// `intervention`, `crash`, or `unknown`.  Reports are never dropped.
+type ClassifyReportType struct {
+	// The name of the annotation to save the schema in.  If empty, we use
+	// "ReportSchema".
+	Annotation string
+}
+
+// ProcessReports annotates each report with the schema that its body matches.
+func (c ClassifyReportType) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	annotation := c.Annotation
+	if annotation == "" {
+		annotation = "ReportSchema"
+	}
+	for i := range batch.Reports {
+		batch.Reports[i].SetAnnotation(annotation, classifyReport(&batch.Reports[i]))
+	}
+}
+
+func classifyReport(report *collector.NelReport) string {
+	if report.ReportType == "network-error" {
+		if report.Type == "" {
+			return "unknown"
+		}
+		return "network-error"
+	}
+
+	required, ok := reportSchemas[report.ReportType]
+	if !ok {
+		return "unknown"
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(report.RawBody, &body); err != nil || body == nil {
+		return "unknown"
+	}
+	for _, field := range required {
+		if _, ok := body[field]; !ok {
+			return "unknown"
+		}
+	}
+	return report.ReportType
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ClassifyReportType",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotation string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			return ClassifyReportType{config.Annotation}, nil
+		})
+}
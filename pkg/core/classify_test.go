@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestClassifyReportType(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestClassifyReportType",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "ClassifyReportType"
+			[[processor]]
+			type = "EncodeBatchAsResult"
+		`),
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+func TestClassifyReportTypeSchemas(t *testing.T) {
+	cases := []struct {
+		reportType, body, want string
+	}{
+		{"csp-violation", `{"documentURL": "https://example.com/", "effectiveDirective": "script-src"}`, "csp-violation"},
+		{"csp-violation", `{"documentURL": "https://example.com/"}`, "unknown"},
+		{"deprecation", `{"id": "websql", "message": "WebSQL is deprecated"}`, "deprecation"},
+		{"intervention", `{"id": "audio", "message": "Autoplay blocked"}`, "intervention"},
+		{"crash", `{}`, "crash"},
+		{"crash", `"not an object"`, "unknown"},
+		{"another-error", `{"random": "stuff"}`, "unknown"},
+	}
+	for _, c := range cases {
+		batch := &collector.ReportBatch{
+			Reports: []collector.NelReport{{ReportType: c.reportType, RawBody: []byte(c.body)}},
+		}
+		core.ClassifyReportType{}.ProcessReports(context.Background(), batch)
+		if got := batch.Reports[0].GetAnnotation("ReportSchema"); got != c.want {
+			t.Errorf("ClassifyReportType(%s, %s) = %v, wanted %v", c.reportType, c.body, got, c.want)
+		}
+	}
+}
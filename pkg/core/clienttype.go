@@ -0,0 +1,274 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// TagClientType is a pipeline processor that classifies the client that
+// uploaded each report by its IP address, so that errors seen by real users
+// can be told apart from errors seen from datacenters and VPNs.  We set the
+// ClientType annotation to "cloud" or "vpn" if the client's address is in one
+// of the CloudRanges or VPNRanges (the most specific range wins, if it's in
+// both), to "residential" if it isn't, and to "unknown" if the address is
+// missing or invalid.  Addresses can include a port or brackets, as in
+// `[2001:db8::1]:443`.
+//
+// The ranges can also be read from files, which contain one CIDR range or IP
+// address per line; blank lines and anything after a `#` are ignored.  The
+// files are read when the processor is created.  You can call Reload to read
+// them again; or, if you give NewTagClientType a reload interval, we check that
+// often whether any of the files have been modified, and read them all again
+// if they have.  If any of them are invalid, we log an error and carry on
+// using the old ranges.
+type TagClientType struct {
+	CloudRanges []*net.IPNet
+	VPNRanges   []*net.IPNet
+	CloudFiles  []string
+	VPNFiles    []string
+
+	mu       sync.RWMutex
+	subnets  []Subnet
+	modTimes map[string]time.Time
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewTagClientType creates a new TagClientType processor, which reads extra
+// ranges from cloudFiles and vpnFiles.  It returns an error if any of the files
+// can't be read.  If reloadInterval is nonzero, we also start checking for
+// changes to the files in the background; Close stops checking.
+func NewTagClientType(cloudRanges, vpnRanges []*net.IPNet, cloudFiles, vpnFiles []string, reloadInterval time.Duration) (*TagClientType, error) {
+	t := &TagClientType{
+		CloudRanges: cloudRanges,
+		VPNRanges:   vpnRanges,
+		CloudFiles:  cloudFiles,
+		VPNFiles:    vpnFiles,
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		t.done = make(chan struct{})
+		t.wg.Add(1)
+		go t.run(reloadInterval)
+	}
+	return t, nil
+}
+
+// changed returns whether any of the files have been modified since they were
+// last read.
+func (t *TagClientType) changed() (bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for path, modTime := range t.modTimes {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		if !info.ModTime().Equal(modTime) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *TagClientType) run(interval time.Duration) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := t.changed()
+			if err == nil && changed {
+				err = t.Reload()
+			}
+			if err != nil {
+				log.Printf("TagClientType: %v", err)
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// readRangesFile reads a file of CIDR ranges and IP addresses, one per line.
+func readRangesFile(path string) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var result []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if comment := strings.IndexByte(text, '#'); comment >= 0 {
+			text = text[:comment]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if !strings.Contains(text, "/") {
+			ip := net.ParseIP(text)
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: invalid IP address %s", path, line, text)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		result = append(result, ipnet)
+	}
+	return result, scanner.Err()
+}
+
+// Reload reads the ranges from CloudFiles and VPNFiles again.  If any of the
+// files can't be read, we return an error and keep using the old ranges.
+func (t *TagClientType) Reload() error {
+	modTimes := make(map[string]time.Time)
+	var subnets []Subnet
+	add := func(label string, ranges []*net.IPNet, files []string) error {
+		for _, ipnet := range ranges {
+			subnets = append(subnets, Subnet{ipnet, label})
+		}
+		for _, path := range files {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			ranges, err := readRangesFile(path)
+			if err != nil {
+				return err
+			}
+			for _, ipnet := range ranges {
+				subnets = append(subnets, Subnet{ipnet, label})
+			}
+			modTimes[path] = info.ModTime()
+		}
+		return nil
+	}
+	if err := add("cloud", t.CloudRanges, t.CloudFiles); err != nil {
+		return err
+	}
+	if err := add("vpn", t.VPNRanges, t.VPNFiles); err != nil {
+		return err
+	}
+	sortSubnets(subnets)
+
+	t.mu.Lock()
+	t.subnets = subnets
+	t.modTimes = modTimes
+	t.mu.Unlock()
+	return nil
+}
+
+// clientType classifies a client IP address.  t.mu must be held.
+func (t *TagClientType) clientType(address string) string {
+	ip := parseIPAddress(address)
+	if ip == nil {
+		return "unknown"
+	}
+	for _, subnet := range t.subnets {
+		if subnet.Range.Contains(ip) {
+			return subnet.Label
+		}
+	}
+	return "residential"
+}
+
+// ProcessReports annotates each report with the type of its client.
+func (t *TagClientType) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		report.SetAnnotation("ClientType", t.clientType(clientIP(batch, report)))
+	}
+}
+
+// Close stops checking for changes to the files.
+func (t *TagClientType) Close() error {
+	if t.done != nil {
+		close(t.done)
+		t.wg.Wait()
+		t.done = nil
+	}
+	return nil
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"TagClientType",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				CloudRanges    []string `toml:"cloud_ranges"`
+				VPNRanges      []string `toml:"vpn_ranges"`
+				CloudFiles     []string `toml:"cloud_files"`
+				VPNFiles       []string `toml:"vpn_files"`
+				ReloadInterval string   `toml:"reload_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			cloudRanges, err := ParseCIDRs(config.CloudRanges)
+			if err != nil {
+				return nil, fmt.Errorf("TagClientType invalid `cloud_ranges`: %v", err)
+			}
+			vpnRanges, err := ParseCIDRs(config.VPNRanges)
+			if err != nil {
+				return nil, fmt.Errorf("TagClientType invalid `vpn_ranges`: %v", err)
+			}
+			var reloadInterval time.Duration
+			if config.ReloadInterval != "" {
+				reloadInterval, err = time.ParseDuration(config.ReloadInterval)
+				if err != nil {
+					return nil, fmt.Errorf("TagClientType invalid `reload_interval`: %v", err)
+				}
+				if reloadInterval <= 0 {
+					return nil, fmt.Errorf("TagClientType `reload_interval` must be positive")
+				}
+			}
+
+			t, err := NewTagClientType(cloudRanges, vpnRanges, config.CloudFiles, config.VPNFiles, reloadInterval)
+			if err != nil {
+				return nil, fmt.Errorf("TagClientType couldn't read ranges: %v", err)
+			}
+			return t, nil
+		})
+}
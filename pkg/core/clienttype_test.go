@@ -0,0 +1,137 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// clientTypes returns the ClientType annotation of a report uploaded from each
+// client IP.
+func clientTypes(p collector.ReportProcessor, ips ...string) []string {
+	var result []string
+	for _, ip := range ips {
+		batch := &collector.ReportBatch{ClientIP: ip, Reports: []collector.NelReport{{}}}
+		p.ProcessReports(context.Background(), batch)
+		result = append(result, fmt.Sprint(batch.Reports[0].GetAnnotation("ClientType")))
+	}
+	return result
+}
+
+func TestTagClientType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clienttype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vpn.txt")
+	ioutil.WriteFile(path, []byte("# Exit nodes\n203.0.113.7\n2001:db8:1::/48  # IPv6 pool\n\n"), 0644)
+
+	config := fmt.Sprintf(`
+		[[processor]]
+		type = "TagClientType"
+		cloud_ranges = ["203.0.113.0/24", "2001:db8::/32"]
+		vpn_files = [%q]
+	`, path)
+	var got []string
+	for _, ip := range []string{"203.0.113.1", "203.0.113.7:443", "[2001:db8:1::5]:443", "2001:db8:2::5", "198.51.100.1", "not an address", ""} {
+		batch := pipelinetest.RunTestConfig(config, &collector.ReportBatch{ClientIP: ip, Reports: []collector.NelReport{{}}})
+		got = append(got, fmt.Sprint(batch.Reports[0].GetAnnotation("ClientType")))
+	}
+	want := []string{"cloud", "vpn", "vpn", "cloud", "residential", "unknown", "unknown"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("TagClientType got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTagClientTypeReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clienttype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cloud.txt")
+	ioutil.WriteFile(path, []byte("192.0.2.0/24\n"), 0644)
+
+	c, err := core.NewTagClientType(nil, nil, []string{path}, nil, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if diff := cmp.Diff([]string{"cloud", "residential"}, clientTypes(c, "192.0.2.1", "198.51.100.1")); diff != "" {
+		t.Errorf("TagClientType got diff (-want +got):\n%s", diff)
+	}
+
+	ioutil.WriteFile(path, []byte("198.51.100.0/24\n"), 0644)
+	// Make sure that the modification time changes, even on filesystems with
+	// coarse timestamps.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := clientTypes(c, "192.0.2.1", "198.51.100.1")
+		if cmp.Equal([]string{"residential", "cloud"}, got) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TagClientType didn't reload the file: got %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An invalid file leaves the old ranges in place.
+	ioutil.WriteFile(path, []byte("198.51.100.0/33\n"), 0644)
+	if err := c.Reload(); err == nil {
+		t.Errorf("Reload of an invalid file should return error")
+	}
+	if diff := cmp.Diff([]string{"cloud"}, clientTypes(c, "198.51.100.1")); diff != "" {
+		t.Errorf("TagClientType after failed Reload got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTagClientTypeBadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clienttype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vpn.txt")
+	ioutil.WriteFile(path, []byte("not an address\n"), 0644)
+
+	for _, config := range []string{
+		`cloud_ranges = ["203.0.113.0"]`,
+		`vpn_ranges = ["2001:db8::/129"]`,
+		fmt.Sprintf("vpn_files = [%q]", path),
+		fmt.Sprintf("cloud_files = [%q]", filepath.Join(dir, "nonexistent.txt")),
+		`reload_interval = "soon"`,
+		`reload_interval = "0s"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"TagClientType\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// CloudInstance describes the cloud instance that the collector is running
+// on.
+type CloudInstance struct {
+	Provider   string
+	Region     string
+	Zone       string
+	InstanceID string
+}
+
+// cloudMetadataEndpoints are the default addresses of each provider's metadata
+// server.
+var cloudMetadataEndpoints = map[string]string{
+	"gcp":   "http://metadata.google.internal",
+	"aws":   "http://169.254.169.254",
+	"azure": "http://169.254.169.254",
+}
+
+// cloudProviders is the order in which LookupCloudInstance tries each provider
+// when auto-detecting.
+var cloudProviders = []string{"gcp", "aws", "azure"}
+
+// metadataClient is used for all requests to metadata servers.  They're only
+// reachable from the instance itself, so we never go through a proxy.
+var metadataClient = &http.Client{Transport: &http.Transport{}}
+
+// metadataRequest sends a request to a metadata server and returns the body
+// of its response, which must be successful.
+func metadataRequest(ctx context.Context, method, url string, header map[string]string) (string, http.Header, error) {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	response, err := metadataClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return "", nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if err != nil {
+		return "", nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return strings.TrimSpace(string(body)), response.Header, nil
+}
+
+// lookupGCPInstance asks the GCE metadata server where we are.  The zone comes
+// back as projects/<number>/zones/<zone>, and the region is the zone without
+// its final suffix.
+func lookupGCPInstance(ctx context.Context, endpoint string) (CloudInstance, error) {
+	header := map[string]string{"Metadata-Flavor": "Google"}
+	zone, responseHeader, err := metadataRequest(ctx, "GET", endpoint+"/computeMetadata/v1/instance/zone", header)
+	if err != nil {
+		return CloudInstance{}, err
+	}
+	if responseHeader.Get("Metadata-Flavor") != "Google" {
+		return CloudInstance{}, fmt.Errorf("%s isn't a GCE metadata server", endpoint)
+	}
+	id, _, err := metadataRequest(ctx, "GET", endpoint+"/computeMetadata/v1/instance/id", header)
+	if err != nil {
+		return CloudInstance{}, err
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	return CloudInstance{Provider: "gcp", Region: region, Zone: zone, InstanceID: id}, nil
+}
+
+// lookupAWSInstance asks the EC2 instance metadata service where we are,
+// using a session token (IMDSv2).
+func lookupAWSInstance(ctx context.Context, endpoint string) (CloudInstance, error) {
+	token, _, err := metadataRequest(ctx, "PUT", endpoint+"/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return CloudInstance{}, err
+	}
+	header := map[string]string{"X-aws-ec2-metadata-token": token}
+	instance := CloudInstance{Provider: "aws"}
+	for _, field := range []struct {
+		path  string
+		value *string
+	}{
+		{"placement/region", &instance.Region},
+		{"placement/availability-zone", &instance.Zone},
+		{"instance-id", &instance.InstanceID},
+	} {
+		if *field.value, _, err = metadataRequest(ctx, "GET", endpoint+"/latest/meta-data/"+field.path, header); err != nil {
+			return CloudInstance{}, err
+		}
+	}
+	return instance, nil
+}
+
+// lookupAzureInstance asks the Azure instance metadata service where we are.
+// Azure numbers the zones within each region, so we qualify the zone with the
+// region, as Kubernetes does (westus2-1).
+func lookupAzureInstance(ctx context.Context, endpoint string) (CloudInstance, error) {
+	body, _, err := metadataRequest(ctx, "GET", endpoint+"/metadata/instance/compute?api-version=2021-02-01", map[string]string{"Metadata": "true"})
+	if err != nil {
+		return CloudInstance{}, err
+	}
+	var compute struct {
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+		VMID     string `json:"vmId"`
+	}
+	if err := json.Unmarshal([]byte(body), &compute); err != nil {
+		return CloudInstance{}, fmt.Errorf("Couldn't parse Azure instance metadata: %v", err)
+	}
+	instance := CloudInstance{Provider: "azure", Region: compute.Location, InstanceID: compute.VMID}
+	if compute.Zone != "" {
+		instance.Zone = compute.Location + "-" + compute.Zone
+	}
+	return instance, nil
+}
+
+var cloudLookups = map[string]func(ctx context.Context, endpoint string) (CloudInstance, error){
+	"gcp":   lookupGCPInstance,
+	"aws":   lookupAWSInstance,
+	"azure": lookupAzureInstance,
+}
+
+// LookupCloudInstance asks a cloud provider's metadata server which instance
+// the collector is running on.  provider is "gcp", "aws", or "azure"; or
+// "auto", to try each of them in turn, returning the first that works.  If
+// endpoint is empty, we use the provider's usual address for its metadata
+// server.
+func LookupCloudInstance(ctx context.Context, provider, endpoint string) (CloudInstance, error) {
+	providers := []string{provider}
+	if provider == "auto" {
+		providers = cloudProviders
+	}
+	var errs []string
+	for _, provider := range providers {
+		lookup, ok := cloudLookups[provider]
+		if !ok {
+			return CloudInstance{}, fmt.Errorf("Unknown cloud provider %s", provider)
+		}
+		base := endpoint
+		if base == "" {
+			base = cloudMetadataEndpoints[provider]
+		}
+		instance, err := lookup(ctx, strings.TrimSuffix(base, "/"))
+		if err == nil {
+			return instance, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", provider, err))
+	}
+	return CloudInstance{}, fmt.Errorf("Couldn't look up cloud instance (%s)", strings.Join(errs, "; "))
+}
+
+// cloudMetadataFields maps each field that CloudMetadata can emit to the
+// annotation that it uses.
+var cloudMetadataFields = map[string]string{
+	"region":      "CollectorRegion",
+	"zone":        "CollectorZone",
+	"instance_id": "CollectorInstanceID",
+}
+
+// DefaultCloudMetadataFields are the fields that CloudMetadata emits, unless
+// you ask for different ones.
+var DefaultCloudMetadataFields = []string{"region", "zone", "instance_id"}
+
+// CloudMetadata is a pipeline processor that records where each batch was
+// collected, which helps when a multi-region deployment's collectors all
+// publish to the same place.  Each batch gets a CollectorRegion,
+// CollectorZone, and CollectorInstanceID annotation, as selected by Fields,
+// with the values from Instance.  A field that's empty in Instance isn't
+// annotated at all.
+//
+// The loader looks up Instance from the cloud provider's metadata server once,
+// when the pipeline is loaded (see LookupCloudInstance), so that we don't send
+// the metadata server a request for every batch.
+type CloudMetadata struct {
+	Instance CloudInstance
+	Fields   []string
+}
+
+// NewCloudMetadata creates a new CloudMetadata processor, which annotates
+// batches with the given fields of instance.  Each field must be "region",
+// "zone", or "instance_id".
+func NewCloudMetadata(instance CloudInstance, fields []string) (*CloudMetadata, error) {
+	for _, field := range fields {
+		if _, ok := cloudMetadataFields[field]; !ok {
+			return nil, fmt.Errorf("Unknown cloud metadata field %s", field)
+		}
+	}
+	return &CloudMetadata{Instance: instance, Fields: fields}, nil
+}
+
+// ProcessReports annotates the batch with the collector's location.
+func (m *CloudMetadata) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for _, field := range m.Fields {
+		var value string
+		switch field {
+		case "region":
+			value = m.Instance.Region
+		case "zone":
+			value = m.Instance.Zone
+		case "instance_id":
+			value = m.Instance.InstanceID
+		}
+		if value != "" {
+			batch.SetAnnotation(cloudMetadataFields[field], value)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"CloudMetadata",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Provider string   `toml:"provider"`
+				Endpoint string   `toml:"endpoint"`
+				Fields   []string `toml:"fields"`
+				Timeout  string   `toml:"timeout"`
+				Fallback struct {
+					Region     string `toml:"region"`
+					Zone       string `toml:"zone"`
+					InstanceID string `toml:"instance_id"`
+				} `toml:"fallback"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Provider == "" {
+				config.Provider = "auto"
+			}
+			if _, ok := cloudLookups[config.Provider]; !ok && config.Provider != "auto" {
+				return nil, fmt.Errorf("CloudMetadata invalid `provider`: %s", config.Provider)
+			}
+			if config.Fields == nil {
+				config.Fields = DefaultCloudMetadataFields
+			}
+			timeout := 2 * time.Second
+			if config.Timeout != "" {
+				timeout, err = time.ParseDuration(config.Timeout)
+				if err != nil {
+					return nil, fmt.Errorf("CloudMetadata invalid `timeout`: %v", err)
+				}
+				if timeout <= 0 {
+					return nil, fmt.Errorf("CloudMetadata `timeout` must be positive")
+				}
+			}
+
+			m, err := NewCloudMetadata(CloudInstance{}, config.Fields)
+			if err != nil {
+				return nil, fmt.Errorf("CloudMetadata invalid `fields`: %v", err)
+			}
+
+			// If the metadata server can't be reached (say, because we're not
+			// running in the cloud at all), we use the fallback values rather
+			// than refusing to start.
+			lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			m.Instance, err = LookupCloudInstance(lookupCtx, config.Provider, config.Endpoint)
+			if err != nil {
+				log.Printf("CloudMetadata: %v; using fallback values", err)
+				m.Instance = CloudInstance{
+					Region:     config.Fallback.Region,
+					Zone:       config.Fallback.Zone,
+					InstanceID: config.Fallback.InstanceID,
+				}
+			}
+			return m, nil
+		})
+}
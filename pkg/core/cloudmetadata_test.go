@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// newMetadataServer returns a fake metadata server for one cloud provider,
+// along with a count of the requests that it's received.
+func newMetadataServer(provider string) (*httptest.Server, *int64) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		switch provider + " " + r.Method + " " + r.URL.Path {
+		case "gcp GET /computeMetadata/v1/instance/zone":
+			if r.Header.Get("Metadata-Flavor") == "Google" {
+				w.Header().Set("Metadata-Flavor", "Google")
+				fmt.Fprint(w, "projects/123/zones/europe-west1-b")
+				return
+			}
+		case "gcp GET /computeMetadata/v1/instance/id":
+			if r.Header.Get("Metadata-Flavor") == "Google" {
+				w.Header().Set("Metadata-Flavor", "Google")
+				fmt.Fprint(w, "4520031799277581759")
+				return
+			}
+		case "aws PUT /latest/api/token":
+			fmt.Fprint(w, "token")
+			return
+		case "aws GET /latest/meta-data/placement/region",
+			"aws GET /latest/meta-data/placement/availability-zone",
+			"aws GET /latest/meta-data/instance-id":
+			if r.Header.Get("X-aws-ec2-metadata-token") == "token" {
+				fmt.Fprint(w, map[string]string{
+					"/latest/meta-data/placement/region":            "us-east-1",
+					"/latest/meta-data/placement/availability-zone": "us-east-1a",
+					"/latest/meta-data/instance-id":                 "i-0123456789abcdef0",
+				}[r.URL.Path])
+				return
+			}
+		case "azure GET /metadata/instance/compute":
+			if r.Header.Get("Metadata") == "true" {
+				fmt.Fprint(w, `{"location":"westus2","zone":"1","vmId":"02aab8a4-74ef-476e-8182-f6d2ba4166a6"}`)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	return server, &requests
+}
+
+func TestLookupCloudInstance(t *testing.T) {
+	for _, test := range []struct {
+		provider string
+		want     core.CloudInstance
+	}{
+		{"gcp", core.CloudInstance{Provider: "gcp", Region: "europe-west1", Zone: "europe-west1-b", InstanceID: "4520031799277581759"}},
+		{"aws", core.CloudInstance{Provider: "aws", Region: "us-east-1", Zone: "us-east-1a", InstanceID: "i-0123456789abcdef0"}},
+		{"azure", core.CloudInstance{Provider: "azure", Region: "westus2", Zone: "westus2-1", InstanceID: "02aab8a4-74ef-476e-8182-f6d2ba4166a6"}},
+	} {
+		server, _ := newMetadataServer(test.provider)
+		for _, provider := range []string{test.provider, "auto"} {
+			got, err := core.LookupCloudInstance(context.Background(), provider, server.URL)
+			if err != nil {
+				t.Errorf("LookupCloudInstance(%s) on %s: %v", provider, test.provider, err)
+				continue
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("LookupCloudInstance(%s) on %s got diff (-want +got):\n%s", provider, test.provider, diff)
+			}
+		}
+		server.Close()
+	}
+
+	server, _ := newMetadataServer("aws")
+	defer server.Close()
+	if _, err := core.LookupCloudInstance(context.Background(), "gcp", server.URL); err == nil {
+		t.Errorf("LookupCloudInstance(gcp) should fail on AWS")
+	}
+}
+
+func TestCloudMetadata(t *testing.T) {
+	server, requests := newMetadataServer("aws")
+	defer server.Close()
+	config := fmt.Sprintf(`
+		[[processor]]
+		type = "CloudMetadata"
+		provider = "aws"
+		endpoint = %q
+		fields = ["region", "zone"]
+	`, server.URL)
+	pipeline := pipelinetest.NewTestConfigPipeline(config)
+	defer pipeline.Close()
+	before := atomic.LoadInt64(requests)
+
+	for i := 0; i < 3; i++ {
+		batch := &collector.ReportBatch{}
+		pipeline.ProcessBatch(context.Background(), batch)
+		if got := batch.GetAnnotation("CollectorRegion"); got != "us-east-1" {
+			t.Errorf("CollectorRegion is %v, wanted us-east-1", got)
+		}
+		if got := batch.GetAnnotation("CollectorZone"); got != "us-east-1a" {
+			t.Errorf("CollectorZone is %v, wanted us-east-1a", got)
+		}
+		if got := batch.GetAnnotation("CollectorInstanceID"); got != nil {
+			t.Errorf("CollectorInstanceID is %v, but it wasn't requested", got)
+		}
+	}
+	// The metadata is only looked up when the processor is loaded.
+	if after := atomic.LoadInt64(requests); after != before {
+		t.Errorf("CloudMetadata sent %d requests while processing batches, wanted none", after-before)
+	}
+}
+
+func TestCloudMetadataFallback(t *testing.T) {
+	server, _ := newMetadataServer("azure")
+	server.Close()
+	batch := pipelinetest.RunTestConfig(fmt.Sprintf(`
+		[[processor]]
+		type = "CloudMetadata"
+		endpoint = %q
+		timeout = "1s"
+		fallback = { region = "on-prem" }
+	`, server.URL), &collector.ReportBatch{})
+	if got := batch.GetAnnotation("CollectorRegion"); got != "on-prem" {
+		t.Errorf("CollectorRegion is %v, wanted the fallback", got)
+	}
+	if got := batch.GetAnnotation("CollectorZone"); got != nil {
+		t.Errorf("CollectorZone is %v, but it has no fallback", got)
+	}
+}
+
+func TestCloudMetadataBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`provider = "digitalocean"`,
+		`fields = ["region", "rack"]`,
+		`timeout = "soon"`,
+		`timeout = "0s"`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"CloudMetadata\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
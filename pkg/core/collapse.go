@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// DefaultCollapseFields are the report fields that CollapseDuplicates groups
+// reports by, unless you choose different ones.
+var DefaultCollapseFields = []string{"url", "type", "status_code"}
+
+// CollapseDuplicates is a pipeline processor that collapses identical reports
+// within a single batch into one.  Two reports are identical if they have the
+// same values for each of Fields, which are named as in Where's conditions
+// (such as `url` or `status_code`).  We keep the first report in each group,
+// and set an annotation on it (Count by default) saying how many reports were
+// in the group; the others are thrown away, along with their annotations.
+//
+// This only looks at one batch at a time, so it doesn't need to remember
+// anything, and won't notice duplicates that are uploaded separately.
+type CollapseDuplicates struct {
+	Fields     []string
+	Annotation string
+
+	getters []func(report *collector.NelReport) interface{}
+}
+
+// NewCollapseDuplicates creates a new CollapseDuplicates processor that groups
+// reports by the given fields.
+func NewCollapseDuplicates(fields []string, annotation string) (*CollapseDuplicates, error) {
+	c := &CollapseDuplicates{Fields: fields, Annotation: annotation}
+	for _, field := range fields {
+		get, ok := reportFields[field]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", field)
+		}
+		c.getters = append(c.getters, get)
+	}
+	return c, nil
+}
+
+func (c *CollapseDuplicates) key(report *collector.NelReport) string {
+	values := make([]string, len(c.getters))
+	for i, get := range c.getters {
+		values[i] = fmt.Sprint(get(report))
+	}
+	return strings.Join(values, "\x00")
+}
+
+// ProcessReports collapses the identical reports in the batch.
+func (c *CollapseDuplicates) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var collapsed []collector.NelReport
+	var counts []int
+	groups := make(map[string]int)
+	for _, report := range batch.Reports {
+		key := c.key(&report)
+		if i, ok := groups[key]; ok {
+			counts[i]++
+			continue
+		}
+		groups[key] = len(collapsed)
+		collapsed = append(collapsed, report)
+		counts = append(counts, 1)
+	}
+	for i := range collapsed {
+		collapsed[i].SetAnnotation(c.Annotation, counts[i])
+	}
+	batch.Reports = collapsed
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"CollapseDuplicates",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Fields     []string `toml:"fields"`
+				Annotation string   `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			if config.Fields == nil {
+				config.Fields = DefaultCollapseFields
+			}
+			if len(config.Fields) == 0 {
+				return nil, fmt.Errorf("CollapseDuplicates `fields` must not be empty")
+			}
+			if config.Annotation == "" {
+				config.Annotation = "Count"
+			}
+			c, err := NewCollapseDuplicates(config.Fields, config.Annotation)
+			if err != nil {
+				return nil, fmt.Errorf("CollapseDuplicates invalid `fields`: %v", err)
+			}
+			return c, nil
+		})
+}
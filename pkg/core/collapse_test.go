@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestCollapseDuplicates(t *testing.T) {
+	reports := []collector.NelReport{
+		{URL: "https://a/", Type: "tcp.timed_out", Age: 1},
+		{URL: "https://a/", Type: "http.error", StatusCode: 500, Age: 2},
+		{URL: "https://a/", Type: "tcp.timed_out", Age: 3},
+		{URL: "https://b/", Type: "tcp.timed_out", Age: 4},
+		{URL: "https://a/", Type: "http.error", StatusCode: 503, Age: 5},
+		{URL: "https://a/", Type: "tcp.timed_out", Age: 6},
+	}
+	cases := []struct {
+		config, annotation string
+		want               []string
+	}{
+		{"", "Count", []string{"1×3", "2×1", "4×1", "5×1"}},
+		{`fields = ["type"]`, "Count", []string{"1×4", "2×2"}},
+		{`fields = ["url", "type"]` + "\n" + `annotation = "Duplicates"`, "Duplicates", []string{"1×3", "2×2", "4×1"}},
+	}
+	for _, c := range cases {
+		batch := &collector.ReportBatch{Reports: append([]collector.NelReport(nil), reports...)}
+		batch = pipelinetest.RunTestConfig("[[processor]]\ntype = \"CollapseDuplicates\"\n"+c.config, batch)
+		var got []string
+		for _, report := range batch.Reports {
+			got = append(got, fmt.Sprintf("%d×%v", report.Age, report.GetAnnotation(c.annotation)))
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("CollapseDuplicates(%s) got diff (-want +got):\n%s", c.config, diff)
+		}
+	}
+}
+
+func TestCollapseDuplicatesBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`fields = []`,
+		`fields = ["url", "colour"]`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"CollapseDuplicates\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
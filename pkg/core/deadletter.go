@@ -0,0 +1,172 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// DeadLetter is a pipeline processor that wraps a chain of other processors
+// (typically publishers), and routes any batch that they fail to handle to a
+// dead-letter sink, instead of letting those reports silently vanish.
+//
+// Each processor in the chain is run using collector.TryProcessReports; only
+// processors that implement collector.FallibleReportProcessor can fail.  If one
+// of them fails, we skip the rest of the chain, and run the Sink processors
+// against a copy of the batch as it was before the chain started, with the
+// error message stored in its DeadLetterError annotation.  The sink could be a
+// DeadLetterWriter, which saves the batch to a file so that it can be replayed
+// later, or any other chain of processors.
+type DeadLetter struct {
+	Processors []collector.ReportProcessor
+	Sink       []collector.ReportProcessor
+}
+
+// ProcessReports runs the wrapped chain against the batch, sending the batch to
+// the dead-letter sink if any of the chain's processors fail.
+func (d DeadLetter) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	original := batch.Clone()
+	for _, processor := range d.Processors {
+		if err := collector.TryProcessReports(ctx, processor, batch); err != nil {
+			original.SetAnnotation("DeadLetterError", err.Error())
+			runChain(ctx, d.Sink, original)
+			return
+		}
+	}
+}
+
+// Close closes any processors in the wrapped chain and the dead-letter sink
+// that need to be closed.
+func (d DeadLetter) Close() error {
+	err := collector.CloseProcessors(d.Processors)
+	if sinkErr := collector.CloseProcessors(d.Sink); err == nil {
+		err = sinkErr
+	}
+	return err
+}
+
+// DeadLetterWriter is a pipeline processor that writes each batch that it
+// receives as a single line of JSON.  The line includes the batch's reports in
+// the same format that they were originally uploaded in, so that they can be
+// replayed later, along with some metadata about the upload and the contents of
+// the batch's DeadLetterError annotation.
+type DeadLetterWriter struct {
+	Writer io.Writer
+
+	mu     sync.Mutex
+	closer io.Closer
+}
+
+// NewDeadLetterFile creates a DeadLetterWriter that appends to a file, creating
+// it if needed.
+func NewDeadLetterFile(path string) (*DeadLetterWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterWriter{Writer: f, closer: f}, nil
+}
+
+type deadLetterRecord struct {
+	Time            time.Time             `json:"time"`
+	ClientIP        string                `json:"client_ip,omitempty"`
+	ClientUserAgent string                `json:"client_user_agent,omitempty"`
+	Error           interface{}           `json:"error,omitempty"`
+	Reports         []collector.NelReport `json:"reports"`
+}
+
+// ProcessReports writes the batch to the DeadLetterWriter's Writer.
+func (d *DeadLetterWriter) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	line, err := json.Marshal(deadLetterRecord{
+		Time:            batch.Time,
+		ClientIP:        batch.ClientIP,
+		ClientUserAgent: batch.ClientUserAgent,
+		Error:           batch.GetAnnotation("DeadLetterError"),
+		Reports:         batch.Reports,
+	})
+	if err != nil {
+		log.Printf("DeadLetterWriter: couldn't encode %d reports: %v", len(batch.Reports), err)
+		return
+	}
+	line = append(line, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.Writer.Write(line); err != nil {
+		log.Printf("DeadLetterWriter: couldn't write %d reports: %v", len(batch.Reports), err)
+	}
+}
+
+// Close closes the file that the DeadLetterWriter writes to, if it was created
+// by NewDeadLetterFile.
+func (d *DeadLetterWriter) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"DeadLetter",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Path       string           `toml:"path"`
+				DeadLetter []toml.Primitive `toml:"dead_letter"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if (config.Path == "") == (len(config.DeadLetter) == 0) {
+				return nil, fmt.Errorf("DeadLetter needs exactly one of `path` or `dead_letter`")
+			}
+
+			var d DeadLetter
+			d.Processors, err = collector.LoadChildProcessors(ctx, configPrimitive)
+			if err != nil {
+				return nil, fmt.Errorf("DeadLetter: %v", err)
+			}
+			if len(d.Processors) == 0 {
+				return nil, fmt.Errorf("DeadLetter missing `children`")
+			}
+			if config.Path != "" {
+				writer, err := NewDeadLetterFile(config.Path)
+				if err != nil {
+					collector.CloseProcessors(d.Processors)
+					return nil, fmt.Errorf("DeadLetter invalid `path`: %v", err)
+				}
+				d.Sink = []collector.ReportProcessor{writer}
+			} else {
+				d.Sink, err = collector.LoadProcessors(ctx, config.DeadLetter)
+				if err != nil {
+					collector.CloseProcessors(d.Processors)
+					return nil, fmt.Errorf("DeadLetter sink: %v", err)
+				}
+			}
+			return d, nil
+		})
+}
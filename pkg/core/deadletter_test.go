@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// failingPublisher fails to publish any batch that contains a CSP report.
+type failingPublisher struct {
+	published int
+}
+
+func (f *failingPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	f.TryProcessReports(ctx, batch)
+}
+
+func (f *failingPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	for _, report := range batch.Reports {
+		if report.ReportType == "csp-violation" {
+			return errors.New("backend unavailable")
+		}
+	}
+	f.published += len(batch.Reports)
+	return nil
+}
+
+func TestDeadLetter(t *testing.T) {
+	var buf bytes.Buffer
+	publisher := &failingPublisher{}
+	after := 0
+	d := core.DeadLetter{
+		Processors: []collector.ReportProcessor{
+			core.ClassifyReportType{Annotation: "ReportSchema"},
+			publisher,
+			processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+				after++
+			}),
+		},
+		Sink: []collector.ReportProcessor{&core.DeadLetterWriter{Writer: &buf}},
+	}
+
+	good := &collector.ReportBatch{
+		ClientIP: "192.0.2.1",
+		Reports:  []collector.NelReport{{ReportType: "network-error", Type: "ok"}},
+	}
+	d.ProcessReports(context.Background(), good)
+	if publisher.published != 1 || after != 1 || buf.Len() != 0 {
+		t.Errorf("DeadLetter(good batch): published %d, after %d, dead letters %q", publisher.published, after, buf.String())
+	}
+
+	bad := &collector.ReportBatch{
+		ClientIP: "192.0.2.2",
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", Type: "ok"},
+			{ReportType: "csp-violation", RawBody: []byte(`{"blocked-uri":"https://example.com/"}`)},
+		},
+	}
+	d.ProcessReports(context.Background(), bad)
+	if publisher.published != 1 || after != 1 {
+		t.Errorf("DeadLetter(bad batch): published %d, after %d; wanted the chain to stop", publisher.published, after)
+	}
+
+	var record struct {
+		ClientIP string            `json:"client_ip"`
+		Error    string            `json:"error"`
+		Reports  []json.RawMessage `json:"reports"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf.String(), err)
+	}
+	if record.ClientIP != "192.0.2.2" || record.Error != "backend unavailable" || len(record.Reports) != 2 {
+		t.Errorf("DeadLetter wrote %q", buf.String())
+	}
+	// The dead letter should contain the batch as it was before the chain ran.
+	if bytes.Contains(buf.Bytes(), []byte("ReportSchema")) {
+		t.Errorf("DeadLetter wrote annotations from the wrapped chain: %q", buf.String())
+	}
+}
+
+func TestDeadLetterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead-letters.jsonl")
+
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	err = pipeline.LoadFromConfig(context.Background(), []byte(`
+		[[processor]]
+		type = "DeadLetter"
+		path = "`+path+`"
+		  [[processor.children]]
+		  type = "KeepNelReports"
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("DeadLetter didn't create its file: %v", err)
+	}
+}
+
+func TestDeadLetterBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "DeadLetter", path = "dead-letters.jsonl"}]`,
+		`processor = [{type = "DeadLetter", processor = [{type = "KeepNelReports"}]}]`,
+		`processor = [{type = "DeadLetter", processor = [{type = "KeepNelReports"}], path = "dead-letters.jsonl", dead_letter = [{type = "KeepNelReports"}]}]`,
+		`processor = [{type = "DeadLetter", processor = [{type = "UnknownType"}], path = "dead-letters.jsonl"}]`,
+		`processor = [{type = "DeadLetter", processor = [{type = "KeepNelReports"}], dead_letter = [{type = "UnknownType"}]}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
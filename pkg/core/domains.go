@@ -0,0 +1,222 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// RestrictToDomains is a pipeline processor that drops any report whose URL
+// isn't on one of a set of registrable domains (or "eTLD+1"s, according to the
+// public suffix list), such as reports for sites that copied our Report-To
+// header, or outright spam.  A report for `https://www.example.co.uk/` is kept
+// if "example.co.uk" is allowed, but one for `https://example.co.uk.evil.com/`
+// isn't.  Reports whose URL has an IP address or an opaque origin are always
+// dropped.  Since this is cheap, and throws away reports that every later
+// processor would otherwise waste time on, it should usually come first.
+//
+// RestrictToDomains counts the reports that it drops; see Dropped.  If Log is
+// set, we also log the host of each one.
+type RestrictToDomains struct {
+	Domains map[string]bool
+	Log     bool
+
+	dropped int64
+}
+
+// NewRestrictToDomains creates a new RestrictToDomains processor that allows
+// the given registrable domains.  It returns an error if any of them aren't
+// registrable domains (for instance, if they're a subdomain, or a public
+// suffix).
+func NewRestrictToDomains(domains []string) (*RestrictToDomains, error) {
+	r := &RestrictToDomains{Domains: make(map[string]bool)}
+	for _, domain := range domains {
+		host, err := parseRegistrableDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		r.Domains[host] = true
+	}
+	return r, nil
+}
+
+// parseRegistrableDomain returns the canonical form of a registrable domain
+// from a configuration, or an error if it isn't one.
+func parseRegistrableDomain(domain string) (string, error) {
+	host, ok := canonicalHost(strings.TrimSuffix(domain, "."))
+	if !ok {
+		return "", fmt.Errorf("invalid domain %s", domain)
+	}
+	registrable, ok := registrableDomain(host)
+	if !ok {
+		return "", fmt.Errorf("%s isn't a registrable domain", domain)
+	}
+	if registrable != host {
+		return "", fmt.Errorf("%s isn't a registrable domain (did you mean %s?)", domain, registrable)
+	}
+	return host, nil
+}
+
+// reportDomain returns the registrable domain of a report's URL, reusing the
+// RegistrableDomain annotation if an earlier processor (such as DomainInfo)
+// has already found it.
+func reportDomain(report *collector.NelReport) (string, bool) {
+	if domain, ok := report.GetAnnotation("RegistrableDomain").(string); ok {
+		return domain, true
+	}
+	origin, ok := parseOrigin(report.URL)
+	if !ok {
+		return "", false
+	}
+	return registrableDomain(origin.Host)
+}
+
+// Dropped returns the number of reports that the processor has thrown away.
+func (r *RestrictToDomains) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+func (r *RestrictToDomains) allowed(report *collector.NelReport) bool {
+	domain, ok := reportDomain(report)
+	return ok && r.Domains[domain]
+}
+
+// ProcessReports throws away any reports that aren't on an allowed domain.
+func (r *RestrictToDomains) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var filtered []collector.NelReport
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if r.allowed(report) {
+			filtered = append(filtered, *report)
+			continue
+		}
+		if r.Log {
+			host := "(invalid URL)"
+			if origin, ok := parseOrigin(report.URL); ok {
+				host = origin.Host
+			}
+			log.Printf("RestrictToDomains: dropped report for %s from %s", host, clientIP(batch, report))
+		}
+	}
+	atomic.AddInt64(&r.dropped, int64(len(batch.Reports)-len(filtered)))
+	batch.Reports = filtered
+}
+
+// DomainInfo is a pipeline processor that annotates each report with
+// information about the host of its URL: RegistrableDomain is its registrable
+// domain (or "eTLD+1", according to the public suffix list), and
+// SubdomainDepth is the number of labels in front of that (an int).  For
+// instance, `https://a.b.example.co.uk/` has a RegistrableDomain of
+// "example.co.uk" and a SubdomainDepth of 2.  Neither annotation is set if the
+// URL is invalid, or its host is an IP address or a public suffix.
+//
+// Later processors can use these annotations instead of parsing the URL again;
+// RestrictToDomains does, for instance.
+type DomainInfo struct{}
+
+// ProcessReports annotates each report with information about its URL's host.
+func (DomainInfo) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		origin, ok := parseOrigin(report.URL)
+		if !ok {
+			continue
+		}
+		domain, ok := registrableDomain(origin.Host)
+		if !ok {
+			continue
+		}
+		host := strings.TrimSuffix(origin.Host, ".")
+		report.SetAnnotation("RegistrableDomain", domain)
+		report.SetAnnotation("SubdomainDepth", strings.Count(host, ".")-strings.Count(domain, "."))
+	}
+}
+
+// ReferrerDomain is a pipeline processor that annotates each report with the
+// registrable domain (or "eTLD+1") of its `referrer`, in the ReferrerDomain
+// annotation, so that reports can be grouped by the site that sent the user
+// to the failing page.  Reports with no referrer, or whose referrer is opaque
+// (such as `about:client` or an `android-app:` URL), is invalid, or has a
+// host that's an IP address or a public suffix, aren't annotated.
+type ReferrerDomain struct{}
+
+// ProcessReports annotates each report with its referrer's registrable domain.
+func (ReferrerDomain) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.Referrer == "" {
+			continue
+		}
+		origin, ok := parseOrigin(report.Referrer)
+		if !ok {
+			continue
+		}
+		if domain, ok := registrableDomain(origin.Host); ok {
+			report.SetAnnotation("ReferrerDomain", domain)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ReferrerDomain",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct{}
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			return ReferrerDomain{}, nil
+		})
+	collector.RegisterContextReportLoaderFunc(
+		"DomainInfo",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct{}
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			return DomainInfo{}, nil
+		})
+	collector.RegisterContextReportLoaderFunc(
+		"RestrictToDomains",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Domains []string `toml:"domains"`
+				Log     bool     `toml:"log"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Domains) == 0 {
+				return nil, fmt.Errorf("RestrictToDomains missing `domains`")
+			}
+			r, err := NewRestrictToDomains(config.Domains)
+			if err != nil {
+				return nil, fmt.Errorf("RestrictToDomains invalid `domains`: %v", err)
+			}
+			r.Log = config.Log
+			return r, nil
+		})
+}
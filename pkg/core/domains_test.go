@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestDomainInfo(t *testing.T) {
+	cases := []struct {
+		url, want string
+	}{
+		{"https://example.com/", "example.com 0"},
+		{"https://www.Example.com:8443/", "example.com 1"},
+		{"https://a.b.example.co.uk./", "example.co.uk 2"},
+		{"https://bücher.example/", "xn--bcher-kva.example 0"},
+		{"https://192.0.2.1/", "<nil> <nil>"},
+		{"https://[2001:db8::1]/", "<nil> <nil>"},
+		{"https://co.uk/", "<nil> <nil>"},
+		{"not a url", "<nil> <nil>"},
+	}
+	batch := &collector.ReportBatch{}
+	for _, c := range cases {
+		batch.Reports = append(batch.Reports, collector.NelReport{URL: c.url})
+	}
+	batch = pipelinetest.RunTestConfig("[[processor]]\ntype = \"DomainInfo\"", batch)
+	for i, c := range cases {
+		report := &batch.Reports[i]
+		got := fmt.Sprintf("%v %v", report.GetAnnotation("RegistrableDomain"), report.GetAnnotation("SubdomainDepth"))
+		if got != c.want {
+			t.Errorf("DomainInfo(%s) = %s, wanted %s", c.url, got, c.want)
+		}
+	}
+}
+
+func TestReferrerDomain(t *testing.T) {
+	cases := []struct {
+		referrer string
+		want     interface{}
+	}{
+		{"https://www.google.co.uk/search?q=x", "google.co.uk"},
+		{"http://News.Example.com:8080/", "example.com"},
+		{"", nil},
+		{"about:client", nil},
+		{"android-app://com.example.app/", nil},
+		{"https://192.0.2.1/", nil},
+		{"https://github.io/", nil},
+		{"not a url", nil},
+	}
+	batch := &collector.ReportBatch{}
+	for _, c := range cases {
+		batch.Reports = append(batch.Reports, collector.NelReport{URL: "https://example.org/", Referrer: c.referrer})
+	}
+	batch = pipelinetest.RunTestConfig("[[processor]]\ntype = \"ReferrerDomain\"", batch)
+	for i, c := range cases {
+		if got := batch.Reports[i].GetAnnotation("ReferrerDomain"); got != c.want {
+			t.Errorf("ReferrerDomain(%q) = %v, wanted %v", c.referrer, got, c.want)
+		}
+	}
+}
+
+func TestRestrictToDomains(t *testing.T) {
+	r, err := core.NewRestrictToDomains([]string{"example.com", "Example.co.uk."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := &collector.ReportBatch{}
+	for _, url := range []string{
+		"https://example.com/",
+		"https://www.EXAMPLE.com:8443/path",
+		"https://cdn.example.co.uk/",
+		"https://example.co.uk.evil.com/",
+		"https://notexample.com/",
+		"https://192.0.2.1/",
+		"https://co.uk/",
+		"data:text/plain,hello",
+		"",
+	} {
+		batch.Reports = append(batch.Reports, collector.NelReport{URL: url})
+	}
+	r.ProcessReports(context.Background(), batch)
+
+	var got []string
+	for _, report := range batch.Reports {
+		got = append(got, report.URL)
+	}
+	want := []string{"https://example.com/", "https://www.EXAMPLE.com:8443/path", "https://cdn.example.co.uk/"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RestrictToDomains kept diff (-want +got):\n%s", diff)
+	}
+	if got, want := r.Dropped(), int64(6); got != want {
+		t.Errorf("RestrictToDomains dropped %d reports, wanted %d", got, want)
+	}
+}
+
+func TestRestrictToDomainsBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`domains = []`,
+		`domains = ["www.example.com"]`,
+		`domains = ["co.uk"]`,
+		`domains = ["192.0.2.1"]`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"RestrictToDomains\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// DualOutput is a pipeline processor that keeps every report and summarizes
+// them at the same time.  Each batch is passed straight to the Raw chain (as a
+// copy, so that processors after the DualOutput see the batch unchanged), and
+// its reports are also added to a window of aggregated counts.  Whenever
+// Window has passed (according to Clock), and when the DualOutput is closed,
+// the window is sent to the Aggregate chain as a single batch and a new one is
+// started.
+//
+// Reports are aggregated in the same way as CollapseDuplicates: reports with
+// the same values for each of Fields are counted together, and the aggregate
+// batch contains the first report seen in each group, with an annotation
+// (Count by default) saying how many reports were in the group during the
+// window.  The aggregate batch's time is the end of the window, and it has
+// WindowStart and WindowEnd annotations.  Empty windows aren't sent.
+type DualOutput struct {
+	Window    time.Duration
+	Raw       []collector.ReportProcessor
+	Aggregate []collector.ReportProcessor
+
+	// Clock is used to decide when the window is over.  If nil, we use the
+	// current time.
+	Clock collector.Clock
+
+	grouper *CollapseDuplicates
+	mu      sync.Mutex
+	start   time.Time
+	groups  map[string]int
+	reports []collector.NelReport
+	counts  []int
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDualOutput creates a new DualOutput processor that groups reports by the
+// given fields, and starts checking whether the window is over.  (Close stops
+// checking.)  We check in the background a few times per Window; you can also
+// call Tick to check immediately.
+func NewDualOutput(window time.Duration, fields []string, annotation string, raw, aggregate []collector.ReportProcessor, clock collector.Clock) (*DualOutput, error) {
+	grouper, err := NewCollapseDuplicates(fields, annotation)
+	if err != nil {
+		return nil, err
+	}
+	d := &DualOutput{
+		Window:    window,
+		Raw:       raw,
+		Aggregate: aggregate,
+		Clock:     clock,
+		grouper:   grouper,
+		groups:    make(map[string]int),
+		done:      make(chan struct{}),
+	}
+	d.start = d.now()
+	d.wg.Add(1)
+	go d.run()
+	return d, nil
+}
+
+func (d *DualOutput) now() time.Time {
+	if d.Clock == nil {
+		return time.Now()
+	}
+	return d.Clock.Now()
+}
+
+func (d *DualOutput) run() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.Window / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.Tick(context.Background())
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// ProcessReports passes a copy of the batch to the Raw chain, and adds its
+// reports to the current window.
+func (d *DualOutput) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	d.mu.Lock()
+	for _, report := range batch.Reports {
+		key := d.grouper.key(&report)
+		if i, ok := d.groups[key]; ok {
+			d.counts[i]++
+			continue
+		}
+		d.groups[key] = len(d.reports)
+		report.Annotations = report.CloneAnnotations()
+		d.reports = append(d.reports, report)
+		d.counts = append(d.counts, 1)
+	}
+	d.mu.Unlock()
+	runChain(ctx, d.Raw, batch.Clone())
+}
+
+// Tick sends the current window to the Aggregate chain if it has lasted for
+// at least Window, and returns whether it did.
+func (d *DualOutput) Tick(ctx context.Context) bool {
+	now := d.now()
+	d.mu.Lock()
+	if now.Sub(d.start) < d.Window {
+		d.mu.Unlock()
+		return false
+	}
+	d.mu.Unlock()
+	d.Flush(ctx)
+	return true
+}
+
+// Flush sends the current window to the Aggregate chain straight away, even
+// if it hasn't lasted for Window yet, and starts a new one.
+func (d *DualOutput) Flush(ctx context.Context) {
+	now := d.now()
+	d.mu.Lock()
+	start, reports, counts := d.start, d.reports, d.counts
+	d.start = now
+	d.groups = make(map[string]int)
+	d.reports = nil
+	d.counts = nil
+	d.mu.Unlock()
+
+	if len(reports) == 0 {
+		return
+	}
+	for i := range reports {
+		reports[i].SetAnnotation(d.grouper.Annotation, counts[i])
+	}
+	batch := &collector.ReportBatch{Time: now, Reports: reports}
+	batch.SetAnnotation("WindowStart", start)
+	batch.SetAnnotation("WindowEnd", now)
+	runChain(ctx, d.Aggregate, batch)
+}
+
+// Close stops checking the window, sends whatever is in it to the Aggregate
+// chain, and closes any processors in both chains that need to be closed.
+func (d *DualOutput) Close() error {
+	close(d.done)
+	d.wg.Wait()
+	d.Flush(context.Background())
+	result := collector.CloseProcessors(d.Raw)
+	if err := collector.CloseProcessors(d.Aggregate); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"DualOutput",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Window     string           `toml:"window"`
+				Fields     []string         `toml:"fields"`
+				Annotation string           `toml:"annotation"`
+				Raw        []toml.Primitive `toml:"raw"`
+				Aggregate  []toml.Primitive `toml:"aggregate"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Window == "" {
+				return nil, fmt.Errorf("DualOutput missing `window`")
+			}
+			window, err := time.ParseDuration(config.Window)
+			if err != nil {
+				return nil, fmt.Errorf("DualOutput invalid `window`: %v", err)
+			}
+			if window <= 0 {
+				return nil, fmt.Errorf("DualOutput `window` must be positive")
+			}
+			if config.Fields == nil {
+				config.Fields = DefaultCollapseFields
+			}
+			if len(config.Fields) == 0 {
+				return nil, fmt.Errorf("DualOutput `fields` must not be empty")
+			}
+			if config.Annotation == "" {
+				config.Annotation = "Count"
+			}
+			if len(config.Raw) == 0 {
+				return nil, fmt.Errorf("DualOutput missing `raw`")
+			}
+			if len(config.Aggregate) == 0 {
+				return nil, fmt.Errorf("DualOutput missing `aggregate`")
+			}
+
+			raw, err := collector.LoadProcessors(ctx, config.Raw)
+			if err != nil {
+				return nil, fmt.Errorf("DualOutput raw: %v", err)
+			}
+			aggregate, err := collector.LoadProcessors(ctx, config.Aggregate)
+			if err != nil {
+				collector.CloseProcessors(raw)
+				return nil, fmt.Errorf("DualOutput aggregate: %v", err)
+			}
+			d, err := NewDualOutput(window, config.Fields, config.Annotation, raw, aggregate, clock)
+			if err != nil {
+				collector.CloseProcessors(raw)
+				collector.CloseProcessors(aggregate)
+				return nil, fmt.Errorf("DualOutput invalid `fields`: %v", err)
+			}
+			return d, nil
+		})
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestDualOutput(t *testing.T) {
+	var mu sync.Mutex
+	var raw, aggregate []string
+	recordRaw := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, report := range batch.Reports {
+			raw = append(raw, fmt.Sprintf("%s %s", batch.Time.Format("15:04:05"), report.URL))
+		}
+		// Filtering in the raw chain mustn't affect the caller's batch.
+		batch.Reports = nil
+	})
+	recordAggregate := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		mu.Lock()
+		defer mu.Unlock()
+		start := batch.GetAnnotation("WindowStart").(time.Time)
+		for _, report := range batch.Reports {
+			aggregate = append(aggregate, fmt.Sprintf("%s-%s %s %s %v", start.Format("15:04:05"), batch.Time.Format("15:04:05"), report.URL, report.Type, report.GetAnnotation("Count")))
+		}
+	})
+
+	// The background check runs on real time, so use a window that it won't
+	// reach during the test.
+	clock := pipelinetest.NewSimulatedClock()
+	d, err := core.NewDualOutput(time.Hour, []string{"url", "type"}, "Count",
+		[]collector.ReportProcessor{recordRaw}, []collector.ReportProcessor{recordAggregate}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	report := func(url, typ string) collector.NelReport {
+		return collector.NelReport{ReportType: "network-error", URL: url, Type: typ}
+	}
+	process := func(offset time.Duration, reports ...collector.NelReport) {
+		clock.CurrentTime = clock.CurrentTime.Add(offset)
+		batch := &collector.ReportBatch{Time: clock.Now(), Reports: reports}
+		d.ProcessReports(ctx, batch)
+		if len(batch.Reports) != len(reports) {
+			t.Errorf("DualOutput changed the batch's reports to %v", batch.Reports)
+		}
+	}
+	tick := func(offset time.Duration) bool {
+		clock.CurrentTime = clock.CurrentTime.Add(offset)
+		return d.Tick(ctx)
+	}
+
+	var ticks []bool
+	process(10*time.Minute, report("https://a.example/", "ok"), report("https://a.example/", "tcp.reset"))
+	ticks = append(ticks, tick(20*time.Minute))
+	process(20*time.Minute, report("https://a.example/", "ok"))
+	ticks = append(ticks, tick(30*time.Minute))
+	ticks = append(ticks, tick(time.Hour))
+	process(5*time.Minute, report("https://b.example/", "ok"))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]bool{false, true, true}, ticks); diff != "" {
+		t.Errorf("Tick got diff (-want +got):\n%s", diff)
+	}
+	wantRaw := []string{
+		"00:10:00 https://a.example/",
+		"00:10:00 https://a.example/",
+		"00:50:00 https://a.example/",
+		"02:25:00 https://b.example/",
+	}
+	if diff := cmp.Diff(wantRaw, raw); diff != "" {
+		t.Errorf("DualOutput raw chain saw diff (-want +got):\n%s", diff)
+	}
+	// The empty window from 01:20 to 02:20 isn't sent.
+	wantAggregate := []string{
+		"00:00:00-01:20:00 https://a.example/ ok 2",
+		"00:00:00-01:20:00 https://a.example/ tcp.reset 1",
+		"02:20:00-02:25:00 https://b.example/ ok 1",
+	}
+	if diff := cmp.Diff(wantAggregate, aggregate); diff != "" {
+		t.Errorf("DualOutput aggregate chain saw diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDualOutputBadConfig(t *testing.T) {
+	chains := "\n[[processor.raw]]\ntype = \"AssignReportID\"\n[[processor.aggregate]]\ntype = \"AssignReportID\""
+	for _, config := range []string{
+		chains,
+		`window = "soon"` + chains,
+		`window = "-1m"` + chains,
+		`window = "1m"` + "\nfields = []" + chains,
+		`window = "1m"` + "\nfields = [\"nonexistent\"]" + chains,
+		`window = "1m"` + "\n[[processor.raw]]\ntype = \"AssignReportID\"",
+		`window = "1m"` + "\n[[processor.aggregate]]\ntype = \"AssignReportID\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"DualOutput\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -15,10 +15,16 @@
 package core
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/google/nel-collector/pkg/collector"
@@ -39,30 +45,276 @@ func (d DumpReportsAsCLF) ProcessReports(ctx context.Context, batch *collector.R
 		writer = batch.AnnotationWriter("TestResult")
 	}
 	collector.PrintBatchAsCLF(batch, writer)
+	if f, ok := writer.(*dumpWriter); ok {
+		f.Flush()
+	}
+}
+
+// Close closes the destination file, if the dumper's configuration asked us to
+// open one.
+func (d DumpReportsAsCLF) Close() error {
+	if f, ok := d.Writer.(*dumpWriter); ok {
+		return f.Close()
+	}
+	return nil
+}
+
+// DefaultCSVColumns are the columns that DumpReportsAsCSV writes by default.
+var DefaultCSVColumns = []string{"received_at", "client_ip", "report_type", "url", "phase", "type", "status_code", "elapsed_time"}
+
+// csvFieldName matches the column names that DumpReportsAsCSV treats as report
+// fields rather than annotations.
+var csvFieldName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// DumpReportsAsCSV is a ReportProcessor that writes each report as a row of
+// CSV, with a header row naming the columns at the start of the output.
+//
+// Each column is either a report field (using the same names as Where's
+// conditions, such as `url` or `status_code`, along with `received_at` for the
+// time that the report's batch was received, and `client_ip` for the client
+// that uploaded it), or the name of an annotation.  Column names in
+// lower_snake_case are report fields, and anything else is an annotation.  As
+// in Where's conditions, we fall back on the batch's annotation if a report
+// doesn't have one, and missing annotations are written as empty cells.
+type DumpReportsAsCSV struct {
+	// Writer is where the CSV should be written to.  If nil, we'll save the CSV
+	// (including a header row) for each batch as the value of the TestResult
+	// annotation.
+	Writer io.Writer
+
+	Columns []string
+
+	values      []func(batch *collector.ReportBatch, report *collector.NelReport) interface{}
+	mu          sync.Mutex
+	wroteHeader bool
+}
+
+// NewDumpReportsAsCSV creates a new DumpReportsAsCSV processor that writes the
+// given columns to writer.
+func NewDumpReportsAsCSV(writer io.Writer, columns []string) (*DumpReportsAsCSV, error) {
+	d := &DumpReportsAsCSV{Writer: writer, Columns: columns}
+	for _, column := range columns {
+		switch {
+		case column == "received_at":
+			d.values = append(d.values, func(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+				return batch.Time.UTC().Format(time.RFC3339Nano)
+			})
+		case column == "client_ip":
+			d.values = append(d.values, func(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+				return clientIP(batch, report)
+			})
+		case csvFieldName.MatchString(column):
+			get, ok := reportFields[column]
+			if !ok {
+				return nil, fmt.Errorf("unknown field %s", column)
+			}
+			d.values = append(d.values, fieldRef{get}.eval)
+		case column != "":
+			d.values = append(d.values, annotationRef{column}.eval)
+		default:
+			return nil, fmt.Errorf("empty column name")
+		}
+	}
+	return d, nil
+}
+
+// encode writes the rows for a batch to a buffer, starting with the header if
+// header is true.
+func (d *DumpReportsAsCSV) encode(batch *collector.ReportBatch, header bool) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if header {
+		w.Write(d.Columns)
+	}
+	row := make([]string, len(d.values))
+	for i := range batch.Reports {
+		for j, value := range d.values {
+			row[j], _ = routeValue(value(batch, &batch.Reports[i]))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// ProcessReports writes a row for each report in the batch.
+func (d *DumpReportsAsCSV) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if d.Writer == nil {
+		batch.SetAnnotation("TestResult", d.encode(batch, true))
+		return
+	}
+	// Encode the whole batch before writing it, so that rows from batches
+	// that are being processed at the same time don't get mixed up.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Writer.Write(d.encode(batch, !d.wroteHeader))
+	d.wroteHeader = true
+	if f, ok := d.Writer.(*dumpWriter); ok {
+		f.Flush()
+	}
+}
+
+// Close closes the destination file, if the dumper's configuration asked us to
+// open one.
+func (d *DumpReportsAsCSV) Close() error {
+	if f, ok := d.Writer.(*dumpWriter); ok {
+		return f.Close()
+	}
+	return nil
+}
+
+// dumpWriter is the destination of a dumper that was loaded from a
+// configuration file.  It can compress its output, and it's safe to write to
+// from several pipeline workers at once.
+type dumpWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	gz     *gzip.Writer
+	closer io.Closer
+}
+
+// newDumpWriter creates a dumpWriter that writes to w, optionally compressing
+// it with gzip.  If closer isn't nil, it's closed when the dumpWriter is.
+func newDumpWriter(w io.Writer, closer io.Closer, compress bool) *dumpWriter {
+	d := &dumpWriter{w: w, closer: closer}
+	if compress {
+		d.gz = gzip.NewWriter(w)
+		d.w = d.gz
+	}
+	return d
+}
+
+func (d *dumpWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.w.Write(p)
+}
+
+// Flush writes any buffered compressed data, so that everything written so far
+// can be decompressed.
+func (d *dumpWriter) Flush() error {
+	if d.gz == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gz.Flush()
+}
+
+// Close writes the gzip trailer (if we're compressing), and closes the
+// underlying file (if we opened it).
+func (d *dumpWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var err error
+	if d.gz != nil {
+		err = d.gz.Close()
+	}
+	if d.closer != nil {
+		if closeErr := d.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openDumpDest opens the destination of a dumper, as specified in its
+// configuration: `dest` can be "stdout", "file" (in which case `path` gives
+// the name of the file to append to), or "annotation" (in which case we return
+// nil).  If `compress` is true, the output is gzipped.
+func openDumpDest(dumper, dest, path string, compress bool) (io.Writer, error) {
+	if dest == "" {
+		return nil, fmt.Errorf("%s missing `dest`", dumper)
+	}
+	if path != "" && dest != "file" {
+		return nil, fmt.Errorf("%s only uses `path` when `dest` is file", dumper)
+	}
+
+	if dest == "stdout" {
+		if !compress {
+			return os.Stdout, nil
+		}
+		return newDumpWriter(os.Stdout, nil, compress), nil
+	} else if dest == "file" {
+		if path == "" {
+			return nil, fmt.Errorf("%s missing `path`", dumper)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid `path`: %v", dumper, err)
+		}
+		return newDumpWriter(f, f, compress), nil
+	} else if dest == "annotation" {
+		if compress {
+			return nil, fmt.Errorf("%s can't `compress` annotations", dumper)
+		}
+		return nil, nil
+	} else {
+		return nil, fmt.Errorf("%s invalid `dest`: %s", dumper, dest)
+	}
 }
 
 func init() {
-	collector.RegisterReportLoaderFunc(
+	collector.RegisterContextReportLoaderFunc(
 		"DumpReportsAsCLF",
-		func(configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
 			var config struct {
-				Dest string `toml:"dest"`
+				Dest     string `toml:"dest"`
+				Path     string `toml:"path"`
+				Compress bool   `toml:"compress"`
 			}
 
-			err := toml.PrimitiveDecode(configPrimitive, &config)
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
 			if err != nil {
 				return nil, err
 			}
-			if config.Dest == "" {
-				return nil, fmt.Errorf("DumpReportsAsCLF missing `dest`")
+
+			writer, err := openDumpDest("DumpReportsAsCLF", config.Dest, config.Path, config.Compress)
+			if err != nil {
+				return nil, err
+			}
+			return DumpReportsAsCLF{writer}, nil
+		})
+	collector.RegisterContextReportLoaderFunc(
+		"DumpReportsAsCSV",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Dest     string   `toml:"dest"`
+				Path     string   `toml:"path"`
+				Compress bool     `toml:"compress"`
+				Columns  []string `toml:"columns"`
 			}
 
-			if config.Dest == "stdout" {
-				return DumpReportsAsCLF{os.Stdout}, nil
-			} else if config.Dest == "annotation" {
-				return DumpReportsAsCLF{}, nil
-			} else {
-				return nil, fmt.Errorf("DumpReportsAsCLF invalid `dest`: %s", config.Dest)
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Columns == nil {
+				config.Columns = DefaultCSVColumns
+			}
+			if len(config.Columns) == 0 {
+				return nil, fmt.Errorf("DumpReportsAsCSV `columns` must not be empty")
+			}
+			// Validate the columns before opening the destination, so that we
+			// don't leave a file open if they're invalid.
+			if _, err := NewDumpReportsAsCSV(nil, config.Columns); err != nil {
+				return nil, fmt.Errorf("DumpReportsAsCSV invalid `columns`: %v", err)
+			}
+
+			// If we're appending to a file that already has content, it already
+			// has a header.
+			var appending bool
+			if config.Dest == "file" && config.Path != "" {
+				if info, err := os.Stat(config.Path); err == nil && info.Size() > 0 {
+					appending = true
+				}
+			}
+			writer, err := openDumpDest("DumpReportsAsCSV", config.Dest, config.Path, config.Compress)
+			if err != nil {
+				return nil, err
 			}
+			d, _ := NewDumpReportsAsCSV(writer, config.Columns)
+			d.wroteHeader = appending
+			return d, nil
 		})
 }
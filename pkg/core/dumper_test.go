@@ -15,8 +15,18 @@
 package core_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/google/nel-collector/pkg/collector"
 	_ "github.com/google/nel-collector/pkg/core"
 	"github.com/google/nel-collector/pkg/pipelinetest"
 )
@@ -39,3 +49,152 @@ func TestDumpReportsAsCLF(t *testing.T) {
 	}
 	p.Run(t)
 }
+
+func TestDumpReportsAsCLFCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reports.log.gz")
+
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	err = pipeline.LoadFromConfig(context.Background(), []byte(`
+		[[processor]]
+		type = "DumpReportsAsCLF"
+		dest = "file"
+		path = "`+path+`"
+		compress = true
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := ioutil.ReadFile("../pipelinetest/testdata/reports/valid-nel-report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+		request.Header.Add("Content-Type", "application/reports+json")
+		response := httptest.NewRecorder()
+		pipeline.ServeHTTP(response, request)
+		if response.Code != http.StatusNoContent {
+			t.Fatalf("ServeHTTP: got %d", response.Code)
+		}
+	}
+	// Closing the pipeline should write the gzip trailer.
+	pipeline.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Reading compressed output: %v", err)
+	}
+	if got := strings.Count(string(contents), `"GET https://example.com/about/" 200`); got != 3 {
+		t.Errorf("Compressed output has %d reports, wanted 3:\n%s", got, contents)
+	}
+}
+
+func TestDumpReportsAsCLFBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "DumpReportsAsCLF"}]`,
+		`processor = [{type = "DumpReportsAsCLF", dest = "stderr"}]`,
+		`processor = [{type = "DumpReportsAsCLF", dest = "file"}]`,
+		`processor = [{type = "DumpReportsAsCLF", dest = "stdout", path = "reports.log"}]`,
+		`processor = [{type = "DumpReportsAsCLF", dest = "annotation", compress = true}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
+
+// CSV dumping test cases
+
+func TestDumpReportsAsCSV(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestDumpReportsAsCSV",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "AnnotateOrigin"
+			[[processor]]
+			type = "DumpReportsAsCSV"
+			dest = "annotation"
+			columns = ["received_at", "client_ip", "url", "status_code", "Origin", "Missing"]
+		`),
+		OutputExtension: ".csv",
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+func TestDumpReportsAsCSVFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reports.csv")
+	payload, err := ioutil.ReadFile("../pipelinetest/testdata/reports/valid-nel-report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each pipeline appends to the file, but the header is only written once.
+	for i := 0; i < 2; i++ {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		err = pipeline.LoadFromConfig(context.Background(), []byte(`
+			[[processor]]
+			type = "DumpReportsAsCSV"
+			dest = "file"
+			path = "`+path+`"
+			columns = ["url", "type"]
+		`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			request := httptest.NewRequest("POST", "https://example.com/upload/", bytes.NewReader(payload))
+			request.Header.Add("Content-Type", "application/reports+json")
+			pipeline.ServeHTTP(httptest.NewRecorder(), request)
+		}
+		pipeline.Close()
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "url,type\n" + strings.Repeat("https://example.com/about/,ok\n", 4)
+	if string(contents) != want {
+		t.Errorf("DumpReportsAsCSV wrote %q, wanted %q", contents, want)
+	}
+}
+
+func TestDumpReportsAsCSVBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "DumpReportsAsCSV"}]`,
+		`processor = [{type = "DumpReportsAsCSV", dest = "stdout", columns = []}]`,
+		`processor = [{type = "DumpReportsAsCSV", dest = "stdout", columns = ["nonexistent"]}]`,
+		`processor = [{type = "DumpReportsAsCSV", dest = "stdout", columns = ["url", ""]}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
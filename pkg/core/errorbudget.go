@@ -0,0 +1,246 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// ErrorBudgetBurn is a pipeline processor that turns NEL reports into the
+// error-budget burn rates that SLO alerting rules are written against.  Given
+// an SLO Target (such as 0.999, meaning that 99.9% of requests should
+// succeed), a host's burn rate over a window is its error ratio over that
+// window (the fraction of its `network-error` reports that were failures)
+// divided by the ratio that the SLO allows (1 - Target).  A burn rate of 1
+// spends the error budget exactly as fast as the SLO allows; a burn rate of 10
+// spends it ten times as fast.
+//
+// We keep a separate error ratio for each host over each of Windows (say, 5m
+// and 1h, for a multi-window alert), measured in tenths of the window, as
+// with AttachErrorRate.  Each `network-error` report gets its host's burn rate
+// over each window (including the report itself), as a float64, in an
+// annotation named after the window: with the default Annotation, that's
+// ErrorBudgetBurn_5m and ErrorBudgetBurn_1h.
+//
+// We track at most MaxKeys hosts at a time, forgetting about the ones that
+// we've heard from least recently.
+type ErrorBudgetBurn struct {
+	Target     float64
+	Windows    []time.Duration
+	Annotation string
+	MaxKeys    int
+
+	// Clock is used to decide which reports are recent.  If nil, we use the
+	// current time.
+	Clock collector.Clock
+
+	key     func(report *collector.NelReport) (string, bool)
+	mu      sync.Mutex
+	windows *ttlCache
+}
+
+// NewErrorBudgetBurn creates a new ErrorBudgetBurn processor for an SLO
+// target, which keeps separate burn rates for each value of field, over each
+// of the given windows.  The field can be "host", for the host of each
+// report's URL, or any of the fields that Where's conditions can use.
+func NewErrorBudgetBurn(field string, target float64, windows []time.Duration) (*ErrorBudgetBurn, error) {
+	key, err := reportKey(field)
+	if err != nil {
+		return nil, err
+	}
+	return &ErrorBudgetBurn{
+		Target:     target,
+		Windows:    windows,
+		Annotation: "ErrorBudgetBurn",
+		MaxKeys:    10000,
+		key:        key,
+	}, nil
+}
+
+func (b *ErrorBudgetBurn) now() time.Time {
+	if b.Clock == nil {
+		return time.Now()
+	}
+	return b.Clock.Now()
+}
+
+// windowName returns a short name for a window, such as 5m or 1h30m, for use
+// in annotation names.
+func windowName(window time.Duration) string {
+	name := window.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// annotations returns the names of the annotations for each window.
+func (b *ErrorBudgetBurn) annotations() []string {
+	names := make([]string, len(b.Windows))
+	for i, window := range b.Windows {
+		names[i] = b.Annotation + "_" + windowName(window)
+	}
+	return names
+}
+
+// keyWindows returns the windows for a key, creating them if needed.  b.mu
+// must be held.
+func (b *ErrorBudgetBurn) keyWindows(key string, now time.Time) []errorRateWindow {
+	if b.windows == nil {
+		b.windows = newTTLCache(b.MaxKeys, 0)
+	}
+	if windows, ok := b.windows.get(key, now); ok {
+		return windows.([]errorRateWindow)
+	}
+	windows := make([]errorRateWindow, len(b.Windows))
+	b.windows.add(key, windows, now)
+	return windows
+}
+
+// ProcessReports updates the counts for each host in the batch, and annotates
+// the batch's reports with the resulting burn rates.
+func (b *ErrorBudgetBurn) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	keys := make([]string, len(batch.Reports))
+	counted := make([]bool, len(batch.Reports))
+	reports := make(map[string]int)
+	failures := make(map[string]int)
+	var distinct []string
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" {
+			continue
+		}
+		key, ok := b.key(report)
+		if !ok {
+			continue
+		}
+		keys[i] = key
+		counted[i] = true
+		if reports[key] == 0 {
+			distinct = append(distinct, key)
+		}
+		reports[key]++
+		if isFailure(report) {
+			failures[key]++
+		}
+	}
+	if len(distinct) == 0 {
+		return
+	}
+
+	now := b.now()
+	budget := 1 - b.Target
+	burns := make(map[string][]float64, len(distinct))
+	b.mu.Lock()
+	for _, key := range distinct {
+		windows := b.keyWindows(key, now)
+		burns[key] = make([]float64, len(windows))
+		for i, window := range b.Windows {
+			bucketWidth := window / errorRateBuckets
+			if bucketWidth <= 0 {
+				bucketWidth = 1
+			}
+			bucket := now.UnixNano() / int64(bucketWidth)
+			burns[key][i] = windows[i].add(bucket, reports[key], failures[key]) / budget
+		}
+	}
+	b.mu.Unlock()
+
+	names := b.annotations()
+	for i := range batch.Reports {
+		if !counted[i] {
+			continue
+		}
+		for j, name := range names {
+			batch.Reports[i].SetAnnotation(name, burns[keys[i]][j])
+		}
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ErrorBudgetBurn",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Target     *float64 `toml:"target"`
+				Windows    []string `toml:"windows"`
+				Field      string   `toml:"field"`
+				Annotation string   `toml:"annotation"`
+				MaxKeys    *int     `toml:"max_keys"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Target == nil {
+				return nil, fmt.Errorf("ErrorBudgetBurn missing `target`")
+			}
+			if *config.Target <= 0 || *config.Target >= 1 {
+				return nil, fmt.Errorf("ErrorBudgetBurn `target` must be between 0 and 1")
+			}
+			if config.Windows == nil {
+				config.Windows = []string{"5m", "1h"}
+			}
+			if len(config.Windows) == 0 {
+				return nil, fmt.Errorf("ErrorBudgetBurn `windows` must not be empty")
+			}
+			var windows []time.Duration
+			seen := make(map[string]bool)
+			for _, w := range config.Windows {
+				window, err := time.ParseDuration(w)
+				if err != nil {
+					return nil, fmt.Errorf("ErrorBudgetBurn invalid `windows`: %v", err)
+				}
+				if window <= 0 {
+					return nil, fmt.Errorf("ErrorBudgetBurn `windows` must be positive")
+				}
+				if seen[windowName(window)] {
+					return nil, fmt.Errorf("ErrorBudgetBurn has duplicate `windows`: %s", w)
+				}
+				seen[windowName(window)] = true
+				windows = append(windows, window)
+			}
+			if config.Field == "" {
+				config.Field = "host"
+			}
+
+			b, err := NewErrorBudgetBurn(config.Field, *config.Target, windows)
+			if err != nil {
+				return nil, fmt.Errorf("ErrorBudgetBurn invalid `field`: %s", config.Field)
+			}
+			if config.MaxKeys != nil {
+				if *config.MaxKeys < 1 {
+					return nil, fmt.Errorf("ErrorBudgetBurn `max_keys` must be positive")
+				}
+				b.MaxKeys = *config.MaxKeys
+			}
+			if config.Annotation != "" {
+				b.Annotation = config.Annotation
+			}
+			b.Clock = clock
+			return b, nil
+		})
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestErrorBudgetBurn(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	b, err := core.NewErrorBudgetBurn("host", 0.75, []time.Duration{time.Minute, time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Clock = clock
+	start := clock.CurrentTime
+
+	report := func(url, typ string) collector.NelReport {
+		return collector.NelReport{ReportType: "network-error", URL: url, Type: typ}
+	}
+	// Each report's burn rates over the last minute and hour.  The SLO allows
+	// a quarter of requests to fail.
+	cases := []struct {
+		offset  time.Duration
+		reports []collector.NelReport
+		want    [][]interface{}
+	}{
+		{
+			0,
+			[]collector.NelReport{
+				report("https://a.example/", "ok"),
+				report("https://a.example/x", "tcp.reset"),
+				report("https://b.example/", "ok"),
+				{ReportType: "csp-violation", URL: "https://a.example/"},
+			},
+			[][]interface{}{{2.0, 2.0}, {2.0, 2.0}, {0.0, 0.0}, {nil, nil}},
+		},
+		// The first batch has left the shorter window, but not the longer one.
+		{
+			2 * time.Minute,
+			[]collector.NelReport{report("https://a.example/", "ok"), report("https://a.example/", "ok")},
+			[][]interface{}{{0.0, 1.0}, {0.0, 1.0}},
+		},
+	}
+	for _, c := range cases {
+		clock.CurrentTime = start.Add(c.offset)
+		batch := &collector.ReportBatch{Reports: c.reports}
+		b.ProcessReports(context.Background(), batch)
+		var got [][]interface{}
+		for _, report := range batch.Reports {
+			got = append(got, []interface{}{report.GetAnnotation("ErrorBudgetBurn_1m"), report.GetAnnotation("ErrorBudgetBurn_1h")})
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("At %v, ErrorBudgetBurn diff (-want +got):\n%s", c.offset, diff)
+		}
+	}
+}
+
+func TestErrorBudgetBurnConfig(t *testing.T) {
+	config := `
+[[processor]]
+type = "ErrorBudgetBurn"
+target = 0.5
+windows = ["30m", "1h30m"]
+annotation = "Burn"
+`
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{
+		{ReportType: "network-error", URL: "https://a.example/", Type: "dns.name_not_resolved"},
+		{ReportType: "network-error", URL: "https://a.example/", Type: "ok"},
+		{ReportType: "network-error", URL: "https://a.example/", Type: "ok"},
+		{ReportType: "network-error", URL: "https://a.example/", Type: "ok"},
+	}}
+	pipeline.ProcessBatch(context.Background(), batch)
+	for _, name := range []string{"Burn_30m", "Burn_1h30m"} {
+		if got := batch.Reports[0].GetAnnotation(name); got != 0.5 {
+			t.Errorf("ErrorBudgetBurn %s = %v, wanted 0.5", name, got)
+		}
+	}
+}
+
+func TestErrorBudgetBurnBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`target = 1.0`,
+		`target = 0.0`,
+		"target = 0.99\nwindows = []",
+		"target = 0.99\nwindows = [\"soon\"]",
+		"target = 0.99\nwindows = [\"-5m\"]",
+		"target = 0.99\nwindows = [\"60m\", \"1h\"]",
+		"target = 0.99\nfield = \"nonexistent\"",
+		"target = 0.99\nmax_keys = 0",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"ErrorBudgetBurn\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// errorRateBuckets is the number of buckets that each URL's window is divided
+// into.  Reports leave the window a bucket at a time, so the window really
+// covers between 9/10 and all of AttachErrorRate.Window.
+const errorRateBuckets = 10
+
+// errorRateWindow counts the reports and failures for a URL in each bucket of
+// its window.  Bucket i holds the counts for the bucket numbered index[i]
+// since the epoch; any that are older than the window are stale.
+type errorRateWindow struct {
+	index    [errorRateBuckets]int64
+	reports  [errorRateBuckets]int
+	failures [errorRateBuckets]int
+}
+
+// add counts some reports in the given bucket, and returns the error rate over
+// the window ending with it.
+func (w *errorRateWindow) add(bucket int64, reports, failures int) float64 {
+	i := bucket % errorRateBuckets
+	if w.index[i] != bucket {
+		w.index[i] = bucket
+		w.reports[i] = 0
+		w.failures[i] = 0
+	}
+	w.reports[i] += reports
+	w.failures[i] += failures
+	return w.rate(bucket)
+}
+
+// rate returns the error rate over the window ending with the given bucket.
+func (w *errorRateWindow) rate(bucket int64) float64 {
+	var totalReports, totalFailures int
+	for i := range w.index {
+		if w.index[i] > bucket-errorRateBuckets && w.index[i] <= bucket {
+			totalReports += w.reports[i]
+			totalFailures += w.failures[i]
+		}
+	}
+	if totalReports == 0 {
+		return 0
+	}
+	return float64(totalFailures) / float64(totalReports)
+}
+
+// AttachErrorRate is a pipeline processor that annotates each `network-error`
+// report with the fraction of the recent reports for its URL (including the
+// report itself) that were failures, so that alerts can be written against a
+// single stream of reports.  The rate is a float64 between 0 and 1, in the
+// ErrorRate annotation.  Recent means within the last Window, which we measure
+// in tenths of Window.
+//
+// We track at most MaxURLs URLs at a time.  When a new URL arrives and we're
+// already tracking that many, we forget about the URL that we've heard from
+// least recently, and if it comes back we start counting it from scratch.  So
+// if there are many more URLs than MaxURLs, the rates for the rare ones are
+// only based on the last few reports about them (perhaps only the current
+// batch), while the common ones aren't affected.
+type AttachErrorRate struct {
+	Window  time.Duration
+	MaxURLs int
+
+	// Clock is used to decide which reports are recent.  If nil, we use the
+	// current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	windows *ttlCache
+}
+
+// NewAttachErrorRate creates a new AttachErrorRate processor, which calculates
+// error rates over the given window.
+func NewAttachErrorRate(window time.Duration) *AttachErrorRate {
+	return &AttachErrorRate{Window: window, MaxURLs: 10000}
+}
+
+func (a *AttachErrorRate) now() time.Time {
+	if a.Clock == nil {
+		return time.Now()
+	}
+	return a.Clock.Now()
+}
+
+// window returns the window for a URL, creating it if needed.  a.mu must be
+// held.
+func (a *AttachErrorRate) window(url string, now time.Time) *errorRateWindow {
+	if a.windows == nil {
+		a.windows = newTTLCache(a.MaxURLs, 0)
+	}
+	if window, ok := a.windows.get(url, now); ok {
+		return window.(*errorRateWindow)
+	}
+	window := &errorRateWindow{}
+	a.windows.add(url, window, now)
+	return window
+}
+
+// ProcessReports updates the counts for each URL in the batch, and annotates
+// the batch's reports with the resulting error rates.
+func (a *AttachErrorRate) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	reports := make(map[string]int)
+	failures := make(map[string]int)
+	var urls []string
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" {
+			continue
+		}
+		if reports[report.URL] == 0 {
+			urls = append(urls, report.URL)
+		}
+		reports[report.URL]++
+		if isFailure(report) {
+			failures[report.URL]++
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	now := a.now()
+	bucketWidth := a.Window / errorRateBuckets
+	if bucketWidth <= 0 {
+		bucketWidth = 1
+	}
+	bucket := now.UnixNano() / int64(bucketWidth)
+	rates := make(map[string]float64, len(urls))
+	a.mu.Lock()
+	for _, url := range urls {
+		rates[url] = a.window(url, now).add(bucket, reports[url], failures[url])
+	}
+	a.mu.Unlock()
+
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType == "network-error" {
+			report.SetAnnotation("ErrorRate", rates[report.URL])
+		}
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"AttachErrorRate",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Window  string `toml:"window"`
+				MaxURLs *int   `toml:"max_urls"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			window := 5 * time.Minute
+			if config.Window != "" {
+				window, err = time.ParseDuration(config.Window)
+				if err != nil {
+					return nil, fmt.Errorf("AttachErrorRate invalid `window`: %v", err)
+				}
+				if window <= 0 {
+					return nil, fmt.Errorf("AttachErrorRate `window` must be positive")
+				}
+			}
+
+			a := NewAttachErrorRate(window)
+			if config.MaxURLs != nil {
+				if *config.MaxURLs < 1 {
+					return nil, fmt.Errorf("AttachErrorRate `max_urls` must be positive")
+				}
+				a.MaxURLs = *config.MaxURLs
+			}
+			a.Clock = clock
+			return a, nil
+		})
+}
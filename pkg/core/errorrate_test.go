@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// errorRates processes a batch of reports with the given URLs and types, and
+// returns the ErrorRate annotation of each one.
+func errorRates(a *core.AttachErrorRate, reports ...string) []interface{} {
+	batch := &collector.ReportBatch{}
+	for i := 0; i < len(reports); i += 2 {
+		batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", URL: reports[i], Type: reports[i+1]})
+	}
+	a.ProcessReports(context.Background(), batch)
+	var result []interface{}
+	for _, report := range batch.Reports {
+		result = append(result, report.GetAnnotation("ErrorRate"))
+	}
+	return result
+}
+
+func TestAttachErrorRate(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	a := core.NewAttachErrorRate(time.Minute)
+	a.Clock = clock
+	start := clock.CurrentTime
+
+	cases := []struct {
+		offset  time.Duration
+		reports []string
+		want    []interface{}
+	}{
+		{0, []string{"https://a.example/", "ok", "https://a.example/", "tcp.reset", "https://b.example/", "tcp.reset"}, []interface{}{0.5, 0.5, 1.0}},
+		{30 * time.Second, []string{"https://a.example/", "ok", "https://a.example/", "ok"}, []interface{}{0.25, 0.25}},
+		// The first batch has left the window.
+		{61 * time.Second, []string{"https://a.example/", "ok", "https://b.example/", "ok"}, []interface{}{0.0, 0.0}},
+	}
+	for _, c := range cases {
+		clock.CurrentTime = start.Add(c.offset)
+		if diff := cmp.Diff(c.want, errorRates(a, c.reports...)); diff != "" {
+			t.Errorf("AttachErrorRate at %v diff (-want +got):\n%s", c.offset, diff)
+		}
+	}
+}
+
+func TestAttachErrorRateEviction(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	a := core.NewAttachErrorRate(time.Minute)
+	a.Clock = clock
+	a.MaxURLs = 1
+
+	errorRates(a, "https://a.example/", "tcp.reset")
+	errorRates(a, "https://b.example/", "ok")
+	// a.example has been forgotten, so its earlier failure doesn't count.
+	if diff := cmp.Diff([]interface{}{0.0}, errorRates(a, "https://a.example/", "ok")); diff != "" {
+		t.Errorf("AttachErrorRate after eviction diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAttachErrorRateIgnoresOtherReports(t *testing.T) {
+	a := core.NewAttachErrorRate(time.Minute)
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{
+		{ReportType: "csp-violation", URL: "https://a.example/"},
+	}}
+	a.ProcessReports(context.Background(), batch)
+	if got := batch.Reports[0].GetAnnotation("ErrorRate"); got != nil {
+		t.Errorf("AttachErrorRate annotated a csp-violation report with %v", got)
+	}
+}
+
+func TestAttachErrorRateBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`window = "soon"`,
+		`window = "-1m"`,
+		`max_urls = 0`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"AttachErrorRate\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
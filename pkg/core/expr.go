@@ -0,0 +1,401 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// A condition is a compiled boolean expression that can be evaluated against
+// a report; see parseCondition for the syntax.
+type condition interface {
+	eval(batch *collector.ReportBatch, report *collector.NelReport) interface{}
+}
+
+// reportFields maps the names that conditions can use for each report field to
+// a function that extracts it.  Numbers are always float64s.
+var reportFields = map[string]func(report *collector.NelReport) interface{}{
+	"age":               func(r *collector.NelReport) interface{} { return float64(r.Age) },
+	"report_type":       func(r *collector.NelReport) interface{} { return r.ReportType },
+	"url":               func(r *collector.NelReport) interface{} { return r.URL },
+	"user_agent":        func(r *collector.NelReport) interface{} { return r.UserAgent },
+	"referrer":          func(r *collector.NelReport) interface{} { return r.Referrer },
+	"sampling_fraction": func(r *collector.NelReport) interface{} { return float64(r.SamplingFraction) },
+	"server_ip":         func(r *collector.NelReport) interface{} { return r.ServerIP },
+	"protocol":          func(r *collector.NelReport) interface{} { return r.Protocol },
+	"method":            func(r *collector.NelReport) interface{} { return r.Method },
+	"status_code":       func(r *collector.NelReport) interface{} { return float64(r.StatusCode) },
+	"elapsed_time":      func(r *collector.NelReport) interface{} { return float64(r.ElapsedTime) },
+	"phase":             func(r *collector.NelReport) interface{} { return r.Phase },
+	"type":              func(r *collector.NelReport) interface{} { return r.Type },
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (l literal) eval(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	return l.value
+}
+
+type fieldRef struct {
+	get func(report *collector.NelReport) interface{}
+}
+
+func (f fieldRef) eval(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	return f.get(report)
+}
+
+// annotationRef looks up an annotation of the report, falling back on the
+// batch's annotation of the same name.
+type annotationRef struct {
+	name string
+}
+
+func (a annotationRef) eval(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	value := report.GetAnnotation(a.name)
+	if value == nil {
+		value = batch.GetAnnotation(a.name)
+	}
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+type notExpr struct {
+	operand condition
+}
+
+func (n notExpr) eval(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	return !truthy(n.operand.eval(batch, report))
+}
+
+type logicalExpr struct {
+	and         bool
+	left, right condition
+}
+
+func (l logicalExpr) eval(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	if truthy(l.left.eval(batch, report)) != l.and {
+		return !l.and
+	}
+	return truthy(l.right.eval(batch, report))
+}
+
+type comparison struct {
+	op          string
+	left, right condition
+}
+
+func (c comparison) eval(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	left := c.left.eval(batch, report)
+	right := c.right.eval(batch, report)
+	switch c.op {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	}
+	// Ordering comparisons are only defined between two numbers or two
+	// strings; anything else is false.
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		if l < r {
+			cmp = -1
+		} else if l > r {
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return false
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// truthy returns whether a value counts as true when it's used as a
+// condition: true, any non-zero number, and any non-empty string.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return value != nil
+	}
+}
+
+type token struct {
+	kind  string // "ident", "number", "string", "op", or "eof"
+	text  string
+	value interface{}
+	pos   int
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(input) && (input[i] == '_' || input[i] == '.' || unicode.IsLetter(rune(input[i])) || unicode.IsDigit(rune(input[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: "ident", text: input[start:i], pos: start})
+		case unicode.IsDigit(rune(c)) || (c == '-' && i+1 < len(input) && unicode.IsDigit(rune(input[i+1]))):
+			start := i
+			i++
+			for i < len(input) && (input[i] == '.' || unicode.IsDigit(rune(input[i]))) {
+				i++
+			}
+			value, err := strconv.ParseFloat(input[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at position %d", input[start:i], start)
+			}
+			tokens = append(tokens, token{kind: "number", text: input[start:i], value: value, pos: start})
+		case c == '\'' || c == '"':
+			start := i
+			var value strings.Builder
+			for i++; ; i++ {
+				if i >= len(input) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if input[i] == c {
+					i++
+					break
+				}
+				if input[i] == '\\' && i+1 < len(input) {
+					i++
+				}
+				value.WriteByte(input[i])
+			}
+			tokens = append(tokens, token{kind: "string", text: input[start:i], value: value.String(), pos: start})
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(input[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %c at position %d", c, i)
+			}
+			tokens = append(tokens, token{kind: "op", text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: "eof", pos: len(input)}), nil
+}
+
+type conditionParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *conditionParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it's one of the given operators or
+// keywords.
+func (p *conditionParser) accept(texts ...string) bool {
+	t := p.peek()
+	if t.kind != "op" && t.kind != "ident" {
+		return false
+	}
+	for _, text := range texts {
+		if t.text == text {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *conditionParser) unexpected(t token) error {
+	if t.kind == "eof" {
+		return fmt.Errorf("unexpected end of condition")
+	}
+	return fmt.Errorf("unexpected %s at position %d", t.text, t.pos)
+}
+
+func (p *conditionParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and", "&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseNot() (condition, error) {
+	if p.accept("not", "!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (condition, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == "op" {
+		switch t.text {
+		case "==", "!=", "<", "<=", ">", ">=":
+			p.next()
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return comparison{op: t.text, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseOperand() (condition, error) {
+	t := p.next()
+	switch t.kind {
+	case "number", "string":
+		return literal{t.value}, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		case "and", "or", "not":
+			return nil, p.unexpected(t)
+		}
+		name := strings.TrimPrefix(t.text, "report.")
+		if strings.HasPrefix(name, "annotations.") {
+			annotation := strings.TrimPrefix(name, "annotations.")
+			if annotation == "" {
+				return nil, fmt.Errorf("missing annotation name at position %d", t.pos)
+			}
+			return annotationRef{annotation}, nil
+		}
+		get, ok := reportFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s at position %d", t.text, t.pos)
+		}
+		return fieldRef{get}, nil
+	case "op":
+		if t.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, p.unexpected(p.peek())
+			}
+			return inner, nil
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+// parseCondition compiles a condition.  See NewWhere for the syntax.
+func parseCondition(input string) (condition, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{tokens: tokens}
+	if p.peek().kind == "eof" {
+		return nil, fmt.Errorf("empty condition")
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, p.unexpected(t)
+	}
+	return c, nil
+}
@@ -16,6 +16,11 @@ package core
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
 
 	"github.com/BurntSushi/toml"
 	"github.com/google/nel-collector/pkg/collector"
@@ -35,10 +40,284 @@ func (KeepNelReports) ProcessReports(ctx context.Context, batch *collector.Repor
 	batch.Reports = filtered
 }
 
+// FilterByReportType is a pipeline processor that keeps or drops reports based
+// on their report type.  In "keep" mode, we only keep reports whose type is one
+// of Types; in "drop" mode, we throw those reports away and keep everything
+// else.
+type FilterByReportType struct {
+	Types map[string]bool
+	Drop  bool
+}
+
+// ProcessReports throws away any reports that don't pass the filter.
+func (f FilterByReportType) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var filtered []collector.NelReport
+	for _, report := range batch.Reports {
+		if f.Types[report.ReportType] != f.Drop {
+			filtered = append(filtered, report)
+		}
+	}
+	batch.Reports = filtered
+}
+
+// DefaultPrivateServerIPRanges are the CIDR ranges that FilterServerIP looks
+// for by default: the RFC 1918 private ranges, loopback, link-local, and IPv6
+// unique local addresses.
+var DefaultPrivateServerIPRanges = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+}
+
+// FilterServerIP is a pipeline processor that looks for reports whose
+// server_ip is in one of a set of CIDR ranges (by default, the private and
+// loopback ranges in DefaultPrivateServerIPRanges).  Reports like that are
+// almost always bogus or test traffic.  If Annotation is empty, we drop those
+// reports; otherwise we keep every report, and set the named annotation to
+// true or false depending on whether the report's server_ip matched.
+//
+// Reports with a missing or unparseable server_ip never match.
+type FilterServerIP struct {
+	Ranges     []*net.IPNet
+	Annotation string
+}
+
+// parseServerIP parses the server_ip field of a report, which might be
+// surrounded by whitespace or (for IPv6 addresses) brackets.  Returns nil if
+// the field is empty or isn't a valid IP address.
+func parseServerIP(serverIP string) net.IP {
+	serverIP = strings.TrimSpace(serverIP)
+	serverIP = strings.TrimPrefix(serverIP, "[")
+	serverIP = strings.TrimSuffix(serverIP, "]")
+	return net.ParseIP(serverIP)
+}
+
+func (f FilterServerIP) matches(report *collector.NelReport) bool {
+	ip := parseServerIP(report.ServerIP)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range f.Ranges {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessReports drops or annotates any reports whose server_ip matches.
+func (f FilterServerIP) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if f.Annotation != "" {
+		for i := range batch.Reports {
+			batch.Reports[i].SetAnnotation(f.Annotation, f.matches(&batch.Reports[i]))
+		}
+		return
+	}
+
+	var filtered []collector.NelReport
+	for i := range batch.Reports {
+		if !f.matches(&batch.Reports[i]) {
+			filtered = append(filtered, batch.Reports[i])
+		}
+	}
+	batch.Reports = filtered
+}
+
+// DefaultBotUserAgents are the patterns that FilterUserAgent looks for by
+// default: common crawlers, uptime monitors, and HTTP client libraries.
+var DefaultBotUserAgents = []string{
+	`(?i)bot\b`,
+	`(?i)crawl`,
+	`(?i)spider`,
+	`(?i)slurp`,
+	`(?i)headlesschrome`,
+	`(?i)lighthouse`,
+	`(?i)pingdom`,
+	`(?i)uptimerobot`,
+	`(?i)statuscake`,
+	`(?i)site24x7`,
+	`(?i)^curl/`,
+	`(?i)^wget/`,
+	`(?i)^python-`,
+	`(?i)^go-http-client/`,
+	`(?i)^java/`,
+	`(?i)^okhttp/`,
+}
+
+// FilterUserAgent is a pipeline processor that keeps or drops reports based on
+// the User-Agent of the client that uploaded them (see clientUserAgent).  A
+// report matches if its User-Agent matches any of Patterns.  In "drop" mode
+// (the default) we throw matching reports away; in "keep" mode we only keep
+// matching reports.  Reports without a User-Agent never match.
+//
+// FilterUserAgent counts the reports that it drops; see Dropped.
+type FilterUserAgent struct {
+	Patterns []*regexp.Regexp
+	Keep     bool
+
+	dropped int64
+}
+
+// Dropped returns the number of reports that the filter has thrown away.
+func (f *FilterUserAgent) Dropped() int64 {
+	return atomic.LoadInt64(&f.dropped)
+}
+
+func (f *FilterUserAgent) matches(ua string) bool {
+	if ua == "" {
+		return false
+	}
+	for _, pattern := range f.Patterns {
+		if pattern.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessReports throws away any reports that don't pass the filter.
+func (f *FilterUserAgent) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var filtered []collector.NelReport
+	for i := range batch.Reports {
+		if f.matches(clientUserAgent(batch, &batch.Reports[i])) == f.Keep {
+			filtered = append(filtered, batch.Reports[i])
+		}
+	}
+	atomic.AddInt64(&f.dropped, int64(len(batch.Reports)-len(filtered)))
+	batch.Reports = filtered
+}
+
+// ParseCIDRs parses a list of CIDR ranges, such as "10.0.0.0/8" or "fe80::/10".
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
 func init() {
-	collector.RegisterReportLoaderFunc(
+	collector.RegisterContextReportLoaderFunc(
 		"KeepNelReports",
-		func(configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct{}
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
 			return KeepNelReports{}, nil
 		})
+	collector.RegisterContextReportLoaderFunc(
+		"FilterByReportType",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Types []string `toml:"types"`
+				Mode  string   `toml:"mode"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Types) == 0 {
+				return nil, fmt.Errorf("FilterByReportType missing `types`")
+			}
+
+			f := FilterByReportType{Types: make(map[string]bool)}
+			for _, reportType := range config.Types {
+				f.Types[reportType] = true
+			}
+			if config.Mode == "" || config.Mode == "keep" {
+				f.Drop = false
+			} else if config.Mode == "drop" {
+				f.Drop = true
+			} else {
+				return nil, fmt.Errorf("FilterByReportType invalid `mode`: %s", config.Mode)
+			}
+			return f, nil
+		})
+	collector.RegisterContextReportLoaderFunc(
+		"FilterServerIP",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Ranges     []string `toml:"ranges"`
+				Mode       string   `toml:"mode"`
+				Annotation string   `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Ranges == nil {
+				config.Ranges = DefaultPrivateServerIPRanges
+			}
+
+			var f FilterServerIP
+			f.Ranges, err = ParseCIDRs(config.Ranges)
+			if err != nil {
+				return nil, fmt.Errorf("FilterServerIP invalid `ranges`: %v", err)
+			}
+			if config.Mode == "" || config.Mode == "drop" {
+				if config.Annotation != "" {
+					return nil, fmt.Errorf("FilterServerIP only uses `annotation` in annotate mode")
+				}
+			} else if config.Mode == "annotate" {
+				f.Annotation = config.Annotation
+				if f.Annotation == "" {
+					f.Annotation = "PrivateServerIP"
+				}
+			} else {
+				return nil, fmt.Errorf("FilterServerIP invalid `mode`: %s", config.Mode)
+			}
+			return f, nil
+		})
+	collector.RegisterContextReportLoaderFunc(
+		"FilterUserAgent",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Patterns []string `toml:"patterns"`
+				Mode     string   `toml:"mode"`
+				Builtin  *bool    `toml:"builtin"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			patterns := config.Patterns
+			if config.Builtin == nil || *config.Builtin {
+				patterns = append(patterns, DefaultBotUserAgents...)
+			}
+			if len(patterns) == 0 {
+				return nil, fmt.Errorf("FilterUserAgent missing `patterns`")
+			}
+
+			f := &FilterUserAgent{}
+			for _, pattern := range patterns {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("FilterUserAgent invalid `patterns`: %v", err)
+				}
+				f.Patterns = append(f.Patterns, re)
+			}
+			if config.Mode == "" || config.Mode == "drop" {
+				f.Keep = false
+			} else if config.Mode == "keep" {
+				f.Keep = true
+			} else {
+				return nil, fmt.Errorf("FilterUserAgent invalid `mode`: %s", config.Mode)
+			}
+			return f, nil
+		})
 }
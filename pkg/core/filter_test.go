@@ -15,9 +15,12 @@
 package core_test
 
 import (
+	"context"
+	"regexp"
 	"testing"
 
-	_ "github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
 	"github.com/google/nel-collector/pkg/pipelinetest"
 )
 
@@ -37,3 +40,152 @@ func TestKeepNelReports(t *testing.T) {
 	}
 	p.Run(t)
 }
+
+func TestFilterByReportType(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestFilterByReportType",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "FilterByReportType"
+			types = ["network-error", "csp-violation"]
+			mode = "drop"
+			[[processor]]
+			type = "EncodeBatchAsResult"
+		`),
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+func TestFilterByReportTypeKeep(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestFilterByReportTypeKeep",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "FilterByReportType"
+			types = ["another-error"]
+			mode = "keep"
+			[[processor]]
+			type = "EncodeBatchAsResult"
+		`),
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+func TestFilterServerIP(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestFilterServerIP",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "FilterServerIP"
+			ranges = ["203.0.113.75/32"]
+			mode = "annotate"
+			annotation = "TestServer"
+			[[processor]]
+			type = "EncodeBatchAsResult"
+		`),
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+func TestFilterServerIPDefaultRanges(t *testing.T) {
+	ranges, err := core.ParseCIDRs(core.DefaultPrivateServerIPRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		serverIP string
+		private  bool
+	}{
+		{"203.0.113.75", false},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{" 192.168.1.1 ", true},
+		{"::ffff:10.1.2.3", true},
+		{"::1", true},
+		{"[::1]", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"2001:db8::1", false},
+		{"", false},
+		{"not-an-ip", false},
+	}
+	for _, c := range cases {
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{{ServerIP: c.serverIP}}}
+		core.FilterServerIP{Ranges: ranges}.ProcessReports(context.Background(), batch)
+		if got := len(batch.Reports) == 0; got != c.private {
+			t.Errorf("FilterServerIP(%q) dropped = %v, wanted %v", c.serverIP, got, c.private)
+		}
+	}
+}
+
+func TestFilterUserAgent(t *testing.T) {
+	f := &core.FilterUserAgent{}
+	for _, pattern := range core.DefaultBotUserAgents {
+		f.Patterns = append(f.Patterns, regexp.MustCompile(pattern))
+	}
+	cases := []struct {
+		ua  string
+		bot bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", false},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36", true},
+		{"Pingdom.com_bot_version_1.4_(http://www.pingdom.com/)", true},
+		{"curl/7.64.1", true},
+		{"python-requests/2.31.0", true},
+		{"", false},
+	}
+	for _, c := range cases {
+		batch := &collector.ReportBatch{ClientUserAgent: c.ua, Reports: []collector.NelReport{{}}}
+		f.ProcessReports(context.Background(), batch)
+		if got := len(batch.Reports) == 0; got != c.bot {
+			t.Errorf("FilterUserAgent(%q) dropped = %v, wanted %v", c.ua, got, c.bot)
+		}
+	}
+	if got, want := f.Dropped(), int64(6); got != want {
+		t.Errorf("Dropped() = %d, wanted %d", got, want)
+	}
+
+	// A per-report ClientUserAgent annotation (from coalescing) takes
+	// precedence over the batch's.
+	batch := &collector.ReportBatch{ClientUserAgent: "curl/7.64.1", Reports: []collector.NelReport{{}, {}}}
+	batch.Reports[0].SetAnnotation("ClientUserAgent", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+	f.ProcessReports(context.Background(), batch)
+	if got, want := len(batch.Reports), 1; got != want {
+		t.Errorf("FilterUserAgent kept %d reports, wanted %d", got, want)
+	}
+}
+
+func TestFilterUserAgentConfig(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "FilterUserAgent"
+		patterns = ["^Internal-Probe/"]
+		builtin = false
+		mode = "keep"
+	`, &collector.ReportBatch{Reports: []collector.NelReport{
+		{UserAgent: "Internal-Probe/1.0"},
+		{UserAgent: "curl/7.64.1"},
+		{},
+	}})
+	if got, want := len(batch.Reports), 1; got != want || batch.Reports[0].UserAgent != "Internal-Probe/1.0" {
+		t.Errorf("FilterUserAgent kept %v, wanted only the Internal-Probe report", batch.Reports)
+	}
+}
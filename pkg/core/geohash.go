@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// maxGeohashPrecision is the longest geohash that GeohashClient will produce.
+// A 5-character geohash is a cell about 5km across, which is enough to put a
+// client in a city but not on a street.
+const maxGeohashPrecision = 5
+
+// geohash encodes a location as a geohash with the given number of characters.
+func geohash(latitude, longitude float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	longRange := [2]float64{-180, 180}
+	result := make([]byte, 0, precision)
+	even := true
+	bits, ch := 0, 0
+	for len(result) < precision {
+		r, value := &latRange, latitude
+		if even {
+			r, value = &longRange, longitude
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if value >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bits++; bits == 5 {
+			result = append(result, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(result)
+}
+
+// toFloat converts a numeric annotation value to a float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// GeohashClient is a pipeline processor that replaces the precise location of
+// each report's client with a coarse geohash, which is good enough for a
+// heatmap but doesn't identify individual clients.  It must run after a
+// processor that sets the client's latitude and longitude as annotations
+// (Latitude and Longitude by default) on each report or on the batch.  Those
+// annotations are removed, and the geohash is stored in another annotation
+// (ClientGeohash by default).  Reports whose location is missing or invalid
+// don't get a geohash annotation.
+type GeohashClient struct {
+	// The number of characters in each geohash; at most 5.
+	Precision int
+
+	LatitudeAnnotation  string
+	LongitudeAnnotation string
+	Annotation          string
+}
+
+// NewGeohashClient creates a new GeohashClient processor that uses the default
+// annotation names.
+func NewGeohashClient(precision int) *GeohashClient {
+	return &GeohashClient{
+		Precision:           precision,
+		LatitudeAnnotation:  "Latitude",
+		LongitudeAnnotation: "Longitude",
+		Annotation:          "ClientGeohash",
+	}
+}
+
+// location returns the client location of a report, preferring the report's
+// own annotations to its batch's.
+func (g *GeohashClient) location(batch *collector.ReportBatch, report *collector.NelReport) (float64, float64, bool) {
+	latitude := report.GetAnnotation(g.LatitudeAnnotation)
+	longitude := report.GetAnnotation(g.LongitudeAnnotation)
+	if latitude == nil && longitude == nil {
+		latitude = batch.GetAnnotation(g.LatitudeAnnotation)
+		longitude = batch.GetAnnotation(g.LongitudeAnnotation)
+	}
+	lat, latOK := toFloat(latitude)
+	long, longOK := toFloat(longitude)
+	if !latOK || !longOK || lat < -90 || lat > 90 || long < -180 || long > 180 {
+		return 0, 0, false
+	}
+	return lat, long, true
+}
+
+// ProcessReports annotates each report with the geohash of its client's
+// location, and removes the precise location.
+func (g *GeohashClient) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if lat, long, ok := g.location(batch, report); ok {
+			report.SetAnnotation(g.Annotation, geohash(lat, long, g.Precision))
+		}
+		report.DeleteAnnotation(g.LatitudeAnnotation)
+		report.DeleteAnnotation(g.LongitudeAnnotation)
+	}
+	batch.DeleteAnnotation(g.LatitudeAnnotation)
+	batch.DeleteAnnotation(g.LongitudeAnnotation)
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"GeohashClient",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Precision           int    `toml:"precision"`
+				LatitudeAnnotation  string `toml:"latitude_annotation"`
+				LongitudeAnnotation string `toml:"longitude_annotation"`
+				Annotation          string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Precision == 0 {
+				config.Precision = 4
+			}
+			if config.Precision < 1 || config.Precision > maxGeohashPrecision {
+				return nil, fmt.Errorf("GeohashClient `precision` must be between 1 and %d", maxGeohashPrecision)
+			}
+
+			g := NewGeohashClient(config.Precision)
+			if config.LatitudeAnnotation != "" {
+				g.LatitudeAnnotation = config.LatitudeAnnotation
+			}
+			if config.LongitudeAnnotation != "" {
+				g.LongitudeAnnotation = config.LongitudeAnnotation
+			}
+			if config.Annotation != "" {
+				g.Annotation = config.Annotation
+			}
+			return g, nil
+		})
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestGeohashClient(t *testing.T) {
+	batch := &collector.ReportBatch{
+		Reports: []collector.NelReport{{}, {}, {}, {}},
+	}
+	// Batch-level location, which applies to reports without their own.
+	batch.SetAnnotation("Latitude", 57.64911)
+	batch.SetAnnotation("Longitude", 10.40744)
+	// The Googleplex.
+	batch.Reports[1].SetAnnotation("Latitude", 37.422)
+	batch.Reports[1].SetAnnotation("Longitude", -122.084)
+	// Unknown and invalid locations.
+	batch.Reports[2].SetAnnotation("Latitude", "unknown")
+	batch.Reports[2].SetAnnotation("Longitude", "unknown")
+	batch.Reports[3].SetAnnotation("Latitude", 91.0)
+	batch.Reports[3].SetAnnotation("Longitude", 0)
+
+	pipelinetest.RunProcessor(core.NewGeohashClient(5), batch)
+
+	want := []map[string]interface{}{
+		{"ClientGeohash": "u4pru"},
+		{"ClientGeohash": "9q9hv"},
+		{},
+		{},
+	}
+	var got []map[string]interface{}
+	for _, report := range batch.Reports {
+		annotations := report.Annotations.Annotations
+		if annotations == nil {
+			annotations = map[string]interface{}{}
+		}
+		got = append(got, annotations)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GeohashClient got diff (-want +got):\n%s", diff)
+	}
+	if len(batch.Annotations.Annotations) != 0 {
+		t.Errorf("GeohashClient left batch annotations %v", batch.Annotations.Annotations)
+	}
+}
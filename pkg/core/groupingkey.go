@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// DefaultGroupingFields are the fields that GroupingKey uses, unless you
+// choose different ones.
+var DefaultGroupingFields = []string{"host", "phase", "type", "status_class"}
+
+// groupingField returns the function that extracts the normalized value of a
+// field for GroupingKey, or nil if there's no such field.
+func groupingField(name string) func(report *collector.NelReport) string {
+	switch name {
+	case "host":
+		return func(report *collector.NelReport) string {
+			origin, _ := parseOrigin(report.URL)
+			return origin.Host
+		}
+	case "status_class":
+		return func(report *collector.NelReport) string {
+			if report.StatusCode == 0 {
+				return ""
+			}
+			return fmt.Sprintf("%dxx", report.StatusCode/100)
+		}
+	}
+	get, ok := reportFields[name]
+	if !ok {
+		return nil
+	}
+	return func(report *collector.NelReport) string {
+		value, _ := routeValue(get(report))
+		return value
+	}
+}
+
+// GroupingKey is a pipeline processor that labels each report with a
+// fingerprint of the kind of error that it describes, so that a downstream
+// store can count "the same error" together even when it happened on many
+// different URLs.  Unlike CollapseDuplicates, it doesn't remove anything.  The
+// fingerprint goes in an annotation (GroupingKey by default).
+//
+// The fingerprint only depends on Fields, which default to
+// DefaultGroupingFields.  Each field's value is normalized as follows:
+//
+//   - `host` is the host of the report's URL, lowercased, with
+//     internationalized labels in their punycode form, and without the port.
+//     It's empty if the URL isn't an HTTP(S) URL.
+//   - `status_class` is the first digit of the status code followed by "xx"
+//     (such as "5xx"), or empty if there's no status code.
+//   - Any of the fields that Where's conditions can use are taken as they
+//     are, with numbers formatted in the shortest decimal form that
+//     represents them exactly (so a status_code of 503 is "503").
+//
+// We sort the fields by name, write a line containing name=value for each
+// one, with the value quoted and escaped as a Go string literal (for
+// instance, `type="tcp.timed_out"`), and the fingerprint is the first 16 hex
+// digits of the SHA-256 hash of those lines, each ending with a newline.  The
+// order of Fields doesn't matter, but adding or removing a field changes
+// every fingerprint.
+type GroupingKey struct {
+	Annotation string
+	Fields     []string
+
+	getters map[string]func(report *collector.NelReport) string
+}
+
+// NewGroupingKey creates a new GroupingKey processor that uses the given
+// fields, returning an error if any of them is unknown.
+func NewGroupingKey(fields []string) (*GroupingKey, error) {
+	sorted := append([]string(nil), fields...)
+	sort.Strings(sorted)
+	getters := make(map[string]func(report *collector.NelReport) string, len(fields))
+	for _, name := range sorted {
+		get := groupingField(name)
+		if get == nil {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		getters[name] = get
+	}
+	return &GroupingKey{Annotation: "GroupingKey", Fields: sorted, getters: getters}, nil
+}
+
+// fingerprint returns the fingerprint of a report.
+func (g *GroupingKey) fingerprint(report *collector.NelReport) string {
+	var lines strings.Builder
+	for _, name := range g.Fields {
+		fmt.Fprintf(&lines, "%s=%q\n", name, g.getters[name](report))
+	}
+	sum := sha256.Sum256([]byte(lines.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ProcessReports annotates each report in the batch with its fingerprint.
+func (g *GroupingKey) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		report.SetAnnotation(g.Annotation, g.fingerprint(report))
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"GroupingKey",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotation string   `toml:"annotation"`
+				Fields     []string `toml:"fields"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Fields == nil {
+				config.Fields = DefaultGroupingFields
+			}
+			if len(config.Fields) == 0 {
+				return nil, fmt.Errorf("GroupingKey missing `fields`")
+			}
+			seen := make(map[string]bool)
+			for _, name := range config.Fields {
+				if seen[name] {
+					return nil, fmt.Errorf("GroupingKey invalid `fields`: %s appears twice", name)
+				}
+				seen[name] = true
+			}
+
+			g, err := NewGroupingKey(config.Fields)
+			if err != nil {
+				return nil, fmt.Errorf("GroupingKey invalid `fields`: %v", err)
+			}
+			if config.Annotation != "" {
+				g.Annotation = config.Annotation
+			}
+			return g, nil
+		})
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestGroupingKey(t *testing.T) {
+	reports := []collector.NelReport{
+		{URL: "https://Example.com/a?q=1", Phase: "application", Type: "http.error", StatusCode: 503},
+		{URL: "https://example.com:443/b/c", Phase: "application", Type: "http.error", StatusCode: 500},
+		{URL: "https://example.com/a", Phase: "application", Type: "http.error", StatusCode: 404},
+		{URL: "https://other.example/a", Phase: "application", Type: "http.error", StatusCode: 503},
+		{URL: "https://example.com/a", Phase: "connection", Type: "tcp.reset"},
+	}
+	batch := pipelinetest.RunTestConfig("[[processor]]\ntype = \"GroupingKey\"", &collector.ReportBatch{Reports: reports})
+	var keys []string
+	for _, report := range batch.Reports {
+		key, ok := report.GetAnnotation("GroupingKey").(string)
+		if !ok || len(key) != 16 {
+			t.Fatalf("GroupingKey annotation = %v, wanted 16 hex digits", report.GetAnnotation("GroupingKey"))
+		}
+		keys = append(keys, key)
+	}
+	// Only the path, query, port, and case of the host differ.
+	if keys[0] != keys[1] {
+		t.Errorf("Reports for the same error got different keys %s and %s", keys[0], keys[1])
+	}
+	for i := 2; i < len(keys); i++ {
+		if keys[i] == keys[0] {
+			t.Errorf("Report %d got the same key as a different error", i)
+		}
+	}
+	// The fingerprint is documented exactly.
+	sum := sha256.Sum256([]byte("host=\"example.com\"\nphase=\"connection\"\nstatus_class=\"\"\ntype=\"tcp.reset\"\n"))
+	if want := hex.EncodeToString(sum[:8]); keys[4] != want {
+		t.Errorf("GroupingKey = %s, wanted %s", keys[4], want)
+	}
+
+	// The order of the fields doesn't matter.
+	config := "[[processor]]\ntype = \"GroupingKey\"\nannotation = \"Group\"\nfields = [\"type\", \"status_class\", \"phase\", \"host\"]"
+	batch = pipelinetest.RunTestConfig(config, &collector.ReportBatch{Reports: []collector.NelReport{reports[4]}})
+	if got := batch.Reports[0].GetAnnotation("Group"); got != keys[4] {
+		t.Errorf("GroupingKey with reordered fields = %v, wanted %s", got, keys[4])
+	}
+}
+
+func TestGroupingKeyBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`fields = []`,
+		`fields = ["host", "url_path"]`,
+		`fields = ["host", "type", "host"]`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"GroupingKey\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// Heartbeat is a pipeline processor that makes sure that its children (usually
+// a publisher) hear from the collector regularly, even when no reports are
+// arriving, so that a consumer can tell a healthy-but-quiet collector from one
+// that has stopped working.
+//
+// Every batch is passed straight through to the children, just as if they came
+// after the Heartbeat in the pipeline.  Whenever Interval has passed (according
+// to Clock) without the children seeing a batch, we send them a synthetic batch
+// instead, containing a single copy of Report, with a Heartbeat annotation on
+// the batch.
+type Heartbeat struct {
+	Interval time.Duration
+	Report   collector.NelReport
+	Children []collector.ReportProcessor
+
+	// Clock is used to decide when the children have been idle for long
+	// enough.  If nil, we use the current time.
+	Clock collector.Clock
+
+	mu       sync.Mutex
+	lastSeen time.Time
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewHeartbeat creates a new Heartbeat processor, and starts checking whether
+// its children are idle.  (Close stops checking.)  We check in the background
+// a few times per Interval; you can also call Tick to check immediately.
+func NewHeartbeat(interval time.Duration, report collector.NelReport, children []collector.ReportProcessor, clock collector.Clock) *Heartbeat {
+	h := &Heartbeat{
+		Interval: interval,
+		Report:   report,
+		Children: children,
+		Clock:    clock,
+		done:     make(chan struct{}),
+	}
+	h.lastSeen = h.now()
+	h.wg.Add(1)
+	go h.run()
+	return h
+}
+
+func (h *Heartbeat) now() time.Time {
+	if h.Clock == nil {
+		return time.Now()
+	}
+	return h.Clock.Now()
+}
+
+func (h *Heartbeat) run() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.Interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Tick(context.Background())
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Tick sends a heartbeat batch to the children if they haven't seen a batch
+// for at least Interval, and returns whether it did.
+func (h *Heartbeat) Tick(ctx context.Context) bool {
+	now := h.now()
+	h.mu.Lock()
+	if now.Sub(h.lastSeen) < h.Interval {
+		h.mu.Unlock()
+		return false
+	}
+	h.lastSeen = now
+	h.mu.Unlock()
+
+	batch := &collector.ReportBatch{
+		Time:    now,
+		Reports: []collector.NelReport{h.Report},
+	}
+	batch.Reports[0].Annotations = h.Report.CloneAnnotations()
+	batch.SetAnnotation("Heartbeat", true)
+	runChain(ctx, h.Children, batch)
+	return true
+}
+
+// ProcessReports passes the batch through to the children.
+func (h *Heartbeat) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := h.now()
+	h.mu.Lock()
+	if now.After(h.lastSeen) {
+		h.lastSeen = now
+	}
+	h.mu.Unlock()
+	runChain(ctx, h.Children, batch)
+}
+
+// Close stops sending heartbeats, and closes any child processors that need
+// to be closed.
+func (h *Heartbeat) Close() error {
+	close(h.done)
+	h.wg.Wait()
+	return collector.CloseProcessors(h.Children)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"Heartbeat",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Interval   string `toml:"interval"`
+				ReportType string `toml:"report_type"`
+				URL        string `toml:"url"`
+				Body       string `toml:"body"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Interval == "" {
+				return nil, fmt.Errorf("Heartbeat missing `interval`")
+			}
+			interval, err := time.ParseDuration(config.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("Heartbeat invalid `interval`: %v", err)
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("Heartbeat `interval` must be positive")
+			}
+			report := collector.NelReport{
+				ReportType: config.ReportType,
+				URL:        config.URL,
+			}
+			if report.ReportType == "" {
+				report.ReportType = "heartbeat"
+			}
+			if config.Body != "" {
+				if !json.Valid([]byte(config.Body)) {
+					return nil, fmt.Errorf("Heartbeat `body` must be valid JSON")
+				}
+				report.RawBody = []byte(config.Body)
+			}
+
+			children, err := collector.LoadChildProcessors(ctx, configPrimitive)
+			if err != nil {
+				return nil, fmt.Errorf("Heartbeat children: %v", err)
+			}
+			if len(children) == 0 {
+				return nil, fmt.Errorf("Heartbeat missing `children`")
+			}
+			return NewHeartbeat(interval, report, children, clock), nil
+		})
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	record := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, fmt.Sprintf("%s %s %v", batch.Time.Format("15:04:05"), batch.Reports[0].ReportType, batch.GetAnnotation("Heartbeat")))
+	})
+
+	// The background check runs on real time, so use an interval that it
+	// won't reach during the test.
+	clock := pipelinetest.NewSimulatedClock()
+	h := core.NewHeartbeat(time.Hour, collector.NelReport{ReportType: "heartbeat"}, []collector.ReportProcessor{record}, clock)
+	ctx := context.Background()
+	tick := func(d time.Duration) bool {
+		clock.CurrentTime = clock.CurrentTime.Add(d)
+		return h.Tick(ctx)
+	}
+	process := func(d time.Duration) {
+		clock.CurrentTime = clock.CurrentTime.Add(d)
+		h.ProcessReports(ctx, &collector.ReportBatch{Time: clock.Now(), Reports: []collector.NelReport{{ReportType: "network-error"}}})
+	}
+
+	var ticks []bool
+	ticks = append(ticks, tick(30*time.Minute))
+	ticks = append(ticks, tick(30*time.Minute))
+	process(10 * time.Minute)
+	ticks = append(ticks, tick(55*time.Minute))
+	ticks = append(ticks, tick(5*time.Minute))
+	ticks = append(ticks, tick(time.Hour))
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]bool{false, true, false, true, true}, ticks); diff != "" {
+		t.Errorf("Tick got diff (-want +got):\n%s", diff)
+	}
+	want := []string{
+		"01:00:00 heartbeat true",
+		"01:10:00 network-error <nil>",
+		"02:10:00 heartbeat true",
+		"03:10:00 heartbeat true",
+	}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("Heartbeat children saw diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestHeartbeatBadConfig(t *testing.T) {
+	child := "\n[[processor.children]]\ntype = \"AssignReportID\""
+	for _, config := range []string{
+		child,
+		`interval = "soon"` + child,
+		`interval = "-1s"` + child,
+		`interval = "1m"`,
+		`interval = "1m"` + "\n" + `body = "{"` + child,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"Heartbeat\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// HoistUniformAnnotations is a pipeline processor that moves report
+// annotations up to the batch, when every report in the batch has the same
+// value for them.  (Annotations that come from the upload itself, such as the
+// client's country, often are.)  Publishers that write out the batch's
+// annotations then only have to write those values once, rather than once per
+// report.
+//
+// We only consider the annotations named in Annotations.  An annotation stays
+// where it is if any report is missing it or has a different value for it
+// (compared with reflect.DeepEqual), or if the batch already has a different
+// value for it.
+type HoistUniformAnnotations struct {
+	Annotations []string
+}
+
+// ProcessReports hoists each uniform annotation from the batch's reports to
+// the batch.
+func (h HoistUniformAnnotations) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if len(batch.Reports) == 0 {
+		return
+	}
+	for _, name := range h.Annotations {
+		value := batch.Reports[0].GetAnnotation(name)
+		if value == nil {
+			continue
+		}
+		uniform := true
+		for i := 1; i < len(batch.Reports) && uniform; i++ {
+			uniform = reflect.DeepEqual(batch.Reports[i].GetAnnotation(name), value)
+		}
+		if !uniform {
+			continue
+		}
+		if existing := batch.GetOrAddAnnotation(name, value); !reflect.DeepEqual(existing, value) {
+			continue
+		}
+		for i := range batch.Reports {
+			batch.Reports[i].DeleteAnnotation(name)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"HoistUniformAnnotations",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotations []string `toml:"annotations"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Annotations) == 0 {
+				return nil, fmt.Errorf("HoistUniformAnnotations missing `annotations`")
+			}
+			return HoistUniformAnnotations{config.Annotations}, nil
+		})
+}
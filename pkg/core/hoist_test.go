@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestHoistUniformAnnotations(t *testing.T) {
+	batch := &collector.ReportBatch{Reports: make([]collector.NelReport, 3)}
+	batch.SetAnnotation("Conflict", "batch")
+	batch.SetAnnotation("Agreed", []string{"a", "b"})
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		report.SetAnnotation("ClientCountry", "NZ")
+		report.SetAnnotation("Agreed", []string{"a", "b"})
+		report.SetAnnotation("Conflict", "report")
+		report.SetAnnotation("Index", i)
+		report.SetAnnotation("Ineligible", true)
+		if i > 0 {
+			report.SetAnnotation("Partial", "yes")
+		}
+	}
+	config := `
+		[[processor]]
+		type = "HoistUniformAnnotations"
+		annotations = ["ClientCountry", "Agreed", "Conflict", "Index", "Partial", "Missing"]
+	`
+	pipelinetest.RunTestConfig(config, batch)
+
+	wantBatch := map[string]interface{}{
+		"ClientCountry": "NZ",
+		"Agreed":        []string{"a", "b"},
+		"Conflict":      "batch",
+	}
+	if diff := cmp.Diff(wantBatch, batch.Annotations.Annotations); diff != "" {
+		t.Errorf("Batch annotations diff (-want +got):\n%s", diff)
+	}
+	for i, report := range batch.Reports {
+		want := map[string]interface{}{
+			"Conflict":   "report",
+			"Index":      i,
+			"Ineligible": true,
+		}
+		if i > 0 {
+			want["Partial"] = "yes"
+		}
+		if diff := cmp.Diff(want, report.Annotations.Annotations); diff != "" {
+			t.Errorf("Report %d annotations diff (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestHoistUniformAnnotationsBadConfig(t *testing.T) {
+	var pipeline collector.Pipeline
+	config := "[[processor]]\ntype = \"HoistUniformAnnotations\""
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+		t.Errorf("LoadFromConfig(%s) should return error", config)
+	}
+}
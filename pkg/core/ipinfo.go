@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// A Subnet is a CIDR range with a label, such as the name of the datacenter or
+// ISP that the range belongs to.
+type Subnet struct {
+	Range *net.IPNet
+	Label string
+}
+
+// ParseSubnets parses a map from CIDR ranges to their labels, returning the
+// subnets sorted from most to least specific.
+func ParseSubnets(labels map[string]string) ([]Subnet, error) {
+	var result []Subnet
+	for cidr, label := range labels {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, Subnet{ipnet, label})
+	}
+	sortSubnets(result)
+	return result, nil
+}
+
+// sortSubnets sorts subnets from most to least specific.
+func sortSubnets(subnets []Subnet) {
+	sort.Slice(subnets, func(i, j int) bool {
+		ones, _ := subnets[i].Range.Mask.Size()
+		otherOnes, _ := subnets[j].Range.Mask.Size()
+		if ones != otherOnes {
+			return ones > otherOnes
+		}
+		return subnets[i].Range.String() < subnets[j].Range.String()
+	})
+}
+
+// parseIPAddress parses an IP address that might also include a port (as in
+// `192.0.2.1:443` or `[2001:db8::1]:443`), brackets, or an IPv6 zone.
+// Returns nil if the address is empty or invalid.
+func parseIPAddress(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimPrefix(address, "[")
+	address = strings.TrimSuffix(address, "]")
+	if zone := strings.IndexByte(address, '%'); zone >= 0 {
+		address = address[:zone]
+	}
+	return net.ParseIP(address)
+}
+
+// ipVersion returns "IPv4" or "IPv6".  IPv4-mapped IPv6 addresses (such as
+// `::ffff:192.0.2.1`) count as IPv4.
+func ipVersion(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// clientIP returns the IP address of the client that uploaded a report.
+// That's the ClientIP annotation if the report has one (since coalesced
+// batches can contain reports from different uploads), and otherwise the
+// batch's ClientIP.
+func clientIP(batch *collector.ReportBatch, report *collector.NelReport) string {
+	if ip, ok := report.GetAnnotation("ClientIP").(string); ok && ip != "" {
+		return ip
+	}
+	return batch.ClientIP
+}
+
+// AnnotateIPInfo is a pipeline processor that annotates each report with the
+// IP version of the client that uploaded it and of the server that the report
+// is about, in the ClientIPVersion and ServerIPVersion annotations (as "IPv4"
+// or "IPv6").  If either address is in one of Subnets, we also set the
+// ClientSubnet or ServerSubnet annotation to the label of the most specific
+// subnet that it's in.
+//
+// Addresses can include a port or brackets; annotations aren't set for
+// addresses that are missing or invalid.
+type AnnotateIPInfo struct {
+	// The subnets to look for, which must be sorted from most to least
+	// specific; see ParseSubnets.
+	Subnets []Subnet
+}
+
+func (a AnnotateIPInfo) subnet(ip net.IP) (string, bool) {
+	for _, subnet := range a.Subnets {
+		if subnet.Range.Contains(ip) {
+			return subnet.Label, true
+		}
+	}
+	return "", false
+}
+
+func (a AnnotateIPInfo) annotate(report *collector.NelReport, address, prefix string) {
+	ip := parseIPAddress(address)
+	if ip == nil {
+		return
+	}
+	report.SetAnnotation(prefix+"IPVersion", ipVersion(ip))
+	if label, ok := a.subnet(ip); ok {
+		report.SetAnnotation(prefix+"Subnet", label)
+	}
+}
+
+// ProcessReports annotates each report in the batch.
+func (a AnnotateIPInfo) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		a.annotate(report, clientIP(batch, report), "Client")
+		a.annotate(report, report.ServerIP, "Server")
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"AnnotateIPInfo",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Subnets map[string]string `toml:"subnets"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			subnets, err := ParseSubnets(config.Subnets)
+			if err != nil {
+				return nil, fmt.Errorf("AnnotateIPInfo invalid `subnets`: %v", err)
+			}
+			return AnnotateIPInfo{subnets}, nil
+		})
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+const annotateIPInfoConfig = `
+	[[processor]]
+	type = "AnnotateIPInfo"
+	[processor.subnets]
+	"203.0.113.0/24" = "us-east"
+	"203.0.113.128/25" = "us-east-b"
+	"2001:db8::/32" = "isp"
+	"192.0.2.0/24" = "office"
+`
+
+func TestAnnotateIPInfo(t *testing.T) {
+	cases := []struct {
+		clientIP, clientAnnotation, serverIP string
+		want                                 map[string]interface{}
+	}{
+		{"192.0.2.1", "", "203.0.113.75", map[string]interface{}{
+			"ClientIPVersion": "IPv4", "ClientSubnet": "office",
+			"ServerIPVersion": "IPv4", "ServerSubnet": "us-east",
+		}},
+		{"2001:db8::2", "", "[2001:db8::1]:443", map[string]interface{}{
+			"ClientIPVersion": "IPv6", "ClientSubnet": "isp",
+			"ServerIPVersion": "IPv6", "ServerSubnet": "isp",
+		}},
+		// The most specific subnet wins.
+		{"198.51.100.1", "", "203.0.113.200:443", map[string]interface{}{
+			"ClientIPVersion": "IPv4",
+			"ServerIPVersion": "IPv4", "ServerSubnet": "us-east-b",
+		}},
+		{"192.0.2.1", "2001:db8::5", " ::ffff:203.0.113.1 ", map[string]interface{}{
+			"ClientIPVersion": "IPv6", "ClientSubnet": "isp",
+			"ServerIPVersion": "IPv4", "ServerSubnet": "us-east",
+		}},
+		{"fe80::1%eth0", "", "", map[string]interface{}{
+			"ClientIPVersion": "IPv6",
+		}},
+		{"", "", "not an address", nil},
+	}
+	for _, c := range cases {
+		report := collector.NelReport{ServerIP: c.serverIP}
+		if c.clientAnnotation != "" {
+			report.SetAnnotation("ClientIP", c.clientAnnotation)
+		}
+		batch := pipelinetest.RunTestConfig(annotateIPInfoConfig, &collector.ReportBatch{
+			ClientIP: c.clientIP,
+			Reports:  []collector.NelReport{report},
+		})
+		got := batch.Reports[0].Annotations.Annotations
+		delete(got, "ClientIP")
+		if len(got) == 0 {
+			got = nil
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("AnnotateIPInfo(%q, %q) got diff (-want +got):\n%s", c.clientIP, c.serverIP, diff)
+		}
+	}
+}
+
+func TestAnnotateIPInfoBadConfig(t *testing.T) {
+	for _, config := range []string{
+		"[processor.subnets]\n\"10.0.0.0\" = \"a\"",
+		"subnets = { \"10.0.0.0/33\" = \"a\" }",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"AnnotateIPInfo\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
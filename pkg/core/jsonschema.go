@@ -0,0 +1,669 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// maxSchemaErrors is the most validation errors that we record for a single
+// report.
+const maxSchemaErrors = 10
+
+// JSONSchema is a compiled JSON Schema.  We support the commonly used subset of
+// draft 7 (and later) validation keywords:
+//
+//	type, enum, const
+//	properties, required, additionalProperties, minProperties, maxProperties
+//	items, minItems, maxItems, uniqueItems
+//	minLength, maxLength, pattern
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf
+//	allOf, anyOf, oneOf, not
+//	$ref (only to "#", or to "#/definitions/..." or "#/$defs/...")
+//
+// Any other keywords (such as `format` or `title`) are ignored, as the spec
+// allows.
+type JSONSchema struct {
+	// For the boolean schemas `true` and `false`.
+	always *bool
+
+	types                []string
+	enum                 []interface{}
+	constValue           interface{}
+	hasConst             bool
+	properties           map[string]*JSONSchema
+	required             []string
+	additionalProperties *JSONSchema
+	minProperties        *int
+	maxProperties        *int
+	items                *JSONSchema
+	minItems             *int
+	maxItems             *int
+	uniqueItems          bool
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	multipleOf           *float64
+	allOf                []*JSONSchema
+	anyOf                []*JSONSchema
+	oneOf                []*JSONSchema
+	not                  *JSONSchema
+
+	ref  string
+	root *JSONSchema
+	defs map[string]*JSONSchema
+}
+
+// ParseJSONSchema compiles a JSON Schema, returning an error if it's invalid or
+// uses a $ref that we don't support.
+func ParseJSONSchema(data []byte) (*JSONSchema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	root := &JSONSchema{}
+	if err := root.compile(raw, root, ""); err != nil {
+		return nil, err
+	}
+	if err := root.checkRefs(root, make(map[*JSONSchema]bool)); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// LoadJSONSchema reads and compiles a JSON Schema from a file.
+func LoadJSONSchema(path string) (*JSONSchema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ParseJSONSchema(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return schema, nil
+}
+
+func compileSubschema(raw interface{}, root *JSONSchema, path string) (*JSONSchema, error) {
+	s := &JSONSchema{}
+	if err := s.compile(raw, root, path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func compileSubschemas(raw interface{}, root *JSONSchema, path string) ([]*JSONSchema, error) {
+	list, ok := raw.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s must be a non-empty array", path)
+	}
+	var result []*JSONSchema
+	for i, item := range list {
+		s, err := compileSubschema(item, root, fmt.Sprintf("%s/%d", path, i))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+func schemaNumber(raw interface{}, path string) (*float64, error) {
+	n, ok := raw.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a number", path)
+	}
+	return &n, nil
+}
+
+func schemaCount(raw interface{}, path string) (*int, error) {
+	n, ok := raw.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return nil, fmt.Errorf("%s must be a non-negative integer", path)
+	}
+	i := int(n)
+	return &i, nil
+}
+
+var jsonTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+func (s *JSONSchema) compile(raw interface{}, root *JSONSchema, path string) error {
+	s.root = root
+	if b, ok := raw.(bool); ok {
+		s.always = &b
+		return nil
+	}
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("schema%s must be an object or a boolean", path)
+	}
+	var err error
+	for keyword, value := range object {
+		at := path + "/" + keyword
+		switch keyword {
+		case "type":
+			switch v := value.(type) {
+			case string:
+				s.types = []string{v}
+			case []interface{}:
+				for _, t := range v {
+					name, ok := t.(string)
+					if !ok {
+						return fmt.Errorf("%s must only contain strings", at)
+					}
+					s.types = append(s.types, name)
+				}
+			default:
+				return fmt.Errorf("%s must be a string or an array", at)
+			}
+			for _, t := range s.types {
+				if !jsonTypes[t] {
+					return fmt.Errorf("%s has unknown type %q", at, t)
+				}
+			}
+		case "enum":
+			list, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be an array", at)
+			}
+			s.enum = list
+		case "const":
+			s.constValue, s.hasConst = value, true
+		case "properties", "definitions", "$defs":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be an object", at)
+			}
+			compiled := make(map[string]*JSONSchema)
+			for name, prop := range props {
+				compiled[name], err = compileSubschema(prop, root, at+"/"+name)
+				if err != nil {
+					return err
+				}
+			}
+			if keyword == "properties" {
+				s.properties = compiled
+			} else {
+				if s.defs == nil {
+					s.defs = make(map[string]*JSONSchema)
+				}
+				for name, def := range compiled {
+					s.defs[keyword+"/"+name] = def
+				}
+			}
+		case "required":
+			list, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be an array", at)
+			}
+			for _, name := range list {
+				name, ok := name.(string)
+				if !ok {
+					return fmt.Errorf("%s must only contain strings", at)
+				}
+				s.required = append(s.required, name)
+			}
+		case "additionalProperties":
+			s.additionalProperties, err = compileSubschema(value, root, at)
+		case "items":
+			s.items, err = compileSubschema(value, root, at)
+		case "not":
+			s.not, err = compileSubschema(value, root, at)
+		case "allOf":
+			s.allOf, err = compileSubschemas(value, root, at)
+		case "anyOf":
+			s.anyOf, err = compileSubschemas(value, root, at)
+		case "oneOf":
+			s.oneOf, err = compileSubschemas(value, root, at)
+		case "minProperties":
+			s.minProperties, err = schemaCount(value, at)
+		case "maxProperties":
+			s.maxProperties, err = schemaCount(value, at)
+		case "minItems":
+			s.minItems, err = schemaCount(value, at)
+		case "maxItems":
+			s.maxItems, err = schemaCount(value, at)
+		case "minLength":
+			s.minLength, err = schemaCount(value, at)
+		case "maxLength":
+			s.maxLength, err = schemaCount(value, at)
+		case "uniqueItems":
+			unique, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("%s must be a boolean", at)
+			}
+			s.uniqueItems = unique
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s must be a string", at)
+			}
+			s.pattern, err = regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s is invalid: %v", at, err)
+			}
+		case "minimum":
+			s.minimum, err = schemaNumber(value, at)
+		case "maximum":
+			s.maximum, err = schemaNumber(value, at)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = schemaNumber(value, at)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = schemaNumber(value, at)
+		case "multipleOf":
+			s.multipleOf, err = schemaNumber(value, at)
+			if err == nil && *s.multipleOf <= 0 {
+				return fmt.Errorf("%s must be positive", at)
+			}
+		case "$ref":
+			ref, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s must be a string", at)
+			}
+			if ref != "#" && !strings.HasPrefix(ref, "#/definitions/") && !strings.HasPrefix(ref, "#/$defs/") {
+				return fmt.Errorf("%s %q isn't supported; only local references are", at, ref)
+			}
+			s.ref = ref
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the schema that a $ref refers to, or nil if there isn't one.
+func (s *JSONSchema) resolve() *JSONSchema {
+	if s.ref == "#" {
+		return s.root
+	}
+	return s.root.defs[strings.TrimPrefix(s.ref, "#/")]
+}
+
+// checkRefs makes sure that every $ref in the schema refers to something.
+func (s *JSONSchema) checkRefs(root *JSONSchema, seen map[*JSONSchema]bool) error {
+	if s == nil || seen[s] {
+		return nil
+	}
+	seen[s] = true
+	if s.ref != "" && s.resolve() == nil {
+		return fmt.Errorf("$ref %q doesn't refer to a definition", s.ref)
+	}
+	children := []*JSONSchema{s.additionalProperties, s.items, s.not}
+	children = append(children, s.allOf...)
+	children = append(children, s.anyOf...)
+	children = append(children, s.oneOf...)
+	for _, child := range s.properties {
+		children = append(children, child)
+	}
+	for _, child := range s.defs {
+		children = append(children, child)
+	}
+	for _, child := range children {
+		if err := child.checkRefs(root, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks a JSON document against the schema, and returns a
+// description of each way in which it doesn't match (up to a limit), or nil if
+// it's valid.
+func (s *JSONSchema) Validate(data []byte) []string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	var errors []string
+	s.validate(value, "", &errors, 0)
+	if len(errors) > maxSchemaErrors {
+		errors = append(errors[:maxSchemaErrors], fmt.Sprintf("(and %d more)", len(errors)-maxSchemaErrors))
+	}
+	return errors
+}
+
+// maxSchemaDepth stops a recursive $ref from running forever.
+const maxSchemaDepth = 100
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func (s *JSONSchema) hasType(value interface{}) bool {
+	actual := jsonType(value)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether value is valid, without recording why not.
+func (s *JSONSchema) matches(value interface{}, depth int) bool {
+	var errors []string
+	s.validate(value, "", &errors, depth)
+	return len(errors) == 0
+}
+
+func (s *JSONSchema) validate(value interface{}, path string, errors *[]string, depth int) {
+	fail := func(format string, args ...interface{}) {
+		at := path
+		if at == "" {
+			at = "/"
+		}
+		*errors = append(*errors, at+": "+fmt.Sprintf(format, args...))
+	}
+	if depth > maxSchemaDepth {
+		fail("schema is nested too deeply")
+		return
+	}
+	if s.always != nil {
+		if !*s.always {
+			fail("not allowed")
+		}
+		return
+	}
+	if s.ref != "" {
+		s.resolve().validate(value, path, errors, depth+1)
+	}
+
+	if len(s.types) > 0 && !s.hasType(value) {
+		fail("must be of type %s, not %s", strings.Join(s.types, " or "), jsonType(value))
+		return
+	}
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			if reflect.DeepEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of the allowed values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(value, s.constValue) {
+		fail("must be %v", s.constValue)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		if s.minProperties != nil && len(v) < *s.minProperties {
+			fail("must have at least %d properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && len(v) > *s.maxProperties {
+			fail("must have at most %d properties", *s.maxProperties)
+		}
+		// Go through the properties in order, so that the errors are too.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			at := path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+			if prop, ok := s.properties[name]; ok {
+				prop.validate(v[name], at, errors, depth+1)
+			} else if s.additionalProperties != nil {
+				if s.additionalProperties.always != nil && !*s.additionalProperties.always {
+					fail("unexpected property %q", name)
+				} else {
+					s.additionalProperties.validate(v[name], at, errors, depth+1)
+				}
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						fail("items %d and %d must be unique", i, j)
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range v {
+				s.items.validate(item, fmt.Sprintf("%s/%d", path, i), errors, depth+1)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			fail("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %q", s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("must be at most %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			fail("must be more than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			fail("must be less than %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil {
+			quotient := v / *s.multipleOf
+			if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(value, path, errors, depth+1)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.matches(value, depth+1) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one schema in anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.matches(value, depth+1) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one schema in oneOf, but matches %d", matched)
+		}
+	}
+	if s.not != nil && s.not.matches(value, depth+1) {
+		fail("must not match the schema in not")
+	}
+}
+
+// JSONSchemaValidate is a pipeline processor that checks the body of each
+// report against a JSON Schema, for report types whose payloads we don't
+// otherwise check.  If Types isn't empty, we only check reports of those types.
+// (For NEL reports, which don't keep their raw body, we check the body as it
+// would be marshaled.)
+//
+// In "drop" mode we throw away reports that don't match the schema, and count
+// them; see Dropped.  In "annotate" mode we keep them, but set an annotation
+// (SchemaErrors by default) to a []string describing why they don't match.
+type JSONSchemaValidate struct {
+	Schema     *JSONSchema
+	Types      map[string]bool
+	Annotation string
+
+	dropped int64
+}
+
+// Dropped returns the number of reports that the processor has thrown away.
+func (v *JSONSchemaValidate) Dropped() int64 {
+	return atomic.LoadInt64(&v.dropped)
+}
+
+// reportBody returns the JSON `body` of a report.
+func reportBody(report *collector.NelReport) ([]byte, error) {
+	if report.RawBody != nil {
+		return report.RawBody, nil
+	}
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	var wrapper struct {
+		Body json.RawMessage `json:"body"`
+	}
+	if err := json.Unmarshal(encoded, &wrapper); err != nil {
+		return nil, err
+	}
+	return wrapper.Body, nil
+}
+
+// ProcessReports checks the body of each report against the schema.
+func (v *JSONSchemaValidate) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var filtered []collector.NelReport
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if len(v.Types) > 0 && !v.Types[report.ReportType] {
+			filtered = append(filtered, *report)
+			continue
+		}
+		var errors []string
+		body, err := reportBody(report)
+		if err != nil {
+			errors = []string{err.Error()}
+		} else {
+			errors = v.Schema.Validate(body)
+		}
+		if len(errors) == 0 {
+			filtered = append(filtered, *report)
+			continue
+		}
+		if v.Annotation == "" {
+			continue
+		}
+		report.SetAnnotation(v.Annotation, errors)
+		filtered = append(filtered, *report)
+	}
+	atomic.AddInt64(&v.dropped, int64(len(batch.Reports)-len(filtered)))
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"JSONSchemaValidate",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Schema     string   `toml:"schema"`
+				Types      []string `toml:"types"`
+				Mode       string   `toml:"mode"`
+				Annotation string   `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Schema == "" {
+				return nil, fmt.Errorf("JSONSchemaValidate missing `schema`")
+			}
+
+			v := &JSONSchemaValidate{Types: make(map[string]bool)}
+			v.Schema, err = LoadJSONSchema(config.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("JSONSchemaValidate invalid `schema`: %v", err)
+			}
+			for _, reportType := range config.Types {
+				v.Types[reportType] = true
+			}
+			if config.Mode == "" || config.Mode == "drop" {
+				if config.Annotation != "" {
+					return nil, fmt.Errorf("JSONSchemaValidate only uses `annotation` in annotate mode")
+				}
+			} else if config.Mode == "annotate" {
+				v.Annotation = config.Annotation
+				if v.Annotation == "" {
+					v.Annotation = "SchemaErrors"
+				}
+			} else {
+				return nil, fmt.Errorf("JSONSchemaValidate invalid `mode`: %s", config.Mode)
+			}
+			return v, nil
+		})
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+const cspSchema = `{
+	"type": "object",
+	"required": ["documentURL", "effectiveDirective"],
+	"properties": {
+		"documentURL": {"type": "string", "pattern": "^https?://"},
+		"effectiveDirective": {"$ref": "#/definitions/directive"},
+		"statusCode": {"type": "integer", "minimum": 0, "maximum": 599},
+		"sample": {"type": "string", "maxLength": 40}
+	},
+	"additionalProperties": {"type": ["string", "integer", "null"]},
+	"definitions": {
+		"directive": {"enum": ["script-src-elem", "style-src-elem", "img-src"]}
+	}
+}`
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := core.ParseJSONSchema([]byte(cspSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		body string
+		want []string
+	}{
+		{`{"documentURL": "https://example.com/", "effectiveDirective": "img-src", "statusCode": 200, "lineNumber": 4}`, nil},
+		{`{"documentURL": "ftp://example.com/", "effectiveDirective": "img-src"}`, []string{
+			`/documentURL: must match "^https?://"`,
+		}},
+		{`{"documentURL": "https://example.com/", "effectiveDirective": "font-src", "statusCode": 200.5, "extra": true}`, []string{
+			`/effectiveDirective: must be one of the allowed values`,
+			`/extra: must be of type string or integer or null, not boolean`,
+			`/statusCode: must be of type integer, not number`,
+		}},
+		{`{"statusCode": 600}`, []string{
+			`/: missing required property "documentURL"`,
+			`/: missing required property "effectiveDirective"`,
+			`/statusCode: must be at most 599`,
+		}},
+		{`[]`, []string{`/: must be of type object, not array`}},
+		{`{"documentURL": `, []string{`invalid JSON: unexpected EOF`}},
+	}
+	for _, c := range cases {
+		if diff := cmp.Diff(c.want, schema.Validate([]byte(c.body))); diff != "" {
+			t.Errorf("Validate(%s) got diff (-want +got):\n%s", c.body, diff)
+		}
+	}
+}
+
+func TestJSONSchemaCombinators(t *testing.T) {
+	schema, err := core.ParseJSONSchema([]byte(`{
+		"type": "array",
+		"uniqueItems": true,
+		"items": {
+			"oneOf": [{"type": "integer", "multipleOf": 2}, {"type": "integer", "multipleOf": 3}],
+			"not": {"const": 8}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		body string
+		want []string
+	}{
+		{`[2, 3, 4, 9]`, nil},
+		{`[6, 5, 8, 2, 2]`, []string{
+			`/: items 3 and 4 must be unique`,
+			`/0: must match exactly one schema in oneOf, but matches 2`,
+			`/1: must match exactly one schema in oneOf, but matches 0`,
+			`/2: must not match the schema in not`,
+		}},
+	}
+	for _, c := range cases {
+		if diff := cmp.Diff(c.want, schema.Validate([]byte(c.body))); diff != "" {
+			t.Errorf("Validate(%s) got diff (-want +got):\n%s", c.body, diff)
+		}
+	}
+}
+
+func TestParseJSONSchemaErrors(t *testing.T) {
+	for _, schema := range []string{
+		`[]`,
+		`{"type": "float"}`,
+		`{"pattern": "("}`,
+		`{"minLength": -1}`,
+		`{"anyOf": []}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"properties": {"a": 5}}`,
+	} {
+		if _, err := core.ParseJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("ParseJSONSchema(%s) should return error", schema)
+		}
+	}
+}
+
+func writeSchema(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "jsonschema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "csp.json")
+	ioutil.WriteFile(path, []byte(cspSchema), 0644)
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	path, cleanup := writeSchema(t)
+	defer cleanup()
+
+	reports := []collector.NelReport{
+		{ReportType: "csp-violation", RawBody: []byte(`{"documentURL": "https://example.com/", "effectiveDirective": "img-src"}`)},
+		{ReportType: "csp-violation", RawBody: []byte(`{"documentURL": "https://example.com/"}`)},
+		{ReportType: "csp-violation"},
+		{ReportType: "network-error", Type: "ok"},
+	}
+	cases := []struct {
+		name, config string
+		want         []string
+	}{
+		{"Drop", `types = ["csp-violation"]`, []string{
+			"csp-violation <nil>",
+			"network-error <nil>",
+		}},
+		{"Annotate", "types = [\"csp-violation\"]\nmode = \"annotate\"", []string{
+			"csp-violation <nil>",
+			`csp-violation [/: missing required property "effectiveDirective"]`,
+			"csp-violation [/: must be of type object, not null]",
+			"network-error <nil>",
+		}},
+		// NEL reports are checked against their marshaled body, which doesn't
+		// match this schema.
+		{"AllTypes", `mode = "annotate"`, []string{
+			"csp-violation <nil>",
+			`csp-violation [/: missing required property "effectiveDirective"]`,
+			"csp-violation [/: must be of type object, not null]",
+			`network-error [/: missing required property "documentURL" /: missing required property "effectiveDirective"]`,
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batch := pipelinetest.RunTestConfig(fmt.Sprintf("[[processor]]\ntype = \"JSONSchemaValidate\"\nschema = %q\n%s", path, c.config),
+				&collector.ReportBatch{Reports: append([]collector.NelReport(nil), reports...)})
+			var got []string
+			for _, report := range batch.Reports {
+				got = append(got, fmt.Sprintf("%s %v", report.ReportType, report.GetAnnotation("SchemaErrors")))
+			}
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("JSONSchemaValidate got diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaValidateBadConfig(t *testing.T) {
+	path, cleanup := writeSchema(t)
+	defer cleanup()
+
+	for _, config := range []string{
+		``,
+		`schema = "/nonexistent/schema.json"`,
+		fmt.Sprintf("schema = %q\nmode = \"ignore\"", path),
+		fmt.Sprintf("schema = %q\nannotation = \"Errors\"", path),
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"JSONSchemaValidate\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// LimitReportSize is a pipeline processor that protects downstream storage
+// from pathologically large reports, which can slip past the limits on the
+// size of an entire upload.
+//
+// A report is too large if its `url` or `referrer` is longer than MaxURLLength
+// bytes, or if its unparsed body (see NelReport.RawBody) is longer than
+// MaxBodyBytes.  (NEL reports are parsed into fixed fields, and any extra
+// content in their bodies is discarded, so only the URLs of NEL reports are
+// checked.)  A limit of 0 means that there's no limit.
+//
+// In "drop" mode we throw away every report that's too large.  In "truncate"
+// mode we shorten long URLs instead, taking care not to split a UTF-8
+// character.  Truncating a body would leave it as invalid JSON, so reports
+// whose bodies are too large are dropped in either mode.
+type LimitReportSize struct {
+	MaxURLLength int
+	MaxBodyBytes int
+	Truncate     bool
+}
+
+// truncateString returns the longest prefix of s that's at most max bytes long
+// and doesn't end in the middle of a UTF-8 character.
+func truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// limitURL enforces MaxURLLength on a single URL, returning false if the report
+// containing it should be dropped.
+func (l LimitReportSize) limitURL(url *string) bool {
+	if l.MaxURLLength == 0 || len(*url) <= l.MaxURLLength {
+		return true
+	}
+	if !l.Truncate {
+		return false
+	}
+	*url = truncateString(*url, l.MaxURLLength)
+	return true
+}
+
+// ProcessReports drops or truncates each report that's too large.
+func (l LimitReportSize) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var filtered []collector.NelReport
+	for _, report := range batch.Reports {
+		if l.MaxBodyBytes != 0 && len(report.RawBody) > l.MaxBodyBytes {
+			continue
+		}
+		if !l.limitURL(&report.URL) || !l.limitURL(&report.Referrer) {
+			continue
+		}
+		filtered = append(filtered, report)
+	}
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"LimitReportSize",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				MaxURLLength int    `toml:"max_url_length"`
+				MaxBodyBytes int    `toml:"max_body_bytes"`
+				Mode         string `toml:"mode"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			if config.MaxURLLength < 0 {
+				return nil, fmt.Errorf("LimitReportSize `max_url_length` must not be negative")
+			}
+			if config.MaxBodyBytes < 0 {
+				return nil, fmt.Errorf("LimitReportSize `max_body_bytes` must not be negative")
+			}
+			l := LimitReportSize{
+				MaxURLLength: config.MaxURLLength,
+				MaxBodyBytes: config.MaxBodyBytes,
+			}
+			switch config.Mode {
+			case "", "drop":
+			case "truncate":
+				l.Truncate = true
+			default:
+				return nil, fmt.Errorf("LimitReportSize invalid `mode`: %s", config.Mode)
+			}
+			return l, nil
+		})
+}
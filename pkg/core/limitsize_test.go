@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestLimitReportSize(t *testing.T) {
+	cases := []struct {
+		mode string
+		want []string
+	}{
+		{"drop", []string{"https://a/ https://r/", "https://a/ü https://r/"}},
+		{"truncate", []string{
+			"https://a/ https://r/",
+			"https://a/ü https://r/",
+			"https://a/bb https://r/",
+			"https://a/ https://r/xx",
+			"https://a/b https://r/",
+		}},
+	}
+	for _, c := range cases {
+		batch := pipelinetest.RunTestConfig(fmt.Sprintf(`
+			[[processor]]
+			type = "LimitReportSize"
+			max_url_length = 12
+			max_body_bytes = 8
+			mode = "%s"
+		`, c.mode), &collector.ReportBatch{
+			Reports: []collector.NelReport{
+				{URL: "https://a/", Referrer: "https://r/", RawBody: []byte(`{}`)},
+				// Exactly 12 bytes, since ü takes two.
+				{URL: "https://a/ü", Referrer: "https://r/"},
+				{URL: "https://a/bbbbbbbb", Referrer: "https://r/"},
+				{URL: "https://a/", Referrer: "https://r/" + strings.Repeat("x", 10)},
+				// Truncating after 12 bytes would split the ü.
+				{URL: "https://a/bü", Referrer: "https://r/"},
+				{URL: "https://a/", Referrer: "https://r/", RawBody: []byte(`{"a": [[[[]]]]}`)},
+			},
+		})
+		var got []string
+		for _, report := range batch.Reports {
+			got = append(got, report.URL+" "+report.Referrer)
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("LimitReportSize(mode=%s) got diff (-want +got):\n%s", c.mode, diff)
+		}
+	}
+}
+
+func TestLimitReportSizeBadConfig(t *testing.T) {
+	cases := []struct{ config, want string }{
+		{`max_url_length = -1`, "LimitReportSize `max_url_length` must not be negative"},
+		{`max_body_bytes = -1`, "LimitReportSize `max_body_bytes` must not be negative"},
+		{`mode = "shorten"`, "LimitReportSize invalid `mode`: shorten"},
+	}
+	for _, c := range cases {
+		var pipeline collector.Pipeline
+		err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"LimitReportSize\"\n"+c.config))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("LoadFromConfig(%s) got error %v, want %q", c.config, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+const defaultLiveTailBufferSize = 100
+
+// LiveTail is a ReportProcessor that streams each report it sees to any HTTP
+// clients that are currently connected to it.  It is also an http.Handler;
+// mount it somewhere in your server's mux and then `curl` it (to get
+// newline-delimited JSON) or open it in a browser with an EventSource (to get
+// Server-Sent Events).
+//
+// Each connected client gets its own bounded queue of pending reports.  If a
+// client can't keep up, we drop reports for that client rather than blocking
+// the pipeline's workers.
+type LiveTail struct {
+	// The number of encoded reports that we'll queue up for each connected
+	// client before we start dropping them.  If zero, we use a default of 100.
+	BufferSize int
+
+	mu          sync.RWMutex
+	subscribers map[*liveTailSubscriber]struct{}
+}
+
+type liveTailSubscriber struct {
+	c chan []byte
+}
+
+// liveTailReport lets us encode a report exactly as it looks in Go (including
+// its annotations), instead of using our spec-aware JSON rules.
+type liveTailReport collector.NelReport
+
+type liveTailEvent struct {
+	Time     string
+	ClientIP string
+	Report   liveTailReport
+}
+
+// ProcessReports sends each report in the batch to every connected client.
+// This never blocks; clients whose queues are full just miss out.
+func (l *LiveTail) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.subscribers) == 0 {
+		return
+	}
+
+	time := batch.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	for _, report := range batch.Reports {
+		encoded, err := json.Marshal(liveTailEvent{time, batch.ClientIP, liveTailReport(report)})
+		if err != nil {
+			continue
+		}
+		for sub := range l.subscribers {
+			select {
+			case sub.c <- encoded:
+			default:
+			}
+		}
+	}
+}
+
+func (l *LiveTail) subscribe() *liveTailSubscriber {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bufferSize := l.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultLiveTailBufferSize
+	}
+	sub := &liveTailSubscriber{make(chan []byte, bufferSize)}
+	if l.subscribers == nil {
+		l.subscribers = make(map[*liveTailSubscriber]struct{})
+	}
+	l.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (l *LiveTail) unsubscribe(sub *liveTailSubscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subscribers, sub)
+}
+
+// ServeHTTP streams reports to the client until it disconnects.  If the client
+// asks for `text/event-stream`, each report is sent as a Server-Sent Event;
+// otherwise we send newline-delimited JSON.
+func (l *LiveTail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	sub := l.subscribe()
+	defer l.unsubscribe(sub)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case encoded := <-sub.c:
+			var err error
+			if sse {
+				_, err = w.Write([]byte("data: " + string(encoded) + "\n\n"))
+			} else {
+				_, err = w.Write(append(encoded, '\n'))
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+var liveTails = struct {
+	sync.Mutex
+	m map[string]*LiveTail
+}{m: make(map[string]*LiveTail)}
+
+// NamedLiveTail returns the LiveTail with the given name, creating it if it
+// doesn't exist yet.  LiveTail processors that are loaded from a configuration
+// file are looked up by name, so that the http.Handler that you mount in your
+// server keeps working when a new pipeline is swapped in.
+func NamedLiveTail(name string) *LiveTail {
+	liveTails.Lock()
+	defer liveTails.Unlock()
+	l, ok := liveTails.m[name]
+	if !ok {
+		l = &LiveTail{}
+		liveTails.m[name] = l
+	}
+	return l
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"LiveTail",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Name       string `toml:"name"`
+				BufferSize int    `toml:"buffer_size"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Name == "" {
+				config.Name = "default"
+			}
+
+			l := NamedLiveTail(config.Name)
+			if config.BufferSize != 0 {
+				l.mu.Lock()
+				l.BufferSize = config.BufferSize
+				l.mu.Unlock()
+			}
+			return l, nil
+		})
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+func liveTailBatch() *collector.ReportBatch {
+	return &collector.ReportBatch{
+		Time:     time.Unix(0, 0),
+		ClientIP: "192.0.2.1",
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", URL: "https://example.com/about/", Type: "tcp.timed_out"},
+		},
+	}
+}
+
+func TestLiveTailStreamsReports(t *testing.T) {
+	for _, c := range []struct{ name, accept, want string }{
+		{"ndjson", "", `{"Time":"1970-01-01T00:00:00.000Z","ClientIP":"192.0.2.1","Report":{`},
+		{"sse", "text/event-stream", `data: {"Time":"1970-01-01T00:00:00.000Z","ClientIP":"192.0.2.1","Report":{`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tail := &core.LiveTail{}
+			server := httptest.NewServer(tail)
+			defer server.Close()
+
+			request, _ := http.NewRequest("GET", server.URL, nil)
+			if c.accept != "" {
+				request.Header.Set("Accept", c.accept)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			// The handler has subscribed by the time the response headers arrive.
+			tail.ProcessReports(context.Background(), liveTailBatch())
+
+			line, err := bufio.NewReader(response.Body).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, c.want) {
+				t.Errorf("LiveTail(%s) got %q, wanted prefix %q", c.name, line, c.want)
+			}
+			if !strings.Contains(line, `"Type":"tcp.timed_out"`) {
+				t.Errorf("LiveTail(%s) got %q, wanted the report's Type", c.name, line)
+			}
+		})
+	}
+}
+
+func TestLiveTailDoesNotBlockOnSlowClients(t *testing.T) {
+	tail := &core.LiveTail{BufferSize: 1}
+	server := httptest.NewServer(tail)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	// We never read from the response, so all but the first few reports must be
+	// dropped.  If ProcessReports blocked, this would hang.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10000; i++ {
+			tail.ProcessReports(context.Background(), liveTailBatch())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ProcessReports blocked on a slow client")
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// LookupTable is a pipeline processor that joins reports with a table of extra
+// information read from a file, such as a CMDB export mapping server IPs to
+// the services and teams that own them.  We look up the value of one of each
+// report's fields (whose name is as in Where's conditions) in the table, and
+// add each of the other columns of the matching row to the report as an
+// annotation with the same name as the column.  Reports that don't match any
+// row get the annotations in Default instead, if there are any.
+//
+// The table is read from Path when the processor is created.  A file whose
+// name ends in `.json` must contain an object mapping each key to an object of
+// column values, which must all be strings.  Any other file is read as CSV;
+// its first line names the columns, and the key is in KeyColumn (or the first
+// column, if that's empty).  If a key appears more than once, the last row
+// wins.
+//
+// You can call Reload to read the file again; or, if you give NewLookupTable a
+// reload interval, we check that often whether the file has been modified, and
+// read it again if it has.  If the new contents are invalid, we log an error
+// and carry on using the old table.
+type LookupTable struct {
+	Path      string
+	KeyColumn string
+	Default   map[string]string
+
+	key     func(report *collector.NelReport) (string, bool)
+	mu      sync.RWMutex
+	rows    map[string]map[string]string
+	modTime time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewLookupTable creates a new LookupTable processor, which looks up the
+// value of field in the table in path (using the given key column, for CSV
+// files).  It returns an error if the file can't be read.  If reloadInterval
+// is nonzero, we also start checking for changes to the file in the
+// background; Close stops checking.
+func NewLookupTable(path, field, keyColumn string, reloadInterval time.Duration) (*LookupTable, error) {
+	get, ok := reportFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", field)
+	}
+	l := &LookupTable{
+		Path:      path,
+		KeyColumn: keyColumn,
+		key: func(report *collector.NelReport) (string, bool) {
+			return routeValue(get(report))
+		},
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		l.done = make(chan struct{})
+		l.wg.Add(1)
+		go l.run(reloadInterval)
+	}
+	return l, nil
+}
+
+func (l *LookupTable) run(interval time.Duration) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(l.Path)
+			if err != nil {
+				log.Printf("LookupTable: %v", err)
+				continue
+			}
+			l.mu.RLock()
+			changed := !info.ModTime().Equal(l.modTime)
+			l.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := l.Reload(); err != nil {
+				log.Printf("LookupTable: %v", err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Reload reads the table from Path again.  If the file can't be read, we
+// return an error and keep using the old table.
+func (l *LookupTable) Reload() error {
+	info, err := os.Stat(l.Path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		return err
+	}
+	var rows map[string]map[string]string
+	if strings.EqualFold(filepath.Ext(l.Path), ".json") {
+		err = json.Unmarshal(data, &rows)
+	} else {
+		rows, err = parseLookupCSV(data, l.KeyColumn)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", l.Path, err)
+	}
+
+	l.mu.Lock()
+	l.rows = rows
+	l.modTime = info.ModTime()
+	l.mu.Unlock()
+	return nil
+}
+
+// parseLookupCSV parses a CSV lookup table, returning a map from each row's
+// value in keyColumn to its other columns.
+func parseLookupCSV(data []byte, keyColumn string) (map[string]map[string]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing header")
+	}
+	header := records[0]
+	keyIndex := 0
+	if keyColumn != "" {
+		keyIndex = -1
+		for i, column := range header {
+			if column == keyColumn {
+				keyIndex = i
+			}
+		}
+		if keyIndex < 0 {
+			return nil, fmt.Errorf("missing key column %s", keyColumn)
+		}
+	}
+	rows := make(map[string]map[string]string, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header)-1)
+		for i, column := range header {
+			if i != keyIndex {
+				row[column] = record[i]
+			}
+		}
+		rows[record[keyIndex]] = row
+	}
+	return rows, nil
+}
+
+// ProcessReports annotates each report with the columns of the row that it
+// matches.
+func (l *LookupTable) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		row := l.Default
+		if key, ok := l.key(report); ok {
+			if match, ok := l.rows[key]; ok {
+				row = match
+			}
+		}
+		for column, value := range row {
+			report.SetAnnotation(column, value)
+		}
+	}
+}
+
+// Close stops checking for changes to the file.
+func (l *LookupTable) Close() error {
+	if l.done != nil {
+		close(l.done)
+		l.wg.Wait()
+		l.done = nil
+	}
+	return nil
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"LookupTable",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Path           string            `toml:"path"`
+				Field          string            `toml:"field"`
+				KeyColumn      string            `toml:"key_column"`
+				Default        map[string]string `toml:"default"`
+				ReloadInterval string            `toml:"reload_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Path == "" {
+				return nil, fmt.Errorf("LookupTable missing `path`")
+			}
+			if config.Field == "" {
+				return nil, fmt.Errorf("LookupTable missing `field`")
+			}
+			if _, ok := reportFields[config.Field]; !ok {
+				return nil, fmt.Errorf("LookupTable invalid `field`: %s", config.Field)
+			}
+			var reloadInterval time.Duration
+			if config.ReloadInterval != "" {
+				reloadInterval, err = time.ParseDuration(config.ReloadInterval)
+				if err != nil {
+					return nil, fmt.Errorf("LookupTable invalid `reload_interval`: %v", err)
+				}
+				if reloadInterval <= 0 {
+					return nil, fmt.Errorf("LookupTable `reload_interval` must be positive")
+				}
+			}
+
+			l, err := NewLookupTable(config.Path, config.Field, config.KeyColumn, reloadInterval)
+			if err != nil {
+				return nil, fmt.Errorf("LookupTable invalid `path`: %v", err)
+			}
+			l.Default = config.Default
+			return l, nil
+		})
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// lookupServices returns the Service and Team annotations of reports from
+// each server IP.
+func lookupServices(p collector.ReportProcessor, ips ...string) []string {
+	batch := &collector.ReportBatch{}
+	for _, ip := range ips {
+		batch.Reports = append(batch.Reports, collector.NelReport{ServerIP: ip})
+	}
+	p.ProcessReports(context.Background(), batch)
+	var result []string
+	for _, report := range batch.Reports {
+		result = append(result, fmt.Sprintf("%v/%v", report.GetAnnotation("Service"), report.GetAnnotation("Team")))
+	}
+	return result
+}
+
+func TestLookupTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	csvPath := filepath.Join(dir, "servers.csv")
+	jsonPath := filepath.Join(dir, "servers.json")
+	ioutil.WriteFile(csvPath, []byte("Service,ip,Team\nweb,192.0.2.1,frontend\napi,192.0.2.2,backend\n"), 0644)
+	ioutil.WriteFile(jsonPath, []byte(`{"192.0.2.1": {"Service": "web", "Team": "frontend"}}`), 0644)
+
+	cases := []struct {
+		name, config string
+		want         []string
+	}{
+		{"CSV", fmt.Sprintf(`
+			path = %q
+			field = "server_ip"
+			key_column = "ip"
+		`, csvPath), []string{"web/frontend", "api/backend", "<nil>/<nil>"}},
+		{"JSON", fmt.Sprintf(`
+			path = %q
+			field = "server_ip"
+		`, jsonPath), []string{"web/frontend", "<nil>/<nil>", "<nil>/<nil>"}},
+		{"Default", fmt.Sprintf(`
+			path = %q
+			field = "server_ip"
+			[processor.default]
+			Service = "unknown"
+		`, jsonPath), []string{"web/frontend", "unknown/<nil>", "unknown/<nil>"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batch := &collector.ReportBatch{}
+			for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+				batch.Reports = append(batch.Reports, collector.NelReport{ServerIP: ip})
+			}
+			batch = pipelinetest.RunTestConfig("[[processor]]\ntype = \"LookupTable\"\n"+c.config, batch)
+			var got []string
+			for _, report := range batch.Reports {
+				got = append(got, fmt.Sprintf("%v/%v", report.GetAnnotation("Service"), report.GetAnnotation("Team")))
+			}
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("LookupTable got diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLookupTableReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers.csv")
+	ioutil.WriteFile(path, []byte("ip,Service,Team\n192.0.2.1,web,frontend\n"), 0644)
+
+	l, err := core.NewLookupTable(path, "server_ip", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if diff := cmp.Diff([]string{"web/frontend"}, lookupServices(l, "192.0.2.1")); diff != "" {
+		t.Errorf("LookupTable got diff (-want +got):\n%s", diff)
+	}
+
+	ioutil.WriteFile(path, []byte("ip,Service,Team\n192.0.2.1,api,backend\n"), 0644)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"api/backend"}, lookupServices(l, "192.0.2.1")); diff != "" {
+		t.Errorf("LookupTable after Reload got diff (-want +got):\n%s", diff)
+	}
+
+	// An invalid file leaves the old table in place.
+	ioutil.WriteFile(path, []byte("ip,Service,Team\n192.0.2.1,web\n"), 0644)
+	if err := l.Reload(); err == nil {
+		t.Errorf("Reload of an invalid file should return error")
+	}
+	if diff := cmp.Diff([]string{"api/backend"}, lookupServices(l, "192.0.2.1")); diff != "" {
+		t.Errorf("LookupTable after failed Reload got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLookupTableReloadInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers.json")
+	ioutil.WriteFile(path, []byte(`{"192.0.2.1": {"Service": "web", "Team": "frontend"}}`), 0644)
+
+	l, err := core.NewLookupTable(path, "server_ip", "", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ioutil.WriteFile(path, []byte(`{"192.0.2.1": {"Service": "api", "Team": "backend"}}`), 0644)
+	// Make sure that the modification time changes, even on filesystems with
+	// coarse timestamps.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := lookupServices(l, "192.0.2.1")
+		if got[0] == "api/backend" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("LookupTable didn't reload the file: got %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLookupTableBadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers.csv")
+	ioutil.WriteFile(path, []byte("ip,Service\n192.0.2.1,web\n"), 0644)
+
+	for _, config := range []string{
+		`field = "server_ip"`,
+		fmt.Sprintf("path = %q", path),
+		fmt.Sprintf("path = %q\nfield = \"nonexistent\"", path),
+		fmt.Sprintf("path = %q\nfield = \"server_ip\"", filepath.Join(dir, "nonexistent.csv")),
+		fmt.Sprintf("path = %q\nfield = \"server_ip\"\nkey_column = \"host\"", path),
+		fmt.Sprintf("path = %q\nfield = \"server_ip\"\nreload_interval = \"soon\"", path),
+		fmt.Sprintf("path = %q\nfield = \"server_ip\"\nreload_interval = \"-1s\"", path),
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"LookupTable\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// DefaultNetworkLabelFormat is the format that NetworkLabel uses by default,
+// which gives labels like `AS15169 Google US`.
+const DefaultNetworkLabelFormat = "AS{ASN} {ASOrganization} {Country}"
+
+// annotationPlaceholder matches the placeholders in a NetworkLabel's format.
+var annotationPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// NetworkLabel is a pipeline processor that combines several annotations about
+// the client's network (such as its AS number, the organization that the AS
+// belongs to, and its country, which a GeoIP lookup earlier in the pipeline
+// can provide) into a single human-readable annotation, which is handy as a
+// dashboard label.
+//
+// The label comes from Format, where placeholders such as `{ASN}` are replaced
+// by the value of that annotation.  As in Where's conditions, we fall back on
+// the batch's annotation if a report doesn't have one.  Any word (that is, a
+// run of non-space characters) of the format that refers to a missing or empty
+// annotation is left out, so `AS{ASN}` disappears entirely if there's no ASN.
+// Reports that don't have any of the annotations don't get a label.
+type NetworkLabel struct {
+	Format     string
+	Annotation string
+
+	// words holds each word of Format, and the annotations that it refers to.
+	words []networkLabelWord
+}
+
+type networkLabelWord struct {
+	text        string
+	annotations []annotationRef
+}
+
+// NewNetworkLabel creates a new NetworkLabel processor that saves labels with
+// the given format in the Network annotation.
+func NewNetworkLabel(format string) (*NetworkLabel, error) {
+	n := &NetworkLabel{Format: format, Annotation: "Network"}
+	var placeholders int
+	for _, text := range strings.Fields(format) {
+		word := networkLabelWord{text: text}
+		for _, match := range annotationPlaceholder.FindAllStringSubmatch(text, -1) {
+			word.annotations = append(word.annotations, annotationRef{match[1]})
+		}
+		placeholders += len(word.annotations)
+		n.words = append(n.words, word)
+	}
+	if placeholders == 0 {
+		return nil, fmt.Errorf("no annotations in format %q", format)
+	}
+	return n, nil
+}
+
+// label returns the label for a report, or false if the report doesn't have
+// any of the annotations that the format uses.
+func (n *NetworkLabel) label(batch *collector.ReportBatch, report *collector.NelReport) (string, bool) {
+	var words []string
+	var found bool
+	for _, word := range n.words {
+		text := word.text
+		complete := true
+		for _, annotation := range word.annotations {
+			value, ok := routeValue(annotation.eval(batch, report))
+			if !ok || value == "" {
+				complete = false
+				break
+			}
+			found = true
+			text = strings.Replace(text, "{"+annotation.name+"}", value, -1)
+		}
+		if complete {
+			words = append(words, text)
+		}
+	}
+	return strings.Join(words, " "), found
+}
+
+// ProcessReports annotates each report in the batch with its network label.
+func (n *NetworkLabel) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if label, ok := n.label(batch, report); ok {
+			report.SetAnnotation(n.Annotation, label)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"NetworkLabel",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Format     string `toml:"format"`
+				Annotation string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Format == "" {
+				config.Format = DefaultNetworkLabelFormat
+			}
+
+			n, err := NewNetworkLabel(config.Format)
+			if err != nil {
+				return nil, fmt.Errorf("NetworkLabel invalid `format`: %v", err)
+			}
+			if config.Annotation != "" {
+				n.Annotation = config.Annotation
+			}
+			return n, nil
+		})
+}
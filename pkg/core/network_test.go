@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestNetworkLabel(t *testing.T) {
+	withAnnotations := func(annotations map[string]interface{}) collector.NelReport {
+		var report collector.NelReport
+		for name, value := range annotations {
+			report.SetAnnotation(name, value)
+		}
+		return report
+	}
+	batch := &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			withAnnotations(map[string]interface{}{"ASN": 15169, "ASOrganization": "Google", "Country": "US"}),
+			withAnnotations(map[string]interface{}{"ASN": 64500.0, "Country": "CA"}),
+			withAnnotations(map[string]interface{}{"ASOrganization": "Example Networks", "ASN": ""}),
+			withAnnotations(nil),
+		},
+	}
+	batch.Reports[3].SetAnnotation("Other", "x")
+	batch = pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "NetworkLabel"
+	`, batch)
+
+	var got []interface{}
+	for _, report := range batch.Reports {
+		got = append(got, report.GetAnnotation("Network"))
+	}
+	want := []interface{}{"AS15169 Google US", "AS64500 CA", "Example Networks", nil}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NetworkLabel got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkLabelCustomFormat(t *testing.T) {
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{{}}}
+	batch.SetAnnotation("Country", "DE")
+	batch.Reports[0].SetAnnotation("ASN", 3320)
+	batch = pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "NetworkLabel"
+		format = "{Country}/AS{ASN}"
+		annotation = "Net"
+	`, batch)
+	if got, want := batch.Reports[0].GetAnnotation("Net"), "DE/AS3320"; got != want {
+		t.Errorf("NetworkLabel got %v, wanted %v", got, want)
+	}
+}
+
+func TestNetworkLabelBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`format = "no placeholders"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"NetworkLabel\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
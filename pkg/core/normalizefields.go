@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// normalizableFields maps the name of each field that NormalizeFields can
+// normalize (as in Where's conditions) to a pointer to it.  They're all
+// case-insensitive tokens in practice, unlike (say) URLs.
+var normalizableFields = map[string]func(report *collector.NelReport) *string{
+	"report_type": func(r *collector.NelReport) *string { return &r.ReportType },
+	"type":        func(r *collector.NelReport) *string { return &r.Type },
+	"phase":       func(r *collector.NelReport) *string { return &r.Phase },
+	"protocol":    func(r *collector.NelReport) *string { return &r.Protocol },
+	"method":      func(r *collector.NelReport) *string { return &r.Method },
+	"server_ip":   func(r *collector.NelReport) *string { return &r.ServerIP },
+}
+
+// DefaultNormalizeFields are the fields that NormalizeFields normalizes by
+// default: the ones that the standard filters compare exactly.
+var DefaultNormalizeFields = []string{"report_type", "type", "phase"}
+
+// NormalizeFields is a pipeline processor that trims whitespace from some of
+// the fields of each report, and lowercases them, so that later processors
+// that compare them exactly (such as KeepNelReports, which looks for a
+// `report_type` of "network-error") aren't fooled by clients that send
+// ` Network-Error`.  The exception is `method`, which is uppercased instead,
+// since that's how HTTP methods are always written.  It should come before any
+// filters.
+//
+// The fields that can be normalized are `report_type`, `type`, `phase`,
+// `protocol`, `method`, and `server_ip`.
+type NormalizeFields struct {
+	fields []string
+	refs   []func(report *collector.NelReport) *string
+}
+
+// NewNormalizeFields creates a new NormalizeFields processor for the given
+// fields.  It returns an error if any of them can't be normalized.
+func NewNormalizeFields(fields []string) (*NormalizeFields, error) {
+	n := &NormalizeFields{fields: fields}
+	for _, field := range fields {
+		ref, ok := normalizableFields[field]
+		if !ok {
+			var names []string
+			for name := range normalizableFields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("can't normalize %s (must be one of %s)", field, strings.Join(names, ", "))
+		}
+		n.refs = append(n.refs, ref)
+	}
+	return n, nil
+}
+
+// ProcessReports normalizes the fields of each report in the batch.
+func (n *NormalizeFields) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		for j, ref := range n.refs {
+			value := ref(report)
+			if n.fields[j] == "method" {
+				*value = strings.ToUpper(strings.TrimSpace(*value))
+			} else {
+				*value = strings.ToLower(strings.TrimSpace(*value))
+			}
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"NormalizeFields",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Fields []string `toml:"fields"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Fields == nil {
+				config.Fields = DefaultNormalizeFields
+			}
+			n, err := NewNormalizeFields(config.Fields)
+			if err != nil {
+				return nil, fmt.Errorf("NormalizeFields invalid `fields`: %v", err)
+			}
+			return n, nil
+		})
+}
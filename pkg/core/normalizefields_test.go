@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func mixedCaseBatch() *collector.ReportBatch {
+	return &collector.ReportBatch{Reports: []collector.NelReport{
+		{ReportType: "network-error", Phase: "dns", Type: "dns.unreachable"},
+		{ReportType: "Network-Error", Phase: "DNS", Type: "DNS.Unreachable"},
+		{ReportType: " network-error\n", Phase: " connection ", Type: "tcp.reset\t"},
+	}}
+}
+
+func TestNormalizeFields(t *testing.T) {
+	// Without normalization, mixed-case reports slip past KeepNelReports.
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "KeepNelReports"
+	`, mixedCaseBatch())
+	if got, want := len(batch.Reports), 1; got != want {
+		t.Errorf("KeepNelReports kept %d reports without NormalizeFields, wanted %d", got, want)
+	}
+
+	batch = pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "NormalizeFields"
+		[[processor]]
+		type = "KeepNelReports"
+	`, mixedCaseBatch())
+	want := []collector.NelReport{
+		{ReportType: "network-error", Phase: "dns", Type: "dns.unreachable"},
+		{ReportType: "network-error", Phase: "dns", Type: "dns.unreachable"},
+		{ReportType: "network-error", Phase: "connection", Type: "tcp.reset"},
+	}
+	if diff := cmp.Diff(want, batch.Reports); diff != "" {
+		t.Errorf("NormalizeFields got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestNormalizeFieldsConfig(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "NormalizeFields"
+		fields = ["method", "protocol"]
+	`, &collector.ReportBatch{Reports: []collector.NelReport{
+		{ReportType: "Network-Error", Method: " post", Protocol: "H2 "},
+	}})
+	want := []collector.NelReport{{ReportType: "Network-Error", Method: "POST", Protocol: "h2"}}
+	if diff := cmp.Diff(want, batch.Reports); diff != "" {
+		t.Errorf("NormalizeFields got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestNormalizeFieldsBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`fields = ["url"]`,
+		`fields = ["nonexistent"]`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"NormalizeFields\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// NormalizeSampling is a pipeline processor that checks the sampling_fraction
+// of each `network-error` report, and annotates it with the report's weight:
+// the number of events that it stands for, which is the reciprocal of its
+// sampling fraction.  A client that reports 10% of its failures sends reports
+// with a sampling_fraction of 0.1, and so each of them gets a Weight of 10.
+// Aggregating by summing the weights of the reports, rather than counting
+// them, gives unbiased estimates of the number of events, even when clients
+// use different sampling fractions.  For dashboards that can only sum
+// integers, we also add an EstimatedOccurrences annotation, which is the
+// Weight rounded to the nearest integer.
+//
+// The NEL spec requires the sampling fraction to be greater than 0 and at most
+// 1.  (A missing sampling_fraction is parsed as 0, so it's invalid too.)  In
+// "drop" mode we throw reports with invalid sampling fractions away.  In
+// "annotate" mode we keep them, without a Weight, but with an annotation
+// (InvalidSamplingFraction by default) containing the invalid value.  In
+// "default" mode we add that annotation too, but treat the report as if it
+// had a sampling fraction of 1, so that it still counts as one event.
+//
+// The Weight only accounts for the sampling that the client did.  Processors
+// that sample reports in the collector, such as SampleReports, record their
+// own sampling in a separate SamplingWeight annotation; multiply the two to
+// get the overall weight.  Reports of other types are left alone.
+type NormalizeSampling struct {
+	Mode       string
+	Annotation string
+}
+
+// ProcessReports drops or annotates each report with an invalid sampling
+// fraction, and sets the Weight of the others.
+func (n *NormalizeSampling) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var filtered []collector.NelReport
+	for _, report := range batch.Reports {
+		if report.ReportType != "network-error" {
+			filtered = append(filtered, report)
+			continue
+		}
+		fraction := float64(report.SamplingFraction)
+		if fraction <= 0 || fraction > 1 {
+			if n.Mode == "drop" {
+				continue
+			}
+			report.SetAnnotation(n.Annotation, fraction)
+			if n.Mode == "annotate" {
+				filtered = append(filtered, report)
+				continue
+			}
+			fraction = 1
+		}
+		report.SetAnnotation("Weight", 1/fraction)
+		report.SetAnnotation("EstimatedOccurrences", int64(math.Round(1/fraction)))
+		filtered = append(filtered, report)
+	}
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"NormalizeSampling",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Mode       string `toml:"mode"`
+				Annotation string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			n := &NormalizeSampling{Mode: config.Mode, Annotation: config.Annotation}
+			switch n.Mode {
+			case "":
+				n.Mode = "drop"
+			case "drop", "annotate", "default":
+			default:
+				return nil, fmt.Errorf("NormalizeSampling invalid `mode`: %s", config.Mode)
+			}
+			if n.Annotation == "" {
+				n.Annotation = "InvalidSamplingFraction"
+			}
+			return n, nil
+		})
+}
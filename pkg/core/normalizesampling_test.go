@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestNormalizeSampling(t *testing.T) {
+	cases := []struct {
+		mode string
+		want []string
+	}{
+		{"drop", []string{"1 1 <nil>", "4 4 <nil>", "1.6 2 <nil>", "<nil> <nil> <nil>"}},
+		{"annotate", []string{"1 1 <nil>", "4 4 <nil>", "1.6 2 <nil>", "<nil> <nil> 0", "<nil> <nil> 1.5", "<nil> <nil> <nil>"}},
+		{"default", []string{"1 1 <nil>", "4 4 <nil>", "1.6 2 <nil>", "1 1 0", "1 1 1.5", "<nil> <nil> <nil>"}},
+	}
+	for _, c := range cases {
+		batch := pipelinetest.RunTestConfig(fmt.Sprintf(`
+			[[processor]]
+			type = "NormalizeSampling"
+			mode = "%s"
+		`, c.mode), &collector.ReportBatch{
+			Reports: []collector.NelReport{
+				{ReportType: "network-error", SamplingFraction: 1},
+				{ReportType: "network-error", SamplingFraction: 0.25},
+				{ReportType: "network-error", SamplingFraction: 0.625},
+				{ReportType: "network-error"},
+				{ReportType: "network-error", SamplingFraction: 1.5},
+				{ReportType: "csp-violation"},
+			},
+		})
+		var got []string
+		for _, report := range batch.Reports {
+			got = append(got, fmt.Sprintf("%v %v %v", report.GetAnnotation("Weight"), report.GetAnnotation("EstimatedOccurrences"), report.GetAnnotation("InvalidSamplingFraction")))
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("NormalizeSampling(mode=%s) got diff (-want +got):\n%s", c.mode, diff)
+		}
+	}
+}
+
+func TestNormalizeSamplingBadConfig(t *testing.T) {
+	var pipeline collector.Pipeline
+	config := "[[processor]]\ntype = \"NormalizeSampling\"\nmode = \"reweight\""
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+		t.Errorf("LoadFromConfig(%s) should return error", config)
+	}
+}
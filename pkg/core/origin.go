@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// parsedOrigin is the tuple origin of a URL, with the host converted to its
+// canonical ASCII form.
+type parsedOrigin struct {
+	Scheme string
+	Host   string
+	Port   string
+}
+
+// parseOrigin extracts the origin of a URL.  It returns false if the URL can't
+// be parsed, or if it has an opaque origin (for instance, if it's not an HTTP
+// URL).
+func parseOrigin(rawurl string) (parsedOrigin, bool) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return parsedOrigin{}, false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	defaultPort, ok := defaultPorts[scheme]
+	if !ok || u.Hostname() == "" {
+		return parsedOrigin{}, false
+	}
+	host, ok := canonicalHost(u.Hostname())
+	if !ok {
+		return parsedOrigin{}, false
+	}
+	port := u.Port()
+	if port == defaultPort {
+		port = ""
+	}
+	return parsedOrigin{scheme, host, port}, true
+}
+
+// canonicalHost lowercases a hostname and converts any internationalized labels
+// to their punycode form.  IP addresses are returned unchanged.
+func canonicalHost(host string) (string, bool) {
+	if net.ParseIP(host) != nil {
+		return strings.ToLower(host), true
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", false
+	}
+	return ascii, true
+}
+
+// String serializes an origin the same way that browsers do.
+func (o parsedOrigin) String() string {
+	host := o.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if o.Port != "" {
+		host += ":" + o.Port
+	}
+	return o.Scheme + "://" + host
+}
+
+// registrableDomain returns the registrable domain (or "eTLD+1") of a
+// canonicalized host, according to the public suffix list.  It returns false
+// for IP addresses, and for hosts that are themselves public suffixes.
+func registrableDomain(host string) (string, bool) {
+	if net.ParseIP(host) != nil {
+		return "", false
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", false
+	}
+	return domain, true
+}
+
+// AnnotateOrigin is a pipeline processor that parses the URL of each report,
+// and saves its origin in an annotation named Origin.  Default ports are
+// omitted, and internationalized hostnames are converted to punycode, so that
+// URLs with the same origin always produce the same annotation.  URLs with an
+// opaque origin are annotated with "null".
+//
+// If RegistrableDomain is true, we also save the registrable domain of the
+// URL's host (its "eTLD+1", according to the public suffix list) in an
+// annotation named RegistrableDomain.  This annotation is omitted if the host
+// is an IP address or a public suffix.
+type AnnotateOrigin struct {
+	RegistrableDomain bool
+}
+
+// ProcessReports annotates each report with the origin of its URL.
+func (a AnnotateOrigin) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		origin, ok := parseOrigin(report.URL)
+		if !ok {
+			report.SetAnnotation("Origin", "null")
+			continue
+		}
+		report.SetAnnotation("Origin", origin.String())
+		if a.RegistrableDomain {
+			if domain, ok := registrableDomain(origin.Host); ok {
+				report.SetAnnotation("RegistrableDomain", domain)
+			}
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"AnnotateOrigin",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				RegistrableDomain bool `toml:"registrable_domain"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			return AnnotateOrigin{config.RegistrableDomain}, nil
+		})
+}
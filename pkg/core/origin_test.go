@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestAnnotateOrigin(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestAnnotateOrigin",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "AnnotateOrigin"
+			registrable_domain = true
+			[[processor]]
+			type = "EncodeBatchAsResult"
+		`),
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+func TestAnnotateOriginURLs(t *testing.T) {
+	cases := []struct {
+		url, origin string
+		domain      interface{}
+	}{
+		{"https://example.com/about/", "https://example.com", "example.com"},
+		{"HTTPS://WWW.Example.COM:443/", "https://www.example.com", "example.com"},
+		{"http://example.com:80/", "http://example.com", "example.com"},
+		{"http://example.com:8080/", "http://example.com:8080", "example.com"},
+		{"https://www.example.co.uk/", "https://www.example.co.uk", "example.co.uk"},
+		{"https://bücher.example/", "https://xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"https://[2001:DB8::1]:443/", "https://[2001:db8::1]", nil},
+		{"https://192.0.2.1:8443/", "https://192.0.2.1:8443", nil},
+		{"https://co.uk/", "https://co.uk", nil},
+		{"data:text/plain,hello", "null", nil},
+		{"", "null", nil},
+	}
+	for _, c := range cases {
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{{URL: c.url}}}
+		core.AnnotateOrigin{RegistrableDomain: true}.ProcessReports(context.Background(), batch)
+		if got := batch.Reports[0].GetAnnotation("Origin"); got != c.origin {
+			t.Errorf("AnnotateOrigin(%q) Origin = %v, wanted %v", c.url, got, c.origin)
+		}
+		if got := batch.Reports[0].GetAnnotation("RegistrableDomain"); got != c.domain {
+			t.Errorf("AnnotateOrigin(%q) RegistrableDomain = %v, wanted %v", c.url, got, c.domain)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// OutageEvent describes a suspected outage that an OutageDetector has found.
+type OutageEvent struct {
+	// The value of the OutageDetector's key field that the reports shared,
+	// which is usually the host that they were about.
+	Key string
+
+	// The estimated number of failures per second over the short window, and
+	// over the long window.
+	Rate     float64
+	Baseline float64
+
+	Time time.Time
+}
+
+// decayingRate is an exponentially decaying count of events, which (divided
+// by its time constant) estimates how often the events happen.
+type decayingRate struct {
+	count   float64
+	updated time.Time
+}
+
+func (r *decayingRate) add(n float64, now time.Time, tau time.Duration) float64 {
+	if !r.updated.IsZero() && now.After(r.updated) {
+		r.count *= math.Exp(-float64(now.Sub(r.updated)) / float64(tau))
+	}
+	if now.After(r.updated) {
+		r.updated = now
+	}
+	r.count += n
+	return r.count
+}
+
+type outageState struct {
+	short, long decayingRate
+	firstSeen   time.Time
+	suspected   bool
+}
+
+// OutageDetector is a pipeline processor that notices when the rate of
+// failures for a host suddenly spikes above its usual level, which usually
+// means that something is broken.
+//
+// We count the `network-error` reports (other than successful ones) for each
+// host, with exponentially decaying counts whose time constants are
+// ShortWindow and LongWindow, and so estimate the host's recent failure rate
+// and its baseline rate.  An outage is suspected when the recent rate is more
+// than Threshold times the baseline, and there have been at least MinReports
+// recent failures; it's over once that's no longer true.  (That includes when
+// a long outage has lasted long enough to become the new baseline.)  Until
+// we've seen failures for a host for LongWindow, we estimate its baseline from
+// the failures since we first saw one, so hosts that we haven't seen before
+// don't look like they're having an outage.
+//
+// While an outage is suspected, each of the host's failure reports gets an
+// OutageSuspected annotation.  When an outage starts, we also send a copy of
+// the batch containing just the host's reports to the Alert chain, if there is
+// one, with an Outage annotation on the batch containing an OutageEvent.  If
+// AlertResolved is set, we also send the Alert chain a batch when an outage
+// ends, with an OutageResolved annotation instead.  (We can only tell that an
+// outage has ended when more failures for the host arrive.)
+//
+// We track at most MaxKeys hosts at a time, forgetting about the ones that
+// we've heard from least recently.
+type OutageDetector struct {
+	ShortWindow time.Duration
+	LongWindow  time.Duration
+	Threshold   float64
+	MinReports  int
+	MaxKeys     int
+	Alert       []collector.ReportProcessor
+
+	AlertResolved bool
+
+	// Clock is used to decay the counts.  If nil, we use the current time.
+	Clock collector.Clock
+
+	key    func(report *collector.NelReport) (string, bool)
+	mu     sync.Mutex
+	states *ttlCache
+}
+
+// NewOutageDetector creates a new OutageDetector, which tracks the failure
+// rate separately for each value of field.  The field can be "host", for the
+// host of each report's URL, or any of the fields that Where's conditions can
+// use.
+func NewOutageDetector(field string, shortWindow, longWindow time.Duration, threshold float64) (*OutageDetector, error) {
+	d := &OutageDetector{
+		ShortWindow: shortWindow,
+		LongWindow:  longWindow,
+		Threshold:   threshold,
+		MinReports:  10,
+		MaxKeys:     10000,
+	}
+	key, err := reportKey(field)
+	if err != nil {
+		return nil, err
+	}
+	d.key = key
+	return d, nil
+}
+
+// reportKey returns a function that extracts the value of a field from a
+// report, for processors that keep track of something separately for each
+// value.  The field can be "host", for the host of each report's URL, or any
+// of the fields that Where's conditions can use.  The function returns false
+// if the report doesn't have a value, such as when its URL can't be parsed.
+func reportKey(field string) (func(report *collector.NelReport) (string, bool), error) {
+	if field == "host" {
+		return func(report *collector.NelReport) (string, bool) {
+			origin, ok := parseOrigin(report.URL)
+			return origin.Host, ok
+		}, nil
+	}
+	get, ok := reportFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", field)
+	}
+	return func(report *collector.NelReport) (string, bool) {
+		return routeValue(get(report))
+	}, nil
+}
+
+func (d *OutageDetector) now() time.Time {
+	if d.Clock == nil {
+		return time.Now()
+	}
+	return d.Clock.Now()
+}
+
+// state returns the state for a key, creating it if needed.  d.mu must be
+// held.
+func (d *OutageDetector) state(key string, now time.Time) *outageState {
+	if d.states == nil {
+		d.states = newTTLCache(d.MaxKeys, 0)
+	}
+	if state, ok := d.states.get(key, now); ok {
+		return state.(*outageState)
+	}
+	state := &outageState{firstSeen: now}
+	d.states.add(key, state, now)
+	return state
+}
+
+func isFailure(report *collector.NelReport) bool {
+	return report.ReportType == "network-error" && report.Type != "ok"
+}
+
+// ProcessReports updates the failure rate for each host in the batch, and
+// annotates the reports for any hosts that seem to be having an outage.
+func (d *OutageDetector) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := d.now()
+	counts := make(map[string]int)
+	var keys []string
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if !isFailure(report) {
+			continue
+		}
+		if key, ok := d.key(report); ok {
+			if counts[key] == 0 {
+				keys = append(keys, key)
+			}
+			counts[key]++
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	suspected := make(map[string]bool)
+	var events, resolved []OutageEvent
+	d.mu.Lock()
+	for _, key := range keys {
+		state := d.state(key, now)
+		n := float64(counts[key])
+		recent := state.short.add(n, now, d.ShortWindow)
+		total := state.long.add(n, now, d.LongWindow)
+		// The decayed count only reaches its steady state once the host has been
+		// tracked for about one time constant; until then, we spread it over the
+		// time that we've been tracking the host instead.
+		longWindow := now.Sub(state.firstSeen)
+		if longWindow < d.ShortWindow {
+			longWindow = d.ShortWindow
+		} else if longWindow > d.LongWindow {
+			longWindow = d.LongWindow
+		}
+		rate := recent / d.ShortWindow.Seconds()
+		baseline := total / longWindow.Seconds()
+		outage := recent >= float64(d.MinReports) && rate > d.Threshold*baseline
+		if outage && !state.suspected {
+			events = append(events, OutageEvent{Key: key, Rate: rate, Baseline: baseline, Time: now})
+		} else if !outage && state.suspected && d.AlertResolved {
+			resolved = append(resolved, OutageEvent{Key: key, Rate: rate, Baseline: baseline, Time: now})
+		}
+		state.suspected = outage
+		suspected[key] = outage
+	}
+	d.mu.Unlock()
+
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if !isFailure(report) {
+			continue
+		}
+		if key, ok := d.key(report); ok && suspected[key] {
+			report.SetAnnotation("OutageSuspected", true)
+		}
+	}
+	if len(d.Alert) == 0 {
+		return
+	}
+	for _, event := range events {
+		d.alert(ctx, batch, "Outage", event)
+	}
+	for _, event := range resolved {
+		d.alert(ctx, batch, "OutageResolved", event)
+	}
+}
+
+// alert sends a copy of the batch, containing just the failure reports for an
+// event's host, to the Alert chain.
+func (d *OutageDetector) alert(ctx context.Context, batch *collector.ReportBatch, annotation string, event OutageEvent) {
+	clone := batch.Clone()
+	var reports []collector.NelReport
+	for _, report := range clone.Reports {
+		if key, ok := d.key(&report); ok && key == event.Key && isFailure(&report) {
+			reports = append(reports, report)
+		}
+	}
+	clone.Reports = reports
+	clone.SetAnnotation(annotation, event)
+	runChain(ctx, d.Alert, clone)
+}
+
+// Close closes any processors in the Alert chain that need to be closed.
+func (d *OutageDetector) Close() error {
+	return collector.CloseProcessors(d.Alert)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"OutageDetector",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Field       string           `toml:"field"`
+				ShortWindow string           `toml:"short_window"`
+				LongWindow  string           `toml:"long_window"`
+				Threshold   *float64         `toml:"threshold"`
+				MinReports  *int             `toml:"min_reports"`
+				MaxKeys     *int             `toml:"max_keys"`
+				Alert       []toml.Primitive `toml:"alert"`
+
+				AlertResolved bool `toml:"alert_resolved"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Field == "" {
+				config.Field = "host"
+			}
+			shortWindow := time.Minute
+			if config.ShortWindow != "" {
+				shortWindow, err = time.ParseDuration(config.ShortWindow)
+				if err != nil {
+					return nil, fmt.Errorf("OutageDetector invalid `short_window`: %v", err)
+				}
+				if shortWindow <= 0 {
+					return nil, fmt.Errorf("OutageDetector `short_window` must be positive")
+				}
+			}
+			longWindow := time.Hour
+			if config.LongWindow != "" {
+				longWindow, err = time.ParseDuration(config.LongWindow)
+				if err != nil {
+					return nil, fmt.Errorf("OutageDetector invalid `long_window`: %v", err)
+				}
+			}
+			if longWindow <= shortWindow {
+				return nil, fmt.Errorf("OutageDetector `long_window` must be longer than `short_window`")
+			}
+			threshold := 5.0
+			if config.Threshold != nil {
+				threshold = *config.Threshold
+				if threshold <= 1 {
+					return nil, fmt.Errorf("OutageDetector `threshold` must be greater than 1")
+				}
+			}
+
+			d, err := NewOutageDetector(config.Field, shortWindow, longWindow, threshold)
+			if err != nil {
+				return nil, fmt.Errorf("OutageDetector invalid `field`: %s", config.Field)
+			}
+			if config.MinReports != nil {
+				if *config.MinReports < 1 {
+					return nil, fmt.Errorf("OutageDetector `min_reports` must be positive")
+				}
+				d.MinReports = *config.MinReports
+			}
+			if config.MaxKeys != nil {
+				if *config.MaxKeys < 1 {
+					return nil, fmt.Errorf("OutageDetector `max_keys` must be positive")
+				}
+				d.MaxKeys = *config.MaxKeys
+			}
+			d.Clock = clock
+			d.AlertResolved = config.AlertResolved
+			d.Alert, err = collector.LoadProcessors(ctx, config.Alert)
+			if err != nil {
+				return nil, fmt.Errorf("OutageDetector alert: %v", err)
+			}
+			return d, nil
+		})
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestOutageDetector(t *testing.T) {
+	var alerts []string
+	record := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		if event, ok := batch.GetAnnotation("Outage").(core.OutageEvent); ok {
+			alerts = append(alerts, fmt.Sprintf("%s %s %d", event.Time.Format("15:04:05"), event.Key, len(batch.Reports)))
+		}
+		if event, ok := batch.GetAnnotation("OutageResolved").(core.OutageEvent); ok {
+			alerts = append(alerts, fmt.Sprintf("%s %s resolved", event.Time.Format("15:04:05"), event.Key))
+		}
+	})
+
+	clock := pipelinetest.NewSimulatedClock()
+	d, err := core.NewOutageDetector("host", time.Minute, time.Hour, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Clock = clock
+	d.Alert = []collector.ReportProcessor{record}
+	d.AlertResolved = true
+	ctx := context.Background()
+
+	// Each batch covers ten seconds, and contains the given number of failures
+	// for a.example (along with a successful report), and one failure for
+	// b.example.  It returns how many reports were annotated.
+	process := func(failures int) int {
+		clock.CurrentTime = clock.CurrentTime.Add(10 * time.Second)
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{
+			{ReportType: "network-error", URL: "https://a.example/", Type: "ok"},
+			{ReportType: "network-error", URL: "https://b.example/", Type: "tcp.timed_out"},
+		}}
+		for i := 0; i < failures; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", URL: "https://A.example:443/", Type: "tcp.reset"})
+		}
+		d.ProcessReports(ctx, batch)
+		var annotated int
+		for _, report := range batch.Reports {
+			if report.GetAnnotation("OutageSuspected") == true {
+				if report.Type == "ok" || report.URL == "https://b.example/" {
+					t.Fatalf("OutageDetector annotated %+v", report)
+				}
+				annotated++
+			}
+		}
+		return annotated
+	}
+
+	// Two hours of a steady baseline shouldn't look like an outage.
+	for i := 0; i < 720; i++ {
+		if n := process(5); n != 0 {
+			t.Fatalf("OutageDetector annotated %d reports during the baseline", n)
+		}
+	}
+	// A tenfold spike should, once it's been going on for long enough to
+	// affect the short window.
+	var annotated []int
+	for i := 0; i < 6; i++ {
+		annotated = append(annotated, process(50))
+	}
+	if diff := cmp.Diff([]int{0, 0, 50, 50, 50, 50}, annotated); diff != "" {
+		t.Errorf("OutageDetector annotated diff (-want +got):\n%s", diff)
+	}
+	for i := 0; i < 60; i++ {
+		process(5)
+	}
+	if n := process(5); n != 0 {
+		t.Errorf("OutageDetector annotated %d reports after the spike", n)
+	}
+
+	want := []string{"02:00:30 a.example 50", "02:01:30 a.example resolved"}
+	if diff := cmp.Diff(want, alerts); diff != "" {
+		t.Errorf("OutageDetector alerts diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestOutageDetectorMinReports(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	d, err := core.NewOutageDetector("host", time.Minute, time.Hour, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Clock = clock
+	ctx := context.Background()
+	process := func(failures int) interface{} {
+		batch := &collector.ReportBatch{}
+		for i := 0; i < failures; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", URL: "https://a.example/", Type: "dns.name_not_resolved"})
+		}
+		d.ProcessReports(ctx, batch)
+		return batch.Reports[0].GetAnnotation("OutageSuspected")
+	}
+
+	// One failure a minute for two hours...
+	for i := 0; i < 120; i++ {
+		clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+		process(1)
+	}
+	// ...followed by nine all at once is a big spike, but too few reports to
+	// suspect an outage.  One more is enough.
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	if got := process(9); got != nil {
+		t.Errorf("OutageDetector set OutageSuspected to %v after 9 reports", got)
+	}
+	if got := process(1); got != true {
+		t.Errorf("OutageDetector set OutageSuspected to %v after 10 reports", got)
+	}
+}
+
+func TestOutageDetectorBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`field = "nonexistent"`,
+		`short_window = "soon"`,
+		`short_window = "-1s"`,
+		`long_window = "1m"`,
+		`threshold = 0.5`,
+		`min_reports = 0`,
+		`max_keys = 0`,
+		"[[processor.alert]]\ntype = \"Nonexistent\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"OutageDetector\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// A Tenant is one of the tenants of a multi-tenant collector, which owns the
+// reports for a set of registrable domains, and has its own chain of
+// processors (and so its own sinks and credentials) for them.
+type Tenant struct {
+	Name       string
+	Domains    []string
+	Processors []collector.ReportProcessor
+}
+
+// PerTenantRoute is a pipeline processor that isolates the reports of each
+// tenant of a multi-tenant collector.  Each report is sent to the chain of
+// processors of the tenant that owns its URL's registrable domain (see
+// DomainInfo, whose RegistrableDomain annotation we reuse if it's there), and
+// annotated with the tenant's name, in the Tenant annotation.  As with
+// RouteBy, each tenant's chain receives its own copy of the batch (see
+// ReportBatch.Clone) containing just that tenant's reports.
+//
+// Unlike RouteBy, the reports that are sent to a tenant are removed from the
+// original batch, so that no processor after PerTenantRoute can see them, and
+// one tenant's reports can never end up in a sink that's shared by all of
+// them.  Reports that don't belong to any tenant (including ones whose URL
+// doesn't have a registrable domain) are dropped, unless KeepUnknown is set,
+// in which case they're left in the batch for the later processors.
+//
+// The tenants are read from a TOML file, which lists each tenant's name,
+// domains, and processors, nested in the same way as the children of a
+// composite processor (see collector.LoadChildProcessors):
+//
+//	[[tenant]]
+//	name = "example"
+//	domains = ["example.com", "example.co.uk"]
+//
+//	[[tenant.children]]
+//	type = "WebhookPublisher"
+//	url = "https://reports.example.com/nel"
+//
+// You can call Reload to read the file again; or, if you give
+// NewPerTenantRoute a reload interval, we check that often whether the file
+// has been modified, and read it again if it has.  The old tenants' processors
+// are closed once any batches that they're handling have finished.  If the new
+// contents are invalid, we log an error and carry on using the old tenants.
+type PerTenantRoute struct {
+	Path        string
+	KeepUnknown bool
+
+	ctx     context.Context
+	mu      sync.RWMutex
+	tenants []Tenant
+	domains map[string]int
+	modTime time.Time
+	dropped int64
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewPerTenantRoute creates a new PerTenantRoute processor, which reads its
+// tenants from the file in path.  It returns an error if the file can't be
+// read, or any of its tenants are invalid.  The tenants' processors are
+// created using ctx, as with collector.LoadProcessors.  If reloadInterval is
+// nonzero, we also start checking for changes to the file in the background;
+// Close stops checking.
+func NewPerTenantRoute(ctx context.Context, path string, reloadInterval time.Duration) (*PerTenantRoute, error) {
+	r := &PerTenantRoute{Path: path, ctx: ctx}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		r.done = make(chan struct{})
+		r.wg.Add(1)
+		go r.run(reloadInterval)
+	}
+	return r, nil
+}
+
+func (r *PerTenantRoute) run(interval time.Duration) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(r.Path)
+			if err != nil {
+				log.Printf("PerTenantRoute: %v", err)
+				continue
+			}
+			r.mu.RLock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Printf("PerTenantRoute: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// closeTenants closes the processors of a set of tenants.
+func closeTenants(tenants []Tenant) error {
+	var result error
+	for _, tenant := range tenants {
+		if err := collector.CloseProcessors(tenant.Processors); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// loadTenants creates the tenants in a tenant file, and returns them along
+// with a map from each of their domains to their index.
+func loadTenants(ctx context.Context, data []byte) ([]Tenant, map[string]int, error) {
+	var config struct {
+		Tenants []toml.Primitive `toml:"tenant"`
+	}
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+
+	var tenants []Tenant
+	domains := make(map[string]int)
+	names := make(map[string]bool)
+	for idx, tenantPrimitive := range config.Tenants {
+		err := func() error {
+			var tenantConfig struct {
+				Name    string   `toml:"name"`
+				Domains []string `toml:"domains"`
+			}
+			if err := toml.PrimitiveDecode(tenantPrimitive, &tenantConfig); err != nil {
+				return fmt.Errorf("tenant %d: %v", idx, err)
+			}
+			if tenantConfig.Name == "" {
+				return fmt.Errorf("tenant %d missing `name`", idx)
+			}
+			if names[tenantConfig.Name] {
+				return fmt.Errorf("tenant %d has duplicate `name` %q", idx, tenantConfig.Name)
+			}
+			names[tenantConfig.Name] = true
+			if len(tenantConfig.Domains) == 0 {
+				return fmt.Errorf("tenant %s missing `domains`", tenantConfig.Name)
+			}
+			tenant := Tenant{Name: tenantConfig.Name}
+			for _, domain := range tenantConfig.Domains {
+				host, err := parseRegistrableDomain(domain)
+				if err != nil {
+					return fmt.Errorf("tenant %s invalid `domains`: %v", tenant.Name, err)
+				}
+				if owner, ok := domains[host]; ok {
+					return fmt.Errorf("tenant %s has domain %s, which already belongs to %s", tenant.Name, host, tenants[owner].Name)
+				}
+				domains[host] = len(tenants)
+				tenant.Domains = append(tenant.Domains, host)
+			}
+			processors, err := collector.LoadChildProcessors(ctx, tenantPrimitive)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %v", tenant.Name, err)
+			}
+			if len(processors) == 0 {
+				return fmt.Errorf("tenant %s missing `children`", tenant.Name)
+			}
+			tenant.Processors = processors
+			tenants = append(tenants, tenant)
+			return nil
+		}()
+		if err != nil {
+			closeTenants(tenants)
+			return nil, nil, err
+		}
+	}
+	return tenants, domains, nil
+}
+
+// Reload reads the tenants from Path again, and creates their processors.
+// If the file can't be read, or any of its tenants are invalid, we return an
+// error and keep using the old tenants.
+func (r *PerTenantRoute) Reload() error {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return err
+	}
+	tenants, domains, err := loadTenants(r.ctx, data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", r.Path, err)
+	}
+
+	// Taking the write lock waits for any batches that the old tenants are
+	// handling, so it's safe to close them once we have it.
+	r.mu.Lock()
+	old := r.tenants
+	r.tenants = tenants
+	r.domains = domains
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+	if err := closeTenants(old); err != nil {
+		log.Printf("PerTenantRoute: closing old tenants: %v", err)
+	}
+	return nil
+}
+
+// Tenants returns the names of the current tenants.
+func (r *PerTenantRoute) Tenants() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, len(r.tenants))
+	for i, tenant := range r.tenants {
+		names[i] = tenant.Name
+	}
+	return names
+}
+
+// Dropped returns the number of reports that the processor has thrown away
+// because they didn't belong to any tenant.
+func (r *PerTenantRoute) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+// ProcessReports sends each report in the batch to its tenant's processors,
+// and removes it from the batch.
+func (r *PerTenantRoute) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// routed[i] holds the indexes of the reports for the ith tenant.
+	routed := make([][]int, len(r.tenants))
+	var unknown []collector.NelReport
+	for i := range batch.Reports {
+		domain, ok := reportDomain(&batch.Reports[i])
+		if tenant, found := r.domains[domain]; ok && found {
+			routed[tenant] = append(routed[tenant], i)
+			continue
+		}
+		if r.KeepUnknown {
+			unknown = append(unknown, batch.Reports[i])
+		}
+	}
+
+	for i, indexes := range routed {
+		if len(indexes) == 0 {
+			continue
+		}
+		tenant := r.tenants[i]
+		clone := batch.Clone()
+		reports := make([]collector.NelReport, len(indexes))
+		for j, idx := range indexes {
+			reports[j] = clone.Reports[idx]
+			reports[j].SetAnnotation("Tenant", tenant.Name)
+		}
+		clone.Reports = reports
+		runChain(ctx, tenant.Processors, clone)
+	}
+	if !r.KeepUnknown {
+		dropped := len(batch.Reports)
+		for _, indexes := range routed {
+			dropped -= len(indexes)
+		}
+		atomic.AddInt64(&r.dropped, int64(dropped))
+	}
+	batch.Reports = unknown
+}
+
+// Close stops checking for changes to the file, and closes the tenants'
+// processors.
+func (r *PerTenantRoute) Close() error {
+	if r.done != nil {
+		close(r.done)
+		r.wg.Wait()
+		r.done = nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := closeTenants(r.tenants)
+	r.tenants = nil
+	r.domains = nil
+	return err
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"PerTenantRoute",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Path           string `toml:"path"`
+				Unknown        string `toml:"unknown_tenants"`
+				ReloadInterval string `toml:"reload_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Path == "" {
+				return nil, fmt.Errorf("PerTenantRoute missing `path`")
+			}
+			switch config.Unknown {
+			case "", "drop", "keep":
+			default:
+				return nil, fmt.Errorf("PerTenantRoute invalid `unknown_tenants`: %s", config.Unknown)
+			}
+			var reloadInterval time.Duration
+			if config.ReloadInterval != "" {
+				reloadInterval, err = time.ParseDuration(config.ReloadInterval)
+				if err != nil {
+					return nil, fmt.Errorf("PerTenantRoute invalid `reload_interval`: %v", err)
+				}
+				if reloadInterval <= 0 {
+					return nil, fmt.Errorf("PerTenantRoute `reload_interval` must be positive")
+				}
+			}
+
+			r, err := NewPerTenantRoute(ctx, config.Path, reloadInterval)
+			if err != nil {
+				return nil, fmt.Errorf("PerTenantRoute invalid `path`: %v", err)
+			}
+			r.KeepUnknown = config.Unknown == "keep"
+			return r, nil
+		})
+}
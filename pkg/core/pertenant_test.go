@@ -0,0 +1,224 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// tenantSinks records the reports that each RecordTenant processor sees, and
+// which of them have been closed.
+var tenantSinks = struct {
+	sync.Mutex
+	seen   map[string][]string
+	closed map[string]bool
+}{seen: make(map[string][]string), closed: make(map[string]bool)}
+
+type recordTenant struct {
+	sink string
+}
+
+func (r recordTenant) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	tenantSinks.Lock()
+	defer tenantSinks.Unlock()
+	for _, report := range batch.Reports {
+		tenantSinks.seen[r.sink] = append(tenantSinks.seen[r.sink], fmt.Sprintf("%s %v", report.URL, report.GetAnnotation("Tenant")))
+	}
+}
+
+func (r recordTenant) Close() error {
+	tenantSinks.Lock()
+	defer tenantSinks.Unlock()
+	tenantSinks.closed[r.sink] = true
+	return nil
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc("RecordTenant", func(ctx context.Context, config toml.Primitive) (collector.ReportProcessor, error) {
+		var sink struct {
+			Sink string `toml:"sink"`
+		}
+		if err := collector.DecodeConfig(ctx, config, &sink); err != nil {
+			return nil, err
+		}
+		return recordTenant{sink.Sink}, nil
+	})
+}
+
+func resetTenantSinks() {
+	tenantSinks.Lock()
+	defer tenantSinks.Unlock()
+	tenantSinks.seen = make(map[string][]string)
+	tenantSinks.closed = make(map[string]bool)
+}
+
+const tenantFile = `
+[[tenant]]
+name = "acme"
+domains = ["acme.com", "acme.co.uk"]
+[[tenant.children]]
+type = "RecordTenant"
+sink = "acme-sink"
+
+[[tenant]]
+name = "globex"
+domains = ["globex.example"]
+[[tenant.children]]
+type = "RecordTenant"
+sink = "globex-sink"
+`
+
+func tenantBatch() *collector.ReportBatch {
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{
+		{URL: "https://www.acme.com/"},
+		{URL: "https://globex.example/a"},
+		{URL: "https://shop.acme.co.uk/"},
+		{URL: "https://initech.example/"},
+		{URL: "https://192.0.2.1/"},
+	}}
+	// An earlier DomainInfo's annotation is trusted.
+	batch.Reports[1].SetAnnotation("RegistrableDomain", "globex.example")
+	return batch
+}
+
+func TestPerTenantRoute(t *testing.T) {
+	resetTenantSinks()
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tenants.toml")
+	ioutil.WriteFile(path, []byte(tenantFile), 0644)
+
+	r, err := core.NewPerTenantRoute(context.Background(), path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"acme", "globex"}, r.Tenants()); diff != "" {
+		t.Errorf("Tenants() diff (-want +got):\n%s", diff)
+	}
+	batch := tenantBatch()
+	r.ProcessReports(context.Background(), batch)
+	want := map[string][]string{
+		"acme-sink":   {"https://www.acme.com/ acme", "https://shop.acme.co.uk/ acme"},
+		"globex-sink": {"https://globex.example/a globex"},
+	}
+	if diff := cmp.Diff(want, tenantSinks.seen); diff != "" {
+		t.Errorf("PerTenantRoute routed diff (-want +got):\n%s", diff)
+	}
+	if len(batch.Reports) != 0 {
+		t.Errorf("PerTenantRoute left %d reports in the batch, wanted 0", len(batch.Reports))
+	}
+	if got := r.Dropped(); got != 2 {
+		t.Errorf("Dropped() = %d, wanted 2", got)
+	}
+
+	// Unknown tenants' reports can be left for later processors.
+	resetTenantSinks()
+	r.KeepUnknown = true
+	batch = tenantBatch()
+	r.ProcessReports(context.Background(), batch)
+	var kept []string
+	for _, report := range batch.Reports {
+		kept = append(kept, report.URL)
+	}
+	if diff := cmp.Diff([]string{"https://initech.example/", "https://192.0.2.1/"}, kept); diff != "" {
+		t.Errorf("PerTenantRoute with KeepUnknown kept diff (-want +got):\n%s", diff)
+	}
+
+	// Reloading replaces the tenants, and closes the old ones' processors.
+	resetTenantSinks()
+	ioutil.WriteFile(path, []byte("[[tenant]]\nname = \"initech\"\ndomains = [\"initech.example\"]\n[[tenant.children]]\ntype = \"RecordTenant\"\nsink = \"initech-sink\"\n"), 0644)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]bool{"acme-sink": true, "globex-sink": true}, tenantSinks.closed); diff != "" {
+		t.Errorf("Reload closed diff (-want +got):\n%s", diff)
+	}
+	r.ProcessReports(context.Background(), tenantBatch())
+	if diff := cmp.Diff(map[string][]string{"initech-sink": {"https://initech.example/ initech"}}, tenantSinks.seen); diff != "" {
+		t.Errorf("PerTenantRoute after Reload routed diff (-want +got):\n%s", diff)
+	}
+
+	// An invalid file leaves the old tenants in place.
+	ioutil.WriteFile(path, []byte("[[tenant]]\nname = \"initech\"\n"), 0644)
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload of an invalid file should return error")
+	}
+	if diff := cmp.Diff([]string{"initech"}, r.Tenants()); diff != "" {
+		t.Errorf("Tenants() after failed Reload diff (-want +got):\n%s", diff)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !tenantSinks.closed["initech-sink"] {
+		t.Errorf("Close didn't close the tenants' processors")
+	}
+}
+
+func TestPerTenantRouteBadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tenant := func(name, domains, processor string) string {
+		return fmt.Sprintf("[[tenant]]\nname = %q\ndomains = [%s]\n%s\n", name, domains, processor)
+	}
+	recorder := "[[tenant.children]]\ntype = \"RecordTenant\""
+	for i, file := range []string{
+		"tenant = 5",
+		tenant("", `"acme.com"`, recorder),
+		tenant("acme", ``, recorder),
+		tenant("acme", `"acme.com"`, ``),
+		tenant("acme", `"www.acme.com"`, recorder),
+		tenant("acme", `"acme.com"`, "[[tenant.children]]\ntype = \"Nope\""),
+		tenant("acme", `"acme.com"`, recorder) + tenant("acme", `"acme.org"`, recorder),
+		tenant("acme", `"acme.com"`, recorder) + tenant("globex", `"acme.com"`, recorder),
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("tenants%d.toml", i))
+		ioutil.WriteFile(path, []byte(file), 0644)
+		if _, err := core.NewPerTenantRoute(context.Background(), path, 0); err == nil {
+			t.Errorf("NewPerTenantRoute(%s) should return error", file)
+		}
+	}
+
+	path := filepath.Join(dir, "tenants.toml")
+	ioutil.WriteFile(path, []byte(tenantFile), 0644)
+	for _, config := range []string{
+		``,
+		`path = "/nonexistent/tenants.toml"`,
+		fmt.Sprintf("path = %q\nunknown_tenants = \"default\"", path),
+		fmt.Sprintf("path = %q\nreload_interval = \"0s\"", path),
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"PerTenantRoute\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// ProjectAnnotations is a pipeline processor that removes the annotations that
+// shouldn't be published from each batch and its reports, so that internal
+// annotations (such as timings and intermediate scores) don't leak into
+// published output.  Put it in front of your publishers (or dumpers), after
+// any processors that still need the annotations that it removes; if only
+// some publishers should see fewer annotations, put it in a Tee branch.
+//
+// By default, we remove the internal annotations, whose names start with
+// collector.InternalAnnotationPrefix (`__`), and keep everything else; see
+// collector.AnnotationProjection for the other options.
+type ProjectAnnotations struct {
+	Projection collector.AnnotationProjection
+}
+
+// ProcessReports removes the annotations that shouldn't be kept.
+func (p ProjectAnnotations) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	p.Projection.Apply(batch)
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ProjectAnnotations",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Allow         []string `toml:"allow"`
+				StripPrefixes []string `toml:"strip_prefixes"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.StripPrefixes == nil {
+				config.StripPrefixes = []string{collector.InternalAnnotationPrefix}
+			}
+			return ProjectAnnotations{collector.AnnotationProjection{
+				Allow:         config.Allow,
+				StripPrefixes: config.StripPrefixes,
+			}}, nil
+		})
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestProjectAnnotations(t *testing.T) {
+	newBatch := func() *collector.ReportBatch {
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "network-error"}}}
+		batch.SetAnnotation("BatchID", "abc")
+		batch.SetAnnotation("__halt", true)
+		batch.Reports[0].SetAnnotation("ServerHostname", "cdn.example")
+		batch.Reports[0].SetAnnotation("AbuseScore", 0.5)
+		batch.Reports[0].SetAnnotation("__score", 3)
+		return batch
+	}
+	cases := []struct {
+		name               string
+		config             string
+		batch, firstReport map[string]interface{}
+	}{
+		{"Default", ``,
+			map[string]interface{}{"BatchID": "abc"},
+			map[string]interface{}{"ServerHostname": "cdn.example", "AbuseScore": 0.5}},
+		{"Allow", `allow = ["BatchID", "ServerHostname", "__score"]`,
+			map[string]interface{}{"BatchID": "abc"},
+			map[string]interface{}{"ServerHostname": "cdn.example"}},
+		{"NoStrip", `allow = ["BatchID", "__score"]` + "\n" + `strip_prefixes = []`,
+			map[string]interface{}{"BatchID": "abc"},
+			map[string]interface{}{"__score": 3}},
+		{"StripPrefixes", `strip_prefixes = ["__", "Abuse"]`,
+			map[string]interface{}{"BatchID": "abc"},
+			map[string]interface{}{"ServerHostname": "cdn.example"}},
+	}
+	for _, c := range cases {
+		batch := pipelinetest.RunTestConfig("[[processor]]\ntype = \"ProjectAnnotations\"\n"+c.config, newBatch())
+		if diff := cmp.Diff(c.batch, batch.Annotations.Annotations); diff != "" {
+			t.Errorf("ProjectAnnotations(%s) got diff in batch annotations (-want +got):\n%s", c.name, diff)
+		}
+		if diff := cmp.Diff(c.firstReport, batch.Reports[0].Annotations.Annotations); diff != "" {
+			t.Errorf("ProjectAnnotations(%s) got diff in report annotations (-want +got):\n%s", c.name, diff)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// quotaWindow counts the reports that have been let through for one host in
+// the window numbered index since the epoch.
+type quotaWindow struct {
+	index int64
+	count int
+}
+
+// PerHostQuota is a pipeline processor that lets through at most Quota reports
+// for each host in each Window, so that a few very noisy hosts can't drown out
+// everyone else in a shared collector.  Unlike a global rate limit, a host
+// that stays under its quota is never affected by the others.
+//
+// Windows are fixed, and aligned to the epoch of the pipeline's Clock: every
+// host's count starts again from zero when a new window starts.  Overrides
+// gives the quota for particular hosts, in place of Quota; an override of 0
+// drops all of a host's reports.  Reports without a key (such as those whose
+// URL can't be parsed, when counting by host) are always kept.
+//
+// When we drop any of a batch's reports, we set Annotation on the batch to the
+// number that we dropped.  PerHostQuota also counts the reports that it drops;
+// see Dropped.  We track at most MaxKeys hosts at a time, forgetting about the
+// ones that we've heard from least recently, so a forgotten host can get a
+// fresh quota within a window.
+type PerHostQuota struct {
+	Quota      int
+	Window     time.Duration
+	Overrides  map[string]int
+	MaxKeys    int
+	Annotation string
+
+	// Clock is used to decide which window each batch is in.  If nil, we use
+	// the current time.
+	Clock collector.Clock
+
+	dropped int64
+	key     func(report *collector.NelReport) (string, bool)
+	mu      sync.Mutex
+	windows *ttlCache
+}
+
+// NewPerHostQuota creates a new PerHostQuota processor, which counts reports
+// separately for each value of field.  As with OutageDetector, the field can
+// be "host", for the host of each report's URL, or any of the fields that
+// Where's conditions can use.
+func NewPerHostQuota(field string, quota int, window time.Duration) (*PerHostQuota, error) {
+	q := &PerHostQuota{
+		Quota:      quota,
+		Window:     window,
+		MaxKeys:    10000,
+		Annotation: "QuotaDropped",
+	}
+	key, err := reportKey(field)
+	if err != nil {
+		return nil, err
+	}
+	q.key = key
+	return q, nil
+}
+
+// Dropped returns the number of reports that the processor has thrown away.
+func (q *PerHostQuota) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+func (q *PerHostQuota) now() time.Time {
+	if q.Clock == nil {
+		return time.Now()
+	}
+	return q.Clock.Now()
+}
+
+func (q *PerHostQuota) quota(key string) int {
+	if quota, ok := q.Overrides[key]; ok {
+		return quota
+	}
+	return q.Quota
+}
+
+// window returns the current window for a key, creating it (or starting it
+// again) if needed.  q.mu must be held.
+func (q *PerHostQuota) window(key string, index int64, now time.Time) *quotaWindow {
+	if q.windows == nil {
+		q.windows = newTTLCache(q.MaxKeys, 0)
+	}
+	if value, ok := q.windows.get(key, now); ok {
+		window := value.(*quotaWindow)
+		if window.index != index {
+			window.index = index
+			window.count = 0
+		}
+		return window
+	}
+	window := &quotaWindow{index: index}
+	q.windows.add(key, window, now)
+	return window
+}
+
+// ProcessReports throws away the reports in the batch that are over their
+// host's quota.
+func (q *PerHostQuota) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := q.now()
+	width := q.Window
+	if width <= 0 {
+		width = 1
+	}
+	index := now.UnixNano() / int64(width)
+
+	var filtered []collector.NelReport
+	q.mu.Lock()
+	for _, report := range batch.Reports {
+		key, ok := q.key(&report)
+		if !ok {
+			filtered = append(filtered, report)
+			continue
+		}
+		window := q.window(key, index, now)
+		if window.count >= q.quota(key) {
+			continue
+		}
+		window.count++
+		filtered = append(filtered, report)
+	}
+	q.mu.Unlock()
+
+	if dropped := len(batch.Reports) - len(filtered); dropped > 0 {
+		atomic.AddInt64(&q.dropped, int64(dropped))
+		batch.SetAnnotation(q.Annotation, dropped)
+	}
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"PerHostQuota",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Quota      *int           `toml:"quota"`
+				Window     string         `toml:"window"`
+				Field      string         `toml:"field"`
+				Overrides  map[string]int `toml:"overrides"`
+				MaxKeys    *int           `toml:"max_keys"`
+				Annotation string         `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Quota == nil {
+				return nil, fmt.Errorf("PerHostQuota missing `quota`")
+			}
+			if *config.Quota < 1 {
+				return nil, fmt.Errorf("PerHostQuota `quota` must be positive")
+			}
+			if config.Field == "" {
+				config.Field = "host"
+			}
+			window := time.Minute
+			if config.Window != "" {
+				window, err = time.ParseDuration(config.Window)
+				if err != nil {
+					return nil, fmt.Errorf("PerHostQuota invalid `window`: %v", err)
+				}
+				if window <= 0 {
+					return nil, fmt.Errorf("PerHostQuota `window` must be positive")
+				}
+			}
+
+			q, err := NewPerHostQuota(config.Field, *config.Quota, window)
+			if err != nil {
+				return nil, fmt.Errorf("PerHostQuota invalid `field`: %s", config.Field)
+			}
+			for host, quota := range config.Overrides {
+				if quota < 0 {
+					return nil, fmt.Errorf("PerHostQuota `overrides` for %s must not be negative", host)
+				}
+			}
+			q.Overrides = config.Overrides
+			if config.MaxKeys != nil {
+				if *config.MaxKeys < 1 {
+					return nil, fmt.Errorf("PerHostQuota `max_keys` must be positive")
+				}
+				q.MaxKeys = *config.MaxKeys
+			}
+			if config.Annotation != "" {
+				q.Annotation = config.Annotation
+			}
+			q.Clock = clock
+			return q, nil
+		})
+}
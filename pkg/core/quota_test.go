@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestPerHostQuota(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	q, err := core.NewPerHostQuota("host", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Clock = clock
+	q.Overrides = map[string]int{"big.example": 3, "banned.example": 0}
+
+	// process runs a batch with the given number of reports for each host, and
+	// returns the URLs that are kept, and the batch's drop count.
+	process := func(counts map[string]int) ([]string, interface{}) {
+		batch := &collector.ReportBatch{}
+		for _, host := range []string{"a.example", "b.example", "big.example", "banned.example"} {
+			for i := 0; i < counts[host]; i++ {
+				batch.Reports = append(batch.Reports, collector.NelReport{ReportType: "network-error", URL: "https://" + host + "/"})
+			}
+		}
+		q.ProcessReports(context.Background(), batch)
+		var urls []string
+		for _, report := range batch.Reports {
+			urls = append(urls, report.URL)
+		}
+		return urls, batch.GetAnnotation("QuotaDropped")
+	}
+
+	urls, dropped := process(map[string]int{"a.example": 3, "b.example": 1, "big.example": 4, "banned.example": 1})
+	want := []string{
+		"https://a.example/", "https://a.example/",
+		"https://b.example/",
+		"https://big.example/", "https://big.example/", "https://big.example/",
+	}
+	if diff := cmp.Diff(want, urls); diff != "" {
+		t.Errorf("PerHostQuota kept reports with diff (-want +got):\n%s", diff)
+	}
+	if dropped != 3 {
+		t.Errorf("PerHostQuota annotated batch with %v dropped reports, wanted 3", dropped)
+	}
+
+	// a.example has used its quota for this window, but b.example hasn't.
+	clock.CurrentTime = clock.CurrentTime.Add(30 * time.Second)
+	urls, dropped = process(map[string]int{"a.example": 1, "b.example": 2})
+	if diff := cmp.Diff([]string{"https://b.example/"}, urls); diff != "" {
+		t.Errorf("PerHostQuota kept reports with diff (-want +got):\n%s", diff)
+	}
+	if dropped != 2 {
+		t.Errorf("PerHostQuota annotated batch with %v dropped reports, wanted 2", dropped)
+	}
+
+	// Every host gets a fresh quota in the next window.
+	clock.CurrentTime = clock.CurrentTime.Add(30 * time.Second)
+	urls, dropped = process(map[string]int{"a.example": 2})
+	if diff := cmp.Diff([]string{"https://a.example/", "https://a.example/"}, urls); diff != "" {
+		t.Errorf("PerHostQuota kept reports with diff (-want +got):\n%s", diff)
+	}
+	if dropped != nil {
+		t.Errorf("PerHostQuota annotated batch with %v dropped reports, wanted none", dropped)
+	}
+	if got, want := q.Dropped(), int64(5); got != want {
+		t.Errorf("PerHostQuota.Dropped() = %d, wanted %d", got, want)
+	}
+}
+
+func TestPerHostQuotaConfig(t *testing.T) {
+	config := `
+[[processor]]
+type = "PerHostQuota"
+quota = 1
+field = "server_ip"
+annotation = "OverQuota"
+[processor.overrides]
+"192.0.2.1" = 2
+`
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{
+		{ServerIP: "192.0.2.1"}, {ServerIP: "192.0.2.1"}, {ServerIP: "192.0.2.1"},
+		{ServerIP: "192.0.2.2"}, {ServerIP: "192.0.2.2"},
+	}}
+	pipeline.ProcessBatch(context.Background(), batch)
+	if got, want := len(batch.Reports), 3; got != want {
+		t.Errorf("PerHostQuota kept %d reports, wanted %d", got, want)
+	}
+	if got, want := batch.GetAnnotation("OverQuota"), 2; got != want {
+		t.Errorf("PerHostQuota annotated batch with %v dropped reports, wanted %d", got, want)
+	}
+}
+
+func TestPerHostQuotaBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`quota = 0`,
+		"quota = 10\nwindow = \"soon\"",
+		"quota = 10\nwindow = \"0s\"",
+		"quota = 10\nfield = \"nonexistent\"",
+		"quota = 10\nmax_keys = 0",
+		"quota = 10\n[processor.overrides]\n\"a.example\" = -1",
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"PerHostQuota\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
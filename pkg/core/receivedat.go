@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// ReceivedAt is a pipeline processor that records when the collector received
+// each batch, formatted in UTC as RFC 3339 with nanoseconds, so that every
+// publisher sees the same receive timestamp.  The time is saved as an
+// annotation (ReceivedAt by default) on the batch, and copied onto each of its
+// reports so that it survives processors that split batches up.
+//
+// The receive time is the batch's Time, which the pipeline's clock sets when
+// the upload is parsed.  If the batch doesn't have one, we use Clock instead.
+type ReceivedAt struct {
+	Annotation string
+
+	// Clock is used for batches that don't have a receive time.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+}
+
+func (r *ReceivedAt) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
+
+// ProcessReports annotates the batch and each of its reports with the batch's
+// receive time.
+func (r *ReceivedAt) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	received := batch.Time
+	if received.IsZero() {
+		received = r.now()
+	}
+	formatted := received.UTC().Format(time.RFC3339Nano)
+	batch.SetAnnotation(r.Annotation, formatted)
+	for i := range batch.Reports {
+		batch.Reports[i].SetAnnotation(r.Annotation, formatted)
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ReceivedAt",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotation string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Annotation == "" {
+				config.Annotation = "ReceivedAt"
+			}
+			return &ReceivedAt{Annotation: config.Annotation, Clock: clock}, nil
+		})
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestReceivedAt(t *testing.T) {
+	cases := []struct {
+		name, config string
+		batchTime    time.Time
+		annotation   string
+		want         string
+	}{
+		{"BatchTime", ``, time.Date(2018, 6, 1, 12, 30, 45, 123456789, time.FixedZone("UTC+2", 7200)), "ReceivedAt",
+			"2018-06-01T10:30:45.123456789Z"},
+		// Without a receive time, we fall back on the clock (the Unix epoch).
+		{"NoBatchTime", `annotation = "Received"`, time.Time{}, "Received",
+			"1970-01-01T00:00:00Z"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batch := pipelinetest.RunTestConfig("[[processor]]\ntype = \"ReceivedAt\"\n"+c.config, &collector.ReportBatch{
+				Time:    c.batchTime,
+				Reports: []collector.NelReport{{}, {}},
+			})
+			got := []interface{}{batch.GetAnnotation(c.annotation)}
+			for _, report := range batch.Reports {
+				got = append(got, report.GetAnnotation(c.annotation))
+			}
+			if diff := cmp.Diff([]interface{}{c.want, c.want, c.want}, got); diff != "" {
+				t.Errorf("ReceivedAt got diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
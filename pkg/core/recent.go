@@ -0,0 +1,251 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+const defaultRecentReportsSize = 1000
+
+// recentReportsFlushEvery is how many reports RecentReports.ServeHTTP writes
+// between flushes, so that a large response is sent as it's written rather
+// than piling up in the connection's buffer.
+const recentReportsFlushEvery = 100
+
+// RecentReports is a ReportProcessor that remembers the last Size reports it
+// has seen, in a ring buffer.  It is also an http.Handler, which returns them
+// as a JSON array, oldest (by their batch's Time) first, in the same format that LiveTail uses.  Unlike
+// LiveTail, you don't have to be connected when a report arrives to see it.
+//
+// The handler understands two query parameters:
+//
+//   - `since` is an RFC 3339 timestamp; only reports from batches received
+//     after it are returned.
+//   - `limit` is the largest number of reports to return.  Without `since`,
+//     you get the most recent ones; with it, you get the oldest ones after
+//     `since`, so that you can page through the buffer by passing the Time of
+//     the last report on one page as the `since` of the next.  (So that this
+//     doesn't skip anything, a page never ends partway through a batch, unless
+//     the batch alone is larger than `limit`.)
+//
+// Each report is encoded when it arrives, and the response is streamed from
+// the encoded reports, so fetching even a large buffer doesn't need much
+// memory.
+type RecentReports struct {
+	// The number of reports that we remember.  If zero, we use a default of
+	// 1000.
+	Size int
+
+	mu      sync.Mutex
+	entries []recentReport
+	next    int
+}
+
+type recentReport struct {
+	time    time.Time
+	encoded []byte
+}
+
+// ProcessReports adds each report in the batch to the buffer, replacing the
+// oldest ones if it's full.
+func (r *RecentReports) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	timestamp := batch.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	encoded := make([]recentReport, 0, len(batch.Reports))
+	for _, report := range batch.Reports {
+		b, err := json.Marshal(liveTailEvent{timestamp, batch.ClientIP, liveTailReport(report)})
+		if err != nil {
+			continue
+		}
+		// Match the precision of the Time that we report, so that paging with
+		// it as `since` works.
+		encoded = append(encoded, recentReport{batch.Time.Truncate(time.Millisecond), b})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := r.Size
+	if size <= 0 {
+		size = defaultRecentReportsSize
+	}
+	for _, entry := range encoded {
+		if len(r.entries) < size {
+			r.entries = append(r.entries, entry)
+			continue
+		}
+		r.entries[r.next] = entry
+		r.next = (r.next + 1) % len(r.entries)
+	}
+}
+
+// snapshot returns the buffered reports, oldest first.  The encoded reports
+// are never modified, so the result shares them with the buffer.
+//
+// The buffer is in the order that the batches reached us, which isn't always
+// the order of their Times: several workers can process batches at once, and
+// a batch can be delayed by coalescing, or replayed from a WAL.  Paging with
+// `since` relies on the reports being in order of their Times, so we sort
+// them by it, keeping the reports from each batch (and from batches with the
+// same Time) in the order that they arrived.
+func (r *RecentReports) snapshot() []recentReport {
+	r.mu.Lock()
+	result := make([]recentReport, 0, len(r.entries))
+	result = append(result, r.entries[r.next:]...)
+	result = append(result, r.entries[:r.next]...)
+	r.mu.Unlock()
+	sort.SliceStable(result, func(i, j int) bool { return result[i].time.Before(result[j].time) })
+	return result
+}
+
+// recentReportsPage selects the reports that a request for the given since and
+// limit should return.
+func recentReportsPage(entries []recentReport, since time.Time, limit int) []recentReport {
+	if since.IsZero() {
+		if limit > 0 && len(entries) > limit {
+			entries = entries[len(entries)-limit:]
+		}
+		return entries
+	}
+
+	var selected []recentReport
+	for _, entry := range entries {
+		if entry.time.After(since) {
+			selected = append(selected, entry)
+		}
+	}
+	if limit <= 0 || len(selected) <= limit {
+		return selected
+	}
+	end := limit
+	for end > 1 && selected[end].time.Equal(selected[end-1].time) {
+		end--
+	}
+	if end == 1 && selected[1].time.Equal(selected[0].time) {
+		end = limit
+	}
+	return selected[:end]
+}
+
+// ServeHTTP writes the buffered reports as a JSON array.
+func (r *RecentReports) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	var limit int
+	var err error
+	query := req.URL.Query()
+	if s := query.Get("since"); s != "" {
+		since, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := recentReportsPage(r.snapshot(), since, limit)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if _, err := w.Write([]byte("[")); err != nil {
+		return
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			if _, err := w.Write([]byte(",\n")); err != nil {
+				return
+			}
+		}
+		if _, err := w.Write(entry.encoded); err != nil {
+			return
+		}
+		if flusher != nil && (i+1)%recentReportsFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	w.Write([]byte("]\n"))
+}
+
+var recentReports = struct {
+	sync.Mutex
+	m map[string]*RecentReports
+}{m: make(map[string]*RecentReports)}
+
+// NamedRecentReports returns the RecentReports with the given name, creating it
+// if it doesn't exist yet.  Like LiveTail processors, RecentReports processors
+// that are loaded from a configuration file are looked up by name, so that the
+// http.Handler that you mount in your server keeps working when a new pipeline
+// is swapped in.
+func NamedRecentReports(name string) *RecentReports {
+	recentReports.Lock()
+	defer recentReports.Unlock()
+	r, ok := recentReports.m[name]
+	if !ok {
+		r = &RecentReports{}
+		recentReports.m[name] = r
+	}
+	return r
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"RecentReports",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Name string `toml:"name"`
+				Size *int   `toml:"size"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Name == "" {
+				config.Name = "default"
+			}
+
+			r := NamedRecentReports(config.Name)
+			if config.Size != nil {
+				if *config.Size < 1 {
+					return nil, fmt.Errorf("RecentReports `size` must be positive")
+				}
+				r.mu.Lock()
+				if *config.Size != r.Size {
+					// Start again rather than trying to preserve the order of a
+					// resized ring.
+					r.Size = *config.Size
+					r.entries = nil
+					r.next = 0
+				}
+				r.mu.Unlock()
+			}
+			return r, nil
+		})
+}
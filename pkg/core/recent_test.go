@@ -0,0 +1,172 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// fetchRecent requests the given query from a RecentReports handler, and
+// returns the Time and URL of each report in the response.
+func fetchRecent(t *testing.T, r *core.RecentReports, query string) []string {
+	t.Helper()
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, httptest.NewRequest("GET", "/debug/recent"+query, nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("RecentReports(%s) returned %d: %s", query, response.Code, response.Body)
+	}
+	var events []struct {
+		Time   string
+		Report struct{ URL string }
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &events); err != nil {
+		t.Fatalf("RecentReports(%s) returned invalid JSON: %v", query, err)
+	}
+	var result []string
+	for _, event := range events {
+		result = append(result, event.Time[17:23]+" "+event.Report.URL)
+	}
+	return result
+}
+
+func TestRecentReports(t *testing.T) {
+	r := &core.RecentReports{Size: 5}
+	if got := fetchRecent(t, r, ""); len(got) != 0 {
+		t.Errorf("RecentReports returned %v before any reports arrived", got)
+	}
+
+	// Batches of 1, 2, 3 and 1 reports, received a second apart.
+	for i, count := range []int{1, 2, 3, 1} {
+		batch := &collector.ReportBatch{Time: time.Unix(int64(i), 0)}
+		for j := 0; j < count; j++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{URL: fmt.Sprintf("https://example.com/%d/%d", i, j)})
+		}
+		r.ProcessReports(context.Background(), batch)
+	}
+
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{
+			"01.000 https://example.com/1/1",
+			"02.000 https://example.com/2/0",
+			"02.000 https://example.com/2/1",
+			"02.000 https://example.com/2/2",
+			"03.000 https://example.com/3/0",
+		}},
+		{"?limit=2", []string{
+			"02.000 https://example.com/2/2",
+			"03.000 https://example.com/3/0",
+		}},
+		{"?since=1970-01-01T00:00:01Z", []string{
+			"02.000 https://example.com/2/0",
+			"02.000 https://example.com/2/1",
+			"02.000 https://example.com/2/2",
+			"03.000 https://example.com/3/0",
+		}},
+		// A page doesn't end partway through a batch...
+		{"?since=1970-01-01T00:00:00Z&limit=3", []string{
+			"01.000 https://example.com/1/1",
+		}},
+		// ...unless the batch doesn't fit in a page at all.
+		{"?since=1970-01-01T00:00:01Z&limit=2", []string{
+			"02.000 https://example.com/2/0",
+			"02.000 https://example.com/2/1",
+		}},
+		{"?since=1970-01-01T00:00:02.000Z&limit=2", []string{
+			"03.000 https://example.com/3/0",
+		}},
+		{"?since=1970-01-01T00:00:03Z", nil},
+	} {
+		if diff := cmp.Diff(c.want, fetchRecent(t, r, c.query)); diff != "" {
+			t.Errorf("RecentReports(%s) got diff (-want +got):\n%s", c.query, diff)
+		}
+	}
+}
+
+func TestRecentReportsOutOfOrder(t *testing.T) {
+	r := &core.RecentReports{Size: 5}
+	// The batch from 1s arrives last, say because it was coalesced.
+	for _, i := range []int{0, 2, 3, 1} {
+		batch := &collector.ReportBatch{Time: time.Unix(int64(i), 0)}
+		batch.Reports = append(batch.Reports, collector.NelReport{URL: fmt.Sprintf("https://example.com/%d", i)})
+		r.ProcessReports(context.Background(), batch)
+	}
+
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{
+			"00.000 https://example.com/0",
+			"01.000 https://example.com/1",
+			"02.000 https://example.com/2",
+			"03.000 https://example.com/3",
+		}},
+		{"?limit=2", []string{
+			"02.000 https://example.com/2",
+			"03.000 https://example.com/3",
+		}},
+		// Paging through the buffer doesn't skip the late batch.
+		{"?since=1970-01-01T00:00:00Z&limit=1", []string{
+			"01.000 https://example.com/1",
+		}},
+		{"?since=1970-01-01T00:00:01Z&limit=1", []string{
+			"02.000 https://example.com/2",
+		}},
+	} {
+		if diff := cmp.Diff(c.want, fetchRecent(t, r, c.query)); diff != "" {
+			t.Errorf("RecentReports(%s) got diff (-want +got):\n%s", c.query, diff)
+		}
+	}
+}
+
+func TestRecentReportsBadQuery(t *testing.T) {
+	r := &core.RecentReports{}
+	for _, query := range []string{"?limit=0", "?limit=many", "?since=yesterday"} {
+		var response httptest.ResponseRecorder
+		r.ServeHTTP(&response, httptest.NewRequest("GET", "/debug/recent"+query, nil))
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("RecentReports(%s) returned %d, wanted %d", query, response.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRecentReportsConfig(t *testing.T) {
+	var pipeline collector.Pipeline
+	if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"RecentReports\"\nname = \"TestRecentReportsConfig\"\nsize = 1")); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.ProcessBatch(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{{URL: "https://a/"}, {URL: "https://b/"}}})
+	got := fetchRecent(t, core.NamedRecentReports("TestRecentReportsConfig"), "")
+	if len(got) != 1 || got[0][7:] != "https://b/" {
+		t.Errorf("RecentReports got %v, wanted just https://b/", got)
+	}
+
+	if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"RecentReports\"\nsize = 0")); err == nil {
+		t.Errorf("LoadFromConfig should reject a `size` of 0")
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// ReplayGuard is a pipeline processor that looks for uploads that have been
+// captured and replayed, to poison our data.  Genuine uploads almost never
+// repeat exactly, since each report has its own age (and often its own
+// elapsed time and sampling decision), so a batch whose reports are identical
+// to those of many other recent batches, sent from several different clients,
+// is very likely a replay.
+//
+// We fingerprint each batch by hashing the JSON encodings of its reports (as
+// produced by NelReport.MarshalJSON, so annotations don't count), and count
+// how many batches with each fingerprint have arrived in the Window since it
+// was first seen, along with how many distinct client IPs sent them.  Once a
+// fingerprint has been seen more than Threshold times in its window, from at
+// least MinClients clients, every further batch with that fingerprint in the
+// window is a replay.  (The first copies get through, since we can't tell
+// them apart from the original yet.)  If Annotation is empty, we drop the
+// reports in a replayed batch; otherwise we keep every report, and set the
+// named annotation to true or false depending on whether its batch was a
+// replay.  ReplayGuard counts the reports that it drops or flags; see
+// Replayed.
+//
+// We remember at most MaxFingerprints fingerprints at a time, forgetting about
+// the ones that we've seen least recently.  ReplayGuard should come before any
+// processor that coalesces or splits batches, since it works on whole
+// uploads.  Empty batches are ignored.
+type ReplayGuard struct {
+	Window          time.Duration
+	Threshold       int
+	MinClients      int
+	MaxFingerprints int
+	Annotation      string
+
+	// Clock is used to decide when each fingerprint's window ends.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+
+	replayed     int64
+	mu           sync.Mutex
+	fingerprints *ttlCache
+}
+
+// replayWindow counts the batches with one fingerprint in the current window.
+type replayWindow struct {
+	count   int
+	clients map[string]bool
+}
+
+// NewReplayGuard creates a new ReplayGuard that drops batches that have been
+// seen more than threshold times within window, from at least 2 clients.
+func NewReplayGuard(window time.Duration, threshold int) *ReplayGuard {
+	return &ReplayGuard{
+		Window:          window,
+		Threshold:       threshold,
+		MinClients:      2,
+		MaxFingerprints: 100000,
+	}
+}
+
+// Replayed returns the number of reports that the processor has dropped or
+// flagged as replays.
+func (g *ReplayGuard) Replayed() int64 {
+	return atomic.LoadInt64(&g.replayed)
+}
+
+func (g *ReplayGuard) now() time.Time {
+	if g.Clock == nil {
+		return time.Now()
+	}
+	return g.Clock.Now()
+}
+
+// replayFingerprint returns a hash of the reports in a batch.
+func replayFingerprint(reports []collector.NelReport) (string, error) {
+	h := sha256.New()
+	for _, report := range reports {
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			return "", err
+		}
+		h.Write(encoded)
+		h.Write([]byte{'\n'})
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// replay counts a batch with a fingerprint, and returns whether it's a
+// replay.
+func (g *ReplayGuard) replay(fingerprint, client string) bool {
+	now := g.now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.fingerprints == nil {
+		g.fingerprints = newTTLCache(g.MaxFingerprints, g.Window)
+	}
+	var window *replayWindow
+	if value, ok := g.fingerprints.get(fingerprint, now); ok {
+		window = value.(*replayWindow)
+	} else {
+		window = &replayWindow{clients: make(map[string]bool)}
+		g.fingerprints.add(fingerprint, window, now)
+	}
+	window.count++
+	// There's no need to remember more clients than it takes to be a replay.
+	if len(window.clients) < g.MinClients {
+		window.clients[client] = true
+	}
+	return window.count > g.Threshold && len(window.clients) >= g.MinClients
+}
+
+// ProcessReports drops or annotates the reports in the batch, if it's a
+// replay.
+func (g *ReplayGuard) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if len(batch.Reports) == 0 {
+		return
+	}
+	key, err := replayFingerprint(batch.Reports)
+	if err != nil {
+		return
+	}
+	replayed := g.replay(key, batch.ClientIP)
+	if replayed {
+		atomic.AddInt64(&g.replayed, int64(len(batch.Reports)))
+	}
+	if g.Annotation != "" {
+		for i := range batch.Reports {
+			batch.Reports[i].SetAnnotation(g.Annotation, replayed)
+		}
+		return
+	}
+	if replayed {
+		batch.Reports = nil
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ReplayGuard",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Window          string `toml:"window"`
+				Threshold       int    `toml:"threshold"`
+				MinClients      *int   `toml:"min_clients"`
+				MaxFingerprints *int   `toml:"max_fingerprints"`
+				Mode            string `toml:"mode"`
+				Annotation      string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Threshold == 0 {
+				return nil, fmt.Errorf("ReplayGuard missing `threshold`")
+			}
+			if config.Threshold < 0 {
+				return nil, fmt.Errorf("ReplayGuard `threshold` must be positive")
+			}
+			window := time.Minute
+			if config.Window != "" {
+				window, err = time.ParseDuration(config.Window)
+				if err != nil {
+					return nil, fmt.Errorf("ReplayGuard invalid `window`: %v", err)
+				}
+				if window <= 0 {
+					return nil, fmt.Errorf("ReplayGuard `window` must be positive")
+				}
+			}
+
+			g := NewReplayGuard(window, config.Threshold)
+			if config.MinClients != nil {
+				if *config.MinClients < 1 {
+					return nil, fmt.Errorf("ReplayGuard `min_clients` must be positive")
+				}
+				g.MinClients = *config.MinClients
+			}
+			if config.MaxFingerprints != nil {
+				if *config.MaxFingerprints < 1 {
+					return nil, fmt.Errorf("ReplayGuard `max_fingerprints` must be positive")
+				}
+				g.MaxFingerprints = *config.MaxFingerprints
+			}
+			if config.Mode == "" || config.Mode == "drop" {
+				if config.Annotation != "" {
+					return nil, fmt.Errorf("ReplayGuard only uses `annotation` in annotate mode")
+				}
+			} else if config.Mode == "annotate" {
+				g.Annotation = config.Annotation
+				if g.Annotation == "" {
+					g.Annotation = "Replayed"
+				}
+			} else {
+				return nil, fmt.Errorf("ReplayGuard invalid `mode`: %s", config.Mode)
+			}
+			g.Clock = clock
+			return g, nil
+		})
+}
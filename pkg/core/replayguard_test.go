@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestReplayGuard(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	g := core.NewReplayGuard(time.Minute, 2)
+	g.Clock = clock
+	start := clock.CurrentTime
+
+	upload := func(clientIP string, age int) int {
+		batch := &collector.ReportBatch{ClientIP: clientIP, Reports: []collector.NelReport{
+			{ReportType: "network-error", URL: "https://a.example/", Age: age, Type: "tcp.reset"},
+			{ReportType: "network-error", URL: "https://b.example/", Age: age, Type: "ok"},
+		}}
+		batch.Reports[0].SetAnnotation("Unrelated", age)
+		g.ProcessReports(context.Background(), batch)
+		return len(batch.Reports)
+	}
+	cases := []struct {
+		offset   time.Duration
+		clientIP string
+		age      int
+		want     int
+	}{
+		// The same client retrying isn't a replay, however often it happens.
+		{0, "192.0.2.1", 100, 2},
+		{0, "192.0.2.1", 100, 2},
+		{0, "192.0.2.1", 100, 2},
+		// But once a second client sends the same reports, the rest are
+		// replays.
+		{time.Second, "192.0.2.2", 100, 0},
+		{time.Second, "192.0.2.1", 100, 0},
+		// Reports that differ at all aren't.
+		{time.Second, "192.0.2.3", 101, 2},
+		// The window starts again once it's over.
+		{time.Minute, "192.0.2.2", 100, 2},
+		{time.Minute, "192.0.2.3", 100, 2},
+		{time.Minute, "192.0.2.4", 100, 0},
+	}
+	var want, got []int
+	for _, c := range cases {
+		clock.CurrentTime = start.Add(c.offset)
+		want = append(want, c.want)
+		got = append(got, upload(c.clientIP, c.age))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReplayGuard kept reports diff (-want +got):\n%s", diff)
+	}
+	if got := g.Replayed(); got != 6 {
+		t.Errorf("ReplayGuard.Replayed() = %d, wanted 6", got)
+	}
+}
+
+func TestReplayGuardConfig(t *testing.T) {
+	config := `
+[[processor]]
+type = "ReplayGuard"
+threshold = 1
+min_clients = 1
+mode = "annotate"
+`
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for i := 0; i < 3; i++ {
+		batch := &collector.ReportBatch{ClientIP: "192.0.2.1", Reports: []collector.NelReport{{URL: "https://a.example/"}}}
+		pipeline.ProcessBatch(context.Background(), batch)
+		got = append(got, batch.Reports[0].GetAnnotation("Replayed"))
+	}
+	if diff := cmp.Diff([]interface{}{false, true, true}, got); diff != "" {
+		t.Errorf("ReplayGuard annotations diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReplayGuardBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`threshold = -1`,
+		"threshold = 10\nwindow = \"soon\"",
+		"threshold = 10\nwindow = \"0s\"",
+		"threshold = 10\nmin_clients = 0",
+		"threshold = 10\nmax_fingerprints = 0",
+		"threshold = 10\nmode = \"block\"",
+		"threshold = 10\nannotation = \"Replayed\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"ReplayGuard\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// reportIDNamespace is the namespace of the name-based UUIDs that
+// AssignReportID generates in deterministic mode.  (It's a random UUID that we
+// generated once; it must never change, or every report's ID would too.)
+var reportIDNamespace = [16]byte{
+	0x6e, 0x7a, 0x3c, 0x51, 0x0b, 0x8e, 0x4f, 0x2d,
+	0x9a, 0x41, 0xc5, 0x27, 0xe3, 0x90, 0x1d, 0x6f,
+}
+
+// AssignReportID is a pipeline processor that gives each report a unique
+// identifier, so that downstream systems can deduplicate and join reports.
+// The ID is stored in a per-report annotation (ReportID by default), formatted
+// as a UUID.  This processor should appear early in the pipeline, so that
+// every later processor and publisher sees the same ID.
+//
+// If Deterministic is false, each report gets a random (version 4) UUID.  If
+// it's true, each report gets a name-based (version 5) UUID, derived from:
+//
+//   - the IP address of the client that uploaded the report, and
+//   - the report's JSON encoding (as produced by NelReport.MarshalJSON) with
+//     its age set to 0: that is, its report type, URL, user agent, and body.
+//
+// The report's age and the time that it was received are deliberately left
+// out, so that if a client uploads the same report twice, both copies get the
+// same ID.  Annotations don't affect the ID either.
+type AssignReportID struct {
+	Annotation    string
+	Deterministic bool
+}
+
+// formatUUID formats 16 bytes as a UUID, after setting its version and variant
+// bits.
+func formatUUID(b [16]byte, version byte) string {
+	b[6] = (b[6] & 0x0f) | version<<4
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func randomReportID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return formatUUID(b, 4)
+}
+
+func deterministicReportID(batch *collector.ReportBatch, report *collector.NelReport) string {
+	withoutAge := *report
+	withoutAge.Age = 0
+	encoded, err := json.Marshal(withoutAge)
+	if err != nil {
+		// Fall back on a random ID; a report that can't be encoded can't be
+		// published anywhere that would join on its ID.
+		return randomReportID()
+	}
+
+	h := sha1.New()
+	h.Write(reportIDNamespace[:])
+	h.Write([]byte(batch.ClientIP))
+	h.Write([]byte{0})
+	h.Write(encoded)
+	var b [16]byte
+	copy(b[:], h.Sum(nil))
+	return formatUUID(b, 5)
+}
+
+// ProcessReports assigns an ID to each report in the batch.
+func (a AssignReportID) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	annotation := a.Annotation
+	if annotation == "" {
+		annotation = "ReportID"
+	}
+	for i := range batch.Reports {
+		var id string
+		if a.Deterministic {
+			id = deterministicReportID(batch, &batch.Reports[i])
+		} else {
+			id = randomReportID()
+		}
+		batch.Reports[i].SetAnnotation(annotation, id)
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"AssignReportID",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotation string `toml:"annotation"`
+				Mode       string `toml:"mode"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			a := AssignReportID{Annotation: config.Annotation}
+			if config.Mode == "" || config.Mode == "random" {
+				a.Deterministic = false
+			} else if config.Mode == "hash" {
+				a.Deterministic = true
+			} else {
+				return nil, fmt.Errorf("AssignReportID invalid `mode`: %s", config.Mode)
+			}
+			return a, nil
+		})
+}
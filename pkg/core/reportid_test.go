@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestAssignReportID(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestAssignReportID",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "AssignReportID"
+			mode = "hash"
+			[[processor]]
+			type = "EncodeBatchAsResult"
+		`),
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-([0-9a-f])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestAssignReportIDModes(t *testing.T) {
+	newBatch := func(age int, clientIP string) *collector.ReportBatch {
+		return &collector.ReportBatch{
+			ClientIP: clientIP,
+			Reports: []collector.NelReport{
+				{Age: age, ReportType: "network-error", URL: "https://example.com/", Type: "tcp.timed_out"},
+				{Age: age, ReportType: "network-error", URL: "https://example.com/", Type: "ok"},
+			},
+		}
+	}
+	ids := func(a core.AssignReportID, batch *collector.ReportBatch) []string {
+		a.ProcessReports(context.Background(), batch)
+		var result []string
+		for _, report := range batch.Reports {
+			id, _ := report.GetAnnotation("ReportID").(string)
+			result = append(result, id)
+		}
+		return result
+	}
+
+	random1 := ids(core.AssignReportID{}, newBatch(0, "192.0.2.1"))
+	random2 := ids(core.AssignReportID{}, newBatch(0, "192.0.2.1"))
+	for _, id := range append(random1, random2...) {
+		if m := uuidPattern.FindStringSubmatch(id); m == nil || m[1] != "4" {
+			t.Errorf("random ReportID %q isn't a version 4 UUID", id)
+		}
+	}
+	if random1[0] == random2[0] || random1[0] == random1[1] {
+		t.Errorf("random ReportIDs aren't unique: %v %v", random1, random2)
+	}
+
+	hashed := core.AssignReportID{Deterministic: true}
+	first := ids(hashed, newBatch(0, "192.0.2.1"))
+	retried := ids(hashed, newBatch(5000, "192.0.2.1"))
+	otherClient := ids(hashed, newBatch(0, "192.0.2.2"))
+	for _, id := range first {
+		if m := uuidPattern.FindStringSubmatch(id); m == nil || m[1] != "5" {
+			t.Errorf("deterministic ReportID %q isn't a version 5 UUID", id)
+		}
+	}
+	if first[0] != retried[0] || first[1] != retried[1] {
+		t.Errorf("deterministic ReportIDs depend on age: %v %v", first, retried)
+	}
+	if first[0] == first[1] || first[0] == otherClient[0] {
+		t.Errorf("deterministic ReportIDs collide: %v %v", first, otherClient)
+	}
+}
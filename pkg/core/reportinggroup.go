@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// The places that CaptureReportingGroup can find a batch's reporting group.
+const (
+	GroupFromPath   = "path"
+	GroupFromHeader = "header"
+	GroupFromQuery  = "query"
+)
+
+// UnknownReportingGroup is the reporting group of batches that don't say which
+// group they belong to.
+const UnknownReportingGroup = "unknown"
+
+// CaptureReportingGroup is a pipeline processor that annotates each batch with
+// the Reporting API group (the `report-to` endpoint group) that it was
+// uploaded for, so that you can see which group's configuration produces the
+// most reports.  User agents don't send the group name themselves, so each
+// group's endpoint URL has to identify it, and Source says where:
+//
+//   - GroupFromPath uses the PathSegment'th segment of the upload's path,
+//     counting from 0, so that with a PathSegment of 1, an upload to
+//     /upload/checkout/ belongs to the `checkout` group.
+//
+//   - GroupFromHeader uses the request header called Name, which is useful if
+//     a proxy in front of the collector adds it.
+//
+//   - GroupFromQuery uses the query parameter called Name, such as
+//     /upload/?group=checkout.
+//
+// The group is saved in a batch annotation (ReportingGroup by default).
+// Batches that don't have a group get UnknownReportingGroup.
+type CaptureReportingGroup struct {
+	Source      string
+	Name        string
+	PathSegment int
+	Annotation  string
+}
+
+// group returns the reporting group of a batch, or "" if it doesn't have one.
+func (c CaptureReportingGroup) group(batch *collector.ReportBatch) string {
+	switch c.Source {
+	case GroupFromHeader:
+		return batch.Header.Get(c.Name)
+	case GroupFromQuery:
+		return batch.CollectorURL.Query().Get(c.Name)
+	default:
+		var segments []string
+		for _, segment := range strings.Split(batch.CollectorURL.Path, "/") {
+			if segment != "" {
+				segments = append(segments, segment)
+			}
+		}
+		if c.PathSegment < len(segments) {
+			return segments[c.PathSegment]
+		}
+		return ""
+	}
+}
+
+// ProcessReports annotates the batch with its reporting group.
+func (c CaptureReportingGroup) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	group := c.group(batch)
+	if group == "" {
+		group = UnknownReportingGroup
+	}
+	batch.SetAnnotation(c.Annotation, group)
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"CaptureReportingGroup",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Source      string `toml:"source"`
+				Name        string `toml:"name"`
+				PathSegment *int   `toml:"path_segment"`
+				Annotation  string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			c := CaptureReportingGroup{
+				Source:      config.Source,
+				Name:        config.Name,
+				PathSegment: 1,
+				Annotation:  config.Annotation,
+			}
+			switch c.Source {
+			case "":
+				c.Source = GroupFromPath
+			case GroupFromPath:
+			case GroupFromHeader, GroupFromQuery:
+				if c.Name == "" {
+					return nil, fmt.Errorf("CaptureReportingGroup missing `name`")
+				}
+			default:
+				return nil, fmt.Errorf("CaptureReportingGroup invalid `source`: %s", c.Source)
+			}
+			if config.PathSegment != nil {
+				if *config.PathSegment < 0 {
+					return nil, fmt.Errorf("CaptureReportingGroup `path_segment` must not be negative")
+				}
+				c.PathSegment = *config.PathSegment
+			}
+			if c.Annotation == "" {
+				c.Annotation = "ReportingGroup"
+			}
+			return c, nil
+		})
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestCaptureReportingGroup(t *testing.T) {
+	cases := []struct {
+		name, config, url string
+		header            http.Header
+		want              string
+	}{
+		{"Path", ``, "https://collector.example/upload/checkout/", nil, "checkout"},
+		{"PathMissing", ``, "https://collector.example/upload/", nil, "unknown"},
+		{"PathSegment", `path_segment = 0`, "https://collector.example/checkout/upload", nil, "checkout"},
+		{"Header", "source = \"header\"\nname = \"X-Reporting-Group\"", "https://collector.example/upload/",
+			http.Header{"X-Reporting-Group": {"search"}}, "search"},
+		{"HeaderMissing", "source = \"header\"\nname = \"X-Reporting-Group\"", "https://collector.example/upload/", nil, "unknown"},
+		{"Query", "source = \"query\"\nname = \"group\"", "https://collector.example/upload/?group=checkout", nil, "checkout"},
+		{"QueryEmpty", "source = \"query\"\nname = \"group\"", "https://collector.example/upload/?group=", nil, "unknown"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			u, err := url.Parse(c.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batch := pipelinetest.RunTestConfig("[[processor]]\ntype = \"CaptureReportingGroup\"\n"+c.config,
+				&collector.ReportBatch{CollectorURL: *u, Header: c.header})
+			if got := batch.GetAnnotation("ReportingGroup"); got != c.want {
+				t.Errorf("CaptureReportingGroup annotated %s with %v, wanted %s", c.url, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCaptureReportingGroupBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`source = "cookie"`,
+		`source = "header"`,
+		`source = "query"`,
+		`path_segment = -1`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"CaptureReportingGroup\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// A RetentionRule gives the reports that match a condition a retention
+// period, in days.
+type RetentionRule struct {
+	Condition string `toml:"condition"`
+	Days      int    `toml:"days"`
+}
+
+// RetentionTag is a pipeline processor that decides how long each report
+// should be kept, so that the policy lives in one place, and sinks (such as
+// Elasticsearch's index lifecycle management, or BigQuery's partition expiry)
+// only have to honor it.  Each report is checked against the rules in order,
+// and the first rule that it matches decides its retention period; reports
+// that don't match any rule get DefaultDays.  We save the period in the
+// RetentionDays annotation (an int), and the time that the report expires,
+// which is its event time (see NelReport.EventTime) plus that many days, in
+// the ExpiresAt annotation (a time.Time in UTC).  Reports are never dropped.
+//
+// A report with a negative age has no usable event time, so we use the time
+// that its batch was received instead.  If the batch doesn't have a receive
+// time either, we use Clock.
+type RetentionTag struct {
+	DefaultDays int
+
+	// The names of the annotations to save the retention period and expiry
+	// time in.  If empty, we use "RetentionDays" and "ExpiresAt".
+	DaysAnnotation    string
+	ExpiresAnnotation string
+
+	// Clock is used for batches that don't have a receive time.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+
+	rules []retentionRule
+}
+
+type retentionRule struct {
+	condition condition
+	days      int
+}
+
+// NewRetentionTag creates a new RetentionTag processor with the given rules,
+// whose conditions use the same syntax as NewWhere's, and keeps reports that
+// don't match any of them for defaultDays.
+func NewRetentionTag(rules []RetentionRule, defaultDays int) (*RetentionTag, error) {
+	if defaultDays <= 0 {
+		return nil, fmt.Errorf("default retention must be positive")
+	}
+	r := &RetentionTag{
+		DefaultDays:       defaultDays,
+		DaysAnnotation:    "RetentionDays",
+		ExpiresAnnotation: "ExpiresAt",
+	}
+	for i, rule := range rules {
+		if rule.Days <= 0 {
+			return nil, fmt.Errorf("rule %d has non-positive retention %d", i, rule.Days)
+		}
+		parsed, err := parseCondition(rule.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		r.rules = append(r.rules, retentionRule{parsed, rule.Days})
+	}
+	return r, nil
+}
+
+func (r *RetentionTag) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
+
+// Days returns the number of days that a report in a batch should be kept.
+func (r *RetentionTag) Days(batch *collector.ReportBatch, report *collector.NelReport) int {
+	for _, rule := range r.rules {
+		if truthy(rule.condition.eval(batch, report)) {
+			return rule.days
+		}
+	}
+	return r.DefaultDays
+}
+
+// ProcessReports annotates each report with its retention period and expiry
+// time.
+func (r *RetentionTag) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	received := batch.Time
+	if received.IsZero() {
+		received = r.now()
+	}
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		eventTime := received
+		if report.Age >= 0 {
+			eventTime = report.EventTime(received)
+		}
+		days := r.Days(batch, report)
+		report.SetAnnotation(r.DaysAnnotation, days)
+		report.SetAnnotation(r.ExpiresAnnotation, eventTime.UTC().AddDate(0, 0, days))
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"RetentionTag",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Rules             []RetentionRule `toml:"rule"`
+				DefaultDays       int             `toml:"default_days"`
+				DaysAnnotation    string          `toml:"days_annotation"`
+				ExpiresAnnotation string          `toml:"expires_annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.DefaultDays == 0 {
+				return nil, fmt.Errorf("RetentionTag missing `default_days`")
+			}
+			if config.DefaultDays < 0 {
+				return nil, fmt.Errorf("RetentionTag `default_days` must be positive")
+			}
+			r, err := NewRetentionTag(config.Rules, config.DefaultDays)
+			if err != nil {
+				return nil, fmt.Errorf("RetentionTag invalid `rule`: %v", err)
+			}
+			if config.DaysAnnotation != "" {
+				r.DaysAnnotation = config.DaysAnnotation
+			}
+			if config.ExpiresAnnotation != "" {
+				r.ExpiresAnnotation = config.ExpiresAnnotation
+			}
+			if r.DaysAnnotation == r.ExpiresAnnotation {
+				return nil, fmt.Errorf("RetentionTag `days_annotation` and `expires_annotation` must be different")
+			}
+			r.Clock = clock
+			return r, nil
+		})
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestRetentionTag(t *testing.T) {
+	config := `
+[[processor]]
+type = "RetentionTag"
+default_days = 30
+
+[[processor.rule]]
+condition = "report_type == 'csp-violation'"
+days = 365
+
+[[processor.rule]]
+condition = "status_code == 404"
+days = 7
+`
+	clock := pipelinetest.NewSimulatedClock()
+	pipeline := collector.NewTestPipeline(clock)
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	batch := &collector.ReportBatch{Time: received, Reports: []collector.NelReport{
+		{ReportType: "csp-violation", Age: 60000},
+		{ReportType: "network-error", Type: "http.error", StatusCode: 404},
+		{ReportType: "network-error", Type: "tcp.reset", Age: -5},
+	}}
+	pipeline.ProcessBatch(context.Background(), batch)
+	// Batches without a receive time use the clock.
+	undated := &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "network-error", Type: "ok"}}}
+	pipeline.ProcessBatch(context.Background(), undated)
+
+	type retention struct {
+		Days    interface{}
+		Expires interface{}
+	}
+	var got []retention
+	for _, report := range append(batch.Reports, undated.Reports...) {
+		got = append(got, retention{report.GetAnnotation("RetentionDays"), report.GetAnnotation("ExpiresAt")})
+	}
+	want := []retention{
+		{365, time.Date(2025, 1, 1, 15, 29, 0, 0, time.UTC)},
+		{7, time.Date(2024, 1, 9, 15, 30, 0, 0, time.UTC)},
+		{30, time.Date(2024, 2, 1, 15, 30, 0, 0, time.UTC)},
+		{30, clock.CurrentTime.UTC().AddDate(0, 0, 30)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RetentionTag diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRetentionTagBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`default_days = -1`,
+		"default_days = 30\n[[processor.rule]]\ncondition = \"status_code == 404\"\ndays = 0",
+		"default_days = 30\n[[processor.rule]]\ncondition = \"status_code ==\"\ndays = 7",
+		"default_days = 30\ndays_annotation = \"Retention\"\nexpires_annotation = \"Retention\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"RetentionTag\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// ReverseDNS is a pipeline processor that looks up the PTR record for each
+// report's server_ip, and stores the resulting hostname in an annotation
+// (ServerHostname by default).  This can help when debugging CDN issues.
+//
+// Results are kept in a bounded cache, so that we don't send the resolver a
+// query for every report, and each lookup has a timeout, so that a slow
+// resolver can't stall the pipeline.  Addresses that don't have a PTR record
+// (and lookups that fail or time out) get an empty annotation.  Reports without
+// a server_ip aren't annotated at all, and nor are ones whose server_ip isn't
+// an IP address.
+//
+// Since server_ip comes from the client, we're careful not to let an upload
+// make us send the resolver an unbounded number of queries: we look up at most
+// MaxLookupsPerBatch uncached addresses for each batch (the rest get an empty
+// annotation), run at most MaxConcurrentLookups lookups at once across every
+// batch, and remember failed lookups for half a minute, so that they can't be
+// forced again on every upload.
+type ReverseDNS struct {
+	// The name of the annotation to store the hostname in.
+	Annotation string
+
+	// How long we wait for each lookup before giving up.
+	Timeout time.Duration
+
+	// The most uncached addresses that we look up for a single batch.
+	MaxLookupsPerBatch int
+
+	// The most lookups that we run at once.  A lookup that can't start
+	// within Timeout gives up.
+	MaxConcurrentLookups int
+
+	// LookupAddr performs the reverse lookup.  NewReverseDNS sets it to use
+	// net.DefaultResolver.
+	LookupAddr func(ctx context.Context, addr string) ([]string, error)
+
+	// Clock is used to expire cached results.  If nil, we use the current time.
+	Clock collector.Clock
+
+	cache    *ttlCache
+	failures *ttlCache
+	semOnce  sync.Once
+	sem      chan struct{}
+}
+
+// The defaults for a ReverseDNS's limits on lookups.
+const (
+	DefaultReverseDNSLookupsPerBatch   = 64
+	DefaultReverseDNSConcurrentLookups = 16
+)
+
+// reverseDNSFailureTTL is how long we remember that a lookup failed.
+const reverseDNSFailureTTL = 30 * time.Second
+
+// errReverseDNSBusy is returned by lookup if there were already
+// MaxConcurrentLookups lookups running for the whole of the timeout.
+var errReverseDNSBusy = errors.New("too many lookups in progress")
+
+// NewReverseDNS creates a new ReverseDNS processor that caches up to cacheSize
+// results for ttl each.
+func NewReverseDNS(cacheSize int, ttl, timeout time.Duration) *ReverseDNS {
+	return &ReverseDNS{
+		Annotation:           "ServerHostname",
+		Timeout:              timeout,
+		MaxLookupsPerBatch:   DefaultReverseDNSLookupsPerBatch,
+		MaxConcurrentLookups: DefaultReverseDNSConcurrentLookups,
+		LookupAddr:           net.DefaultResolver.LookupAddr,
+		cache:                newTTLCache(cacheSize, ttl),
+		failures:             newTTLCache(cacheSize, reverseDNSFailureTTL),
+	}
+}
+
+// newResolver returns a Resolver that sends its queries to a specific DNS
+// server, rather than the system's default.
+func newResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func (r *ReverseDNS) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
+
+// lookup returns the hostname for addr, which is empty if it doesn't have a
+// PTR record, or an error if the lookup failed.  (We cache names and missing
+// PTR records for the full TTL, but other errors are likely to be transient.)
+func (r *ReverseDNS) lookup(ctx context.Context, addr string) (string, error) {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	select {
+	case r.sem <- struct{}{}:
+		defer func() { <-r.sem }()
+	case <-ctx.Done():
+		return "", errReverseDNSBusy
+	}
+	names, err := r.LookupAddr(ctx, addr)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
+// ProcessReports annotates each report with the hostname of its server_ip.
+// Any addresses that aren't already cached are looked up in parallel, up to
+// MaxLookupsPerBatch of them.
+func (r *ReverseDNS) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	r.semOnce.Do(func() {
+		concurrency := r.MaxConcurrentLookups
+		if concurrency < 1 {
+			concurrency = DefaultReverseDNSConcurrentLookups
+		}
+		r.sem = make(chan struct{}, concurrency)
+	})
+	now := r.now()
+	hostnames := make(map[string]string)
+	var missing []string
+	for _, report := range batch.Reports {
+		addr := report.ServerIP
+		if addr == "" || net.ParseIP(addr) == nil {
+			continue
+		}
+		if _, seen := hostnames[addr]; seen {
+			continue
+		}
+		hostnames[addr] = ""
+		if hostname, ok := r.cache.get(addr, now); ok {
+			hostnames[addr] = hostname.(string)
+		} else if _, failed := r.failures.get(addr, now); !failed && len(missing) < r.MaxLookupsPerBatch {
+			missing = append(missing, addr)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, addr := range missing {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			hostname, err := r.lookup(ctx, addr)
+			switch err {
+			case nil:
+				r.cache.add(addr, hostname, now)
+			case errReverseDNSBusy:
+			default:
+				r.failures.add(addr, "", now)
+			}
+			mu.Lock()
+			hostnames[addr] = hostname
+			mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	for i := range batch.Reports {
+		if hostname, ok := hostnames[batch.Reports[i].ServerIP]; ok {
+			batch.Reports[i].SetAnnotation(r.Annotation, hostname)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ReverseDNS",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotation string `toml:"annotation"`
+				CacheSize  int    `toml:"cache_size"`
+				TTL        string `toml:"ttl"`
+				Timeout    string `toml:"timeout"`
+				Resolver   string `toml:"resolver"`
+
+				MaxLookupsPerBatch   *int `toml:"max_lookups_per_batch"`
+				MaxConcurrentLookups *int `toml:"max_concurrent_lookups"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.CacheSize < 0 {
+				return nil, fmt.Errorf("ReverseDNS `cache_size` must not be negative")
+			}
+			if config.CacheSize == 0 {
+				config.CacheSize = 10000
+			}
+
+			ttl := 5 * time.Minute
+			if config.TTL != "" {
+				ttl, err = time.ParseDuration(config.TTL)
+				if err != nil {
+					return nil, fmt.Errorf("ReverseDNS invalid `ttl`: %v", err)
+				}
+			}
+			timeout := 500 * time.Millisecond
+			if config.Timeout != "" {
+				timeout, err = time.ParseDuration(config.Timeout)
+				if err != nil {
+					return nil, fmt.Errorf("ReverseDNS invalid `timeout`: %v", err)
+				}
+			}
+
+			if config.MaxLookupsPerBatch != nil && *config.MaxLookupsPerBatch < 1 {
+				return nil, fmt.Errorf("ReverseDNS `max_lookups_per_batch` must be positive")
+			}
+			if config.MaxConcurrentLookups != nil && *config.MaxConcurrentLookups < 1 {
+				return nil, fmt.Errorf("ReverseDNS `max_concurrent_lookups` must be positive")
+			}
+
+			r := NewReverseDNS(config.CacheSize, ttl, timeout)
+			r.Clock = clock
+			if config.MaxLookupsPerBatch != nil {
+				r.MaxLookupsPerBatch = *config.MaxLookupsPerBatch
+			}
+			if config.MaxConcurrentLookups != nil {
+				r.MaxConcurrentLookups = *config.MaxConcurrentLookups
+			}
+			if config.Annotation != "" {
+				r.Annotation = config.Annotation
+			}
+			if config.Resolver != "" {
+				address := config.Resolver
+				if _, _, err := net.SplitHostPort(address); err != nil {
+					address = net.JoinHostPort(address, "53")
+				}
+				r.LookupAddr = newResolver(address).LookupAddr
+			}
+			return r, nil
+		})
+}
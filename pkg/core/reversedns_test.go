@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+type fakeResolver struct {
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	f.mu.Lock()
+	f.lookups[addr]++
+	f.mu.Unlock()
+	switch addr {
+	case "203.0.113.75":
+		return []string{"edge-1.cdn.example."}, nil
+	case "203.0.113.76":
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	default:
+		return nil, errors.New("i/o timeout")
+	}
+}
+
+func TestReverseDNS(t *testing.T) {
+	resolver := &fakeResolver{lookups: make(map[string]int)}
+	clock := pipelinetest.NewSimulatedClock()
+	r := core.NewReverseDNS(10, time.Minute, time.Second)
+	r.LookupAddr = resolver.LookupAddr
+	r.Clock = clock
+
+	newBatch := func() *collector.ReportBatch {
+		return &collector.ReportBatch{
+			Reports: []collector.NelReport{
+				{ServerIP: "203.0.113.75"},
+				{ServerIP: "203.0.113.75"},
+				{ServerIP: "203.0.113.76"},
+				{ServerIP: "203.0.113.77"},
+				{},
+			},
+		}
+	}
+
+	for round := 0; round < 2; round++ {
+		batch := newBatch()
+		r.ProcessReports(context.Background(), batch)
+		for i, want := range []interface{}{"edge-1.cdn.example", "edge-1.cdn.example", "", "", nil} {
+			if got := batch.Reports[i].GetAnnotation("ServerHostname"); got != want {
+				t.Errorf("round %d: report %d ServerHostname = %v, wanted %v", round, i, got, want)
+			}
+		}
+	}
+
+	// Successful lookups and missing PTR records are cached, and so are other
+	// errors, for a shorter time.
+	want := map[string]int{"203.0.113.75": 1, "203.0.113.76": 1, "203.0.113.77": 1}
+	for addr, count := range want {
+		if got := resolver.lookups[addr]; got != count {
+			t.Errorf("LookupAddr(%s) called %d times, wanted %d", addr, got, count)
+		}
+	}
+
+	// Once the TTL passes, we should look up the address again.
+	clock.CurrentTime = clock.CurrentTime.Add(2 * time.Minute)
+	r.ProcessReports(context.Background(), newBatch())
+	if got := resolver.lookups["203.0.113.75"]; got != 2 {
+		t.Errorf("LookupAddr(203.0.113.75) called %d times after TTL, wanted 2", got)
+	}
+	if got := resolver.lookups["203.0.113.77"]; got != 2 {
+		t.Errorf("LookupAddr(203.0.113.77) called %d times after TTL, wanted 2", got)
+	}
+}
+
+func TestReverseDNSLimits(t *testing.T) {
+	resolver := &fakeResolver{lookups: make(map[string]int)}
+	var mu sync.Mutex
+	running, most := 0, 0
+	r := core.NewReverseDNS(1000, time.Minute, 5*time.Second)
+	r.LookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return resolver.LookupAddr(ctx, addr)
+	}
+	r.Clock = pipelinetest.NewSimulatedClock()
+	r.MaxLookupsPerBatch = 10
+	r.MaxConcurrentLookups = 2
+
+	batch := &collector.ReportBatch{}
+	for i := 0; i < 100; i++ {
+		batch.Reports = append(batch.Reports, collector.NelReport{ServerIP: fmt.Sprintf("198.51.100.%d", i)})
+	}
+	batch.Reports = append(batch.Reports, collector.NelReport{ServerIP: "not an address"})
+	r.ProcessReports(context.Background(), batch)
+	if got := len(resolver.lookups); got != 10 {
+		t.Errorf("ReverseDNS looked up %d addresses, wanted 10", got)
+	}
+	if most > 2 {
+		t.Errorf("ReverseDNS ran %d lookups at once, wanted at most 2", most)
+	}
+	if got := batch.Reports[99].GetAnnotation("ServerHostname"); got != "" {
+		t.Errorf("Address over the limit has ServerHostname %v, wanted \"\"", got)
+	}
+	if got := batch.Reports[100].GetAnnotation("ServerHostname"); got != nil {
+		t.Errorf("Invalid address has ServerHostname %v, wanted none", got)
+	}
+}
+
+func TestReverseDNSBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "ReverseDNS", cache_size = -1}]`,
+		`processor = [{type = "ReverseDNS", ttl = "soon"}]`,
+		`processor = [{type = "ReverseDNS", timeout = "soon"}]`,
+		`processor = [{type = "ReverseDNS", max_lookups_per_batch = 0}]`,
+		`processor = [{type = "ReverseDNS", max_concurrent_lookups = 0}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
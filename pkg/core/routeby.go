@@ -0,0 +1,205 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// RouteBy is a pipeline processor that works like a switch statement: it looks
+// at the value of one field or annotation of each report, and sends the report
+// to the chain of processors (its route) for that value.  Reports whose value
+// doesn't have a route (or that don't have the annotation at all) are sent to
+// the Default chain, if there is one.
+//
+// Like the branches of a Tee, each route receives its own copy of the batch
+// (see ReportBatch.Clone), containing just the reports that were sent to it.
+// Each copy has its own copy of the batch's annotations, so annotations that
+// one route adds aren't visible to the others.  The original batch is never
+// modified.  Routes are run one after another, in the order they were
+// configured, followed by the default; a route that doesn't receive any reports
+// isn't run at all.
+type RouteBy struct {
+	Routes  []Route
+	Default []collector.ReportProcessor
+
+	value condition
+}
+
+// A Route is a chain of processors that RouteBy sends some reports to.
+type Route struct {
+	Value      string
+	Processors []collector.ReportProcessor
+}
+
+// NewRouteBy creates a new RouteBy processor that routes reports by the value
+// of a field, whose name is as in Where's conditions (such as `report_type` or
+// `status_code`).  Numbers are compared with route values in their shortest
+// decimal form, so a `status_code` of 503 is routed to the route for "503".
+func NewRouteBy(field string, routes []Route, defaultRoute []collector.ReportProcessor) (*RouteBy, error) {
+	get, ok := reportFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", field)
+	}
+	return &RouteBy{Routes: routes, Default: defaultRoute, value: fieldRef{get}}, nil
+}
+
+// NewRouteByAnnotation creates a new RouteBy processor that routes reports by
+// the value of an annotation.  As in Where's conditions, we fall back on the
+// batch's annotation if a report doesn't have one.
+func NewRouteByAnnotation(annotation string, routes []Route, defaultRoute []collector.ReportProcessor) *RouteBy {
+	return &RouteBy{Routes: routes, Default: defaultRoute, value: annotationRef{annotation}}
+}
+
+// routeValue returns the string that a report's value is compared against
+// route values as, or false if the report doesn't have a value.
+func routeValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// ProcessReports sends each report in the batch to its route.
+func (r *RouteBy) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	routes := make(map[string]int, len(r.Routes))
+	for i := len(r.Routes) - 1; i >= 0; i-- {
+		routes[r.Routes[i].Value] = i
+	}
+	// routed[i] holds the indexes of the reports for the ith route; the last
+	// element is for the default.
+	routed := make([][]int, len(r.Routes)+1)
+	for i := range batch.Reports {
+		route := len(r.Routes)
+		if value, ok := routeValue(r.value.eval(batch, &batch.Reports[i])); ok {
+			if idx, ok := routes[value]; ok {
+				route = idx
+			}
+		}
+		routed[route] = append(routed[route], i)
+	}
+
+	for i, indexes := range routed {
+		chain := r.Default
+		if i < len(r.Routes) {
+			chain = r.Routes[i].Processors
+		}
+		if len(indexes) == 0 || len(chain) == 0 {
+			continue
+		}
+		clone := batch.Clone()
+		reports := make([]collector.NelReport, len(indexes))
+		for j, idx := range indexes {
+			reports[j] = clone.Reports[idx]
+		}
+		clone.Reports = reports
+		runChain(ctx, chain, clone)
+	}
+}
+
+// Close closes any processors in the routes that need to be closed.
+func (r *RouteBy) Close() error {
+	result := collector.CloseProcessors(r.Default)
+	for _, route := range r.Routes {
+		if err := collector.CloseProcessors(route.Processors); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"RouteBy",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Field      string           `toml:"field"`
+				Annotation string           `toml:"annotation"`
+				Routes     []toml.Primitive `toml:"route"`
+				Default    []toml.Primitive `toml:"default"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if (config.Field == "") == (config.Annotation == "") {
+				return nil, fmt.Errorf("RouteBy needs exactly one of `field` or `annotation`")
+			}
+			if config.Field != "" {
+				if _, ok := reportFields[config.Field]; !ok {
+					return nil, fmt.Errorf("RouteBy invalid `field`: %s", config.Field)
+				}
+			}
+			if len(config.Routes) == 0 {
+				return nil, fmt.Errorf("RouteBy missing `route`")
+			}
+
+			// Keep track of the processors we've loaded, so that we can close them
+			// if a later route is invalid.
+			loaded := &RouteBy{}
+			seen := make(map[string]bool)
+			for idx, routePrimitive := range config.Routes {
+				var routeConfig struct {
+					Value string `toml:"value"`
+				}
+				if err := collector.DecodeConfig(ctx, routePrimitive, &routeConfig); err != nil {
+					loaded.Close()
+					return nil, fmt.Errorf("RouteBy route %d: %v", idx, err)
+				}
+				if seen[routeConfig.Value] {
+					loaded.Close()
+					return nil, fmt.Errorf("RouteBy route %d has duplicate `value` %q", idx, routeConfig.Value)
+				}
+				seen[routeConfig.Value] = true
+				processors, err := collector.LoadChildProcessors(ctx, routePrimitive)
+				if err != nil {
+					loaded.Close()
+					return nil, fmt.Errorf("RouteBy route %d: %v", idx, err)
+				}
+				if len(processors) == 0 {
+					loaded.Close()
+					return nil, fmt.Errorf("RouteBy route %d missing `children`", idx)
+				}
+				loaded.Routes = append(loaded.Routes, Route{Value: routeConfig.Value, Processors: processors})
+			}
+			loaded.Default, err = collector.LoadProcessors(ctx, config.Default)
+			if err != nil {
+				loaded.Close()
+				return nil, fmt.Errorf("RouteBy default: %v", err)
+			}
+
+			if config.Annotation != "" {
+				return NewRouteByAnnotation(config.Annotation, loaded.Routes, loaded.Default), nil
+			}
+			r, err := NewRouteBy(config.Field, loaded.Routes, loaded.Default)
+			if err != nil {
+				loaded.Close()
+				return nil, err
+			}
+			return r, nil
+		})
+}
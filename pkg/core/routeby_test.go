@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// routeRecorder returns a processor that records the URLs of the reports that
+// it sees under a name, and annotates the batch with that name.
+func routeRecorder(name string, seen map[string][]string) collector.ReportProcessor {
+	return processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		for _, report := range batch.Reports {
+			seen[name] = append(seen[name], report.URL)
+		}
+		seen[name+" saw"] = append(seen[name+" saw"], strings.Join(batch.GetAnnotation("Routes").([]string), ","))
+		batch.SetAnnotation("Routes", append(batch.GetAnnotation("Routes").([]string), name))
+	})
+}
+
+func TestRouteBy(t *testing.T) {
+	newBatch := func() *collector.ReportBatch {
+		batch := &collector.ReportBatch{
+			Reports: []collector.NelReport{
+				{ReportType: "network-error", URL: "a", StatusCode: 503},
+				{ReportType: "csp-violation", URL: "b"},
+				{ReportType: "network-error", URL: "c", StatusCode: 200},
+				{ReportType: "deprecation", URL: "d"},
+			},
+		}
+		batch.SetAnnotation("Routes", []string{})
+		batch.Reports[1].SetAnnotation("Sink", "siem")
+		batch.Reports[3].SetAnnotation("Sink", "siem")
+		return batch
+	}
+
+	seen := make(map[string][]string)
+	r, err := core.NewRouteBy("report_type", []core.Route{
+		{Value: "network-error", Processors: []collector.ReportProcessor{routeRecorder("nel", seen)}},
+		{Value: "csp-violation", Processors: []collector.ReportProcessor{routeRecorder("csp", seen)}},
+		{Value: "unused", Processors: []collector.ReportProcessor{routeRecorder("unused", seen)}},
+	}, []collector.ReportProcessor{routeRecorder("default", seen)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := newBatch()
+	r.ProcessReports(context.Background(), batch)
+	want := map[string][]string{
+		"nel":         {"a", "c"},
+		"nel saw":     {""},
+		"csp":         {"b"},
+		"csp saw":     {""},
+		"default":     {"d"},
+		"default saw": {""},
+	}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("RouteBy(report_type) routed diff (-want +got):\n%s", diff)
+	}
+	if len(batch.Reports) != 4 || len(batch.GetAnnotation("Routes").([]string)) != 0 {
+		t.Errorf("RouteBy modified the original batch")
+	}
+
+	// Numeric fields are routed by their decimal form.
+	seen = make(map[string][]string)
+	r, err = core.NewRouteBy("status_code", []core.Route{
+		{Value: "503", Processors: []collector.ReportProcessor{routeRecorder("503", seen)}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ProcessReports(context.Background(), newBatch())
+	if diff := cmp.Diff(map[string][]string{"503": {"a"}, "503 saw": {""}}, seen); diff != "" {
+		t.Errorf("RouteBy(status_code) routed diff (-want +got):\n%s", diff)
+	}
+
+	// Reports without the annotation go to the default route.
+	seen = make(map[string][]string)
+	r = core.NewRouteByAnnotation("Sink", []core.Route{
+		{Value: "siem", Processors: []collector.ReportProcessor{routeRecorder("siem", seen)}},
+	}, []collector.ReportProcessor{routeRecorder("default", seen)})
+	r.ProcessReports(context.Background(), newBatch())
+	want = map[string][]string{
+		"siem":        {"b", "d"},
+		"siem saw":    {""},
+		"default":     {"a", "c"},
+		"default saw": {""},
+	}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("RouteByAnnotation(Sink) routed diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRouteByConfig(t *testing.T) {
+	var pipeline collector.Pipeline
+	err := pipeline.LoadFromConfig(context.Background(), []byte(`
+		[[processor]]
+		type = "RouteBy"
+		field = "report_type"
+
+		[[processor.route]]
+		value = "network-error"
+		[[processor.route.children]]
+		type = "AssignReportID"
+
+		[[processor.route]]
+		value = "csp-violation"
+		[[processor.route.children]]
+		type = "AssignReportID"
+		mode = "hash"
+
+		[[processor.default]]
+		type = "AssignReportID"
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, config := range []string{
+		"field = \"report_type\"",
+		"field = \"colour\"\n[[processor.route]]\nvalue = \"a\"\n[[processor.route.children]]\ntype = \"AssignReportID\"",
+		"field = \"type\"\nannotation = \"Sink\"\n[[processor.route]]\nvalue = \"a\"\n[[processor.route.children]]\ntype = \"AssignReportID\"",
+		"annotation = \"Sink\"\n[[processor.route]]\nvalue = \"a\"",
+		"annotation = \"Sink\"\n[[processor.route]]\nvalue = \"a\"\n[[processor.route.children]]\ntype = \"AssignReportID\"\n[[processor.route]]\nvalue = \"a\"\n[[processor.route.children]]\ntype = \"AssignReportID\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"RouteBy\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// SampleReports is a pipeline processor that keeps a fixed fraction (Rate) of
+// the reports that it sees, and throws the rest away.
+//
+// By default each report is kept at random.  In hash mode, we instead hash a
+// stable key for each report (by default, the IP address of the client that
+// uploaded it), along with Salt, and keep the report if the hash is below
+// Rate.  That means that a given client's reports are either always or never
+// in the sample, so you can follow individual clients over time.  Membership
+// is monotonic in Rate: raising the rate keeps every client that was sampled
+// before and adds some more, and lowering it drops some clients while keeping
+// the rest.  Changing Salt chooses an unrelated set of clients.  Reports that
+// don't have a key are sampled at random.
+//
+// Each report that we keep gets a SamplingMode annotation ("random" or
+// "hash"), and a SamplingWeight annotation containing the reciprocal of the
+// probability that we kept it, so that downstream aggregations can sum weights
+// instead of counting reports.  If the report already has a SamplingWeight
+// (say, from an earlier AdaptiveSample), we multiply it.
+//
+// An operator can change the rate while the processor is running with
+// SetRate, which only accepts rates between MinRate and MaxRate; see
+// SampleRateHandler for doing that over HTTP.  Each batch is sampled entirely
+// at the rate in effect when we started on it.
+type SampleReports struct {
+	Rate float64
+	Hash bool
+	Salt string
+
+	// The range of rates that SetRate accepts.  If MaxRate is 0, we use 1.
+	MinRate float64
+	MaxRate float64
+
+	// override holds the bits of the rate that was set with SetRate, or 0
+	// if it hasn't been.  It's only accessed atomically.
+	override uint64
+
+	key  func(batch *collector.ReportBatch, report *collector.NelReport) (string, bool)
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewSampleReports creates a new SampleReports processor that keeps reports
+// at random.
+func NewSampleReports(rate float64) *SampleReports {
+	return &SampleReports{
+		Rate: rate,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// NewHashSampleReports creates a new SampleReports processor that keeps
+// reports based on a hash of field, which can be "client_ip", for the IP
+// address of the client that uploaded each report, or any of the fields that
+// Where's conditions can use.
+func NewHashSampleReports(rate float64, field, salt string) (*SampleReports, error) {
+	s := NewSampleReports(rate)
+	s.Hash = true
+	s.Salt = salt
+	if field == "client_ip" {
+		s.key = func(batch *collector.ReportBatch, report *collector.NelReport) (string, bool) {
+			ip := clientIP(batch, report)
+			return ip, ip != ""
+		}
+		return s, nil
+	}
+	get, ok := reportFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", field)
+	}
+	s.key = func(batch *collector.ReportBatch, report *collector.NelReport) (string, bool) {
+		value, ok := routeValue(get(report))
+		return value, ok && value != ""
+	}
+	return s, nil
+}
+
+// hashFraction maps a salted key to a number in [0, 1) that's effectively
+// random, but always the same for the same key and salt.
+func hashFraction(salt, key string) float64 {
+	sum := sha256.Sum256([]byte(salt + "\x00" + key))
+	// Use the top 53 bits, so that the result is exact as a float64.
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// CurrentRate returns the rate that we're sampling at: the one most recently
+// passed to SetRate, or Rate if there hasn't been one.
+func (s *SampleReports) CurrentRate() float64 {
+	if bits := atomic.LoadUint64(&s.override); bits != 0 {
+		return math.Float64frombits(bits)
+	}
+	return s.Rate
+}
+
+// rateRange returns the range of rates that SetRate accepts.
+func (s *SampleReports) rateRange() (float64, float64) {
+	if s.MaxRate == 0 {
+		return s.MinRate, 1
+	}
+	return s.MinRate, s.MaxRate
+}
+
+// SetRate changes the rate that we sample at, returning an error (and leaving
+// the rate alone) if it's outside of the range between MinRate and MaxRate.
+// It's safe to call while other goroutines are processing reports.
+func (s *SampleReports) SetRate(rate float64) error {
+	min, max := s.rateRange()
+	if rate <= 0 || rate < min || rate > max || math.IsNaN(rate) {
+		return fmt.Errorf("Sampling rate must be greater than 0, at least %v, and at most %v", min, max)
+	}
+	atomic.StoreUint64(&s.override, math.Float64bits(rate))
+	return nil
+}
+
+// keep returns whether we should keep a report at the given rate, and the
+// sampling mode that we used to decide.
+func (s *SampleReports) keep(batch *collector.ReportBatch, report *collector.NelReport, rate float64) (bool, string) {
+	if s.Hash && s.key != nil {
+		if key, ok := s.key(batch, report); ok {
+			return hashFraction(s.Salt, key) < rate, "hash"
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < rate, "random"
+}
+
+// ProcessReports throws away the reports in the batch that aren't in the
+// sample, annotating the ones that are kept.
+func (s *SampleReports) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	rate := s.CurrentRate()
+	var filtered []collector.NelReport
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		keep, mode := s.keep(batch, report, rate)
+		if !keep {
+			continue
+		}
+		weight := 1 / rate
+		if previous, ok := report.GetAnnotation("SamplingWeight").(float64); ok {
+			weight *= previous
+		}
+		report.SetAnnotation("SamplingMode", mode)
+		report.SetAnnotation("SamplingWeight", weight)
+		filtered = append(filtered, *report)
+	}
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"SampleReports",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Rate      float64  `toml:"rate"`
+				Mode      string   `toml:"mode"`
+				Field     string   `toml:"field"`
+				Salt      string   `toml:"salt"`
+				AdminPath string   `toml:"admin_path"`
+				MinRate   float64  `toml:"min_rate"`
+				MaxRate   *float64 `toml:"max_rate"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Rate <= 0 || config.Rate > 1 || math.IsNaN(config.Rate) {
+				return nil, fmt.Errorf("SampleReports `rate` must be greater than 0 and at most 1")
+			}
+			maxRate := 1.0
+			if config.MaxRate != nil {
+				maxRate = *config.MaxRate
+			}
+			if config.MinRate < 0 || math.IsNaN(config.MinRate) {
+				return nil, fmt.Errorf("SampleReports `min_rate` must not be negative")
+			}
+			if maxRate <= 0 || maxRate > 1 || math.IsNaN(maxRate) {
+				return nil, fmt.Errorf("SampleReports `max_rate` must be greater than 0 and at most 1")
+			}
+			if config.Rate < config.MinRate || config.Rate > maxRate {
+				return nil, fmt.Errorf("SampleReports `rate` must be between `min_rate` and `max_rate`")
+			}
+			if config.AdminPath != "" && !strings.HasPrefix(config.AdminPath, "/") {
+				return nil, fmt.Errorf("SampleReports invalid `admin_path`: %s", config.AdminPath)
+			}
+
+			var s *SampleReports
+			switch config.Mode {
+			case "", "random":
+				if config.Field != "" || config.Salt != "" {
+					return nil, fmt.Errorf("SampleReports only uses `field` and `salt` in hash mode")
+				}
+				s = NewSampleReports(config.Rate)
+			case "hash":
+				if config.Field == "" {
+					config.Field = "client_ip"
+				}
+				s, err = NewHashSampleReports(config.Rate, config.Field, config.Salt)
+				if err != nil {
+					return nil, fmt.Errorf("SampleReports invalid `field`: %s", config.Field)
+				}
+			default:
+				return nil, fmt.Errorf("SampleReports invalid `mode`: %s", config.Mode)
+			}
+			s.MinRate = config.MinRate
+			s.MaxRate = maxRate
+			if config.AdminPath != "" {
+				registerSampleRate(config.AdminPath, s)
+			}
+			return s, nil
+		})
+}
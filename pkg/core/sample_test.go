@@ -0,0 +1,197 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// sampledClients returns the client IPs (out of 1000) whose reports a
+// SampleReports processor keeps.
+func sampledClients(t *testing.T, s *core.SampleReports) map[string]bool {
+	result := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("192.0.%d.%d", i/256, i%256)
+		batch := &collector.ReportBatch{ClientIP: ip, Reports: []collector.NelReport{{}, {}}}
+		s.ProcessReports(context.Background(), batch)
+		switch len(batch.Reports) {
+		case 0:
+		case 2:
+			result[ip] = true
+			for _, report := range batch.Reports {
+				if mode := report.GetAnnotation("SamplingMode"); mode != "hash" {
+					t.Fatalf("SampleReports set SamplingMode to %v, wanted hash", mode)
+				}
+			}
+		default:
+			t.Fatalf("SampleReports kept %d of a client's 2 reports", len(batch.Reports))
+		}
+	}
+	return result
+}
+
+func TestHashSampleReports(t *testing.T) {
+	newSampler := func(rate float64, salt string) *core.SampleReports {
+		s, err := core.NewHashSampleReports(rate, "client_ip", salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tenth := sampledClients(t, newSampler(0.1, "salt"))
+	if len(tenth) < 50 || len(tenth) > 150 {
+		t.Errorf("SampleReports kept %d of 1000 clients, wanted about 100", len(tenth))
+	}
+	// The same clients are sampled every time...
+	again := sampledClients(t, newSampler(0.1, "salt"))
+	if len(again) != len(tenth) {
+		t.Errorf("SampleReports kept %d clients the second time, wanted %d", len(again), len(tenth))
+	}
+	for ip := range tenth {
+		if !again[ip] {
+			t.Errorf("SampleReports didn't keep %s the second time", ip)
+		}
+	}
+	// ...and raising the rate keeps all of them.
+	fifth := sampledClients(t, newSampler(0.2, "salt"))
+	for ip := range tenth {
+		if !fifth[ip] {
+			t.Errorf("SampleReports dropped %s when the rate was raised", ip)
+		}
+	}
+	// A different salt chooses different clients.
+	var overlap int
+	for ip := range sampledClients(t, newSampler(0.1, "pepper")) {
+		if tenth[ip] {
+			overlap++
+		}
+	}
+	if overlap > 30 {
+		t.Errorf("SampleReports kept %d of the same clients with a different salt", overlap)
+	}
+}
+
+func TestSampleReportsWeight(t *testing.T) {
+	s := core.NewSampleReports(0.5)
+	// Keep trying until both reports happen to be kept.
+	var batch *collector.ReportBatch
+	for i := 0; i < 100; i++ {
+		batch = &collector.ReportBatch{Reports: []collector.NelReport{{}, {}}}
+		batch.Reports[1].SetAnnotation("SamplingWeight", 4.0)
+		s.ProcessReports(context.Background(), batch)
+		if len(batch.Reports) == 2 {
+			break
+		}
+	}
+	if len(batch.Reports) != 2 {
+		t.Fatalf("SampleReports never kept both reports")
+	}
+	if got := batch.Reports[0].GetAnnotation("SamplingWeight"); got != 2.0 {
+		t.Errorf("SampleReports set SamplingWeight to %v, wanted 2", got)
+	}
+	if got := batch.Reports[1].GetAnnotation("SamplingWeight"); got != 8.0 {
+		t.Errorf("SampleReports set SamplingWeight to %v for a weighted report, wanted 8", got)
+	}
+	if got := batch.Reports[0].GetAnnotation("SamplingMode"); got != "random" {
+		t.Errorf("SampleReports set SamplingMode to %v, wanted random", got)
+	}
+}
+
+func TestSampleRateHandler(t *testing.T) {
+	pipeline := pipelinetest.NewTestConfigPipeline(`
+		[[processor]]
+		type = "SampleReports"
+		rate = 0.5
+		min_rate = 0.01
+		max_rate = 0.8
+		admin_path = "/sampling/test"
+	`)
+	defer pipeline.Close()
+	handler := core.SampleRateHandler()
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	cases := []struct {
+		method, path, body string
+		code               int
+		response           string
+	}{
+		{"GET", "/sampling/test", "", http.StatusOK, `{"rate":0.5,"min_rate":0.01,"max_rate":0.8}`},
+		{"GET", "/sampling/other", "", http.StatusNotFound, ""},
+		{"PATCH", "/sampling/test", "rate=0.9", http.StatusBadRequest, ""},
+		{"PATCH", "/sampling/test", "rate=0.001", http.StatusBadRequest, ""},
+		{"PATCH", "/sampling/test", "rate=lots", http.StatusBadRequest, ""},
+		{"DELETE", "/sampling/test", "", http.StatusMethodNotAllowed, ""},
+		{"PATCH", "/sampling/test", "rate=0.1", http.StatusOK, `{"rate":0.1,"min_rate":0.01,"max_rate":0.8}`},
+		{"GET", "/sampling/test", "", http.StatusOK, `{"rate":0.1,"min_rate":0.01,"max_rate":0.8}`},
+	}
+	for _, c := range cases {
+		w := request(c.method, c.path, c.body)
+		if w.Code != c.code {
+			t.Errorf("%s %s %q: got %d, wanted %d", c.method, c.path, c.body, w.Code, c.code)
+			continue
+		}
+		if got := strings.TrimSpace(w.Body.String()); c.response != "" && got != c.response {
+			t.Errorf("%s %s %q: got %s, wanted %s", c.method, c.path, c.body, got, c.response)
+		}
+	}
+
+	// The new rate applies to the running pipeline.
+	batch := &collector.ReportBatch{Reports: make([]collector.NelReport, 1000)}
+	pipeline.ProcessBatch(context.Background(), batch)
+	if len(batch.Reports) < 50 || len(batch.Reports) > 150 {
+		t.Errorf("SampleReports kept %d of 1000 reports after the rate was lowered, wanted about 100", len(batch.Reports))
+	}
+	for _, report := range batch.Reports {
+		if got := report.GetAnnotation("SamplingWeight"); got != 10.0 {
+			t.Fatalf("SampleReports set SamplingWeight to %v, wanted 10", got)
+		}
+	}
+}
+
+func TestSampleReportsBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`rate = 1.5`,
+		`rate = 0.5` + "\n" + `mode = "sometimes"`,
+		`rate = 0.5` + "\n" + `salt = "x"`,
+		`rate = 0.5` + "\n" + `mode = "hash"` + "\n" + `field = "nonexistent"`,
+		`rate = 0.5` + "\n" + `min_rate = 0.6`,
+		`rate = 0.5` + "\n" + `max_rate = 0.4`,
+		`rate = 0.5` + "\n" + `max_rate = 0.0`,
+		`rate = 0.5` + "\n" + `min_rate = -0.1`,
+		`rate = 0.5` + "\n" + `admin_path = "sampling"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"SampleReports\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var sampleRates = struct {
+	sync.Mutex
+	m map[string]*SampleReports
+}{m: make(map[string]*SampleReports)}
+
+// registerSampleRate makes a SampleReports processor adjustable via
+// SampleRateHandler at the given path.  A processor loaded from a new
+// configuration replaces the old one at the same path, so the handler keeps
+// working when a new pipeline is swapped in.
+func registerSampleRate(path string, s *SampleReports) {
+	sampleRates.Lock()
+	defer sampleRates.Unlock()
+	sampleRates.m[path] = s
+}
+
+type sampleRateHandler struct{}
+
+// SampleRateHandler returns an http.Handler that lets an operator read and
+// change the sampling rate of the SampleReports processors whose
+// configurations have an `admin_path`, at runtime.  Mount it at "/" on an
+// admin server (more specific paths on the same mux still take priority); a
+// request for a path that no processor was configured with gets a 404.
+//
+// A GET request returns a JSON object with the processor's current `rate`,
+// and the `min_rate` and `max_rate` that it can be set to.  A PATCH request
+// with a `rate` form value changes the rate (see SampleReports.SetRate), and
+// returns the same object.  The new rate applies to every batch that the
+// processor starts on afterwards, but it's forgotten when the configuration
+// is reloaded.
+//
+// The handler doesn't do any authentication of its own, so it should only be
+// served on an address that isn't reachable by the public.
+func SampleRateHandler() http.Handler {
+	return sampleRateHandler{}
+}
+
+func (sampleRateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sampleRates.Lock()
+	s, ok := sampleRates.m[r.URL.Path]
+	sampleRates.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PATCH":
+		rate, err := strconv.ParseFloat(r.FormValue("rate"), 64)
+		if err != nil {
+			http.Error(w, "Invalid `rate` value", http.StatusBadRequest)
+			return
+		}
+		if err := s.SetRate(rate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PATCH")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	min, max := s.rateRange()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rate    float64 `json:"rate"`
+		MinRate float64 `json:"min_rate"`
+		MaxRate float64 `json:"max_rate"`
+	}{s.CurrentRate(), min, max})
+}
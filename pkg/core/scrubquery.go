@@ -0,0 +1,208 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// The actions that ScrubQueryParams can take for each query parameter.
+const (
+	ScrubKeep = "keep"
+	ScrubDrop = "drop"
+	ScrubHash = "hash"
+)
+
+// ScrubQueryParams is a pipeline processor that removes secrets and personal
+// information from the query strings of report URLs, while keeping the
+// parameters that are useful for analysis.  Each query parameter is kept,
+// dropped, or has its value replaced by a salted hash (so that reports with
+// the same value can still be grouped together), according to Rules, which
+// maps parameter names to actions.  A rule whose name ends in `*` applies to
+// every parameter with that prefix, such as `utm_*`; an exact rule beats a
+// prefix rule, and a longer prefix beats a shorter one.  Names are matched
+// case-insensitively.  Parameters without a rule get the Default action.
+//
+// The result is saved in an annotation (ScrubbedURL by default), and the
+// report's URL itself is unchanged.  If the report already has that annotation
+// (for instance, if it's CanonicalURL), we scrub the annotation instead of the
+// URL.  The order of the remaining parameters is kept, and so is the encoding
+// of the ones that are kept as they are.
+type ScrubQueryParams struct {
+	Rules      map[string]string
+	Default    string
+	Salt       string
+	Annotation string
+
+	exact    map[string]string
+	prefixes map[string]string
+}
+
+// NewScrubQueryParams creates a new ScrubQueryParams processor.  It returns an
+// error if any of the actions are invalid, or if some of them hash parameters
+// without a salt.
+func NewScrubQueryParams(rules map[string]string, defaultAction, salt string) (*ScrubQueryParams, error) {
+	s := &ScrubQueryParams{
+		Rules:      rules,
+		Default:    defaultAction,
+		Salt:       salt,
+		Annotation: "ScrubbedURL",
+		exact:      make(map[string]string),
+		prefixes:   make(map[string]string),
+	}
+	actions := []string{defaultAction}
+	for name, action := range rules {
+		name = strings.ToLower(name)
+		if strings.HasSuffix(name, "*") {
+			s.prefixes[strings.TrimSuffix(name, "*")] = action
+		} else {
+			s.exact[name] = action
+		}
+		actions = append(actions, action)
+	}
+	for _, action := range actions {
+		switch action {
+		case ScrubKeep, ScrubDrop:
+		case ScrubHash:
+			if salt == "" {
+				return nil, fmt.Errorf("hashing parameters needs a salt")
+			}
+		default:
+			return nil, fmt.Errorf("invalid action %s", action)
+		}
+	}
+	return s, nil
+}
+
+// action returns what to do with a query parameter.
+func (s *ScrubQueryParams) action(name string) string {
+	name = strings.ToLower(name)
+	if action, ok := s.exact[name]; ok {
+		return action
+	}
+	best, action := -1, s.Default
+	for prefix, prefixAction := range s.prefixes {
+		if len(prefix) > best && strings.HasPrefix(name, prefix) {
+			best, action = len(prefix), prefixAction
+		}
+	}
+	return action
+}
+
+func (s *ScrubQueryParams) hash(value string) string {
+	sum := sha256.Sum256([]byte(s.Salt + "\x00" + value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// scrub returns a URL with its query string scrubbed.  URLs that we can't
+// parse are returned unchanged.
+func (s *ScrubQueryParams) scrub(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.RawQuery == "" {
+		return rawurl
+	}
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		rawName, rawValue := param, ""
+		hasValue := false
+		if eq := strings.Index(param, "="); eq >= 0 {
+			rawName, rawValue, hasValue = param[:eq], param[eq+1:], true
+		}
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		switch s.action(name) {
+		case ScrubKeep:
+			params = append(params, param)
+		case ScrubHash:
+			if !hasValue {
+				params = append(params, param)
+				continue
+			}
+			value, err := url.QueryUnescape(rawValue)
+			if err != nil {
+				value = rawValue
+			}
+			params = append(params, rawName+"="+s.hash(value))
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+	u.ForceQuery = false
+	return u.String()
+}
+
+// ProcessReports annotates each report with its scrubbed URL.
+func (s *ScrubQueryParams) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		rawurl, ok := report.GetAnnotation(s.Annotation).(string)
+		if !ok {
+			rawurl = report.URL
+		}
+		report.SetAnnotation(s.Annotation, s.scrub(rawurl))
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ScrubQueryParams",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Rules      map[string]string `toml:"rules"`
+				Default    string            `toml:"default"`
+				Salt       string            `toml:"salt"`
+				Annotation string            `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			switch config.Default {
+			case "":
+				config.Default = ScrubKeep
+			case ScrubKeep, ScrubDrop, ScrubHash:
+			default:
+				return nil, fmt.Errorf("ScrubQueryParams invalid `default`: %s", config.Default)
+			}
+			hashes := config.Default == ScrubHash
+			for _, action := range config.Rules {
+				hashes = hashes || action == ScrubHash
+			}
+			if hashes && config.Salt == "" {
+				return nil, fmt.Errorf("ScrubQueryParams missing `salt`")
+			}
+			s, err := NewScrubQueryParams(config.Rules, config.Default, config.Salt)
+			if err != nil {
+				return nil, fmt.Errorf("ScrubQueryParams invalid `rules`: %v", err)
+			}
+			if config.Annotation != "" {
+				s.Annotation = config.Annotation
+			}
+			return s, nil
+		})
+}
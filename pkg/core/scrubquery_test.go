@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestScrubQueryParams(t *testing.T) {
+	urls := []string{
+		"https://example.com/path?utm_source=mail&utm_medium=email&token=s3cret&uid=42&page=2",
+		"https://example.com/?SID=abc&Uid=42&utm_id=x&utm_idx=y",
+		"https://example.com/?q=a%20b&uid=4%32&flag",
+		"https://example.com/?token=s3cret",
+		"https://example.com/no-query",
+		"%zz",
+	}
+	batch := &collector.ReportBatch{}
+	for _, url := range urls {
+		batch.Reports = append(batch.Reports, collector.NelReport{URL: url})
+	}
+	batch = pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "ScrubQueryParams"
+		default = "drop"
+		salt = "pepper"
+		[processor.rules]
+		"utm_*" = "keep"
+		utm_idx = "drop"
+		token = "drop"
+		sid = "drop"
+		uid = "hash"
+		q = "keep"
+		flag = "hash"
+	`, batch)
+
+	var got []string
+	for i, report := range batch.Reports {
+		if report.URL != urls[i] {
+			t.Errorf("ScrubQueryParams changed URL to %s", report.URL)
+		}
+		got = append(got, report.GetAnnotation("ScrubbedURL").(string))
+	}
+	// uid=42 always hashes to the same value.
+	hashed := strings.SplitN(got[0], "uid=", 2)[1]
+	want := []string{
+		"https://example.com/path?utm_source=mail&utm_medium=email&uid=" + hashed,
+		"https://example.com/?Uid=" + hashed + "&utm_id=x",
+		"https://example.com/?q=a%20b&uid=" + hashed + "&flag",
+		"https://example.com/",
+		"https://example.com/no-query",
+		"%zz",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ScrubQueryParams got diff (-want +got):\n%s", diff)
+	}
+	if len(hashed) != 16 || strings.Contains(hashed, "42") {
+		t.Errorf("ScrubQueryParams hashed uid=42 to %q", hashed)
+	}
+}
+
+func TestScrubQueryParamsAnnotation(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "CanonicalizeURL"
+
+		[[processor]]
+		type = "ScrubQueryParams"
+		annotation = "CanonicalURL"
+		rules = {token = "drop"}
+	`, &collector.ReportBatch{Reports: []collector.NelReport{{URL: "https://WWW.example.com/?token=s3cret&page=2"}}})
+	if got, want := batch.Reports[0].GetAnnotation("CanonicalURL"), "https://example.com?page=2"; got != want {
+		t.Errorf("ScrubQueryParams set CanonicalURL to %v, wanted %v", got, want)
+	}
+}
+
+func TestScrubQueryParamsBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`default = "mangle"`,
+		`rules = {token = "mangle"}`,
+		`rules = {uid = "hash"}`,
+		`default = "hash"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"ScrubQueryParams\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// severityLevels are the severities that SeverityClassifier can assign.
+var severityLevels = map[string]bool{
+	"info":     true,
+	"warning":  true,
+	"critical": true,
+}
+
+// A SeverityRule gives the reports that match a condition a severity.
+type SeverityRule struct {
+	Condition string `toml:"condition"`
+	Severity  string `toml:"severity"`
+}
+
+// DefaultSeverityRules are the rules that SeverityClassifier uses unless you
+// provide different ones.  DNS failures, refused or unreachable connections,
+// and certificate errors usually mean that a host is unavailable to everyone
+// who tries to reach it, so they're critical.  Other failures, such as the
+// occasional connection reset or timeout, and server errors, tend to affect
+// only some of a host's clients, so they're warnings.  Everything else
+// (including successful requests, and client errors, which are often a
+// client's own fault) gets the default severity.
+var DefaultSeverityRules = []SeverityRule{
+	{`phase == "dns"`, "critical"},
+	{`type == "tcp.refused" or type == "tcp.address_unreachable"`, "critical"},
+	{`type == "tls.cert.invalid" or type == "tls.cert.date_invalid" or type == "tls.cert.authority_invalid" or type == "tls.cert.name_invalid"`, "critical"},
+	{`status_code >= 500`, "warning"},
+	{`report_type == "network-error" and type != "ok" and type != "http.error"`, "warning"},
+}
+
+// SeverityClassifier is a pipeline processor that decides how serious each
+// report is, so that later processors (such as a Where that only sends alerts
+// for critical reports) and sinks can tell a host that's down for everyone
+// apart from sporadic failures.  Each report is checked against the rules in
+// order, and the first rule that it matches decides its severity, which will
+// be `info`, `warning`, or `critical`; reports that don't match any rule get
+// Default.  The severity is saved in a per-report annotation.  Reports are
+// never dropped.
+type SeverityClassifier struct {
+	// The name of the annotation to save the severity in.  If empty, we use
+	// "Severity".
+	Annotation string
+	Default    string
+
+	rules []severityRule
+}
+
+type severityRule struct {
+	condition condition
+	severity  string
+}
+
+// NewSeverityClassifier creates a new SeverityClassifier processor with the
+// given rules, whose conditions use the same syntax as NewWhere's.  Reports
+// that don't match any of the rules get the `info` severity.
+func NewSeverityClassifier(rules []SeverityRule) (*SeverityClassifier, error) {
+	c := &SeverityClassifier{Annotation: "Severity", Default: "info"}
+	for i, rule := range rules {
+		if !severityLevels[rule.Severity] {
+			return nil, fmt.Errorf("rule %d has invalid severity %s", i, rule.Severity)
+		}
+		parsed, err := parseCondition(rule.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		c.rules = append(c.rules, severityRule{parsed, rule.Severity})
+	}
+	return c, nil
+}
+
+// Classify returns the severity of a report in a batch.
+func (c *SeverityClassifier) Classify(batch *collector.ReportBatch, report *collector.NelReport) string {
+	for _, rule := range c.rules {
+		if truthy(rule.condition.eval(batch, report)) {
+			return rule.severity
+		}
+	}
+	return c.Default
+}
+
+// ProcessReports annotates each report with its severity.
+func (c *SeverityClassifier) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		batch.Reports[i].SetAnnotation(c.Annotation, c.Classify(batch, &batch.Reports[i]))
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"SeverityClassifier",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Rules      []SeverityRule `toml:"rule"`
+				Default    string         `toml:"default"`
+				Annotation string         `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			rules := config.Rules
+			if rules == nil {
+				rules = DefaultSeverityRules
+			}
+			c, err := NewSeverityClassifier(rules)
+			if err != nil {
+				return nil, fmt.Errorf("SeverityClassifier invalid `rule`: %v", err)
+			}
+			if config.Default != "" {
+				if !severityLevels[config.Default] {
+					return nil, fmt.Errorf("SeverityClassifier invalid `default`: %s", config.Default)
+				}
+				c.Default = config.Default
+			}
+			if config.Annotation != "" {
+				c.Annotation = config.Annotation
+			}
+			return c, nil
+		})
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestSeverityClassifierDefaultRules(t *testing.T) {
+	classifier, err := core.NewSeverityClassifier(core.DefaultSeverityRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		report collector.NelReport
+		want   string
+	}{
+		{collector.NelReport{ReportType: "network-error", Phase: "dns", Type: "dns.name_not_resolved"}, "critical"},
+		{collector.NelReport{ReportType: "network-error", Phase: "connection", Type: "tcp.refused"}, "critical"},
+		{collector.NelReport{ReportType: "network-error", Phase: "connection", Type: "tls.cert.date_invalid"}, "critical"},
+		{collector.NelReport{ReportType: "network-error", Phase: "application", Type: "tcp.reset"}, "warning"},
+		{collector.NelReport{ReportType: "network-error", Phase: "application", Type: "http.error", StatusCode: 503}, "warning"},
+		{collector.NelReport{ReportType: "network-error", Phase: "application", Type: "http.error", StatusCode: 404}, "info"},
+		{collector.NelReport{ReportType: "network-error", Phase: "application", Type: "ok", StatusCode: 200}, "info"},
+		{collector.NelReport{ReportType: "csp-violation"}, "info"},
+	}
+	batch := &collector.ReportBatch{}
+	for _, c := range cases {
+		batch.Reports = append(batch.Reports, c.report)
+	}
+	classifier.ProcessReports(context.Background(), batch)
+	for i, c := range cases {
+		if got := batch.Reports[i].GetAnnotation("Severity"); got != c.want {
+			t.Errorf("SeverityClassifier(%s, %s, %d) = %v, wanted %v", c.report.Phase, c.report.Type, c.report.StatusCode, got, c.want)
+		}
+	}
+}
+
+func TestSeverityClassifierConfig(t *testing.T) {
+	config := `
+[[processor]]
+type = "SeverityClassifier"
+default = "warning"
+annotation = "Level"
+
+[[processor.rule]]
+condition = "type == 'ok'"
+severity = "info"
+
+[[processor.rule]]
+condition = "annotations.Tier == 'gold'"
+severity = "critical"
+`
+	var pipeline collector.Pipeline
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{
+		{Type: "ok"},
+		{Type: "tcp.reset"},
+		{Type: "tcp.reset"},
+	}}
+	batch.Reports[2].SetAnnotation("Tier", "gold")
+	pipeline.ProcessBatch(context.Background(), batch)
+	for i, want := range []string{"info", "warning", "critical"} {
+		if got := batch.Reports[i].GetAnnotation("Level"); got != want {
+			t.Errorf("SeverityClassifier report %d = %v, wanted %v", i, got, want)
+		}
+	}
+}
+
+func TestSeverityClassifierBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`default = "loud"`,
+		"[[processor.rule]]\ncondition = \"phase == 'dns'\"\nseverity = \"loud\"",
+		"[[processor.rule]]\ncondition = \"phase ==\"\nseverity = \"critical\"",
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"SeverityClassifier\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
@@ -0,0 +1,553 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// DefaultMaxSpoolBytes is the default limit on the size of a Spool's
+// directory.
+const DefaultMaxSpoolBytes = 1 << 30
+
+const spoolSuffix = ".spool"
+const spoolLockFile = "lock"
+
+// Spool is a pipeline processor that wraps a chain of other processors
+// (typically a single publisher), and saves batches to disk while the chain is
+// failing, replaying them once it recovers.  This keeps reports safe during an
+// outage of whatever the chain publishes to, without needing an external
+// queue.
+//
+// Each processor in the chain is run using collector.TryProcessReports, as in
+// DeadLetter.  If one of them fails, we skip the rest of the chain, write the
+// batch as it was before the chain started to the spool, and open the circuit:
+// until the chain recovers, every new batch goes straight to the spool, rather
+// than waiting for the chain to fail again.  Every RetryInterval, we replay the
+// spooled batches through the whole chain, oldest first, with up to
+// ReplayConcurrency batches in flight at once.  Once a replay finishes without
+// any failures, we close the circuit again.  Batches that fail during a replay
+// stay in the spool for the next one.  (Since the whole chain is replayed, any
+// processors before the one that failed see those batches more than once.)
+//
+// The spool is a directory of append-only segment files, each containing one
+// line of JSON per batch, with the batch's reports and annotations and some
+// metadata about the upload.  (Annotations come back in their JSON form; for
+// instance, numbers become float64s.)  We start a new segment once the current
+// one is SegmentBytes long, or when a replay starts, and delete each segment
+// once it's been replayed; a segment that was only partly replayed is
+// atomically replaced with one containing the batches that still need to be.
+// If writing a batch would make the spool bigger than MaxBytes, we drop the
+// batch instead, and count it in Dropped.  Any segments left in Dir when the
+// processor is created (for instance, because the collector crashed or was
+// restarted during an outage) are replayed too; if a crash left a segment
+// with a partly written line, that line is skipped.  Only one Spool can use a
+// directory at a time; NewSpool locks it (on systems that support flock), and
+// fails if it's already locked.
+type Spool struct {
+	Processors        []collector.ReportProcessor
+	Dir               string
+	MaxBytes          int64
+	SegmentBytes      int64
+	ReplayConcurrency int
+	RetryInterval     time.Duration
+
+	dropped int64
+
+	// replayMu is held while replaying, so that only one replay runs at a
+	// time.
+	replayMu sync.Mutex
+
+	mu       sync.Mutex
+	lock     *os.File
+	open     bool
+	bytes    int64
+	nextID   int64
+	segment  *os.File
+	segBytes int64
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewSpool creates a new Spool processor that saves batches to dir, creating
+// it if needed, and locks it until the spool is closed.  If retryInterval is
+// nonzero, we also start replaying spooled batches in the background that
+// often; Close stops replaying.  (You can also call Replay yourself.)
+func NewSpool(processors []collector.ReportProcessor, dir string, retryInterval time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockSpoolDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		Processors:        processors,
+		Dir:               dir,
+		MaxBytes:          DefaultMaxSpoolBytes,
+		SegmentBytes:      1 << 20,
+		ReplayConcurrency: 1,
+		RetryInterval:     retryInterval,
+		lock:              lock,
+	}
+	// Clean up after any replays that crashed while replacing a segment.
+	if leftovers, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix+".tmp")); err == nil {
+		for _, path := range leftovers {
+			os.Remove(path)
+		}
+	}
+	segments, err := s.segments()
+	if err != nil {
+		s.unlock()
+		return nil, err
+	}
+	for _, path := range segments {
+		info, err := os.Stat(path)
+		if err != nil {
+			s.unlock()
+			return nil, err
+		}
+		s.bytes += info.Size()
+		if id := spoolSegmentID(path); id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	// Leftover batches should be replayed before new ones are published.
+	s.open = len(segments) > 0
+	if retryInterval > 0 {
+		s.done = make(chan struct{})
+		s.wg.Add(1)
+		go s.run()
+	}
+	return s, nil
+}
+
+func (s *Spool) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Replay(context.Background()); err != nil {
+				log.Printf("Spool: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Dropped returns the number of batches that were dropped because the spool
+// was full.
+func (s *Spool) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Bytes returns the current size of the spool.
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// segments returns the paths of the segment files in the spool, oldest first.
+func (s *Spool) segments() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// spoolSegmentID returns the ID of a segment file, from its name.
+func spoolSegmentID(path string) int64 {
+	id, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), spoolSuffix), 10, 64)
+	return id
+}
+
+// unlock releases the lock on the spool's directory.
+func (s *Spool) unlock() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
+
+// rotate closes the current segment, so that it can be replayed.  s.mu must be
+// held.
+func (s *Spool) rotate() error {
+	if s.segment == nil {
+		return nil
+	}
+	err := s.segment.Sync()
+	if closeErr := s.segment.Close(); err == nil {
+		err = closeErr
+	}
+	s.segment = nil
+	return err
+}
+
+type spoolRecord struct {
+	Time              time.Time                `json:"time"`
+	ClientIP          string                   `json:"client_ip,omitempty"`
+	ClientUserAgent   string                   `json:"client_user_agent,omitempty"`
+	ClientReferrer    string                   `json:"client_referrer,omitempty"`
+	Annotations       map[string]interface{}   `json:"annotations,omitempty"`
+	Reports           []collector.NelReport    `json:"reports"`
+	ReportAnnotations []map[string]interface{} `json:"report_annotations,omitempty"`
+}
+
+func encodeSpoolRecord(batch *collector.ReportBatch) ([]byte, error) {
+	record := spoolRecord{
+		Time:            batch.Time,
+		ClientIP:        batch.ClientIP,
+		ClientUserAgent: batch.ClientUserAgent,
+		ClientReferrer:  batch.ClientReferrer,
+		Annotations:     batch.CloneAnnotations().Annotations,
+		Reports:         batch.Reports,
+	}
+	for i := range batch.Reports {
+		annotations := batch.Reports[i].CloneAnnotations().Annotations
+		if len(annotations) > 0 && record.ReportAnnotations == nil {
+			record.ReportAnnotations = make([]map[string]interface{}, len(batch.Reports))
+		}
+		if record.ReportAnnotations != nil {
+			record.ReportAnnotations[i] = annotations
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func decodeSpoolRecord(line []byte) (*collector.ReportBatch, error) {
+	var record spoolRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, err
+	}
+	batch := &collector.ReportBatch{
+		Time:            record.Time,
+		ClientIP:        record.ClientIP,
+		ClientUserAgent: record.ClientUserAgent,
+		ClientReferrer:  record.ClientReferrer,
+		Reports:         record.Reports,
+	}
+	for name, value := range record.Annotations {
+		batch.SetAnnotation(name, value)
+	}
+	for i, annotations := range record.ReportAnnotations {
+		if i >= len(batch.Reports) {
+			break
+		}
+		for name, value := range annotations {
+			batch.Reports[i].SetAnnotation(name, value)
+		}
+	}
+	return batch, nil
+}
+
+// write appends a batch to the current segment, starting a new one if needed.
+func (s *Spool) write(batch *collector.ReportBatch) error {
+	line, err := encodeSpoolRecord(batch)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxBytes > 0 && s.bytes+int64(len(line)) > s.MaxBytes {
+		atomic.AddInt64(&s.dropped, 1)
+		return fmt.Errorf("spool is full; dropped %d reports", len(batch.Reports))
+	}
+	if s.segment != nil && s.segBytes >= s.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if s.segment == nil {
+		path := filepath.Join(s.Dir, fmt.Sprintf("%020d%s", s.nextID, spoolSuffix))
+		s.segment, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		s.nextID++
+		s.segBytes = 0
+	}
+	n, err := s.segment.Write(line)
+	s.bytes += int64(n)
+	s.segBytes += int64(n)
+	return err
+}
+
+// runChain runs the wrapped chain against a batch, stopping at the first
+// failure.
+func (s *Spool) runChain(ctx context.Context, batch *collector.ReportBatch) error {
+	for _, processor := range s.Processors {
+		if err := collector.TryProcessReports(ctx, processor, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProcessReports runs the wrapped chain against the batch, or saves it to the
+// spool if the circuit is open or the chain fails.
+func (s *Spool) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	s.mu.Lock()
+	open := s.open
+	s.mu.Unlock()
+
+	if !open {
+		original := batch.Clone()
+		err := s.runChain(ctx, batch)
+		if err == nil {
+			return
+		}
+		log.Printf("Spool: spooling %d reports after error: %v", len(original.Reports), err)
+		s.mu.Lock()
+		s.open = true
+		s.mu.Unlock()
+		batch = original
+	}
+	if err := s.write(batch); err != nil {
+		log.Printf("Spool: %v", err)
+	}
+}
+
+// replaySegment replays the batches in a segment file, and then deletes it, or
+// replaces it with the batches that failed.  It returns the number of batches
+// that failed.  Once one batch fails, we don't try any more of them, since the
+// chain probably hasn't recovered yet.
+func (s *Spool) replaySegment(ctx context.Context, path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var lines [][]byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[len(line)-1] != '\n' {
+			log.Printf("Spool: skipping partly written batch at the end of %s", path)
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	failed := make([]bool, len(lines))
+	var stop int32
+	work := make(chan int)
+	var wg sync.WaitGroup
+	concurrency := s.ReplayConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if atomic.LoadInt32(&stop) != 0 {
+					failed[i] = true
+					continue
+				}
+				batch, err := decodeSpoolRecord(lines[i])
+				if err != nil {
+					log.Printf("Spool: skipping invalid batch in %s: %v", path, err)
+					continue
+				}
+				if s.runChain(ctx, batch) != nil {
+					failed[i] = true
+					atomic.StoreInt32(&stop, 1)
+				}
+			}
+		}()
+	}
+	for i := range lines {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var remaining []byte
+	count := 0
+	for i, line := range lines {
+		if failed[i] {
+			remaining = append(remaining, line...)
+			count++
+		}
+	}
+	if count == 0 {
+		err = os.Remove(path)
+	} else {
+		// Replace the segment atomically, so that a crash can't lose the
+		// batches that still need to be replayed.
+		tmp := path + ".tmp"
+		err = ioutil.WriteFile(tmp, remaining, 0644)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		return count, err
+	}
+	s.mu.Lock()
+	s.bytes -= int64(len(data) - len(remaining))
+	s.mu.Unlock()
+	return count, nil
+}
+
+// Replay replays every spooled batch through the wrapped chain, and closes the
+// circuit if they all succeed.  It returns an error if the spool can't be read;
+// batches that fail are kept for the next replay, without being reported as
+// errors.
+func (s *Spool) Replay(ctx context.Context) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	// Only replay the segments that are closed by now, since write can start
+	// a new one as soon as we release the lock, and a segment that's still
+	// being appended to mustn't be deleted.
+	s.mu.Lock()
+	err := s.rotate()
+	end := s.nextID
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, path := range segments {
+		if spoolSegmentID(path) >= end {
+			break
+		}
+		failed, err := s.replaySegment(ctx, path)
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return nil
+		}
+	}
+
+	s.mu.Lock()
+	s.open = false
+	s.mu.Unlock()
+	return nil
+}
+
+// Close stops replaying in the background, closes the current segment, unlocks
+// the directory, and closes any processors in the wrapped chain that need to be
+// closed.  Anything
+// still in the spool is replayed by the next Spool to use the same directory.
+func (s *Spool) Close() error {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
+	}
+	s.mu.Lock()
+	err := s.rotate()
+	if unlockErr := s.unlock(); err == nil {
+		err = unlockErr
+	}
+	s.mu.Unlock()
+	if closeErr := collector.CloseProcessors(s.Processors); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"Spool",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Dir               string `toml:"dir"`
+				MaxBytes          *int64 `toml:"max_bytes"`
+				ReplayConcurrency *int   `toml:"replay_concurrency"`
+				RetryInterval     string `toml:"retry_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Dir == "" {
+				return nil, fmt.Errorf("Spool missing `dir`")
+			}
+			if config.MaxBytes != nil && *config.MaxBytes < 1 {
+				return nil, fmt.Errorf("Spool `max_bytes` must be positive")
+			}
+			if config.ReplayConcurrency != nil && *config.ReplayConcurrency < 1 {
+				return nil, fmt.Errorf("Spool `replay_concurrency` must be positive")
+			}
+			retryInterval := 30 * time.Second
+			if config.RetryInterval != "" {
+				retryInterval, err = time.ParseDuration(config.RetryInterval)
+				if err != nil {
+					return nil, fmt.Errorf("Spool invalid `retry_interval`: %v", err)
+				}
+				if retryInterval <= 0 {
+					return nil, fmt.Errorf("Spool `retry_interval` must be positive")
+				}
+			}
+
+			processors, err := collector.LoadChildProcessors(ctx, configPrimitive)
+			if err != nil {
+				return nil, fmt.Errorf("Spool: %v", err)
+			}
+			if len(processors) == 0 {
+				return nil, fmt.Errorf("Spool missing `children`")
+			}
+			s, err := NewSpool(processors, config.Dir, retryInterval)
+			if err != nil {
+				collector.CloseProcessors(processors)
+				return nil, fmt.Errorf("Spool invalid `dir`: %v", err)
+			}
+			if config.MaxBytes != nil {
+				s.MaxBytes = *config.MaxBytes
+			}
+			if config.ReplayConcurrency != nil {
+				s.ReplayConcurrency = *config.ReplayConcurrency
+			}
+			return s, nil
+		})
+}
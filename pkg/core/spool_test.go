@@ -0,0 +1,307 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// flakyPublisher records the URL and Service annotation of each report that it
+// publishes, and fails while it's down.
+type flakyPublisher struct {
+	mu        sync.Mutex
+	down      bool
+	attempts  int
+	published []string
+}
+
+func (f *flakyPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	f.TryProcessReports(ctx, batch)
+}
+
+func (f *flakyPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	if f.down {
+		return errors.New("backend unavailable")
+	}
+	for _, report := range batch.Reports {
+		f.published = append(f.published, fmt.Sprintf("%s %v", report.URL, report.GetAnnotation("Service")))
+	}
+	return nil
+}
+
+func spoolBatch(url string) *collector.ReportBatch {
+	batch := &collector.ReportBatch{
+		ClientIP: "192.0.2.1",
+		Reports:  []collector.NelReport{{ReportType: "network-error", URL: url, Type: "tcp.timed_out"}},
+	}
+	batch.Reports[0].SetAnnotation("Service", "web")
+	return batch
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	publisher := &flakyPublisher{}
+	s, err := core.NewSpool([]collector.ReportProcessor{publisher}, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.ProcessReports(ctx, spoolBatch("https://a/"))
+	publisher.down = true
+	s.ProcessReports(ctx, spoolBatch("https://b/"))
+	// The circuit is open now, so this batch goes straight to the spool.
+	s.ProcessReports(ctx, spoolBatch("https://c/"))
+	if got, want := publisher.attempts, 2; got != want {
+		t.Errorf("Spool tried to publish %d times, wanted %d", got, want)
+	}
+	if s.Bytes() == 0 {
+		t.Errorf("Spool didn't spool anything")
+	}
+
+	// Replays fail while the publisher is still down...
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.ProcessReports(ctx, spoolBatch("https://d/"))
+	if s.Bytes() == 0 {
+		t.Errorf("Spool lost batches during a failed replay")
+	}
+
+	// ...and succeed once it's back.
+	publisher.down = false
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.ProcessReports(ctx, spoolBatch("https://e/"))
+	want := []string{"https://a/ web", "https://b/ web", "https://c/ web", "https://d/ web", "https://e/ web"}
+	if diff := cmp.Diff(want, publisher.published); diff != "" {
+		t.Errorf("Spool published diff (-want +got):\n%s", diff)
+	}
+	if got := s.Bytes(); got != 0 {
+		t.Errorf("Spool has %d bytes left after a successful replay", got)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.spool*")); len(segments) != 0 {
+		t.Errorf("Spool left files after a successful replay: %v", segments)
+	}
+}
+
+func TestSpoolPartialReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	publisher := &flakyPublisher{down: true}
+	s, err := core.NewSpool([]collector.ReportProcessor{publisher}, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, url := range []string{"https://a/", "https://b/", "https://c/"} {
+		s.ProcessReports(ctx, spoolBatch(url))
+	}
+
+	// Let the first replayed batch through, and then fail again.
+	publisher.down = false
+	failAfterFirst := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		publisher.mu.Lock()
+		publisher.down = true
+		publisher.mu.Unlock()
+	})
+	s.Processors = append(s.Processors, failAfterFirst)
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.Processors = s.Processors[:1]
+	publisher.down = false
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://a/ web", "https://b/ web", "https://c/ web"}
+	if diff := cmp.Diff(want, publisher.published); diff != "" {
+		t.Errorf("Spool published diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSpoolWriteDuringReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	publisher := &flakyPublisher{down: true}
+	s, err := core.NewSpool([]collector.ReportProcessor{publisher}, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.ProcessReports(ctx, spoolBatch("https://a/"))
+
+	// A batch that arrives while we're replaying goes to a new segment, which
+	// this replay mustn't delete.
+	publisher.down = false
+	var once sync.Once
+	arrive := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		once.Do(func() { s.ProcessReports(ctx, spoolBatch("https://b/")) })
+	})
+	s.Processors = append(s.Processors, arrive)
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.Bytes() == 0 {
+		t.Fatal("Spool lost a batch that was written during a replay")
+	}
+	s.Processors = s.Processors[:1]
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://a/ web", "https://b/ web"}
+	if diff := cmp.Diff(want, publisher.published); diff != "" {
+		t.Errorf("Spool published diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSpoolLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := core.NewSpool(nil, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := core.NewSpool(nil, dir, 0); err == nil {
+		t.Errorf("NewSpool of a directory that's in use should return error")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = core.NewSpool(nil, dir, 0)
+	if err != nil {
+		t.Fatalf("NewSpool after closing: %v", err)
+	}
+	s.Close()
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A segment left behind by a collector that crashed in the middle of
+	// writing its second batch.
+	segment := `{"time":"2024-01-02T15:30:00Z","reports":[{"age":0,"type":"network-error","url":"https://a/","body":{"type":"tcp.timed_out"}}],"report_annotations":[{"Service":"web"}]}` + "\n" +
+		`{"time":"2024-01-02T15:30:00Z","reports":[{"age":0,"type":"netw`
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000007.spool"), []byte(segment), 0644)
+
+	ctx := context.Background()
+	publisher := &flakyPublisher{}
+	s, err := core.NewSpool([]collector.ReportProcessor{publisher}, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Leftover batches are replayed before new ones are published.
+	s.ProcessReports(ctx, spoolBatch("https://b/"))
+	if len(publisher.published) != 0 {
+		t.Errorf("Spool published %v before replaying leftover batches", publisher.published)
+	}
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://a/ web", "https://b/ web"}
+	if diff := cmp.Diff(want, publisher.published); diff != "" {
+		t.Errorf("Spool published diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	s, err := core.NewSpool([]collector.ReportProcessor{&flakyPublisher{down: true}}, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.MaxBytes = 300
+	for i := 0; i < 5; i++ {
+		s.ProcessReports(ctx, spoolBatch("https://a/"))
+	}
+	if got := s.Bytes(); got > s.MaxBytes {
+		t.Errorf("Spool has %d bytes, more than its limit of %d", got, s.MaxBytes)
+	}
+	if got := s.Dropped(); got == 0 {
+		t.Errorf("Spool should have dropped batches once it was full")
+	}
+}
+
+func TestSpoolBadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	processor := "\n[[processor.children]]\ntype = \"KeepNelReports\""
+
+	for _, config := range []string{
+		fmt.Sprintf("dir = %q", dir),
+		processor,
+		fmt.Sprintf("dir = %q\nmax_bytes = 0", dir) + processor,
+		fmt.Sprintf("dir = %q\nreplay_concurrency = 0", dir) + processor,
+		fmt.Sprintf("dir = %q\nretry_interval = \"soon\"", dir) + processor,
+		fmt.Sprintf("dir = %q\nretry_interval = \"-1s\"", dir) + processor,
+		fmt.Sprintf("dir = %q", dir) + "\n[[processor.children]]\ntype = \"Nonexistent\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"Spool\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// SummarizeBatch is a pipeline processor that adds annotations to each batch
+// summarizing the reports in it, so that a publisher can send one enriched
+// event per upload rather than one per report.  The annotations are:
+//
+//   - ReportCount: the number of reports in the batch (an int).
+//   - ReportsByType: the number of reports of each type (a map[string]int).
+//     NEL reports are counted by their NEL type, such as "tcp.timed_out";
+//     other reports by their report type, such as "csp-violation".
+//   - ReportsByStatusClass: the number of reports with each class of status
+//     code, such as "5xx" (a map[string]int).  Reports without a status code
+//     aren't counted.
+//   - TopFailingHost and TopFailingHostCount: the host with the most failed
+//     NEL reports, and how many it has.  Ties go to the host that sorts first.
+//     These aren't set if nothing in the batch failed.
+//
+// The summary only describes the batch that it's attached to; SummarizeBatch
+// doesn't keep any state between batches.
+type SummarizeBatch struct{}
+
+// ProcessReports annotates the batch with a summary of its reports.
+func (SummarizeBatch) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	byType := make(map[string]int)
+	byStatusClass := make(map[string]int)
+	failures := make(map[string]int)
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType == "network-error" {
+			byType[report.Type]++
+		} else {
+			byType[report.ReportType]++
+		}
+		if report.StatusCode > 0 {
+			byStatusClass[fmt.Sprintf("%dxx", report.StatusCode/100)]++
+		}
+		if isFailure(report) {
+			if origin, ok := parseOrigin(report.URL); ok {
+				failures[origin.Host]++
+			}
+		}
+	}
+
+	var topHost string
+	var topCount int
+	for host, count := range failures {
+		if count > topCount || (count == topCount && host < topHost) {
+			topHost, topCount = host, count
+		}
+	}
+
+	batch.SetAnnotation("ReportCount", len(batch.Reports))
+	batch.SetAnnotation("ReportsByType", byType)
+	batch.SetAnnotation("ReportsByStatusClass", byStatusClass)
+	if topCount > 0 {
+		batch.SetAnnotation("TopFailingHost", topHost)
+		batch.SetAnnotation("TopFailingHostCount", topCount)
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"SummarizeBatch",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct{}
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			return SummarizeBatch{}, nil
+		})
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestSummarizeBatch(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "SummarizeBatch"
+	`, &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", URL: "https://a.example/", Type: "ok", StatusCode: 200},
+			{ReportType: "network-error", URL: "https://B.example/x", Type: "http.error", StatusCode: 503},
+			{ReportType: "network-error", URL: "https://b.example:8443/", Type: "tcp.timed_out"},
+			{ReportType: "network-error", URL: "https://a.example/", Type: "http.error", StatusCode: 500},
+			{ReportType: "network-error", URL: "https://c.example/", Type: "http.error", StatusCode: 404},
+			{ReportType: "csp-violation", URL: "https://c.example/"},
+		},
+	})
+	want := map[string]interface{}{
+		"ReportCount":          6,
+		"ReportsByType":        map[string]int{"ok": 1, "http.error": 3, "tcp.timed_out": 1, "csp-violation": 1},
+		"ReportsByStatusClass": map[string]int{"2xx": 1, "4xx": 1, "5xx": 2},
+		"TopFailingHost":       "b.example",
+		"TopFailingHostCount":  2,
+	}
+	if diff := cmp.Diff(want, batch.Annotations.Annotations); diff != "" {
+		t.Errorf("SummarizeBatch got diff (-want +got):\n%s", diff)
+	}
+
+	// Batches without failures don't have a top failing host.
+	batch = pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "SummarizeBatch"
+	`, &collector.ReportBatch{})
+	if got := batch.GetAnnotation("TopFailingHost"); got != nil {
+		t.Errorf("SummarizeBatch of an empty batch got TopFailingHost %v", got)
+	}
+	if got := batch.GetAnnotation("ReportCount"); got != 0 {
+		t.Errorf("SummarizeBatch of an empty batch got ReportCount %v", got)
+	}
+}
+
+func TestSummarizeBatchBadConfig(t *testing.T) {
+	var pipeline collector.Pipeline
+	if err := pipeline.LoadFromConfig(context.Background(), []byte("strict = true\n[[processor]]\ntype = \"SummarizeBatch\"\nfield = \"host\"")); err == nil {
+		t.Errorf("LoadFromConfig with an unknown field should return error")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// TagSynthetic is a pipeline processor that flags the reports that come from
+// synthetic traffic, such as uptime monitors and other probes, so that they
+// can be left out of real-user aggregates without being thrown away.  A
+// report is synthetic if the client that uploaded it (see clientIP) is in one
+// of Ranges, if that client's User-Agent (see clientUserAgent) matches any of
+// UserAgents, or if the report's URL has any of the query parameters in
+// Params (which are matched case-insensitively, whatever their values).  We
+// set the Annotation (Synthetic by default) of every report to true or false.
+type TagSynthetic struct {
+	Ranges     []*net.IPNet
+	UserAgents []*regexp.Regexp
+	Params     []string
+	Annotation string
+}
+
+func (t *TagSynthetic) fromRange(batch *collector.ReportBatch, report *collector.NelReport) bool {
+	ip := parseIPAddress(clientIP(batch, report))
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range t.Ranges {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TagSynthetic) fromUserAgent(batch *collector.ReportBatch, report *collector.NelReport) bool {
+	ua := clientUserAgent(batch, report)
+	if ua == "" {
+		return false
+	}
+	for _, pattern := range t.UserAgents {
+		if pattern.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TagSynthetic) hasParam(report *collector.NelReport) bool {
+	if len(t.Params) == 0 {
+		return false
+	}
+	u, err := url.Parse(report.URL)
+	if err != nil || u.RawQuery == "" {
+		return false
+	}
+	for name := range u.Query() {
+		for _, param := range t.Params {
+			if strings.EqualFold(name, param) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProcessReports annotates each report with whether it's synthetic.
+func (t *TagSynthetic) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		synthetic := t.fromRange(batch, report) || t.fromUserAgent(batch, report) || t.hasParam(report)
+		report.SetAnnotation(t.Annotation, synthetic)
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"TagSynthetic",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Ranges     []string `toml:"ranges"`
+				UserAgents []string `toml:"user_agents"`
+				Params     []string `toml:"params"`
+				Annotation string   `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Ranges) == 0 && len(config.UserAgents) == 0 && len(config.Params) == 0 {
+				return nil, fmt.Errorf("TagSynthetic missing `ranges`, `user_agents`, or `params`")
+			}
+
+			t := &TagSynthetic{Params: config.Params, Annotation: config.Annotation}
+			t.Ranges, err = ParseCIDRs(config.Ranges)
+			if err != nil {
+				return nil, fmt.Errorf("TagSynthetic invalid `ranges`: %v", err)
+			}
+			for _, pattern := range config.UserAgents {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("TagSynthetic invalid `user_agents`: %v", err)
+				}
+				t.UserAgents = append(t.UserAgents, re)
+			}
+			for _, param := range config.Params {
+				if param == "" {
+					return nil, fmt.Errorf("TagSynthetic invalid `params`: empty parameter name")
+				}
+			}
+			if t.Annotation == "" {
+				t.Annotation = "Synthetic"
+			}
+			return t, nil
+		})
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestTagSynthetic(t *testing.T) {
+	config := `
+		[[processor]]
+		type = "TagSynthetic"
+		ranges = ["203.0.113.0/24", "2001:db8::/32"]
+		user_agents = ["(?i)pingdom", "^Monitor/"]
+		params = ["nel_probe"]
+	`
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		clientIP, userAgent, url string
+		want                     bool
+	}{
+		{"203.0.113.5:443", "Mozilla/5.0", "https://example.com/", true},
+		{"[2001:db8::1]:443", "", "https://example.com/", true},
+		{"198.51.100.1", "Mozilla/5.0 (compatible; Pingdom.com_bot)", "https://example.com/", true},
+		{"198.51.100.1", "Monitor/1.0", "https://example.com/", true},
+		{"198.51.100.1", "Mozilla/5.0 Monitor/1.0", "https://example.com/", false},
+		{"198.51.100.1", "Mozilla/5.0", "https://example.com/?a=1&NEL_PROBE", true},
+		{"198.51.100.1", "Mozilla/5.0", "https://example.com/?nel_probes=1", false},
+		{"198.51.100.1", "Mozilla/5.0", "https://example.com/", false},
+		{"", "", "", false},
+	}
+	var want, got []bool
+	for _, c := range cases {
+		batch := &collector.ReportBatch{ClientIP: c.clientIP, ClientUserAgent: c.userAgent, Reports: []collector.NelReport{{URL: c.url}}}
+		pipeline.ProcessBatch(context.Background(), batch)
+		want = append(want, c.want)
+		got = append(got, batch.Reports[0].GetAnnotation("Synthetic").(bool))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("TagSynthetic diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTagSyntheticBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`ranges = ["203.0.113.0"]`,
+		`user_agents = ["("]`,
+		`params = [""]`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"TagSynthetic\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// Tee is a pipeline processor that sends each batch to several independent
+// chains of processors (its branches).
+//
+// Each branch receives its own copy of the batch (see ReportBatch.Clone), so a
+// branch can filter reports or add annotations without affecting what the
+// other branches see.  The original batch is never modified; processors that
+// come after the Tee in the pipeline see the batch exactly as it was before
+// the Tee.
+//
+// If Parallel is true, the branches are run in separate goroutines, so that a
+// slow branch doesn't delay the processing of a fast one.  ProcessReports still
+// waits for every branch to finish before returning, so the number of batches
+// in flight is still bounded by the pipeline's number of workers.  If a branch
+// panics, the panic is passed on from ProcessReports once the other branches
+// have finished, so that the pipeline can recover from it, just as it would
+// if the branches ran in order.
+type Tee struct {
+	Branches [][]collector.ReportProcessor
+	Parallel bool
+}
+
+func runChain(ctx context.Context, chain []collector.ReportProcessor, batch *collector.ReportBatch) {
+	for _, processor := range chain {
+		processor.ProcessReports(ctx, batch)
+	}
+}
+
+// ProcessReports runs each branch against its own copy of the batch.
+func (t Tee) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if !t.Parallel {
+		for _, branch := range t.Branches {
+			runChain(ctx, branch, batch.Clone())
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	panics := make(chan interface{}, len(t.Branches))
+	for idx, branch := range t.Branches {
+		wg.Add(1)
+		go func(idx int, branch []collector.ReportProcessor, batch *collector.ReportBatch) {
+			defer wg.Done()
+			// Nothing can recover from a panic in this goroutine but us, and
+			// an unrecovered one would crash the collector.
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					panics <- fmt.Sprintf("Tee branch %d panicked: %v\n%s", idx, recovered, debug.Stack())
+				}
+			}()
+			runChain(ctx, branch, batch)
+		}(idx, branch, batch.Clone())
+	}
+	wg.Wait()
+	select {
+	case recovered := <-panics:
+		panic(recovered)
+	default:
+	}
+}
+
+// Close closes any processors in the Tee's branches that need to be closed.
+func (t Tee) Close() error {
+	var result error
+	for _, branch := range t.Branches {
+		if err := collector.CloseProcessors(branch); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"Tee",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Parallel bool             `toml:"parallel"`
+				Branches []toml.Primitive `toml:"branch"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Branches) == 0 {
+				return nil, fmt.Errorf("Tee missing `branch`")
+			}
+
+			t := Tee{Parallel: config.Parallel}
+			for idx, branchConfig := range config.Branches {
+				branch, err := collector.LoadChildProcessors(ctx, branchConfig)
+				if err != nil {
+					t.Close()
+					return nil, fmt.Errorf("Tee branch %d: %v", idx, err)
+				}
+				if len(branch) == 0 {
+					t.Close()
+					return nil, fmt.Errorf("Tee branch %d missing `children`", idx)
+				}
+				t.Branches = append(t.Branches, branch)
+			}
+			return t, nil
+		})
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+type processorFunc func(ctx context.Context, batch *collector.ReportBatch)
+
+func (f processorFunc) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	f(ctx, batch)
+}
+
+func TestTeeBranchesAreIndependent(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		var mu sync.Mutex
+		seen := make(map[string]int)
+		record := func(name string) collector.ReportProcessor {
+			return processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+				mu.Lock()
+				defer mu.Unlock()
+				seen[name] = len(batch.Reports)
+			})
+		}
+		tee := core.Tee{
+			Parallel: parallel,
+			Branches: [][]collector.ReportProcessor{
+				{core.KeepNelReports{}, record("nel")},
+				{processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+					batch.SetAnnotation("Branch", "all")
+					batch.Reports[0].SetAnnotation("Branch", "all")
+				}), record("all")},
+			},
+		}
+
+		batch := &collector.ReportBatch{
+			Reports: []collector.NelReport{
+				{ReportType: "network-error"},
+				{ReportType: "csp-violation"},
+			},
+		}
+		tee.ProcessReports(context.Background(), batch)
+
+		if seen["nel"] != 1 || seen["all"] != 2 {
+			t.Errorf("Tee(parallel=%v) branches saw %v, wanted nel:1 all:2", parallel, seen)
+		}
+		if len(batch.Reports) != 2 {
+			t.Errorf("Tee(parallel=%v) modified the original batch's reports", parallel)
+		}
+		if batch.GetAnnotation("Branch") != nil || batch.Reports[0].GetAnnotation("Branch") != nil {
+			t.Errorf("Tee(parallel=%v) leaked a branch's annotations into the original batch", parallel)
+		}
+	}
+}
+
+func TestTeeParallelPanic(t *testing.T) {
+	var ran int64
+	tee := core.Tee{
+		Parallel: true,
+		Branches: [][]collector.ReportProcessor{
+			{processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+				panic("broken branch")
+			})},
+			{processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+				atomic.AddInt64(&ran, 1)
+			})},
+		},
+	}
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			t.Fatal("Tee didn't pass on the branch's panic")
+		}
+		if !strings.Contains(fmt.Sprint(recovered), "broken branch") {
+			t.Errorf("Tee panicked with %v", recovered)
+		}
+		if atomic.LoadInt64(&ran) != 1 {
+			t.Errorf("Tee didn't wait for the other branch")
+		}
+	}()
+	tee.ProcessReports(context.Background(), &collector.ReportBatch{})
+}
+
+func TestTeeConfig(t *testing.T) {
+	p := pipelinetest.PipelineTest{
+		TestName: "TestTeeConfig",
+		Pipeline: pipelinetest.NewTestConfigPipeline(`
+			[[processor]]
+			type = "Tee"
+			parallel = true
+
+			  [[processor.branch]]
+			    [[processor.branch.children]]
+			    type = "KeepNelReports"
+			    [[processor.branch.children]]
+			    type = "DumpReportsAsCLF"
+			    dest = "annotation"
+
+			  [[processor.branch]]
+			    [[processor.branch.children]]
+			    type = "ClassifyReportType"
+
+			[[processor]]
+			type = "DumpReportsAsCLF"
+			dest = "annotation"
+		`),
+		OutputExtension: ".log",
+		Testdata: pipelinetest.DefaultTestdataLoader{
+			InputPath:         "../pipelinetest",
+			UpdateGoldenFiles: *update,
+		},
+	}
+	p.Run(t)
+}
+
+func TestTeeBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "Tee"}]`,
+		`processor = [{type = "Tee", branch = [{}]}]`,
+		`processor = [{type = "Tee", branch = [{children = [{type = "UnknownType"}]}]}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+
+	// Branches that loaded before the one that failed are closed.
+	resetTenantSinks()
+	config := `processor = [{type = "Tee", branch = [{children = [{type = "RecordTenant", sink = "first"}]}, {}]}]`
+	var pipeline collector.Pipeline
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+		t.Errorf("LoadFromConfig(%s) should return error", config)
+	}
+	tenantSinks.Lock()
+	defer tenantSinks.Unlock()
+	if !tenantSinks.closed["first"] {
+		t.Errorf("Tee didn't close the branch that loaded")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	hexSegment     = regexp.MustCompile(`^(?i)[0-9a-f]{16,}$`)
+)
+
+// A URLTemplateRule rewrites the parts of a URL's path that match a regular
+// expression.  Replacement can refer to the expression's groups as in
+// regexp.Regexp.ReplaceAllString, such as `$1`.
+type URLTemplateRule struct {
+	Pattern     string `toml:"pattern"`
+	Replacement string `toml:"replacement"`
+}
+
+// TemplatizeURL is a pipeline processor that turns each report's URL into a
+// template, by replacing the parts of its path that identify a particular
+// resource (such as the 12345 in /user/12345/profile) with placeholders, so
+// that the URLs of a site with lots of IDs in them can be grouped together,
+// or used as a metric label, without an explosion of distinct values.  The
+// template is saved in an annotation (URLTemplate by default), and the
+// report's URL itself is unchanged.
+//
+// The template has the URL's scheme and host, and a rewritten path; the query
+// and fragment are left out.  First, each of the Rules is applied to the whole
+// path, in order.  Then each segment of the path that matches one of the
+// enabled heuristics is replaced:
+//
+//   - Numeric replaces segments made up entirely of digits with `{id}`.
+//   - UUID replaces segments that are UUIDs with `{uuid}`.
+//   - Hex replaces segments of at least 16 hex digits (such as hashes) with
+//     `{hash}`.
+//
+// URLs that we can't parse, or that don't have a host, don't get a template.
+// Where's conditions and RouteBy can use the template as
+// `annotations.URLTemplate`, alongside GroupingKey's coarser fingerprint.
+type TemplatizeURL struct {
+	Numeric    bool
+	UUID       bool
+	Hex        bool
+	Annotation string
+
+	rules []urlTemplateRule
+}
+
+type urlTemplateRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// NewTemplatizeURL creates a new TemplatizeURL processor with the given rules,
+// and all of the heuristics enabled.
+func NewTemplatizeURL(rules []URLTemplateRule) (*TemplatizeURL, error) {
+	t := &TemplatizeURL{Numeric: true, UUID: true, Hex: true, Annotation: "URLTemplate"}
+	for i, rule := range rules {
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("rule %d has no pattern", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		t.rules = append(t.rules, urlTemplateRule{pattern, rule.Replacement})
+	}
+	return t, nil
+}
+
+// segment returns the placeholder for a path segment, or the segment itself
+// if none of the heuristics match it.
+func (t *TemplatizeURL) segment(segment string) string {
+	switch {
+	case t.Numeric && numericSegment.MatchString(segment):
+		return "{id}"
+	case t.UUID && uuidSegment.MatchString(segment):
+		return "{uuid}"
+	case t.Hex && hexSegment.MatchString(segment):
+		return "{hash}"
+	}
+	return segment
+}
+
+// Template returns the template for a URL, or false if it can't be parsed.
+func (t *TemplatizeURL) Template(rawurl string) (string, bool) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	path := u.EscapedPath()
+	for _, rule := range t.rules {
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+	}
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		segments[i] = t.segment(segments[i])
+	}
+	return u.Scheme + "://" + u.Host + strings.Join(segments, "/"), true
+}
+
+// ProcessReports annotates each report with its URL's template.
+func (t *TemplatizeURL) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if template, ok := t.Template(report.URL); ok {
+			report.SetAnnotation(t.Annotation, template)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"TemplatizeURL",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Rules      []URLTemplateRule `toml:"rule"`
+				Numeric    *bool             `toml:"numeric"`
+				UUID       *bool             `toml:"uuid"`
+				Hex        *bool             `toml:"hex"`
+				Annotation string            `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			t, err := NewTemplatizeURL(config.Rules)
+			if err != nil {
+				return nil, fmt.Errorf("TemplatizeURL invalid `rule`: %v", err)
+			}
+			if config.Numeric != nil {
+				t.Numeric = *config.Numeric
+			}
+			if config.UUID != nil {
+				t.UUID = *config.UUID
+			}
+			if config.Hex != nil {
+				t.Hex = *config.Hex
+			}
+			if !t.Numeric && !t.UUID && !t.Hex && len(t.rules) == 0 {
+				return nil, fmt.Errorf("TemplatizeURL has no `rule`s, and every heuristic is disabled")
+			}
+			if config.Annotation != "" {
+				t.Annotation = config.Annotation
+			}
+			return t, nil
+		})
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestTemplatizeURL(t *testing.T) {
+	templatize, err := core.NewTemplatizeURL(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		url, want string
+	}{
+		{"https://example.com/user/12345/profile", "https://example.com/user/{id}/profile"},
+		{"https://example.com/orders/2f1c9e7a-58b4-4c2e-9d3b-0a6e4f8c1b2d?ref=email#top", "https://example.com/orders/{uuid}"},
+		{"https://example.com:8443/static/0123456789abcdef0123/app.js", "https://example.com:8443/static/{hash}/app.js"},
+		{"https://example.com/v2/cafe/12a", "https://example.com/v2/cafe/12a"},
+		{"https://example.com", "https://example.com"},
+		{"/relative/123", ""},
+		{"%", ""},
+	}
+	for _, c := range cases {
+		got, _ := templatize.Template(c.url)
+		if got != c.want {
+			t.Errorf("Template(%s) = %q, wanted %q", c.url, got, c.want)
+		}
+	}
+}
+
+func TestTemplatizeURLConfig(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "TemplatizeURL"
+		hex = false
+		annotation = "Route"
+
+		[[processor.rule]]
+		pattern = "^/@[^/]+"
+		replacement = "/@{user}"
+
+		[[processor.rule]]
+		pattern = "/(\\d{4})-\\d{2}-\\d{2}/"
+		replacement = "/$1-{date}/"
+	`, &collector.ReportBatch{Reports: []collector.NelReport{
+		{URL: "https://example.com/@alice/posts/42"},
+		{URL: "https://example.com/archive/2024-01-02/0123456789abcdef0123"},
+		{URL: "not a url"},
+	}})
+	var got []string
+	for _, report := range batch.Reports {
+		got = append(got, fmt.Sprint(report.GetAnnotation("Route")))
+	}
+	want := []string{"https://example.com/@{user}/posts/{id}", "https://example.com/archive/2024-{date}/0123456789abcdef0123", "<nil>"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("TemplatizeURL diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTemplatizeURLBadConfig(t *testing.T) {
+	for _, config := range []string{
+		"[[processor.rule]]\npattern = \"(\"",
+		"[[processor.rule]]\nreplacement = \"{id}\"",
+		"numeric = false\nuuid = false\nhex = false",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"TemplatizeURL\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// ThrottleMatching is a pipeline processor that rate-limits the reports whose
+// URL matches any of Patterns (which are regular expressions, matched
+// anywhere in the URL unless they're anchored), while letting every other
+// report through untouched.  That's useful when a single broken page or
+// script is responsible for most of the collector's traffic: unlike
+// PerHostQuota, the rest of the host's reports aren't affected.
+//
+// Matching reports share a single token bucket, which holds up to Burst
+// tokens, and is refilled at Rate tokens per second; each matching report
+// that's kept takes a token, and matching reports that arrive while the
+// bucket is empty are dropped.  The bucket starts out full.  (To give several
+// patterns their own limits, use a ThrottleMatching for each of them.)
+//
+// When we drop any of a batch's reports, we set Annotation on the batch to the
+// number that we dropped.  ThrottleMatching also counts the reports that it
+// drops; see Dropped.
+type ThrottleMatching struct {
+	Patterns   []*regexp.Regexp
+	Rate       float64
+	Burst      int
+	Annotation string
+
+	// Clock is used to refill the bucket.  If nil, we use the current time.
+	Clock collector.Clock
+
+	dropped int64
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	started bool
+}
+
+// NewThrottleMatching creates a new ThrottleMatching processor that lets
+// through up to rate reports per second (after an initial burst of up to burst
+// reports) whose URLs match any of patterns.
+func NewThrottleMatching(patterns []*regexp.Regexp, rate float64, burst int) *ThrottleMatching {
+	return &ThrottleMatching{
+		Patterns:   patterns,
+		Rate:       rate,
+		Burst:      burst,
+		Annotation: "ThrottleDropped",
+	}
+}
+
+// Dropped returns the number of reports that the processor has thrown away.
+func (t *ThrottleMatching) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
+
+func (t *ThrottleMatching) now() time.Time {
+	if t.Clock == nil {
+		return time.Now()
+	}
+	return t.Clock.Now()
+}
+
+func (t *ThrottleMatching) matches(report *collector.NelReport) bool {
+	for _, pattern := range t.Patterns {
+		if pattern.MatchString(report.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+// refill adds the tokens that have accumulated since the last batch.  t.mu
+// must be held.
+func (t *ThrottleMatching) refill(now time.Time) {
+	if !t.started {
+		t.tokens = float64(t.Burst)
+		t.last = now
+		t.started = true
+		return
+	}
+	if elapsed := now.Sub(t.last); elapsed > 0 {
+		t.tokens = math.Min(float64(t.Burst), t.tokens+elapsed.Seconds()*t.Rate)
+		t.last = now
+	}
+}
+
+// ProcessReports throws away the matching reports in the batch that arrive
+// while the bucket is empty.
+func (t *ThrottleMatching) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := t.now()
+	var filtered []collector.NelReport
+	t.mu.Lock()
+	t.refill(now)
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if t.matches(report) {
+			if t.tokens < 1 {
+				continue
+			}
+			t.tokens--
+		}
+		filtered = append(filtered, *report)
+	}
+	t.mu.Unlock()
+
+	if dropped := len(batch.Reports) - len(filtered); dropped > 0 {
+		atomic.AddInt64(&t.dropped, int64(dropped))
+		batch.SetAnnotation(t.Annotation, dropped)
+	}
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ThrottleMatching",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Patterns   []string `toml:"patterns"`
+				Rate       *float64 `toml:"rate"`
+				Burst      *int     `toml:"burst"`
+				Annotation string   `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Patterns) == 0 {
+				return nil, fmt.Errorf("ThrottleMatching missing `patterns`")
+			}
+			var patterns []*regexp.Regexp
+			for _, pattern := range config.Patterns {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("ThrottleMatching invalid `patterns`: %v", err)
+				}
+				patterns = append(patterns, re)
+			}
+			if config.Rate == nil {
+				return nil, fmt.Errorf("ThrottleMatching missing `rate`")
+			}
+			if *config.Rate <= 0 {
+				return nil, fmt.Errorf("ThrottleMatching `rate` must be positive")
+			}
+			// By default, allow a burst of one second's worth of reports.
+			burst := int(math.Ceil(*config.Rate))
+			if config.Burst != nil {
+				if *config.Burst < 1 {
+					return nil, fmt.Errorf("ThrottleMatching `burst` must be positive")
+				}
+				burst = *config.Burst
+			}
+
+			t := NewThrottleMatching(patterns, *config.Rate, burst)
+			if config.Annotation != "" {
+				t.Annotation = config.Annotation
+			}
+			t.Clock = clock
+			return t, nil
+		})
+}
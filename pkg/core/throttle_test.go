@@ -0,0 +1,127 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestThrottleMatching(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	throttle := core.NewThrottleMatching([]*regexp.Regexp{regexp.MustCompile(`^https://cdn\.example/broken\.js`)}, 2, 3)
+	throttle.Clock = clock
+
+	// process runs a batch with the given number of noisy and other reports,
+	// and returns how many of each are kept, and the batch's drop count.
+	process := func(noisy, other int) (int, int, interface{}) {
+		batch := &collector.ReportBatch{}
+		for i := 0; i < noisy; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{URL: "https://cdn.example/broken.js?v=1"})
+			if i < other {
+				batch.Reports = append(batch.Reports, collector.NelReport{URL: "https://cdn.example/ok.js"})
+			}
+		}
+		for i := noisy; i < other; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{URL: "https://cdn.example/ok.js"})
+		}
+		throttle.ProcessReports(context.Background(), batch)
+		var keptNoisy, keptOther int
+		for _, report := range batch.Reports {
+			if report.URL == "https://cdn.example/ok.js" {
+				keptOther++
+			} else {
+				keptNoisy++
+			}
+		}
+		return keptNoisy, keptOther, batch.GetAnnotation("ThrottleDropped")
+	}
+
+	for _, c := range []struct {
+		advance              time.Duration
+		noisy, other         int
+		keptNoisy, keptOther int
+		dropped              interface{}
+	}{
+		// The bucket starts out with the whole burst.
+		{0, 5, 10, 3, 10, 2},
+		// Half a second refills one token.
+		{500 * time.Millisecond, 5, 1, 1, 1, 4},
+		// The bucket never holds more than the burst.
+		{time.Minute, 4, 0, 3, 0, 1},
+		{time.Second, 2, 2, 2, 2, nil},
+	} {
+		clock.CurrentTime = clock.CurrentTime.Add(c.advance)
+		keptNoisy, keptOther, dropped := process(c.noisy, c.other)
+		if diff := cmp.Diff([]interface{}{c.keptNoisy, c.keptOther, c.dropped}, []interface{}{keptNoisy, keptOther, dropped}); diff != "" {
+			t.Errorf("After %v, ThrottleMatching kept/dropped diff (-want +got):\n%s", c.advance, diff)
+		}
+	}
+	if got, want := throttle.Dropped(), int64(7); got != want {
+		t.Errorf("ThrottleMatching.Dropped() = %d, wanted %d", got, want)
+	}
+}
+
+func TestThrottleMatchingConfig(t *testing.T) {
+	config := `
+[[processor]]
+type = "ThrottleMatching"
+patterns = ["/broken\\.js"]
+rate = 0.5
+annotation = "Throttled"
+`
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{
+		{URL: "https://a.example/broken.js"}, {URL: "https://a.example/"}, {URL: "https://b.example/broken.js"},
+	}}
+	pipeline.ProcessBatch(context.Background(), batch)
+	var urls []string
+	for _, report := range batch.Reports {
+		urls = append(urls, report.URL)
+	}
+	if diff := cmp.Diff([]string{"https://a.example/broken.js", "https://a.example/"}, urls); diff != "" {
+		t.Errorf("ThrottleMatching kept reports with diff (-want +got):\n%s", diff)
+	}
+	if got := batch.GetAnnotation("Throttled"); got != 1 {
+		t.Errorf("ThrottleMatching annotated batch with %v dropped reports, wanted 1", got)
+	}
+}
+
+func TestThrottleMatchingBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`rate = 10.0`,
+		"patterns = [\"(\"]\nrate = 10.0",
+		`patterns = ["broken"]`,
+		"patterns = [\"broken\"]\nrate = 0.0",
+		"patterns = [\"broken\"]\nrate = 10.0\nburst = 0",
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"ThrottleMatching\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
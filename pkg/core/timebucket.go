@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// DefaultTimeBucketResolution is the size of the buckets that TimeBucket uses
+// if you don't specify one.
+const DefaultTimeBucketResolution = time.Minute
+
+// TimeBucket is a pipeline processor that annotates each report with its event
+// time (see NelReport.EventTime), truncated to a multiple of Resolution, so
+// that later processors can cheaply group reports into a time series.  The
+// annotation (TimeBucket by default) is a time.Time in Location, and buckets
+// line up with midnight in that time zone; for instance, with a Resolution of
+// 1h and a Location of Asia/Kolkata, buckets start on the half hour in UTC.
+//
+// A report with a negative age has no usable event time, so we use the time
+// that its batch was received instead.  If the batch doesn't have a receive
+// time either, we use Clock.
+type TimeBucket struct {
+	Resolution time.Duration
+	Location   *time.Location
+	Annotation string
+
+	// Clock is used for batches that don't have a receive time.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+}
+
+func (b *TimeBucket) now() time.Time {
+	if b.Clock == nil {
+		return time.Now()
+	}
+	return b.Clock.Now()
+}
+
+// bucket returns the start of the bucket that t falls in.
+func (b *TimeBucket) bucket(t time.Time) time.Time {
+	location := b.Location
+	if location == nil {
+		location = time.UTC
+	}
+	t = t.In(location)
+	// Truncate works in terms of absolute time, so shift t by its zone's
+	// offset first to make the buckets line up with local time.
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(b.Resolution).Add(-shift)
+}
+
+// ProcessReports annotates each report with its time bucket.
+func (b *TimeBucket) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	received := batch.Time
+	if received.IsZero() {
+		received = b.now()
+	}
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		eventTime := received
+		if report.Age >= 0 {
+			eventTime = report.EventTime(received)
+		}
+		report.SetAnnotation(b.Annotation, b.bucket(eventTime))
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"TimeBucket",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Resolution string `toml:"resolution"`
+				TimeZone   string `toml:"time_zone"`
+				Annotation string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			b := &TimeBucket{
+				Resolution: DefaultTimeBucketResolution,
+				Location:   time.UTC,
+				Annotation: config.Annotation,
+				Clock:      clock,
+			}
+			if config.Resolution != "" {
+				b.Resolution, err = time.ParseDuration(config.Resolution)
+				if err != nil {
+					return nil, fmt.Errorf("TimeBucket invalid `resolution`: %v", err)
+				}
+				if b.Resolution <= 0 {
+					return nil, fmt.Errorf("TimeBucket `resolution` must be positive")
+				}
+			}
+			if config.TimeZone != "" {
+				b.Location, err = time.LoadLocation(config.TimeZone)
+				if err != nil {
+					return nil, fmt.Errorf("TimeBucket invalid `time_zone`: %v", err)
+				}
+			}
+			if b.Annotation == "" {
+				b.Annotation = "TimeBucket"
+			}
+			return b, nil
+		})
+}
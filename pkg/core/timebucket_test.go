@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestTimeBucket(t *testing.T) {
+	cases := []struct {
+		name, config string
+		batchTime    time.Time
+		want         []string
+	}{
+		{"Default", ``, time.Date(2018, 6, 1, 12, 30, 45, 0, time.UTC), []string{
+			"2018-06-01T12:30:00Z",
+			"2018-06-01T12:29:00Z",
+			"2018-06-01T12:30:00Z",
+		}},
+		{"Hourly", `resolution = "1h"`, time.Date(2018, 6, 1, 12, 30, 45, 0, time.UTC), []string{
+			"2018-06-01T12:00:00Z",
+			"2018-06-01T12:00:00Z",
+			"2018-06-01T12:00:00Z",
+		}},
+		{"TimeZone", "resolution = \"1h\"\ntime_zone = \"Asia/Kolkata\"", time.Date(2018, 6, 1, 12, 10, 0, 0, time.UTC), []string{
+			"2018-06-01T17:00:00+05:30",
+			"2018-06-01T17:00:00+05:30",
+			"2018-06-01T17:00:00+05:30",
+		}},
+		{"Daily", "resolution = \"24h\"\ntime_zone = \"America/New_York\"", time.Date(2018, 6, 1, 2, 0, 0, 0, time.UTC), []string{
+			"2018-05-31T00:00:00-04:00",
+			"2018-05-31T00:00:00-04:00",
+			"2018-05-31T00:00:00-04:00",
+		}},
+		// Without a receive time, we fall back on the clock (the Unix epoch).
+		{"NoBatchTime", ``, time.Time{}, []string{
+			"1970-01-01T00:00:00Z",
+			"1969-12-31T23:59:00Z",
+			"1970-01-01T00:00:00Z",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batch := pipelinetest.RunTestConfig("[[processor]]\ntype = \"TimeBucket\"\n"+c.config, &collector.ReportBatch{
+				Time: c.batchTime,
+				Reports: []collector.NelReport{
+					{Age: 0},
+					{Age: 60000},
+					// A report from the future uses the receive time.
+					{Age: -3600000},
+				},
+			})
+			var got []string
+			for _, report := range batch.Reports {
+				bucket, ok := report.GetAnnotation("TimeBucket").(time.Time)
+				if !ok {
+					t.Fatalf("TimeBucket annotation = %v, wanted a time.Time", report.GetAnnotation("TimeBucket"))
+				}
+				got = append(got, bucket.Format(time.RFC3339))
+			}
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("TimeBucket got diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTimeBucketBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`resolution = "soon"`,
+		`resolution = "0s"`,
+		`resolution = "-1m"`,
+		`time_zone = "Mars/Olympus_Mons"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(fmt.Sprintf("[[processor]]\ntype = \"TimeBucket\"\n%s", config))); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
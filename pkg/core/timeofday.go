@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// TimeOfDay is a pipeline processor that annotates each report with the local
+// hour (HourOfDay, an int from 0 to 23) and day of the week (DayOfWeek, such as
+// "Monday") of its event time (see NelReport.EventTime) in Location, so that
+// dashboards can look for daily and weekly patterns without doing any time
+// zone math themselves.  Since Location is an IANA time zone, the hours follow
+// its daylight saving time rules.
+//
+// As with TimeBucket, a report with a negative age uses the time that its
+// batch was received instead, and a batch without a receive time uses Clock.
+type TimeOfDay struct {
+	Location *time.Location
+
+	// Clock is used for batches that don't have a receive time.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+}
+
+func (d *TimeOfDay) now() time.Time {
+	if d.Clock == nil {
+		return time.Now()
+	}
+	return d.Clock.Now()
+}
+
+// ProcessReports annotates each report with its local hour and day.
+func (d *TimeOfDay) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	location := d.Location
+	if location == nil {
+		location = time.UTC
+	}
+	received := batch.Time
+	if received.IsZero() {
+		received = d.now()
+	}
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		eventTime := received
+		if report.Age >= 0 {
+			eventTime = report.EventTime(received)
+		}
+		eventTime = eventTime.In(location)
+		report.SetAnnotation("HourOfDay", eventTime.Hour())
+		report.SetAnnotation("DayOfWeek", eventTime.Weekday().String())
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"TimeOfDay",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				TimeZone string `toml:"time_zone"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			d := &TimeOfDay{Location: time.UTC, Clock: clock}
+			if config.TimeZone != "" {
+				d.Location, err = time.LoadLocation(config.TimeZone)
+				if err != nil {
+					return nil, fmt.Errorf("TimeOfDay invalid `time_zone`: %v", err)
+				}
+			}
+			return d, nil
+		})
+}
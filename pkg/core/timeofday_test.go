@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestTimeOfDay(t *testing.T) {
+	cases := []struct {
+		name, config string
+		batchTime    time.Time
+		want         []string
+	}{
+		{"Default", ``, time.Date(2018, 6, 4, 0, 30, 0, 0, time.UTC), []string{
+			"0 Monday",
+			"23 Sunday",
+			"0 Monday",
+		}},
+		{"TimeZone", `time_zone = "Asia/Kolkata"`, time.Date(2018, 6, 4, 18, 0, 0, 0, time.UTC), []string{
+			"23 Monday",
+			"22 Monday",
+			"23 Monday",
+		}},
+		// New York switched to daylight saving time at 2am local time on
+		// 2018-03-11, so an hour before 3:30am EDT is 1:30am EST.
+		{"DaylightSavingTime", `time_zone = "America/New_York"`, time.Date(2018, 3, 11, 7, 30, 0, 0, time.UTC), []string{
+			"3 Sunday",
+			"1 Sunday",
+			"3 Sunday",
+		}},
+		// Without a receive time, we fall back on the clock (the Unix epoch).
+		{"NoBatchTime", ``, time.Time{}, []string{
+			"0 Thursday",
+			"23 Wednesday",
+			"0 Thursday",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batch := pipelinetest.RunTestConfig("[[processor]]\ntype = \"TimeOfDay\"\n"+c.config, &collector.ReportBatch{
+				Time: c.batchTime,
+				Reports: []collector.NelReport{
+					{Age: 0},
+					{Age: 3600000},
+					// A report from the future uses the receive time.
+					{Age: -3600000},
+				},
+			})
+			var got []string
+			for _, report := range batch.Reports {
+				hour, ok := report.GetAnnotation("HourOfDay").(int)
+				if !ok {
+					t.Fatalf("HourOfDay annotation = %v, wanted an int", report.GetAnnotation("HourOfDay"))
+				}
+				got = append(got, fmt.Sprintf("%d %v", hour, report.GetAnnotation("DayOfWeek")))
+			}
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("TimeOfDay got diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTimeOfDayBadConfig(t *testing.T) {
+	var pipeline collector.Pipeline
+	config := "[[processor]]\ntype = \"TimeOfDay\"\ntime_zone = \"Mars/Olympus_Mons\""
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+		t.Errorf("LoadFromConfig(%s) should return error", config)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// tlsErrorCategories maps each of the TLS error types defined by the NEL spec
+// to its category.
+var tlsErrorCategories = map[string]string{
+	"tls.cert.date_invalid":                 "expired",
+	"tls.cert.authority_invalid":            "untrusted",
+	"tls.cert.revoked":                      "untrusted",
+	"tls.cert.pinned_key_not_in_cert_chain": "untrusted",
+	"tls.cert.name_invalid":                 "name-mismatch",
+	"tls.version_or_cipher_mismatch":        "protocol",
+	"tls.protocol.error":                    "protocol",
+	"tls.cert.invalid":                      "other",
+	"tls.bad_client_auth_cert":              "other",
+	"tls.failed":                            "other",
+}
+
+// TLSErrorClassifier is a pipeline processor that picks out the NEL reports for
+// TLS errors, so that they can be tracked separately from general connectivity
+// errors.  Each one gets a per-report annotation with its category:
+//
+//	expired        tls.cert.date_invalid
+//	untrusted      tls.cert.authority_invalid, tls.cert.revoked,
+//	               tls.cert.pinned_key_not_in_cert_chain
+//	name-mismatch  tls.cert.name_invalid
+//	protocol       tls.version_or_cipher_mismatch, tls.protocol.error
+//	other          tls.cert.invalid, tls.bad_client_auth_cert, tls.failed
+//
+// Reports with any other type, including TLS types that the spec doesn't
+// define, don't get an annotation.  If there are Children, they're run (like
+// Where's) against a copy of the batch that only contains the TLS errors, such
+// as to send them to a dedicated publisher; the original batch is passed on
+// with all of its reports.
+type TLSErrorClassifier struct {
+	// The name of the annotation to save the category in.  If empty, we use
+	// "TLSErrorCategory".
+	Annotation string
+	Children   []collector.ReportProcessor
+}
+
+// TLSErrorCategory returns the category of a NEL error type, and whether it's
+// one of the TLS errors that TLSErrorClassifier knows about.
+func TLSErrorCategory(errorType string) (string, bool) {
+	category, ok := tlsErrorCategories[errorType]
+	return category, ok
+}
+
+// ProcessReports annotates each TLS error in the batch with its category, and
+// sends them to the children.
+func (c *TLSErrorClassifier) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	annotation := c.Annotation
+	if annotation == "" {
+		annotation = "TLSErrorCategory"
+	}
+	var matches []int
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" {
+			continue
+		}
+		if category, ok := TLSErrorCategory(report.Type); ok {
+			report.SetAnnotation(annotation, category)
+			matches = append(matches, i)
+		}
+	}
+	if len(c.Children) == 0 || len(matches) == 0 {
+		return
+	}
+
+	clone := batch.Clone()
+	filtered := make([]collector.NelReport, len(matches))
+	for i, index := range matches {
+		filtered[i] = clone.Reports[index]
+	}
+	clone.Reports = filtered
+	runChain(ctx, c.Children, clone)
+}
+
+// Close closes any child processors that need to be closed.
+func (c *TLSErrorClassifier) Close() error {
+	return collector.CloseProcessors(c.Children)
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"TLSErrorClassifier",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotation string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			children, err := collector.LoadChildProcessors(ctx, configPrimitive)
+			if err != nil {
+				return nil, fmt.Errorf("TLSErrorClassifier children: %v", err)
+			}
+			return &TLSErrorClassifier{Annotation: config.Annotation, Children: children}, nil
+		})
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestTLSErrorClassifier(t *testing.T) {
+	cases := []struct {
+		reportType, errorType string
+		want                  interface{}
+	}{
+		{"network-error", "tls.cert.date_invalid", "expired"},
+		{"network-error", "tls.cert.authority_invalid", "untrusted"},
+		{"network-error", "tls.cert.revoked", "untrusted"},
+		{"network-error", "tls.cert.name_invalid", "name-mismatch"},
+		{"network-error", "tls.version_or_cipher_mismatch", "protocol"},
+		{"network-error", "tls.protocol.error", "protocol"},
+		{"network-error", "tls.failed", "other"},
+		{"network-error", "tls.cert.something_new", nil},
+		{"network-error", "tcp.timed_out", nil},
+		{"network-error", "ok", nil},
+		{"csp-violation", "tls.failed", nil},
+	}
+	batch := &collector.ReportBatch{}
+	for _, c := range cases {
+		batch.Reports = append(batch.Reports, collector.NelReport{ReportType: c.reportType, Type: c.errorType})
+	}
+	var routed *collector.ReportBatch
+	sink := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		routed = batch
+	})
+	classifier := &core.TLSErrorClassifier{Children: []collector.ReportProcessor{sink}}
+	classifier.ProcessReports(context.Background(), batch)
+
+	if len(batch.Reports) != len(cases) {
+		t.Fatalf("TLSErrorClassifier removed reports from the batch")
+	}
+	var tlsErrors []string
+	for i, c := range cases {
+		if got := batch.Reports[i].GetAnnotation("TLSErrorCategory"); got != c.want {
+			t.Errorf("TLSErrorClassifier(%s, %s) = %v, wanted %v", c.reportType, c.errorType, got, c.want)
+		}
+		if c.want != nil {
+			tlsErrors = append(tlsErrors, c.errorType)
+		}
+	}
+	if routed == nil || len(routed.Reports) != len(tlsErrors) {
+		t.Fatalf("TLSErrorClassifier sent %v to its children, wanted %v", routed, tlsErrors)
+	}
+	for i, want := range tlsErrors {
+		if got := routed.Reports[i].Type; got != want {
+			t.Errorf("TLSErrorClassifier child report %d is %s, wanted %s", i, got, want)
+		}
+	}
+}
+
+func TestTLSErrorClassifierConfig(t *testing.T) {
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "TLSErrorClassifier"
+		annotation = "TLS"
+	`, &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "network-error", Type: "tls.cert.name_invalid"}}})
+	if got, want := batch.Reports[0].GetAnnotation("TLS"), "name-mismatch"; got != want {
+		t.Errorf("TLSErrorClassifier annotation = %v, wanted %v", got, want)
+	}
+}
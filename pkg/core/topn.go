@@ -0,0 +1,374 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// topNCounter is one of the keys that a topNBucket is tracking.  overcount is
+// the most that count might overstate the key's true count by, because the key
+// took over the counter of one that was evicted.
+type topNCounter struct {
+	key       string
+	count     int
+	overcount int
+	index     int
+}
+
+// topNHeap is a min-heap of counters, ordered by count.
+type topNHeap []*topNCounter
+
+func (h topNHeap) Len() int           { return len(h) }
+func (h topNHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topNHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *topNHeap) Push(x interface{}) {
+	c := x.(*topNCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *topNHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// topNBucket counts the keys seen during one bucket of a TopN's window, using
+// the Space-Saving algorithm: we track at most maxKeys keys, and when a new key
+// arrives once we're full, it replaces the key with the smallest count and
+// inherits that count.  So the counts of frequent keys are never understated,
+// and are only overstated by the count of whatever they replaced.
+type topNBucket struct {
+	index    int64
+	counters map[string]*topNCounter
+	heap     topNHeap
+}
+
+func (b *topNBucket) add(key string, n, maxKeys int) {
+	if c, ok := b.counters[key]; ok {
+		c.count += n
+		heap.Fix(&b.heap, c.index)
+		return
+	}
+	if len(b.counters) < maxKeys {
+		c := &topNCounter{key: key, count: n}
+		heap.Push(&b.heap, c)
+		b.counters[key] = c
+		return
+	}
+	c := b.heap[0]
+	delete(b.counters, c.key)
+	c.key = key
+	c.overcount = c.count
+	c.count += n
+	b.counters[key] = c
+	heap.Fix(&b.heap, 0)
+}
+
+// TopNEntry is one of the keys that a TopN returns.
+type TopNEntry struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+
+	// The most that Count might overstate the key's true count by, because
+	// we weren't tracking it for the whole window.  Usually 0.
+	Error int `json:"error"`
+}
+
+// TopN is a pipeline processor that keeps track of which values of a field
+// (such as URLs) have been seen the most over a recent window, for a live view
+// of where errors are coming from.  By default only failed `network-error`
+// reports are counted, so you see the noisiest URLs by error count; with
+// allReports, every report that has a value for the field is counted.
+//
+// As with AttachErrorRate, the window is measured in tenths.  To bound the
+// memory used by a flood of distinct values, each tenth tracks at most maxKeys
+// of them, using the Space-Saving algorithm: a new value replaces the least
+// frequent one and inherits its count.  The frequent values that a TopN is
+// interested in are counted accurately; rarer ones may be overcounted, and
+// each entry's Error says by how much.
+//
+// A TopN is also an http.Handler, which returns the current top n as JSON.  The
+// handler understands an `n` query parameter, which asks for a different
+// number of values.
+type TopN struct {
+	// Clock is used to decide which reports are in the window.  If nil, we use
+	// the current time.
+	Clock collector.Clock
+
+	mu         sync.Mutex
+	field      string
+	key        func(report *collector.NelReport) (string, bool)
+	window     time.Duration
+	n          int
+	maxKeys    int
+	allReports bool
+	buckets    [errorRateBuckets]topNBucket
+}
+
+// NewTopN creates a new TopN processor that counts the values of field (which
+// can be "host", or any of the fields that Where's conditions can use) over
+// the given window, returns the top n of them, and tracks at most maxKeys
+// values in each tenth of the window.
+func NewTopN(field string, window time.Duration, n, maxKeys int, allReports bool) (*TopN, error) {
+	t := &TopN{}
+	if err := t.Configure(field, window, n, maxKeys, allReports); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Configure changes the TopN's settings (see NewTopN).  If any of them
+// change, the counts start again from scratch.
+func (t *TopN) Configure(field string, window time.Duration, n, maxKeys int, allReports bool) error {
+	key, err := reportKey(field)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if field == t.field && window == t.window && n == t.n && maxKeys == t.maxKeys && allReports == t.allReports {
+		return nil
+	}
+	t.field = field
+	t.key = key
+	t.window = window
+	t.n = n
+	t.maxKeys = maxKeys
+	t.allReports = allReports
+	t.buckets = [errorRateBuckets]topNBucket{}
+	return nil
+}
+
+// bucket returns the number of the bucket that now falls in.  t.mu must be
+// held.
+func (t *TopN) bucket() int64 {
+	now := time.Now()
+	if t.Clock != nil {
+		now = t.Clock.Now()
+	}
+	bucketWidth := t.window / errorRateBuckets
+	if bucketWidth <= 0 {
+		bucketWidth = 1
+	}
+	return now.UnixNano() / int64(bucketWidth)
+}
+
+// ProcessReports counts the values of the field in the batch.
+func (t *TopN) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	t.mu.Lock()
+	key, allReports := t.key, t.allReports
+	t.mu.Unlock()
+
+	counts := make(map[string]int)
+	var keys []string
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if !allReports && !isFailure(report) {
+			continue
+		}
+		k, ok := key(report)
+		if !ok {
+			continue
+		}
+		if counts[k] == 0 {
+			keys = append(keys, k)
+		}
+		counts[k]++
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := t.bucket()
+	b := &t.buckets[bucket%errorRateBuckets]
+	if b.index != bucket || b.counters == nil {
+		*b = topNBucket{index: bucket, counters: make(map[string]*topNCounter)}
+	}
+	for _, k := range keys {
+		b.add(k, counts[k], t.maxKeys)
+	}
+}
+
+// Top returns the n values with the highest counts over the window, most
+// frequent first.  Ties go to the value that sorts first.  If n isn't
+// positive, we use the TopN's own n.
+func (t *TopN) Top(n int) []TopNEntry {
+	t.mu.Lock()
+	if n <= 0 {
+		n = t.n
+	}
+	bucket := t.bucket()
+	merged := make(map[string]*TopNEntry)
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if b.index <= bucket-errorRateBuckets || b.index > bucket {
+			continue
+		}
+		for key, c := range b.counters {
+			entry, ok := merged[key]
+			if !ok {
+				entry = &TopNEntry{Key: key}
+				merged[key] = entry
+			}
+			entry.Count += c.count
+			entry.Error += c.overcount
+		}
+	}
+	t.mu.Unlock()
+
+	entries := make([]TopNEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// ServeHTTP writes the current top values as JSON.
+func (t *TopN) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var n int
+	if s := req.URL.Query().Get("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid n: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	top := t.Top(n)
+	t.mu.Lock()
+	response := struct {
+		Field  string      `json:"field"`
+		Window string      `json:"window"`
+		Top    []TopNEntry `json:"top"`
+	}{t.field, windowName(t.window), top}
+	t.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(response)
+}
+
+var topNs = struct {
+	sync.Mutex
+	m map[string]*TopN
+}{m: make(map[string]*TopN)}
+
+// NamedTopN returns the TopN with the given name, creating it if it doesn't
+// exist yet, with its default settings: the top 10 URLs by error count over
+// the last 5 minutes.  As with RecentReports, TopN processors that are loaded
+// from a configuration file are looked up by name, so that the http.Handler
+// that you mount in your server keeps working when a new pipeline is swapped
+// in.
+func NamedTopN(name string) *TopN {
+	topNs.Lock()
+	defer topNs.Unlock()
+	t, ok := topNs.m[name]
+	if !ok {
+		t, _ = NewTopN("url", 5*time.Minute, 10, 1000, false)
+		topNs.m[name] = t
+	}
+	return t
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"TopN",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Name       string `toml:"name"`
+				Field      string `toml:"field"`
+				Window     string `toml:"window"`
+				N          *int   `toml:"n"`
+				MaxKeys    *int   `toml:"max_keys"`
+				AllReports bool   `toml:"all_reports"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Name == "" {
+				config.Name = "default"
+			}
+			if config.Field == "" {
+				config.Field = "url"
+			}
+			window := 5 * time.Minute
+			if config.Window != "" {
+				window, err = time.ParseDuration(config.Window)
+				if err != nil {
+					return nil, fmt.Errorf("TopN invalid `window`: %v", err)
+				}
+				if window <= 0 {
+					return nil, fmt.Errorf("TopN `window` must be positive")
+				}
+			}
+			n := 10
+			if config.N != nil {
+				if *config.N < 1 {
+					return nil, fmt.Errorf("TopN `n` must be positive")
+				}
+				n = *config.N
+			}
+			maxKeys := 1000
+			if config.MaxKeys != nil {
+				if *config.MaxKeys < 1 {
+					return nil, fmt.Errorf("TopN `max_keys` must be positive")
+				}
+				maxKeys = *config.MaxKeys
+			}
+			if maxKeys < n {
+				return nil, fmt.Errorf("TopN `max_keys` must be at least `n`")
+			}
+
+			t := NamedTopN(config.Name)
+			if err := t.Configure(config.Field, window, n, maxKeys, config.AllReports); err != nil {
+				return nil, fmt.Errorf("TopN invalid `field`: %v", err)
+			}
+			t.mu.Lock()
+			t.Clock = clock
+			t.mu.Unlock()
+			return t, nil
+		})
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestTopN(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	top, err := core.NewTopN("url", 10*time.Minute, 2, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top.Clock = clock
+	ctx := context.Background()
+	process := func(reports ...collector.NelReport) {
+		top.ProcessReports(ctx, &collector.ReportBatch{Reports: reports})
+	}
+	report := func(url, typ string) collector.NelReport {
+		return collector.NelReport{ReportType: "network-error", URL: url, Type: typ}
+	}
+
+	process(
+		report("https://a.example/", "tcp.reset"),
+		report("https://a.example/", "tcp.reset"),
+		report("https://b.example/", "dns.name_not_resolved"),
+		report("https://c.example/", "ok"),
+		report("https://c.example/", "ok"),
+		report("https://c.example/", "ok"),
+		collector.NelReport{ReportType: "csp-violation", URL: "https://d.example/"},
+	)
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Minute)
+	process(report("https://b.example/", "tcp.timed_out"), report("https://e.example/", "http.error"))
+	want := []core.TopNEntry{{Key: "https://a.example/", Count: 2}, {Key: "https://b.example/", Count: 2}}
+	if diff := cmp.Diff(want, top.Top(0)); diff != "" {
+		t.Errorf("Top got diff (-want +got):\n%s", diff)
+	}
+
+	// The first batch has left the window.
+	clock.CurrentTime = clock.CurrentTime.Add(6 * time.Minute)
+	want = []core.TopNEntry{{Key: "https://b.example/", Count: 1}, {Key: "https://e.example/", Count: 1}}
+	if diff := cmp.Diff(want, top.Top(5)); diff != "" {
+		t.Errorf("Top after 11m got diff (-want +got):\n%s", diff)
+	}
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Hour)
+	if got := top.Top(0); len(got) != 0 {
+		t.Errorf("Top after an hour = %v, wanted nothing", got)
+	}
+}
+
+func TestTopNMaxKeys(t *testing.T) {
+	top, err := core.NewTopN("host", time.Hour, 2, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top.Clock = pipelinetest.NewSimulatedClock()
+	var reports []collector.NelReport
+	for i := 0; i < 200; i++ {
+		reports = append(reports, collector.NelReport{URL: "https://hot.example/"})
+	}
+	// A flood of distinct hosts, each seen once, only ever takes over the
+	// least frequent counter, so the hot host stays on top.
+	for i := 0; i < 100; i++ {
+		reports = append(reports, collector.NelReport{URL: fmt.Sprintf("https://%d.example/", i)})
+	}
+	top.ProcessReports(context.Background(), &collector.ReportBatch{Reports: reports})
+	want := []core.TopNEntry{{Key: "hot.example", Count: 200}, {Key: "99.example", Count: 100, Error: 99}}
+	if diff := cmp.Diff(want, top.Top(0)); diff != "" {
+		t.Errorf("Top got diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTopNHandler(t *testing.T) {
+	config := `
+[[processor]]
+type = "TopN"
+name = "TestTopNHandler"
+field = "host"
+window = "1m"
+n = 1
+`
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.ProcessBatch(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{
+		{ReportType: "network-error", URL: "https://a.example/x", Type: "tcp.reset"},
+		{ReportType: "network-error", URL: "https://a.example/y", Type: "tcp.reset"},
+		{ReportType: "network-error", URL: "https://b.example/", Type: "tcp.reset"},
+	}})
+
+	fetch := func(query string) interface{} {
+		response := httptest.NewRecorder()
+		core.NamedTopN("TestTopNHandler").ServeHTTP(response, httptest.NewRequest("GET", "/debug/top"+query, nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("TopN(%s) returned %d", query, response.Code)
+		}
+		var got interface{}
+		if err := json.Unmarshal(response.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	want := map[string]interface{}{
+		"field":  "host",
+		"window": "1m",
+		"top":    []interface{}{map[string]interface{}{"key": "a.example", "count": 2.0, "error": 0.0}},
+	}
+	if diff := cmp.Diff(want, fetch("")); diff != "" {
+		t.Errorf("TopN handler got diff (-want +got):\n%s", diff)
+	}
+	if got := fetch("?n=5").(map[string]interface{})["top"].([]interface{}); len(got) != 2 {
+		t.Errorf("TopN handler with n=5 returned %v, wanted 2 entries", got)
+	}
+
+	for _, query := range []string{"?n=0", "?n=many"} {
+		var response httptest.ResponseRecorder
+		core.NamedTopN("TestTopNHandler").ServeHTTP(&response, httptest.NewRequest("GET", "/debug/top"+query, nil))
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("TopN(%s) returned %d, wanted %d", query, response.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTopNBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`field = "nonexistent"`,
+		`window = "soon"`,
+		`window = "-1m"`,
+		`n = 0`,
+		`max_keys = 0`,
+		"n = 20\nmax_keys = 10",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"TopN\"\nname = \"TestTopNBadConfig\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
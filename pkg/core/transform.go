@@ -0,0 +1,382 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// transformField is a report field that a Transform can read and write.  get
+// returns ints for integer fields, so that copying them into an annotation
+// doesn't turn them into floats.
+type transformField struct {
+	get func(r *collector.NelReport) interface{}
+	set func(r *collector.NelReport, value interface{}) bool
+}
+
+func stringTransformField(ref func(r *collector.NelReport) *string) transformField {
+	return transformField{
+		get: func(r *collector.NelReport) interface{} { return *ref(r) },
+		set: func(r *collector.NelReport, value interface{}) bool {
+			*ref(r) = fmt.Sprint(value)
+			return true
+		},
+	}
+}
+
+func intTransformField(ref func(r *collector.NelReport) *int) transformField {
+	return transformField{
+		get: func(r *collector.NelReport) interface{} { return *ref(r) },
+		set: func(r *collector.NelReport, value interface{}) bool {
+			n, ok := toNumber(value)
+			if ok {
+				*ref(r) = int(n)
+			}
+			return ok
+		},
+	}
+}
+
+// transformFields are the report fields that a Transform can use, with the
+// same names as in Where's conditions.
+var transformFields = map[string]transformField{
+	"age":         intTransformField(func(r *collector.NelReport) *int { return &r.Age }),
+	"report_type": stringTransformField(func(r *collector.NelReport) *string { return &r.ReportType }),
+	"url":         stringTransformField(func(r *collector.NelReport) *string { return &r.URL }),
+	"user_agent":  stringTransformField(func(r *collector.NelReport) *string { return &r.UserAgent }),
+	"referrer":    stringTransformField(func(r *collector.NelReport) *string { return &r.Referrer }),
+	"sampling_fraction": {
+		get: func(r *collector.NelReport) interface{} { return float64(r.SamplingFraction) },
+		set: func(r *collector.NelReport, value interface{}) bool {
+			n, ok := toNumber(value)
+			if ok {
+				r.SamplingFraction = float32(n)
+			}
+			return ok
+		},
+	},
+	"server_ip":    stringTransformField(func(r *collector.NelReport) *string { return &r.ServerIP }),
+	"protocol":     stringTransformField(func(r *collector.NelReport) *string { return &r.Protocol }),
+	"method":       stringTransformField(func(r *collector.NelReport) *string { return &r.Method }),
+	"status_code":  intTransformField(func(r *collector.NelReport) *int { return &r.StatusCode }),
+	"elapsed_time": intTransformField(func(r *collector.NelReport) *int { return &r.ElapsedTime }),
+	"phase":        stringTransformField(func(r *collector.NelReport) *string { return &r.Phase }),
+	"type":         stringTransformField(func(r *collector.NelReport) *string { return &r.Type }),
+}
+
+// toNumber converts a number, or a string containing one, to a float64.
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// transformRef is a report field, or an annotation (written as
+// `annotations.Name`), that a Transform rule reads or writes.
+type transformRef struct {
+	field      *transformField
+	annotation string
+}
+
+func parseTransformRef(name string) (transformRef, error) {
+	if strings.HasPrefix(name, "annotations.") {
+		annotation := strings.TrimPrefix(name, "annotations.")
+		if annotation == "" {
+			return transformRef{}, fmt.Errorf("missing annotation name in %s", name)
+		}
+		return transformRef{annotation: annotation}, nil
+	}
+	field, ok := transformFields[strings.TrimPrefix(name, "report.")]
+	if !ok {
+		return transformRef{}, fmt.Errorf("unknown field %s", name)
+	}
+	return transformRef{field: &field}, nil
+}
+
+// get returns the value of the field or annotation, or nil if it's an
+// annotation that isn't set.  As in Where's conditions, annotations fall back
+// on the batch's annotation of the same name.
+func (t transformRef) get(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	if t.field != nil {
+		return t.field.get(report)
+	}
+	value := report.GetAnnotation(t.annotation)
+	if value == nil {
+		value = batch.GetAnnotation(t.annotation)
+	}
+	return value
+}
+
+// set sets the field or annotation, and returns false if the value can't be
+// stored in the field.
+func (t transformRef) set(report *collector.NelReport, value interface{}) bool {
+	if t.field != nil {
+		return t.field.set(report, value)
+	}
+	report.SetAnnotation(t.annotation, value)
+	return true
+}
+
+// clear resets the field to its zero value, or removes the annotation.
+func (t transformRef) clear(report *collector.NelReport) {
+	if t.field != nil {
+		t.field.set(report, zeroLike(t.field.get(report)))
+		return
+	}
+	report.DeleteAnnotation(t.annotation)
+}
+
+func zeroLike(value interface{}) interface{} {
+	if _, ok := value.(string); ok {
+		return ""
+	}
+	return 0
+}
+
+// convertTransformValue converts a value to the type named by a rule's `as`
+// setting, and returns false if it can't be.
+func convertTransformValue(value interface{}, as string) (interface{}, bool) {
+	switch as {
+	case "string":
+		return fmt.Sprint(value), true
+	case "int":
+		n, ok := toNumber(value)
+		if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, false
+		}
+		return int64(n), true
+	case "float":
+		return toNumber(value)
+	}
+	return value, true
+}
+
+// TransformRule is one of the steps of a Transform.  Which of its settings are
+// used depends on its Op:
+//
+//	set     sets To to Value
+//	rename  moves From to To, clearing From
+//	copy    copies From to To
+//	delete  clears Field
+//	concat  sets To to the values of Fields, joined with Separator
+//
+// Fields are named as in Where's conditions, and annotations as
+// `annotations.Name`.  Clearing a field sets it to zero or the empty string;
+// clearing an annotation removes it.  If As is set, the value is converted to
+// a "string", "int", or "float" before it's stored; values that can't be
+// converted (or stored in a numeric field) are skipped, leaving To alone, as
+// are annotations that aren't set.
+type TransformRule struct {
+	Op        string      `toml:"op"`
+	From      string      `toml:"from"`
+	To        string      `toml:"to"`
+	Field     string      `toml:"field"`
+	Fields    []string    `toml:"fields"`
+	Value     interface{} `toml:"value"`
+	Separator string      `toml:"separator"`
+	As        string      `toml:"as"`
+}
+
+// compiledTransformRule is a TransformRule whose references have been parsed.
+type compiledTransformRule struct {
+	TransformRule
+	from   transformRef
+	to     transformRef
+	fields []transformRef
+}
+
+func compileTransformRule(rule TransformRule) (compiledTransformRule, error) {
+	c := compiledTransformRule{TransformRule: rule}
+	switch rule.As {
+	case "", "string", "int", "float":
+	default:
+		return c, fmt.Errorf("invalid `as`: %s", rule.As)
+	}
+	var err error
+	parse := func(setting, name string) (transformRef, error) {
+		if name == "" {
+			return transformRef{}, fmt.Errorf("%s rule missing `%s`", rule.Op, setting)
+		}
+		ref, err := parseTransformRef(name)
+		if err != nil {
+			return transformRef{}, fmt.Errorf("%s rule invalid `%s`: %v", rule.Op, setting, err)
+		}
+		return ref, nil
+	}
+	switch rule.Op {
+	case "set":
+		if c.to, err = parse("to", rule.To); err != nil {
+			return c, err
+		}
+		if rule.Value == nil {
+			return c, fmt.Errorf("set rule missing `value`")
+		}
+		value, ok := convertTransformValue(rule.Value, rule.As)
+		if !ok {
+			return c, fmt.Errorf("set rule can't convert `value` %v to %s", rule.Value, rule.As)
+		}
+		var report collector.NelReport
+		if !c.to.set(&report, value) {
+			return c, fmt.Errorf("set rule can't store `value` %v in %s", rule.Value, rule.To)
+		}
+		c.Value = value
+	case "rename", "copy":
+		if c.from, err = parse("from", rule.From); err != nil {
+			return c, err
+		}
+		if c.to, err = parse("to", rule.To); err != nil {
+			return c, err
+		}
+	case "delete":
+		if c.from, err = parse("field", rule.Field); err != nil {
+			return c, err
+		}
+	case "concat":
+		if len(rule.Fields) == 0 {
+			return c, fmt.Errorf("concat rule missing `fields`")
+		}
+		for _, name := range rule.Fields {
+			ref, err := parse("fields", name)
+			if err != nil {
+				return c, err
+			}
+			c.fields = append(c.fields, ref)
+		}
+		if c.to, err = parse("to", rule.To); err != nil {
+			return c, err
+		}
+	case "":
+		return c, fmt.Errorf("rule missing `op`")
+	default:
+		return c, fmt.Errorf("unknown rule `op`: %s", rule.Op)
+	}
+	return c, nil
+}
+
+// store converts a value as the rule says, and stores it in To.  It returns
+// false if the value couldn't be converted or stored.
+func (c *compiledTransformRule) store(report *collector.NelReport, value interface{}) bool {
+	value, ok := convertTransformValue(value, c.As)
+	return ok && c.to.set(report, value)
+}
+
+func (c *compiledTransformRule) apply(batch *collector.ReportBatch, report *collector.NelReport) {
+	switch c.Op {
+	case "set":
+		c.to.set(report, c.Value)
+	case "rename", "copy":
+		value := c.from.get(batch, report)
+		if value == nil {
+			return
+		}
+		if c.store(report, value) && c.Op == "rename" && c.From != c.To {
+			c.from.clear(report)
+		}
+	case "delete":
+		c.from.clear(report)
+	case "concat":
+		parts := make([]string, len(c.fields))
+		for i, field := range c.fields {
+			if value := field.get(batch, report); value != nil {
+				parts[i] = fmt.Sprint(value)
+			}
+		}
+		c.store(report, strings.Join(parts, c.Separator))
+	}
+}
+
+// Transform is a pipeline processor that makes small changes to the fields
+// and annotations of each report, following a list of rules (see
+// TransformRule) in order, so that simple rewrites don't each need a
+// processor of their own.  For example:
+//
+//	[[processor]]
+//	type = "Transform"
+//	[[processor.rule]]
+//	op = "rename"
+//	from = "status_code"
+//	to = "annotations.Status"
+//	[[processor.rule]]
+//	op = "concat"
+//	fields = ["phase", "type"]
+//	separator = "/"
+//	to = "annotations.Failure"
+type Transform struct {
+	rules []compiledTransformRule
+}
+
+// NewTransform creates a new Transform processor that applies rules, in
+// order.  It returns an error if any of the rules are invalid.
+func NewTransform(rules []TransformRule) (*Transform, error) {
+	t := &Transform{}
+	for i, rule := range rules {
+		compiled, err := compileTransformRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		t.rules = append(t.rules, compiled)
+	}
+	return t, nil
+}
+
+// ProcessReports applies the rules to each report in the batch.
+func (t *Transform) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		for j := range t.rules {
+			t.rules[j].apply(batch, &batch.Reports[i])
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"Transform",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Rules []TransformRule `toml:"rule"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if len(config.Rules) == 0 {
+				return nil, fmt.Errorf("Transform missing `rule`")
+			}
+			t, err := NewTransform(config.Rules)
+			if err != nil {
+				return nil, fmt.Errorf("Transform invalid `rule`: %v", err)
+			}
+			return t, nil
+		})
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestTransform(t *testing.T) {
+	newBatch := func() *collector.ReportBatch {
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{{
+			ReportType: "network-error",
+			URL:        "https://example.com/",
+			Referrer:   "https://referrer.example/",
+			StatusCode: 503,
+			Phase:      "application",
+			Type:       "http.error",
+		}}}
+		batch.SetAnnotation("Region", "eu")
+		batch.Reports[0].SetAnnotation("Code", "404")
+		batch.Reports[0].SetAnnotation("Score", "high")
+		return batch
+	}
+	cases := []struct {
+		name, rules string
+		want        func(report *collector.NelReport)
+	}{
+		{"Set", `
+			op = "set"
+			to = "annotations.Team"
+			value = "edge"
+		`, func(r *collector.NelReport) { r.SetAnnotation("Team", "edge") }},
+		{"SetField", `
+			op = "set"
+			to = "status_code"
+			value = "200"
+			as = "int"
+		`, func(r *collector.NelReport) { r.StatusCode = 200 }},
+		{"Rename", `
+			op = "rename"
+			from = "status_code"
+			to = "annotations.Status"
+		`, func(r *collector.NelReport) {
+			r.StatusCode = 0
+			r.SetAnnotation("Status", 503)
+		}},
+		{"CopyAndCast", `
+			op = "copy"
+			from = "annotations.Code"
+			to = "status_code"
+		`, func(r *collector.NelReport) { r.StatusCode = 404 }},
+		{"CastAnnotation", `
+			op = "copy"
+			from = "annotations.Code"
+			to = "annotations.Code"
+			as = "int"
+		`, func(r *collector.NelReport) { r.SetAnnotation("Code", int64(404)) }},
+		{"UnconvertibleIsSkipped", `
+			op = "rename"
+			from = "annotations.Score"
+			to = "status_code"
+		`, func(r *collector.NelReport) {}},
+		{"BatchAnnotation", `
+			op = "copy"
+			from = "annotations.Region"
+			to = "annotations.ReportRegion"
+		`, func(r *collector.NelReport) { r.SetAnnotation("ReportRegion", "eu") }},
+		{"MissingAnnotationIsSkipped", `
+			op = "copy"
+			from = "annotations.Missing"
+			to = "referrer"
+		`, func(r *collector.NelReport) {}},
+		{"Delete", `
+			op = "delete"
+			field = "referrer"
+			[[processor.rule]]
+			op = "delete"
+			field = "annotations.Score"
+		`, func(r *collector.NelReport) {
+			r.Referrer = ""
+			r.DeleteAnnotation("Score")
+		}},
+		{"Concat", `
+			op = "concat"
+			fields = ["phase", "type", "annotations.Missing", "report.status_code"]
+			separator = "/"
+			to = "annotations.Failure"
+		`, func(r *collector.NelReport) { r.SetAnnotation("Failure", "application/http.error//503") }},
+		{"InOrder", `
+			op = "copy"
+			from = "type"
+			to = "annotations.OriginalType"
+			[[processor.rule]]
+			op = "set"
+			to = "type"
+			value = "redacted"
+		`, func(r *collector.NelReport) {
+			r.SetAnnotation("OriginalType", "http.error")
+			r.Type = "redacted"
+		}},
+	}
+	for _, c := range cases {
+		batch := pipelinetest.RunTestConfig("[[processor]]\ntype = \"Transform\"\n[[processor.rule]]\n"+c.rules, newBatch())
+		want := newBatch().Reports[0]
+		c.want(&want)
+		if diff := cmp.Diff(want, batch.Reports[0], cmp.AllowUnexported(collector.Annotations{})); diff != "" {
+			t.Errorf("Transform(%s) got diff (-want +got):\n%s", c.name, diff)
+		}
+	}
+}
+
+func TestTransformBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		"[[processor.rule]]\nop = \"upsert\"",
+		"[[processor.rule]]\nto = \"type\"",
+		"[[processor.rule]]\nop = \"set\"\nto = \"type\"",
+		"[[processor.rule]]\nop = \"set\"\nvalue = \"x\"",
+		"[[processor.rule]]\nop = \"set\"\nto = \"status_code\"\nvalue = \"ok\"",
+		"[[processor.rule]]\nop = \"set\"\nto = \"type\"\nvalue = \"x\"\nas = \"bool\"",
+		"[[processor.rule]]\nop = \"rename\"\nfrom = \"nonexistent\"\nto = \"type\"",
+		"[[processor.rule]]\nop = \"copy\"\nfrom = \"type\"",
+		"[[processor.rule]]\nop = \"copy\"\nfrom = \"type\"\nto = \"annotations.\"",
+		"[[processor.rule]]\nop = \"delete\"",
+		"[[processor.rule]]\nop = \"concat\"\nto = \"annotations.X\"",
+		"[[processor.rule]]\nop = \"concat\"\nfields = [\"type\"]",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"Transform\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// TransitProvider is a pipeline processor that labels each report with the
+// upstream transit provider of the client's network, so that you can see when
+// errors are concentrated behind one provider, which a long list of AS numbers
+// would hide.  We read the client's AS number from an annotation (ASNAnnotation,
+// which a GeoIP lookup earlier in the pipeline can provide; as in Where's
+// conditions, we fall back on the batch's annotation if a report doesn't have
+// one), look it up in a table read from Path, and save the provider in the
+// TransitProvider annotation.  The AS number can be a number, or a string with
+// or without an `AS` prefix.  Reports whose AS number is missing, invalid, or
+// not in the table get Default instead, unless that's empty, in which case
+// they don't get the annotation.
+//
+// Each line of the table file holds an AS number (again, with or without an
+// `AS` prefix), followed by whitespace and the provider's name, which can
+// contain spaces of its own.  Blank lines, and anything after a `#`, are
+// ignored.  If an AS number appears more than once, the last line wins.
+//
+// You can call Reload to read the file again; or, if you give
+// NewTransitProvider a reload interval, we check that often whether the file
+// has been modified, and read it again if it has.  If the new contents are
+// invalid, we log an error and carry on using the old table.
+type TransitProvider struct {
+	Path          string
+	ASNAnnotation string
+	Annotation    string
+	Default       string
+
+	asn       annotationRef
+	mu        sync.RWMutex
+	providers map[uint32]string
+	modTime   time.Time
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewTransitProvider creates a new TransitProvider processor, which looks up
+// the ASN annotation of each report in the table in path.  It returns an
+// error if the file can't be read.  If reloadInterval is nonzero, we also
+// start checking for changes to the file in the background; Close stops
+// checking.
+func NewTransitProvider(path string, reloadInterval time.Duration) (*TransitProvider, error) {
+	t := &TransitProvider{
+		Path:          path,
+		ASNAnnotation: "ASN",
+		Annotation:    "TransitProvider",
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		t.done = make(chan struct{})
+		t.wg.Add(1)
+		go t.run(reloadInterval)
+	}
+	return t, nil
+}
+
+func (t *TransitProvider) run(interval time.Duration) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(t.Path)
+			if err != nil {
+				log.Printf("TransitProvider: %v", err)
+				continue
+			}
+			t.mu.RLock()
+			changed := !info.ModTime().Equal(t.modTime)
+			t.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := t.Reload(); err != nil {
+				log.Printf("TransitProvider: %v", err)
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// parseASN parses an AS number, with or without an `AS` prefix.
+func parseASN(text string) (uint32, bool) {
+	text = strings.TrimSpace(text)
+	if len(text) > 2 && strings.EqualFold(text[:2], "AS") {
+		text = text[2:]
+	}
+	asn, err := strconv.ParseUint(text, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(asn), true
+}
+
+// Reload reads the table from Path again.  If the file can't be read, we
+// return an error and keep using the old table.
+func (t *TransitProvider) Reload() error {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	providers := make(map[uint32]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if comment := strings.IndexByte(text, '#'); comment >= 0 {
+			text = text[:comment]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return fmt.Errorf("%s:%d: missing provider for %s", t.Path, line, fields[0])
+		}
+		asn, ok := parseASN(fields[0])
+		if !ok {
+			return fmt.Errorf("%s:%d: invalid AS number %s", t.Path, line, fields[0])
+		}
+		providers[asn] = strings.Join(fields[1:], " ")
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", t.Path, err)
+	}
+
+	t.mu.Lock()
+	t.providers = providers
+	t.modTime = info.ModTime()
+	t.mu.Unlock()
+	return nil
+}
+
+// provider returns the transit provider for a report, or "" if there isn't
+// one.  t.mu must be held.
+func (t *TransitProvider) provider(batch *collector.ReportBatch, report *collector.NelReport) string {
+	value, ok := routeValue(annotationRef{t.ASNAnnotation}.eval(batch, report))
+	if !ok {
+		return t.Default
+	}
+	asn, ok := parseASN(value)
+	if !ok {
+		return t.Default
+	}
+	if provider, ok := t.providers[asn]; ok {
+		return provider
+	}
+	return t.Default
+}
+
+// ProcessReports annotates each report with its client's transit provider.
+func (t *TransitProvider) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if provider := t.provider(batch, report); provider != "" {
+			report.SetAnnotation(t.Annotation, provider)
+		}
+	}
+}
+
+// Close stops checking for changes to the file.
+func (t *TransitProvider) Close() error {
+	if t.done != nil {
+		close(t.done)
+		t.wg.Wait()
+		t.done = nil
+	}
+	return nil
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"TransitProvider",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Path           string `toml:"path"`
+				ASNAnnotation  string `toml:"asn_annotation"`
+				Annotation     string `toml:"annotation"`
+				Default        string `toml:"default"`
+				ReloadInterval string `toml:"reload_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Path == "" {
+				return nil, fmt.Errorf("TransitProvider missing `path`")
+			}
+			reloadInterval := time.Minute
+			if config.ReloadInterval != "" {
+				reloadInterval, err = time.ParseDuration(config.ReloadInterval)
+				if err != nil {
+					return nil, fmt.Errorf("TransitProvider invalid `reload_interval`: %v", err)
+				}
+				if reloadInterval <= 0 {
+					return nil, fmt.Errorf("TransitProvider `reload_interval` must be positive")
+				}
+			}
+
+			t, err := NewTransitProvider(config.Path, reloadInterval)
+			if err != nil {
+				return nil, fmt.Errorf("TransitProvider invalid `path`: %v", err)
+			}
+			if config.ASNAnnotation != "" {
+				t.ASNAnnotation = config.ASNAnnotation
+			}
+			if config.Annotation != "" {
+				t.Annotation = config.Annotation
+			}
+			t.Default = config.Default
+			return t, nil
+		})
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+// transitProviders returns the TransitProvider annotation of a report from a
+// client in each AS.
+func transitProviders(p collector.ReportProcessor, asns ...interface{}) []string {
+	var result []string
+	for _, asn := range asns {
+		batch := &collector.ReportBatch{Reports: []collector.NelReport{{}}}
+		if asn != nil {
+			batch.Reports[0].SetAnnotation("ASN", asn)
+		}
+		p.ProcessReports(context.Background(), batch)
+		result = append(result, fmt.Sprint(batch.Reports[0].GetAnnotation("TransitProvider")))
+	}
+	return result
+}
+
+func TestTransitProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "transit.txt")
+	ioutil.WriteFile(path, []byte("# Upstreams\n64496  Provider X\nAS64497 Provider Y  # via IX\n\n"), 0644)
+
+	config := fmt.Sprintf(`
+		[[processor]]
+		type = "TransitProvider"
+		path = %q
+		default = "unknown"
+	`, path)
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	p := pipeline.Processors()[0]
+	got := transitProviders(p, 64496, "AS64497", "as64496", 64497.0, "64498", "not an ASN", nil)
+	want := []string{"Provider X", "Provider Y", "Provider X", "Provider Y", "unknown", "unknown", "unknown"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("TransitProvider got diff (-want +got):\n%s", diff)
+	}
+
+	// The batch's annotation is used if the report doesn't have one.
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{{}}}
+	batch.SetAnnotation("ASN", "64497")
+	p.ProcessReports(context.Background(), batch)
+	if got := batch.Reports[0].GetAnnotation("TransitProvider"); got != "Provider Y" {
+		t.Errorf("TransitProvider with batch ASN = %v, wanted Provider Y", got)
+	}
+}
+
+func TestTransitProviderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "transit.txt")
+	ioutil.WriteFile(path, []byte("64496 Provider X\n"), 0644)
+
+	p, err := core.NewTransitProvider(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// Without a default, reports that aren't in the table aren't annotated.
+	if diff := cmp.Diff([]string{"Provider X", "<nil>"}, transitProviders(p, 64496, 64497)); diff != "" {
+		t.Errorf("TransitProvider got diff (-want +got):\n%s", diff)
+	}
+
+	// An invalid file leaves the old table in place.
+	ioutil.WriteFile(path, []byte("64496\n"), 0644)
+	if err := p.Reload(); err == nil {
+		t.Errorf("Reload of an invalid file should return error")
+	}
+	if diff := cmp.Diff([]string{"Provider X"}, transitProviders(p, 64496)); diff != "" {
+		t.Errorf("TransitProvider after failed Reload got diff (-want +got):\n%s", diff)
+	}
+
+	ioutil.WriteFile(path, []byte("64496 Provider Z\n"), 0644)
+	// Make sure that the modification time changes, even on filesystems with
+	// coarse timestamps.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := transitProviders(p, 64496)
+		if got[0] == "Provider Z" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TransitProvider didn't reload the file: got %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransitProviderBadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "transit.txt")
+	ioutil.WriteFile(path, []byte("64496 Provider X\n"), 0644)
+	invalid := filepath.Join(dir, "invalid.txt")
+	ioutil.WriteFile(invalid, []byte("ASX Provider X\n"), 0644)
+
+	for _, config := range []string{
+		``,
+		fmt.Sprintf("path = %q", filepath.Join(dir, "nonexistent.txt")),
+		fmt.Sprintf("path = %q", invalid),
+		fmt.Sprintf("path = %q\nreload_interval = \"soon\"", path),
+		fmt.Sprintf("path = %q\nreload_interval = \"-1s\"", path),
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"TransitProvider\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// hyperLogLog is a HyperLogLog sketch, which estimates the number of distinct
+// values that have been added to it, using 2^precision one-byte registers no
+// matter how many values there are.  The standard error of the estimate is
+// about 1.04/sqrt(2^precision).
+type hyperLogLog struct {
+	precision uint
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint) *hyperLogLog {
+	return &hyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+// hashValue returns a well-mixed 64-bit hash of a value: FNV-1a, followed by
+// MurmurHash3's finalizer, since FNV on its own doesn't spread similar inputs
+// (like neighbouring IP addresses) over the high bits well enough.
+func hashValue(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// add adds a value, given its hash, to the sketch.  The top precision bits of
+// the hash choose a register, which records the longest run of leading zeros
+// (plus one) that it's seen in the rest of the hash.
+func (h *hyperLogLog) add(hash uint64) {
+	index := hash >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(hash<<h.precision|1<<(h.precision-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// estimate returns the estimated number of distinct values in the sketch,
+// using linear counting instead while the estimate is small enough that it's
+// more accurate.
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// uniqueClientsBody is the JSON body of each report that UniqueClients sends
+// to its children.
+type uniqueClientsBody struct {
+	Key           string    `json:"key"`
+	UniqueClients int64     `json:"unique_clients"`
+	WindowStart   time.Time `json:"window_start"`
+	WindowEnd     time.Time `json:"window_end"`
+}
+
+// UniqueClients is a pipeline processor that estimates how many distinct
+// clients have uploaded reports about each host, which is a privacy-friendly
+// way of measuring how many users a problem affects.  We never store the
+// clients' IP addresses: each one is hashed and fed into a HyperLogLog sketch
+// for the host, which only remembers enough to estimate the number of distinct
+// hashes.  Each sketch uses 2^Precision bytes; the estimates' standard error
+// is about 1.04/sqrt(2^Precision), or about 3% for the default of 10.
+//
+// Windows are fixed, and aligned to the epoch of Clock.  When a window ends,
+// we send Children a batch with one report for each host that we heard about
+// during it, in order of host, with a report_type of `unique-clients`.  Each
+// report's body holds the host (as `key`), the estimate (as
+// `unique_clients`), and the window's start and end; the estimate is also in
+// the report's UniqueClients annotation.  Batches themselves are passed
+// through unchanged, and aren't sent to the children.  Anything left when the
+// pipeline is closed is sent for the partial window.
+//
+// We track at most MaxKeys hosts in each window, forgetting about the ones
+// that we've heard from least recently.
+type UniqueClients struct {
+	Window    time.Duration
+	Precision uint
+	MaxKeys   int
+	Children  []collector.ReportProcessor
+
+	// Clock is used to decide which window each batch is in.  If nil, we use
+	// the current time.
+	Clock collector.Clock
+
+	key      func(report *collector.NelReport) (string, bool)
+	mu       sync.Mutex
+	index    int64
+	sketches *ttlCache
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewUniqueClients creates a new UniqueClients processor, which counts
+// clients separately for each value of field, and starts checking whether
+// each window has ended.  (Close stops checking.)  As with OutageDetector,
+// the field can be "host", for the host of each report's URL, or any of the
+// fields that Where's conditions can use.  We check in the background a few
+// times per window; you can also call Tick to check immediately.
+func NewUniqueClients(field string, window time.Duration, precision uint, children []collector.ReportProcessor, clock collector.Clock) (*UniqueClients, error) {
+	key, err := reportKey(field)
+	if err != nil {
+		return nil, err
+	}
+	if precision < 4 || precision > 16 {
+		return nil, fmt.Errorf("precision must be between 4 and 16")
+	}
+	u := &UniqueClients{
+		Window:    window,
+		Precision: precision,
+		MaxKeys:   10000,
+		Children:  children,
+		Clock:     clock,
+		key:       key,
+		done:      make(chan struct{}),
+	}
+	u.index = u.windowIndex(u.now())
+	u.wg.Add(1)
+	go u.run()
+	return u, nil
+}
+
+func (u *UniqueClients) now() time.Time {
+	if u.Clock == nil {
+		return time.Now()
+	}
+	return u.Clock.Now()
+}
+
+func (u *UniqueClients) windowIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(u.Window)
+}
+
+func (u *UniqueClients) run() {
+	defer u.wg.Done()
+	ticker := time.NewTicker(u.Window / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.Tick(context.Background())
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// take removes the sketches for the current window, if it's before index, so
+// that they can be sent to the children.  u.mu must be held.
+func (u *UniqueClients) take(index int64) (*ttlCache, int64) {
+	if index <= u.index {
+		return nil, 0
+	}
+	sketches, previous := u.sketches, u.index
+	u.sketches = nil
+	u.index = index
+	return sketches, previous
+}
+
+// emit sends the children the estimates for a window.
+func (u *UniqueClients) emit(ctx context.Context, sketches *ttlCache, index int64) {
+	if sketches == nil {
+		return
+	}
+	start := time.Unix(0, index*int64(u.Window)).UTC()
+	end := start.Add(u.Window)
+	estimates := make(map[string]int64)
+	var keys []string
+	sketches.each(func(key string, value interface{}) {
+		estimates[key] = value.(*hyperLogLog).estimate()
+		keys = append(keys, key)
+	})
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+
+	batch := &collector.ReportBatch{Time: end}
+	for _, key := range keys {
+		body, _ := json.Marshal(uniqueClientsBody{
+			Key:           key,
+			UniqueClients: estimates[key],
+			WindowStart:   start,
+			WindowEnd:     end,
+		})
+		report := collector.NelReport{ReportType: "unique-clients", RawBody: body}
+		report.SetAnnotation("UniqueClients", estimates[key])
+		batch.Reports = append(batch.Reports, report)
+	}
+	runChain(ctx, u.Children, batch)
+}
+
+// Tick sends the children the estimates for the previous window, if it's
+// ended and they haven't been sent yet, and returns whether it did.
+func (u *UniqueClients) Tick(ctx context.Context) bool {
+	u.mu.Lock()
+	sketches, index := u.take(u.windowIndex(u.now()))
+	u.mu.Unlock()
+	u.emit(ctx, sketches, index)
+	return sketches != nil
+}
+
+// ProcessReports adds the client of each report in the batch to its host's
+// sketch.
+func (u *UniqueClients) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := u.now()
+	u.mu.Lock()
+	sketches, index := u.take(u.windowIndex(now))
+	if u.sketches == nil {
+		u.sketches = newTTLCache(u.MaxKeys, 0)
+	}
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		ip := clientIP(batch, report)
+		if ip == "" {
+			continue
+		}
+		key, ok := u.key(report)
+		if !ok {
+			continue
+		}
+		var sketch *hyperLogLog
+		if value, ok := u.sketches.get(key, now); ok {
+			sketch = value.(*hyperLogLog)
+		} else {
+			sketch = newHyperLogLog(u.Precision)
+			u.sketches.add(key, sketch, now)
+		}
+		sketch.add(hashValue(ip))
+	}
+	u.mu.Unlock()
+	u.emit(ctx, sketches, index)
+}
+
+// Close sends the children the estimates for the current, partial window,
+// stops checking whether windows have ended, and closes any child processors
+// that need to be closed.
+func (u *UniqueClients) Close() error {
+	close(u.done)
+	u.wg.Wait()
+	u.mu.Lock()
+	sketches, index := u.sketches, u.index
+	u.sketches = nil
+	u.mu.Unlock()
+	u.emit(context.Background(), sketches, index)
+	return collector.CloseProcessors(u.Children)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"UniqueClients",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Field     string `toml:"field"`
+				Window    string `toml:"window"`
+				Precision *int   `toml:"precision"`
+				MaxKeys   *int   `toml:"max_keys"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Field == "" {
+				config.Field = "host"
+			}
+			if _, err := reportKey(config.Field); err != nil {
+				return nil, fmt.Errorf("UniqueClients invalid `field`: %s", config.Field)
+			}
+			window := time.Minute
+			if config.Window != "" {
+				window, err = time.ParseDuration(config.Window)
+				if err != nil {
+					return nil, fmt.Errorf("UniqueClients invalid `window`: %v", err)
+				}
+				if window <= 0 {
+					return nil, fmt.Errorf("UniqueClients `window` must be positive")
+				}
+			}
+			precision := 10
+			if config.Precision != nil {
+				precision = *config.Precision
+				if precision < 4 || precision > 16 {
+					return nil, fmt.Errorf("UniqueClients `precision` must be between 4 and 16")
+				}
+			}
+			if config.MaxKeys != nil && *config.MaxKeys < 1 {
+				return nil, fmt.Errorf("UniqueClients `max_keys` must be positive")
+			}
+
+			children, err := collector.LoadChildProcessors(ctx, configPrimitive)
+			if err != nil {
+				return nil, fmt.Errorf("UniqueClients children: %v", err)
+			}
+			if len(children) == 0 {
+				return nil, fmt.Errorf("UniqueClients missing `children`")
+			}
+			u, err := NewUniqueClients(config.Field, window, uint(precision), children, clock)
+			if err != nil {
+				return nil, err
+			}
+			if config.MaxKeys != nil {
+				u.MaxKeys = *config.MaxKeys
+			}
+			return u, nil
+		})
+}
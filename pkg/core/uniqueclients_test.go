@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestUniqueClients(t *testing.T) {
+	clock := pipelinetest.NewSimulatedClock()
+	var emitted []*collector.ReportBatch
+	sink := processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+		emitted = append(emitted, batch)
+	})
+	u, err := core.NewUniqueClients("host", time.Hour, 14, []collector.ReportProcessor{sink}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	upload := func(ip, url string) {
+		u.ProcessReports(ctx, &collector.ReportBatch{
+			ClientIP: ip,
+			Reports:  []collector.NelReport{{ReportType: "network-error", URL: url}},
+		})
+	}
+	// Lots of distinct clients for a.example, and a few clients that upload
+	// over and over for b.example.
+	for i := 0; i < 20000; i++ {
+		upload(fmt.Sprintf("10.%d.%d.1", i/256, i%256), "https://a.example/")
+		upload(fmt.Sprintf("192.0.2.%d", i%10), "https://b.example/")
+	}
+	// Coalesced batches have a ClientIP annotation on each report.
+	coalesced := &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "network-error", URL: "https://c.example/"}}}
+	coalesced.Reports[0].SetAnnotation("ClientIP", "198.51.100.1")
+	u.ProcessReports(ctx, coalesced)
+
+	if u.Tick(ctx) || len(emitted) != 0 {
+		t.Fatalf("UniqueClients emitted estimates before the window ended")
+	}
+	clock.CurrentTime = clock.CurrentTime.Add(time.Hour)
+	if !u.Tick(ctx) || len(emitted) != 1 {
+		t.Fatalf("UniqueClients emitted %d batches when the window ended, wanted 1", len(emitted))
+	}
+
+	wants := []struct {
+		key      string
+		min, max int64
+	}{
+		{"a.example", 19400, 20600},
+		{"b.example", 10, 10},
+		{"c.example", 1, 1},
+	}
+	batch := emitted[0]
+	if len(batch.Reports) != len(wants) {
+		t.Fatalf("UniqueClients emitted %d reports, wanted %d", len(batch.Reports), len(wants))
+	}
+	for i, want := range wants {
+		report := batch.Reports[i]
+		var body struct {
+			Key           string    `json:"key"`
+			UniqueClients int64     `json:"unique_clients"`
+			WindowEnd     time.Time `json:"window_end"`
+		}
+		if err := json.Unmarshal(report.RawBody, &body); err != nil {
+			t.Fatal(err)
+		}
+		if report.ReportType != "unique-clients" || body.Key != want.key {
+			t.Errorf("UniqueClients report %d is a %s for %s, wanted unique-clients for %s", i, report.ReportType, body.Key, want.key)
+		}
+		if body.UniqueClients < want.min || body.UniqueClients > want.max {
+			t.Errorf("UniqueClients estimated %d clients for %s, wanted between %d and %d", body.UniqueClients, want.key, want.min, want.max)
+		}
+		if got := report.GetAnnotation("UniqueClients"); got != body.UniqueClients {
+			t.Errorf("UniqueClients annotation is %v, wanted %d", got, body.UniqueClients)
+		}
+		if !body.WindowEnd.Equal(batch.Time) {
+			t.Errorf("UniqueClients window ends at %v, but batch is at %v", body.WindowEnd, batch.Time)
+		}
+	}
+
+	// The new window starts from scratch, and is sent when we're closed.
+	upload("192.0.2.1", "https://b.example/")
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(emitted) != 2 || len(emitted[1].Reports) != 1 || emitted[1].Reports[0].GetAnnotation("UniqueClients") != int64(1) {
+		t.Errorf("UniqueClients didn't send the partial window when closed")
+	}
+}
+
+func TestUniqueClientsBadConfig(t *testing.T) {
+	child := "\n[[processor.children]]\ntype = \"SummarizeBatch\""
+	for _, config := range []string{
+		``,
+		`field = "nonexistent"` + child,
+		`window = "soon"` + child,
+		`window = "0s"` + child,
+		`precision = 3` + child,
+		`precision = 17` + child,
+		`max_keys = 0` + child,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"UniqueClients\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
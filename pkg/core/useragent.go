@@ -0,0 +1,179 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/mssola/useragent"
+)
+
+// UserAgentFields lists the annotations that ParseUserAgent can add to each
+// report.
+var UserAgentFields = []string{"BrowserFamily", "BrowserVersion", "OS", "DeviceType"}
+
+// userAgentInfo holds the parsed form of a User-Agent string, keyed by
+// annotation name.
+type userAgentInfo map[string]string
+
+// clientUserAgent returns the User-Agent of the client that uploaded a report.
+// That's the ClientUserAgent annotation if the report has one (since
+// coalesced batches can contain reports from different uploads), then the
+// batch's ClientUserAgent, and finally the report's own `user_agent` field.
+func clientUserAgent(batch *collector.ReportBatch, report *collector.NelReport) string {
+	if ua, ok := report.GetAnnotation("ClientUserAgent").(string); ok && ua != "" {
+		return ua
+	}
+	if batch.ClientUserAgent != "" {
+		return batch.ClientUserAgent
+	}
+	return report.UserAgent
+}
+
+// ParseUserAgent is a pipeline processor that parses the User-Agent of the
+// client that uploaded each report (see clientUserAgent), and annotates the
+// report with the browser family and version, operating system, and device
+// type (one of `Desktop`, `Mobile`, `Tablet`, or `Bot`).
+//
+// User-Agent strings that we can't make sense of get `Other` for each field
+// (and an empty BrowserVersion); reports with no User-Agent at all aren't
+// annotated.  Parse results are kept in a bounded cache, since most reports
+// come from a fairly small number of distinct User-Agent strings.
+type ParseUserAgent struct {
+	// The annotations to add; each must be one of UserAgentFields.
+	Fields []string
+
+	cache *ttlCache
+}
+
+// NewParseUserAgent creates a new ParseUserAgent processor that adds all of
+// the UserAgentFields annotations, and caches up to cacheSize parse results.
+func NewParseUserAgent(cacheSize int) *ParseUserAgent {
+	return &ParseUserAgent{
+		Fields: UserAgentFields,
+		cache:  newTTLCache(cacheSize, 0),
+	}
+}
+
+func parseUserAgent(raw string) userAgentInfo {
+	ua := useragent.New(raw)
+	info := userAgentInfo{
+		"BrowserFamily": "Other",
+		"OS":            "Other",
+		"DeviceType":    "Other",
+	}
+
+	// The parser treats anything at all as a browser name, so we only believe
+	// it if there's a version number too.
+	if family, version := ua.Browser(); family != "" && version != "" {
+		info["BrowserFamily"] = family
+		info["BrowserVersion"] = version
+	}
+
+	platform := ua.Platform()
+	switch {
+	case platform == "iPhone" || platform == "iPad" || platform == "iPod":
+		info["OS"] = "iOS"
+	case ua.OSInfo().Name != "":
+		info["OS"] = ua.OSInfo().Name
+	}
+
+	switch {
+	case ua.Bot():
+		info["DeviceType"] = "Bot"
+	case platform == "iPad":
+		info["DeviceType"] = "Tablet"
+	case info["OS"] == "Android" && !strings.Contains(raw, "Mobile"):
+		// Android tablets leave the Mobile token out of their User-Agent.
+		info["DeviceType"] = "Tablet"
+	case ua.Mobile():
+		info["DeviceType"] = "Mobile"
+	case info["OS"] != "Other":
+		info["DeviceType"] = "Desktop"
+	}
+	return info
+}
+
+func (p *ParseUserAgent) parse(raw string) userAgentInfo {
+	if cached, ok := p.cache.get(raw, time.Time{}); ok {
+		return cached.(userAgentInfo)
+	}
+	info := parseUserAgent(raw)
+	p.cache.add(raw, info, time.Time{})
+	return info
+}
+
+// ProcessReports annotates each report with information about the browser
+// that sent it.
+func (p *ParseUserAgent) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		raw := clientUserAgent(batch, report)
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		info := p.parse(raw)
+		for _, field := range p.Fields {
+			report.SetAnnotation(field, info[field])
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ParseUserAgent",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Fields    []string `toml:"fields"`
+				CacheSize int      `toml:"cache_size"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.CacheSize < 0 {
+				return nil, fmt.Errorf("ParseUserAgent `cache_size` must not be negative")
+			}
+			if config.CacheSize == 0 {
+				config.CacheSize = 10000
+			}
+
+			p := NewParseUserAgent(config.CacheSize)
+			if config.Fields != nil {
+				for _, field := range config.Fields {
+					if !isUserAgentField(field) {
+						return nil, fmt.Errorf("ParseUserAgent invalid `fields`: unknown field %s", field)
+					}
+				}
+				p.Fields = config.Fields
+			}
+			return p, nil
+		})
+}
+
+func isUserAgentField(field string) bool {
+	for _, known := range UserAgentFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	cases := []struct {
+		ua   string
+		want map[string]interface{}
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			map[string]interface{}{"BrowserFamily": "Chrome", "BrowserVersion": "120.0.0.0", "OS": "Windows", "DeviceType": "Desktop"}},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			map[string]interface{}{"BrowserFamily": "Firefox", "BrowserVersion": "121.0", "OS": "Linux", "DeviceType": "Desktop"}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			map[string]interface{}{"BrowserFamily": "Safari", "BrowserVersion": "17.1", "OS": "iOS", "DeviceType": "Mobile"}},
+		{"Mozilla/5.0 (iPad; CPU OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			map[string]interface{}{"BrowserFamily": "Safari", "BrowserVersion": "17.1", "OS": "iOS", "DeviceType": "Tablet"}},
+		{"Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			map[string]interface{}{"BrowserFamily": "Chrome", "BrowserVersion": "120.0.0.0", "OS": "Android", "DeviceType": "Mobile"}},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			map[string]interface{}{"BrowserFamily": "Chrome", "BrowserVersion": "120.0.0.0", "OS": "Android", "DeviceType": "Tablet"}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			map[string]interface{}{"BrowserFamily": "Googlebot", "BrowserVersion": "2.1", "OS": "Other", "DeviceType": "Bot"}},
+		{"!!garbage((",
+			map[string]interface{}{"BrowserFamily": "Other", "BrowserVersion": "", "OS": "Other", "DeviceType": "Other"}},
+		{"", nil},
+		{"   ", nil},
+	}
+	p := core.NewParseUserAgent(10)
+	for _, c := range cases {
+		// Parse each string twice, to check that cached results are the same.
+		for round := 0; round < 2; round++ {
+			batch := &collector.ReportBatch{
+				ClientUserAgent: c.ua,
+				Reports:         []collector.NelReport{{}},
+			}
+			p.ProcessReports(context.Background(), batch)
+			if diff := cmp.Diff(c.want, batch.Reports[0].Annotations.Annotations); diff != "" {
+				t.Errorf("ParseUserAgent(%q) round %d got diff (-want +got):\n%s", c.ua, round, diff)
+			}
+		}
+	}
+}
+
+func TestParseUserAgentConfig(t *testing.T) {
+	// Without an upload header, we fall back on the report's own user_agent.
+	batch := pipelinetest.RunTestConfig(`
+		[[processor]]
+		type = "ParseUserAgent"
+		fields = ["BrowserFamily", "DeviceType"]
+	`, &collector.ReportBatch{
+		Reports: []collector.NelReport{{UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"}},
+	})
+	want := map[string]interface{}{"BrowserFamily": "Firefox", "DeviceType": "Desktop"}
+	if diff := cmp.Diff(want, batch.Reports[0].Annotations.Annotations); diff != "" {
+		t.Errorf("ParseUserAgent got diff (-want +got):\n%s", diff)
+	}
+
+	var bad collector.Pipeline
+	err := bad.LoadFromConfig(context.Background(), []byte(`processor = [{type = "ParseUserAgent", fields = ["Browser"]}]`))
+	if want := "Couldn't create a ParseUserAgent for processor 0: ParseUserAgent invalid `fields`: unknown field Browser"; err == nil || err.Error() != want {
+		t.Errorf("LoadFromConfig got error %v, wanted %q", err, want)
+	}
+}
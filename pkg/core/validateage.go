@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// ValidateAge is a pipeline processor that looks for reports with implausible
+// ages, usually from clients with broken clocks.  A report's event time (see
+// NelReport.EventTime) is invalid if it's in the future, or more than MaxAge in
+// the past.  Invalid reports get an annotation (InvalidAge by default) saying
+// why: either `future` or `too_old`.
+//
+// In "drop" mode we throw invalid reports away.  In "clamp" mode we keep them,
+// but change their age so that their event time is the current time (for
+// reports from the future) or exactly MaxAge ago (for reports that are too
+// old).  In "annotate" mode we keep them unchanged.
+type ValidateAge struct {
+	MaxAge     time.Duration
+	Mode       string
+	Annotation string
+
+	// Clock is used to decide which event times are in the future.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+}
+
+func (v *ValidateAge) now() time.Time {
+	if v.Clock == nil {
+		return time.Now()
+	}
+	return v.Clock.Now()
+}
+
+// ProcessReports drops, clamps, or annotates each report with an invalid age.
+func (v *ValidateAge) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := v.now()
+	oldest := now.Add(-v.MaxAge)
+	var filtered []collector.NelReport
+	for _, report := range batch.Reports {
+		eventTime := report.EventTime(batch.Time)
+		var reason string
+		var clampTo time.Time
+		if eventTime.After(now) {
+			reason, clampTo = "future", now
+		} else if eventTime.Before(oldest) {
+			reason, clampTo = "too_old", oldest
+		}
+		if reason == "" {
+			filtered = append(filtered, report)
+			continue
+		}
+
+		switch v.Mode {
+		case "drop":
+			continue
+		case "clamp":
+			age := batch.Time.Sub(clampTo) / time.Millisecond
+			if age < 0 {
+				age = 0
+			}
+			report.Age = int(age)
+		}
+		report.SetAnnotation(v.Annotation, reason)
+		filtered = append(filtered, report)
+	}
+	batch.Reports = filtered
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ValidateAge",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				MaxAge     string `toml:"max_age"`
+				Mode       string `toml:"mode"`
+				Annotation string `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			v := &ValidateAge{
+				MaxAge:     30 * 24 * time.Hour,
+				Mode:       config.Mode,
+				Annotation: config.Annotation,
+				Clock:      clock,
+			}
+			if config.MaxAge != "" {
+				v.MaxAge, err = time.ParseDuration(config.MaxAge)
+				if err != nil {
+					return nil, fmt.Errorf("ValidateAge invalid `max_age`: %v", err)
+				}
+				if v.MaxAge <= 0 {
+					return nil, fmt.Errorf("ValidateAge `max_age` must be positive")
+				}
+			}
+			switch v.Mode {
+			case "":
+				v.Mode = "drop"
+			case "drop", "clamp", "annotate":
+			default:
+				return nil, fmt.Errorf("ValidateAge invalid `mode`: %s", config.Mode)
+			}
+			if v.Annotation == "" {
+				v.Annotation = "InvalidAge"
+			}
+			return v, nil
+		})
+}
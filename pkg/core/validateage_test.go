@@ -0,0 +1,62 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestValidateAge(t *testing.T) {
+	day := int(24 * time.Hour / time.Millisecond)
+	cases := []struct {
+		mode string
+		want []string
+	}{
+		{"drop", []string{"1000 <nil>", "0 <nil>"}},
+		{"annotate", []string{"1000 <nil>", "-5000 future", "0 <nil>", "2678400000 too_old"}},
+		{"clamp", []string{"1000 <nil>", "0 future", "0 <nil>", fmt.Sprintf("%d too_old", 2*day)}},
+	}
+	for _, c := range cases {
+		// The simulated clock, and the time that the batch was received, are
+		// both the Unix epoch.
+		batch := pipelinetest.RunTestConfig(fmt.Sprintf(`
+			[[processor]]
+			type = "ValidateAge"
+			max_age = "48h"
+			mode = "%s"
+		`, c.mode), &collector.ReportBatch{
+			Time: time.Unix(0, 0).UTC(),
+			Reports: []collector.NelReport{
+				{Age: 1000},
+				{Age: -5000},
+				{Age: 0},
+				{Age: 31 * day},
+			},
+		})
+		var got []string
+		for _, report := range batch.Reports {
+			got = append(got, fmt.Sprintf("%d %v", report.Age, report.GetAnnotation("InvalidAge")))
+		}
+		if diff := cmp.Diff(c.want, got); diff != "" {
+			t.Errorf("ValidateAge(mode=%s) got diff (-want +got):\n%s", c.mode, diff)
+		}
+	}
+}
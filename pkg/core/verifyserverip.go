@@ -0,0 +1,234 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// The values of VerifyServerIP's annotation.
+const (
+	ServerIPMatch    = "match"
+	ServerIPMismatch = "mismatch"
+	ServerIPUnknown  = "unknown"
+)
+
+// VerifyServerIP is a pipeline processor that checks whether each report's
+// server_ip is one of the addresses (A or AAAA records) that the host in its
+// URL currently resolves to, and stores the result in an annotation
+// (ServerIPVerified by default): "match", "mismatch", or "unknown" if we
+// couldn't resolve the host.  A mismatch can be a sign that the client was
+// misrouted, or that its DNS was hijacked, though it can also just mean that
+// the host's records changed between the request and the report.
+//
+// As with ReverseDNS, results are kept in a bounded cache and each lookup has
+// a timeout.  Hosts that don't exist are cached (as "unknown"), but other
+// failures aren't.  Reports without a server_ip, or whose URL doesn't have a
+// host, aren't annotated at all; if the host is an IP address, it's compared
+// with server_ip directly.
+type VerifyServerIP struct {
+	// The name of the annotation to store the result in.
+	Annotation string
+
+	// How long we wait for each lookup before giving up.
+	Timeout time.Duration
+
+	// LookupIPAddr resolves a host.  NewVerifyServerIP sets it to use
+	// net.DefaultResolver.
+	LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	// Clock is used to expire cached results.  If nil, we use the current time.
+	Clock collector.Clock
+
+	cache *ttlCache
+}
+
+// NewVerifyServerIP creates a new VerifyServerIP processor that caches up to
+// cacheSize results for ttl each.
+func NewVerifyServerIP(cacheSize int, ttl, timeout time.Duration) *VerifyServerIP {
+	return &VerifyServerIP{
+		Annotation:   "ServerIPVerified",
+		Timeout:      timeout,
+		LookupIPAddr: net.DefaultResolver.LookupIPAddr,
+		cache:        newTTLCache(cacheSize, ttl),
+	}
+}
+
+func (v *VerifyServerIP) now() time.Time {
+	if v.Clock == nil {
+		return time.Now()
+	}
+	return v.Clock.Now()
+}
+
+// serverIPSet is the set of addresses that a host resolves to, in canonical
+// form; a nil set means that we couldn't resolve the host.
+type serverIPSet map[string]bool
+
+// check returns whether addr is in the set.
+func (s serverIPSet) check(addr string) string {
+	if s == nil {
+		return ServerIPUnknown
+	}
+	ip := net.ParseIP(addr)
+	if ip != nil && s[ip.String()] {
+		return ServerIPMatch
+	}
+	return ServerIPMismatch
+}
+
+// lookup returns the addresses that host resolves to, and whether the result
+// should be cached.
+func (v *VerifyServerIP) lookup(ctx context.Context, host string) (serverIPSet, bool) {
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+	addrs, err := v.LookupIPAddr(ctx, host)
+	if err != nil {
+		dnsErr, ok := err.(*net.DNSError)
+		return nil, ok && dnsErr.IsNotFound
+	}
+	set := make(serverIPSet)
+	for _, addr := range addrs {
+		set[addr.IP.String()] = true
+	}
+	return set, true
+}
+
+// reportHost returns the host in a report's URL, or "" if it doesn't have one.
+func reportHost(report *collector.NelReport) string {
+	u, err := url.Parse(report.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// ProcessReports annotates each report with whether its server_ip matches its
+// host.  Any hosts that aren't already cached are looked up in parallel.
+func (v *VerifyServerIP) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := v.now()
+	hosts := make([]string, len(batch.Reports))
+	resolved := make(map[string]serverIPSet)
+	var missing []string
+	for i := range batch.Reports {
+		if batch.Reports[i].ServerIP == "" {
+			continue
+		}
+		host := reportHost(&batch.Reports[i])
+		hosts[i] = host
+		if host == "" {
+			continue
+		}
+		if _, seen := resolved[host]; seen {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			resolved[host] = serverIPSet{ip.String(): true}
+		} else if set, ok := v.cache.get(host, now); ok {
+			resolved[host] = set.(serverIPSet)
+		} else {
+			resolved[host] = nil
+			missing = append(missing, host)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, host := range missing {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			set, cacheable := v.lookup(ctx, host)
+			if cacheable {
+				v.cache.add(host, set, now)
+			}
+			mu.Lock()
+			resolved[host] = set
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+
+	for i := range batch.Reports {
+		if hosts[i] != "" {
+			batch.Reports[i].SetAnnotation(v.Annotation, resolved[hosts[i]].check(batch.Reports[i].ServerIP))
+		}
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"VerifyServerIP",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Annotation string `toml:"annotation"`
+				CacheSize  int    `toml:"cache_size"`
+				TTL        string `toml:"ttl"`
+				Timeout    string `toml:"timeout"`
+				Resolver   string `toml:"resolver"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.CacheSize < 0 {
+				return nil, fmt.Errorf("VerifyServerIP `cache_size` must not be negative")
+			}
+			if config.CacheSize == 0 {
+				config.CacheSize = 10000
+			}
+
+			ttl := time.Minute
+			if config.TTL != "" {
+				ttl, err = time.ParseDuration(config.TTL)
+				if err != nil {
+					return nil, fmt.Errorf("VerifyServerIP invalid `ttl`: %v", err)
+				}
+			}
+			timeout := 500 * time.Millisecond
+			if config.Timeout != "" {
+				timeout, err = time.ParseDuration(config.Timeout)
+				if err != nil {
+					return nil, fmt.Errorf("VerifyServerIP invalid `timeout`: %v", err)
+				}
+			}
+
+			v := NewVerifyServerIP(config.CacheSize, ttl, timeout)
+			v.Clock = clock
+			if config.Annotation != "" {
+				v.Annotation = config.Annotation
+			}
+			if config.Resolver != "" {
+				address := config.Resolver
+				if _, _, err := net.SplitHostPort(address); err != nil {
+					address = net.JoinHostPort(address, "53")
+				}
+				v.LookupIPAddr = newResolver(address).LookupIPAddr
+			}
+			return v, nil
+		})
+}
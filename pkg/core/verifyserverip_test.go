@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+type fakeHostResolver struct {
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (f *fakeHostResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	f.mu.Lock()
+	f.lookups[host]++
+	f.mu.Unlock()
+	switch host {
+	case "example.com":
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.75")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+	case "missing.example.com":
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return nil, errors.New("i/o timeout")
+	}
+}
+
+func TestVerifyServerIP(t *testing.T) {
+	resolver := &fakeHostResolver{lookups: make(map[string]int)}
+	clock := pipelinetest.NewSimulatedClock()
+	v := core.NewVerifyServerIP(10, time.Minute, time.Second)
+	v.LookupIPAddr = resolver.LookupIPAddr
+	v.Clock = clock
+
+	newBatch := func() *collector.ReportBatch {
+		return &collector.ReportBatch{
+			Reports: []collector.NelReport{
+				{URL: "https://example.com/", ServerIP: "203.0.113.75"},
+				{URL: "https://example.com:8443/x", ServerIP: "2001:db8:0::1"},
+				{URL: "https://example.com/", ServerIP: "198.51.100.1"},
+				{URL: "https://missing.example.com/", ServerIP: "203.0.113.75"},
+				{URL: "https://slow.example.com/", ServerIP: "203.0.113.75"},
+				{URL: "https://[2001:db8::2]/", ServerIP: "2001:db8::2"},
+				{URL: "https://example.com/"},
+			},
+		}
+	}
+
+	want := []interface{}{
+		core.ServerIPMatch,
+		core.ServerIPMatch,
+		core.ServerIPMismatch,
+		core.ServerIPUnknown,
+		core.ServerIPUnknown,
+		core.ServerIPMatch,
+		nil,
+	}
+	for round := 0; round < 2; round++ {
+		batch := newBatch()
+		v.ProcessReports(context.Background(), batch)
+		for i := range want {
+			if got := batch.Reports[i].GetAnnotation("ServerIPVerified"); got != want[i] {
+				t.Errorf("round %d: report %d ServerIPVerified = %v, wanted %v", round, i, got, want[i])
+			}
+		}
+	}
+
+	// Successful lookups and missing hosts are cached; other errors aren't.
+	wantLookups := map[string]int{"example.com": 1, "missing.example.com": 1, "slow.example.com": 2}
+	for host, count := range wantLookups {
+		if got := resolver.lookups[host]; got != count {
+			t.Errorf("LookupIPAddr(%s) called %d times, wanted %d", host, got, count)
+		}
+	}
+
+	// Once the TTL passes, we should resolve the host again.
+	clock.CurrentTime = clock.CurrentTime.Add(2 * time.Minute)
+	v.ProcessReports(context.Background(), newBatch())
+	if got := resolver.lookups["example.com"]; got != 2 {
+		t.Errorf("LookupIPAddr(example.com) called %d times after TTL, wanted 2", got)
+	}
+}
+
+func TestVerifyServerIPBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "VerifyServerIP", cache_size = -1}]`,
+		`processor = [{type = "VerifyServerIP", ttl = "soon"}]`,
+		`processor = [{type = "VerifyServerIP", timeout = "soon"}]`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// Where is a pipeline processor that runs a chain of child processors against
+// only those reports that match a condition, such as
+//
+//	type == 'tcp.timed_out' and status_code >= 500
+//
+// (See NewWhere for the syntax of conditions.)  Like the branches of a Tee, the
+// children receive their own copy of the batch, containing just the matching
+// reports; the original batch is never modified.  If no reports match, the
+// children aren't run at all.
+type Where struct {
+	Children []collector.ReportProcessor
+
+	condition condition
+}
+
+// NewWhere creates a new Where processor that runs children against the
+// reports that match a condition.  A condition is a boolean expression over
+// the fields and annotations of a report.  Fields use the names from the JSON
+// representation of a report (status_code, phase, type, and so on), and can
+// optionally be written with a `report.` prefix; annotations are written as
+// `annotations.Name`, and fall back on the batch's annotation if the report
+// doesn't have one.  Conditions can compare values with ==, !=, <, <=, >, and
+// >=, and combine them with and, or, not (or &&, ||, !) and parentheses.
+// Values are numbers, strings in single or double quotes, true, false, and
+// null.  Comparing values of different types is always false (except with !=).
+func NewWhere(condition string, children []collector.ReportProcessor) (*Where, error) {
+	c, err := parseCondition(condition)
+	if err != nil {
+		return nil, err
+	}
+	return &Where{Children: children, condition: c}, nil
+}
+
+// Matches returns whether a report in a batch matches the condition.
+func (w *Where) Matches(batch *collector.ReportBatch, report *collector.NelReport) bool {
+	return truthy(w.condition.eval(batch, report))
+}
+
+// ProcessReports runs the children against a copy of the batch that only
+// contains the matching reports.
+func (w *Where) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	matches := make([]bool, len(batch.Reports))
+	anyMatch := false
+	for i := range batch.Reports {
+		matches[i] = w.Matches(batch, &batch.Reports[i])
+		anyMatch = anyMatch || matches[i]
+	}
+	if !anyMatch {
+		return
+	}
+
+	clone := batch.Clone()
+	filtered := clone.Reports[:0]
+	for i, report := range clone.Reports {
+		if matches[i] {
+			filtered = append(filtered, report)
+		}
+	}
+	clone.Reports = filtered
+	runChain(ctx, w.Children, clone)
+}
+
+// Close closes any child processors that need to be closed.
+func (w *Where) Close() error {
+	return collector.CloseProcessors(w.Children)
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"Where",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Condition string `toml:"condition"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Condition == "" {
+				return nil, fmt.Errorf("Where missing `condition`")
+			}
+			// Check the condition before loading the children, so that we don't
+			// have to close them if it's invalid.
+			if _, err := parseCondition(config.Condition); err != nil {
+				return nil, fmt.Errorf("Where invalid `condition`: %v", err)
+			}
+
+			children, err := collector.LoadChildProcessors(ctx, configPrimitive)
+			if err != nil {
+				return nil, fmt.Errorf("Where children: %v", err)
+			}
+			if len(children) == 0 {
+				return nil, fmt.Errorf("Where missing `children`")
+			}
+			w, err := NewWhere(config.Condition, children)
+			if err != nil {
+				collector.CloseProcessors(children)
+				return nil, err
+			}
+			return w, nil
+		})
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestWhereConditions(t *testing.T) {
+	batch := &collector.ReportBatch{}
+	batch.SetAnnotation("Region", "eu")
+	report := &collector.NelReport{
+		ReportType: "network-error",
+		URL:        "https://example.com/",
+		StatusCode: 503,
+		Phase:      "application",
+		Type:       "http.error",
+	}
+	report.SetAnnotation("SamplingWeight", 2.0)
+	report.SetAnnotation("PrivateServerIP", false)
+
+	cases := []struct {
+		condition string
+		want      bool
+	}{
+		{`type == 'http.error'`, true},
+		{`report.type == "http.error"`, true},
+		{`type == 'tcp.timed_out' and status_code >= 500`, false},
+		{`type == 'tcp.timed_out' or status_code >= 500`, true},
+		{`status_code >= 500 && status_code < 600`, true},
+		{`!(phase == 'dns') && phase != "connection"`, true},
+		{`not status_code == 503`, false},
+		{`annotations.SamplingWeight > 1.5`, true},
+		{`annotations.PrivateServerIP`, false},
+		{`annotations.Region == 'eu'`, true},
+		{`annotations.Missing == null`, true},
+		{`annotations.Missing`, false},
+		{`status_code == '503'`, false},
+		{`status_code < 'abc'`, false},
+		{`url > 'https://a' and url < 'https://z'`, true},
+		{`server_ip`, false},
+		{`elapsed_time == 0 and age >= -1`, true},
+		{`true and (false or true)`, true},
+		{`'it\'s' == "it's"`, true},
+	}
+	for _, c := range cases {
+		w, err := core.NewWhere(c.condition, nil)
+		if err != nil {
+			t.Errorf("NewWhere(%s): %v", c.condition, err)
+			continue
+		}
+		if got := w.Matches(batch, report); got != c.want {
+			t.Errorf("Matches(%s) = %v, wanted %v", c.condition, got, c.want)
+		}
+	}
+}
+
+func TestWhereBadConditions(t *testing.T) {
+	cases := []struct {
+		condition, want string
+	}{
+		{``, "empty condition"},
+		{`status == 500`, "unknown field status at position 0"},
+		{`type == 'tcp.timed_out`, "unterminated string at position 8"},
+		{`status_code >= 500 and`, "unexpected end of condition"},
+		{`(type == 'ok'`, "unexpected end of condition"},
+		{`type = 'ok'`, "unexpected = at position 5"},
+		{`type == 'ok' phase`, "unexpected phase at position 13"},
+		{`annotations. == 1`, "missing annotation name at position 0"},
+	}
+	for _, c := range cases {
+		_, err := core.NewWhere(c.condition, nil)
+		if err == nil || err.Error() != c.want {
+			t.Errorf("NewWhere(%s) got error %v, wanted %q", c.condition, err, c.want)
+		}
+	}
+}
+
+func TestWhere(t *testing.T) {
+	var seen *collector.ReportBatch
+	w, err := core.NewWhere(`method == 'POST'`, []collector.ReportProcessor{
+		processorFunc(func(ctx context.Context, batch *collector.ReportBatch) {
+			batch.Reports[0].SetAnnotation("Seen", true)
+			seen = batch
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			{Method: "GET"},
+			{Method: "POST", URL: "https://example.com/login/"},
+		},
+	}
+	w.ProcessReports(context.Background(), batch)
+	if seen == nil || len(seen.Reports) != 1 || seen.Reports[0].URL != "https://example.com/login/" {
+		t.Errorf("Where children saw %v, wanted only the POST report", seen)
+	}
+	if len(batch.Reports) != 2 || batch.Reports[1].GetAnnotation("Seen") != nil {
+		t.Errorf("Where modified the original batch")
+	}
+
+	// If nothing matches, the children aren't run.
+	seen = nil
+	w.ProcessReports(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{{Method: "GET"}}})
+	if seen != nil {
+		t.Errorf("Where ran its children without any matching reports")
+	}
+}
+
+func TestWhereBadConfig(t *testing.T) {
+	cases := []struct {
+		config, want string
+	}{
+		{`processor = [{type = "Where", children = [{type = "KeepNelReports"}]}]`,
+			"Couldn't create a Where for processor 0: Where missing `condition`"},
+		{`processor = [{type = "Where", condition = "type == 'ok'"}]`,
+			"Couldn't create a Where for processor 0: Where missing `children`"},
+		{`processor = [{type = "Where", condition = "type === 'ok'", children = [{type = "KeepNelReports"}]}]`,
+			"Couldn't create a Where for processor 0: Where invalid `condition`: unexpected = at position 7"},
+		{`processor = [{type = "Where", condition = "type == 'ok'", children = [{type = "UnknownType"}]}]`,
+			"Couldn't create a Where for processor 0: Where children: Unknown processor type UnknownType for processor 0"},
+	}
+	for _, c := range cases {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		err := pipeline.LoadFromConfig(context.Background(), []byte(c.config))
+		if err == nil || err.Error() != c.want {
+			t.Errorf("LoadFromConfig(%s) got error %v, wanted %q", c.config, err, c.want)
+		}
+		pipeline.Close()
+	}
+}
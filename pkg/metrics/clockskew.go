@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultClockSkewBuckets are the histogram buckets (in seconds) that
+// ClockSkew uses if you don't provide any.  The negative buckets catch reports
+// whose event times are in the future.
+var DefaultClockSkewBuckets = []float64{-3600, -60, -1, 0, 1, 10, 60, 300, 900, 3600, 86400}
+
+// ClockSkew is a pipeline processor that measures how far each report's event
+// time (see collector.NelReport.EventTime) is behind the current time, which
+// is how long the client held on to the report before we processed it.  Large
+// values point to clients that buffer reports for a long time, or whose clocks
+// are slow; negative ones to clients whose clocks are fast.  Either way, this
+// is a good way to choose ValidateAge's MaxAge.
+//
+// Each report is annotated with the difference in seconds, in the ClockSkew
+// annotation by default.  If the processor was created with a histogram, the
+// differences are also recorded there:
+//
+//	nel_clock_skew_seconds
+type ClockSkew struct {
+	Annotation string
+
+	// Clock gives the current time.  If nil, we use the current time.
+	Clock collector.Clock
+
+	skew prometheus.Histogram
+}
+
+// NewClockSkew creates a new ClockSkew processor.  If registerer is non-nil,
+// we also record the differences in a histogram with the given name and
+// buckets, which is registered with registerer.
+func NewClockSkew(registerer prometheus.Registerer, name string, buckets []float64) (*ClockSkew, error) {
+	c := &ClockSkew{Annotation: "ClockSkew"}
+	if registerer == nil {
+		return c, nil
+	}
+	skew, err := register(registerer, prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    name,
+			Help:    "How far the event times of reports are behind the time that they're processed.",
+			Buckets: buckets,
+		}))
+	if err != nil {
+		return nil, err
+	}
+	c.skew = skew.(prometheus.Histogram)
+	return c, nil
+}
+
+func (c *ClockSkew) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
+}
+
+// ProcessReports annotates each report in the batch with how far its event
+// time is behind the current time.
+func (c *ClockSkew) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	now := c.now()
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		seconds := now.Sub(report.EventTime(batch.Time)).Seconds()
+		report.SetAnnotation(c.Annotation, seconds)
+		if c.skew != nil {
+			c.skew.Observe(seconds)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ClockSkew",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Metrics    *bool     `toml:"metrics"`
+				Name       string    `toml:"name"`
+				Buckets    []float64 `toml:"buckets"`
+				Annotation string    `toml:"annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Name == "" {
+				config.Name = "nel_clock_skew_seconds"
+			}
+			if config.Buckets == nil {
+				config.Buckets = DefaultClockSkewBuckets
+			}
+			if len(config.Buckets) == 0 {
+				return nil, fmt.Errorf("ClockSkew `buckets` must not be empty")
+			}
+			if !sort.Float64sAreSorted(config.Buckets) {
+				return nil, fmt.Errorf("ClockSkew `buckets` must be in increasing order")
+			}
+
+			registerer := prometheus.DefaultRegisterer
+			if config.Metrics != nil && !*config.Metrics {
+				registerer = nil
+			}
+			c, err := NewClockSkew(registerer, config.Name, config.Buckets)
+			if err != nil {
+				return nil, err
+			}
+			if config.Annotation != "" {
+				c.Annotation = config.Annotation
+			}
+			c.Clock = clock
+			return c, nil
+		})
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestClockSkew(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c, err := metrics.NewClockSkew(registry, "test_clock_skew_seconds", []float64{0, 10, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := pipelinetest.NewSimulatedClock()
+	c.Clock = clock
+	received := clock.Now()
+	clock.CurrentTime = received.Add(2 * time.Second)
+
+	batch := &collector.ReportBatch{
+		Time: received,
+		Reports: []collector.NelReport{
+			{Age: 0},
+			{Age: 30000},
+			{Age: 500000},
+			// A report from a client whose clock is fast, which claims to
+			// be from the future.
+			{Age: -5000},
+		},
+	}
+	c.ProcessReports(context.Background(), batch)
+
+	var got []interface{}
+	for _, report := range batch.Reports {
+		got = append(got, report.GetAnnotation("ClockSkew"))
+	}
+	if diff := cmp.Diff([]interface{}{2.0, 32.0, 502.0, -3.0}, got); diff != "" {
+		t.Errorf("ClockSkew annotations diff (-want +got):\n%s", diff)
+	}
+
+	histogram := findMetric(t, registry, "test_clock_skew_seconds", nil).GetHistogram()
+	var buckets []uint64
+	for _, bucket := range histogram.GetBucket() {
+		buckets = append(buckets, bucket.GetCumulativeCount())
+	}
+	if diff := cmp.Diff([]uint64{1, 2, 3}, buckets); diff != "" {
+		t.Errorf("ClockSkew bucket counts diff (-want +got):\n%s", diff)
+	}
+	if got, want := histogram.GetSampleCount(), uint64(4); got != want {
+		t.Errorf("ClockSkew sample count = %v, wanted %v", got, want)
+	}
+}
+
+func TestClockSkewWithoutMetrics(t *testing.T) {
+	config := `
+[[processor]]
+type = "ClockSkew"
+metrics = false
+annotation = "Skew"
+`
+	clock := pipelinetest.NewSimulatedClock()
+	pipeline := collector.NewTestPipeline(clock)
+	defer pipeline.Close()
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	batch := &collector.ReportBatch{Time: clock.Now(), Reports: []collector.NelReport{{Age: 1500}}}
+	pipeline.ProcessBatch(context.Background(), batch)
+	if got, want := batch.Reports[0].GetAnnotation("Skew"), 1.5; got != want {
+		t.Errorf("ClockSkew annotation = %v, wanted %v", got, want)
+	}
+}
+
+func TestClockSkewBadConfig(t *testing.T) {
+	for _, config := range []string{
+		"metrics = false\nbuckets = []",
+		"metrics = false\nbuckets = [10.0, 1.0]",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"ClockSkew\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultElapsedTimeBuckets are the histogram buckets (in seconds) that
+// ElapsedTimeHistogram uses if you don't provide any.
+var DefaultElapsedTimeBuckets = prometheus.ExponentialBuckets(0.01, 2, 13)
+
+// ElapsedTimeHistogram is a pipeline processor that records the elapsed_time
+// of each NEL report in a Prometheus histogram, labeled by the phase and type
+// of the failure:
+//
+//	nel_elapsed_time_seconds{phase, type}
+//
+// This shows how long failing requests took before they failed, which can
+// tell a slow timeout apart from an immediate connection reset.  The labels
+// are normalized so that a misbehaving client can't create arbitrary label
+// values; see normalizePhase and normalizeType.  Reports that aren't NEL
+// reports, or that don't have an elapsed_time, aren't recorded.  (We can't
+// tell a missing elapsed_time apart from one of zero, so those aren't
+// recorded either.)
+type ElapsedTimeHistogram struct {
+	elapsed *prometheus.HistogramVec
+}
+
+// NewElapsedTimeHistogram creates a new ElapsedTimeHistogram processor whose
+// histogram has the given name and buckets, and is registered with registerer.
+func NewElapsedTimeHistogram(registerer prometheus.Registerer, name string, buckets []float64) (*ElapsedTimeHistogram, error) {
+	elapsed, err := register(registerer, prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    name,
+			Help:    "Elapsed time of the requests described by NEL reports, by phase and type.",
+			Buckets: buckets,
+		},
+		[]string{"phase", "type"}))
+	if err != nil {
+		return nil, err
+	}
+	return &ElapsedTimeHistogram{elapsed.(*prometheus.HistogramVec)}, nil
+}
+
+// ProcessReports records the elapsed time of each NEL report in the batch.
+func (h *ElapsedTimeHistogram) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for _, report := range batch.Reports {
+		if report.ReportType != "network-error" || report.ElapsedTime <= 0 {
+			continue
+		}
+		seconds := (time.Duration(report.ElapsedTime) * time.Millisecond).Seconds()
+		h.elapsed.WithLabelValues(normalizePhase(report.Phase), normalizeType(report.Type)).Observe(seconds)
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ElapsedTimeHistogram",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Name    string    `toml:"name"`
+				Buckets []float64 `toml:"buckets"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Name == "" {
+				config.Name = "nel_elapsed_time_seconds"
+			}
+			if config.Buckets == nil {
+				config.Buckets = DefaultElapsedTimeBuckets
+			}
+			if len(config.Buckets) == 0 {
+				return nil, fmt.Errorf("ElapsedTimeHistogram `buckets` must not be empty")
+			}
+			if !sort.Float64sAreSorted(config.Buckets) {
+				return nil, fmt.Errorf("ElapsedTimeHistogram `buckets` must be in increasing order")
+			}
+
+			return NewElapsedTimeHistogram(prometheus.DefaultRegisterer, config.Name, config.Buckets)
+		})
+}
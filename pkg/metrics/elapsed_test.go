@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestElapsedTimeHistogram(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	h, err := metrics.NewElapsedTimeHistogram(registry, "test_elapsed_time_seconds", []float64{0.1, 1, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ProcessReports(context.Background(), &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", Phase: "connection", Type: "tcp.timed_out", ElapsedTime: 5000},
+			{ReportType: "network-error", Phase: "connection", Type: "tcp.timed_out", ElapsedTime: 20000},
+			{ReportType: "network-error", Phase: "connection", Type: "tcp.reset", ElapsedTime: 50},
+			{ReportType: "network-error", Phase: "dns", Type: "dns.name_not_resolved"},
+			{ReportType: "network-error", Phase: "made-up", Type: "tcp.made_up", ElapsedTime: 10},
+			{ReportType: "csp-violation"},
+		},
+	})
+
+	timedOut := findMetric(t, registry, "test_elapsed_time_seconds", map[string]string{"phase": "connection", "type": "tcp.timed_out"})
+	var got []uint64
+	for _, bucket := range timedOut.GetHistogram().GetBucket() {
+		got = append(got, bucket.GetCumulativeCount())
+	}
+	if diff := cmp.Diff([]uint64{0, 0, 1}, got); diff != "" {
+		t.Errorf("tcp.timed_out bucket counts got diff (-want +got):\n%s", diff)
+	}
+	if got, want := timedOut.GetHistogram().GetSampleCount(), uint64(2); got != want {
+		t.Errorf("tcp.timed_out sample count = %v, wanted %v", got, want)
+	}
+	reset := findMetric(t, registry, "test_elapsed_time_seconds", map[string]string{"phase": "connection", "type": "tcp.reset"})
+	if got, want := reset.GetHistogram().GetSampleSum(), 0.05; got != want {
+		t.Errorf("tcp.reset sample sum = %v, wanted %v", got, want)
+	}
+
+	// Clients can't create their own label values.
+	other := findMetric(t, registry, "test_elapsed_time_seconds", map[string]string{"phase": "other", "type": "other"})
+	if got, want := other.GetHistogram().GetSampleCount(), uint64(1); got != want {
+		t.Errorf("other sample count = %v, wanted %v", got, want)
+	}
+
+	// Reports without an elapsed_time aren't recorded.
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(families[0].GetMetric()), 3; got != want {
+		t.Errorf("got %d label combinations, wanted %d", got, want)
+	}
+}
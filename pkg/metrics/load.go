@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LoadMetrics is a Prometheus collector that exports a pipeline's current load
+// (see collector.Pipeline.LoadFactor), and the NEL policy fractions that we
+// recommend because of it (see collector.Pipeline.RecommendedFractions):
+//
+//	nel_pipeline_load_factor
+//	nel_recommended_success_fraction
+//	nel_recommended_failure_fraction
+//
+// so that whatever generates the monitored origins' NEL policies can ask
+// clients to send fewer reports while the collector is struggling.
+type LoadMetrics struct {
+	pipeline *collector.Pipeline
+	load     *prometheus.Desc
+	success  *prometheus.Desc
+	failure  *prometheus.Desc
+}
+
+// NewLoadMetrics creates a new LoadMetrics for pipeline, which is registered
+// with registerer.
+func NewLoadMetrics(pipeline *collector.Pipeline, registerer prometheus.Registerer) (*LoadMetrics, error) {
+	m := &LoadMetrics{
+		pipeline: pipeline,
+		load: prometheus.NewDesc(
+			"nel_pipeline_load_factor",
+			"How loaded the pipeline is, from 0 (idle) to 1 (unable to take more uploads).",
+			nil, nil),
+		success: prometheus.NewDesc(
+			"nel_recommended_success_fraction",
+			"The NEL success_fraction that we recommend, given the pipeline's load.",
+			nil, nil),
+		failure: prometheus.NewDesc(
+			"nel_recommended_failure_fraction",
+			"The NEL failure_fraction that we recommend, given the pipeline's load.",
+			nil, nil),
+	}
+	c, err := register(registerer, m)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*LoadMetrics), nil
+}
+
+// Describe sends the descriptors of LoadMetrics' metrics to ch.
+func (m *LoadMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.load
+	ch <- m.success
+	ch <- m.failure
+}
+
+// Collect sends the pipeline's current load and recommended fractions to ch.
+func (m *LoadMetrics) Collect(ch chan<- prometheus.Metric) {
+	success, failure := m.pipeline.RecommendedFractions()
+	ch <- prometheus.MustNewConstMetric(m.load, prometheus.GaugeValue, m.pipeline.LoadFactor())
+	ch <- prometheus.MustNewConstMetric(m.success, prometheus.GaugeValue, success)
+	ch <- prometheus.MustNewConstMetric(m.failure, prometheus.GaugeValue, failure)
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoadMetrics(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{SuccessFraction: 0.1, FailureFraction: 0.8})
+	registry := prometheus.NewRegistry()
+	if _, err := metrics.NewLoadMetrics(pipeline, registry); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		idle, closed float64
+	}{
+		{"nel_pipeline_load_factor", 0, 1},
+		{"nel_recommended_success_fraction", 0.1, 0},
+		{"nel_recommended_failure_fraction", 0.8, 0.4},
+	}
+	for _, c := range cases {
+		if got := findMetric(t, registry, c.name, nil).GetGauge().GetValue(); got != c.idle {
+			t.Errorf("%s of an idle pipeline = %v, wanted %v", c.name, got, c.idle)
+		}
+	}
+	// A closed pipeline is fully loaded.
+	pipeline.Close()
+	for _, c := range cases {
+		if got := findMetric(t, registry, c.name, nil).GetGauge().GetValue(); got != c.closed {
+			t.Errorf("%s of a closed pipeline = %v, wanted %v", c.name, got, c.closed)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// normalizePhase converts the phase of a NEL report into one of the phases
+// that the NEL spec defines ("dns", "connection", or "application"),
+// "unknown" (if the report doesn't have a phase), or "other".
+func normalizePhase(phase string) string {
+	phase = strings.ToLower(strings.TrimSpace(phase))
+	switch phase {
+	case "dns", "connection", "application":
+		return phase
+	case "":
+		return "unknown"
+	default:
+		return "other"
+	}
+}
+
+// PhaseMetrics is a pipeline processor that counts NEL reports by the phase
+// and type of the failure in a Prometheus counter:
+//
+//	nel_reports_by_phase_total{phase, type}
+//
+// which shows how failures are distributed between DNS resolution, connection
+// setup, and the application over time.  The phase and type are normalized
+// so that a misbehaving client can't create arbitrary label values; see
+// normalizePhase and normalizeType for the values that they can have.  Reports that aren't NEL reports are
+// ignored.  (ElapsedTimeHistogram shows how long the failures in each phase
+// took.)
+type PhaseMetrics struct {
+	reports *prometheus.CounterVec
+}
+
+// NewPhaseMetrics creates a new PhaseMetrics processor whose counter has the
+// given name, and is registered with registerer.
+func NewPhaseMetrics(registerer prometheus.Registerer, name string) (*PhaseMetrics, error) {
+	reports, err := register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: "Number of NEL reports received, by phase and NEL type.",
+		},
+		[]string{"phase", "type"}))
+	if err != nil {
+		return nil, err
+	}
+	return &PhaseMetrics{reports.(*prometheus.CounterVec)}, nil
+}
+
+// ProcessReports counts each NEL report in the batch.
+func (p *PhaseMetrics) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for _, report := range batch.Reports {
+		if report.ReportType != "network-error" {
+			continue
+		}
+		p.reports.WithLabelValues(normalizePhase(report.Phase), normalizeType(report.Type)).Inc()
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"PhaseMetrics",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Name string `toml:"name"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Name == "" {
+				config.Name = "nel_reports_by_phase_total"
+			}
+			return NewPhaseMetrics(prometheus.DefaultRegisterer, config.Name)
+		})
+}
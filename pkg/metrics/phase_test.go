@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPhaseMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p, err := metrics.NewPhaseMetrics(registry, "test_reports_by_phase_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", Phase: "dns", Type: "dns.name_not_resolved"},
+			{ReportType: "network-error", Phase: "Connection", Type: "tcp.reset"},
+			{ReportType: "network-error", Phase: "application", Type: "ok"},
+			{ReportType: "network-error", Phase: "tls", Type: "tls.failed"},
+			{ReportType: "network-error", Type: "abandoned"},
+			{ReportType: "network-error", Phase: "dns", Type: "dns.made_up"},
+			{ReportType: "csp-violation", Phase: "dns"},
+		},
+	}
+	// The counters are shared by every goroutine running the processor.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.ProcessReports(context.Background(), batch)
+		}()
+	}
+	wg.Wait()
+
+	for _, c := range []struct {
+		phase, typ string
+		want       float64
+	}{
+		{"dns", "dns.name_not_resolved", 4},
+		{"connection", "tcp.reset", 4},
+		{"application", "ok", 4},
+		{"other", "tls.failed", 4},
+		{"unknown", "abandoned", 4},
+		{"dns", "other", 4},
+	} {
+		metric := findMetric(t, registry, "test_reports_by_phase_total", map[string]string{"phase": c.phase, "type": c.typ})
+		if got := metric.GetCounter().GetValue(); got != c.want {
+			t.Errorf("Count for %s %s = %v, wanted %v", c.phase, c.typ, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProcessorMetrics is a Prometheus collector that exports the number of
+// reports that have gone into and come out of each of a pipeline's processors
+// (see collector.Pipeline.ProcessorCounts):
+//
+//	nel_processor_reports_in_total{index, type}
+//	nel_processor_reports_out_total{index, type}
+//	nel_processor_reports_dropped_total{index, type}
+//
+// which makes the effect of each filter and sampler observable without any
+// instrumentation of its own.  The pipeline must have
+// PipelineConfig.RecordProcessorCounts set; otherwise there's nothing to
+// export.
+type ProcessorMetrics struct {
+	pipeline *collector.Pipeline
+	in       *prometheus.Desc
+	out      *prometheus.Desc
+	dropped  *prometheus.Desc
+}
+
+// NewProcessorMetrics creates a new ProcessorMetrics for pipeline, which is
+// registered with registerer.
+func NewProcessorMetrics(pipeline *collector.Pipeline, registerer prometheus.Registerer) (*ProcessorMetrics, error) {
+	labels := []string{"index", "type"}
+	m := &ProcessorMetrics{
+		pipeline: pipeline,
+		in: prometheus.NewDesc(
+			"nel_processor_reports_in_total",
+			"Number of reports in the batches given to each processor.",
+			labels, nil),
+		out: prometheus.NewDesc(
+			"nel_processor_reports_out_total",
+			"Number of reports left in each processor's batches once it returned.",
+			labels, nil),
+		dropped: prometheus.NewDesc(
+			"nel_processor_reports_dropped_total",
+			"Number of reports that each processor removed from its batches.",
+			labels, nil),
+	}
+	c, err := register(registerer, m)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*ProcessorMetrics), nil
+}
+
+// Describe sends the descriptors of ProcessorMetrics' metrics to ch.
+func (m *ProcessorMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.in
+	ch <- m.out
+	ch <- m.dropped
+}
+
+// Collect sends the current counts for each processor to ch.
+func (m *ProcessorMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, counts := range m.pipeline.ProcessorCounts() {
+		index := strconv.Itoa(counts.Index)
+		ch <- prometheus.MustNewConstMetric(m.in, prometheus.CounterValue, float64(counts.In), index, counts.Type)
+		ch <- prometheus.MustNewConstMetric(m.out, prometheus.CounterValue, float64(counts.Out), index, counts.Type)
+		ch <- prometheus.MustNewConstMetric(m.dropped, prometheus.CounterValue, float64(counts.Dropped), index, counts.Type)
+	}
+}
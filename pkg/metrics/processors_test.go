@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// keepFirst is a processor that only keeps the first report in each batch.
+type keepFirst struct{}
+
+func (keepFirst) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if len(batch.Reports) > 1 {
+		batch.Reports = batch.Reports[:1]
+	}
+}
+
+func TestProcessorMetrics(t *testing.T) {
+	pipeline := collector.NewTestPipelineWithConfig(pipelinetest.NewSimulatedClock(), collector.PipelineConfig{RecordProcessorCounts: true})
+	defer pipeline.Close()
+	pipeline.AddProcessor(keepFirst{})
+	registry := prometheus.NewRegistry()
+	if _, err := metrics.NewProcessorMetrics(pipeline, registry); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.ProcessBatch(context.Background(), &collector.ReportBatch{Reports: make([]collector.NelReport, 5)})
+
+	labels := map[string]string{"index": "0", "type": "metrics_test.keepFirst"}
+	for _, c := range []struct {
+		name string
+		want float64
+	}{
+		{"nel_processor_reports_in_total", 5},
+		{"nel_processor_reports_out_total", 1},
+		{"nel_processor_reports_dropped_total", 4},
+	} {
+		if got := findMetric(t, registry, c.name, labels).GetCounter().GetValue(); got != c.want {
+			t.Errorf("%s = %v, wanted %v", c.name, got, c.want)
+		}
+	}
+}
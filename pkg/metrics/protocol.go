@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// protocolAliases maps the protocol strings that browsers send (after
+// lowercasing) to their normalized form.
+var protocolAliases = map[string]string{
+	"http/0.9": "http/0.9",
+	"http/1.0": "http/1.0",
+	"http/1.1": "http/1.1",
+	"h2":       "h2",
+	"h2c":      "h2",
+	"http/2":   "h2",
+	"http/2.0": "h2",
+	"h3":       "h3",
+	"http/3":   "h3",
+	"quic":     "h3",
+}
+
+// normalizeProtocol converts the protocol of a NEL report into one of a small
+// set of values: "http/0.9", "http/1.0", "http/1.1", "h2", "h3", "unknown"
+// (if the report doesn't have a protocol), or "other".  Draft versions of
+// HTTP/3 (such as "h3-29"), and gQUIC (such as "http/2+quic/43"), count as h3.
+func normalizeProtocol(protocol string) string {
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if protocol == "" {
+		return "unknown"
+	}
+	if normalized, ok := protocolAliases[protocol]; ok {
+		return normalized
+	}
+	if strings.HasPrefix(protocol, "h3-") || strings.Contains(protocol, "quic") {
+		return "h3"
+	}
+	return "other"
+}
+
+// ProtocolBreakdown is a pipeline processor that normalizes the protocol of
+// each NEL report, and counts the reports by protocol and type in a
+// Prometheus counter:
+//
+//	nel_reports_by_protocol_total{protocol, type}
+//
+// Comparing the count of each error type to the count of "ok" reports shows
+// the error rate for each protocol, such as h3 versus h2.  (That needs the
+// NEL policy's success_fraction to be nonzero.)  The normalized protocol is
+// also saved in each report's Protocol annotation; see normalizeProtocol for
+// the values that it can have.  Reports that aren't NEL reports are ignored.
+type ProtocolBreakdown struct {
+	reports *prometheus.CounterVec
+}
+
+// NewProtocolBreakdown creates a new ProtocolBreakdown processor whose counter
+// has the given name, and is registered with registerer.
+func NewProtocolBreakdown(registerer prometheus.Registerer, name string) (*ProtocolBreakdown, error) {
+	reports, err := register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: name,
+			Help: "Number of NEL reports received, by protocol and NEL type.",
+		},
+		[]string{"protocol", "type"}))
+	if err != nil {
+		return nil, err
+	}
+	return &ProtocolBreakdown{reports.(*prometheus.CounterVec)}, nil
+}
+
+// ProcessReports annotates and counts each NEL report in the batch.
+func (p *ProtocolBreakdown) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if report.ReportType != "network-error" {
+			continue
+		}
+		protocol := normalizeProtocol(report.Protocol)
+		report.SetAnnotation("Protocol", protocol)
+		p.reports.WithLabelValues(protocol, report.Type).Inc()
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ProtocolBreakdown",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Name string `toml:"name"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Name == "" {
+				config.Name = "nel_reports_by_protocol_total"
+			}
+			return NewProtocolBreakdown(prometheus.DefaultRegisterer, config.Name)
+		})
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestProtocolBreakdown(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p, err := metrics.NewProtocolBreakdown(registry, "test_reports_by_protocol_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", Protocol: "http/1.1", Type: "ok"},
+			{ReportType: "network-error", Protocol: "HTTP/2", Type: "ok"},
+			{ReportType: "network-error", Protocol: "h2", Type: "tcp.reset"},
+			{ReportType: "network-error", Protocol: "h3", Type: "ok"},
+			{ReportType: "network-error", Protocol: "h3-29", Type: "quic.protocol.error"},
+			{ReportType: "network-error", Protocol: "http/2+quic/43", Type: "ok"},
+			{ReportType: "network-error", Protocol: "spdy/3", Type: "ok"},
+			{ReportType: "network-error", Type: "dns.name_not_resolved"},
+			{ReportType: "csp-violation", Protocol: "h2"},
+		},
+	}
+	p.ProcessReports(context.Background(), batch)
+
+	var annotations []interface{}
+	for _, report := range batch.Reports {
+		annotations = append(annotations, report.GetAnnotation("Protocol"))
+	}
+	want := []interface{}{"http/1.1", "h2", "h2", "h3", "h3", "h3", "other", "unknown", nil}
+	if diff := cmp.Diff(want, annotations); diff != "" {
+		t.Errorf("Protocol annotations got diff (-want +got):\n%s", diff)
+	}
+
+	for _, c := range []struct {
+		protocol, typ string
+		want          float64
+	}{
+		{"h2", "ok", 1},
+		{"h2", "tcp.reset", 1},
+		{"h3", "ok", 2},
+		{"h3", "quic.protocol.error", 1},
+		{"unknown", "dns.name_not_resolved", 1},
+	} {
+		metric := findMetric(t, registry, "test_reports_by_protocol_total", map[string]string{"protocol": c.protocol, "type": c.typ})
+		if got := metric.GetCounter().GetValue(); got != c.want {
+			t.Errorf("Count for %s %s = %v, wanted %v", c.protocol, c.typ, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A SendErrorCounter is a publisher that counts the reports that it couldn't
+// send, such as publish.PulsarPublisher.
+type SendErrorCounter interface {
+	SendErrors() int64
+}
+
+// PublisherMetrics is a Prometheus collector that exports the number of
+// reports that each of a pipeline's publishers couldn't send:
+//
+//	nel_publisher_send_errors_total{index, type}
+//
+// Only the processors that are SendErrorCounters are included.
+type PublisherMetrics struct {
+	pipeline   *collector.Pipeline
+	sendErrors *prometheus.Desc
+}
+
+// NewPublisherMetrics creates a new PublisherMetrics for pipeline, which is
+// registered with registerer.
+func NewPublisherMetrics(pipeline *collector.Pipeline, registerer prometheus.Registerer) (*PublisherMetrics, error) {
+	m := &PublisherMetrics{
+		pipeline: pipeline,
+		sendErrors: prometheus.NewDesc(
+			"nel_publisher_send_errors_total",
+			"Number of reports that each publisher couldn't send.",
+			[]string{"index", "type"}, nil),
+	}
+	c, err := register(registerer, m)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*PublisherMetrics), nil
+}
+
+// Describe sends the descriptors of PublisherMetrics' metrics to ch.
+func (m *PublisherMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.sendErrors
+}
+
+// Collect sends the current counts for each publisher to ch.
+func (m *PublisherMetrics) Collect(ch chan<- prometheus.Metric) {
+	infos := m.pipeline.Describe()
+	for i, processor := range m.pipeline.Processors() {
+		counter, ok := processor.(SendErrorCounter)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.sendErrors, prometheus.CounterValue, float64(counter.SendErrors()), strconv.Itoa(i), infos[i].Type)
+	}
+}
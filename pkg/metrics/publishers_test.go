@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// failingPublisher is a publisher that has failed to send some reports.
+type failingPublisher struct {
+	keepFirst
+	errors int64
+}
+
+func (p failingPublisher) SendErrors() int64 {
+	return p.errors
+}
+
+func TestPublisherMetrics(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	pipeline.AddProcessor(keepFirst{})
+	pipeline.AddProcessor(failingPublisher{errors: 3})
+	registry := prometheus.NewRegistry()
+	if _, err := metrics.NewPublisherMetrics(pipeline, registry); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"index": "1", "type": "metrics_test.failingPublisher"}
+	if got := findMetric(t, registry, "nel_publisher_send_errors_total", labels).GetCounter().GetValue(); got != 3 {
+		t.Errorf("nel_publisher_send_errors_total = %v, wanted 3", got)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 1 {
+		t.Errorf("PublisherMetrics exported %v, wanted only the failing publisher", families)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// register registers a Prometheus collector.  If an identical collector has
+// already been registered (for instance, because the pipeline's configuration
+// was reloaded), we return that one instead, so that its metrics carry on
+// where they left off.
+func register(registerer prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	err := registerer.Register(c)
+	if err != nil {
+		if existing, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return existing.ExistingCollector, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// maxTraceIDLength is the longest trace ID that we'll attach to an exemplar.
+// (Prometheus limits the total length of an exemplar's labels to 128
+// characters, and panics if you exceed that.)
+const maxTraceIDLength = 64
+
+// knownReportTypes are the report types that normalizeReportType passes
+// through unchanged: the ones that the Reporting API and the specs built on it
+// define.
+var knownReportTypes = map[string]bool{
+	"network-error":                true,
+	"csp-violation":                true,
+	"deprecation":                  true,
+	"intervention":                 true,
+	"crash":                        true,
+	"coep":                         true,
+	"coop":                         true,
+	"document-policy-violation":    true,
+	"permissions-policy-violation": true,
+}
+
+// knownNelTypes are the NEL types that normalizeType passes through unchanged.
+var knownNelTypes = make(map[string]bool)
+
+func init() {
+	for _, nelType := range core.NelTypes {
+		knownNelTypes[nelType] = true
+	}
+}
+
+// normalizeReportType converts the type of a report into one of
+// knownReportTypes, "unknown" (if the report doesn't have a type), or "other",
+// so that clients can't create arbitrary label values.
+func normalizeReportType(reportType string) string {
+	switch {
+	case knownReportTypes[reportType]:
+		return reportType
+	case reportType == "":
+		return "unknown"
+	default:
+		return "other"
+	}
+}
+
+// normalizeType converts the NEL type of a report into one of core.NelTypes,
+// "" (if the report doesn't have one, as with reports that aren't NEL
+// reports), or "other", so that clients can't create arbitrary label values.
+// Use core.CanonicalizeType before this to count legacy spellings of the
+// standard types as those types, rather than as "other".
+func normalizeType(nelType string) string {
+	if nelType == "" || knownNelTypes[nelType] {
+		return nelType
+	}
+	return "other"
+}
+
+// ReportMetrics is a pipeline processor that counts the reports that it sees,
+// and tracks the distribution of elapsed_time of NEL reports, as Prometheus
+// metrics:
+//
+//	nel_reports_total{report_type, type}
+//	nel_report_elapsed_time_seconds{type}
+//
+// The labels are normalized so that a misbehaving client can't create
+// arbitrary label values; see normalizeReportType and normalizeType for the
+// values that they can have.
+//
+// If a report (or its batch) has a trace ID annotation (TraceID by default),
+// each observation is recorded along with an exemplar containing that trace
+// ID, so that you can jump from a spike on a dashboard straight to a relevant
+// trace.  None of the processors in this repository set that annotation, so
+// it's up to your own processors to (say, by finding the request that a
+// report describes in your tracing system).  Without it, we use the trace ID
+// from the upload's W3C `traceparent` header, if it has one, which a tracing
+// proxy in front of the collector may have added.  Exemplars are only
+// exported if the metrics endpoint uses the OpenMetrics format.
+type ReportMetrics struct {
+	// The name of the annotation that contains each report's trace ID.
+	TraceAnnotation string
+
+	reports *prometheus.CounterVec
+	elapsed *prometheus.HistogramVec
+}
+
+// NewReportMetrics creates a new ReportMetrics processor whose metrics are
+// registered with registerer.
+func NewReportMetrics(registerer prometheus.Registerer) (*ReportMetrics, error) {
+	reports, err := register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nel_reports_total",
+			Help: "Number of reports received, by report type and NEL type.",
+		},
+		[]string{"report_type", "type"}))
+	if err != nil {
+		return nil, err
+	}
+	elapsed, err := register(registerer, prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nel_report_elapsed_time_seconds",
+			Help:    "Elapsed time of the requests described by NEL reports, by NEL type.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+		[]string{"type"}))
+	if err != nil {
+		return nil, err
+	}
+	return &ReportMetrics{
+		TraceAnnotation: "TraceID",
+		reports:         reports.(*prometheus.CounterVec),
+		elapsed:         elapsed.(*prometheus.HistogramVec),
+	}, nil
+}
+
+// traceID returns the trace ID of a report, preferring the report's own
+// annotation to its batch's, and its batch's to the upload's traceparent
+// header.
+func (m *ReportMetrics) traceID(batch *collector.ReportBatch, report *collector.NelReport) string {
+	traceID, _ := report.GetAnnotation(m.TraceAnnotation).(string)
+	if traceID == "" {
+		traceID, _ = batch.GetAnnotation(m.TraceAnnotation).(string)
+	}
+	if traceID == "" {
+		traceID = traceParentID(batch.Header.Get("Traceparent"))
+	}
+	if len(traceID) > maxTraceIDLength {
+		return ""
+	}
+	return traceID
+}
+
+// traceParentID returns the trace ID from a W3C traceparent header, which
+// looks like 00-<trace ID>-<parent ID>-<flags>, or "" if it doesn't have a
+// valid one.
+func traceParentID(header string) string {
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || len(fields[1]) != 32 || fields[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	for _, c := range fields[1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return fields[1]
+}
+
+// ProcessReports updates the metrics for each report in the batch.
+func (m *ReportMetrics) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		var exemplar prometheus.Labels
+		if traceID := m.traceID(batch, report); traceID != "" {
+			exemplar = prometheus.Labels{"trace_id": traceID}
+		}
+
+		nelType := normalizeType(report.Type)
+		counter := m.reports.WithLabelValues(normalizeReportType(report.ReportType), nelType)
+		if exemplar != nil {
+			counter.(prometheus.ExemplarAdder).AddWithExemplar(1, exemplar)
+		} else {
+			counter.Inc()
+		}
+
+		if report.ReportType != "network-error" {
+			continue
+		}
+		elapsed := m.elapsed.WithLabelValues(nelType)
+		seconds := (time.Duration(report.ElapsedTime) * time.Millisecond).Seconds()
+		if exemplar != nil {
+			elapsed.(prometheus.ExemplarObserver).ObserveWithExemplar(seconds, exemplar)
+		} else {
+			elapsed.Observe(seconds)
+		}
+	}
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"ReportMetrics",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				TraceAnnotation string `toml:"trace_annotation"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			m, err := NewReportMetrics(prometheus.DefaultRegisterer)
+			if err != nil {
+				return nil, err
+			}
+			if config.TraceAnnotation != "" {
+				m.TraceAnnotation = config.TraceAnnotation
+			}
+			return m, nil
+		})
+}
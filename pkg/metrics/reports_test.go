@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// findMetric returns the metric in a registry with a particular name and set
+// of label values.
+func findMetric(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) *dto.Metric {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	t.Fatalf("No %s metric with labels %v", name, labels)
+	return nil
+}
+
+func exemplarTraceID(exemplar *dto.Exemplar) string {
+	for _, label := range exemplar.GetLabel() {
+		if label.GetName() == "trace_id" {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestReportMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.NewReportMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", Type: "tcp.timed_out", ElapsedTime: 1500},
+			{ReportType: "network-error", Type: "tcp.timed_out", ElapsedTime: 250},
+			{ReportType: "csp-violation"},
+		},
+	}
+	batch.SetAnnotation("TraceID", "4bf92f3577b34da6a3ce929d0e0e4736")
+	batch.Reports[1].SetAnnotation("TraceID", "00f067aa0ba902b7")
+	m.ProcessReports(context.Background(), batch)
+
+	counter := findMetric(t, registry, "nel_reports_total", map[string]string{"report_type": "network-error", "type": "tcp.timed_out"})
+	if got, want := counter.GetCounter().GetValue(), 2.0; got != want {
+		t.Errorf("nel_reports_total{network-error, tcp.timed_out} = %v, wanted %v", got, want)
+	}
+	if got, want := exemplarTraceID(counter.GetCounter().GetExemplar()), "00f067aa0ba902b7"; got != want {
+		t.Errorf("nel_reports_total exemplar trace_id = %q, wanted %q", got, want)
+	}
+
+	histogram := findMetric(t, registry, "nel_report_elapsed_time_seconds", map[string]string{"type": "tcp.timed_out"})
+	if got, want := histogram.GetHistogram().GetSampleCount(), uint64(2); got != want {
+		t.Errorf("nel_report_elapsed_time_seconds sample count = %v, wanted %v", got, want)
+	}
+	if got, want := histogram.GetHistogram().GetSampleSum(), 1.75; got != want {
+		t.Errorf("nel_report_elapsed_time_seconds sample sum = %v, wanted %v", got, want)
+	}
+	traceIDs := make(map[string]bool)
+	for _, bucket := range histogram.GetHistogram().GetBucket() {
+		if bucket.GetExemplar() != nil {
+			traceIDs[exemplarTraceID(bucket.GetExemplar())] = true
+		}
+	}
+	if !traceIDs["4bf92f3577b34da6a3ce929d0e0e4736"] || !traceIDs["00f067aa0ba902b7"] {
+		t.Errorf("nel_report_elapsed_time_seconds exemplars have trace IDs %v", traceIDs)
+	}
+
+	// Loading the processor again should reuse the existing metrics.
+	if _, err := metrics.NewReportMetrics(registry); err != nil {
+		t.Errorf("NewReportMetrics (again): %v", err)
+	}
+}
+
+func TestReportMetricsLabels(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.NewReportMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients can't create their own label values.
+	batch := &collector.ReportBatch{
+		Header: http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", Type: "tcp.made_up", ElapsedTime: 100},
+			{ReportType: "network-error", Type: "tcp.also_made_up", ElapsedTime: 100},
+			{ReportType: "made-up-report"},
+		},
+	}
+	m.ProcessReports(context.Background(), batch)
+
+	counter := findMetric(t, registry, "nel_reports_total", map[string]string{"report_type": "network-error", "type": "other"})
+	if got, want := counter.GetCounter().GetValue(), 2.0; got != want {
+		t.Errorf("nel_reports_total{network-error, other} = %v, wanted %v", got, want)
+	}
+	// The trace ID comes from the traceparent header when there's no
+	// annotation.
+	if got, want := exemplarTraceID(counter.GetCounter().GetExemplar()), "0af7651916cd43dd8448eb211c80319c"; got != want {
+		t.Errorf("nel_reports_total exemplar trace_id = %q, wanted %q", got, want)
+	}
+	counter = findMetric(t, registry, "nel_reports_total", map[string]string{"report_type": "other", "type": ""})
+	if got, want := counter.GetCounter().GetValue(), 1.0; got != want {
+		t.Errorf("nel_reports_total{other, \"\"} = %v, wanted %v", got, want)
+	}
+}
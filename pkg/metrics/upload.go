@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultUploadSizeBuckets are the histogram buckets (in bytes) that
+// UploadMetrics uses for the size of each upload.
+var DefaultUploadSizeBuckets = prometheus.ExponentialBuckets(256, 4, 8)
+
+// UploadMetrics is an http.Handler that passes requests on to another handler
+// (usually a Pipeline), and records Prometheus metrics about the HTTP side of
+// each upload:
+//
+//	nel_uploads_total{code}
+//	nel_upload_size_bytes
+//	nel_upload_duration_seconds{code}
+//
+// which count the uploads by the status code that we responded with, and track
+// the distribution of the size of their bodies and of how long we took to
+// respond.  Unlike the metrics that processors record, these include uploads
+// that are rejected before they produce any reports, such as malformed
+// payloads (400), oversized ones (413), or ones with the wrong Content-Type
+// (415).  The size is the number of bytes that the wrapped handler actually
+// read, so rejected uploads whose bodies weren't read count as empty.
+type UploadMetrics struct {
+	handler  http.Handler
+	uploads  *prometheus.CounterVec
+	sizes    prometheus.Histogram
+	duration *prometheus.HistogramVec
+}
+
+// NewUploadMetrics creates a new UploadMetrics that wraps handler, and whose
+// metrics are registered with registerer.
+func NewUploadMetrics(handler http.Handler, registerer prometheus.Registerer) (*UploadMetrics, error) {
+	uploads, err := register(registerer, prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "nel_uploads_total",
+			Help: "Number of uploads received, by response status code.",
+		},
+		[]string{"code"}))
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := register(registerer, prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "nel_upload_size_bytes",
+			Help:    "Size of the body of each upload.",
+			Buckets: DefaultUploadSizeBuckets,
+		}))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := register(registerer, prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "nel_upload_duration_seconds",
+			Help:    "Time taken to respond to each upload, by response status code.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"code"}))
+	if err != nil {
+		return nil, err
+	}
+	return &UploadMetrics{
+		handler:  handler,
+		uploads:  uploads.(*prometheus.CounterVec),
+		sizes:    sizes.(prometheus.Histogram),
+		duration: duration.(*prometheus.HistogramVec),
+	}, nil
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes through to the underlying ResponseWriter, so that wrapping a
+// streaming handler doesn't break it.
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ServeHTTP handles the request with the wrapped handler, and records metrics
+// about it.
+func (m *UploadMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	recorder := &statusRecorder{ResponseWriter: w}
+	m.handler.ServeHTTP(recorder, r)
+
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	code := strconv.Itoa(status)
+	m.uploads.WithLabelValues(code).Inc()
+	m.sizes.Observe(float64(atomic.LoadInt64(&body.n)))
+	m.duration.WithLabelValues(code).Observe(time.Since(start).Seconds())
+}
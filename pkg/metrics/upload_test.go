@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/metrics"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUploadMetrics(t *testing.T) {
+	pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+	defer pipeline.Close()
+	registry := prometheus.NewRegistry()
+	m, err := metrics.NewUploadMetrics(pipeline, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := `[{"age": 0, "type": "network-error", "url": "https://example.com/", "body": {"type": "ok"}}]`
+	for _, upload := range []struct {
+		method, contentType, body string
+	}{
+		{"POST", "application/reports+json", valid},
+		{"POST", "application/reports+json", valid},
+		{"POST", "application/reports+json", `[{"age": "soon"`},
+		{"POST", "application/json", valid},
+		{"GET", "", ""},
+	} {
+		r := httptest.NewRequest(upload.method, "https://example.com/upload/", strings.NewReader(upload.body))
+		r.Header.Set("Content-Type", upload.contentType)
+		m.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	for _, c := range []struct {
+		code string
+		want float64
+	}{
+		{"204", 2},
+		{"400", 1},
+		{"415", 1},
+		{"405", 1},
+	} {
+		labels := map[string]string{"code": c.code}
+		if got := findMetric(t, registry, "nel_uploads_total", labels).GetCounter().GetValue(); got != c.want {
+			t.Errorf("nel_uploads_total{code=%s} = %v, wanted %v", c.code, got, c.want)
+		}
+		if got := findMetric(t, registry, "nel_upload_duration_seconds", labels).GetHistogram().GetSampleCount(); float64(got) != c.want {
+			t.Errorf("nel_upload_duration_seconds{code=%s} has %d samples, wanted %v", c.code, got, c.want)
+		}
+	}
+	sizes := findMetric(t, registry, "nel_upload_size_bytes", nil).GetHistogram()
+	if got, want := sizes.GetSampleCount(), uint64(5); got != want {
+		t.Errorf("nel_upload_size_bytes has %d samples, wanted %d", got, want)
+	}
+	if got, want := sizes.GetSampleSum(), float64(2*len(valid)+len(`[{"age": "soon"`)); got != want {
+		t.Errorf("nel_upload_size_bytes has sum %v, wanted %v", got, want)
+	}
+}
+
+func TestUploadMetricsFlush(t *testing.T) {
+	m, err := metrics.NewUploadMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		}
+	}), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := httptest.NewRecorder()
+	m.ServeHTTP(response, httptest.NewRequest("GET", "https://example.com/debug/tail", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("UploadMetrics hid the wrapped ResponseWriter's Flush method")
+	}
+}
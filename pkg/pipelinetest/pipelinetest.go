@@ -19,6 +19,8 @@ package pipelinetest
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -28,6 +30,7 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 	"github.com/google/nel-collector/pkg/collector"
@@ -52,12 +55,13 @@ func (c SimulatedClock) Now() time.Time {
 	return c.CurrentTime
 }
 
-// NewTestConfigPipeline constructs a new Pipeline from the contents of a TOML
-// configuration string.  We assume that configString is well-formed and panic
-// if there are any errors parsing it, or configuring the pipeline's processors.
-// This is especially useful in test cases, along with PipelineTest.
+// NewTestConfigPipeline constructs a new synchronous Pipeline (see
+// collector.NewSynchronousPipeline) from the contents of a TOML configuration
+// string.  We assume that configString is well-formed and panic if there are
+// any errors parsing it, or configuring the pipeline's processors. This is
+// especially useful in test cases, along with PipelineTest.
 func NewTestConfigPipeline(configString string) *collector.Pipeline {
-	p := collector.NewTestPipeline(NewSimulatedClock())
+	p := collector.NewSynchronousPipeline(NewSimulatedClock())
 	err := p.LoadFromConfig(context.Background(), []byte(configString))
 	if err != nil {
 		log.Fatal(err)
@@ -66,6 +70,26 @@ func NewTestConfigPipeline(configString string) *collector.Pipeline {
 	return p
 }
 
+// RunProcessor runs a single processor against a batch of reports, and returns
+// the batch.  Unlike PipelineTest, this doesn't go through HTTP or the
+// pipeline's queue and workers, so it's useful for unit-testing a processor
+// with a hand-built batch.
+func RunProcessor(p collector.ReportProcessor, batch *collector.ReportBatch) *collector.ReportBatch {
+	p.ProcessReports(context.Background(), batch)
+	return batch
+}
+
+// RunTestConfig loads the processors in the contents of a TOML configuration
+// string, runs them in order against a batch of reports, and returns the
+// batch.  Like NewTestConfigPipeline, we assume that configString is
+// well-formed.
+func RunTestConfig(configString string, batch *collector.ReportBatch) *collector.ReportBatch {
+	p := NewTestConfigPipeline(configString)
+	defer p.Close()
+	p.ProcessBatch(context.Background(), batch)
+	return batch
+}
+
 // PipelineTest automates the process of running a NEL collector pipeline
 // against a large number of test uploads.
 //
@@ -78,11 +102,17 @@ type PipelineTest struct {
 	// all test cases that use the same OutputPath.
 	TestName string
 
-	// The pipeline being tested.  It should include a processor that adds a
-	// []byte annotation named `TestResult` to the report batch; we'll verify the
-	// contents of this annotation to determine whether each test succeeded.
+	// The pipeline being tested.  Unless you provide an Encoder, it should
+	// include a processor that adds a []byte annotation named `TestResult` to
+	// the report batch; we'll verify the contents of this annotation to
+	// determine whether each test succeeded.
 	Pipeline *collector.Pipeline
 
+	// The function that turns each batch, once the pipeline has processed it,
+	// into the output that we compare against the golden file.  If nil, we use
+	// EncodeTestResult.
+	Encoder ResultEncoder
+
 	// The extension that we should use for the golden files for your test case.
 	// If empty, we will use ".json".
 	OutputExtension string
@@ -96,6 +126,41 @@ type PipelineTest struct {
 	URL string
 }
 
+// A ResultEncoder turns a batch of reports that has gone through the pipeline
+// being tested into the output that PipelineTest compares against a golden
+// file.  This lets you test processors with output in any format (such as
+// CSV or protobuf), without needing a processor that saves that output in an
+// annotation.
+type ResultEncoder func(batch *collector.ReportBatch) ([]byte, error)
+
+// EncodeTestResult is the default ResultEncoder, which returns the contents of
+// the batch's TestResult annotation.  That annotation must be a []byte; see
+// EncodeBatchAsResult for a processor that adds one.
+func EncodeTestResult(batch *collector.ReportBatch) ([]byte, error) {
+	result := batch.GetAnnotation("TestResult")
+	if result == nil {
+		return nil, fmt.Errorf("got nil")
+	}
+	encoded, ok := result.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("got %v, wanted []byte", result)
+	}
+	return encoded, nil
+}
+
+// diffResults returns a description of the differences between the expected
+// and actual output of a test case, or "" if they're the same.  Text is diffed
+// line by line; anything that isn't valid UTF-8 is shown as a hex dump.
+func diffResults(want, got []byte) string {
+	if bytes.Equal(want, got) {
+		return ""
+	}
+	if utf8.Valid(want) && utf8.Valid(got) {
+		return diff.Diff(string(want), string(got))
+	}
+	return diff.Diff(hex.Dump(want), hex.Dump(got))
+}
+
 // TestCase describes one test case managed by a PipelineTest.
 type TestCase struct {
 	// The name of the PipelineTest that created this test case.
@@ -137,9 +202,9 @@ func (c TestCase) FullName() string {
 }
 
 // Run tests your pipeline against all of the input files that we found in your
-// InputPath, comparing the values of the TestResult annotation with the
-// corresponding golden files in OutputPath. It uses the default upload URL of
-// https://example.com/upload/
+// InputPath, comparing the output of Encoder (by default, the values of the
+// TestResult annotation) with the corresponding golden files in OutputPath. It
+// uses the default upload URL of https://example.com/upload/
 func (p *PipelineTest) Run(t *testing.T) {
 	payloadNames, err := p.Testdata.GetPayloadNames()
 	if err != nil {
@@ -154,10 +219,19 @@ func (p *PipelineTest) Run(t *testing.T) {
 	if url == "" {
 		url = "https://example.com/upload/"
 	}
+	encoder := p.Encoder
+	if encoder == nil {
+		encoder = EncodeTestResult
+	}
 
-	const chanSize = 100
-	c := make(chan *collector.ReportBatch, chanSize)
-	p.Pipeline.AddProcessor(extractReports{c})
+	// For asynchronous pipelines, we need a processor to hand each batch back to
+	// us once all of the others have finished with it.
+	var c chan *collector.ReportBatch
+	if !p.Pipeline.Synchronous() {
+		const chanSize = 100
+		c = make(chan *collector.ReportBatch, chanSize)
+		p.Pipeline.AddProcessor(extractReports{c})
+	}
 
 	for _, payloadName := range payloadNames {
 		for _, ip := range []struct{ tag, remoteAddr string }{{"ipv4", ""}, {"ipv6", "[2001:db8::2]:1234"}} {
@@ -176,33 +250,30 @@ func (p *PipelineTest) Run(t *testing.T) {
 				}
 
 				var response httptest.ResponseRecorder
-				p.Pipeline.ProcessReports(context.Background(), &response, request)
-				batch := <-c
+				batch, _ := p.Pipeline.ProcessUpload(context.Background(), &response, request)
 				if response.Code != http.StatusNoContent {
 					t.Errorf("ProcessReports(%s:%s) got status code %d, wanted %d", payloadName, ip.tag, response.Code, http.StatusNoContent)
 					return
 				}
+				if c != nil {
+					batch = <-c
+				}
 				if batch == nil {
 					t.Errorf("ProcessReports(%s:%s) got nil", payloadName, ip.tag)
 					return
 				}
 
-				result := batch.GetAnnotation("TestResult")
-				if result == nil {
-					t.Errorf("TestResult(%s:%s) got nil", payloadName, ip.tag)
+				got, err := encoder(batch)
+				if err != nil {
+					t.Errorf("TestResult(%s:%s) %v", payloadName, ip.tag, err)
 					return
 				}
 
-				got, ok := result.([]byte)
-				if !ok {
-					t.Errorf("TestResult(%s:%s) got %v, wanted []byte", payloadName, ip.tag, result)
-				}
-
 				want, err := p.Testdata.LoadOutputFile(testCase, got)
 				if err != nil {
 					t.Fatal(err)
 				}
-				if diff := diff.Diff((string)(want), (string)(got)); diff != "" {
+				if diff := diffResults(want, got); diff != "" {
 					t.Errorf("TestResult(%s:%s) got diff (want → got):\n%s", payloadName, ip.tag, diff)
 					return
 				}
@@ -234,14 +305,14 @@ type TestdataLoader interface {
 //
 // We expect the following directory structure:
 //
-//   [InputPath]/
-//     testdata/
-//       reports/
-//         [PayloadName].json
-//   [OutputPath]/
-//     testdata/
-//       [TestName]/
-//         [PayloadName].[IPTag].[OutputExtension]
+//	[InputPath]/
+//	  testdata/
+//	    reports/
+//	      [PayloadName].json
+//	[OutputPath]/
+//	  testdata/
+//	    [TestName]/
+//	      [PayloadName].[IPTag].[OutputExtension]
 //
 // InputPath and OutputPath both default to the current directory if empty,
 // which lines up with the `go test` convention of running test cases in the
@@ -347,9 +418,14 @@ func (e extractReports) ProcessReports(ctx context.Context, batch *collector.Rep
 }
 
 func init() {
-	collector.RegisterReportLoaderFunc(
+	collector.RegisterContextReportLoaderFunc(
 		"EncodeBatchAsResult",
-		func(configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct{}
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
 			return EncodeBatchAsResult{}, nil
 		})
 }
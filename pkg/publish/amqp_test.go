@@ -0,0 +1,329 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+type amqpDelivery struct {
+	exchange, routingKey, body string
+}
+
+// fakeAMQP is a minimal AMQP 0-9-1 broker, which records the messages that
+// are published to it, and confirms them (rejecting the ones that mention
+// rejected.example).  If dropAfter is nonzero, the first connection is closed,
+// without confirming anything, once that many messages have been published on
+// it.
+type fakeAMQP struct {
+	listener  net.Listener
+	vhost     string
+	dropAfter int
+
+	mu          sync.Mutex
+	connections int
+	confirmed   []amqpDelivery
+}
+
+func newFakeAMQP(t *testing.T) *fakeAMQP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeAMQP{listener: listener}
+	go f.serve()
+	return f
+}
+
+func (f *fakeAMQP) url(credentials, vhost string) string {
+	return "amqp://" + credentials + "@" + f.listener.Addr().String() + vhost
+}
+
+func (f *fakeAMQP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.connections++
+		first := f.connections == 1
+		f.mu.Unlock()
+		go f.handle(conn, first)
+	}
+}
+
+func writeFakeFrame(w io.Writer, frameType byte, channel uint16, payload []byte) {
+	header := []byte{frameType, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], channel)
+	binary.BigEndian.PutUint32(header[3:], uint32(len(payload)))
+	w.Write(header)
+	w.Write(payload)
+	w.Write([]byte{0xce})
+}
+
+func writeFakeMethod(w io.Writer, channel uint16, class, method uint16, args ...interface{}) {
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, class)
+	binary.Write(&payload, binary.BigEndian, method)
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			payload.WriteByte(byte(len(arg)))
+			payload.WriteString(arg)
+		case []byte:
+			binary.Write(&payload, binary.BigEndian, uint32(len(arg)))
+			payload.Write(arg)
+		default:
+			binary.Write(&payload, binary.BigEndian, arg)
+		}
+	}
+	writeFakeFrame(w, 1, channel, payload.Bytes())
+}
+
+func readFakeFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload[:len(payload)-1], nil
+}
+
+// readFakeMethod reads a method frame, and returns its class and method IDs
+// along with its arguments.
+func readFakeMethod(r io.Reader) (uint16, uint16, []byte, error) {
+	_, payload, err := readFakeFrame(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), payload[4:], nil
+}
+
+func (f *fakeAMQP) handle(conn net.Conn, first bool) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	protocol := make([]byte, 8)
+	if _, err := io.ReadFull(r, protocol); err != nil || string(protocol) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	writeFakeMethod(conn, 0, 10, 10, uint8(0), uint8(9), []byte{}, []byte("AMQPLAIN PLAIN"), []byte("en_US"))
+	_, _, startOk, err := readFakeMethod(r)
+	if err != nil || !bytes.Contains(startOk, []byte("\x00nel\x00secret")) {
+		writeFakeMethod(conn, 0, 10, 50, uint16(403), "ACCESS_REFUSED", uint16(0), uint16(0))
+		return
+	}
+	// A small frame size makes larger messages span several body frames.
+	writeFakeMethod(conn, 0, 10, 30, uint16(2047), uint32(256), uint16(60))
+	readFakeMethod(r)
+	_, _, open, err := readFakeMethod(r)
+	if err != nil || string(open[1:1+int(open[0])]) != f.vhost {
+		writeFakeMethod(conn, 0, 10, 50, uint16(530), "NOT_ALLOWED", uint16(10), uint16(40))
+		return
+	}
+	writeFakeMethod(conn, 0, 10, 41, "")
+	readFakeMethod(r)
+	writeFakeMethod(conn, 1, 20, 11, []byte{})
+
+	confirm := false
+	var tag uint64
+	for {
+		class, method, args, err := readFakeMethod(r)
+		if err != nil {
+			return
+		}
+		switch {
+		case class == 85 && method == 10:
+			confirm = true
+			writeFakeMethod(conn, 1, 85, 11)
+		case class == 10 && method == 50:
+			writeFakeMethod(conn, 0, 10, 51)
+			return
+		case class == 60 && method == 40:
+			exchange := string(args[3 : 3+int(args[2])])
+			args = args[3+int(args[2]):]
+			routingKey := string(args[1 : 1+int(args[0])])
+			_, header, err := readFakeFrame(r)
+			if err != nil {
+				return
+			}
+			size := int(binary.BigEndian.Uint64(header[4:]))
+			var body []byte
+			for len(body) < size {
+				_, chunk, err := readFakeFrame(r)
+				if err != nil {
+					return
+				}
+				body = append(body, chunk...)
+			}
+			tag++
+			if first && f.dropAfter > 0 && int(tag) >= f.dropAfter {
+				return
+			}
+			if !confirm {
+				continue
+			}
+			if strings.Contains(string(body), "rejected.example") {
+				writeFakeMethod(conn, 1, 60, 120, tag, uint8(0))
+				continue
+			}
+			f.mu.Lock()
+			f.confirmed = append(f.confirmed, amqpDelivery{exchange, routingKey, string(body)})
+			f.mu.Unlock()
+			writeFakeMethod(conn, 1, 60, 80, tag, uint8(0))
+		}
+	}
+}
+
+func TestAMQPPublisher(t *testing.T) {
+	fake := newFakeAMQP(t)
+	fake.vhost = "nel"
+	defer fake.listener.Close()
+
+	p, err := publish.NewAMQPPublisher(fake.url("nel:secret", "/nel"), "reports", "nel.{phase}.{type}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	err = p.TryProcessReports(context.Background(), &collector.ReportBatch{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+		{URL: "https://a.example/" + strings.Repeat("x", 1000), Phase: "connection", Type: "tcp.timed_out"},
+		{URL: "https://b.example/", Type: "ok"},
+		{URL: "https://rejected.example/", Phase: "dns", Type: "dns.name_not_resolved"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err == nil || !strings.Contains(err.Error(), "rejected 1 messages") {
+		t.Errorf("Close got error %v, wanted a rejected message", err)
+	}
+
+	var keys []string
+	for _, delivery := range fake.confirmed {
+		if delivery.exchange != "reports" {
+			t.Errorf("AMQPPublisher published to exchange %q", delivery.exchange)
+		}
+		keys = append(keys, delivery.routingKey)
+	}
+	if diff := cmp.Diff([]string{"nel.connection.tcp.timed_out", "nel._.ok"}, keys); diff != "" {
+		t.Errorf("AMQPPublisher routing keys diff (-want +got):\n%s", diff)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(fake.confirmed[0].body), &record); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(record["url"].(string), "https://a.example/xxx") || record["client_ip"] != "192.0.2.1" || record["received_at"] != "2024-01-02T15:30:00Z" {
+		t.Errorf("AMQPPublisher published message %v", record)
+	}
+	if got := p.SendErrors(); got != 1 {
+		t.Errorf("AMQPPublisher.SendErrors() = %d, wanted 1", got)
+	}
+}
+
+func TestAMQPPublisherReconnect(t *testing.T) {
+	fake := newFakeAMQP(t)
+	fake.vhost = "/"
+	fake.dropAfter = 2
+	defer fake.listener.Close()
+
+	p, err := publish.NewAMQPPublisher(fake.url("nel:secret", ""), "", "nel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.RetryDelay = time.Millisecond
+	p.Timeout = 5 * time.Second
+	err = p.TryProcessReports(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{
+		{URL: "https://a.example/"}, {URL: "https://b.example/"}, {URL: "https://c.example/"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first connection is dropped before anything is confirmed, so Close
+	// has to reconnect and publish everything again.
+	if err := p.Close(); err != nil && !strings.Contains(err.Error(), "EOF") {
+		t.Fatal(err)
+	}
+
+	var urls []string
+	for _, delivery := range fake.confirmed {
+		var record map[string]interface{}
+		json.Unmarshal([]byte(delivery.body), &record)
+		urls = append(urls, record["url"].(string))
+	}
+	sort.Strings(urls)
+	if diff := cmp.Diff([]string{"https://a.example/", "https://b.example/", "https://c.example/"}, urls); diff != "" {
+		t.Errorf("AMQPPublisher confirmed messages diff (-want +got):\n%s", diff)
+	}
+	if fake.connections != 2 {
+		t.Errorf("AMQPPublisher made %d connections, wanted 2", fake.connections)
+	}
+	if got := p.SendErrors(); got != 0 {
+		t.Errorf("AMQPPublisher.SendErrors() = %d, wanted 0", got)
+	}
+}
+
+func TestAMQPPublisherBadCredentials(t *testing.T) {
+	fake := newFakeAMQP(t)
+	defer fake.listener.Close()
+
+	p, err := publish.NewAMQPPublisher(fake.url("nel:wrong", ""), "", "nel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MaxRetries = 1
+	p.RetryDelay = time.Millisecond
+	err = p.TryProcessReports(context.Background(), &collector.ReportBatch{Reports: make([]collector.NelReport, 2)})
+	if err == nil || !strings.Contains(err.Error(), "403 ACCESS_REFUSED") {
+		t.Errorf("AMQPPublisher with bad credentials got error %v", err)
+	}
+	if got := p.SendErrors(); got != 2 {
+		t.Errorf("AMQPPublisher.SendErrors() = %d, wanted 2", got)
+	}
+	p.Close()
+}
+
+func TestAMQPPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`url = "http://localhost:5672"`,
+		`url = "amqp://localhost"` + "\n" + `routing_key = "nel.{colour}"`,
+		`url = "amqp://localhost"` + "\n" + `max_retries = -1`,
+		`url = "amqp://localhost"` + "\n" + `retry_delay = "0s"`,
+		`url = "amqp://localhost"` + "\n" + `timeout = "soon"`,
+		`url = "amqp://localhost"` + "\n" + `field_names = {nonexistent = "x"}`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"AMQPPublisher\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// fakeClickHouse is a ClickHouse HTTP interface that records the rows of each
+// INSERT, failing the first failures requests with a 503.
+type fakeClickHouse struct {
+	failures int
+
+	mu      sync.Mutex
+	queries []url.Values
+	rows    [][]map[string]interface{}
+}
+
+func (f *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("X-ClickHouse-User") != "nel" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+		http.Error(w, "Code: 516. DB::Exception: nel: Authentication failed", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		http.Error(w, "Code: 202. DB::Exception: Too many simultaneous queries", http.StatusServiceUnavailable)
+		return
+	}
+	var rows []map[string]interface{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			http.Error(w, "Code: 117. DB::Exception: Cannot parse input", http.StatusBadRequest)
+			return
+		}
+		rows = append(rows, row)
+	}
+	f.queries = append(f.queries, r.URL.Query())
+	f.rows = append(f.rows, rows)
+}
+
+func TestClickHousePublisher(t *testing.T) {
+	fake := &fakeClickHouse{failures: 1}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "http://", "http://nel:secret@", 1) + "/analytics"
+	p, err := publish.NewClickHousePublisher(dsn, "nel_reports", 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AsyncInsert = publish.ClickHouseAsyncWait
+	p.RetryDelay = time.Millisecond
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	ctx := context.Background()
+	p.ProcessReports(ctx, &collector.ReportBatch{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+		{ReportType: "network-error", URL: "https://a.example/", StatusCode: 502, Phase: "application", Type: "http.error"},
+		{ReportType: "network-error", URL: "https://b.example/", Type: "ok"},
+		{ReportType: "network-error", URL: "https://c.example/", Type: "ok"},
+	}})
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first insert fails, and is retried.
+	if fake.failures != 0 || len(fake.queries) != 1 {
+		t.Fatalf("ClickHousePublisher made %d inserts, wanted 1", len(fake.queries))
+	}
+	want := url.Values{
+		"query":                 {"INSERT INTO nel_reports (received_at, client_ip, age, report_type, url, user_agent, referrer, sampling_fraction, server_ip, protocol, method, status_code, elapsed_time, phase, type, raw) FORMAT JSONEachRow"},
+		"database":              {"analytics"},
+		"async_insert":          {"1"},
+		"wait_for_async_insert": {"1"},
+	}
+	if diff := cmp.Diff(want, fake.queries[0]); diff != "" {
+		t.Errorf("ClickHousePublisher query diff (-want +got):\n%s", diff)
+	}
+	var got [][]string
+	for _, rows := range fake.rows {
+		var urls []string
+		for _, row := range rows {
+			urls = append(urls, row["url"].(string))
+		}
+		got = append(got, urls)
+	}
+	if diff := cmp.Diff([][]string{{"https://a.example/", "https://b.example/", "https://c.example/"}}, got); diff != "" {
+		t.Errorf("ClickHousePublisher inserted rows diff (-want +got):\n%s", diff)
+	}
+	row := fake.rows[0][0]
+	if row["received_at"] != "2024-01-02 15:30:00.000" || row["client_ip"] != "192.0.2.1" || row["status_code"] != 502.0 || row["type"] != "http.error" {
+		t.Errorf("ClickHousePublisher inserted row %v", row)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(row["raw"].(string)), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["url"] != "https://a.example/" || raw["received_at"] != "2024-01-02T15:30:00Z" {
+		t.Errorf("ClickHousePublisher inserted raw record %v", raw)
+	}
+	if got := p.SendErrors(); got != 0 {
+		t.Errorf("ClickHousePublisher.SendErrors() = %d, wanted 0", got)
+	}
+}
+
+func TestClickHousePublisherErrors(t *testing.T) {
+	fake := &fakeClickHouse{failures: 10}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// Transient failures are retried until MaxRetries runs out.
+	dsn := strings.Replace(server.URL, "http://", "http://nel:secret@", 1)
+	p, err := publish.NewClickHousePublisher(dsn, "nel_reports", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MaxRetries = 2
+	p.RetryDelay = time.Millisecond
+	p.ProcessReports(context.Background(), &collector.ReportBatch{Reports: make([]collector.NelReport, 3)})
+	p.Close()
+	if got := p.SendErrors(); got != 3 {
+		t.Errorf("ClickHousePublisher.SendErrors() = %d, wanted 3", got)
+	}
+	if got := fake.failures; got != 7 {
+		t.Errorf("ClickHousePublisher made %d attempts, wanted 3", 10-got)
+	}
+
+	// Other failures aren't.
+	fake.failures = 0
+	p, err = publish.NewClickHousePublisher(server.URL, "nel_reports", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ProcessReports(context.Background(), &collector.ReportBatch{Reports: make([]collector.NelReport, 2)})
+	p.Close()
+	if got := p.SendErrors(); got != 2 {
+		t.Errorf("ClickHousePublisher.SendErrors() = %d, wanted 2", got)
+	}
+}
+
+func TestClickHousePublisherBadConfig(t *testing.T) {
+	base := `type = "ClickHousePublisher"` + "\n" + `dsn = "http://clickhouse.local:8123"` + "\n"
+	configs := []string{
+		`type = "ClickHousePublisher"` + "\n" + `table = "nel_reports"`,
+		`type = "ClickHousePublisher"` + "\n" + `dsn = "tcp://clickhouse.local:9000"` + "\n" + `table = "nel_reports"`,
+		base,
+		base + `table = "nel reports; DROP TABLE x"`,
+		base + `table = "nel_reports"` + "\n" + `batch_size = -1`,
+		base + `table = "nel_reports"` + "\n" + `flush_interval = "0s"`,
+		base + `table = "nel_reports"` + "\n" + `async_insert = "always"`,
+		base + `table = "nel_reports"` + "\n" + `max_retries = -1`,
+		base + `table = "nel_reports"` + "\n" + `retry_delay = "soon"`,
+		base + `table = "nel_reports"` + "\n" + `field_names = {url = ""}`,
+	}
+	for _, config := range configs {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
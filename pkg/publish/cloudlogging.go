@@ -0,0 +1,550 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// DefaultCloudLoggingEndpoint is the Cloud Logging API method that
+// CloudLoggingPublisher writes entries with, unless you choose a different one.
+const DefaultCloudLoggingEndpoint = "https://logging.googleapis.com/v2/entries:write"
+
+// DefaultMetadataTokenURL is where CloudLoggingPublisher gets access tokens
+// for the default service account of the GCE instance (or GKE node, or Cloud
+// Run service) that it's running on, unless you give it a static token.
+const DefaultMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// cloudLoggingSeverities are the severities that Cloud Logging understands.
+var cloudLoggingSeverities = map[string]bool{
+	"DEFAULT": true, "DEBUG": true, "INFO": true, "NOTICE": true, "WARNING": true,
+	"ERROR": true, "CRITICAL": true, "ALERT": true, "EMERGENCY": true,
+}
+
+// A CloudLoggingSeverityRule decides the severity of the log entries for some
+// reports.
+type CloudLoggingSeverityRule struct {
+	// Reports that match this condition get this rule's severity.  (See
+	// core.NewWhere for the syntax.)
+	Where    *core.Where
+	Severity string
+}
+
+// NewCloudLoggingSeverityRule creates a new CloudLoggingSeverityRule that
+// gives reports matching a condition the given severity, such as ERROR.
+func NewCloudLoggingSeverityRule(condition, severity string) (CloudLoggingSeverityRule, error) {
+	if !cloudLoggingSeverities[severity] {
+		return CloudLoggingSeverityRule{}, fmt.Errorf("invalid severity %s", severity)
+	}
+	where, err := core.NewWhere(condition, nil)
+	if err != nil {
+		return CloudLoggingSeverityRule{}, err
+	}
+	return CloudLoggingSeverityRule{Where: where, Severity: severity}, nil
+}
+
+// CloudLoggingSeverityRuleConfig is the configuration of a
+// CloudLoggingSeverityRule, as it appears in the `severity` sections of a
+// CloudLoggingPublisher's configuration.
+type CloudLoggingSeverityRuleConfig struct {
+	Condition string `toml:"condition"`
+	Severity  string `toml:"severity"`
+}
+
+// DefaultCloudLoggingSeverityRules are the rules that CloudLoggingPublisher
+// uses unless you provide different ones: DNS and connection failures and
+// server errors are errors, and client errors and other failed requests are
+// warnings.  Everything else gets the publisher's DefaultSeverity.
+var DefaultCloudLoggingSeverityRules = []CloudLoggingSeverityRuleConfig{
+	{`phase == "dns" or phase == "connection"`, "ERROR"},
+	{`status_code >= 500`, "ERROR"},
+	{`status_code >= 400`, "WARNING"},
+	{`report_type == "network-error" and type != "ok"`, "WARNING"},
+}
+
+// cloudLoggingEntry is the JSON encoding of a Cloud Logging LogEntry.  The log
+// name and monitored resource are shared by every entry in a request, so
+// they're only given once, in cloudLoggingRequest.
+type cloudLoggingEntry struct {
+	Timestamp   time.Time                `json:"timestamp"`
+	Severity    string                   `json:"severity"`
+	Labels      map[string]string        `json:"labels,omitempty"`
+	HTTPRequest *cloudLoggingHTTPRequest `json:"httpRequest,omitempty"`
+	JSONPayload interface{}              `json:"jsonPayload"`
+}
+
+// cloudLoggingHTTPRequest is the JSON encoding of a Cloud Logging
+// HttpRequest, which describes the request that a NEL report is about.
+type cloudLoggingHTTPRequest struct {
+	RequestMethod string `json:"requestMethod,omitempty"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status,omitempty"`
+	Referer       string `json:"referer,omitempty"`
+	ServerIP      string `json:"serverIp,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+	Latency       string `json:"latency,omitempty"`
+}
+
+type cloudLoggingResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// cloudLoggingRequest is the JSON encoding of a WriteLogEntriesRequest.
+type cloudLoggingRequest struct {
+	LogName        string               `json:"logName"`
+	Resource       cloudLoggingResource `json:"resource"`
+	Entries        []cloudLoggingEntry  `json:"entries"`
+	PartialSuccess bool                 `json:"partialSuccess"`
+}
+
+// CloudLoggingPublisher is a pipeline processor that writes reports to Google
+// Cloud Logging, so that they can be searched and alerted on alongside the
+// rest of your logs.  Each report becomes a log entry in LogName, in Project,
+// attached to the monitored resource described by ResourceType and
+// ResourceLabels (such as a gce_instance with its instance_id and zone).  The
+// entry's payload is the same JSON object that ObjectStorePublisher would
+// write, including the report's annotations.  NEL reports also fill in the
+// entry's httpRequest, so that Cloud Logging shows them like request logs, and
+// every entry has report_type, type, and phase labels.
+//
+// Each report is checked against SeverityRules in order, and the first rule
+// that it matches decides the entry's severity; reports that don't match any
+// rule get DefaultSeverity.
+//
+// Like the Cloud Logging client library's asynchronous logger, ProcessReports
+// only buffers entries in memory; a background goroutine writes them every
+// FlushInterval, or as soon as there are BatchSize of them, and anything left
+// is written when the pipeline is closed.  If writes fall behind, at most
+// MaxBuffered entries are kept, and any others are dropped.
+//
+// Requests are authorized with AccessToken if it's set, and otherwise with
+// tokens for the default service account from the metadata server, which is
+// available on GCE, GKE, and Cloud Run.
+type CloudLoggingPublisher struct {
+	Project        string
+	LogName        string
+	ResourceType   string
+	ResourceLabels map[string]string
+
+	SeverityRules   []CloudLoggingSeverityRule
+	DefaultSeverity string
+
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxBuffered   int
+
+	// The API method to write entries with; if empty, we use
+	// DefaultCloudLoggingEndpoint.
+	Endpoint string
+
+	// If set, a static OAuth2 access token to send with each request.
+	AccessToken string
+	// The metadata server URL to get access tokens from, if AccessToken isn't
+	// set.  If empty, we use DefaultMetadataTokenURL.
+	MetadataURL string
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// The client used to write entries and get tokens.  If nil, we use
+	// http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to decide when cached tokens expire.  If nil, we use the
+	// current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	pending []cloudLoggingEntry
+	dropped int64
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	// tokenMu guards the cached token from the metadata server.
+	tokenMu      sync.Mutex
+	token        string
+	tokenExpires time.Time
+}
+
+// NewCloudLoggingPublisher creates a new CloudLoggingPublisher that writes
+// entries to a log in a project, attached to the `global` resource, using
+// DefaultCloudLoggingSeverityRules.
+func NewCloudLoggingPublisher(project, logName string, batchSize int, flushInterval time.Duration) *CloudLoggingPublisher {
+	var rules []CloudLoggingSeverityRule
+	for _, config := range DefaultCloudLoggingSeverityRules {
+		rule, err := NewCloudLoggingSeverityRule(config.Condition, config.Severity)
+		if err != nil {
+			panic(err)
+		}
+		rules = append(rules, rule)
+	}
+	return &CloudLoggingPublisher{
+		Project:         project,
+		LogName:         logName,
+		ResourceType:    "global",
+		ResourceLabels:  map[string]string{"project_id": project},
+		SeverityRules:   rules,
+		DefaultSeverity: "INFO",
+		BatchSize:       batchSize,
+		FlushInterval:   flushInterval,
+		MaxBuffered:     10 * batchSize,
+	}
+}
+
+func (p *CloudLoggingPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+func (p *CloudLoggingPublisher) client() *http.Client {
+	if p.Client == nil {
+		return http.DefaultClient
+	}
+	return p.Client
+}
+
+// Dropped returns the number of entries that have been dropped because the
+// buffer was full.
+func (p *CloudLoggingPublisher) Dropped() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+// severity returns the severity of the entry for a report.
+func (p *CloudLoggingPublisher) severity(batch *collector.ReportBatch, report *collector.NelReport) string {
+	for _, rule := range p.SeverityRules {
+		if rule.Where.Matches(batch, report) {
+			return rule.Severity
+		}
+	}
+	return p.DefaultSeverity
+}
+
+func (p *CloudLoggingPublisher) newEntry(batch *collector.ReportBatch, report *collector.NelReport) cloudLoggingEntry {
+	labels := map[string]string{"report_type": report.ReportType}
+	if report.Type != "" {
+		labels["type"] = report.Type
+	}
+	if report.Phase != "" {
+		labels["phase"] = report.Phase
+	}
+	entry := cloudLoggingEntry{
+		Timestamp:   report.EventTime(batch.Time).UTC(),
+		Severity:    p.severity(batch, report),
+		Labels:      labels,
+		JSONPayload: p.FieldNames.record(batch, report),
+	}
+	if report.ReportType == "network-error" {
+		entry.HTTPRequest = &cloudLoggingHTTPRequest{
+			RequestMethod: report.Method,
+			RequestURL:    report.URL,
+			Status:        report.StatusCode,
+			Referer:       report.Referrer,
+			ServerIP:      report.ServerIP,
+			Protocol:      report.Protocol,
+		}
+		if report.ElapsedTime > 0 {
+			latency := time.Duration(report.ElapsedTime) * time.Millisecond
+			entry.HTTPRequest.Latency = fmt.Sprintf("%gs", latency.Seconds())
+		}
+	}
+	return entry
+}
+
+// accessToken returns the token to authorize requests with, fetching a new
+// one from the metadata server if the cached one has expired.
+func (p *CloudLoggingPublisher) accessToken(ctx context.Context) (string, error) {
+	if p.AccessToken != "" {
+		return p.AccessToken, nil
+	}
+	p.tokenMu.Lock()
+	defer p.tokenMu.Unlock()
+	now := p.now()
+	if p.token != "" && now.Before(p.tokenExpires) {
+		return p.token, nil
+	}
+
+	metadataURL := p.MetadataURL
+	if metadataURL == "" {
+		metadataURL = DefaultMetadataTokenURL
+	}
+	r, err := http.NewRequest("GET", metadataURL, nil)
+	if err != nil {
+		return "", err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Metadata-Flavor", "Google")
+	response, err := p.client().Do(r)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't get an access token: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return "", fmt.Errorf("Couldn't get an access token: %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Couldn't get an access token: %v", err)
+	}
+	// Refresh the token a minute early, so that it doesn't expire while a
+	// request is in flight.
+	p.token = token.AccessToken
+	p.tokenExpires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return p.token, nil
+}
+
+// write sends a set of entries to Cloud Logging.
+func (p *CloudLoggingPublisher) write(ctx context.Context, entries []cloudLoggingEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(cloudLoggingRequest{
+		LogName:        fmt.Sprintf("projects/%s/logs/%s", p.Project, url.PathEscape(p.LogName)),
+		Resource:       cloudLoggingResource{Type: p.ResourceType, Labels: p.ResourceLabels},
+		Entries:        entries,
+		PartialSuccess: true,
+	})
+	if err != nil {
+		return err
+	}
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultCloudLoggingEndpoint
+	}
+	r, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := p.client().Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Couldn't write %d entries to Cloud Logging: %s: %s", len(entries), response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// flush writes every buffered entry, in requests of at most BatchSize entries,
+// returning the first error.
+func (p *CloudLoggingPublisher) flush(ctx context.Context) error {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+
+	var result error
+	for len(pending) > 0 {
+		n := len(pending)
+		if p.BatchSize > 0 && n > p.BatchSize {
+			n = p.BatchSize
+		}
+		if err := p.write(ctx, pending[:n]); err != nil && result == nil {
+			result = err
+		}
+		pending = pending[n:]
+	}
+	return result
+}
+
+// flushInBackground writes the buffered entries every FlushInterval (if it's
+// positive), and whenever ProcessReports fills a batch.
+func (p *CloudLoggingPublisher) flushInBackground() {
+	defer p.wg.Done()
+	var tick <-chan time.Time
+	if p.FlushInterval > 0 {
+		ticker := time.NewTicker(p.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-p.wake:
+		case <-p.done:
+			return
+		}
+		if err := p.flush(context.Background()); err != nil {
+			log.Printf("CloudLoggingPublisher: %v", err)
+		}
+	}
+}
+
+// ProcessReports buffers an entry for each report in the batch.
+func (p *CloudLoggingPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if len(batch.Reports) == 0 {
+		return
+	}
+	entries := make([]cloudLoggingEntry, len(batch.Reports))
+	for i := range batch.Reports {
+		entries[i] = p.newEntry(batch, &batch.Reports[i])
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done == nil {
+		p.wake = make(chan struct{}, 1)
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushInBackground()
+	}
+	for _, entry := range entries {
+		if p.MaxBuffered > 0 && len(p.pending) >= p.MaxBuffered {
+			p.dropped++
+			continue
+		}
+		p.pending = append(p.pending, entry)
+	}
+	if len(p.pending) >= p.BatchSize {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close writes any buffered entries.
+func (p *CloudLoggingPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return p.flush(context.Background())
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"CloudLoggingPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Project         string                           `toml:"project"`
+				LogName         string                           `toml:"log_name"`
+				ResourceType    string                           `toml:"resource_type"`
+				ResourceLabels  map[string]string                `toml:"resource_labels"`
+				DefaultSeverity string                           `toml:"default_severity"`
+				SeverityRules   []CloudLoggingSeverityRuleConfig `toml:"severity"`
+				BatchSize       int                              `toml:"batch_size"`
+				FlushInterval   string                           `toml:"flush_interval"`
+				MaxBuffered     int                              `toml:"max_buffered"`
+				Endpoint        string                           `toml:"endpoint"`
+				AccessToken     string                           `toml:"access_token"`
+				MetadataURL     string                           `toml:"metadata_url"`
+				FieldNames      map[string]string                `toml:"field_names"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("CloudLoggingPublisher invalid `field_names`: %v", err)
+			}
+
+			if config.Project == "" {
+				return nil, fmt.Errorf("CloudLoggingPublisher missing `project`")
+			}
+			if config.LogName == "" {
+				config.LogName = "nel-reports"
+			}
+			if config.BatchSize < 0 {
+				return nil, fmt.Errorf("CloudLoggingPublisher `batch_size` must not be negative")
+			}
+			if config.BatchSize == 0 {
+				config.BatchSize = 500
+			}
+			flushInterval := 5 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("CloudLoggingPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("CloudLoggingPublisher `flush_interval` must be positive")
+				}
+			}
+			if config.MaxBuffered < 0 {
+				return nil, fmt.Errorf("CloudLoggingPublisher `max_buffered` must not be negative")
+			}
+
+			p := NewCloudLoggingPublisher(config.Project, config.LogName, config.BatchSize, flushInterval)
+			p.Clock = clock
+			p.Endpoint = config.Endpoint
+			p.AccessToken = config.AccessToken
+			p.MetadataURL = config.MetadataURL
+			if config.MaxBuffered > 0 {
+				p.MaxBuffered = config.MaxBuffered
+			}
+			if config.ResourceType != "" {
+				p.ResourceType = config.ResourceType
+				p.ResourceLabels = nil
+			}
+			if config.ResourceLabels != nil {
+				p.ResourceLabels = config.ResourceLabels
+			}
+			if config.DefaultSeverity != "" {
+				if !cloudLoggingSeverities[config.DefaultSeverity] {
+					return nil, fmt.Errorf("CloudLoggingPublisher invalid `default_severity`: %s", config.DefaultSeverity)
+				}
+				p.DefaultSeverity = config.DefaultSeverity
+			}
+			if config.SeverityRules != nil {
+				p.SeverityRules = nil
+				for i, rule := range config.SeverityRules {
+					r, err := NewCloudLoggingSeverityRule(rule.Condition, rule.Severity)
+					if err != nil {
+						return nil, fmt.Errorf("CloudLoggingPublisher invalid `severity` %d: %v", i, err)
+					}
+					p.SeverityRules = append(p.SeverityRules, r)
+				}
+			}
+			p.FieldNames = fieldNames
+			return p, nil
+		})
+}
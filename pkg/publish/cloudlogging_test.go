@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+func TestCloudLoggingPublisher(t *testing.T) {
+	var mu sync.Mutex
+	tokens := 0
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		tokens++
+		mu.Unlock()
+		fmt.Fprint(w, `{"access_token": "hunter2", "expires_in": 3600, "token_type": "Bearer"}`)
+	}))
+	defer metadata.Close()
+
+	var requests []map[string]interface{}
+	var entries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hunter2" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var request struct {
+			LogName  string                 `json:"logName"`
+			Resource map[string]interface{} `json:"resource"`
+			Entries  []struct {
+				Timestamp   string                 `json:"timestamp"`
+				Severity    string                 `json:"severity"`
+				Labels      map[string]string      `json:"labels"`
+				HTTPRequest map[string]interface{} `json:"httpRequest"`
+				JSONPayload map[string]interface{} `json:"jsonPayload"`
+			} `json:"entries"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, map[string]interface{}{"logName": request.LogName, "resource": request.Resource})
+		for _, entry := range request.Entries {
+			entries = append(entries, fmt.Sprintf("%s %s %v %v %v", entry.Timestamp, entry.Severity, entry.Labels, entry.HTTPRequest, entry.JSONPayload["url"]))
+		}
+	}))
+	defer server.Close()
+
+	p := publish.NewCloudLoggingPublisher("my-project", "nel/reports", 2, 0)
+	p.Endpoint = server.URL
+	p.MetadataURL = metadata.URL
+	p.ResourceType = "gce_instance"
+	p.ResourceLabels = map[string]string{"instance_id": "1234", "zone": "us-central1-a"}
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	p.ProcessReports(context.Background(), &collector.ReportBatch{Time: received, Reports: []collector.NelReport{
+		{Age: 500, ReportType: "network-error", URL: "https://a/", Phase: "dns", Type: "dns.name_not_resolved"},
+		{ReportType: "network-error", URL: "https://b/", Method: "GET", Protocol: "h2", Phase: "application", Type: "http.error", StatusCode: 404, ElapsedTime: 45},
+		{ReportType: "network-error", URL: "https://c/", Phase: "application", Type: "ok", StatusCode: 200},
+		{ReportType: "csp-violation", URL: "https://d/"},
+	}})
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"2024-01-02T15:29:59.5Z ERROR map[phase:dns report_type:network-error type:dns.name_not_resolved] map[requestUrl:https://a/] https://a/",
+		"2024-01-02T15:30:00Z WARNING map[phase:application report_type:network-error type:http.error] map[latency:0.045s protocol:h2 requestMethod:GET requestUrl:https://b/ status:404] https://b/",
+		"2024-01-02T15:30:00Z INFO map[phase:application report_type:network-error type:ok] map[requestUrl:https://c/ status:200] https://c/",
+		"2024-01-02T15:30:00Z INFO map[report_type:csp-violation] map[] https://d/",
+	}
+	if diff := cmp.Diff(want, entries); diff != "" {
+		t.Errorf("CloudLoggingPublisher wrote entries with diff (-want +got):\n%s", diff)
+	}
+	wantRequest := map[string]interface{}{
+		"logName":  "projects/my-project/logs/nel%2Freports",
+		"resource": map[string]interface{}{"type": "gce_instance", "labels": map[string]interface{}{"instance_id": "1234", "zone": "us-central1-a"}},
+	}
+	if got, want := len(requests), 2; got != want {
+		t.Fatalf("CloudLoggingPublisher sent %d requests, wanted %d", got, want)
+	}
+	if diff := cmp.Diff(wantRequest, requests[0]); diff != "" {
+		t.Errorf("CloudLoggingPublisher sent request with diff (-want +got):\n%s", diff)
+	}
+	// The token is cached until it expires.
+	if tokens != 1 {
+		t.Errorf("CloudLoggingPublisher fetched %d tokens, wanted 1", tokens)
+	}
+}
+
+func TestCloudLoggingPublisherDropsWhenFull(t *testing.T) {
+	var mu sync.Mutex
+	written := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Entries []json.RawMessage `json:"entries"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		written += len(request.Entries)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// A huge batch size means that nothing is written until Close.
+	p := publish.NewCloudLoggingPublisher("my-project", "nel-reports", 1000, 0)
+	p.Endpoint = server.URL
+	p.AccessToken = "hunter2"
+	p.MaxBuffered = 3
+	for i := 0; i < 5; i++ {
+		p.ProcessReports(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "network-error", Type: "ok"}}})
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if written != 3 || p.Dropped() != 2 {
+		t.Errorf("CloudLoggingPublisher wrote %d entries and dropped %d, wanted 3 and 2", written, p.Dropped())
+	}
+}
+
+func TestCloudLoggingPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		"project = \"p\"\nbatch_size = -1",
+		"project = \"p\"\nflush_interval = \"soon\"",
+		"project = \"p\"\nflush_interval = \"0s\"",
+		"project = \"p\"\nmax_buffered = -1",
+		"project = \"p\"\ndefault_severity = \"LOUD\"",
+		"project = \"p\"\nseverity = [{condition = \"phase == 'dns'\", severity = \"LOUD\"}]",
+		"project = \"p\"\nseverity = [{condition = \"phase ==\", severity = \"ERROR\"}]",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"CloudLoggingPublisher\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
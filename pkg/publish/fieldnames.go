@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// objectRecordFields are the names of the top-level fields of the JSON
+// records that publishers write (see objectRecord).
+var objectRecordFields = map[string]bool{
+	"received_at":       true,
+	"client_ip":         true,
+	"age":               true,
+	"report_type":       true,
+	"url":               true,
+	"user_agent":        true,
+	"referrer":          true,
+	"sampling_fraction": true,
+	"server_ip":         true,
+	"protocol":          true,
+	"method":            true,
+	"status_code":       true,
+	"elapsed_time":      true,
+	"phase":             true,
+	"type":              true,
+	"body":              true,
+	"annotations":       true,
+}
+
+// FieldNames renames the fields of the JSON records that publishers write for
+// each report, for downstream schemas that use different names; for
+// instance, {"report_type": "event_type", "url": "target_url"}.  Each key is
+// the name of one of a record's top-level fields (received_at, client_ip, or
+// one of the fields of collector.WireReport), and its value is the name to
+// use instead.  Fields that aren't mentioned keep their usual names, and the
+// fields stay in their usual order.  Annotations keep their own names, though
+// the `annotations` field itself can be renamed.
+//
+// The publishers that write these records (ObjectStorePublisher,
+// KinesisPublisher, CloudLoggingPublisher, LokiPublisher, NATSPublisher,
+// PulsarPublisher, AMQPPublisher, ClickHousePublisher's `raw` column,
+// SentryPublisher, and WebhookPublisher's default body and `.Record`) all
+// accept a `field_names` table in their configuration, which is parsed with
+// ParseFieldNames.
+type FieldNames map[string]string
+
+// ParseFieldNames checks a field-name mapping, returning an error if it
+// renames a field that records don't have, or if two fields would end up with
+// the same name.
+func ParseFieldNames(names map[string]string) (FieldNames, error) {
+	fields := make([]string, 0, len(names))
+	for field := range names {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	final := make(map[string]string, len(objectRecordFields))
+	for field := range objectRecordFields {
+		final[field] = field
+	}
+	for _, field := range fields {
+		if !objectRecordFields[field] {
+			return nil, fmt.Errorf("unknown field %s", field)
+		}
+		if names[field] == "" {
+			return nil, fmt.Errorf("empty name for %s", field)
+		}
+		final[field] = names[field]
+	}
+	owners := make(map[string]string, len(final))
+	for _, field := range fields {
+		owners[final[field]] = field
+	}
+	all := make([]string, 0, len(final))
+	for field := range final {
+		all = append(all, field)
+	}
+	sort.Strings(all)
+	for _, field := range all {
+		if owner, ok := owners[final[field]]; ok && owner != field {
+			return nil, fmt.Errorf("%s and %s would both be named %s", owner, field, final[field])
+		}
+	}
+	return FieldNames(names), nil
+}
+
+// renamedRecord is an objectRecord whose fields are renamed when it's encoded
+// as JSON.
+type renamedRecord struct {
+	record objectRecord
+	names  FieldNames
+}
+
+// MarshalJSON encodes the record as usual, and then renames its fields.
+func (r renamedRecord) MarshalJSON() ([]byte, error) {
+	encoded, err := json.Marshal(r.record)
+	if err != nil {
+		return nil, err
+	}
+	return r.names.rename(encoded)
+}
+
+// rename renames the top-level fields of an encoded JSON object, keeping them
+// in the same order.
+func (f FieldNames) rename(encoded []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	var result bytes.Buffer
+	result.WriteByte('{')
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		name, _ := token.(string)
+		key, err := json.Marshal(f.name(name))
+		if err != nil {
+			return nil, err
+		}
+		if result.Len() > 1 {
+			result.WriteByte(',')
+		}
+		result.Write(key)
+		result.WriteByte(':')
+		result.Write(value)
+	}
+	result.WriteByte('}')
+	return result.Bytes(), nil
+}
+
+// name returns the name that a field is renamed to.
+func (f FieldNames) name(field string) string {
+	if renamed, ok := f[field]; ok {
+		return renamed
+	}
+	return field
+}
+
+// record returns the JSON record for a report, with its fields renamed.
+func (f FieldNames) record(batch *collector.ReportBatch, report *collector.NelReport) interface{} {
+	record := newObjectRecord(batch, report)
+	if len(f) == 0 {
+		return record
+	}
+	return renamedRecord{record, f}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+func TestFieldNames(t *testing.T) {
+	names, err := publish.ParseFieldNames(map[string]string{
+		"report_type": "event_type",
+		"url":         "target_url",
+		"annotations": "labels",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memoryStore{objects: make(map[string][]byte)}
+	p := publish.NewObjectStorePublisher(store, 1000, time.Hour)
+	p.FieldNames = names
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	first := strings.SplitN(string(store.objects[store.keys[0]]), "\n", 2)[0]
+	want := `{"received_at":"2024-01-02T15:30:00Z","client_ip":"192.0.2.1","age":500,"event_type":"network-error","target_url":"https://a/","user_agent":"","phase":"connection","type":"tcp.timed_out","labels":{"Service":"web"}}`
+	if first != want {
+		t.Errorf("ObjectStorePublisher with FieldNames wrote %s, wanted %s", first, want)
+	}
+
+	// The renamed record is also what webhook templates see.
+	server := &webhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	tmpl, err := publish.ParseWebhookTemplate(`{{json .Report.Record}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook := publish.NewWebhookPublisher(ts.URL, tmpl)
+	webhook.FieldNames = publish.FieldNames{"status_code": "http_status"}
+	batch := webhookBatch()
+	batch.Reports = batch.Reports[1:2]
+	if err := webhook.TryProcessReports(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	wantRequests := []string{`POST {"received_at":"2024-01-02T15:30:00Z","client_ip":"192.0.2.1","age":0,"report_type":"network-error","url":"https://b/","user_agent":"","http_status":200,"phase":"application","type":"ok"}`}
+	if diff := cmp.Diff(wantRequests, server.requests); diff != "" {
+		t.Errorf("WebhookPublisher with FieldNames requests diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseFieldNamesErrors(t *testing.T) {
+	for _, names := range []map[string]string{
+		{"report_typ": "event_type"},
+		{"url": ""},
+		{"url": "type"},
+		{"url": "target", "referrer": "target"},
+	} {
+		if _, err := publish.ParseFieldNames(names); err == nil {
+			t.Errorf("ParseFieldNames(%v) should return error", names)
+		}
+	}
+	// Fields can swap names.
+	if _, err := publish.ParseFieldNames(map[string]string{"url": "referrer", "referrer": "url"}); err != nil {
+		t.Errorf("ParseFieldNames with swapped names: %v", err)
+	}
+
+	config := "[[processor]]\ntype = \"LokiPublisher\"\nendpoint = \"http://localhost:3100\"\nfield_names = {colour = \"color\"}"
+	var pipeline collector.Pipeline
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+		t.Errorf("LoadFromConfig(%s) should return error", config)
+	}
+}
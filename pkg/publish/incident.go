@@ -0,0 +1,429 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// The default endpoints of the alerting providers that IncidentAlert supports.
+const (
+	DefaultPagerDutyEndpoint = "https://events.pagerduty.com/v2/enqueue"
+	DefaultOpsgenieEndpoint  = "https://api.opsgenie.com/v2/alerts"
+)
+
+// opsgeniePriorities maps IncidentAlert severities to Opsgenie priorities.
+var opsgeniePriorities = map[string]string{
+	"critical": "P1",
+	"error":    "P2",
+	"warning":  "P3",
+	"info":     "P5",
+}
+
+// incidentCall is a request to the alerting provider that's waiting to be
+// sent.
+type incidentCall struct {
+	resolve bool
+	event   core.OutageEvent
+	reports int
+}
+
+type incidentState struct {
+	open      bool
+	triggered time.Time
+}
+
+// IncidentAlert is a pipeline processor that opens incidents in PagerDuty or
+// Opsgenie for the outages that an OutageDetector finds.  It belongs in an
+// OutageDetector's Alert chain: each batch with an Outage annotation triggers
+// an incident for its host, and (if Resolve is set) each batch with an
+// OutageResolved annotation resolves it.  (The OutageDetector has to have
+// AlertResolved set for the latter.)  Other batches are ignored.
+//
+// Incidents are deduplicated by host, using PagerDuty's dedup_key or
+// Opsgenie's alias, so another trigger for a host whose incident is still open
+// updates it rather than opening a new one.  We don't send another trigger for
+// an open incident until DedupWindow has passed since the last one.
+//
+// To avoid flooding the provider during a widespread outage, we make at most
+// MaxCallsPerMinute calls each minute (if it isn't 0); any others are dropped
+// (see Dropped).  Calls are made in the background, so that a slow provider
+// doesn't hold up the pipeline, and any that are still waiting are made when
+// the pipeline is closed.
+type IncidentAlert struct {
+	// Either "pagerduty" or "opsgenie".
+	Provider string
+
+	// The PagerDuty integration (routing) key, or the Opsgenie API key.
+	RoutingKey string
+
+	// The URL to send events or alerts to; see DefaultPagerDutyEndpoint and
+	// DefaultOpsgenieEndpoint.
+	Endpoint string
+
+	// The severity of the incidents: critical, error, warning, or info.
+	Severity string
+
+	DedupWindow       time.Duration
+	Resolve           bool
+	MaxCallsPerMinute int
+
+	// The client used to make calls.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used for DedupWindow and MaxCallsPerMinute.  If nil, we use the
+	// current time.
+	Clock collector.Clock
+
+	mu          sync.Mutex
+	incidents   map[string]*incidentState
+	pending     []incidentCall
+	windowStart time.Time
+	windowCount int
+	dropped     int64
+	wake        chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewIncidentAlert creates a new IncidentAlert that opens incidents with the
+// given provider ("pagerduty" or "opsgenie") at its default endpoint.
+func NewIncidentAlert(provider, routingKey string) (*IncidentAlert, error) {
+	a := &IncidentAlert{
+		Provider:          provider,
+		RoutingKey:        routingKey,
+		Severity:          "critical",
+		DedupWindow:       time.Hour,
+		Resolve:           true,
+		MaxCallsPerMinute: 10,
+	}
+	switch provider {
+	case "pagerduty":
+		a.Endpoint = DefaultPagerDutyEndpoint
+	case "opsgenie":
+		a.Endpoint = DefaultOpsgenieEndpoint
+	default:
+		return nil, fmt.Errorf("unknown provider %s", provider)
+	}
+	return a, nil
+}
+
+func (a *IncidentAlert) now() time.Time {
+	if a.Clock == nil {
+		return time.Now()
+	}
+	return a.Clock.Now()
+}
+
+// Dropped returns the number of calls that have been dropped because they
+// exceeded MaxCallsPerMinute.
+func (a *IncidentAlert) Dropped() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dropped
+}
+
+// dedupKey returns the PagerDuty dedup_key or Opsgenie alias for a host's
+// incidents.
+func dedupKey(key string) string {
+	return "nel-collector/" + key
+}
+
+func incidentSummary(event core.OutageEvent) string {
+	return fmt.Sprintf("Suspected outage for %s: %.2f failures/s (baseline %.2f/s)", event.Key, event.Rate, event.Baseline)
+}
+
+func incidentDetails(call incidentCall) map[string]interface{} {
+	return map[string]interface{}{
+		"key":          call.event.Key,
+		"rate":         call.event.Rate,
+		"baseline":     call.event.Baseline,
+		"reports":      call.reports,
+		"detected_at":  call.event.Time.UTC().Format(time.RFC3339),
+		"resolved":     call.resolve,
+		"triggered_by": "OutageDetector",
+	}
+}
+
+// request builds the HTTP request for a call.
+func (a *IncidentAlert) request(call incidentCall) (*http.Request, error) {
+	var endpoint string
+	var body interface{}
+	switch a.Provider {
+	case "pagerduty":
+		endpoint = a.Endpoint
+		event := map[string]interface{}{
+			"routing_key":  a.RoutingKey,
+			"event_action": "trigger",
+			"dedup_key":    dedupKey(call.event.Key),
+		}
+		if call.resolve {
+			event["event_action"] = "resolve"
+		} else {
+			event["payload"] = map[string]interface{}{
+				"summary":        incidentSummary(call.event),
+				"source":         call.event.Key,
+				"severity":       a.Severity,
+				"timestamp":      call.event.Time.UTC().Format(time.RFC3339),
+				"component":      "nel-collector",
+				"custom_details": incidentDetails(call),
+			}
+		}
+		body = event
+	case "opsgenie":
+		if call.resolve {
+			endpoint = strings.TrimSuffix(a.Endpoint, "/") + "/" + url.PathEscape(dedupKey(call.event.Key)) + "/close?identifierType=alias"
+			body = map[string]interface{}{
+				"source": "nel-collector",
+				"note":   fmt.Sprintf("Failure rate for %s is back to normal", call.event.Key),
+			}
+		} else {
+			endpoint = a.Endpoint
+			details := make(map[string]string)
+			for name, value := range incidentDetails(call) {
+				details[name] = fmt.Sprint(value)
+			}
+			body = map[string]interface{}{
+				"message":     incidentSummary(call.event),
+				"alias":       dedupKey(call.event.Key),
+				"source":      "nel-collector",
+				"entity":      call.event.Key,
+				"priority":    opsgeniePriorities[a.Severity],
+				"details":     details,
+				"description": incidentSummary(call.event),
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown provider %s", a.Provider)
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if a.Provider == "opsgenie" {
+		r.Header.Set("Authorization", "GenieKey "+a.RoutingKey)
+	}
+	return r, nil
+}
+
+// send makes a single call to the alerting provider.
+func (a *IncidentAlert) send(ctx context.Context, call incidentCall) error {
+	r, err := a.request(call)
+	if err != nil {
+		return err
+	}
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Couldn't send %s call for %s: %s: %s", a.Provider, call.event.Key, response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// flush makes every pending call, returning the first error.
+func (a *IncidentAlert) flush(ctx context.Context) error {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	var result error
+	for _, call := range pending {
+		if err := a.send(ctx, call); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// sendInBackground makes the pending calls whenever there are some.
+func (a *IncidentAlert) sendInBackground() {
+	defer a.wg.Done()
+	for {
+		select {
+		case <-a.wake:
+			if err := a.flush(context.Background()); err != nil {
+				log.Printf("IncidentAlert: %v", err)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// ProcessReports triggers or resolves an incident, if the batch describes an
+// outage.
+func (a *IncidentAlert) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	call := incidentCall{reports: len(batch.Reports)}
+	if event, ok := batch.GetAnnotation("Outage").(core.OutageEvent); ok {
+		call.event = event
+	} else if event, ok := batch.GetAnnotation("OutageResolved").(core.OutageEvent); ok && a.Resolve {
+		call.event = event
+		call.resolve = true
+	} else {
+		return
+	}
+	now := a.now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.incidents == nil {
+		a.incidents = make(map[string]*incidentState)
+	}
+	state := a.incidents[call.event.Key]
+	if call.resolve {
+		// We only resolve incidents that we opened.
+		if state == nil || !state.open {
+			return
+		}
+	} else if state != nil && state.open && now.Sub(state.triggered) < a.DedupWindow {
+		return
+	}
+
+	if now.Sub(a.windowStart) >= time.Minute {
+		a.windowStart = now
+		a.windowCount = 0
+	}
+	if a.MaxCallsPerMinute > 0 && a.windowCount >= a.MaxCallsPerMinute {
+		a.dropped++
+		return
+	}
+	a.windowCount++
+
+	if call.resolve {
+		delete(a.incidents, call.event.Key)
+	} else {
+		a.incidents[call.event.Key] = &incidentState{open: true, triggered: now}
+	}
+	a.pending = append(a.pending, call)
+	if a.done == nil {
+		a.wake = make(chan struct{}, 1)
+		a.done = make(chan struct{})
+		a.wg.Add(1)
+		go a.sendInBackground()
+	}
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close makes any pending calls.
+func (a *IncidentAlert) Close() error {
+	a.mu.Lock()
+	if a.done != nil {
+		close(a.done)
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+	return a.flush(context.Background())
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"IncidentAlert",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Provider          string `toml:"provider"`
+				RoutingKey        string `toml:"routing_key"`
+				Endpoint          string `toml:"endpoint"`
+				Severity          string `toml:"severity"`
+				DedupWindow       string `toml:"dedup_window"`
+				Resolve           string `toml:"resolve"`
+				MaxCallsPerMinute *int   `toml:"max_calls_per_minute"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Provider == "" {
+				return nil, fmt.Errorf("IncidentAlert missing `provider`")
+			}
+			if config.RoutingKey == "" {
+				return nil, fmt.Errorf("IncidentAlert missing `routing_key`")
+			}
+			a, err := NewIncidentAlert(config.Provider, config.RoutingKey)
+			if err != nil {
+				return nil, fmt.Errorf("IncidentAlert invalid `provider`: %s", config.Provider)
+			}
+			if config.Endpoint != "" {
+				u, err := url.Parse(config.Endpoint)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return nil, fmt.Errorf("IncidentAlert invalid `endpoint`: %s", config.Endpoint)
+				}
+				a.Endpoint = config.Endpoint
+			}
+			if config.Severity != "" {
+				if _, ok := opsgeniePriorities[config.Severity]; !ok {
+					return nil, fmt.Errorf("IncidentAlert invalid `severity`: %s", config.Severity)
+				}
+				a.Severity = config.Severity
+			}
+			if config.DedupWindow != "" {
+				a.DedupWindow, err = time.ParseDuration(config.DedupWindow)
+				if err != nil {
+					return nil, fmt.Errorf("IncidentAlert invalid `dedup_window`: %v", err)
+				}
+				if a.DedupWindow < 0 {
+					return nil, fmt.Errorf("IncidentAlert `dedup_window` must not be negative")
+				}
+			}
+			switch config.Resolve {
+			case "", "auto":
+				a.Resolve = true
+			case "manual":
+				a.Resolve = false
+			default:
+				return nil, fmt.Errorf("IncidentAlert invalid `resolve`: %s", config.Resolve)
+			}
+			if config.MaxCallsPerMinute != nil {
+				if *config.MaxCallsPerMinute < 0 {
+					return nil, fmt.Errorf("IncidentAlert `max_calls_per_minute` must not be negative")
+				}
+				a.MaxCallsPerMinute = *config.MaxCallsPerMinute
+			}
+			a.Clock = clock
+			return a, nil
+		})
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// incidentServer records a summary of each call that an IncidentAlert makes.
+func incidentServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var call string
+		switch {
+		case r.Header.Get("Authorization") != "":
+			// Opsgenie
+			call = fmt.Sprintf("%s %s %v %v %v", r.Header.Get("Authorization"), r.URL.RequestURI(), body["alias"], body["priority"], body["message"])
+		default:
+			// PagerDuty
+			payload, _ := body["payload"].(map[string]interface{})
+			call = fmt.Sprintf("%s %s %s %v %v", body["routing_key"], body["event_action"], body["dedup_key"], payload["severity"], payload["summary"])
+		}
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+func outageBatch(annotation, key string, rate float64) *collector.ReportBatch {
+	batch := &collector.ReportBatch{Reports: []collector.NelReport{{URL: "https://" + key + "/"}}}
+	batch.SetAnnotation(annotation, core.OutageEvent{Key: key, Rate: rate, Baseline: 0.5, Time: time.Unix(0, 0)})
+	return batch
+}
+
+func TestIncidentAlert(t *testing.T) {
+	server, calls := incidentServer(t)
+	defer server.Close()
+
+	clock := pipelinetest.NewSimulatedClock()
+	a, err := publish.NewIncidentAlert("pagerduty", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Endpoint = server.URL + "/v2/enqueue"
+	a.Clock = clock
+	a.DedupWindow = 10 * time.Minute
+	a.MaxCallsPerMinute = 3
+	ctx := context.Background()
+
+	a.ProcessReports(ctx, outageBatch("Outage", "a.example", 10))
+	// Deduplicated, since the incident is still open.
+	a.ProcessReports(ctx, outageBatch("Outage", "a.example", 20))
+	// Ignored, since it doesn't describe an outage.
+	a.ProcessReports(ctx, &collector.ReportBatch{})
+	// Ignored, since we didn't open an incident for it.
+	a.ProcessReports(ctx, outageBatch("OutageResolved", "b.example", 0))
+	a.ProcessReports(ctx, outageBatch("Outage", "b.example", 5))
+	a.ProcessReports(ctx, outageBatch("OutageResolved", "b.example", 0))
+	// Over the rate limit.
+	a.ProcessReports(ctx, outageBatch("Outage", "c.example", 5))
+
+	// Once the dedup window has passed, we update the open incident.
+	clock.CurrentTime = clock.CurrentTime.Add(15 * time.Minute)
+	a.ProcessReports(ctx, outageBatch("Outage", "a.example", 30))
+	a.ProcessReports(ctx, outageBatch("OutageResolved", "a.example", 0))
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"routing trigger nel-collector/a.example critical Suspected outage for a.example: 10.00 failures/s (baseline 0.50/s)",
+		"routing trigger nel-collector/b.example critical Suspected outage for b.example: 5.00 failures/s (baseline 0.50/s)",
+		"routing resolve nel-collector/b.example <nil> <nil>",
+		"routing trigger nel-collector/a.example critical Suspected outage for a.example: 30.00 failures/s (baseline 0.50/s)",
+		"routing resolve nel-collector/a.example <nil> <nil>",
+	}
+	if diff := cmp.Diff(want, calls()); diff != "" {
+		t.Errorf("IncidentAlert calls diff (-want +got):\n%s", diff)
+	}
+	if got, want := a.Dropped(), int64(1); got != want {
+		t.Errorf("IncidentAlert dropped %d calls, wanted %d", got, want)
+	}
+}
+
+func TestIncidentAlertOpsgenie(t *testing.T) {
+	server, calls := incidentServer(t)
+	defer server.Close()
+
+	clock := pipelinetest.NewSimulatedClock()
+	pipeline := collector.NewTestPipeline(clock)
+	err := pipeline.LoadFromConfig(context.Background(), []byte(fmt.Sprintf(`
+		[[processor]]
+		type = "IncidentAlert"
+		provider = "opsgenie"
+		routing_key = "genie"
+		endpoint = "%s/v2/alerts"
+		severity = "warning"
+		resolve = "manual"
+	`, server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	pipeline.ProcessBatch(ctx, outageBatch("Outage", "a.example", 10))
+	pipeline.ProcessBatch(ctx, outageBatch("OutageResolved", "a.example", 0))
+	pipeline.Close()
+
+	want := []string{
+		"GenieKey genie /v2/alerts nel-collector/a.example P3 Suspected outage for a.example: 10.00 failures/s (baseline 0.50/s)",
+	}
+	if diff := cmp.Diff(want, calls()); diff != "" {
+		t.Errorf("IncidentAlert calls diff (-want +got):\n%s", diff)
+	}
+
+	// With automatic resolution, the alert is closed by its alias.
+	a, err := publish.NewIncidentAlert("opsgenie", "genie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Endpoint = server.URL + "/v2/alerts"
+	a.Clock = clock
+	a.ProcessReports(ctx, outageBatch("Outage", "b.example", 10))
+	a.ProcessReports(ctx, outageBatch("OutageResolved", "b.example", 0))
+	a.Close()
+	want = append(want,
+		"GenieKey genie /v2/alerts nel-collector/b.example P1 Suspected outage for b.example: 10.00 failures/s (baseline 0.50/s)",
+		"GenieKey genie /v2/alerts/nel-collector%2Fb.example/close?identifierType=alias <nil> <nil> <nil>",
+	)
+	if diff := cmp.Diff(want, calls()); diff != "" {
+		t.Errorf("IncidentAlert calls diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestIncidentAlertBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`routing_key = "key"`,
+		`provider = "pagerduty"`,
+		"provider = \"victorops\"\nrouting_key = \"key\"",
+		"provider = \"pagerduty\"\nrouting_key = \"key\"\nendpoint = \"events.pagerduty.com\"",
+		"provider = \"pagerduty\"\nrouting_key = \"key\"\nseverity = \"dire\"",
+		"provider = \"pagerduty\"\nrouting_key = \"key\"\ndedup_window = \"soon\"",
+		"provider = \"pagerduty\"\nrouting_key = \"key\"\ndedup_window = \"-1m\"",
+		"provider = \"pagerduty\"\nrouting_key = \"key\"\nresolve = \"sometimes\"",
+		"provider = \"pagerduty\"\nrouting_key = \"key\"\nmax_calls_per_minute = -1",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"IncidentAlert\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
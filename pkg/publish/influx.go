@@ -0,0 +1,401 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// influxTag returns the function that extracts a tag from a report, or nil if
+// there's no such field.  InfluxPublisher can use the same fields as
+// LokiPublisher's labels, plus the host of the report's URL.
+func influxTag(name string) func(report *collector.NelReport) string {
+	if name == "host" {
+		return func(report *collector.NelReport) string {
+			u, err := url.Parse(report.URL)
+			if err != nil {
+				return ""
+			}
+			return u.Hostname()
+		}
+	}
+	return reportLabels[name]
+}
+
+// DefaultInfluxTags are the report fields that InfluxPublisher turns into
+// tags, unless you choose different ones.
+var DefaultInfluxTags = []string{"type", "phase", "status_class", "host"}
+
+// influxPoint is a point that's waiting to be written, which combines all of
+// the reports with the same series and timestamp.
+type influxPoint struct {
+	series  string
+	time    time.Time
+	count   int64
+	elapsed int64
+}
+
+// InfluxPublisher is a pipeline processor that writes a point to InfluxDB for
+// each report, in the `nel` measurement (or Measurement).  Each point is
+// timestamped with the report's event time (see NelReport.EventTime), and has
+// two fields: `count`, the number of reports, and `elapsed_time`, their mean
+// elapsed_time in milliseconds.  (Reports with the same tags and timestamp are
+// combined into one point, since InfluxDB would otherwise keep only one of
+// them.)
+//
+// Each point's tags are StaticTags, plus one tag for each of the report fields
+// in Tags.  (A field that's empty in a particular report doesn't get a tag.)
+// Every distinct combination of tags is a separate series in InfluxDB, so
+// choose Tags carefully: the fields that can be used are `report_type`,
+// `type`, `phase`, `method`, `protocol`, `status_class` (such as "5xx"), and
+// `host` (the host of the report's URL), which is the only one whose
+// cardinality isn't bounded by the NEL spec.
+//
+// Reports are buffered in memory until there are BatchSize of them, or until
+// the oldest buffered report is FlushInterval old; the buffer is then written
+// as a single request.  Anything left in the buffer is written when the
+// pipeline is closed.
+type InfluxPublisher struct {
+	// The URL of InfluxDB's write API, including the bucket (or database) and
+	// precision; see NewInfluxPublisher.
+	Endpoint string
+
+	// If set, we send this in the Authorization header of each request.
+	Token string
+
+	Measurement string
+	Tags        []string
+	StaticTags  map[string]string
+
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// The client used to write points.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to decide when the buffer is old enough to write.  If nil,
+	// we use the current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	pending map[string]*influxPoint
+	count   int
+	started time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// InfluxWriteURL returns the URL of the write API of the InfluxDB server at
+// base.  If bucket is set, we use the InfluxDB 2 API, writing to the bucket in
+// org; otherwise we use the InfluxDB 1 API, writing to database.
+func InfluxWriteURL(base, org, bucket, database string) string {
+	query := url.Values{"precision": {"ns"}}
+	path := "/write"
+	if bucket != "" {
+		path = "/api/v2/write"
+		query.Set("bucket", bucket)
+		if org != "" {
+			query.Set("org", org)
+		}
+	} else {
+		query.Set("db", database)
+	}
+	return strings.TrimSuffix(base, "/") + path + "?" + query.Encode()
+}
+
+// NewInfluxPublisher creates a new InfluxPublisher that writes to endpoint
+// (see InfluxWriteURL), using DefaultInfluxTags.
+func NewInfluxPublisher(endpoint string, batchSize int, flushInterval time.Duration) *InfluxPublisher {
+	return &InfluxPublisher{
+		Endpoint:      endpoint,
+		Measurement:   "nel",
+		Tags:          DefaultInfluxTags,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+	}
+}
+
+func (p *InfluxPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// influxEscaper escapes tag keys and values in line protocol.
+var influxEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, `\`, `\\`, "\n", `\n`)
+
+// influxMeasurementEscaper escapes measurement names in line protocol.
+var influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, `\`, `\\`, "\n", `\n`)
+
+// series returns the series that a report belongs to, in line protocol: the
+// measurement, followed by its tags, sorted by name.
+func (p *InfluxPublisher) series(report *collector.NelReport) string {
+	tags := make(map[string]string)
+	for name, value := range p.StaticTags {
+		tags[name] = value
+	}
+	for _, name := range p.Tags {
+		if value := influxTag(name)(report); value != "" {
+			tags[name] = value
+		}
+	}
+	var names []string
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	series := influxMeasurementEscaper.Replace(p.Measurement)
+	for _, name := range names {
+		if tags[name] == "" {
+			continue
+		}
+		series += "," + influxEscaper.Replace(name) + "=" + influxEscaper.Replace(tags[name])
+	}
+	return series
+}
+
+// take removes the buffered points, so that they can be written.  p.mu must be
+// held.
+func (p *InfluxPublisher) take() map[string]*influxPoint {
+	pending := p.pending
+	p.pending = nil
+	p.count = 0
+	return pending
+}
+
+// encodeInfluxPoints encodes a set of points in line protocol, sorted by
+// series and then by time.
+func encodeInfluxPoints(points map[string]*influxPoint) []byte {
+	sorted := make([]*influxPoint, 0, len(points))
+	for _, point := range points {
+		sorted = append(sorted, point)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].series != sorted[j].series {
+			return sorted[i].series < sorted[j].series
+		}
+		return sorted[i].time.Before(sorted[j].time)
+	})
+	var body bytes.Buffer
+	for _, point := range sorted {
+		mean := float64(point.elapsed) / float64(point.count)
+		fmt.Fprintf(&body, "%s count=%di,elapsed_time=%s %d\n",
+			point.series, point.count, strconv.FormatFloat(mean, 'f', -1, 64), point.time.UnixNano())
+	}
+	return body.Bytes()
+}
+
+// write sends a set of points to InfluxDB.
+func (p *InfluxPublisher) write(ctx context.Context, points map[string]*influxPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	r, err := http.NewRequest("POST", p.Endpoint, bytes.NewReader(encodeInfluxPoints(points)))
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.Token != "" {
+		r.Header.Set("Authorization", "Token "+p.Token)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Couldn't write points to %s: %s: %s", p.Endpoint, response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// flushPeriodically writes the buffer every FlushInterval, so that reports
+// don't sit in the buffer for too long when they're arriving slowly.
+func (p *InfluxPublisher) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			if err := p.write(context.Background(), pending); err != nil {
+				log.Printf("InfluxPublisher: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports buffers a point for each report in the batch, writing the
+// buffer once it's big enough or old enough.
+func (p *InfluxPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("InfluxPublisher: %v", err)
+	}
+}
+
+// TryProcessReports buffers a point for each report in the batch, writing the
+// buffer once it's big enough or old enough, and returns an error if that
+// write fails.  Note that a failed write can include reports from earlier
+// batches, which are lost.
+func (p *InfluxPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	series := make([]string, len(batch.Reports))
+	for i := range batch.Reports {
+		series[i] = p.series(&batch.Reports[i])
+	}
+	now := p.now()
+
+	var ready map[string]*influxPoint
+	p.mu.Lock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if p.pending == nil {
+		p.pending = make(map[string]*influxPoint)
+		p.started = now
+	}
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		when := report.EventTime(batch.Time)
+		key := series[i] + " " + strconv.FormatInt(when.UnixNano(), 10)
+		point := p.pending[key]
+		if point == nil {
+			point = &influxPoint{series: series[i], time: when}
+			p.pending[key] = point
+		}
+		point.count++
+		point.elapsed += int64(report.ElapsedTime)
+	}
+	p.count += len(batch.Reports)
+	if p.count >= p.BatchSize || (p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval) {
+		ready = p.take()
+	}
+	p.mu.Unlock()
+
+	return p.write(ctx, ready)
+}
+
+// Close writes anything left in the buffer.
+func (p *InfluxPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	pending := p.take()
+	p.mu.Unlock()
+	return p.write(context.Background(), pending)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"InfluxPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				URL           string            `toml:"url"`
+				Org           string            `toml:"org"`
+				Bucket        string            `toml:"bucket"`
+				Database      string            `toml:"database"`
+				Token         string            `toml:"token"`
+				Measurement   string            `toml:"measurement"`
+				Tags          []string          `toml:"tags"`
+				StaticTags    map[string]string `toml:"static_tags"`
+				BatchSize     int               `toml:"batch_size"`
+				FlushInterval string            `toml:"flush_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			if config.URL == "" {
+				return nil, fmt.Errorf("InfluxPublisher missing `url`")
+			}
+			if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("InfluxPublisher invalid `url`: %s", config.URL)
+			}
+			if (config.Bucket == "") == (config.Database == "") {
+				return nil, fmt.Errorf("InfluxPublisher needs exactly one of `bucket` and `database`")
+			}
+			if config.BatchSize < 0 {
+				return nil, fmt.Errorf("InfluxPublisher `batch_size` must not be negative")
+			}
+			if config.BatchSize == 0 {
+				config.BatchSize = 5000
+			}
+			flushInterval := 10 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("InfluxPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("InfluxPublisher `flush_interval` must be positive")
+				}
+			}
+
+			p := NewInfluxPublisher(InfluxWriteURL(config.URL, config.Org, config.Bucket, config.Database), config.BatchSize, flushInterval)
+			p.Clock = clock
+			p.Token = config.Token
+			if config.Measurement != "" {
+				p.Measurement = config.Measurement
+			}
+			if config.Tags != nil {
+				for _, name := range config.Tags {
+					if influxTag(name) == nil {
+						return nil, fmt.Errorf("InfluxPublisher invalid `tags`: unknown field %s", name)
+					}
+				}
+				p.Tags = config.Tags
+			}
+			p.StaticTags = config.StaticTags
+			return p, nil
+		})
+}
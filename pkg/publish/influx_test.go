@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+func TestInfluxWriteURL(t *testing.T) {
+	for _, test := range []struct {
+		org, bucket, database string
+		want                  string
+	}{
+		{"", "", "nel", "http://influx:8086/write?db=nel&precision=ns"},
+		{"acme", "nel", "", "http://influx:8086/api/v2/write?bucket=nel&org=acme&precision=ns"},
+	} {
+		got := publish.InfluxWriteURL("http://influx:8086/", test.org, test.bucket, test.database)
+		if got != test.want {
+			t.Errorf("InfluxWriteURL(%q, %q, %q) = %s, wanted %s", test.org, test.bucket, test.database, got, test.want)
+		}
+	}
+}
+
+func TestInfluxPublisher(t *testing.T) {
+	var mu sync.Mutex
+	var writes [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "unauthorized access", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		writes = append(writes, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	p := publish.NewInfluxPublisher(server.URL+"/api/v2/write?bucket=nel", 4, 0)
+	p.Token = "secret"
+	p.StaticTags = map[string]string{"region": "us east"}
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	ctx := context.Background()
+	for _, batch := range []*collector.ReportBatch{
+		{Time: received, Reports: []collector.NelReport{
+			{Age: 1000, URL: "https://a.example/", Phase: "connection", Type: "tcp.timed_out", ElapsedTime: 100},
+			{Age: 1000, URL: "https://a.example/x", Phase: "connection", Type: "tcp.timed_out", ElapsedTime: 301},
+			{Age: 1000, URL: "https://b.example/", Phase: "application", Type: "http.error", StatusCode: 503, ElapsedTime: 20},
+		}},
+		{Time: received, Reports: []collector.NelReport{
+			{Age: 500, URL: "https://a.example/", Phase: "connection", Type: "tcp.timed_out", ElapsedTime: 50},
+		}},
+		{Time: received, Reports: []collector.NelReport{
+			{URL: "https://c.example/", Phase: "dns", Type: "dns,odd name"},
+		}},
+	} {
+		if err := p.TryProcessReports(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{
+			`nel,host=a.example,phase=connection,region=us\ east,type=tcp.timed_out count=2i,elapsed_time=200.5 1704209399000000000`,
+			`nel,host=a.example,phase=connection,region=us\ east,type=tcp.timed_out count=1i,elapsed_time=50 1704209399500000000`,
+			`nel,host=b.example,phase=application,region=us\ east,status_class=5xx,type=http.error count=1i,elapsed_time=20 1704209399000000000`,
+		},
+		{
+			`nel,host=c.example,phase=dns,region=us\ east,type=dns\,odd\ name count=1i,elapsed_time=0 1704209400000000000`,
+		},
+	}
+	if diff := cmp.Diff(want, writes); diff != "" {
+		t.Errorf("InfluxPublisher wrote diff (-want +got):\n%s", diff)
+	}
+
+	p.Token = ""
+	err := p.TryProcessReports(ctx, &collector.ReportBatch{Time: received, Reports: []collector.NelReport{{}, {}, {}, {}}})
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized: unauthorized access") {
+		t.Errorf("InfluxPublisher without a token got error %v", err)
+	}
+}
+
+func TestInfluxPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`type = "InfluxPublisher"` + "\n" + `database = "nel"`,
+		`type = "InfluxPublisher"` + "\n" + `url = "influx:8086"` + "\n" + `database = "nel"`,
+		`type = "InfluxPublisher"` + "\n" + `url = "http://influx:8086"`,
+		`type = "InfluxPublisher"` + "\n" + `url = "http://influx:8086"` + "\n" + `database = "nel"` + "\n" + `bucket = "nel"`,
+		`type = "InfluxPublisher"` + "\n" + `url = "http://influx:8086"` + "\n" + `database = "nel"` + "\n" + `tags = ["url"]`,
+		`type = "InfluxPublisher"` + "\n" + `url = "http://influx:8086"` + "\n" + `database = "nel"` + "\n" + `flush_interval = "soon"`,
+		`type = "InfluxPublisher"` + "\n" + `url = "http://influx:8086"` + "\n" + `database = "nel"` + "\n" + `batch_size = -1`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
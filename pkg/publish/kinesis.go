@@ -0,0 +1,539 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// The limits that Kinesis Data Streams and Firehose place on a single
+// PutRecords (or PutRecordBatch) request.  A Kinesis record's size includes
+// its partition key.
+const (
+	kinesisMaxRecords        = 500
+	kinesisMaxRecordBytes    = 1 << 20
+	kinesisMaxRequestBytes   = 5 << 20
+	firehoseMaxRecordBytes   = 1000 << 10
+	firehoseMaxRequestBytes  = 4 << 20
+	kinesisMaxPartitionBytes = 256
+)
+
+// kinesisRecord is a record that's waiting to be sent.
+type kinesisRecord struct {
+	Data         []byte
+	PartitionKey string `json:",omitempty"`
+}
+
+func (r kinesisRecord) size() int {
+	return len(r.Data) + len(r.PartitionKey)
+}
+
+// kinesisResult is the outcome of putting a single record.
+type kinesisResult struct {
+	ErrorCode    string
+	ErrorMessage string
+}
+
+// KinesisPublisher is a pipeline processor that puts each report into an
+// Amazon Kinesis data stream, or (if Firehose is set) a Kinesis Data Firehose
+// delivery stream, as a JSON record with the same fields as the lines of
+// ObjectStorePublisher's objects.  Firehose records end with a newline, so
+// that the objects that Firehose delivers to S3 are newline-delimited JSON,
+// which Athena understands.  Kinesis records get a partition key from the
+// report field named by PartitionKey, which can be any of the fields that
+// InfluxPublisher's tags can use; reports without one use "-".
+//
+// Records are buffered in memory until there are BatchSize of them, until
+// they add up to the largest request that the service accepts, or until the
+// oldest buffered record is FlushInterval old; the buffer is then sent using
+// PutRecords (or PutRecordBatch), split into as many requests as the
+// service's limits need.  Anything left in the buffer is sent when the
+// pipeline is closed.  A report that's too large to be a record on its own is
+// dropped.
+//
+// The service accepts or rejects each record in a request separately.  The
+// records that are rejected (say, because a shard is over its throughput
+// limit), along with whole requests that fail with a network error, a 429, or
+// a 5xx status code, are retried up to MaxRetries times, waiting RetryDelay
+// before the first retry and twice as long before each one after that.
+// Records that still fail are logged and dropped.
+type KinesisPublisher struct {
+	// The base URL of the service.  If empty, we use the public endpoint for
+	// Region.
+	Endpoint string
+	Region   string
+
+	// The name of the data stream or delivery stream.
+	Stream   string
+	Firehose bool
+
+	PartitionKey string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	// An optional session token, for temporary credentials.
+	SessionToken string
+
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryDelay    time.Duration
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// The client used to send requests.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to sign requests, and to decide when the buffer is old
+	// enough to send.  If nil, we use the current time.
+	Clock collector.Clock
+
+	mu           sync.Mutex
+	pending      []kinesisRecord
+	pendingBytes int
+	started      time.Time
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewKinesisPublisher creates a new KinesisPublisher that puts records into a
+// Kinesis data stream in region, using the host of each report's URL as its
+// partition key, and retrying failed records up to 3 times.
+func NewKinesisPublisher(region, stream string, batchSize int, flushInterval time.Duration) *KinesisPublisher {
+	return &KinesisPublisher{
+		Region:        region,
+		Stream:        stream,
+		PartitionKey:  "host",
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		MaxRetries:    3,
+		RetryDelay:    100 * time.Millisecond,
+	}
+}
+
+func (p *KinesisPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// service returns the name of the AWS service that we're sending records to.
+func (p *KinesisPublisher) service() string {
+	if p.Firehose {
+		return "firehose"
+	}
+	return "kinesis"
+}
+
+// endpoint returns the URL that requests are sent to.  (The path has to be
+// "/", rather than empty, for the request's signature to be valid.)
+func (p *KinesisPublisher) endpoint() string {
+	if p.Endpoint != "" {
+		return strings.TrimSuffix(p.Endpoint, "/") + "/"
+	}
+	return "https://" + p.service() + "." + p.Region + ".amazonaws.com/"
+}
+
+// limits returns the largest record and request that the service accepts, in
+// bytes.
+func (p *KinesisPublisher) limits() (int, int) {
+	if p.Firehose {
+		return firehoseMaxRecordBytes, firehoseMaxRequestBytes
+	}
+	return kinesisMaxRecordBytes, kinesisMaxRequestBytes
+}
+
+func (p *KinesisPublisher) batchSize() int {
+	if p.BatchSize <= 0 || p.BatchSize > kinesisMaxRecords {
+		return kinesisMaxRecords
+	}
+	return p.BatchSize
+}
+
+// record encodes a report as a record.
+func (p *KinesisPublisher) record(batch *collector.ReportBatch, report *collector.NelReport) (kinesisRecord, error) {
+	data, err := json.Marshal(p.FieldNames.record(batch, report))
+	if err != nil {
+		return kinesisRecord{}, err
+	}
+	if p.Firehose {
+		return kinesisRecord{Data: append(data, '\n')}, nil
+	}
+	key := influxTag(p.PartitionKey)(report)
+	if key == "" {
+		key = "-"
+	}
+	if len(key) > kinesisMaxPartitionBytes {
+		key = key[:kinesisMaxPartitionBytes]
+	}
+	return kinesisRecord{Data: data, PartitionKey: key}, nil
+}
+
+// take removes the buffered records, so that they can be sent.  p.mu must be
+// held.
+func (p *KinesisPublisher) take() []kinesisRecord {
+	pending := p.pending
+	p.pending = nil
+	p.pendingBytes = 0
+	return pending
+}
+
+// put makes a single request containing records, and returns the records
+// that the service rejected, along with whether it's worth retrying the
+// request if it fails as a whole.
+func (p *KinesisPublisher) put(ctx context.Context, records []kinesisRecord) ([]kinesisRecord, bool, error) {
+	request := struct {
+		StreamName         string `json:",omitempty"`
+		DeliveryStreamName string `json:",omitempty"`
+		Records            []kinesisRecord
+	}{Records: records}
+	target := "Kinesis_20131202.PutRecords"
+	if p.Firehose {
+		request.DeliveryStreamName = p.Stream
+		target = "Firehose_20150804.PutRecordBatch"
+	} else {
+		request.StreamName = p.Stream
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r, err := http.NewRequest("POST", p.endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	r.Header.Set("X-Amz-Target", target)
+	if p.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", p.SessionToken)
+	}
+	signV4(r, sha256Hex(body), p.AccessKeyID, p.SecretAccessKey, p.Region, p.service(), p.now())
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return nil, true, err
+	}
+	defer response.Body.Close()
+	message, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if response.StatusCode/100 != 2 {
+		// Throttling is reported with a 400, and an error type that says so.
+		retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode/100 == 5 ||
+			bytes.Contains(message, []byte("ProvisionedThroughputExceeded")) || bytes.Contains(message, []byte("Throttling"))
+		return nil, retry, fmt.Errorf("Couldn't put records into %s: %s: %s", p.Stream, response.Status, bytes.TrimSpace(message))
+	}
+
+	var results struct {
+		Records          []kinesisResult
+		RequestResponses []kinesisResult
+	}
+	if err := json.Unmarshal(message, &results); err != nil {
+		return nil, false, fmt.Errorf("Couldn't parse response from %s: %v", p.Stream, err)
+	}
+	perRecord := results.Records
+	if p.Firehose {
+		perRecord = results.RequestResponses
+	}
+	if len(perRecord) != len(records) {
+		return nil, false, fmt.Errorf("Response from %s has %d results for %d records", p.Stream, len(perRecord), len(records))
+	}
+	var failed []kinesisRecord
+	var lastError kinesisResult
+	for i, result := range perRecord {
+		if result.ErrorCode != "" {
+			failed = append(failed, records[i])
+			lastError = result
+		}
+	}
+	if len(failed) > 0 {
+		return failed, false, fmt.Errorf("%s rejected %d records: %s: %s", p.Stream, len(failed), lastError.ErrorCode, lastError.ErrorMessage)
+	}
+	return nil, false, nil
+}
+
+// putWithRetries sends a request, retrying whichever of its records fail.
+func (p *KinesisPublisher) putWithRetries(ctx context.Context, records []kinesisRecord) error {
+	delay := p.RetryDelay
+	for attempt := 0; ; attempt++ {
+		failed, retry, err := p.put(ctx, records)
+		if err == nil {
+			return nil
+		}
+		if failed != nil {
+			records = failed
+		} else if !retry {
+			return err
+		}
+		if attempt >= p.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// send sends a set of records, in as many requests as the service's limits
+// need, and returns the first error from any of them.
+func (p *KinesisPublisher) send(ctx context.Context, records []kinesisRecord) error {
+	_, maxRequestBytes := p.limits()
+	var result error
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < kinesisMaxRecords && size+records[n].size() <= maxRequestBytes {
+			size += records[n].size()
+			n++
+		}
+		if err := p.putWithRetries(ctx, records[:n]); err != nil && result == nil {
+			result = err
+		}
+		records = records[n:]
+	}
+	return result
+}
+
+// flushPeriodically sends the buffer every FlushInterval, so that records
+// don't sit in the buffer for too long when they're arriving slowly.
+func (p *KinesisPublisher) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			if err := p.send(context.Background(), pending); err != nil {
+				log.Printf("KinesisPublisher: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports buffers a record for each report in the batch, sending the
+// buffer once it's big enough or old enough.
+func (p *KinesisPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("KinesisPublisher: %v", err)
+	}
+}
+
+// TryProcessReports buffers a record for each report in the batch, sending
+// the buffer once it's big enough or old enough, and returns an error if any
+// report is too large to send, or if sending the buffer fails.  Note that a
+// failed request can include reports from earlier batches, which are lost.
+func (p *KinesisPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	maxRecordBytes, maxRequestBytes := p.limits()
+	var result error
+	records := make([]kinesisRecord, 0, len(batch.Reports))
+	for i := range batch.Reports {
+		record, err := p.record(batch, &batch.Reports[i])
+		if err == nil && record.size() > maxRecordBytes {
+			err = fmt.Errorf("Report for %s is too large to put into %s (%d bytes)", batch.Reports[i].URL, p.Stream, record.size())
+		}
+		if err != nil {
+			if result == nil {
+				result = err
+			}
+			continue
+		}
+		records = append(records, record)
+	}
+	now := p.now()
+
+	var ready []kinesisRecord
+	p.mu.Lock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if len(p.pending) == 0 {
+		p.started = now
+	}
+	for _, record := range records {
+		p.pending = append(p.pending, record)
+		p.pendingBytes += record.size()
+	}
+	if len(p.pending) >= p.batchSize() || p.pendingBytes >= maxRequestBytes ||
+		(p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval) {
+		ready = p.take()
+	}
+	p.mu.Unlock()
+
+	if err := p.send(ctx, ready); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+// Close sends anything left in the buffer.
+func (p *KinesisPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	pending := p.take()
+	p.mu.Unlock()
+	return p.send(context.Background(), pending)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"KinesisPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Service         string            `toml:"service"`
+				Stream          string            `toml:"stream"`
+				Region          string            `toml:"region"`
+				Endpoint        string            `toml:"endpoint"`
+				AccessKeyID     string            `toml:"access_key_id"`
+				SecretAccessKey string            `toml:"secret_access_key"`
+				PartitionKey    string            `toml:"partition_key"`
+				BatchSize       int               `toml:"batch_size"`
+				FlushInterval   string            `toml:"flush_interval"`
+				MaxRetries      *int              `toml:"max_retries"`
+				RetryDelay      string            `toml:"retry_delay"`
+				FieldNames      map[string]string `toml:"field_names"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("KinesisPublisher invalid `field_names`: %v", err)
+			}
+
+			if config.Stream == "" {
+				return nil, fmt.Errorf("KinesisPublisher missing `stream`")
+			}
+			if config.Region == "" {
+				config.Region = os.Getenv("AWS_REGION")
+			}
+			if config.Region == "" {
+				return nil, fmt.Errorf("KinesisPublisher missing `region`")
+			}
+			if config.Endpoint != "" {
+				if u, err := url.Parse(config.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					return nil, fmt.Errorf("KinesisPublisher invalid `endpoint`: %s", config.Endpoint)
+				}
+			}
+			if config.BatchSize < 0 {
+				return nil, fmt.Errorf("KinesisPublisher `batch_size` must not be negative")
+			}
+			if config.BatchSize > kinesisMaxRecords {
+				return nil, fmt.Errorf("KinesisPublisher `batch_size` must be at most %d", kinesisMaxRecords)
+			}
+			if config.BatchSize == 0 {
+				config.BatchSize = kinesisMaxRecords
+			}
+			flushInterval := 10 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("KinesisPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("KinesisPublisher `flush_interval` must be positive")
+				}
+			}
+
+			p := NewKinesisPublisher(config.Region, config.Stream, config.BatchSize, flushInterval)
+			p.Clock = clock
+			p.Endpoint = config.Endpoint
+			switch config.Service {
+			case "", "kinesis":
+			case "firehose":
+				p.Firehose = true
+				if config.PartitionKey != "" {
+					return nil, fmt.Errorf("KinesisPublisher doesn't use `partition_key` with firehose")
+				}
+			default:
+				return nil, fmt.Errorf("KinesisPublisher invalid `service`: %s", config.Service)
+			}
+			if config.PartitionKey != "" {
+				if influxTag(config.PartitionKey) == nil {
+					return nil, fmt.Errorf("KinesisPublisher invalid `partition_key`: %s", config.PartitionKey)
+				}
+				p.PartitionKey = config.PartitionKey
+			}
+			if config.MaxRetries != nil {
+				if *config.MaxRetries < 0 {
+					return nil, fmt.Errorf("KinesisPublisher `max_retries` must not be negative")
+				}
+				p.MaxRetries = *config.MaxRetries
+			}
+			if config.RetryDelay != "" {
+				p.RetryDelay, err = time.ParseDuration(config.RetryDelay)
+				if err != nil {
+					return nil, fmt.Errorf("KinesisPublisher invalid `retry_delay`: %v", err)
+				}
+				if p.RetryDelay <= 0 {
+					return nil, fmt.Errorf("KinesisPublisher `retry_delay` must be positive")
+				}
+			}
+			p.AccessKeyID = config.AccessKeyID
+			p.SecretAccessKey = config.SecretAccessKey
+			if p.AccessKeyID == "" && p.SecretAccessKey == "" {
+				p.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+				p.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+				p.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+			}
+			if p.AccessKeyID == "" || p.SecretAccessKey == "" {
+				return nil, fmt.Errorf("KinesisPublisher missing `access_key_id` or `secret_access_key`")
+			}
+			p.FieldNames = fieldNames
+			return p, nil
+		})
+}
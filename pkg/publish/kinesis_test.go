@@ -0,0 +1,235 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+type kinesisRequest struct {
+	StreamName         string
+	DeliveryStreamName string
+	Records            []struct {
+		Data         []byte
+		PartitionKey string
+	}
+}
+
+// fakeKinesis is a Kinesis (or Firehose) endpoint that records each request,
+// and rejects the records that reject returns true for.
+type fakeKinesis struct {
+	target string
+	reject func(data string) bool
+
+	mu       sync.Mutex
+	requests []kinesisRequest
+}
+
+func (f *fakeKinesis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Amz-Target") != f.target || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, `{"__type":"UnrecognizedClientException"}`, http.StatusBadRequest)
+		return
+	}
+	var request kinesisRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	f.mu.Unlock()
+
+	type result struct {
+		SequenceNumber string `json:",omitempty"`
+		ErrorCode      string `json:",omitempty"`
+		ErrorMessage   string `json:",omitempty"`
+	}
+	var results []result
+	failed := 0
+	for _, record := range request.Records {
+		if f.reject != nil && f.reject(string(record.Data)) {
+			failed++
+			results = append(results, result{ErrorCode: "ProvisionedThroughputExceededException", ErrorMessage: "Rate exceeded"})
+		} else {
+			results = append(results, result{SequenceNumber: "1"})
+		}
+	}
+	if request.DeliveryStreamName != "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"FailedPutCount": failed, "RequestResponses": results})
+	} else {
+		json.NewEncoder(w).Encode(map[string]interface{}{"FailedRecordCount": failed, "Records": results})
+	}
+}
+
+func TestKinesisPublisher(t *testing.T) {
+	// The first attempt to put each report about b.example is throttled.
+	throttled := make(map[string]bool)
+	fake := &fakeKinesis{target: "Kinesis_20131202.PutRecords", reject: func(data string) bool {
+		if !strings.Contains(data, "b.example") || throttled[data] {
+			return false
+		}
+		throttled[data] = true
+		return true
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	p := publish.NewKinesisPublisher("us-east-1", "nel", 3, 0)
+	p.Endpoint = server.URL
+	p.AccessKeyID = "AKID"
+	p.SecretAccessKey = "secret"
+	p.RetryDelay = time.Millisecond
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	ctx := context.Background()
+	for _, batch := range []*collector.ReportBatch{
+		{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+			{URL: "https://a.example/", Type: "tcp.timed_out"},
+			{URL: "https://b.example/", Type: "ok"},
+		}},
+		{Time: received, ClientIP: "192.0.2.2", Reports: []collector.NelReport{
+			{URL: "https://b.example/x", Type: "ok"},
+			{URL: "not a url", Type: "ok"},
+		}},
+	} {
+		if err := p.TryProcessReports(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]string
+	for _, request := range fake.requests {
+		if request.StreamName != "nel" {
+			t.Errorf("Request has StreamName %q, wanted nel", request.StreamName)
+		}
+		var keys []string
+		for _, record := range request.Records {
+			keys = append(keys, record.PartitionKey)
+		}
+		got = append(got, keys)
+	}
+	// The buffer fills up with the second batch, and the records
+	// that were throttled are retried on their own.
+	want := [][]string{
+		{"a.example", "b.example", "b.example", "-"},
+		{"b.example", "b.example"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("KinesisPublisher put partition keys diff (-want +got):\n%s", diff)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(fake.requests[0].Records[0].Data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["url"] != "https://a.example/" || record["client_ip"] != "192.0.2.1" || record["received_at"] != "2024-01-02T15:30:00Z" {
+		t.Errorf("KinesisPublisher put record %v", record)
+	}
+
+	// Records that are still rejected after every retry are reported.
+	fake.reject = func(data string) bool { return true }
+	p.MaxRetries = 1
+	err := p.TryProcessReports(ctx, &collector.ReportBatch{Time: received, Reports: []collector.NelReport{{}, {}, {}}})
+	if err == nil || !strings.Contains(err.Error(), "rejected 3 records: ProvisionedThroughputExceededException") {
+		t.Errorf("KinesisPublisher with rejected records got error %v", err)
+	}
+	if got := len(fake.requests); got != 4 {
+		t.Errorf("KinesisPublisher made %d requests, wanted 4", got)
+	}
+}
+
+func TestKinesisPublisherLimits(t *testing.T) {
+	fake := &fakeKinesis{target: "Firehose_20150804.PutRecordBatch"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	p := publish.NewKinesisPublisher("us-east-1", "nel", 0, 0)
+	p.Firehose = true
+	p.Endpoint = server.URL
+	p.AccessKeyID = "AKID"
+	p.SecretAccessKey = "secret"
+	ctx := context.Background()
+
+	// Nine 900KB reports don't fit in a single 4MB request, and 1200 small ones
+	// don't fit in a single 500-record request.
+	batch := &collector.ReportBatch{}
+	for i := 0; i < 9; i++ {
+		batch.Reports = append(batch.Reports, collector.NelReport{URL: "https://example.com/" + strings.Repeat("x", 900<<10)})
+	}
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	batch = &collector.ReportBatch{Reports: make([]collector.NelReport, 1200)}
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	// A report that's too large for a record of its own is dropped.
+	batch = &collector.ReportBatch{Reports: []collector.NelReport{{URL: strings.Repeat("x", 1<<20)}, {}}}
+	if err := p.TryProcessReports(ctx, batch); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("KinesisPublisher with an oversized report got error %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	for _, request := range fake.requests {
+		if request.DeliveryStreamName != "nel" {
+			t.Errorf("Request has DeliveryStreamName %q, wanted nel", request.DeliveryStreamName)
+		}
+		for _, record := range request.Records {
+			if record.PartitionKey != "" || !strings.HasSuffix(string(record.Data), "}\n") {
+				t.Fatalf("KinesisPublisher put Firehose record %q with partition key %q", record.Data, record.PartitionKey)
+			}
+		}
+		got = append(got, len(request.Records))
+	}
+	if diff := cmp.Diff([]int{4, 4, 1, 500, 500, 200, 1}, got); diff != "" {
+		t.Errorf("KinesisPublisher request sizes diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestKinesisPublisherBadConfig(t *testing.T) {
+	base := `type = "KinesisPublisher"` + "\n" + `region = "us-east-1"` + "\n" + `access_key_id = "AKID"` + "\n" + `secret_access_key = "secret"` + "\n"
+	for _, config := range []string{
+		base,
+		base + `stream = "nel"` + "\n" + `service = "sqs"`,
+		base + `stream = "nel"` + "\n" + `service = "firehose"` + "\n" + `partition_key = "type"`,
+		base + `stream = "nel"` + "\n" + `partition_key = "url"`,
+		base + `stream = "nel"` + "\n" + `batch_size = 501`,
+		base + `stream = "nel"` + "\n" + `batch_size = -1`,
+		base + `stream = "nel"` + "\n" + `flush_interval = "0s"`,
+		base + `stream = "nel"` + "\n" + `max_retries = -1`,
+		base + `stream = "nel"` + "\n" + `retry_delay = "soon"`,
+		base + `stream = "nel"` + "\n" + `endpoint = "kinesis.local"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
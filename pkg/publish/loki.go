@@ -0,0 +1,408 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang/snappy"
+	"github.com/google/nel-collector/pkg/collector"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// reportLabels are the report fields that LokiPublisher can turn into labels
+// (and that NATSPublisher can use in subjects), along with how to extract each
+// one from a report.  They're all low-cardinality; URLs, IP addresses, and the
+// like belong in the log line.
+var reportLabels = map[string]func(report *collector.NelReport) string{
+	"report_type": func(report *collector.NelReport) string { return report.ReportType },
+	"type":        func(report *collector.NelReport) string { return report.Type },
+	"phase":       func(report *collector.NelReport) string { return report.Phase },
+	"method":      func(report *collector.NelReport) string { return report.Method },
+	"protocol":    func(report *collector.NelReport) string { return report.Protocol },
+	"status_class": func(report *collector.NelReport) string {
+		if report.StatusCode == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%dxx", report.StatusCode/100)
+	},
+}
+
+// DefaultLokiLabels are the report fields that LokiPublisher turns into labels,
+// unless you choose different ones.
+var DefaultLokiLabels = []string{"type", "phase", "status_class"}
+
+// lokiEntry is a single log line that's waiting to be pushed.
+type lokiEntry struct {
+	time time.Time
+	line string
+}
+
+// LokiPublisher is a pipeline processor that pushes reports to Grafana Loki,
+// using its protobuf push API.  Each report becomes one log line, containing
+// the same JSON object that ObjectStorePublisher would write, and timestamped
+// with the report's event time (see NelReport.EventTime).
+//
+// Each stream's labels are StaticLabels, plus one label for each of the report
+// fields in Labels, which are left out of the log line itself.  (A field that's
+// empty in a particular report doesn't get a label.)  The fields that can be
+// used as labels are `report_type`, `type`, `phase`, `method`, `protocol`, and
+// `status_class` (such as "5xx", derived from the report's status code).
+//
+// Reports are buffered in memory until there are BatchSize of them, or until
+// the oldest buffered report is FlushInterval old; the buffer is then pushed as
+// a single request.  Anything left in the buffer is pushed when the pipeline is
+// closed.
+type LokiPublisher struct {
+	// The URL of Loki's push API, such as
+	// http://localhost:3100/loki/api/v1/push.
+	Endpoint string
+
+	Labels       []string
+	StaticLabels map[string]string
+
+	// If set, we send this in the X-Scope-OrgID header of each request, for
+	// multi-tenant Loki installations.
+	TenantID string
+
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// The client used to push reports.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to decide when the buffer is old enough to push.  If nil,
+	// we use the current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	pending map[string][]lokiEntry
+	count   int
+	started time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewLokiPublisher creates a new LokiPublisher that pushes reports to
+// endpoint, using DefaultLokiLabels and a `job` label of "nel-collector".
+func NewLokiPublisher(endpoint string, batchSize int, flushInterval time.Duration) *LokiPublisher {
+	return &LokiPublisher{
+		Endpoint:      endpoint,
+		Labels:        DefaultLokiLabels,
+		StaticLabels:  map[string]string{"job": "nel-collector"},
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+	}
+}
+
+func (p *LokiPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// streamLabels returns the labels of the stream that a report belongs to, in
+// Loki's `{name="value", ...}` syntax, with the labels sorted by name.
+func (p *LokiPublisher) streamLabels(report *collector.NelReport) string {
+	labels := make(map[string]string)
+	for name, value := range p.StaticLabels {
+		labels[name] = value
+	}
+	for _, name := range p.Labels {
+		if value := reportLabels[name](report); value != "" {
+			labels[name] = value
+		}
+	}
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// logLine returns the log line for a report, leaving out any fields that are
+// used as labels.
+func (p *LokiPublisher) logLine(batch *collector.ReportBatch, report *collector.NelReport) (string, error) {
+	encoded, err := json.Marshal(p.FieldNames.record(batch, report))
+	if err != nil {
+		return "", err
+	}
+	if len(p.Labels) == 0 {
+		return string(encoded), nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return "", err
+	}
+	for _, name := range p.Labels {
+		delete(fields, p.FieldNames.name(name))
+	}
+	encoded, err = json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// take removes the buffered entries, so that they can be pushed.  p.mu must be
+// held.
+func (p *LokiPublisher) take() map[string][]lokiEntry {
+	pending := p.pending
+	p.pending = nil
+	p.count = 0
+	return pending
+}
+
+// encodePushRequest encodes a set of streams as a logproto.PushRequest
+// protobuf message.
+func encodePushRequest(streams map[string][]lokiEntry) []byte {
+	var labels []string
+	for stream := range streams {
+		labels = append(labels, stream)
+	}
+	sort.Strings(labels)
+
+	var request []byte
+	for _, stream := range labels {
+		entries := streams[stream]
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].time.Before(entries[j].time) })
+
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, stream)
+		for _, entry := range entries {
+			var timestamp []byte
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.time.Unix()))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(entry.time.Nanosecond()))
+
+			var encodedEntry []byte
+			encodedEntry = protowire.AppendTag(encodedEntry, 1, protowire.BytesType)
+			encodedEntry = protowire.AppendBytes(encodedEntry, timestamp)
+			encodedEntry = protowire.AppendTag(encodedEntry, 2, protowire.BytesType)
+			encodedEntry = protowire.AppendString(encodedEntry, entry.line)
+
+			encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+			encoded = protowire.AppendBytes(encoded, encodedEntry)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encoded)
+	}
+	return request
+}
+
+// push sends a set of streams to Loki.
+func (p *LokiPublisher) push(ctx context.Context, streams map[string][]lokiEntry) error {
+	if len(streams) == 0 {
+		return nil
+	}
+	body := snappy.Encode(nil, encodePushRequest(streams))
+	r, err := http.NewRequest("POST", p.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	if p.TenantID != "" {
+		r.Header.Set("X-Scope-OrgID", p.TenantID)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Couldn't push reports to %s: %s: %s", p.Endpoint, response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// flushPeriodically pushes the buffer every FlushInterval, so that reports
+// don't sit in the buffer for too long when they're arriving slowly.
+func (p *LokiPublisher) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			if err := p.push(context.Background(), pending); err != nil {
+				log.Printf("LokiPublisher: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports buffers each report in the batch, pushing the buffer once
+// it's big enough or old enough.
+func (p *LokiPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("LokiPublisher: %v", err)
+	}
+}
+
+// TryProcessReports buffers each report in the batch, pushing the buffer once
+// it's big enough or old enough, and returns an error if that push fails.
+// Note that a failed push can include reports from earlier batches, which are
+// lost.
+func (p *LokiPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	streams := make([]string, len(batch.Reports))
+	entries := make([]lokiEntry, len(batch.Reports))
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		line, err := p.logLine(batch, report)
+		if err != nil {
+			return fmt.Errorf("Couldn't encode report: %v", err)
+		}
+		streams[i] = p.streamLabels(report)
+		entries[i] = lokiEntry{time: report.EventTime(batch.Time), line: line}
+	}
+	now := p.now()
+
+	var ready map[string][]lokiEntry
+	p.mu.Lock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if p.pending == nil {
+		p.pending = make(map[string][]lokiEntry)
+		p.started = now
+	}
+	for i, stream := range streams {
+		p.pending[stream] = append(p.pending[stream], entries[i])
+	}
+	p.count += len(entries)
+	if p.count >= p.BatchSize || (p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval) {
+		ready = p.take()
+	}
+	p.mu.Unlock()
+
+	return p.push(ctx, ready)
+}
+
+// Close pushes anything left in the buffer.
+func (p *LokiPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	pending := p.take()
+	p.mu.Unlock()
+	return p.push(context.Background(), pending)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"LokiPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Endpoint      string            `toml:"endpoint"`
+				Labels        []string          `toml:"labels"`
+				StaticLabels  map[string]string `toml:"static_labels"`
+				TenantID      string            `toml:"tenant_id"`
+				BatchSize     int               `toml:"batch_size"`
+				FlushInterval string            `toml:"flush_interval"`
+				FieldNames    map[string]string `toml:"field_names"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("LokiPublisher invalid `field_names`: %v", err)
+			}
+
+			if config.Endpoint == "" {
+				return nil, fmt.Errorf("LokiPublisher missing `endpoint`")
+			}
+			if config.BatchSize < 0 {
+				return nil, fmt.Errorf("LokiPublisher `batch_size` must not be negative")
+			}
+			if config.BatchSize == 0 {
+				config.BatchSize = 1000
+			}
+			flushInterval := 10 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("LokiPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("LokiPublisher `flush_interval` must be positive")
+				}
+			}
+
+			p := NewLokiPublisher(config.Endpoint, config.BatchSize, flushInterval)
+			p.Clock = clock
+			p.TenantID = config.TenantID
+			if config.Labels != nil {
+				for _, name := range config.Labels {
+					if reportLabels[name] == nil {
+						return nil, fmt.Errorf("LokiPublisher invalid `labels`: unknown field %s", name)
+					}
+				}
+				p.Labels = config.Labels
+			}
+			if config.StaticLabels != nil {
+				p.StaticLabels = config.StaticLabels
+			}
+			p.FieldNames = fieldNames
+			return p, nil
+		})
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeFields decodes a protobuf message into a list of its fields, with
+// each length-delimited field as a []byte and each varint or fixed64 as a
+// uint64.
+func decodeFields(t *testing.T, message []byte) (numbers []protowire.Number, values []interface{}) {
+	for len(message) > 0 {
+		number, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			t.Fatalf("Invalid protobuf tag: %v", protowire.ParseError(n))
+		}
+		message = message[n:]
+		var value interface{}
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(message)
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(message)
+		case protowire.Fixed64Type:
+			value, n = protowire.ConsumeFixed64(message)
+		default:
+			t.Fatalf("Unexpected protobuf wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatalf("Invalid protobuf field: %v", protowire.ParseError(n))
+		}
+		message = message[n:]
+		numbers = append(numbers, number)
+		values = append(values, value)
+	}
+	return numbers, values
+}
+
+// decodePushRequest decodes a snappy-compressed logproto.PushRequest into one
+// string per log line, containing its stream's labels, timestamp, and line.
+func decodePushRequest(t *testing.T, body []byte) []string {
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	_, streams := decodeFields(t, request)
+	for _, stream := range streams {
+		var labels string
+		numbers, values := decodeFields(t, stream.([]byte))
+		for i, number := range numbers {
+			if number == 1 {
+				labels = string(values[i].([]byte))
+				continue
+			}
+			_, entry := decodeFields(t, values[i].([]byte))
+			_, timestamp := decodeFields(t, entry[0].([]byte))
+			when := time.Unix(int64(timestamp[0].(uint64)), int64(timestamp[1].(uint64))).UTC()
+			result = append(result, fmt.Sprintf("%s %s %s", labels, when.Format(time.RFC3339Nano), entry[1]))
+		}
+	}
+	return result
+}
+
+func TestLokiPublisher(t *testing.T) {
+	var mu sync.Mutex
+	var pushes [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Scope-OrgID") != "tenant" {
+			http.Error(w, "no org id", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "wrong content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		mu.Lock()
+		pushes = append(pushes, decodePushRequest(t, body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	p := publish.NewLokiPublisher(server.URL+"/loki/api/v1/push", 3, 0)
+	p.TenantID = "tenant"
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	ctx := context.Background()
+	for _, batch := range []*collector.ReportBatch{
+		{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+			{Age: 500, ReportType: "network-error", URL: "https://a/", Phase: "connection", Type: "tcp.timed_out"},
+			{Age: 1000, ReportType: "network-error", URL: "https://b/", Phase: "application", Type: "http.error", StatusCode: 503},
+		}},
+		{Time: received, ClientIP: "192.0.2.2", Reports: []collector.NelReport{
+			{Age: 2000, ReportType: "network-error", URL: "https://c/", Phase: "connection", Type: "tcp.timed_out"},
+		}},
+		{Time: received, ClientIP: "192.0.2.3", Reports: []collector.NelReport{
+			{ReportType: "csp-violation", URL: "https://d/", RawBody: []byte(`{"blocked":"x"}`)},
+		}},
+	} {
+		if err := p.TryProcessReports(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{
+			`{job="nel-collector", phase="application", status_class="5xx", type="http.error"} 2024-01-02T15:29:59Z {"age":1000,"client_ip":"192.0.2.1","received_at":"2024-01-02T15:30:00Z","report_type":"network-error","status_code":503,"url":"https://b/","user_agent":""}`,
+			`{job="nel-collector", phase="connection", type="tcp.timed_out"} 2024-01-02T15:29:58Z {"age":2000,"client_ip":"192.0.2.2","received_at":"2024-01-02T15:30:00Z","report_type":"network-error","url":"https://c/","user_agent":""}`,
+			`{job="nel-collector", phase="connection", type="tcp.timed_out"} 2024-01-02T15:29:59.5Z {"age":500,"client_ip":"192.0.2.1","received_at":"2024-01-02T15:30:00Z","report_type":"network-error","url":"https://a/","user_agent":""}`,
+		},
+		{
+			`{job="nel-collector"} 2024-01-02T15:30:00Z {"age":0,"body":{"blocked":"x"},"client_ip":"192.0.2.3","received_at":"2024-01-02T15:30:00Z","report_type":"csp-violation","url":"https://d/","user_agent":""}`,
+		},
+	}
+	if diff := cmp.Diff(want, pushes); diff != "" {
+		t.Errorf("LokiPublisher pushed diff (-want +got):\n%s", diff)
+	}
+
+	p.TenantID = ""
+	err := p.TryProcessReports(ctx, &collector.ReportBatch{Time: received, Reports: []collector.NelReport{{}, {}, {}}})
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized: no org id") {
+		t.Errorf("LokiPublisher without a tenant got error %v", err)
+	}
+}
+
+func TestLokiPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`type = "LokiPublisher"`,
+		`type = "LokiPublisher"` + "\n" + `endpoint = "http://loki/"` + "\n" + `labels = ["url"]`,
+		`type = "LokiPublisher"` + "\n" + `endpoint = "http://loki/"` + "\n" + `flush_interval = "soon"`,
+		`type = "LokiPublisher"` + "\n" + `endpoint = "http://loki/"` + "\n" + `batch_size = -1`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
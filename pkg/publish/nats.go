@@ -0,0 +1,513 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// subjectPlaceholder matches the placeholders in a NATSPublisher's subject.
+var subjectPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// invalidSubjectChars matches the characters that can't appear in a NATS
+// subject token.
+var invalidSubjectChars = regexp.MustCompile(`[\s*>]`)
+
+// errNATSClosed is returned when publishing to a NATSPublisher that has been
+// closed.
+var errNATSClosed = errors.New("connection closed")
+
+// NATSPublisher is a pipeline processor that publishes each report to a NATS
+// server, as a JSON message containing the same object that
+// ObjectStorePublisher would write.
+//
+// The subject of each message comes from Subject, where placeholders such as
+// `{type}` are replaced by the report's value for that field; for instance,
+// `nel.{phase}.{type}` gives subjects like `nel.connection.tcp.timed_out`.  The
+// fields that can be used are the same ones that LokiPublisher can use as
+// labels.  Characters that aren't allowed in subjects are replaced by `_`, as
+// are empty values.
+//
+// Messages are buffered, and written to the server in the background every
+// FlushInterval.  If JetStream is set, we publish to a JetStream stream instead,
+// which means that the server acknowledges each message once it has been
+// persisted.  In either case, Close flushes the buffer, and waits for the
+// server to process (and, for JetStream, acknowledge) every message before
+// closing the connection.
+type NATSPublisher struct {
+	// The URL of the server, such as nats://localhost:4222.  Use the tls://
+	// scheme to connect over TLS.  Credentials can be given in the URL, or in
+	// User and Password or Token.
+	URL      string
+	Subject  string
+	User     string
+	Password string
+	Token    string
+
+	JetStream     bool
+	FlushInterval time.Duration
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// The longest that Close waits for the server, before giving up.
+	Timeout time.Duration
+
+	subject   []string
+	mu        sync.Mutex
+	conn      net.Conn
+	w         *bufio.Writer
+	inbox     string
+	sent      int
+	pending   int
+	acked     *sync.Cond
+	pongs     chan struct{}
+	lastError error
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewNATSPublisher creates a new NATSPublisher that publishes reports to a
+// server, under a templated subject.  We don't connect until the first report
+// is published.
+func NewNATSPublisher(serverURL, subject string, flushInterval time.Duration) (*NATSPublisher, error) {
+	p := &NATSPublisher{
+		URL:           serverURL,
+		Subject:       subject,
+		FlushInterval: flushInterval,
+		Timeout:       10 * time.Second,
+	}
+	p.acked = sync.NewCond(&p.mu)
+	if err := p.parseSubject(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseSubject splits Subject into literal text and placeholders; each odd
+// element of p.subject is the name of a field.
+func (p *NATSPublisher) parseSubject() error {
+	if p.Subject == "" {
+		return fmt.Errorf("empty subject")
+	}
+	p.subject = nil
+	last := 0
+	for _, match := range subjectPlaceholder.FindAllStringSubmatchIndex(p.Subject, -1) {
+		name := p.Subject[match[2]:match[3]]
+		if reportLabels[name] == nil {
+			return fmt.Errorf("unknown field %s", name)
+		}
+		p.subject = append(p.subject, p.Subject[last:match[0]], name)
+		last = match[1]
+	}
+	p.subject = append(p.subject, p.Subject[last:])
+	if invalidSubjectChars.MatchString(strings.Join(p.subject, "")) {
+		return fmt.Errorf("invalid subject %s", p.Subject)
+	}
+	return nil
+}
+
+// subjectFor returns the subject of the message for a report.
+func (p *NATSPublisher) subjectFor(report *collector.NelReport) string {
+	var result strings.Builder
+	for i, part := range p.subject {
+		if i%2 == 0 {
+			result.WriteString(part)
+			continue
+		}
+		value := invalidSubjectChars.ReplaceAllString(reportLabels[part](report), "_")
+		if value == "" {
+			value = "_"
+		}
+		result.WriteString(value)
+	}
+	return result.String()
+}
+
+// connect connects to the server, if we're not connected already.  p.mu must
+// be held.
+func (p *NATSPublisher) connect() error {
+	if p.closed {
+		return errNATSClosed
+	}
+	if p.conn != nil {
+		return nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, p.Timeout)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	// The server starts by describing itself.
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from %s: %q", host, strings.TrimSpace(line))
+	}
+	if info.TLSRequired || u.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "nel-collector",
+		"lang":     "go",
+		"version":  "1.0.0",
+		"protocol": 1,
+	}
+	user, password, token := p.User, p.Password, p.Token
+	if u.User != nil && user == "" && token == "" {
+		if pass, ok := u.User.Password(); ok {
+			user, password = u.User.Username(), pass
+		} else {
+			token = u.User.Username()
+		}
+	}
+	if user != "" {
+		options["user"] = user
+		options["pass"] = password
+	}
+	if token != "" {
+		options["auth_token"] = token
+	}
+	encoded, _ := json.Marshal(options)
+
+	p.conn = conn
+	p.w = bufio.NewWriter(conn)
+	fmt.Fprintf(p.w, "CONNECT %s\r\n", encoded)
+	if p.JetStream {
+		// Acknowledgements are sent to replies under our inbox.
+		p.inbox = "_INBOX." + strings.Replace(newObjectID(), "-", "", -1)
+		fmt.Fprintf(p.w, "SUB %s.* 1\r\n", p.inbox)
+	}
+	p.pongs = make(chan struct{}, 16)
+	if err := p.w.Flush(); err != nil {
+		p.disconnect(err)
+		return err
+	}
+	p.wg.Add(1)
+	go p.read(conn, r, p.pongs)
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically(p.done)
+	}
+	return nil
+}
+
+// disconnect closes the connection after an error, so that we'll reconnect
+// the next time we publish.  Any messages that haven't been acknowledged are
+// lost.  p.mu must be held.
+func (p *NATSPublisher) disconnect(err error) {
+	if p.conn == nil {
+		return
+	}
+	p.conn.Close()
+	p.conn = nil
+	p.w = nil
+	if err != nil && p.lastError == nil {
+		p.lastError = err
+	}
+	p.pending = 0
+	p.acked.Broadcast()
+}
+
+// read handles the messages that the server sends us.
+func (p *NATSPublisher) read(conn net.Conn, r *bufio.Reader, pongs chan struct{}) {
+	defer p.wg.Done()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			p.mu.Lock()
+			if p.conn == conn {
+				p.disconnect(err)
+			}
+			p.mu.Unlock()
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch op := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); op {
+		case "PING":
+			p.mu.Lock()
+			if p.conn == conn {
+				p.w.WriteString("PONG\r\n")
+				p.w.Flush()
+			}
+			p.mu.Unlock()
+		case "PONG":
+			select {
+			case pongs <- struct{}{}:
+			default:
+			}
+		case "-ERR":
+			log.Printf("NATSPublisher: server error: %s", line)
+			p.mu.Lock()
+			p.lastError = fmt.Errorf("server error: %s", line)
+			p.mu.Unlock()
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				continue
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				continue
+			}
+			var ack struct {
+				Error *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			json.Unmarshal(payload[:size], &ack)
+			p.mu.Lock()
+			if ack.Error != nil {
+				p.lastError = fmt.Errorf("JetStream error: %s", ack.Error.Description)
+				log.Printf("NATSPublisher: %v", p.lastError)
+			}
+			if p.pending > 0 {
+				p.pending--
+			}
+			p.acked.Broadcast()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// flush writes any buffered messages to the server.  p.mu must be held.
+func (p *NATSPublisher) flush() error {
+	if p.w == nil {
+		return nil
+	}
+	if err := p.w.Flush(); err != nil {
+		p.disconnect(err)
+		return err
+	}
+	return nil
+}
+
+// flushPeriodically writes the buffered messages to the server every
+// FlushInterval.
+func (p *NATSPublisher) flushPeriodically(done chan struct{}) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			err := p.flush()
+			p.mu.Unlock()
+			if err != nil {
+				log.Printf("NATSPublisher: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// ProcessReports publishes each report in the batch.
+func (p *NATSPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("NATSPublisher: %v", err)
+	}
+}
+
+// TryProcessReports publishes each report in the batch, and returns an error
+// if we couldn't connect to the server, or couldn't write to it.
+func (p *NATSPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.connect(); err != nil {
+		return fmt.Errorf("Couldn't connect to %s: %v", p.URL, err)
+	}
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		payload, err := json.Marshal(p.FieldNames.record(batch, report))
+		if err != nil {
+			return fmt.Errorf("Couldn't encode report: %v", err)
+		}
+		subject := p.subjectFor(report)
+		if p.JetStream {
+			p.sent++
+			p.pending++
+			fmt.Fprintf(p.w, "PUB %s %s.%d %d\r\n", subject, p.inbox, p.sent, len(payload))
+		} else {
+			fmt.Fprintf(p.w, "PUB %s %d\r\n", subject, len(payload))
+		}
+		p.w.Write(payload)
+		if _, err := p.w.WriteString("\r\n"); err != nil {
+			p.disconnect(err)
+			return fmt.Errorf("Couldn't publish to %s: %v", p.URL, err)
+		}
+	}
+	return nil
+}
+
+// Close flushes any buffered messages, waits until the server has processed
+// them, and closes the connection.  It returns an error if anything went wrong
+// since the last time that Close was called.
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	p.closed = true
+	err := p.flush()
+	var pongs chan struct{}
+	if err == nil && p.conn != nil {
+		// The server answers PINGs in order, so once it answers this one, it's
+		// processed everything that we've sent.
+		p.w.WriteString("PING\r\n")
+		err = p.flush()
+		pongs = p.pongs
+	}
+	p.mu.Unlock()
+
+	deadline := time.Now().Add(p.Timeout)
+	timer := time.AfterFunc(p.Timeout, func() {
+		p.mu.Lock()
+		p.acked.Broadcast()
+		p.mu.Unlock()
+	})
+	defer timer.Stop()
+	if pongs != nil {
+		select {
+		case <-pongs:
+		case <-time.After(time.Until(deadline)):
+			err = fmt.Errorf("timed out waiting for %s", p.URL)
+		}
+	}
+	p.mu.Lock()
+	if err == nil && p.JetStream {
+		// Wait for the outstanding acknowledgements.
+		for p.pending > 0 && p.conn != nil && time.Now().Before(deadline) {
+			p.acked.Wait()
+		}
+		if p.pending > 0 {
+			err = fmt.Errorf("timed out waiting for %d JetStream acknowledgements", p.pending)
+		}
+	}
+	if err == nil {
+		err = p.lastError
+	}
+	p.lastError = nil
+	p.disconnect(nil)
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"NATSPublisher",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				URL           string            `toml:"url"`
+				Subject       string            `toml:"subject"`
+				User          string            `toml:"user"`
+				Password      string            `toml:"password"`
+				Token         string            `toml:"token"`
+				JetStream     bool              `toml:"jetstream"`
+				FlushInterval string            `toml:"flush_interval"`
+				FieldNames    map[string]string `toml:"field_names"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("NATSPublisher invalid `field_names`: %v", err)
+			}
+			if config.URL == "" {
+				return nil, fmt.Errorf("NATSPublisher missing `url`")
+			}
+			if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "nats" && u.Scheme != "tls") {
+				return nil, fmt.Errorf("NATSPublisher invalid `url`: %s", config.URL)
+			}
+			if config.Subject == "" {
+				config.Subject = "nel.{type}"
+			}
+			flushInterval := 100 * time.Millisecond
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("NATSPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("NATSPublisher `flush_interval` must be positive")
+				}
+			}
+
+			p, err := NewNATSPublisher(config.URL, config.Subject, flushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("NATSPublisher invalid `subject`: %v", err)
+			}
+			p.User = config.User
+			p.Password = config.Password
+			p.Token = config.Token
+			p.JetStream = config.JetStream
+			p.FieldNames = fieldNames
+			return p, nil
+		})
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// fakeNATSServer implements just enough of the NATS protocol to record the
+// messages that are published to it, acknowledging them as JetStream would if
+// they have a reply subject.
+type fakeNATSServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	connects []string
+	messages []string
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATSServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNATSServer) URL() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+func (s *fakeNATSServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeNATSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			s.mu.Lock()
+			s.connects = append(s.connects, strings.TrimSpace(strings.TrimPrefix(line, "CONNECT ")))
+			s.mu.Unlock()
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, fields[1]+" "+string(payload[:size]))
+			s.mu.Unlock()
+			if len(fields) == 4 {
+				ack := `{"stream":"NEL","seq":1}`
+				fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", fields[2], len(ack), ack)
+			}
+		}
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	for _, jetStream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("JetStream=%v", jetStream), func(t *testing.T) {
+			server := newFakeNATSServer(t)
+			defer server.Close()
+
+			p, err := publish.NewNATSPublisher(server.URL(), "nel.{phase}.{type}", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Token = "secret"
+			p.JetStream = jetStream
+			received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+			batch := &collector.ReportBatch{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+				{Age: 500, ReportType: "network-error", URL: "https://a/", Phase: "connection", Type: "tcp.timed_out"},
+				{Age: 1000, ReportType: "network-error", URL: "https://b/", Phase: "application", Type: "http.error", StatusCode: 503},
+				{ReportType: "csp-violation", URL: "https://c/"},
+			}}
+			if err := p.TryProcessReports(context.Background(), batch); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if len(server.connects) != 1 || !strings.Contains(server.connects[0], `"auth_token":"secret"`) {
+				t.Errorf("NATSPublisher connected with %v", server.connects)
+			}
+			want := []string{
+				`nel.connection.tcp.timed_out {"received_at":"2024-01-02T15:30:00Z","client_ip":"192.0.2.1","age":500,"report_type":"network-error","url":"https://a/","user_agent":"","phase":"connection","type":"tcp.timed_out"}`,
+				`nel.application.http.error {"received_at":"2024-01-02T15:30:00Z","client_ip":"192.0.2.1","age":1000,"report_type":"network-error","url":"https://b/","user_agent":"","status_code":503,"phase":"application","type":"http.error"}`,
+				`nel._._ {"received_at":"2024-01-02T15:30:00Z","client_ip":"192.0.2.1","age":0,"report_type":"csp-violation","url":"https://c/","user_agent":""}`,
+			}
+			if diff := cmp.Diff(want, server.messages); diff != "" {
+				t.Errorf("NATSPublisher published diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNATSPublisherUnreachable(t *testing.T) {
+	server := newFakeNATSServer(t)
+	url := server.URL()
+	server.Close()
+
+	p, err := publish.NewNATSPublisher(url, "nel", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.TryProcessReports(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{{}}})
+	if err == nil || !strings.Contains(err.Error(), "Couldn't connect") {
+		t.Errorf("NATSPublisher to a closed server got error %v", err)
+	}
+	p.Close()
+}
+
+func TestNATSPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`type = "NATSPublisher"`,
+		`type = "NATSPublisher"` + "\n" + `url = "http://nats/"`,
+		`type = "NATSPublisher"` + "\n" + `url = "nats://nats/"` + "\n" + `subject = "nel.{url}"`,
+		`type = "NATSPublisher"` + "\n" + `url = "nats://nats/"` + "\n" + `subject = "nel.>"`,
+		`type = "NATSPublisher"` + "\n" + `url = "nats://nats/"` + "\n" + `flush_interval = "soon"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// An ObjectStore stores objects (such as files in a bucket) under string keys.
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, body []byte, contentType, contentEncoding string) error
+}
+
+// FileStore is an ObjectStore that writes each object to a file under a local
+// directory, creating subdirectories as needed.  It's useful for testing, or
+// for a directory that some other process syncs to object storage.
+type FileStore struct {
+	Directory string
+}
+
+// PutObject writes an object to a file.
+func (s FileStore) PutObject(ctx context.Context, key string, body []byte, contentType, contentEncoding string) error {
+	path := filepath.Join(s.Directory, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+// DefaultObjectKeyLayout is the layout of the keys that ObjectStorePublisher
+// uploads objects under, unless you provide a different one.
+const DefaultObjectKeyLayout = "year={year}/month={month}/day={day}/hour={hour}/{uuid}.ndjson"
+
+// objectRecord is the JSON encoding of each line of an uploaded object.  It
+// has the same fields as the columns of SQLPublisher's table: the report's
+// fields are in the wire format (see collector.WireReport).
+type objectRecord struct {
+	ReceivedAt time.Time `json:"received_at"`
+	ClientIP   string    `json:"client_ip"`
+	collector.WireReport
+}
+
+func newObjectRecord(batch *collector.ReportBatch, report *collector.NelReport) objectRecord {
+	return objectRecord{
+		ReceivedAt: batch.Time.UTC(),
+		ClientIP:   batch.ClientIP,
+		WireReport: collector.NewWireReport(report),
+	}
+}
+
+// pendingObject is a buffer of encoded reports that will be uploaded as a
+// single object.
+type pendingObject struct {
+	partition time.Time
+	data      []byte
+	count     int
+}
+
+// ObjectStorePublisher is a pipeline processor that uploads reports to an
+// object store, such as an S3 or Google Cloud Storage bucket, as newline-
+// delimited JSON.  Each line of an object is one report, with the same fields
+// as the columns of SQLPublisher's table.  Objects are partitioned by the hour
+// in which their reports were received, using keys like
+//
+//	year=2024/month=01/day=02/hour=15/<uuid>.ndjson
+//
+// which Athena and BigQuery external tables understand.  (See KeyLayout.)
+//
+// Reports are buffered in memory until there are MaxBytes of them, until the
+// oldest buffered report is FlushInterval old, or until a report arrives for a
+// different hour; the buffer is then uploaded as a single object.  Anything
+// left in the buffer is uploaded when the pipeline is closed.
+type ObjectStorePublisher struct {
+	Store ObjectStore
+
+	// The layout of object keys.  {year}, {month}, {day}, and {hour} are
+	// replaced by the (UTC) hour that the object's reports were received in,
+	// and {uuid} by a random UUID.  If Compress is set, ".gz" is added to the
+	// end of each key.
+	KeyLayout string
+
+	MaxBytes      int
+	FlushInterval time.Duration
+
+	// Whether to gzip each object before uploading it.
+	Compress bool
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// Clock is used to decide when the buffer is old enough to upload.  If nil,
+	// we use the current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	pending *pendingObject
+	started time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewObjectStorePublisher creates a new ObjectStorePublisher that uploads
+// objects to store, using DefaultObjectKeyLayout.
+func NewObjectStorePublisher(store ObjectStore, maxBytes int, flushInterval time.Duration) *ObjectStorePublisher {
+	return &ObjectStorePublisher{
+		Store:         store,
+		KeyLayout:     DefaultObjectKeyLayout,
+		MaxBytes:      maxBytes,
+		FlushInterval: flushInterval,
+	}
+}
+
+func (p *ObjectStorePublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+func newObjectID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// expandKeyLayout returns the key that an object for the given partition
+// should be uploaded under.
+func expandKeyLayout(layout string, partition time.Time) string {
+	return strings.NewReplacer(
+		"{year}", partition.Format("2006"),
+		"{month}", partition.Format("01"),
+		"{day}", partition.Format("02"),
+		"{hour}", partition.Format("15"),
+		"{uuid}", newObjectID(),
+	).Replace(layout)
+}
+
+// objectKey returns the key that an object should be uploaded under.
+func (p *ObjectStorePublisher) objectKey(partition time.Time) string {
+	key := expandKeyLayout(p.KeyLayout, partition)
+	if p.Compress {
+		key += ".gz"
+	}
+	return key
+}
+
+// take removes the pending object from the buffer, so that it can be
+// uploaded.  p.mu must be held.
+func (p *ObjectStorePublisher) take() *pendingObject {
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// upload uploads a pending object to the store.
+func (p *ObjectStorePublisher) upload(ctx context.Context, pending *pendingObject) error {
+	if pending == nil {
+		return nil
+	}
+	body := pending.data
+	contentEncoding := ""
+	if p.Compress {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(body)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+		contentEncoding = "gzip"
+	}
+	key := p.objectKey(pending.partition)
+	if err := p.Store.PutObject(ctx, key, body, "application/x-ndjson", contentEncoding); err != nil {
+		return fmt.Errorf("Couldn't upload %d reports to %s: %v", pending.count, key, err)
+	}
+	return nil
+}
+
+// flushPeriodically uploads the buffer every FlushInterval, so that reports
+// don't sit in the buffer for too long when they're arriving slowly.
+func (p *ObjectStorePublisher) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			if err := p.upload(context.Background(), pending); err != nil {
+				log.Printf("ObjectStorePublisher: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports buffers each report in the batch, uploading the buffer once
+// it's big enough or old enough.
+func (p *ObjectStorePublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("ObjectStorePublisher: %v", err)
+	}
+}
+
+// TryProcessReports buffers each report in the batch, uploading the buffer
+// once it's big enough or old enough, and returns an error if that upload
+// fails.  Note that a failed upload can include reports from earlier batches,
+// which are lost.
+func (p *ObjectStorePublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	var lines []byte
+	for i := range batch.Reports {
+		line, err := json.Marshal(p.FieldNames.record(batch, &batch.Reports[i]))
+		if err != nil {
+			return fmt.Errorf("Couldn't encode report: %v", err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	partition := batch.Time.UTC().Truncate(time.Hour)
+	now := p.now()
+
+	var ready []*pendingObject
+	p.mu.Lock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if p.pending != nil && !p.pending.partition.Equal(partition) {
+		ready = append(ready, p.take())
+	}
+	if p.pending == nil {
+		p.pending = &pendingObject{partition: partition}
+		p.started = now
+	}
+	p.pending.data = append(p.pending.data, lines...)
+	p.pending.count += len(batch.Reports)
+	if len(p.pending.data) >= p.MaxBytes || (p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval) {
+		ready = append(ready, p.take())
+	}
+	p.mu.Unlock()
+
+	var result error
+	for _, pending := range ready {
+		if err := p.upload(ctx, pending); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Close uploads anything left in the buffer.
+func (p *ObjectStorePublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	pending := p.take()
+	p.mu.Unlock()
+	return p.upload(context.Background(), pending)
+}
+
+// loadObjectStore creates the ObjectStore described by a processor's
+// configuration.  It only decodes the fields that describe the store, so the
+// caller should decode the rest of the processor's fields separately.
+func loadObjectStore(ctx context.Context, name string, configPrimitive toml.Primitive) (ObjectStore, error) {
+	var config struct {
+		Provider        string `toml:"provider"`
+		Bucket          string `toml:"bucket"`
+		Directory       string `toml:"directory"`
+		Endpoint        string `toml:"endpoint"`
+		Region          string `toml:"region"`
+		AccessKeyID     string `toml:"access_key_id"`
+		SecretAccessKey string `toml:"secret_access_key"`
+	}
+
+	err := collector.DecodeConfig(ctx, configPrimitive, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Provider {
+	case "file":
+		if config.Directory == "" {
+			return nil, fmt.Errorf("%s missing `directory`", name)
+		}
+		return FileStore{config.Directory}, nil
+	case "s3", "gcs":
+		if config.Bucket == "" {
+			return nil, fmt.Errorf("%s missing `bucket`", name)
+		}
+		s3 := &S3Store{
+			Endpoint:        config.Endpoint,
+			Bucket:          config.Bucket,
+			Region:          config.Region,
+			AccessKeyID:     config.AccessKeyID,
+			SecretAccessKey: config.SecretAccessKey,
+		}
+		if config.Provider == "s3" {
+			if s3.Region == "" {
+				s3.Region = os.Getenv("AWS_REGION")
+			}
+			if s3.Region == "" {
+				return nil, fmt.Errorf("%s missing `region`", name)
+			}
+			if s3.Endpoint == "" {
+				s3.Endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+			}
+			if s3.AccessKeyID == "" && s3.SecretAccessKey == "" {
+				s3.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+				s3.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+				s3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+			}
+		} else {
+			if s3.Region == "" {
+				s3.Region = "auto"
+			}
+			if s3.Endpoint == "" {
+				s3.Endpoint = "https://storage.googleapis.com"
+			}
+		}
+		if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			return nil, fmt.Errorf("%s missing `access_key_id` or `secret_access_key`", name)
+		}
+		return s3, nil
+	case "":
+		return nil, fmt.Errorf("%s missing `provider`", name)
+	default:
+		return nil, fmt.Errorf("%s invalid `provider`: %s", name, config.Provider)
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ObjectStorePublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			store, err := loadObjectStore(ctx, "ObjectStorePublisher", configPrimitive)
+			if err != nil {
+				return nil, err
+			}
+
+			var config struct {
+				KeyPrefix     string            `toml:"key_prefix"`
+				KeyLayout     string            `toml:"key_layout"`
+				BufferSize    int               `toml:"buffer_size"`
+				FlushInterval string            `toml:"flush_interval"`
+				Compress      bool              `toml:"compress"`
+				FieldNames    map[string]string `toml:"field_names"`
+			}
+
+			err = collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("ObjectStorePublisher invalid `field_names`: %v", err)
+			}
+
+			if config.BufferSize < 0 {
+				return nil, fmt.Errorf("ObjectStorePublisher `buffer_size` must not be negative")
+			}
+			if config.BufferSize == 0 {
+				config.BufferSize = 16 << 20
+			}
+			flushInterval := 5 * time.Minute
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("ObjectStorePublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("ObjectStorePublisher `flush_interval` must be positive")
+				}
+			}
+
+			p := NewObjectStorePublisher(store, config.BufferSize, flushInterval)
+			p.Clock = clock
+			p.Compress = config.Compress
+			if config.KeyLayout != "" {
+				p.KeyLayout = config.KeyLayout
+			}
+			p.KeyLayout = config.KeyPrefix + p.KeyLayout
+			p.FieldNames = fieldNames
+			return p, nil
+		})
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// memoryStore is an ObjectStore that keeps uploaded objects in memory.
+type memoryStore struct {
+	mu      sync.Mutex
+	keys    []string
+	objects map[string][]byte
+}
+
+func (s *memoryStore) PutObject(ctx context.Context, key string, body []byte, contentType, contentEncoding string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if contentEncoding == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if body, err = ioutil.ReadAll(gz); err != nil {
+			return err
+		}
+	}
+	s.keys = append(s.keys, key)
+	s.objects[key] = body
+	return nil
+}
+
+// objectKeys returns the keys of the uploaded objects, with their UUIDs
+// replaced by a placeholder, and the number of lines in each object.
+func (s *memoryStore) objectKeys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
+	var result []string
+	for _, key := range s.keys {
+		lines := strings.Count(string(s.objects[key]), "\n")
+		result = append(result, uuid.ReplaceAllString(key, "UUID")+" "+strings.Repeat("*", lines))
+	}
+	return result
+}
+
+func TestObjectStorePublisher(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		store := &memoryStore{objects: make(map[string][]byte)}
+		clock := pipelinetest.NewSimulatedClock()
+		p := publish.NewObjectStorePublisher(store, 1000, time.Hour)
+		p.Clock = clock
+		p.Compress = compress
+		p.KeyLayout = "nel/" + p.KeyLayout
+
+		batch := func(hour int, n int) *collector.ReportBatch {
+			b := &collector.ReportBatch{
+				Time:     time.Date(2024, 1, 2, hour, 30, 0, 0, time.UTC),
+				ClientIP: "192.0.2.1",
+			}
+			for i := 0; i < n; i++ {
+				b.Reports = append(b.Reports, collector.NelReport{ReportType: "network-error", Type: "tcp.timed_out", URL: "https://example.com/"})
+			}
+			return b
+		}
+
+		ctx := context.Background()
+		for _, b := range []*collector.ReportBatch{
+			batch(15, 2),
+			batch(15, 1),
+			// A new hour starts a new object.
+			batch(16, 1),
+			// Too many bytes for one buffer.
+			batch(16, 10),
+			batch(17, 1),
+		} {
+			if err := p.TryProcessReports(ctx, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The buffer is uploaded once it's old enough.
+		clock.CurrentTime = clock.CurrentTime.Add(time.Hour)
+		if err := p.TryProcessReports(ctx, batch(17, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.TryProcessReports(ctx, batch(18, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		suffix := ""
+		if compress {
+			suffix = ".gz"
+		}
+		want := []string{
+			"nel/year=2024/month=01/day=02/hour=15/UUID.ndjson" + suffix + " ***",
+			"nel/year=2024/month=01/day=02/hour=16/UUID.ndjson" + suffix + " ***********",
+			"nel/year=2024/month=01/day=02/hour=17/UUID.ndjson" + suffix + " **",
+			"nel/year=2024/month=01/day=02/hour=18/UUID.ndjson" + suffix + " *",
+		}
+		if diff := cmp.Diff(want, store.objectKeys()); diff != "" {
+			t.Errorf("ObjectStorePublisher(compress=%v) got diff (-want +got):\n%s", compress, diff)
+		}
+
+		first := strings.SplitN(string(store.objects[store.keys[0]]), "\n", 2)[0]
+		wantLine := `{"received_at":"2024-01-02T15:30:00Z","client_ip":"192.0.2.1","age":0,"report_type":"network-error","url":"https://example.com/","user_agent":"","type":"tcp.timed_out"}`
+		if first != wantLine {
+			t.Errorf("First line of object is %s, wanted %s", first, wantLine)
+		}
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+		if strings.Contains(r.URL.Path, "missing") {
+			http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	clock := pipelinetest.NewSimulatedClock()
+	clock.CurrentTime = time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	store := &publish.S3Store{
+		Endpoint:        server.URL,
+		Bucket:          "reports",
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		Clock:           clock,
+	}
+	payload := []byte(`{"type":"ok"}` + "\n")
+	err := store.PutObject(context.Background(), "year=2024/a.ndjson.gz", payload, "application/x-ndjson", "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := request.Method+" "+request.URL.Path, "PUT /reports/year=2024/a.ndjson.gz"; got != want {
+		t.Errorf("Request was %s, wanted %s", got, want)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("Request body was %q, wanted %q", body, payload)
+	}
+	sum := sha256.Sum256(payload)
+	for header, want := range map[string]string{
+		"Content-Type":         "application/x-ndjson",
+		"Content-Encoding":     "gzip",
+		"X-Amz-Date":           "20240102T153000Z",
+		"X-Amz-Content-Sha256": hex.EncodeToString(sum[:]),
+	} {
+		if got := request.Header.Get(header); got != want {
+			t.Errorf("%s header was %q, wanted %q", header, got, want)
+		}
+	}
+	authorization := regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/us-east-1/s3/aws4_request, SignedHeaders=content-encoding;content-type;host;x-amz-content-sha256;x-amz-date, Signature=[0-9a-f]{64}$`)
+	if got := request.Header.Get("Authorization"); !authorization.MatchString(got) {
+		t.Errorf("Authorization header was %q", got)
+	}
+
+	err = store.PutObject(context.Background(), "missing", payload, "application/x-ndjson", "")
+	if err == nil || !strings.Contains(err.Error(), "404 Not Found: NoSuchBucket") {
+		t.Errorf("PutObject to a missing bucket got error %v", err)
+	}
+}
@@ -0,0 +1,554 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The OTLP severity numbers that OTLPLogPublisher uses.
+const (
+	otlpSeverityInfo  = 9
+	otlpSeverityWarn  = 13
+	otlpSeverityError = 17
+)
+
+// otlpAttribute is a key-value pair, whose value is a string, bool, int64, or
+// float64.
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+// otlpLogRecord is a report that's been converted into an OTLP LogRecord, and
+// is waiting to be exported.
+type otlpLogRecord struct {
+	time         time.Time
+	observedTime time.Time
+	severity     int
+	severityText string
+	body         string
+	attributes   []otlpAttribute
+}
+
+// otlpSeverity returns the severity of a report: errors for failures (and 5xx
+// responses), warnings for 4xx responses, and info for everything else.
+func otlpSeverity(report *collector.NelReport) (int, string) {
+	if report.ReportType != "network-error" {
+		return otlpSeverityInfo, "INFO"
+	}
+	switch {
+	case report.Type == "ok":
+		return otlpSeverityInfo, "INFO"
+	case report.Type == "http.error" && report.StatusCode/100 == 4:
+		return otlpSeverityWarn, "WARN"
+	default:
+		return otlpSeverityError, "ERROR"
+	}
+}
+
+// otlpAttributeValue converts an annotation into a value that OTLP can
+// represent, formatting any other types as strings.
+func otlpAttributeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, bool, int64, float64:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// otlpReportAttributes returns the attributes that describe a report: its
+// fields, using OpenTelemetry's semantic conventions where there are any, and
+// its annotations.
+func otlpReportAttributes(batch *collector.ReportBatch, report *collector.NelReport) []otlpAttribute {
+	attributes := []otlpAttribute{
+		{"nel.report_type", report.ReportType},
+		{"url.full", report.URL},
+		{"nel.age", int64(report.Age)},
+	}
+	add := func(key string, value interface{}) {
+		if value != "" && value != int64(0) && value != float64(0) {
+			attributes = append(attributes, otlpAttribute{key, value})
+		}
+	}
+	add("user_agent.original", report.UserAgent)
+	add("client.address", batch.ClientIP)
+	if report.ReportType == "network-error" {
+		add("nel.type", report.Type)
+		add("nel.phase", report.Phase)
+		add("nel.referrer", report.Referrer)
+		add("nel.sampling_fraction", float64(report.SamplingFraction))
+		add("nel.elapsed_time", int64(report.ElapsedTime))
+		add("server.address", report.ServerIP)
+		add("network.protocol.name", report.Protocol)
+		add("http.request.method", report.Method)
+		add("http.response.status_code", int64(report.StatusCode))
+	}
+	annotations := report.CloneAnnotations().Annotations
+	var names []string
+	for name := range annotations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attributes = append(attributes, otlpAttribute{"nel.annotation." + name, otlpAttributeValue(annotations[name])})
+	}
+	return attributes
+}
+
+func newOTLPLogRecord(batch *collector.ReportBatch, report *collector.NelReport) otlpLogRecord {
+	severity, severityText := otlpSeverity(report)
+	body := fmt.Sprintf("%s for %s", report.ReportType, report.URL)
+	if report.ReportType == "network-error" {
+		body = fmt.Sprintf("%s (%s phase) for %s", report.Type, report.Phase, report.URL)
+	}
+	return otlpLogRecord{
+		time:         report.EventTime(batch.Time),
+		observedTime: batch.Time,
+		severity:     severity,
+		severityText: severityText,
+		body:         body,
+		attributes:   otlpReportAttributes(batch, report),
+	}
+}
+
+// appendOTLPAnyValue appends the protobuf encoding of an AnyValue message.
+func appendOTLPAnyValue(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case bool:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case int64:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case float64:
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+// appendOTLPAttributes appends a repeated KeyValue field.
+func appendOTLPAttributes(b []byte, number protowire.Number, attributes []otlpAttribute) []byte {
+	for _, attribute := range attributes {
+		var kv []byte
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, attribute.key)
+		kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+		kv = protowire.AppendBytes(kv, appendOTLPAnyValue(nil, attribute.value))
+		b = protowire.AppendTag(b, number, protowire.BytesType)
+		b = protowire.AppendBytes(b, kv)
+	}
+	return b
+}
+
+// encodeOTLPProtobuf encodes a set of log records as an
+// ExportLogsServiceRequest protobuf message, with a single resource and
+// instrumentation scope.
+func encodeOTLPProtobuf(resource []otlpAttribute, records []otlpLogRecord) []byte {
+	var scopeLogs []byte
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "nel-collector")
+	scopeLogs = protowire.AppendTag(scopeLogs, 1, protowire.BytesType)
+	scopeLogs = protowire.AppendBytes(scopeLogs, scope)
+	for _, record := range records {
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.Fixed64Type)
+		encoded = protowire.AppendFixed64(encoded, uint64(record.time.UnixNano()))
+		encoded = protowire.AppendTag(encoded, 2, protowire.VarintType)
+		encoded = protowire.AppendVarint(encoded, uint64(record.severity))
+		encoded = protowire.AppendTag(encoded, 3, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, record.severityText)
+		encoded = protowire.AppendTag(encoded, 5, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, appendOTLPAnyValue(nil, record.body))
+		encoded = appendOTLPAttributes(encoded, 6, record.attributes)
+		encoded = protowire.AppendTag(encoded, 11, protowire.Fixed64Type)
+		encoded = protowire.AppendFixed64(encoded, uint64(record.observedTime.UnixNano()))
+		scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, encoded)
+	}
+
+	var resourceLogs []byte
+	resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, appendOTLPAttributes(nil, 1, resource))
+	resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, resourceLogs)
+	return request
+}
+
+// otlpJSONValue returns the JSON encoding of an AnyValue message.  (64-bit
+// integers are encoded as strings.)
+func otlpJSONValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{}
+}
+
+func otlpJSONAttributes(attributes []otlpAttribute) []map[string]interface{} {
+	result := make([]map[string]interface{}, len(attributes))
+	for i, attribute := range attributes {
+		result[i] = map[string]interface{}{"key": attribute.key, "value": otlpJSONValue(attribute.value)}
+	}
+	return result
+}
+
+// encodeOTLPJSON encodes a set of log records using the JSON encoding of an
+// ExportLogsServiceRequest.
+func encodeOTLPJSON(resource []otlpAttribute, records []otlpLogRecord) ([]byte, error) {
+	logRecords := make([]map[string]interface{}, len(records))
+	for i, record := range records {
+		logRecords[i] = map[string]interface{}{
+			"timeUnixNano":         strconv.FormatInt(record.time.UnixNano(), 10),
+			"observedTimeUnixNano": strconv.FormatInt(record.observedTime.UnixNano(), 10),
+			"severityNumber":       record.severity,
+			"severityText":         record.severityText,
+			"body":                 otlpJSONValue(record.body),
+			"attributes":           otlpJSONAttributes(record.attributes),
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpJSONAttributes(resource)},
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      map[string]interface{}{"name": "nel-collector"},
+						"logRecords": logRecords,
+					},
+				},
+			},
+		},
+	})
+}
+
+// OTLPLogPublisher is a pipeline processor that exports reports as
+// OpenTelemetry log records, using OTLP over HTTP, so that they can flow
+// through the same infrastructure as other telemetry.  Protocol is either
+// "http/protobuf" or "http/json".  (OTLP over gRPC isn't supported; most
+// OpenTelemetry collectors accept both.)
+//
+// Each report becomes one log record, timestamped with the report's event
+// time (see NelReport.EventTime), with the time the report was received as its
+// observed time.  Failures are errors, except for 4xx responses, which are
+// warnings; everything else is info.  The report's fields are attributes, using
+// OpenTelemetry's semantic conventions where there are any (such as `url.full`
+// and `http.response.status_code`) and a `nel.` prefix otherwise (such as
+// `nel.type` and `nel.phase`).  Each annotation is an attribute too, named
+// `nel.annotation.<name>`.  Every record shares the ResourceAttributes, which
+// include a `service.name` of "nel-collector" unless you choose a different
+// one.
+//
+// Records are buffered in memory until there are BatchSize of them, or until
+// the oldest buffered record is FlushInterval old; the buffer is then exported
+// as a single request.  Anything left in the buffer is exported when the
+// pipeline is closed.
+type OTLPLogPublisher struct {
+	// The URL of the OTLP logs endpoint, such as
+	// http://localhost:4318/v1/logs.
+	Endpoint string
+	Protocol string
+
+	// Extra headers to send with each request, such as API keys.
+	Headers map[string]string
+
+	ResourceAttributes map[string]string
+
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// The client used to export records.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to decide when the buffer is old enough to export.  If
+	// nil, we use the current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	pending []otlpLogRecord
+	started time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewOTLPLogPublisher creates a new OTLPLogPublisher that exports reports to
+// endpoint, using the http/protobuf protocol.
+func NewOTLPLogPublisher(endpoint string, batchSize int, flushInterval time.Duration) *OTLPLogPublisher {
+	return &OTLPLogPublisher{
+		Endpoint:           endpoint,
+		Protocol:           "http/protobuf",
+		ResourceAttributes: map[string]string{"service.name": "nel-collector"},
+		BatchSize:          batchSize,
+		FlushInterval:      flushInterval,
+	}
+}
+
+func (p *OTLPLogPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// take removes the buffered records, so that they can be exported.  p.mu must
+// be held.
+func (p *OTLPLogPublisher) take() []otlpLogRecord {
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// otlpResource returns a set of resource attributes, sorted by key.
+func otlpResource(attributes map[string]string) []otlpAttribute {
+	var resource []otlpAttribute
+	for key, value := range attributes {
+		resource = append(resource, otlpAttribute{key, value})
+	}
+	sort.Slice(resource, func(i, j int) bool { return resource[i].key < resource[j].key })
+	return resource
+}
+
+// export sends a set of records to the endpoint.
+func (p *OTLPLogPublisher) export(ctx context.Context, records []otlpLogRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	resource := otlpResource(p.ResourceAttributes)
+
+	var body []byte
+	contentType := "application/x-protobuf"
+	if p.Protocol == "http/json" {
+		var err error
+		body, err = encodeOTLPJSON(resource, records)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = encodeOTLPProtobuf(resource, records)
+	}
+	return postOTLP(ctx, p.Client, p.Endpoint, p.Headers, contentType, body)
+}
+
+// postOTLP sends an OTLP export request to endpoint.
+func postOTLP(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, contentType string, body []byte) error {
+	r, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Couldn't export reports to %s: %s: %s", endpoint, response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// flushPeriodically exports the buffer every FlushInterval, so that reports
+// don't sit in the buffer for too long when they're arriving slowly.
+func (p *OTLPLogPublisher) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			if err := p.export(context.Background(), pending); err != nil {
+				log.Printf("OTLPLogPublisher: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports buffers each report in the batch, exporting the buffer once
+// it's big enough or old enough.
+func (p *OTLPLogPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("OTLPLogPublisher: %v", err)
+	}
+}
+
+// TryProcessReports buffers each report in the batch, exporting the buffer
+// once it's big enough or old enough, and returns an error if that export
+// fails.  Note that a failed export can include reports from earlier batches,
+// which are lost.
+func (p *OTLPLogPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	records := make([]otlpLogRecord, len(batch.Reports))
+	for i := range batch.Reports {
+		records[i] = newOTLPLogRecord(batch, &batch.Reports[i])
+	}
+	now := p.now()
+
+	var ready []otlpLogRecord
+	p.mu.Lock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if len(p.pending) == 0 {
+		p.started = now
+	}
+	p.pending = append(p.pending, records...)
+	if len(p.pending) >= p.BatchSize || (p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval) {
+		ready = p.take()
+	}
+	p.mu.Unlock()
+
+	return p.export(ctx, ready)
+}
+
+// Close exports anything left in the buffer.
+func (p *OTLPLogPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	pending := p.take()
+	p.mu.Unlock()
+	return p.export(context.Background(), pending)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"OTLPLogPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Endpoint           string            `toml:"endpoint"`
+				Protocol           string            `toml:"protocol"`
+				Headers            map[string]string `toml:"headers"`
+				ResourceAttributes map[string]string `toml:"resource_attributes"`
+				BatchSize          int               `toml:"batch_size"`
+				FlushInterval      string            `toml:"flush_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			if config.Endpoint == "" {
+				return nil, fmt.Errorf("OTLPLogPublisher missing `endpoint`")
+			}
+			u, err := url.Parse(config.Endpoint)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("OTLPLogPublisher invalid `endpoint`: %s", config.Endpoint)
+			}
+			// Like OpenTelemetry's SDKs, treat an endpoint without a path as the
+			// base URL of the collector.
+			if u.Path == "" || u.Path == "/" {
+				u.Path = "/v1/logs"
+			}
+			switch config.Protocol {
+			case "":
+				config.Protocol = "http/protobuf"
+			case "http/protobuf", "http/json":
+			case "grpc":
+				return nil, fmt.Errorf("OTLPLogPublisher doesn't support the grpc `protocol`; use http/protobuf or http/json")
+			default:
+				return nil, fmt.Errorf("OTLPLogPublisher invalid `protocol`: %s", config.Protocol)
+			}
+			if config.BatchSize < 0 {
+				return nil, fmt.Errorf("OTLPLogPublisher `batch_size` must not be negative")
+			}
+			if config.BatchSize == 0 {
+				config.BatchSize = 512
+			}
+			flushInterval := 5 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("OTLPLogPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("OTLPLogPublisher `flush_interval` must be positive")
+				}
+			}
+
+			p := NewOTLPLogPublisher(u.String(), config.BatchSize, flushInterval)
+			p.Clock = clock
+			p.Protocol = config.Protocol
+			p.Headers = config.Headers
+			for key, value := range config.ResourceAttributes {
+				p.ResourceAttributes[key] = value
+			}
+			return p, nil
+		})
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// decodeAnyValue decodes an OTLP AnyValue message into a string.
+func decodeAnyValue(t *testing.T, message []byte) string {
+	numbers, values := decodeFields(t, message)
+	switch numbers[0] {
+	case 1:
+		return fmt.Sprintf("%q", values[0])
+	case 4:
+		return fmt.Sprint(math.Float64frombits(values[0].(uint64)))
+	default:
+		return fmt.Sprint(values[0])
+	}
+}
+
+// decodeAttributes decodes a list of OTLP KeyValue messages into a string.
+func decodeAttributes(t *testing.T, messages []interface{}) string {
+	var result []string
+	for _, message := range messages {
+		_, values := decodeFields(t, message.([]byte))
+		result = append(result, fmt.Sprintf("%s=%s", values[0], decodeAnyValue(t, values[1].([]byte))))
+	}
+	return strings.Join(result, " ")
+}
+
+// decodeExportLogsRequest decodes an OTLP ExportLogsServiceRequest into one
+// string per log record, preceded by one string for each resource's
+// attributes.
+func decodeExportLogsRequest(t *testing.T, body []byte) []string {
+	var result []string
+	_, resourceLogs := decodeFields(t, body)
+	for _, encoded := range resourceLogs {
+		numbers, values := decodeFields(t, encoded.([]byte))
+		for i, number := range numbers {
+			switch number {
+			case 1:
+				_, attributes := decodeFields(t, values[i].([]byte))
+				result = append(result, "resource: "+decodeAttributes(t, attributes))
+			case 2:
+				numbers, values := decodeFields(t, values[i].([]byte))
+				for i, number := range numbers {
+					if number != 2 {
+						continue
+					}
+					var when time.Time
+					var severity uint64
+					var body string
+					var attributes []interface{}
+					recordNumbers, recordValues := decodeFields(t, values[i].([]byte))
+					for j, field := range recordNumbers {
+						switch field {
+						case 1:
+							when = time.Unix(0, int64(recordValues[j].(uint64))).UTC()
+						case 2:
+							severity = recordValues[j].(uint64)
+						case 5:
+							body = decodeAnyValue(t, recordValues[j].([]byte))
+						case 6:
+							attributes = append(attributes, recordValues[j])
+						}
+					}
+					result = append(result, fmt.Sprintf("%d %s %s: %s", severity, when.Format(time.RFC3339Nano), body, decodeAttributes(t, attributes)))
+				}
+			}
+		}
+	}
+	return result
+}
+
+func otlpBatches() []*collector.ReportBatch {
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	batches := []*collector.ReportBatch{
+		{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+			{Age: 500, ReportType: "network-error", URL: "https://a/", Phase: "connection", Type: "tcp.timed_out", SamplingFraction: 0.5},
+			{ReportType: "network-error", URL: "https://b/", Phase: "application", Type: "http.error", StatusCode: 404, Method: "GET"},
+		}},
+		{Time: received, ClientIP: "192.0.2.2", Reports: []collector.NelReport{
+			{ReportType: "network-error", URL: "https://c/", Phase: "application", Type: "ok", StatusCode: 200},
+		}},
+	}
+	batches[0].Reports[0].SetAnnotation("Service", "web")
+	return batches
+}
+
+func TestOTLPLogPublisher(t *testing.T) {
+	var mu sync.Mutex
+	var exports [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer hunter2" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "wrong request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		exports = append(exports, decodeExportLogsRequest(t, body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	p := publish.NewOTLPLogPublisher(server.URL+"/v1/logs", 2, 0)
+	p.Headers = map[string]string{"Authorization": "Bearer hunter2"}
+	p.ResourceAttributes["deployment.environment"] = "test"
+	ctx := context.Background()
+	for _, batch := range otlpBatches() {
+		if err := p.TryProcessReports(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(exports); got != 1 {
+		t.Errorf("OTLPLogPublisher exported %d times before Close, wanted 1", got)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := `resource: deployment.environment="test" service.name="nel-collector"`
+	want := [][]string{
+		{
+			resource,
+			`17 2024-01-02T15:29:59.5Z "tcp.timed_out (connection phase) for https://a/": nel.report_type="network-error" url.full="https://a/" nel.age=500 client.address="192.0.2.1" nel.type="tcp.timed_out" nel.phase="connection" nel.sampling_fraction=0.5 nel.annotation.Service="web"`,
+			`13 2024-01-02T15:30:00Z "http.error (application phase) for https://b/": nel.report_type="network-error" url.full="https://b/" nel.age=0 client.address="192.0.2.1" nel.type="http.error" nel.phase="application" http.request.method="GET" http.response.status_code=404`,
+		},
+		{
+			resource,
+			`9 2024-01-02T15:30:00Z "ok (application phase) for https://c/": nel.report_type="network-error" url.full="https://c/" nel.age=0 client.address="192.0.2.2" nel.type="ok" nel.phase="application" http.response.status_code=200`,
+		},
+	}
+	if diff := cmp.Diff(want, exports); diff != "" {
+		t.Errorf("OTLPLogPublisher exported diff (-want +got):\n%s", diff)
+	}
+
+	p.Headers = nil
+	err := p.TryProcessReports(ctx, otlpBatches()[0])
+	if err == nil || !strings.Contains(err.Error(), "401 Unauthorized: unauthorized") {
+		t.Errorf("OTLPLogPublisher without credentials got error %v", err)
+	}
+}
+
+func TestOTLPLogPublisherJSON(t *testing.T) {
+	var request struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					TimeUnixNano   string `json:"timeUnixNano"`
+					SeverityNumber int    `json:"severityNumber"`
+					Body           struct {
+						StringValue string `json:"stringValue"`
+					} `json:"body"`
+					Attributes []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "wrong content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	p := publish.NewOTLPLogPublisher(server.URL, 1, 0)
+	p.Protocol = "http/json"
+	if err := p.TryProcessReports(context.Background(), otlpBatches()[1]); err != nil {
+		t.Fatal(err)
+	}
+	record := request.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if got, want := record.TimeUnixNano, "1704209400000000000"; got != want {
+		t.Errorf("OTLPLogPublisher sent timeUnixNano %s, wanted %s", got, want)
+	}
+	if got, want := record.SeverityNumber, 9; got != want {
+		t.Errorf("OTLPLogPublisher sent severityNumber %d, wanted %d", got, want)
+	}
+	if got, want := record.Body.StringValue, "ok (application phase) for https://c/"; got != want {
+		t.Errorf("OTLPLogPublisher sent body %q, wanted %q", got, want)
+	}
+	for _, attribute := range record.Attributes {
+		if attribute.Key == "http.response.status_code" {
+			if diff := cmp.Diff(map[string]interface{}{"intValue": "200"}, attribute.Value); diff != "" {
+				t.Errorf("OTLPLogPublisher status code diff (-want +got):\n%s", diff)
+			}
+		}
+	}
+}
+
+func TestOTLPLogPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`endpoint = "localhost:4318"`,
+		"endpoint = \"http://localhost:4318\"\nprotocol = \"grpc\"",
+		"endpoint = \"http://localhost:4318\"\nprotocol = \"thrift\"",
+		"endpoint = \"http://localhost:4318\"\nbatch_size = -1",
+		"endpoint = \"http://localhost:4318\"\nflush_interval = \"soon\"",
+		"endpoint = \"http://localhost:4318\"\nflush_interval = \"0s\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"OTLPLogPublisher\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,721 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang/snappy"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultParquetKeyLayout is the layout of the keys that ParquetPublisher
+// uploads files under, unless you provide a different one.
+const DefaultParquetKeyLayout = "year={year}/month={month}/day={day}/hour={hour}/{uuid}.parquet"
+
+// ParquetCompression is a compression codec for the pages of a Parquet file.
+// The values are the ones that the Parquet format uses.
+type ParquetCompression int32
+
+// The compression codecs that ParquetPublisher supports.
+const (
+	ParquetUncompressed ParquetCompression = 0
+	ParquetSnappy       ParquetCompression = 1
+	ParquetGzip         ParquetCompression = 2
+	ParquetZstd         ParquetCompression = 6
+)
+
+var parquetCompressions = map[string]ParquetCompression{
+	"none":   ParquetUncompressed,
+	"snappy": ParquetSnappy,
+	"gzip":   ParquetGzip,
+	"zstd":   ParquetZstd,
+}
+
+// zstdEncoder is shared by all of the pages that we compress with zstd, since
+// it's expensive to create, and safe to use concurrently with EncodeAll.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+)
+
+// compress compresses the contents of a page.
+func (c ParquetCompression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case ParquetUncompressed:
+		return data, nil
+	case ParquetSnappy:
+		return snappy.Encode(nil, data), nil
+	case ParquetGzip:
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(data)
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+	case ParquetZstd:
+		zstdOnce.Do(func() {
+			zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		})
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("Unknown Parquet compression %d", c)
+	}
+}
+
+// Parquet's physical types, converted types, and the other enums that we use.
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+	parquetJSON            = 19
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+)
+
+// parquetColumns is the schema of the files that ParquetPublisher writes.  It
+// has the same columns as SQLPublisher's table, except that the body and
+// annotations are combined into a single JSON extras column.
+var parquetColumns = []struct {
+	name      string
+	kind      int32
+	converted int32 // -1 for none
+	optional  bool
+}{
+	{"received_at", parquetInt64, parquetTimestampMillis, false},
+	{"client_ip", parquetByteArray, parquetUTF8, false},
+	{"age", parquetInt64, -1, false},
+	{"report_type", parquetByteArray, parquetUTF8, false},
+	{"url", parquetByteArray, parquetUTF8, false},
+	{"user_agent", parquetByteArray, parquetUTF8, false},
+	{"referrer", parquetByteArray, parquetUTF8, false},
+	{"sampling_fraction", parquetFloat, -1, false},
+	{"server_ip", parquetByteArray, parquetUTF8, false},
+	{"protocol", parquetByteArray, parquetUTF8, false},
+	{"method", parquetByteArray, parquetUTF8, false},
+	{"status_code", parquetInt32, -1, false},
+	{"elapsed_time", parquetInt64, -1, false},
+	{"phase", parquetByteArray, parquetUTF8, false},
+	{"type", parquetByteArray, parquetUTF8, false},
+	{"extras", parquetByteArray, parquetJSON, true},
+}
+
+// parquetExtras is the JSON encoding of the extras column.
+type parquetExtras struct {
+	Body        json.RawMessage        `json:"body,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+// parquetRow returns the value of each of parquetColumns for a report.  The
+// extras column is nil if the report doesn't have a body or annotations.
+func parquetRow(batch *collector.ReportBatch, report *collector.NelReport) ([]interface{}, error) {
+	var extras interface{}
+	if len(report.RawBody) > 0 || len(report.Annotations.Annotations) > 0 {
+		encoded, err := json.Marshal(parquetExtras{
+			Body:        json.RawMessage(report.RawBody),
+			Annotations: report.Annotations.Annotations,
+		})
+		if err != nil {
+			return nil, err
+		}
+		extras = string(encoded)
+	}
+	return []interface{}{
+		batch.Time.UnixNano() / int64(time.Millisecond),
+		batch.ClientIP,
+		int64(report.Age),
+		report.ReportType,
+		report.URL,
+		report.UserAgent,
+		report.Referrer,
+		report.SamplingFraction,
+		report.ServerIP,
+		report.Protocol,
+		report.Method,
+		int32(report.StatusCode),
+		int64(report.ElapsedTime),
+		report.Phase,
+		report.Type,
+		extras,
+	}, nil
+}
+
+// parquetColumnBuffer holds the PLAIN-encoded values of one column of the
+// row group that's being built, and for an optional column, the definition
+// level (0 for null, 1 for present) of each row.
+type parquetColumnBuffer struct {
+	values bytes.Buffer
+	levels []byte
+}
+
+func (b *parquetColumnBuffer) add(value interface{}, optional bool) {
+	if optional {
+		if value == nil {
+			b.levels = append(b.levels, 0)
+			return
+		}
+		b.levels = append(b.levels, 1)
+	}
+	var scratch [8]byte
+	switch v := value.(type) {
+	case int32:
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(v))
+		b.values.Write(scratch[:4])
+	case int64:
+		binary.LittleEndian.PutUint64(scratch[:], uint64(v))
+		b.values.Write(scratch[:])
+	case float32:
+		binary.LittleEndian.PutUint32(scratch[:4], math.Float32bits(v))
+		b.values.Write(scratch[:4])
+	case string:
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(v)))
+		b.values.Write(scratch[:4])
+		b.values.WriteString(v)
+	}
+}
+
+// page returns the uncompressed contents of the column's data page.  The
+// definition levels of an optional column use the RLE/bit-packing hybrid
+// encoding; since they're a single bit wide, we only ever need RLE runs, with
+// each value in a single byte.
+func (b *parquetColumnBuffer) page(optional bool) []byte {
+	var page []byte
+	if optional {
+		var levels []byte
+		for i := 0; i < len(b.levels); {
+			j := i
+			for j < len(b.levels) && b.levels[j] == b.levels[i] {
+				j++
+			}
+			levels = appendUvarint(levels, uint64(j-i)<<1)
+			levels = append(levels, b.levels[i])
+			i = j
+		}
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(levels)))
+		page = append(append(page, length[:]...), levels...)
+	}
+	return append(page, b.values.Bytes()...)
+}
+
+// parquetChunk describes a column chunk that's already been written, for the
+// file's footer.
+type parquetChunk struct {
+	offset           int64
+	values           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// parquetRowGroup describes a row group that's already been written.
+type parquetRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []parquetChunk
+}
+
+// pendingParquet is a Parquet file that's being built.  Row groups are
+// encoded into data as soon as they're full; the footer is added when the
+// file is uploaded.
+type pendingParquet struct {
+	partition time.Time
+	data      bytes.Buffer
+	groups    []parquetRowGroup
+	rows      int64
+	columns   []parquetColumnBuffer
+	groupRows int
+}
+
+func newPendingParquet(partition time.Time) *pendingParquet {
+	f := &pendingParquet{
+		partition: partition,
+		columns:   make([]parquetColumnBuffer, len(parquetColumns)),
+	}
+	f.data.WriteString("PAR1")
+	return f
+}
+
+func (f *pendingParquet) add(row []interface{}) {
+	for i, value := range row {
+		f.columns[i].add(value, parquetColumns[i].optional)
+	}
+	f.groupRows++
+	f.rows++
+}
+
+// finishRowGroup writes the rows that have been added since the last row
+// group as a new row group, with a single data page for each column.
+func (f *pendingParquet) finishRowGroup(compression ParquetCompression) error {
+	if f.groupRows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: int64(f.groupRows)}
+	for i, column := range parquetColumns {
+		page := f.columns[i].page(column.optional)
+		compressed, err := compression.compress(page)
+		if err != nil {
+			return err
+		}
+		var header thriftWriter
+		header.i32Field(1, parquetDataPage)
+		header.i32Field(2, int32(len(page)))
+		header.i32Field(3, int32(len(compressed)))
+		header.structField(5)
+		header.i32Field(1, int32(f.groupRows))
+		header.i32Field(2, parquetPlain)
+		header.i32Field(3, parquetRLE)
+		header.i32Field(4, parquetRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := parquetChunk{
+			offset:           int64(f.data.Len()),
+			values:           int64(f.groupRows),
+			uncompressedSize: int64(header.buf.Len() + len(page)),
+			compressedSize:   int64(header.buf.Len() + len(compressed)),
+		}
+		f.data.Write(header.buf.Bytes())
+		f.data.Write(compressed)
+		group.size += chunk.uncompressedSize
+		group.chunks = append(group.chunks, chunk)
+		f.columns[i] = parquetColumnBuffer{}
+	}
+	f.groups = append(f.groups, group)
+	f.groupRows = 0
+	return nil
+}
+
+// finish writes any remaining rows and the file's footer, and returns the
+// contents of the file.
+func (f *pendingParquet) finish(compression ParquetCompression) ([]byte, error) {
+	if err := f.finishRowGroup(compression); err != nil {
+		return nil, err
+	}
+
+	var footer thriftWriter
+	footer.i32Field(1, 1)
+	footer.listField(2, thriftStruct, len(parquetColumns)+1)
+	footer.beginStruct()
+	footer.stringField(4, "schema")
+	footer.i32Field(5, int32(len(parquetColumns)))
+	footer.endStruct()
+	for _, column := range parquetColumns {
+		footer.beginStruct()
+		footer.i32Field(1, column.kind)
+		repetition := int32(parquetRequired)
+		if column.optional {
+			repetition = parquetOptional
+		}
+		footer.i32Field(3, repetition)
+		footer.stringField(4, column.name)
+		if column.converted >= 0 {
+			footer.i32Field(6, column.converted)
+		}
+		footer.endStruct()
+	}
+	footer.i64Field(3, f.rows)
+	footer.listField(4, thriftStruct, len(f.groups))
+	for _, group := range f.groups {
+		footer.beginStruct()
+		footer.listField(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := parquetColumns[i]
+			footer.beginStruct()
+			footer.i64Field(2, chunk.offset)
+			footer.structField(3)
+			footer.i32Field(1, column.kind)
+			footer.listField(2, thriftI32, 2)
+			footer.i32Value(parquetPlain)
+			footer.i32Value(parquetRLE)
+			footer.listField(3, thriftBinary, 1)
+			footer.stringValue(column.name)
+			footer.i32Field(4, int32(compression))
+			footer.i64Field(5, chunk.values)
+			footer.i64Field(6, chunk.uncompressedSize)
+			footer.i64Field(7, chunk.compressedSize)
+			footer.i64Field(9, chunk.offset)
+			footer.endStruct()
+			footer.endStruct()
+		}
+		footer.i64Field(2, group.size)
+		footer.i64Field(3, group.rows)
+		footer.endStruct()
+	}
+	footer.stringField(6, "nel-collector")
+	footer.endStruct()
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(footer.buf.Len()))
+	f.data.Write(footer.buf.Bytes())
+	f.data.Write(length[:])
+	f.data.WriteString("PAR1")
+	return f.data.Bytes(), nil
+}
+
+// ParquetPublisher is a pipeline processor that writes reports to Parquet
+// files in an object store (see ObjectStorePublisher), for loading into a
+// data lake.  Each row of a file is one report.  There's a column for each of
+// the common NEL fields, with the same names as the columns of SQLPublisher's
+// table, and a JSON extras column holding the raw body of non-NEL reports and
+// each report's annotations (which is null if there aren't any).  Files are
+// partitioned by the hour in which their reports were received, using keys
+// like
+//
+//	year=2024/month=01/day=02/hour=15/<uuid>.parquet
+//
+// (See KeyLayout.)
+//
+// Every RowGroupSize reports, the buffered reports are encoded and compressed
+// as a row group.  A file is uploaded when its oldest report is FlushInterval
+// old, or when a report arrives for a different hour; anything left is
+// uploaded when the pipeline is closed.
+type ParquetPublisher struct {
+	Store ObjectStore
+
+	// The layout of object keys, just like ObjectStorePublisher's.
+	KeyLayout string
+
+	RowGroupSize  int
+	FlushInterval time.Duration
+	Compression   ParquetCompression
+
+	// Clock is used to decide when a file is old enough to upload.  If nil, we
+	// use the current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	pending *pendingParquet
+	started time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewParquetPublisher creates a new ParquetPublisher that uploads files to
+// store, using DefaultParquetKeyLayout and snappy compression.
+func NewParquetPublisher(store ObjectStore, rowGroupSize int, flushInterval time.Duration) *ParquetPublisher {
+	return &ParquetPublisher{
+		Store:         store,
+		KeyLayout:     DefaultParquetKeyLayout,
+		RowGroupSize:  rowGroupSize,
+		FlushInterval: flushInterval,
+		Compression:   ParquetSnappy,
+	}
+}
+
+func (p *ParquetPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// take removes the pending file from the publisher, so that it can be
+// uploaded.  p.mu must be held.
+func (p *ParquetPublisher) take() *pendingParquet {
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// upload finishes a pending file and uploads it to the store.
+func (p *ParquetPublisher) upload(ctx context.Context, pending *pendingParquet) error {
+	if pending == nil {
+		return nil
+	}
+	body, err := pending.finish(p.Compression)
+	if err != nil {
+		return fmt.Errorf("Couldn't encode %d reports: %v", pending.rows, err)
+	}
+	key := expandKeyLayout(p.KeyLayout, pending.partition)
+	if err := p.Store.PutObject(ctx, key, body, "application/vnd.apache.parquet", ""); err != nil {
+		return fmt.Errorf("Couldn't upload %d reports to %s: %v", pending.rows, key, err)
+	}
+	return nil
+}
+
+// flushPeriodically uploads the pending file every FlushInterval, so that
+// reports don't sit in memory for too long when they're arriving slowly.
+func (p *ParquetPublisher) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			if err := p.upload(context.Background(), pending); err != nil {
+				log.Printf("ParquetPublisher: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports adds each report in the batch to the pending file, uploading
+// it once it's old enough.
+func (p *ParquetPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("ParquetPublisher: %v", err)
+	}
+}
+
+// TryProcessReports adds each report in the batch to the pending file,
+// uploading it once it's old enough, and returns an error if that upload
+// fails.  Note that a failed upload can include reports from earlier batches,
+// which are lost.
+func (p *ParquetPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	rows := make([][]interface{}, 0, len(batch.Reports))
+	for i := range batch.Reports {
+		row, err := parquetRow(batch, &batch.Reports[i])
+		if err != nil {
+			return fmt.Errorf("Couldn't encode report: %v", err)
+		}
+		rows = append(rows, row)
+	}
+	partition := batch.Time.UTC().Truncate(time.Hour)
+	now := p.now()
+
+	var ready []*pendingParquet
+	var result error
+	p.mu.Lock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if p.pending != nil && !p.pending.partition.Equal(partition) {
+		ready = append(ready, p.take())
+	}
+	if p.pending == nil {
+		p.pending = newPendingParquet(partition)
+		p.started = now
+	}
+	for _, row := range rows {
+		p.pending.add(row)
+		if p.pending.groupRows >= p.RowGroupSize {
+			if err := p.pending.finishRowGroup(p.Compression); err != nil && result == nil {
+				result = fmt.Errorf("Couldn't encode row group: %v", err)
+			}
+		}
+	}
+	if p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval {
+		ready = append(ready, p.take())
+	}
+	p.mu.Unlock()
+
+	for _, pending := range ready {
+		if err := p.upload(ctx, pending); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Close finishes and uploads the pending file.
+func (p *ParquetPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	pending := p.take()
+	p.mu.Unlock()
+	return p.upload(context.Background(), pending)
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes a struct using Thrift's compact protocol, which is what
+// Parquet uses for page headers and file footers.  Start writing fields
+// straight away; the outermost struct is ended like any other.
+type thriftWriter struct {
+	buf    bytes.Buffer
+	last   int16
+	parent []int16
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(b, scratch[:binary.PutUvarint(scratch[:], v)]...)
+}
+
+func (w *thriftWriter) uvarint(v uint64) {
+	w.buf.Write(appendUvarint(nil, v))
+}
+
+func (w *thriftWriter) field(id int16, kind byte) {
+	if delta := id - w.last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		w.buf.WriteByte(kind)
+		w.uvarint(uint64(uint16((id << 1) ^ (id >> 15))))
+	}
+	w.last = id
+}
+
+func (w *thriftWriter) i32Value(v int32) {
+	w.uvarint(uint64(uint32((v << 1) ^ (v >> 31))))
+}
+
+func (w *thriftWriter) stringValue(v string) {
+	w.uvarint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w *thriftWriter) i32Field(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.i32Value(v)
+}
+
+func (w *thriftWriter) i64Field(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *thriftWriter) stringField(id int16, v string) {
+	w.field(id, thriftBinary)
+	w.stringValue(v)
+}
+
+// listField starts a list of n elements.  Write each element with the
+// corresponding Value method, or for a list of structs, with beginStruct and
+// endStruct.
+func (w *thriftWriter) listField(id int16, kind byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.buf.WriteByte(byte(n)<<4 | kind)
+	} else {
+		w.buf.WriteByte(0xf0 | kind)
+		w.uvarint(uint64(n))
+	}
+}
+
+// structField starts a struct-valued field; end it with endStruct.
+func (w *thriftWriter) structField(id int16) {
+	w.field(id, thriftStruct)
+	w.beginStruct()
+}
+
+func (w *thriftWriter) beginStruct() {
+	w.parent = append(w.parent, w.last)
+	w.last = 0
+}
+
+func (w *thriftWriter) endStruct() {
+	w.buf.WriteByte(0)
+	if n := len(w.parent); n > 0 {
+		w.last = w.parent[n-1]
+		w.parent = w.parent[:n-1]
+	}
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ParquetPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			store, err := loadObjectStore(ctx, "ParquetPublisher", configPrimitive)
+			if err != nil {
+				return nil, err
+			}
+
+			var config struct {
+				KeyPrefix     string `toml:"key_prefix"`
+				KeyLayout     string `toml:"key_layout"`
+				RowGroupSize  *int   `toml:"row_group_size"`
+				Compression   string `toml:"compression"`
+				FlushInterval string `toml:"flush_interval"`
+			}
+
+			err = collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			rowGroupSize := 10000
+			if config.RowGroupSize != nil {
+				rowGroupSize = *config.RowGroupSize
+				if rowGroupSize < 1 {
+					return nil, fmt.Errorf("ParquetPublisher `row_group_size` must be positive")
+				}
+			}
+			flushInterval := 15 * time.Minute
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("ParquetPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("ParquetPublisher `flush_interval` must be positive")
+				}
+			}
+
+			p := NewParquetPublisher(store, rowGroupSize, flushInterval)
+			p.Clock = clock
+			if config.Compression != "" {
+				compression, ok := parquetCompressions[config.Compression]
+				if !ok {
+					return nil, fmt.Errorf("ParquetPublisher invalid `compression`: %s", config.Compression)
+				}
+				p.Compression = compression
+			}
+			if config.KeyLayout != "" {
+				p.KeyLayout = config.KeyLayout
+			}
+			p.KeyLayout = config.KeyPrefix + p.KeyLayout
+			return p, nil
+		})
+}
@@ -0,0 +1,320 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/google/nel-collector/pkg/publish"
+	"github.com/klauspost/compress/zstd"
+)
+
+// thriftReader decodes Thrift's compact protocol, just well enough to read
+// the page headers and footers that ParquetPublisher writes.  Structs decode
+// to a map from field ID to value, lists to a slice, integers to int64, and
+// binary values to strings.
+type thriftReader struct {
+	r *bytes.Reader
+}
+
+func (r thriftReader) uvarint() uint64 {
+	v, _ := binary.ReadUvarint(r.r)
+	return v
+}
+
+func (r thriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r thriftReader) value(kind byte) interface{} {
+	switch kind {
+	case 5, 6:
+		return r.zigzag()
+	case 8:
+		b := make([]byte, r.uvarint())
+		io.ReadFull(r.r, b)
+		return string(b)
+	case 9:
+		header, _ := r.r.ReadByte()
+		n := uint64(header >> 4)
+		if n == 15 {
+			n = r.uvarint()
+		}
+		var list []interface{}
+		for i := uint64(0); i < n; i++ {
+			list = append(list, r.value(header&0xf))
+		}
+		return list
+	case 12:
+		s := make(map[int16]interface{})
+		var last int16
+		for {
+			header, err := r.r.ReadByte()
+			if err != nil || header == 0 {
+				return s
+			}
+			id := last + int16(header>>4)
+			if header>>4 == 0 {
+				id = int16(r.zigzag())
+			}
+			s[id] = r.value(header & 0xf)
+			last = id
+		}
+	}
+	panic(fmt.Sprintf("unexpected Thrift type %d", kind))
+}
+
+// parquetFile is the contents of a Parquet file written by ParquetPublisher.
+type parquetFile struct {
+	rows      int64
+	rowGroups int
+	// The values of each column, by name.
+	columns map[string][]interface{}
+}
+
+func readParquet(t *testing.T, data []byte) parquetFile {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Fatalf("Parquet file doesn't start and end with PAR1")
+	}
+	footerLength := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := thriftReader{bytes.NewReader(data[len(data)-8-footerLength : len(data)-8])}.value(12).(map[int16]interface{})
+
+	schema := footer[2].([]interface{})
+	file := parquetFile{
+		rows:    footer[3].(int64),
+		columns: make(map[string][]interface{}),
+	}
+	for _, rg := range footer[4].([]interface{}) {
+		file.rowGroups++
+		for i, c := range rg.(map[int16]interface{})[1].([]interface{}) {
+			element := schema[i+1].(map[int16]interface{})
+			name := element[4].(string)
+			optional := element[3].(int64) == 1
+			meta := c.(map[int16]interface{})[3].(map[int16]interface{})
+			r := thriftReader{bytes.NewReader(data[meta[9].(int64):])}
+			header := r.value(12).(map[int16]interface{})
+			page := make([]byte, header[3].(int64))
+			io.ReadFull(r.r, page)
+
+			var err error
+			switch meta[4].(int64) {
+			case 1:
+				page, err = snappy.Decode(nil, page)
+			case 2:
+				var gz *gzip.Reader
+				if gz, err = gzip.NewReader(bytes.NewReader(page)); err == nil {
+					page, err = ioutil.ReadAll(gz)
+				}
+			case 6:
+				var zr *zstd.Decoder
+				if zr, err = zstd.NewReader(nil); err == nil {
+					page, err = zr.DecodeAll(page, nil)
+					zr.Close()
+				}
+			}
+			if err != nil {
+				t.Fatalf("Couldn't decompress page for %s: %v", name, err)
+			}
+			if int64(len(page)) != header[2].(int64) {
+				t.Fatalf("Page for %s has %d bytes, header says %d", name, len(page), header[2])
+			}
+
+			n := int(header[5].(map[int16]interface{})[1].(int64))
+			levels := make([]byte, n)
+			for i := range levels {
+				levels[i] = 1
+			}
+			if optional {
+				length := binary.LittleEndian.Uint32(page)
+				lr := bytes.NewReader(page[4 : 4+length])
+				for i := 0; i < n; {
+					run, _ := binary.ReadUvarint(lr)
+					level, _ := lr.ReadByte()
+					for j := uint64(0); j < run>>1; j++ {
+						levels[i] = level
+						i++
+					}
+				}
+				page = page[4+length:]
+			}
+			for _, level := range levels {
+				if level == 0 {
+					file.columns[name] = append(file.columns[name], nil)
+					continue
+				}
+				var value interface{}
+				switch element[1].(int64) {
+				case 1:
+					value = int32(binary.LittleEndian.Uint32(page))
+					page = page[4:]
+				case 2:
+					value = int64(binary.LittleEndian.Uint64(page))
+					page = page[8:]
+				case 4:
+					value = math.Float32frombits(binary.LittleEndian.Uint32(page))
+					page = page[4:]
+				case 6:
+					length := binary.LittleEndian.Uint32(page)
+					value = string(page[4 : 4+length])
+					page = page[4+length:]
+				}
+				file.columns[name] = append(file.columns[name], value)
+			}
+		}
+	}
+	return file
+}
+
+func TestParquetPublisher(t *testing.T) {
+	for _, compression := range []publish.ParquetCompression{publish.ParquetUncompressed, publish.ParquetSnappy, publish.ParquetGzip, publish.ParquetZstd} {
+		store := &memoryStore{objects: make(map[string][]byte)}
+		clock := pipelinetest.NewSimulatedClock()
+		p := publish.NewParquetPublisher(store, 2, time.Hour)
+		p.Clock = clock
+		p.Compression = compression
+		p.KeyLayout = "nel/" + p.KeyLayout
+
+		received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+		batch := &collector.ReportBatch{Time: received, ClientIP: "192.0.2.1"}
+		for i := 0; i < 3; i++ {
+			batch.Reports = append(batch.Reports, collector.NelReport{
+				ReportType:       "network-error",
+				URL:              fmt.Sprintf("https://example.com/%d", i),
+				SamplingFraction: 0.5,
+				StatusCode:       200 + i,
+				Type:             "ok",
+			})
+		}
+		batch.Reports[1].SetAnnotation("Sampled", true)
+		next := &collector.ReportBatch{
+			Time:    received.Add(time.Hour),
+			Reports: []collector.NelReport{{ReportType: "csp-violation", URL: "https://example.com/", RawBody: []byte(`{"blocked-uri":"inline"}`)}},
+		}
+
+		ctx := context.Background()
+		// A new hour starts a new file.
+		for _, b := range []*collector.ReportBatch{batch, next} {
+			if err := p.TryProcessReports(ctx, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(store.keys) != 1 {
+			t.Fatalf("ParquetPublisher uploaded %d files before Close, wanted 1", len(store.keys))
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		uuid := regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
+		var keys []string
+		for _, key := range store.keys {
+			keys = append(keys, uuid.ReplaceAllString(key, "UUID"))
+		}
+		wantKeys := []string{
+			"nel/year=2024/month=01/day=02/hour=15/UUID.parquet",
+			"nel/year=2024/month=01/day=02/hour=16/UUID.parquet",
+		}
+		if diff := cmp.Diff(wantKeys, keys); diff != "" {
+			t.Errorf("ParquetPublisher(compression=%d) got diff in keys (-want +got):\n%s", compression, diff)
+		}
+
+		first := readParquet(t, store.objects[store.keys[0]])
+		if first.rows != 3 || first.rowGroups != 2 {
+			t.Errorf("ParquetPublisher(compression=%d) wrote %d rows in %d row groups, wanted 3 in 2", compression, first.rows, first.rowGroups)
+		}
+		millis := received.UnixNano() / int64(time.Millisecond)
+		for column, want := range map[string][]interface{}{
+			"received_at":       {millis, millis, millis},
+			"client_ip":         {"192.0.2.1", "192.0.2.1", "192.0.2.1"},
+			"url":               {"https://example.com/0", "https://example.com/1", "https://example.com/2"},
+			"sampling_fraction": {float32(0.5), float32(0.5), float32(0.5)},
+			"status_code":       {int32(200), int32(201), int32(202)},
+			"referrer":          {"", "", ""},
+			"extras":            {nil, `{"annotations":{"Sampled":true}}`, nil},
+		} {
+			if diff := cmp.Diff(want, first.columns[column]); diff != "" {
+				t.Errorf("ParquetPublisher(compression=%d) got diff in %s (-want +got):\n%s", compression, column, diff)
+			}
+		}
+
+		second := readParquet(t, store.objects[store.keys[1]])
+		if diff := cmp.Diff([]interface{}{`{"body":{"blocked-uri":"inline"}}`}, second.columns["extras"]); diff != "" {
+			t.Errorf("ParquetPublisher(compression=%d) got diff in extras (-want +got):\n%s", compression, diff)
+		}
+	}
+}
+
+func TestParquetPublisherFlushInterval(t *testing.T) {
+	store := &memoryStore{objects: make(map[string][]byte)}
+	clock := pipelinetest.NewSimulatedClock()
+	p := publish.NewParquetPublisher(store, 100, time.Hour)
+	p.Clock = clock
+	defer p.Close()
+
+	batch := func() *collector.ReportBatch {
+		return &collector.ReportBatch{
+			Time:    time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC),
+			Reports: []collector.NelReport{{ReportType: "network-error", URL: "https://example.com/"}},
+		}
+	}
+	ctx := context.Background()
+	if err := p.TryProcessReports(ctx, batch()); err != nil {
+		t.Fatal(err)
+	}
+	clock.CurrentTime = clock.CurrentTime.Add(time.Hour)
+	if err := p.TryProcessReports(ctx, batch()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.keys) != 1 {
+		t.Fatalf("ParquetPublisher uploaded %d files, wanted 1", len(store.keys))
+	}
+	if file := readParquet(t, store.objects[store.keys[0]]); file.rows != 2 || file.rowGroups != 1 {
+		t.Errorf("ParquetPublisher wrote %d rows in %d row groups, wanted 2 in 1", file.rows, file.rowGroups)
+	}
+}
+
+func TestParquetPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`provider = "ftp"`,
+		`provider = "file"`,
+		`provider = "file"` + "\n" + `directory = "/tmp"` + "\n" + `compression = "lzo"`,
+		`provider = "file"` + "\n" + `directory = "/tmp"` + "\n" + `row_group_size = 0`,
+		`provider = "file"` + "\n" + `directory = "/tmp"` + "\n" + `flush_interval = "soon"`,
+		`provider = "file"` + "\n" + `directory = "/tmp"` + "\n" + `flush_interval = "-1m"`,
+	} {
+		pipeline := collector.NewTestPipeline(pipelinetest.NewSimulatedClock())
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"ParquetPublisher\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+		pipeline.Close()
+	}
+}
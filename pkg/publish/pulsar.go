@@ -0,0 +1,453 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// pulsarStringSchema is the value schema of the messages that PulsarPublisher
+// produces: each payload is a JSON record, sent as a string.
+const pulsarStringSchema = `{"type":"STRING","schema":"","properties":{}}`
+
+// pulsarMessage is a message that's waiting to be produced.
+type pulsarMessage struct {
+	Key     string `json:"key,omitempty"`
+	Payload string `json:"payload"`
+}
+
+// PulsarPublisher is a pipeline processor that produces a message for each
+// report to an Apache Pulsar topic, using the REST producer API of the
+// cluster's brokers (or a proxy in front of them).  Each message's payload is a
+// JSON object with the same fields as the lines of ObjectStorePublisher's
+// objects, and its key comes from the report field named by KeyField, which
+// can be any of the fields that InfluxPublisher's tags can use; reports without
+// one don't get a key.
+//
+// Topic is a full topic name, such as persistent://tenant/namespace/topic (the
+// persistent:// prefix can be left out).  If Partitions is nonzero, the topic
+// is partitioned, and we produce each message to a partition chosen by hashing
+// its key, so that reports with the same key stay in order; reports without a
+// key go to partition 0.
+//
+// Sending is asynchronous: messages are buffered until there are BatchSize of
+// them, or the oldest buffered message is FlushInterval old, and are then
+// handed to a background goroutine that produces them, so that a slow broker
+// doesn't hold up the pipeline (unless the background goroutine falls far
+// enough behind, in which case ProcessReports waits for it).  Close flushes the
+// buffer, and waits for every message to be produced.  Messages that can't be
+// produced are logged and dropped, and counted; see SendErrors.
+type PulsarPublisher struct {
+	// The base URL of the broker's (or proxy's) web service, such as
+	// http://pulsar.example.com:8080.
+	ServiceURL string
+	Topic      string
+	Partitions int
+
+	KeyField string
+	// An optional token, sent as a bearer token in each request's
+	// Authorization header.
+	AuthToken string
+
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// The client used to send requests.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to decide when the buffer is old enough to send.  If nil,
+	// we use the current time.
+	Clock collector.Clock
+
+	sendErrors int64
+	mu         sync.Mutex
+	pending    []pulsarMessage
+	started    time.Time
+	closed     bool
+	queueMu    sync.RWMutex
+	queue      chan []pulsarMessage
+	wg         sync.WaitGroup
+}
+
+// NewPulsarPublisher creates a new PulsarPublisher that produces messages to
+// a topic through the web service at serviceURL, keyed by the host of each
+// report's URL.  It returns an error if the topic isn't a valid topic name.
+func NewPulsarPublisher(serviceURL, topic string, batchSize int, flushInterval time.Duration) (*PulsarPublisher, error) {
+	if _, err := pulsarTopicPath(topic); err != nil {
+		return nil, err
+	}
+	return &PulsarPublisher{
+		ServiceURL:    serviceURL,
+		Topic:         topic,
+		KeyField:      "host",
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+	}, nil
+}
+
+// pulsarTopicPath returns the path of the REST producer endpoint for a topic.
+func pulsarTopicPath(topic string) (string, error) {
+	domain := "persistent"
+	name := topic
+	if i := strings.Index(topic, "://"); i >= 0 {
+		domain = topic[:i]
+		name = topic[i+3:]
+	}
+	if domain != "persistent" && domain != "non-persistent" {
+		return "", fmt.Errorf("invalid topic %s", topic)
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid topic %s: should be tenant/namespace/topic", topic)
+	}
+	for i, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("invalid topic %s", topic)
+		}
+		parts[i] = url.PathEscape(part)
+	}
+	return "/topics/" + domain + "/" + strings.Join(parts, "/"), nil
+}
+
+func (p *PulsarPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// SendErrors returns the number of messages that couldn't be produced.
+func (p *PulsarPublisher) SendErrors() int64 {
+	return atomic.LoadInt64(&p.sendErrors)
+}
+
+// partition returns the partition to produce a message with a key to.
+func (p *PulsarPublisher) partition(key string) int {
+	if key == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(p.Partitions))
+}
+
+// message encodes a report as a message.
+func (p *PulsarPublisher) message(batch *collector.ReportBatch, report *collector.NelReport) (pulsarMessage, error) {
+	payload, err := json.Marshal(p.FieldNames.record(batch, report))
+	if err != nil {
+		return pulsarMessage{}, err
+	}
+	var key string
+	if p.KeyField != "" {
+		key = influxTag(p.KeyField)(report)
+	}
+	return pulsarMessage{Key: key, Payload: string(payload)}, nil
+}
+
+// produce makes a single request producing messages to one partition (or, if
+// partition is negative, to a non-partitioned topic), and returns the number
+// of messages that weren't produced.
+func (p *PulsarPublisher) produce(ctx context.Context, partition int, messages []pulsarMessage) (int, error) {
+	path, err := pulsarTopicPath(p.Topic)
+	if err != nil {
+		return len(messages), err
+	}
+	if partition >= 0 {
+		path += "/partitions/" + strconv.Itoa(partition)
+	}
+	body, err := json.Marshal(struct {
+		ValueSchema string          `json:"valueSchema"`
+		Messages    []pulsarMessage `json:"messages"`
+	}{pulsarStringSchema, messages})
+	if err != nil {
+		return len(messages), err
+	}
+
+	r, err := http.NewRequest("POST", strings.TrimSuffix(p.ServiceURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return len(messages), err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	if p.AuthToken != "" {
+		r.Header.Set("Authorization", "Bearer "+p.AuthToken)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return len(messages), err
+	}
+	defer response.Body.Close()
+	message, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return len(messages), err
+	}
+	if response.StatusCode/100 != 2 {
+		return len(messages), fmt.Errorf("Couldn't produce messages to %s: %s: %s", p.Topic, response.Status, bytes.TrimSpace(message))
+	}
+
+	var results struct {
+		MessagePublishResults []struct {
+			ErrorCode int    `json:"errorCode"`
+			ErrorMsg  string `json:"errorMsg"`
+		} `json:"messagePublishResults"`
+	}
+	if err := json.Unmarshal(message, &results); err != nil {
+		return 0, fmt.Errorf("Couldn't parse response from %s: %v", p.Topic, err)
+	}
+	failed := 0
+	var lastError string
+	for _, result := range results.MessagePublishResults {
+		if result.ErrorCode != 0 {
+			failed++
+			lastError = result.ErrorMsg
+		}
+	}
+	if failed > 0 {
+		return failed, fmt.Errorf("%s rejected %d messages: %s", p.Topic, failed, lastError)
+	}
+	return 0, nil
+}
+
+// send produces a set of messages, grouping them by partition, and logs and
+// counts any that fail.
+func (p *PulsarPublisher) send(messages []pulsarMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	var partitions [][]pulsarMessage
+	if p.Partitions > 0 {
+		partitions = make([][]pulsarMessage, p.Partitions)
+		for _, message := range messages {
+			i := p.partition(message.Key)
+			partitions[i] = append(partitions[i], message)
+		}
+	}
+	for i, group := range partitions {
+		if len(group) == 0 {
+			continue
+		}
+		if failed, err := p.produce(context.Background(), i, group); err != nil {
+			atomic.AddInt64(&p.sendErrors, int64(failed))
+			log.Printf("PulsarPublisher: %v", err)
+		}
+	}
+	if partitions == nil {
+		if failed, err := p.produce(context.Background(), -1, messages); err != nil {
+			atomic.AddInt64(&p.sendErrors, int64(failed))
+			log.Printf("PulsarPublisher: %v", err)
+		}
+	}
+}
+
+// take removes the buffered messages, so that they can be sent.  p.mu must be
+// held.
+func (p *PulsarPublisher) take() []pulsarMessage {
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// run produces the batches of messages that are handed to it, and sends the
+// buffer every FlushInterval, so that messages don't sit in the buffer for too
+// long when they're arriving slowly.
+func (p *PulsarPublisher) run(queue chan []pulsarMessage) {
+	defer p.wg.Done()
+	var tick <-chan time.Time
+	if p.FlushInterval > 0 {
+		ticker := time.NewTicker(p.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case messages, ok := <-queue:
+			if !ok {
+				return
+			}
+			p.send(messages)
+		case <-tick:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			p.send(pending)
+		}
+	}
+}
+
+// enqueue hands a batch of messages to the background goroutine.
+func (p *PulsarPublisher) enqueue(messages []pulsarMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	p.queueMu.RLock()
+	defer p.queueMu.RUnlock()
+	if p.queue == nil {
+		atomic.AddInt64(&p.sendErrors, int64(len(messages)))
+		log.Printf("PulsarPublisher: dropping %d messages produced after Close", len(messages))
+		return
+	}
+	p.queue <- messages
+}
+
+// ProcessReports buffers a message for each report in the batch, handing the
+// buffer to the background goroutine once it's big enough or old enough.
+func (p *PulsarPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if len(batch.Reports) == 0 {
+		return
+	}
+	messages := make([]pulsarMessage, 0, len(batch.Reports))
+	for i := range batch.Reports {
+		message, err := p.message(batch, &batch.Reports[i])
+		if err != nil {
+			atomic.AddInt64(&p.sendErrors, 1)
+			log.Printf("PulsarPublisher: %v", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	now := p.now()
+
+	var ready []pulsarMessage
+	p.mu.Lock()
+	if p.queue == nil && !p.closed {
+		p.queueMu.Lock()
+		p.queue = make(chan []pulsarMessage, 16)
+		p.queueMu.Unlock()
+		p.wg.Add(1)
+		go p.run(p.queue)
+	}
+	if len(p.pending) == 0 {
+		p.started = now
+	}
+	p.pending = append(p.pending, messages...)
+	if len(p.pending) >= p.BatchSize || (p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval) {
+		ready = p.take()
+	}
+	p.mu.Unlock()
+
+	p.enqueue(ready)
+}
+
+// Close flushes the buffer, and waits for every message to be produced.
+func (p *PulsarPublisher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	pending := p.take()
+	p.mu.Unlock()
+	p.enqueue(pending)
+
+	p.queueMu.Lock()
+	if p.queue != nil {
+		close(p.queue)
+		p.queue = nil
+	}
+	p.queueMu.Unlock()
+	p.wg.Wait()
+	return nil
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"PulsarPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				ServiceURL    string            `toml:"service_url"`
+				Topic         string            `toml:"topic"`
+				Partitions    int               `toml:"partitions"`
+				KeyField      *string           `toml:"key_field"`
+				AuthToken     string            `toml:"auth_token"`
+				BatchSize     int               `toml:"batch_size"`
+				FlushInterval string            `toml:"flush_interval"`
+				FieldNames    map[string]string `toml:"field_names"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("PulsarPublisher invalid `field_names`: %v", err)
+			}
+
+			if config.ServiceURL == "" {
+				return nil, fmt.Errorf("PulsarPublisher missing `service_url`")
+			}
+			if u, err := url.Parse(config.ServiceURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("PulsarPublisher invalid `service_url`: %s", config.ServiceURL)
+			}
+			if config.Topic == "" {
+				return nil, fmt.Errorf("PulsarPublisher missing `topic`")
+			}
+			if config.Partitions < 0 {
+				return nil, fmt.Errorf("PulsarPublisher `partitions` must not be negative")
+			}
+			if config.BatchSize < 0 {
+				return nil, fmt.Errorf("PulsarPublisher `batch_size` must not be negative")
+			}
+			if config.BatchSize == 0 {
+				config.BatchSize = 100
+			}
+			flushInterval := time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("PulsarPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("PulsarPublisher `flush_interval` must be positive")
+				}
+			}
+
+			p, err := NewPulsarPublisher(config.ServiceURL, config.Topic, config.BatchSize, flushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("PulsarPublisher invalid `topic`: %v", err)
+			}
+			if config.KeyField != nil {
+				if *config.KeyField != "" && influxTag(*config.KeyField) == nil {
+					return nil, fmt.Errorf("PulsarPublisher invalid `key_field`: %s", *config.KeyField)
+				}
+				p.KeyField = *config.KeyField
+			}
+			p.Partitions = config.Partitions
+			p.AuthToken = config.AuthToken
+			p.FieldNames = fieldNames
+			p.Clock = clock
+			return p, nil
+		})
+}
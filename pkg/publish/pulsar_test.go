@@ -0,0 +1,198 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+type pulsarRequest struct {
+	path     string
+	keys     []string
+	payloads []string
+}
+
+// fakePulsar is a Pulsar REST producer endpoint that records each request,
+// and rejects the messages whose payloads mention rejected.example.
+type fakePulsar struct {
+	mu       sync.Mutex
+	requests []pulsarRequest
+}
+
+func (f *fakePulsar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var request struct {
+		ValueSchema string `json:"valueSchema"`
+		Messages    []struct {
+			Key     string `json:"key"`
+			Payload string `json:"payload"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !strings.Contains(request.ValueSchema, "STRING") {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	recorded := pulsarRequest{path: r.URL.Path}
+	type result struct {
+		MessageID string `json:"messageId"`
+		ErrorCode int    `json:"errorCode"`
+		ErrorMsg  string `json:"errorMsg"`
+	}
+	var results []result
+	for _, message := range request.Messages {
+		recorded.keys = append(recorded.keys, message.Key)
+		recorded.payloads = append(recorded.payloads, message.Payload)
+		if strings.Contains(message.Payload, "rejected.example") {
+			results = append(results, result{ErrorCode: 2, ErrorMsg: "Topic is terminated"})
+		} else {
+			results = append(results, result{MessageID: "1:1:-1"})
+		}
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, recorded)
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"messagePublishResults": results})
+}
+
+func TestPulsarPublisher(t *testing.T) {
+	fake := &fakePulsar{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	p, err := publish.NewPulsarPublisher(server.URL, "persistent://public/default/nel", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthToken = "token"
+	received := time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC)
+	ctx := context.Background()
+	p.ProcessReports(ctx, &collector.ReportBatch{Time: received, ClientIP: "192.0.2.1", Reports: []collector.NelReport{
+		{URL: "https://a.example/", Type: "tcp.timed_out"},
+		{URL: "https://b.example/", Type: "ok"},
+		{URL: "https://rejected.example/", Type: "ok"},
+	}})
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]string
+	for _, request := range fake.requests {
+		if request.path != "/topics/persistent/public/default/nel" {
+			t.Errorf("PulsarPublisher sent request to %s", request.path)
+		}
+		got = append(got, request.keys)
+	}
+	if diff := cmp.Diff([][]string{{"a.example", "b.example", "rejected.example"}}, got); diff != "" {
+		t.Errorf("PulsarPublisher produced keys diff (-want +got):\n%s", diff)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(fake.requests[0].payloads[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["url"] != "https://a.example/" || record["client_ip"] != "192.0.2.1" || record["received_at"] != "2024-01-02T15:30:00Z" {
+		t.Errorf("PulsarPublisher produced message %v", record)
+	}
+	if got := p.SendErrors(); got != 1 {
+		t.Errorf("PulsarPublisher.SendErrors() = %d, wanted 1", got)
+	}
+}
+
+func TestPulsarPublisherPartitions(t *testing.T) {
+	fake := &fakePulsar{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	p, err := publish.NewPulsarPublisher(server.URL, "tenant/ns/nel", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AuthToken = "token"
+	p.Partitions = 4
+	batch := &collector.ReportBatch{}
+	for _, host := range []string{"a", "b", "c", "d", "e", "a", "b", "c", "d", "e"} {
+		batch.Reports = append(batch.Reports, collector.NelReport{URL: "https://" + host + ".example/"})
+	}
+	p.ProcessReports(context.Background(), batch)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each host's reports all go to the same partition.
+	partitions := make(map[string]string)
+	total := 0
+	for _, request := range fake.requests {
+		if !strings.HasPrefix(request.path, "/topics/persistent/tenant/ns/nel/partitions/") {
+			t.Errorf("PulsarPublisher sent request to %s", request.path)
+		}
+		for _, key := range request.keys {
+			if partition, ok := partitions[key]; ok && partition != request.path {
+				t.Errorf("PulsarPublisher sent %s to both %s and %s", key, partition, request.path)
+			}
+			partitions[key] = request.path
+			total++
+		}
+	}
+	if total != 10 {
+		t.Errorf("PulsarPublisher produced %d messages, wanted 10", total)
+	}
+
+	// Failed requests count every message as an error.
+	server.Close()
+	p, err = publish.NewPulsarPublisher(server.URL, "tenant/ns/nel", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ProcessReports(context.Background(), &collector.ReportBatch{Reports: make([]collector.NelReport, 3)})
+	p.Close()
+	if got := p.SendErrors(); got != 3 {
+		t.Errorf("PulsarPublisher.SendErrors() = %d, wanted 3", got)
+	}
+}
+
+func TestPulsarPublisherBadConfig(t *testing.T) {
+	base := `type = "PulsarPublisher"` + "\n" + `service_url = "http://pulsar.local:8080"` + "\n"
+	configs := []string{
+		`type = "PulsarPublisher"` + "\n" + `topic = "public/default/nel"`,
+		`type = "PulsarPublisher"` + "\n" + `service_url = "pulsar://pulsar.local:6650"` + "\n" + `topic = "public/default/nel"`,
+		base,
+		base + `topic = "nel"`,
+		base + `topic = "kafka://public/default/nel"`,
+		base + `topic = "public/default/nel"` + "\n" + `partitions = -1`,
+		base + `topic = "public/default/nel"` + "\n" + `key_field = "url"`,
+		base + `topic = "public/default/nel"` + "\n" + `batch_size = -1`,
+		base + `topic = "public/default/nel"` + "\n" + `flush_interval = "0s"`,
+		base + `topic = "public/default/nel"` + "\n" + `field_names = {url = ""}`,
+	}
+	for _, config := range configs {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// A SentryRule decides which reports are severe enough to send to Sentry, and
+// at what level.
+type SentryRule struct {
+	// Reports that match this condition are sent.  (See core.NewWhere for the
+	// syntax.)
+	Where *core.Where
+	// The level of the events for matching reports: fatal, error, warning,
+	// info, or debug.
+	Level string
+}
+
+// NewSentryRule creates a new SentryRule that sends reports matching a
+// condition as events with the given level.
+func NewSentryRule(condition, level string) (SentryRule, error) {
+	switch level {
+	case "fatal", "error", "warning", "info", "debug":
+	default:
+		return SentryRule{}, fmt.Errorf("invalid level %s", level)
+	}
+	where, err := core.NewWhere(condition, nil)
+	if err != nil {
+		return SentryRule{}, err
+	}
+	return SentryRule{Where: where, Level: level}, nil
+}
+
+// SentryRuleConfig is the configuration of a SentryRule, as it appears in the
+// `rule` sections of a SentryPublisher's configuration.
+type SentryRuleConfig struct {
+	Condition string `toml:"condition"`
+	Level     string `toml:"level"`
+}
+
+// DefaultSentryRules are the rules that SentryPublisher uses unless you
+// provide different ones: DNS and connection failures are errors, and server
+// errors are warnings.  Client errors (such as 404s) aren't sent at all.
+var DefaultSentryRules = []SentryRuleConfig{
+	{`phase == "dns"`, "error"},
+	{`phase == "connection"`, "error"},
+	{`status_code >= 500`, "warning"},
+}
+
+// sentryEvent is the JSON encoding of a Sentry event.
+type sentryEvent struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Platform    string                 `json:"platform"`
+	Logger      string                 `json:"logger"`
+	Message     sentryMessage          `json:"message"`
+	Fingerprint []string               `json:"fingerprint"`
+	Tags        map[string]string      `json:"tags"`
+	Request     sentryRequest          `json:"request"`
+	Extra       map[string]interface{} `json:"extra"`
+}
+
+type sentryMessage struct {
+	Formatted string `json:"formatted"`
+}
+
+type sentryRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method,omitempty"`
+}
+
+// SentryPublisher is a pipeline processor that sends severe reports to Sentry
+// as events, so that outages show up alongside your other errors.  Each report
+// is checked against Rules in order, and the first rule that it matches decides
+// the level of its event; reports that don't match any rule aren't sent.
+// Events are fingerprinted by the host of the report's URL and its type, so
+// that Sentry groups together the reports about the same problem.
+//
+// To avoid flooding Sentry during a large outage, at most MaxEventsPerMinute
+// events are sent each minute; any others are dropped.  Events are buffered in
+// memory, and sent every FlushInterval, and when the pipeline is closed.
+type SentryPublisher struct {
+	// The Sentry DSN of the project to send events to, such as
+	// https://<key>@o0.ingest.sentry.io/<project>.
+	DSN string
+
+	Rules              []SentryRule
+	MaxEventsPerMinute int
+	FlushInterval      time.Duration
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// The client used to send events.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to enforce MaxEventsPerMinute.  If nil, we use the current
+	// time.
+	Clock collector.Clock
+
+	endpoint  string
+	publicKey string
+
+	mu          sync.Mutex
+	pending     []sentryEvent
+	windowStart time.Time
+	windowCount int
+	dropped     int64
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewSentryPublisher creates a new SentryPublisher that sends events to the
+// project identified by a DSN.
+func NewSentryPublisher(dsn string, rules []SentryRule, maxEventsPerMinute int, flushInterval time.Duration) (*SentryPublisher, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("DSN is missing its public key")
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	project := u.Path[slash+1:]
+	if slash < 0 || project == "" {
+		return nil, fmt.Errorf("DSN is missing its project ID")
+	}
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path[:slash] + "/api/" + project + "/envelope/"}
+	return &SentryPublisher{
+		DSN:                dsn,
+		Rules:              rules,
+		MaxEventsPerMinute: maxEventsPerMinute,
+		FlushInterval:      flushInterval,
+		endpoint:           endpoint.String(),
+		publicKey:          u.User.Username(),
+	}, nil
+}
+
+func (p *SentryPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// Dropped returns the number of events that have been dropped because they
+// exceeded MaxEventsPerMinute.
+func (p *SentryPublisher) Dropped() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+// level returns the level of the event for a report, or "" if the report
+// shouldn't be sent.
+func (p *SentryPublisher) level(batch *collector.ReportBatch, report *collector.NelReport) string {
+	for _, rule := range p.Rules {
+		if rule.Where.Matches(batch, report) {
+			return rule.Level
+		}
+	}
+	return ""
+}
+
+func newSentryEvent(batch *collector.ReportBatch, report *collector.NelReport, level string, names FieldNames) sentryEvent {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	host := report.URL
+	if u, err := url.Parse(report.URL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	message := fmt.Sprintf("%s (%s phase) for %s", report.Type, report.Phase, host)
+	tags := map[string]string{
+		"nel.type":  report.Type,
+		"nel.phase": report.Phase,
+		"url.host":  host,
+	}
+	if report.StatusCode != 0 {
+		message = fmt.Sprintf("%s (%s phase, status %d) for %s", report.Type, report.Phase, report.StatusCode, host)
+		tags["nel.status_code"] = strconv.Itoa(report.StatusCode)
+	}
+	return sentryEvent{
+		EventID:     hex.EncodeToString(id[:]),
+		Timestamp:   report.EventTime(batch.Time).UTC(),
+		Level:       level,
+		Platform:    "other",
+		Logger:      "nel-collector",
+		Message:     sentryMessage{message},
+		Fingerprint: []string{"nel", host, report.Type},
+		Tags:        tags,
+		Request:     sentryRequest{URL: report.URL, Method: report.Method},
+		Extra:       map[string]interface{}{"report": names.record(batch, report)},
+	}
+}
+
+// send sends a single event to Sentry, wrapped in an envelope.
+func (p *SentryPublisher) send(ctx context.Context, event sentryEvent) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": event.EventID, "dsn": p.DSN})
+	item, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(encoded)})
+	var envelope bytes.Buffer
+	for _, line := range [][]byte{header, item, encoded} {
+		envelope.Write(line)
+		envelope.WriteByte('\n')
+	}
+
+	r, err := http.NewRequest("POST", p.endpoint, &envelope)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-sentry-envelope")
+	r.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=nel-collector/1.0, sentry_key=%s", p.publicKey))
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Couldn't send event to Sentry: %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// flush sends every buffered event, returning the first error.
+func (p *SentryPublisher) flush(ctx context.Context) error {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+
+	var result error
+	for _, event := range pending {
+		if err := p.send(ctx, event); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// flushPeriodically sends the buffered events every FlushInterval.
+func (p *SentryPublisher) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.flush(context.Background()); err != nil {
+				log.Printf("SentryPublisher: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports buffers an event for each severe report in the batch.
+func (p *SentryPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	var events []sentryEvent
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if level := p.level(batch, report); level != "" {
+			events = append(events, newSentryEvent(batch, report, level, p.FieldNames))
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if now.Sub(p.windowStart) >= time.Minute {
+		p.windowStart = now
+		p.windowCount = 0
+	}
+	for _, event := range events {
+		if p.MaxEventsPerMinute > 0 && p.windowCount >= p.MaxEventsPerMinute {
+			p.dropped++
+			continue
+		}
+		p.windowCount++
+		p.pending = append(p.pending, event)
+	}
+}
+
+// Close sends any buffered events.
+func (p *SentryPublisher) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return p.flush(context.Background())
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"SentryPublisher",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				DSN                string             `toml:"dsn"`
+				MaxEventsPerMinute int                `toml:"max_events_per_minute"`
+				FlushInterval      string             `toml:"flush_interval"`
+				Rules              []SentryRuleConfig `toml:"rule"`
+				FieldNames         map[string]string  `toml:"field_names"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("SentryPublisher invalid `field_names`: %v", err)
+			}
+
+			if config.DSN == "" {
+				return nil, fmt.Errorf("SentryPublisher missing `dsn`")
+			}
+			if config.MaxEventsPerMinute < 0 {
+				return nil, fmt.Errorf("SentryPublisher `max_events_per_minute` must not be negative")
+			}
+			if config.MaxEventsPerMinute == 0 {
+				config.MaxEventsPerMinute = 60
+			}
+			flushInterval := 5 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("SentryPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("SentryPublisher `flush_interval` must be positive")
+				}
+			}
+
+			if config.Rules == nil {
+				config.Rules = DefaultSentryRules
+			}
+			var rules []SentryRule
+			for i, rule := range config.Rules {
+				if rule.Level == "" {
+					rule.Level = "error"
+				}
+				r, err := NewSentryRule(rule.Condition, rule.Level)
+				if err != nil {
+					return nil, fmt.Errorf("SentryPublisher invalid `rule` %d: %v", i, err)
+				}
+				rules = append(rules, r)
+			}
+
+			p, err := NewSentryPublisher(config.DSN, rules, config.MaxEventsPerMinute, flushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("SentryPublisher invalid `dsn`: %v", err)
+			}
+			p.Clock = clock
+			p.FieldNames = fieldNames
+			return p, nil
+		})
+}
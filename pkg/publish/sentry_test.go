@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+)
+
+func TestSentryPublisher(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=public") {
+			http.Error(w, "wrong project", http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+		if len(lines) != 3 {
+			http.Error(w, "bad envelope", http.StatusBadRequest)
+			return
+		}
+		var event struct {
+			Level       string            `json:"level"`
+			Fingerprint []string          `json:"fingerprint"`
+			Tags        map[string]string `json:"tags"`
+			Message     struct {
+				Formatted string `json:"formatted"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(lines[2], &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events = append(events, fmt.Sprintf("%s %v %s", event.Level, event.Fingerprint, event.Message.Formatted))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "http://", "http://public@", 1) + "/prefix/42"
+	pipelinetest.RunTestConfig(fmt.Sprintf(`
+		[[processor]]
+		type = "SentryPublisher"
+		dsn = "%s"
+		max_events_per_minute = 3
+	`, dsn), &collector.ReportBatch{
+		Reports: []collector.NelReport{
+			{URL: "https://a.example/x", Phase: "dns", Type: "dns.name_not_resolved"},
+			{URL: "https://b.example/", Phase: "connection", Type: "tcp.timed_out"},
+			{URL: "https://c.example/", Phase: "application", Type: "http.error", StatusCode: 503},
+			{URL: "https://d.example/", Phase: "application", Type: "http.error", StatusCode: 404},
+			{URL: "https://e.example/", Phase: "application", Type: "ok", StatusCode: 200},
+			// Over the rate cap.
+			{URL: "https://f.example/", Phase: "dns", Type: "dns.unreachable"},
+		},
+	})
+
+	want := []string{
+		"error [nel a.example dns.name_not_resolved] dns.name_not_resolved (dns phase) for a.example",
+		"error [nel b.example tcp.timed_out] tcp.timed_out (connection phase) for b.example",
+		"warning [nel c.example http.error] http.error (application phase, status 503) for c.example",
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("SentryPublisher sent diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSentryPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`dsn = "https://o0.ingest.sentry.io/42"`,
+		`dsn = "https://key@o0.ingest.sentry.io/"`,
+		`dsn = "https://key@o0.ingest.sentry.io/42"` + "\n" + `max_events_per_minute = -1`,
+		`dsn = "https://key@o0.ingest.sentry.io/42"` + "\n" + `[[processor.rule]]` + "\n" + `condition = "type =="`,
+		`dsn = "https://key@o0.ingest.sentry.io/42"` + "\n" + `[[processor.rule]]` + "\n" + `condition = "true"` + "\n" + `level = "critical"`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"SentryPublisher\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The OTLP span kind and status codes that ToSpanEvent uses.
+const (
+	otlpSpanKindClient  = 3
+	otlpStatusCodeUnset = 0
+	otlpStatusCodeError = 2
+)
+
+// spanEventAnnotationPrefix marks the sources in ToSpanEvent's attribute
+// mapping that are annotations rather than report fields.
+const spanEventAnnotationPrefix = "annotations."
+
+// spanEventFields are the report fields that ToSpanEvent's attribute mapping
+// can use, other than annotations.
+var spanEventFields = map[string]func(batch *collector.ReportBatch, report *collector.NelReport) interface{}{
+	"age":               func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return int64(r.Age) },
+	"report_type":       func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.ReportType },
+	"url":               func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.URL },
+	"user_agent":        func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.UserAgent },
+	"client_ip":         func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return b.ClientIP },
+	"referrer":          func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.Referrer },
+	"sampling_fraction": func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return float64(r.SamplingFraction) },
+	"server_ip":         func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.ServerIP },
+	"protocol":          func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.Protocol },
+	"method":            func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.Method },
+	"status_code":       func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return int64(r.StatusCode) },
+	"elapsed_time":      func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return int64(r.ElapsedTime) },
+	"phase":             func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.Phase },
+	"type":              func(b *collector.ReportBatch, r *collector.NelReport) interface{} { return r.Type },
+}
+
+// validSpanEventSource returns whether ToSpanEvent's attribute mapping can use
+// a source.
+func validSpanEventSource(source string) bool {
+	if strings.HasPrefix(source, spanEventAnnotationPrefix) {
+		return len(source) > len(spanEventAnnotationPrefix)
+	}
+	_, ok := spanEventFields[source]
+	return ok
+}
+
+// otlpSpan is a report that's been converted into a synthetic OTLP span with a
+// single event, and is waiting to be exported.
+type otlpSpan struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	statusCode int
+	eventName  string
+	attributes []otlpAttribute
+}
+
+// ToSpanEvent is a pipeline processor that exports reports to an OpenTelemetry
+// trace backend, using OTLP over HTTP, so that NEL failures can be correlated
+// with other frontend telemetry in trace-centric tools.  Protocol is either
+// "http/protobuf" or "http/json", as with OTLPLogPublisher (which exports
+// reports as log records instead).
+//
+// Each report becomes a synthetic trace containing a single client span,
+// named after the report type (such as "nel network-error"), which starts at
+// the report's event time (see NelReport.EventTime) and lasts for its
+// elapsed_time.  The span's status is an error for failures (and 5xx
+// responses), and unset otherwise.  The span has one event, named after the
+// report's NEL type (such as "tcp.timed_out"), or its report type if it isn't
+// a NEL report, at the event time.
+//
+// The event's attributes come from Attributes, which maps each attribute name
+// to the report field that it's taken from: `age`, `report_type`, `url`,
+// `user_agent`, `client_ip`, `referrer`, `sampling_fraction`, `server_ip`,
+// `protocol`, `method`, `status_code`, `elapsed_time`, `phase`, `type`, or
+// `annotations.<name>` for an annotation.  Empty and zero values are left
+// out.  If Attributes is nil, the event gets the same attributes as
+// OTLPLogPublisher's log records.
+//
+// Spans are buffered in memory until there are BatchSize of them, or until the
+// oldest buffered span is FlushInterval old; the buffer is then exported as a
+// single request.  Anything left in the buffer is exported when the pipeline
+// is closed.
+type ToSpanEvent struct {
+	// The URL of the OTLP traces endpoint, such as
+	// http://localhost:4318/v1/traces.
+	Endpoint string
+	Protocol string
+
+	// Extra headers to send with each request, such as API keys.
+	Headers map[string]string
+
+	ResourceAttributes map[string]string
+	Attributes         map[string]string
+
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// The client used to export spans.  If nil, we use http.DefaultClient.
+	Client *http.Client
+
+	// Clock is used to decide when the buffer is old enough to export.  If
+	// nil, we use the current time.
+	Clock collector.Clock
+
+	mu      sync.Mutex
+	pending []otlpSpan
+	started time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewToSpanEvent creates a new ToSpanEvent processor that exports spans to
+// endpoint, using the http/protobuf protocol.
+func NewToSpanEvent(endpoint string, batchSize int, flushInterval time.Duration) *ToSpanEvent {
+	return &ToSpanEvent{
+		Endpoint:           endpoint,
+		Protocol:           "http/protobuf",
+		ResourceAttributes: map[string]string{"service.name": "nel-collector"},
+		BatchSize:          batchSize,
+		FlushInterval:      flushInterval,
+	}
+}
+
+func (p *ToSpanEvent) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// attributes returns the attributes of a report's span event.
+func (p *ToSpanEvent) attributes(batch *collector.ReportBatch, report *collector.NelReport) []otlpAttribute {
+	if p.Attributes == nil {
+		return otlpReportAttributes(batch, report)
+	}
+	var names []string
+	for name := range p.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var attributes []otlpAttribute
+	for _, name := range names {
+		source := p.Attributes[name]
+		var value interface{}
+		if strings.HasPrefix(source, spanEventAnnotationPrefix) {
+			value = report.GetAnnotation(strings.TrimPrefix(source, spanEventAnnotationPrefix))
+			if value == nil {
+				continue
+			}
+			value = otlpAttributeValue(value)
+		} else if get, ok := spanEventFields[source]; ok {
+			value = get(batch, report)
+		}
+		if value == nil || value == "" || value == int64(0) || value == float64(0) {
+			continue
+		}
+		attributes = append(attributes, otlpAttribute{name, value})
+	}
+	return attributes
+}
+
+func (p *ToSpanEvent) newSpan(batch *collector.ReportBatch, report *collector.NelReport) otlpSpan {
+	span := otlpSpan{
+		name:       "nel " + report.ReportType,
+		start:      report.EventTime(batch.Time),
+		statusCode: otlpStatusCodeUnset,
+		eventName:  report.ReportType,
+		attributes: p.attributes(batch, report),
+	}
+	span.end = span.start.Add(time.Duration(report.ElapsedTime) * time.Millisecond)
+	if severity, _ := otlpSeverity(report); severity == otlpSeverityError {
+		span.statusCode = otlpStatusCodeError
+	}
+	if report.ReportType == "network-error" {
+		span.eventName = report.Type
+	}
+	if _, err := rand.Read(span.traceID[:]); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(span.spanID[:]); err != nil {
+		panic(err)
+	}
+	return span
+}
+
+// encodeOTLPTraceProtobuf encodes a set of spans as an
+// ExportTraceServiceRequest protobuf message, with a single resource and
+// instrumentation scope.
+func encodeOTLPTraceProtobuf(resource []otlpAttribute, spans []otlpSpan) []byte {
+	var scopeSpans []byte
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "nel-collector")
+	scopeSpans = protowire.AppendTag(scopeSpans, 1, protowire.BytesType)
+	scopeSpans = protowire.AppendBytes(scopeSpans, scope)
+	for _, span := range spans {
+		var event []byte
+		event = protowire.AppendTag(event, 1, protowire.Fixed64Type)
+		event = protowire.AppendFixed64(event, uint64(span.start.UnixNano()))
+		event = protowire.AppendTag(event, 2, protowire.BytesType)
+		event = protowire.AppendString(event, span.eventName)
+		event = appendOTLPAttributes(event, 3, span.attributes)
+
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, span.traceID[:])
+		encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, span.spanID[:])
+		encoded = protowire.AppendTag(encoded, 5, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, span.name)
+		encoded = protowire.AppendTag(encoded, 6, protowire.VarintType)
+		encoded = protowire.AppendVarint(encoded, otlpSpanKindClient)
+		encoded = protowire.AppendTag(encoded, 7, protowire.Fixed64Type)
+		encoded = protowire.AppendFixed64(encoded, uint64(span.start.UnixNano()))
+		encoded = protowire.AppendTag(encoded, 8, protowire.Fixed64Type)
+		encoded = protowire.AppendFixed64(encoded, uint64(span.end.UnixNano()))
+		encoded = protowire.AppendTag(encoded, 11, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, event)
+		if span.statusCode != otlpStatusCodeUnset {
+			var status []byte
+			status = protowire.AppendTag(status, 3, protowire.VarintType)
+			status = protowire.AppendVarint(status, uint64(span.statusCode))
+			encoded = protowire.AppendTag(encoded, 15, protowire.BytesType)
+			encoded = protowire.AppendBytes(encoded, status)
+		}
+		scopeSpans = protowire.AppendTag(scopeSpans, 2, protowire.BytesType)
+		scopeSpans = protowire.AppendBytes(scopeSpans, encoded)
+	}
+
+	var resourceSpans []byte
+	resourceSpans = protowire.AppendTag(resourceSpans, 1, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, appendOTLPAttributes(nil, 1, resource))
+	resourceSpans = protowire.AppendTag(resourceSpans, 2, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, scopeSpans)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, resourceSpans)
+	return request
+}
+
+// encodeOTLPTraceJSON encodes a set of spans using the JSON encoding of an
+// ExportTraceServiceRequest.  (Trace and span IDs are hex-encoded, rather than
+// base64-encoded as usual for bytes in protobuf's JSON mapping.)
+func encodeOTLPTraceJSON(resource []otlpAttribute, spans []otlpSpan) ([]byte, error) {
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, span := range spans {
+		encoded[i] = map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.traceID[:]),
+			"spanId":            hex.EncodeToString(span.spanID[:]),
+			"name":              span.name,
+			"kind":              otlpSpanKindClient,
+			"startTimeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.end.UnixNano(), 10),
+			"events": []interface{}{
+				map[string]interface{}{
+					"timeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+					"name":         span.eventName,
+					"attributes":   otlpJSONAttributes(span.attributes),
+				},
+			},
+			"status": map[string]interface{}{"code": span.statusCode},
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpJSONAttributes(resource)},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "nel-collector"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	})
+}
+
+// take removes the buffered spans, so that they can be exported.  p.mu must
+// be held.
+func (p *ToSpanEvent) take() []otlpSpan {
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// export sends a set of spans to the endpoint.
+func (p *ToSpanEvent) export(ctx context.Context, spans []otlpSpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	resource := otlpResource(p.ResourceAttributes)
+	var body []byte
+	contentType := "application/x-protobuf"
+	if p.Protocol == "http/json" {
+		var err error
+		body, err = encodeOTLPTraceJSON(resource, spans)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = encodeOTLPTraceProtobuf(resource, spans)
+	}
+	return postOTLP(ctx, p.Client, p.Endpoint, p.Headers, contentType, body)
+}
+
+// flushPeriodically exports the buffer every FlushInterval, so that reports
+// don't sit in the buffer for too long when they're arriving slowly.
+func (p *ToSpanEvent) flushPeriodically() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			pending := p.take()
+			p.mu.Unlock()
+			if err := p.export(context.Background(), pending); err != nil {
+				log.Printf("ToSpanEvent: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// ProcessReports buffers a span for each report in the batch, exporting the
+// buffer once it's big enough or old enough.
+func (p *ToSpanEvent) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("ToSpanEvent: %v", err)
+	}
+}
+
+// TryProcessReports buffers a span for each report in the batch, exporting
+// the buffer once it's big enough or old enough, and returns an error if that
+// export fails.  Note that a failed export can include reports from earlier
+// batches, which are lost.
+func (p *ToSpanEvent) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	if len(batch.Reports) == 0 {
+		return nil
+	}
+	spans := make([]otlpSpan, len(batch.Reports))
+	for i := range batch.Reports {
+		spans[i] = p.newSpan(batch, &batch.Reports[i])
+	}
+	now := p.now()
+
+	var ready []otlpSpan
+	p.mu.Lock()
+	if p.done == nil && p.FlushInterval > 0 {
+		p.done = make(chan struct{})
+		p.wg.Add(1)
+		go p.flushPeriodically()
+	}
+	if len(p.pending) == 0 {
+		p.started = now
+	}
+	p.pending = append(p.pending, spans...)
+	if len(p.pending) >= p.BatchSize || (p.FlushInterval > 0 && now.Sub(p.started) >= p.FlushInterval) {
+		ready = p.take()
+	}
+	p.mu.Unlock()
+
+	return p.export(ctx, ready)
+}
+
+// Close exports anything left in the buffer.
+func (p *ToSpanEvent) Close() error {
+	p.mu.Lock()
+	if p.done != nil {
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	pending := p.take()
+	p.mu.Unlock()
+	return p.export(context.Background(), pending)
+}
+
+func init() {
+	collector.RegisterClockReportLoaderFunc(
+		"ToSpanEvent",
+		func(ctx context.Context, clock collector.Clock, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Endpoint           string            `toml:"endpoint"`
+				Protocol           string            `toml:"protocol"`
+				Headers            map[string]string `toml:"headers"`
+				ResourceAttributes map[string]string `toml:"resource_attributes"`
+				Attributes         map[string]string `toml:"attributes"`
+				BatchSize          int               `toml:"batch_size"`
+				FlushInterval      string            `toml:"flush_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+
+			if config.Endpoint == "" {
+				return nil, fmt.Errorf("ToSpanEvent missing `endpoint`")
+			}
+			u, err := url.Parse(config.Endpoint)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("ToSpanEvent invalid `endpoint`: %s", config.Endpoint)
+			}
+			if u.Path == "" || u.Path == "/" {
+				u.Path = "/v1/traces"
+			}
+			switch config.Protocol {
+			case "":
+				config.Protocol = "http/protobuf"
+			case "http/protobuf", "http/json":
+			case "grpc":
+				return nil, fmt.Errorf("ToSpanEvent doesn't support the grpc `protocol`; use http/protobuf or http/json")
+			default:
+				return nil, fmt.Errorf("ToSpanEvent invalid `protocol`: %s", config.Protocol)
+			}
+			for name, source := range config.Attributes {
+				if !validSpanEventSource(source) {
+					return nil, fmt.Errorf("ToSpanEvent invalid `attributes`: unknown field %s for %s", source, name)
+				}
+			}
+			if config.BatchSize < 0 {
+				return nil, fmt.Errorf("ToSpanEvent `batch_size` must not be negative")
+			}
+			if config.BatchSize == 0 {
+				config.BatchSize = 512
+			}
+			flushInterval := 5 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("ToSpanEvent invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("ToSpanEvent `flush_interval` must be positive")
+				}
+			}
+
+			p := NewToSpanEvent(u.String(), config.BatchSize, flushInterval)
+			p.Clock = clock
+			p.Protocol = config.Protocol
+			p.Headers = config.Headers
+			p.Attributes = config.Attributes
+			for key, value := range config.ResourceAttributes {
+				p.ResourceAttributes[key] = value
+			}
+			return p, nil
+		})
+}
@@ -0,0 +1,218 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// decodeExportTraceRequest decodes an OTLP ExportTraceServiceRequest into one
+// string per span, preceded by one string for each resource's attributes.
+// Trace and span IDs are replaced by their lengths, since they're random.
+func decodeExportTraceRequest(t *testing.T, body []byte) []string {
+	var result []string
+	_, resourceSpans := decodeFields(t, body)
+	for _, encoded := range resourceSpans {
+		numbers, values := decodeFields(t, encoded.([]byte))
+		for i, number := range numbers {
+			switch number {
+			case 1:
+				_, attributes := decodeFields(t, values[i].([]byte))
+				result = append(result, "resource: "+decodeAttributes(t, attributes))
+			case 2:
+				numbers, values := decodeFields(t, values[i].([]byte))
+				for i, number := range numbers {
+					if number != 2 {
+						continue
+					}
+					var traceID, spanID []byte
+					var name, event string
+					var kind, status uint64
+					var start, end time.Time
+					spanNumbers, spanValues := decodeFields(t, values[i].([]byte))
+					for j, field := range spanNumbers {
+						switch field {
+						case 1:
+							traceID = spanValues[j].([]byte)
+						case 2:
+							spanID = spanValues[j].([]byte)
+						case 5:
+							name = string(spanValues[j].([]byte))
+						case 6:
+							kind = spanValues[j].(uint64)
+						case 7:
+							start = time.Unix(0, int64(spanValues[j].(uint64))).UTC()
+						case 8:
+							end = time.Unix(0, int64(spanValues[j].(uint64))).UTC()
+						case 11:
+							var when time.Time
+							var eventName string
+							var attributes []interface{}
+							eventNumbers, eventValues := decodeFields(t, spanValues[j].([]byte))
+							for k, field := range eventNumbers {
+								switch field {
+								case 1:
+									when = time.Unix(0, int64(eventValues[k].(uint64))).UTC()
+								case 2:
+									eventName = string(eventValues[k].([]byte))
+								case 3:
+									attributes = append(attributes, eventValues[k])
+								}
+							}
+							event = fmt.Sprintf("%s %s: %s", eventName, when.Format(time.RFC3339Nano), decodeAttributes(t, attributes))
+						case 15:
+							_, statusValues := decodeFields(t, spanValues[j].([]byte))
+							status = statusValues[0].(uint64)
+						}
+					}
+					result = append(result, fmt.Sprintf("%d/%d %q kind=%d status=%d %s-%s [%s]",
+						len(traceID), len(spanID), name, kind, status,
+						start.Format(time.RFC3339Nano), end.Format(time.RFC3339Nano), event))
+				}
+			}
+		}
+	}
+	return result
+}
+
+func TestToSpanEvent(t *testing.T) {
+	var mu sync.Mutex
+	var exports [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "wrong request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		exports = append(exports, decodeExportTraceRequest(t, body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	p := publish.NewToSpanEvent(server.URL+"/v1/traces", 10, 0)
+	p.Attributes = map[string]string{
+		"url.full":                  "url",
+		"http.response.status_code": "status_code",
+		"service":                   "annotations.Service",
+		"nel.elapsed_time":          "elapsed_time",
+	}
+	ctx := context.Background()
+	batches := otlpBatches()
+	batches[1].Reports[0].ElapsedTime = 250
+	for _, batch := range batches {
+		if err := p.TryProcessReports(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(exports); got != 0 {
+		t.Errorf("ToSpanEvent exported %d times before Close, wanted 0", got)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{
+			`resource: service.name="nel-collector"`,
+			`16/8 "nel network-error" kind=3 status=2 2024-01-02T15:29:59.5Z-2024-01-02T15:29:59.5Z [tcp.timed_out 2024-01-02T15:29:59.5Z: service="web" url.full="https://a/"]`,
+			`16/8 "nel network-error" kind=3 status=0 2024-01-02T15:30:00Z-2024-01-02T15:30:00Z [http.error 2024-01-02T15:30:00Z: http.response.status_code=404 url.full="https://b/"]`,
+			`16/8 "nel network-error" kind=3 status=0 2024-01-02T15:30:00Z-2024-01-02T15:30:00.25Z [ok 2024-01-02T15:30:00Z: http.response.status_code=200 nel.elapsed_time=250 url.full="https://c/"]`,
+		},
+	}
+	if diff := cmp.Diff(want, exports); diff != "" {
+		t.Errorf("ToSpanEvent exported diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestToSpanEventJSON(t *testing.T) {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					SpanID  string `json:"spanId"`
+					Name    string `json:"name"`
+					Events  []struct {
+						TimeUnixNano string `json:"timeUnixNano"`
+						Name         string `json:"name"`
+					} `json:"events"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "wrong content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	p := publish.NewToSpanEvent(server.URL, 1, 0)
+	p.Protocol = "http/json"
+	batch := &collector.ReportBatch{
+		Time:    time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC),
+		Reports: []collector.NelReport{{Age: 1000, ReportType: "csp-violation", URL: "https://a/"}},
+	}
+	if err := p.TryProcessReports(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if len(span.TraceID) != 32 || len(span.SpanID) != 16 {
+		t.Errorf("ToSpanEvent sent traceId %q and spanId %q, wanted 32 and 16 hex digits", span.TraceID, span.SpanID)
+	}
+	if got, want := span.Name, "nel csp-violation"; got != want {
+		t.Errorf("ToSpanEvent sent name %q, wanted %q", got, want)
+	}
+	if got, want := span.Events[0].Name, "csp-violation"; got != want {
+		t.Errorf("ToSpanEvent sent event name %q, wanted %q", got, want)
+	}
+	if got, want := span.Events[0].TimeUnixNano, "1704209399000000000"; got != want {
+		t.Errorf("ToSpanEvent sent event timeUnixNano %s, wanted %s", got, want)
+	}
+}
+
+func TestToSpanEventBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`endpoint = "localhost:4318"`,
+		"endpoint = \"http://localhost:4318\"\nprotocol = \"grpc\"",
+		"endpoint = \"http://localhost:4318\"\nattributes = {\"url.full\" = \"uri\"}",
+		"endpoint = \"http://localhost:4318\"\nattributes = {\"service\" = \"annotations.\"}",
+		"endpoint = \"http://localhost:4318\"\nbatch_size = -1",
+		"endpoint = \"http://localhost:4318\"\nflush_interval = \"0s\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"ToSpanEvent\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
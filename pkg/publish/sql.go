@@ -0,0 +1,361 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+)
+
+// sqlDialect describes the differences between the SQL databases that
+// SQLPublisher supports.
+type sqlDialect struct {
+	jsonType    string
+	placeholder func(i int) string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite": {
+		jsonType:    "TEXT",
+		placeholder: func(i int) string { return "?" },
+	},
+	"postgres": {
+		jsonType:    "JSONB",
+		placeholder: func(i int) string { return fmt.Sprintf("$%d", i) },
+	},
+}
+
+// sqlDriverDialects maps the names of some well-known database/sql drivers to
+// the dialect that they speak.
+var sqlDriverDialects = map[string]string{
+	"sqlite":   "sqlite",
+	"sqlite3":  "sqlite",
+	"postgres": "postgres",
+	"pgx":      "postgres",
+}
+
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+var sqlColumns = []struct{ name, kind string }{
+	{"received_at", "TIMESTAMP"},
+	{"client_ip", "TEXT"},
+	{"age", "INTEGER"},
+	{"report_type", "TEXT"},
+	{"url", "TEXT"},
+	{"user_agent", "TEXT"},
+	{"referrer", "TEXT"},
+	{"sampling_fraction", "REAL"},
+	{"server_ip", "TEXT"},
+	{"protocol", "TEXT"},
+	{"method", "TEXT"},
+	{"status_code", "INTEGER"},
+	{"elapsed_time", "INTEGER"},
+	{"phase", "TEXT"},
+	{"type", "TEXT"},
+	{"body", "JSON"},
+	{"annotations", "JSON"},
+}
+
+// SQLPublisher is a pipeline processor that inserts each report into a table
+// in a SQL database, one row per report.  The table has a column for each of
+// the common NEL fields, along with JSON columns for the raw body of non-NEL
+// reports and for each report's annotations.
+//
+// Rows are buffered until there are batchSize of them (see NewSQLPublisher),
+// or until FlushInterval has passed, and then inserted together in a single
+// transaction.  Any remaining rows are inserted when the pipeline is closed.
+//
+// SQLPublisher uses database/sql, so you'll need to import a driver for your
+// database into your binary.  SQLite and Postgres are supported.  The
+// nel-collector command doesn't link in any drivers itself; to use
+// SQLPublisher from a configuration file, build your own copy of it that
+// imports one (such as github.com/lib/pq or modernc.org/sqlite) for its side
+// effects.
+type SQLPublisher struct {
+	// If set, we insert the buffered rows this often, so that reports don't
+	// sit in the buffer for too long when they're arriving slowly.
+	FlushInterval time.Duration
+
+	db        *sql.DB
+	closeDB   bool
+	insert    string
+	batchSize int
+
+	mu   sync.Mutex
+	rows [][]interface{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSQLPublisher creates a new SQLPublisher that inserts reports into a table
+// in db, creating the table if it doesn't already exist.  dialect must be
+// "sqlite" or "postgres".  The caller still owns db, and must close it after
+// closing the publisher.
+func NewSQLPublisher(ctx context.Context, db *sql.DB, dialect, table string, batchSize int) (*SQLPublisher, error) {
+	d, ok := sqlDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("Unknown SQL dialect %s", dialect)
+	}
+	if !sqlTableName.MatchString(table) {
+		return nil, fmt.Errorf("Invalid SQL table name %s", table)
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	var columns, names, placeholders []string
+	for i, column := range sqlColumns {
+		kind := column.kind
+		if kind == "JSON" {
+			kind = d.jsonType
+		}
+		columns = append(columns, column.name+" "+kind)
+		names = append(names, column.name)
+		placeholders = append(placeholders, d.placeholder(i+1))
+	}
+
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(columns, ", "))
+	if _, err := db.ExecContext(ctx, create); err != nil {
+		return nil, fmt.Errorf("Couldn't create table %s: %v", table, err)
+	}
+
+	return &SQLPublisher{
+		db:        db,
+		insert:    fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(names, ", "), strings.Join(placeholders, ", ")),
+		batchSize: batchSize,
+	}, nil
+}
+
+// nullableJSON returns a JSON-encoded value suitable for inserting into a JSON
+// column, or nil (which becomes NULL) if there's nothing to insert.
+func nullableJSON(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return string(encoded)
+}
+
+func sqlRow(batch *collector.ReportBatch, report *collector.NelReport) []interface{} {
+	var body interface{}
+	if len(report.RawBody) > 0 {
+		body = string(report.RawBody)
+	}
+	var annotations interface{}
+	if len(report.Annotations.Annotations) > 0 {
+		annotations = nullableJSON(report.Annotations.Annotations)
+	}
+	return []interface{}{
+		batch.Time.UTC(),
+		batch.ClientIP,
+		report.Age,
+		report.ReportType,
+		report.URL,
+		report.UserAgent,
+		report.Referrer,
+		report.SamplingFraction,
+		report.ServerIP,
+		report.Protocol,
+		report.Method,
+		report.StatusCode,
+		report.ElapsedTime,
+		report.Phase,
+		report.Type,
+		body,
+		annotations,
+	}
+}
+
+// ProcessReports buffers a row for each report in the batch, inserting them
+// into the database once there are enough of them.
+func (s *SQLPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := s.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("SQLPublisher: %v", err)
+	}
+}
+
+// TryProcessReports buffers a row for each report in the batch, inserting them
+// into the database once there are enough of them, and returns an error if
+// that insert fails.  Note that if batchSize is larger than 1, a failed insert
+// can also include rows from earlier batches, which are lost.
+func (s *SQLPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	var ready [][]interface{}
+	s.mu.Lock()
+	if s.done == nil && s.FlushInterval > 0 {
+		s.done = make(chan struct{})
+		s.wg.Add(1)
+		go s.flushPeriodically()
+	}
+	for i := range batch.Reports {
+		s.rows = append(s.rows, sqlRow(batch, &batch.Reports[i]))
+	}
+	if len(s.rows) >= s.batchSize {
+		ready = s.take()
+	}
+	s.mu.Unlock()
+
+	return s.flush(ctx, ready)
+}
+
+// take removes the buffered rows, so that they can be inserted.  s.mu must be
+// held.
+func (s *SQLPublisher) take() [][]interface{} {
+	rows := s.rows
+	s.rows = nil
+	return rows
+}
+
+// flushPeriodically inserts the buffered rows every FlushInterval.
+func (s *SQLPublisher) flushPeriodically() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			rows := s.take()
+			s.mu.Unlock()
+			if err := s.flush(context.Background(), rows); err != nil {
+				log.Printf("SQLPublisher: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush inserts rows in a single transaction.
+func (s *SQLPublisher) flush(ctx context.Context, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't insert %d reports: %v", len(rows), err)
+	}
+	stmt, err := tx.PrepareContext(ctx, s.insert)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Couldn't insert %d reports: %v", len(rows), err)
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Couldn't insert %d reports: %v", len(rows), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Couldn't insert %d reports: %v", len(rows), err)
+	}
+	return nil
+}
+
+// Close inserts any buffered rows.  If the publisher was loaded from a
+// configuration file, Close also closes the database connection that it
+// opened.
+func (s *SQLPublisher) Close() error {
+	s.mu.Lock()
+	if s.done != nil {
+		close(s.done)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	rows := s.take()
+	s.mu.Unlock()
+	err := s.flush(context.Background(), rows)
+	if s.closeDB {
+		if closeErr := s.db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"SQLPublisher",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				Driver        string `toml:"driver"`
+				Dialect       string `toml:"dialect"`
+				DSN           string `toml:"dsn"`
+				Table         string `toml:"table"`
+				BatchSize     int    `toml:"batch_size"`
+				FlushInterval string `toml:"flush_interval"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			if config.Driver == "" {
+				return nil, fmt.Errorf("SQLPublisher missing `driver`")
+			}
+			if config.DSN == "" {
+				return nil, fmt.Errorf("SQLPublisher missing `dsn`")
+			}
+			if config.Table == "" {
+				config.Table = "nel_reports"
+			}
+			if config.Dialect == "" {
+				config.Dialect = sqlDriverDialects[config.Driver]
+				if config.Dialect == "" {
+					return nil, fmt.Errorf("SQLPublisher can't determine the dialect of driver %s; set `dialect`", config.Driver)
+				}
+			}
+
+			flushInterval := 10 * time.Second
+			if config.FlushInterval != "" {
+				flushInterval, err = time.ParseDuration(config.FlushInterval)
+				if err != nil {
+					return nil, fmt.Errorf("SQLPublisher invalid `flush_interval`: %v", err)
+				}
+				if flushInterval <= 0 {
+					return nil, fmt.Errorf("SQLPublisher `flush_interval` must be positive")
+				}
+			}
+
+			db, err := sql.Open(config.Driver, config.DSN)
+			if err != nil {
+				return nil, err
+			}
+			publisher, err := NewSQLPublisher(ctx, db, config.Dialect, config.Table, config.BatchSize)
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+			publisher.FlushInterval = flushInterval
+			publisher.closeDB = true
+			return publisher, nil
+		})
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// recordingDriver is a fake database/sql driver that records the statements
+// that are executed against it.
+type recordingDriver struct {
+	mu         sync.Mutex
+	statements []string
+	args       [][]driver.Value
+	commits    int
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return recordingStmt{c.d, query}, nil
+}
+func (c recordingConn) Close() error              { return nil }
+func (c recordingConn) Begin() (driver.Tx, error) { return recordingTx{c.d}, nil }
+
+type recordingTx struct{ d *recordingDriver }
+
+func (t recordingTx) Commit() error {
+	t.d.mu.Lock()
+	defer t.d.mu.Unlock()
+	t.d.commits++
+	return nil
+}
+func (t recordingTx) Rollback() error { return nil }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return -1 }
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.statements = append(s.d.statements, s.query)
+	s.d.args = append(s.d.args, args)
+	return driver.RowsAffected(1), nil
+}
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+var recorder = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", recorder)
+}
+
+func TestSQLPublisher(t *testing.T) {
+	db, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := publish.NewSQLPublisher(context.Background(), db, "postgres", "nel_reports", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := recorder.statements[0]; !strings.HasPrefix(got, "CREATE TABLE IF NOT EXISTS nel_reports (received_at TIMESTAMP,") || !strings.Contains(got, "annotations JSONB") {
+		t.Errorf("NewSQLPublisher created table with %q", got)
+	}
+
+	batch := &collector.ReportBatch{
+		Time:     time.Unix(0, 0),
+		ClientIP: "192.0.2.1",
+		Reports: []collector.NelReport{
+			{ReportType: "network-error", URL: "https://example.com/", StatusCode: 503, Type: "http.error"},
+		},
+	}
+	batch.Reports[0].SetAnnotation("ServerZone", "us-east1-a")
+	publisher.ProcessReports(context.Background(), batch)
+	if got := len(recorder.statements); got != 1 {
+		t.Errorf("SQLPublisher inserted a row before filling its batch")
+	}
+
+	batch.Reports[0] = collector.NelReport{ReportType: "csp-violation", RawBody: []byte(`{"documentURL":"https://example.com/"}`)}
+	publisher.ProcessReports(context.Background(), batch)
+	if got := len(recorder.statements); got != 3 {
+		t.Fatalf("SQLPublisher executed %d statements, wanted 3", got)
+	}
+	if got := recorder.statements[1]; !strings.HasPrefix(got, "INSERT INTO nel_reports (received_at, client_ip,") || !strings.Contains(got, "$17)") {
+		t.Errorf("SQLPublisher inserted with %q", got)
+	}
+	if got, want := recorder.args[1][16], `{"ServerZone":"us-east1-a"}`; got != want {
+		t.Errorf("SQLPublisher annotations column = %v, wanted %v", got, want)
+	}
+	if got, want := recorder.args[2][15], `{"documentURL":"https://example.com/"}`; got != want {
+		t.Errorf("SQLPublisher body column = %v, wanted %v", got, want)
+	}
+	if got := recorder.args[2][16]; got != nil {
+		t.Errorf("SQLPublisher annotations column = %v, wanted NULL", got)
+	}
+
+	// Close should flush any leftover rows.
+	publisher.ProcessReports(context.Background(), batch)
+	if err := publisher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(recorder.statements); got != 4 {
+		t.Errorf("SQLPublisher executed %d statements after Close, wanted 4", got)
+	}
+	if got := recorder.commits; got != 2 {
+		t.Errorf("SQLPublisher committed %d transactions, wanted 2", got)
+	}
+	// The caller owns db, so Close shouldn't have closed it.
+	if err := db.Ping(); err != nil {
+		t.Errorf("SQLPublisher closed its caller's database: %v", err)
+	}
+	db.Close()
+}
+
+func TestSQLPublisherFlushInterval(t *testing.T) {
+	db, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := publish.NewSQLPublisher(context.Background(), db, "sqlite", "nel_reports", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	publisher.FlushInterval = 10 * time.Millisecond
+	statements := func() int {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		return len(recorder.statements)
+	}
+
+	before := statements()
+	publisher.ProcessReports(context.Background(), &collector.ReportBatch{Reports: []collector.NelReport{{ReportType: "network-error"}}})
+	for deadline := time.Now().Add(5 * time.Second); statements() == before; {
+		if time.Now().After(deadline) {
+			t.Fatal("SQLPublisher didn't insert the buffered row after its flush interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSQLPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		`processor = [{type = "SQLPublisher", dsn = "x"}]`,
+		`processor = [{type = "SQLPublisher", driver = "recording"}]`,
+		`processor = [{type = "SQLPublisher", driver = "recording", dsn = "x"}]`,
+		`processor = [{type = "SQLPublisher", driver = "recording", dialect = "oracle", dsn = "x"}]`,
+		`processor = [{type = "SQLPublisher", driver = "recording", dialect = "sqlite", dsn = "x", table = "reports; DROP TABLE users"}]`,
+		`processor = [{type = "SQLPublisher", driver = "recording", dialect = "sqlite", dsn = "x", flush_interval = "soon"}]`,
+		`processor = [{type = "SQLPublisher", driver = "recording", dialect = "sqlite", dsn = "x", flush_interval = "-1s"}]`,
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}
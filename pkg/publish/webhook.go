@@ -0,0 +1,406 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+)
+
+// webhookFuncs are the extra functions that webhook templates can use.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	},
+}
+
+// ParseWebhookTemplate parses the template for the body of a WebhookPublisher's
+// requests.
+func ParseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(webhookFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// WebhookReport is a single report, as seen by a WebhookPublisher's template.
+type WebhookReport struct {
+	*collector.NelReport
+
+	// The report's annotations, which templates can look up with index, like
+	// `{{index .Annotations "Service"}}`.
+	Annotations map[string]interface{}
+
+	// When the event that the report describes happened (see
+	// NelReport.EventTime).
+	EventTime time.Time
+
+	// The report in the same JSON form that ObjectStorePublisher writes, which
+	// templates can embed with `{{json .Record}}`.
+	Record interface{}
+}
+
+// WebhookPayload is the data that a WebhookPublisher's template is executed
+// with, for each request.
+type WebhookPayload struct {
+	// The upload that the reports came from.
+	Batch *collector.ReportBatch
+
+	// The reports to send in this request.  Report is the first of them, for
+	// templates that send one report at a time.
+	Reports []WebhookReport
+	Report  WebhookReport
+}
+
+func newWebhookPayload(batch *collector.ReportBatch, reports []*collector.NelReport, names FieldNames) WebhookPayload {
+	payload := WebhookPayload{Batch: batch, Reports: make([]WebhookReport, len(reports))}
+	for i, report := range reports {
+		payload.Reports[i] = WebhookReport{
+			NelReport:   report,
+			Annotations: report.CloneAnnotations().Annotations,
+			EventTime:   report.EventTime(batch.Time).UTC(),
+			Record:      names.record(batch, report),
+		}
+	}
+	payload.Report = payload.Reports[0]
+	return payload
+}
+
+// The formats that a WebhookPublisher without a template can send reports in;
+// see WebhookPublisher.Format.
+const (
+	WebhookRecordsFormat = "records"
+	WebhookReportsFormat = "reports"
+)
+
+// WebhookPublisher is a pipeline processor that sends reports to an arbitrary
+// HTTP endpoint, for integrating with systems that don't have a publisher of
+// their own.  Each request's body is produced by Template, which is a Go
+// text/template executed with a WebhookPayload; it can use a `json` function
+// to encode any value as JSON.  Without a template, the body depends on
+// Format.  By default (WebhookRecordsFormat), it's a JSON array of the
+// reports, in the same form that ObjectStorePublisher writes, sent as
+// application/json.  With WebhookReportsFormat, it's an upload in the form
+// that the Reporting API uses, sent as application/reports+json, for
+// forwarding reports to another collector.  Each report's age is increased by
+// how long ago (according to Clock, or time.Now if it's nil) we received its
+// batch, and the request's X-Forwarded-For and User-Agent headers are the
+// batch's ClientIP and ClientUserAgent, so that a collector that trusts us as
+// a proxy (see collector.PipelineConfig.TrustedProxies) sees the same reports
+// that we did.
+//
+// Only reports that match Where (if it's set) are sent.  Each request contains
+// up to BatchSize reports, all from the same upload; with a BatchSize of 1,
+// there's one request per report.  Requests that fail with a network error, a
+// 429, or a 5xx status code are retried up to MaxRetries times, waiting
+// RetryDelay before the first retry and twice as long before each one after
+// that.  Requests that still fail are logged and dropped.
+//
+// If Signer is set, each request's body is signed with it, so that a collector
+// receiving the reports (see collector.VerifySignature) can check that they
+// came from us.
+type WebhookPublisher struct {
+	URL      string
+	Method   string
+	Headers  map[string]string
+	Template *template.Template
+	Where    *core.Where
+
+	BatchSize  int
+	MaxRetries int
+	RetryDelay time.Duration
+	Signer     *collector.PayloadSigner
+	Format     string
+	Clock      collector.Clock
+
+	// Renames the fields of each report's JSON record; see FieldNames.
+	FieldNames FieldNames
+
+	// The client used to send requests.  If nil, we use http.DefaultClient.
+	Client *http.Client
+}
+
+// NewWebhookPublisher creates a new WebhookPublisher that POSTs each report to
+// url, retrying failed requests up to 3 times.
+func NewWebhookPublisher(url string, template *template.Template) *WebhookPublisher {
+	return &WebhookPublisher{
+		URL:        url,
+		Method:     "POST",
+		Template:   template,
+		BatchSize:  1,
+		MaxRetries: 3,
+		RetryDelay: time.Second,
+	}
+}
+
+// body renders the body of a request containing some of the reports in a
+// batch.
+func (p *WebhookPublisher) body(batch *collector.ReportBatch, reports []*collector.NelReport) ([]byte, error) {
+	if p.forwarding() {
+		var delay time.Duration
+		if !batch.Time.IsZero() {
+			delay = p.now().Sub(batch.Time)
+		}
+		forwarded := make([]collector.NelReport, len(reports))
+		for i, report := range reports {
+			forwarded[i] = *report
+			forwarded[i].Age += int(delay / time.Millisecond)
+		}
+		return json.Marshal(forwarded)
+	}
+	if p.Template == nil {
+		records := make([]interface{}, len(reports))
+		for i, report := range reports {
+			records[i] = p.FieldNames.record(batch, report)
+		}
+		return json.Marshal(records)
+	}
+	var body bytes.Buffer
+	if err := p.Template.Execute(&body, newWebhookPayload(batch, reports, p.FieldNames)); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// forwarding returns whether we send reports in the Reporting API's form.
+func (p *WebhookPublisher) forwarding() bool {
+	return p.Template == nil && p.Format == WebhookReportsFormat
+}
+
+func (p *WebhookPublisher) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// send makes a single request, and returns whether it's worth retrying if it
+// fails.
+func (p *WebhookPublisher) send(ctx context.Context, batch *collector.ReportBatch, body []byte) (bool, error) {
+	r, err := http.NewRequest(p.Method, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	r = r.WithContext(ctx)
+	if p.forwarding() {
+		r.Header.Set("Content-Type", "application/reports+json")
+		if batch.ClientIP != "" {
+			r.Header.Set("X-Forwarded-For", batch.ClientIP)
+		}
+		if batch.ClientUserAgent != "" {
+			r.Header.Set("User-Agent", batch.ClientUserAgent)
+		}
+	} else {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range p.Headers {
+		r.Header.Set(name, value)
+	}
+	if p.Signer != nil {
+		r.Header.Set(p.Signer.Header, p.Signer.Sign(body))
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(response.Body)
+		retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode/100 == 5
+		return retry, fmt.Errorf("Couldn't send reports to %s: %s: %s", p.URL, response.Status, bytes.TrimSpace(message))
+	}
+	return false, nil
+}
+
+// sendWithRetries makes a request, retrying it if it fails.
+func (p *WebhookPublisher) sendWithRetries(ctx context.Context, batch *collector.ReportBatch, body []byte) error {
+	delay := p.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := p.send(ctx, batch, body)
+		if err == nil || !retry || attempt >= p.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// ProcessReports sends the matching reports in the batch to the webhook.
+func (p *WebhookPublisher) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	if err := p.TryProcessReports(ctx, batch); err != nil {
+		log.Printf("WebhookPublisher: %v", err)
+	}
+}
+
+// TryProcessReports sends the matching reports in the batch to the webhook,
+// and returns the first error from any of its requests.
+func (p *WebhookPublisher) TryProcessReports(ctx context.Context, batch *collector.ReportBatch) error {
+	var reports []*collector.NelReport
+	for i := range batch.Reports {
+		report := &batch.Reports[i]
+		if p.Where == nil || p.Where.Matches(batch, report) {
+			reports = append(reports, report)
+		}
+	}
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	var result error
+	for start := 0; start < len(reports); start += batchSize {
+		end := start + batchSize
+		if end > len(reports) {
+			end = len(reports)
+		}
+		body, err := p.body(batch, reports[start:end])
+		if err == nil {
+			err = p.sendWithRetries(ctx, batch, body)
+		}
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func init() {
+	collector.RegisterContextReportLoaderFunc(
+		"WebhookPublisher",
+		func(ctx context.Context, configPrimitive toml.Primitive) (collector.ReportProcessor, error) {
+			var config struct {
+				URL        string            `toml:"url"`
+				Method     string            `toml:"method"`
+				Headers    map[string]string `toml:"headers"`
+				Template   string            `toml:"template"`
+				Condition  string            `toml:"condition"`
+				BatchSize  *int              `toml:"batch_size"`
+				MaxRetries *int              `toml:"max_retries"`
+				RetryDelay string            `toml:"retry_delay"`
+				Format     string            `toml:"format"`
+
+				SigningSecret      string            `toml:"signing_secret"`
+				SignatureHeader    string            `toml:"signature_header"`
+				SignatureAlgorithm string            `toml:"signature_algorithm"`
+				FieldNames         map[string]string `toml:"field_names"`
+			}
+
+			err := collector.DecodeConfig(ctx, configPrimitive, &config)
+			if err != nil {
+				return nil, err
+			}
+			fieldNames, err := ParseFieldNames(config.FieldNames)
+			if err != nil {
+				return nil, fmt.Errorf("WebhookPublisher invalid `field_names`: %v", err)
+			}
+
+			if config.URL == "" {
+				return nil, fmt.Errorf("WebhookPublisher missing `url`")
+			}
+			if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("WebhookPublisher invalid `url`: %s", config.URL)
+			}
+			var tmpl *template.Template
+			if config.Template != "" {
+				tmpl, err = ParseWebhookTemplate(config.Template)
+				if err != nil {
+					return nil, fmt.Errorf("WebhookPublisher invalid `template`: %v", err)
+				}
+			}
+
+			p := NewWebhookPublisher(config.URL, tmpl)
+			switch config.Method {
+			case "":
+			case "POST", "PUT", "PATCH":
+				p.Method = config.Method
+			default:
+				return nil, fmt.Errorf("WebhookPublisher invalid `method`: %s", config.Method)
+			}
+			p.Headers = config.Headers
+			switch config.Format {
+			case "", WebhookRecordsFormat:
+			case WebhookReportsFormat:
+				if tmpl != nil {
+					return nil, fmt.Errorf("WebhookPublisher can't use both `template` and `format`")
+				}
+				p.Format = config.Format
+			default:
+				return nil, fmt.Errorf("WebhookPublisher invalid `format`: %s", config.Format)
+			}
+			p.Clock = collector.ClockFromContext(ctx)
+			if config.Condition != "" {
+				p.Where, err = core.NewWhere(config.Condition, nil)
+				if err != nil {
+					return nil, fmt.Errorf("WebhookPublisher invalid `condition`: %v", err)
+				}
+			}
+			if config.BatchSize != nil {
+				if *config.BatchSize < 1 {
+					return nil, fmt.Errorf("WebhookPublisher `batch_size` must be positive")
+				}
+				p.BatchSize = *config.BatchSize
+			}
+			if config.MaxRetries != nil {
+				if *config.MaxRetries < 0 {
+					return nil, fmt.Errorf("WebhookPublisher `max_retries` must not be negative")
+				}
+				p.MaxRetries = *config.MaxRetries
+			}
+			if config.RetryDelay != "" {
+				p.RetryDelay, err = time.ParseDuration(config.RetryDelay)
+				if err != nil {
+					return nil, fmt.Errorf("WebhookPublisher invalid `retry_delay`: %v", err)
+				}
+				if p.RetryDelay <= 0 {
+					return nil, fmt.Errorf("WebhookPublisher `retry_delay` must be positive")
+				}
+			}
+			if config.SigningSecret != "" {
+				if config.SignatureAlgorithm == "" {
+					config.SignatureAlgorithm = "sha256"
+				}
+				p.Signer, err = collector.NewPayloadSigner([]byte(config.SigningSecret), config.SignatureAlgorithm)
+				if err != nil {
+					return nil, fmt.Errorf("WebhookPublisher invalid `signature_algorithm`: %s", config.SignatureAlgorithm)
+				}
+				if config.SignatureHeader != "" {
+					p.Signer.Header = config.SignatureHeader
+				}
+			} else if config.SignatureHeader != "" || config.SignatureAlgorithm != "" {
+				return nil, fmt.Errorf("WebhookPublisher missing `signing_secret`")
+			}
+			p.FieldNames = fieldNames
+			return p, nil
+		})
+}
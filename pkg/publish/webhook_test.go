@@ -0,0 +1,291 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nel-collector/pkg/collector"
+	"github.com/google/nel-collector/pkg/core"
+	"github.com/google/nel-collector/pkg/pipelinetest"
+	"github.com/google/nel-collector/pkg/publish"
+)
+
+// webhookServer records the body of each request, after failing the first
+// `failures` of them with a 503.
+type webhookServer struct {
+	mu       sync.Mutex
+	failures int
+	requests []string
+	headers  []http.Header
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	s.requests = append(s.requests, r.Method+" "+string(body))
+	s.headers = append(s.headers, r.Header)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func webhookBatch() *collector.ReportBatch {
+	batch := &collector.ReportBatch{
+		Time:     time.Date(2024, 1, 2, 15, 30, 0, 0, time.UTC),
+		ClientIP: "192.0.2.1",
+		Reports: []collector.NelReport{
+			{Age: 500, ReportType: "network-error", URL: "https://a/", Phase: "connection", Type: "tcp.timed_out"},
+			{ReportType: "network-error", URL: "https://b/", Phase: "application", Type: "ok", StatusCode: 200},
+			{ReportType: "network-error", URL: "https://c/", Phase: "dns", Type: "dns.name_not_resolved"},
+		},
+	}
+	batch.Reports[0].SetAnnotation("Service", "web")
+	return batch
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	server := &webhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tmpl, err := publish.ParseWebhookTemplate(`{"text": {{json (printf "%s: %s" .Report.URL .Report.Type)}}, "time": "{{.Report.EventTime.Format "15:04:05.000"}}", "service": {{json (index .Report.Annotations "Service")}}, "client": {{json .Batch.ClientIP}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := publish.NewWebhookPublisher(ts.URL, tmpl)
+	p.Method = "PUT"
+	p.Headers = map[string]string{"Authorization": "Bearer hunter2"}
+	p.Where, err = core.NewWhere(`type != "ok"`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`PUT {"text": "https://a/: tcp.timed_out", "time": "15:29:59.500", "service": "web", "client": "192.0.2.1"}`,
+		`PUT {"text": "https://c/: dns.name_not_resolved", "time": "15:30:00.000", "service": null, "client": "192.0.2.1"}`,
+	}
+	if diff := cmp.Diff(want, server.requests); diff != "" {
+		t.Errorf("WebhookPublisher requests diff (-want +got):\n%s", diff)
+	}
+	for _, header := range server.headers {
+		if got, want := header.Get("Authorization"), "Bearer hunter2"; got != want {
+			t.Errorf("WebhookPublisher sent Authorization %q, wanted %q", got, want)
+		}
+		if got, want := header.Get("Content-Type"), "application/json"; got != want {
+			t.Errorf("WebhookPublisher sent Content-Type %q, wanted %q", got, want)
+		}
+	}
+}
+
+func TestWebhookPublisherBatchSize(t *testing.T) {
+	server := &webhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	p := publish.NewWebhookPublisher(ts.URL, nil)
+	p.BatchSize = 2
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err != nil {
+		t.Fatal(err)
+	}
+	var urls [][]string
+	for _, request := range server.requests {
+		var records []struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(request, "POST ")), &records); err != nil {
+			t.Fatalf("WebhookPublisher sent invalid JSON %s: %v", request, err)
+		}
+		var batch []string
+		for _, record := range records {
+			batch = append(batch, record.URL)
+		}
+		urls = append(urls, batch)
+	}
+	want := [][]string{{"https://a/", "https://b/"}, {"https://c/"}}
+	if diff := cmp.Diff(want, urls); diff != "" {
+		t.Errorf("WebhookPublisher batches diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWebhookPublisherRetries(t *testing.T) {
+	server := &webhookServer{failures: 2}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	p := publish.NewWebhookPublisher(ts.URL, nil)
+	p.BatchSize = 3
+	p.RetryDelay = time.Millisecond
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err != nil {
+		t.Fatalf("WebhookPublisher failed after 2 retries: %v", err)
+	}
+	if got, want := len(server.requests), 1; got != want {
+		t.Errorf("WebhookPublisher sent %d requests, wanted %d", got, want)
+	}
+
+	server.failures = 2
+	p.MaxRetries = 1
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err == nil {
+		t.Errorf("WebhookPublisher should fail when it runs out of retries")
+	}
+
+	// Client errors aren't retried.
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	p.URL = rejecting.URL
+	p.RetryDelay = time.Hour
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err == nil {
+		t.Errorf("WebhookPublisher should fail on a 400")
+	}
+}
+
+func TestWebhookPublisherSignature(t *testing.T) {
+	signer, err := collector.NewPayloadSigner([]byte("secret"), "sha512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &webhookServer{}
+	ts := httptest.NewServer(collector.VerifySignature(server, signer, 1<<20))
+	defer ts.Close()
+
+	p := publish.NewWebhookPublisher(ts.URL, nil)
+	p.BatchSize = 3
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err == nil {
+		t.Errorf("WebhookPublisher should fail without a signature")
+	}
+
+	config := fmt.Sprintf("[[processor]]\ntype = \"WebhookPublisher\"\nurl = %q\nbatch_size = 3\nsigning_secret = \"secret\"\nsignature_algorithm = \"sha512\"", ts.URL)
+	var pipeline collector.Pipeline
+	if err := pipeline.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.ProcessBatch(context.Background(), webhookBatch())
+	if got, want := len(server.requests), 1; got != want {
+		t.Fatalf("WebhookPublisher sent %d signed requests, wanted %d", got, want)
+	}
+	body := strings.TrimPrefix(server.requests[0], "POST ")
+	if got := server.headers[0].Get(collector.DefaultSignatureHeader); !signer.Verify([]byte(body), got) {
+		t.Errorf("WebhookPublisher sent invalid signature %q", got)
+	}
+}
+
+// batchChannel is a processor that passes on each batch that it sees.
+type batchChannel chan *collector.ReportBatch
+
+func (c batchChannel) ProcessReports(ctx context.Context, batch *collector.ReportBatch) {
+	c <- batch
+}
+
+func TestWebhookPublisherForwarding(t *testing.T) {
+	signer, err := collector.NewPayloadSigner([]byte("secret"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &pipelinetest.SimulatedClock{CurrentTime: time.Date(2024, 1, 2, 15, 30, 2, 0, time.UTC)}
+	receiver := collector.NewTestPipelineWithConfig(clock, collector.PipelineConfig{
+		TrustedProxies: []string{"127.0.0.0/8", "::1/128"},
+	})
+	defer receiver.Close()
+	received := make(batchChannel, 1)
+	receiver.AddProcessor(received)
+	ts := httptest.NewServer(collector.VerifySignature(receiver, signer, 1<<20))
+	defer ts.Close()
+
+	config := fmt.Sprintf("[[processor]]\ntype = \"WebhookPublisher\"\nurl = %q\nbatch_size = 3\nformat = \"reports\"\nsigning_secret = \"secret\"", ts.URL)
+	sender := collector.NewTestPipeline(clock)
+	defer sender.Close()
+	if err := sender.LoadFromConfig(context.Background(), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	batch := webhookBatch()
+	batch.ClientUserAgent = "Mozilla/5.0"
+	batch.Reports[1].UserAgent = "Mozilla/5.0"
+	sender.ProcessBatch(context.Background(), batch)
+
+	var got *collector.ReportBatch
+	select {
+	case got = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Signed reports weren't forwarded to the receiving pipeline")
+	}
+	if got.ClientIP != "192.0.2.1" || got.ClientUserAgent != "Mozilla/5.0" {
+		t.Errorf("Forwarded batch came from %q (%q), wanted 192.0.2.1 (Mozilla/5.0)", got.ClientIP, got.ClientUserAgent)
+	}
+	if len(got.Reports) != 3 {
+		t.Fatalf("Forwarded batch has %d reports, wanted 3", len(got.Reports))
+	}
+	for i, report := range got.Reports {
+		want := webhookBatch().Reports[i]
+		if report.URL != want.URL || report.Type != want.Type || report.StatusCode != want.StatusCode {
+			t.Errorf("Forwarded report %d = %+v, wanted %+v", i, report, want)
+		}
+		if got, want := report.EventTime(got.Time), want.EventTime(batch.Time); !got.Equal(want) {
+			t.Errorf("Forwarded report %d happened at %v, wanted %v", i, got, want)
+		}
+	}
+	if got, want := got.Reports[1].UserAgent, "Mozilla/5.0"; got != want {
+		t.Errorf("Forwarded report has user agent %q, wanted %q", got, want)
+	}
+
+	// The default format isn't one that a collector accepts.
+	p := publish.NewWebhookPublisher(ts.URL, nil)
+	p.Signer = signer
+	p.MaxRetries = 0
+	if err := p.TryProcessReports(context.Background(), webhookBatch()); err == nil || !strings.Contains(err.Error(), "415") {
+		t.Errorf("Forwarding records should fail with a 415, got %v", err)
+	}
+}
+
+func TestWebhookPublisherBadConfig(t *testing.T) {
+	for _, config := range []string{
+		``,
+		`url = "ftp://example.com/"`,
+		"url = \"https://example.com/\"\nmethod = \"GET\"",
+		"url = \"https://example.com/\"\ntemplate = \"{{.Report\"",
+		"url = \"https://example.com/\"\ncondition = \"type ==\"",
+		"url = \"https://example.com/\"\nbatch_size = 0",
+		"url = \"https://example.com/\"\nmax_retries = -1",
+		"url = \"https://example.com/\"\nretry_delay = \"soon\"",
+		"url = \"https://example.com/\"\nretry_delay = \"-1s\"",
+		"url = \"https://example.com/\"\nsigning_secret = \"secret\"\nsignature_algorithm = \"md5\"",
+		"url = \"https://example.com/\"\nsignature_header = \"X-Signature\"",
+		"url = \"https://example.com/\"\nformat = \"csv\"",
+		"url = \"https://example.com/\"\nformat = \"reports\"\ntemplate = \"{{json .Reports}}\"",
+	} {
+		var pipeline collector.Pipeline
+		if err := pipeline.LoadFromConfig(context.Background(), []byte("[[processor]]\ntype = \"WebhookPublisher\"\n"+config)); err == nil {
+			t.Errorf("LoadFromConfig(%s) should return error", config)
+		}
+	}
+}